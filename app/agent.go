@@ -0,0 +1,222 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var errAgentStopped = errors.New("agent is stopped")
+
+// AgentConfig carries everything needed to set up an update agent that is
+// embedded in another program.
+type AgentConfig struct {
+	// agent configuration, normally obtained with LoadConfig()
+	Config MenderConfig
+	// location of device keys, state data and deployment logs
+	DataStore string
+	// generate new device keys even if there are some already
+	ForceBootstrap bool
+	// identity data of the device; the identity script is run if not set
+	Identity IdentitySource
+}
+
+// MenderAgent is the update agent façade. It wires together the device,
+// data store, authorization manager and state machine exactly like the mender
+// daemon does, so that other Go daemons can run the agent in-process instead
+// of executing the mender binary.
+type MenderAgent struct {
+	daemon    *menderDaemon
+	mender    *mender
+	dataStore string
+	// deployment logs of this agent only
+	logManager *DeploymentLogManager
+}
+
+// NewMenderAgent sets up an update agent operating on the real device
+// (bootloader environment and rootfs partitions from the configuration).
+func NewMenderAgent(config AgentConfig) (*MenderAgent, error) {
+	env, err := NewBootEnv(config.Config)
+	if err != nil {
+		return nil, err
+	}
+	dev := NewDevice(env, new(osCalls), config.Config.GetDeviceConfig())
+	return newMenderAgent(config, dev)
+}
+
+func newMenderAgent(config AgentConfig, dev UInstallCommitRebooter) (*MenderAgent, error) {
+	if config.DataStore == "" {
+		config.DataStore = defaultDataStore
+	}
+	if config.Config.DeviceKey == "" {
+		config.Config.DeviceKey = defaultKeyFile
+	}
+
+	// refuse to run with broken rules rather than leak data to the logs
+	redactor, err := newLogRedactor(config.Config.LogRedactPatterns,
+		config.Config.LogRedactKeys)
+	if err != nil {
+		return nil, err
+	}
+	startLogRing(config.Config, config.DataStore, redactor)
+
+	mp, err := commonInit(&config.Config, config.DataStore,
+		newIdentityGetter(config.Identity))
+	if err != nil {
+		return nil, err
+	}
+	mp.device = dev
+
+	controller, err := NewMender(config.Config, *mp)
+	if controller == nil {
+		mp.store.Close()
+		return nil, errors.Wrap(err, "error initializing mender controller")
+	}
+
+	if config.ForceBootstrap {
+		controller.ForceBootstrap()
+	}
+
+	// every agent keeps the logs of its deployments to itself; the hook
+	// writes nothing unless the deployment logs of the agent are enabled
+	logManager := NewDeploymentLogManager(config.DataStore)
+	controller.logManager = logManager
+	hook := NewDeploymentLogHook(logManager)
+	hook.redactor = redactor
+	hook.events = controller.events
+	addLogHook(hook)
+
+	daemon := NewDaemon(controller, mp.store)
+	daemon.readiness = newReadinessGate(config.Config)
+	daemon.sctx.logManager = logManager
+	daemon.events = controller.events
+
+	return &MenderAgent{
+		daemon:     daemon,
+		mender:     controller,
+		dataStore:  config.DataStore,
+		logManager: logManager,
+	}, nil
+}
+
+// Run executes the update state machine until it finishes, a fatal error
+// occurs or Stop() is called. The data store is closed once Run() returns.
+// ErrRebootRequired is returned if reboot is left to the supervisor
+// ("exit" reboot mode); the update is finished once Run() is called after the
+// reboot.
+func (a *MenderAgent) Run() error {
+	defer a.daemon.Cleanup()
+	// the hook of a stopped agent must not write anything
+	defer a.logManager.Disable()
+	return a.daemon.Run()
+}
+
+// SetUpdateChannel selects the update channel (e.g. stable, beta, canary)
+// reported to the server with update checks and inventory. Empty channel clears
+// the selection. Takes effect with the next server request.
+func (a *MenderAgent) SetUpdateChannel(channel string) error {
+	if a.daemon.store == nil {
+		return errAgentStopped
+	}
+	return storeUpdateChannel(a.daemon.store, channel)
+}
+
+// UpdateChannel returns currently selected update channel, or empty string if
+// none was selected.
+func (a *MenderAgent) UpdateChannel() (string, error) {
+	if a.daemon.store == nil {
+		return "", errAgentStopped
+	}
+	return loadUpdateChannel(a.daemon.store)
+}
+
+// AddUpdatePolicy registers a local policy that can defer installing updates.
+// Deferred updates are reported to the server together with the time they
+// are deferred until. Must be called before Run().
+func (a *MenderAgent) AddUpdatePolicy(p UpdatePolicy) {
+	a.mender.AddUpdatePolicy(p)
+}
+
+// AddMetricsExporter registers an exporter update metrics are sent to, along
+// with the statsd and OTLP ones configured. Must be called before Run().
+func (a *MenderAgent) AddMetricsExporter(e MetricsExporter) {
+	a.mender.AddMetricsExporter(e)
+}
+
+// AddInventorySource registers a source of inventory attributes, called
+// each time the inventory is submitted, so that the program embedding the
+// agent does not need inventory scripts; attributes of sources override the
+// ones of scripts. Must be called before Run().
+func (a *MenderAgent) AddInventorySource(src InventorySource) {
+	a.mender.AddInventorySource(src)
+}
+
+// HoldCommit delays committing a freshly installed update, e.g. while the
+// application migrates its data to the new artifact. The update is committed
+// once all holders call ReleaseCommit(); if the hold lasts longer than
+// configured, the agent commits or rolls back the update on its own and
+// reports that it made the decision. Holds placed before Run() apply to the
+// update being verified after boot. Holds are kept across restarts of the
+// agent; applications not linking it hold the commit by creating a file
+// named after themselves in the commit_holds directory of the state
+// directory, and release it by removing the file.
+func (a *MenderAgent) HoldCommit(holder, reason string) {
+	a.mender.HoldCommit(holder, reason)
+}
+
+// ReleaseCommit releases the hold placed with HoldCommit().
+func (a *MenderAgent) ReleaseCommit(holder string) {
+	a.mender.ReleaseCommit(holder)
+}
+
+// StateMetrics returns time spent in each state of the client, in total and
+// during the last deployment, e.g. for tracking how long downloading and
+// installing updates takes across the fleet.
+func (a *MenderAgent) StateMetrics() StateMetrics {
+	return a.mender.stateTimes.metrics(time.Now())
+}
+
+// Diagnose answers one of the read-only diagnostic queries (DiagnosticBootEnv,
+// DiagnosticDiskUsage, ...), printing the answer to out as text or JSON
+// ("text" or "json" format), for support tooling gathering facts about the
+// device. Can be called while the agent runs.
+func (a *MenderAgent) Diagnose(query, format string, out io.Writer) error {
+	out, err := newCLIOutput(out, format)
+	if err != nil {
+		return err
+	}
+	return a.mender.diagnose(query, a.dataStore, out)
+}
+
+// SetDeviceTags assigns the device to the group, unless empty, and sets the
+// tags of the device on the server, for provisioning code placing the device
+// in groups deployments are targeted at. The server must support
+// device-initiated tagging; the agent must be authorized already.
+func (a *MenderAgent) SetDeviceTags(ctx context.Context, group string,
+	tags map[string]string) error {
+	if merr := a.mender.SetDeviceTags(ctx, group, tags); merr != nil {
+		return merr.Cause()
+	}
+	return nil
+}
+
+// Stop requests the agent to stop. Any wait, server request or install in
+// progress is interrupted and Run() returns shortly after.
+func (a *MenderAgent) Stop() {
+	a.daemon.StopDaemon()
+}
@@ -0,0 +1,175 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/app/testutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMenderAgent(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	agent, err := newMenderAgent(AgentConfig{
+		Config: MenderConfig{
+			ServerURL: "https://localhost",
+		},
+		DataStore: tdir,
+	}, &testutils.FakeDevice{})
+	assert.NoError(t, err)
+	assert.NotNil(t, agent)
+
+	assert.NoError(t, agent.SetUpdateChannel("beta"))
+	ch, err := agent.UpdateChannel()
+	assert.NoError(t, err)
+	assert.Equal(t, "beta", ch)
+
+	// stopped agent runs the init state only
+	agent.Stop()
+	assert.NoError(t, agent.Run())
+
+	// init state bootstraps the device, key should be there now
+	ds := NewDirStore(tdir)
+	key, err := ds.ReadAll(defaultKeyFile)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, key)
+
+	// the data store was closed when the agent stopped
+	assert.Nil(t, agent.daemon.store)
+	assert.Error(t, agent.SetUpdateChannel("stable"))
+
+	// channel selection is persistent
+	db := NewDBStore(tdir)
+	ch, err = loadUpdateChannel(db)
+	db.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "beta", ch)
+}
+
+func TestMenderAgentInvalidRedaction(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	agent, err := newMenderAgent(AgentConfig{
+		Config: MenderConfig{
+			ServerURL:         "https://localhost",
+			LogRedactPatterns: []string{"token=[a-z"},
+		},
+		DataStore: tdir,
+	}, &testutils.FakeDevice{})
+	assert.Error(t, err)
+	assert.Nil(t, agent)
+}
+
+func newTestAgents(t *testing.T, n int) []*MenderAgent {
+	var agents []*MenderAgent
+	for i := 0; i < n; i++ {
+		tdir, err := ioutil.TempDir("", "mendertest")
+		assert.NoError(t, err)
+
+		agent, err := newMenderAgent(AgentConfig{
+			Config: MenderConfig{
+				ServerURL: "https://localhost",
+			},
+			DataStore: tdir,
+		}, &testutils.FakeDevice{})
+		assert.NoError(t, err)
+		agents = append(agents, agent)
+	}
+	return agents
+}
+
+func TestMenderAgentDeploymentLogs(t *testing.T) {
+	agents := newTestAgents(t, 2)
+	for _, agent := range agents {
+		defer os.RemoveAll(agent.dataStore)
+	}
+
+	// agents do not share their deployment logs
+	first, second := agents[0], agents[1]
+	assert.NotEqual(t, first.logManager, second.logManager)
+	assert.Equal(t, first.logManager, first.daemon.sctx.deploymentLogger())
+	assert.Equal(t, first.logManager, first.mender.logManager)
+
+	// logs of a deployment of one agent do not end up with the other
+	assert.NoError(t, first.logManager.Enable("deployment-1"))
+	log.Info("installing deployment-1")
+	assert.NoError(t, first.logManager.Disable())
+
+	logs, err := first.logManager.GetLogs("deployment-1")
+	assert.NoError(t, err)
+	assert.Contains(t, string(logs), "installing deployment-1")
+	logs, err = second.logManager.GetLogs("deployment-1")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(logs), "installing deployment-1")
+
+	for _, agent := range agents {
+		agent.Stop()
+		assert.NoError(t, agent.Run())
+		assert.False(t, agent.logManager.loggingEnabled)
+	}
+}
+
+func TestMenderAgentsSideBySide(t *testing.T) {
+	agents := newTestAgents(t, 2)
+	for _, agent := range agents {
+		defer os.RemoveAll(agent.dataStore)
+	}
+	first, second := agents[0], agents[1]
+
+	// each agent stamps its reports and logs with a sequence of its own
+	assert.False(t, first.mender.events == second.mender.events)
+	assert.True(t, first.daemon.events == first.mender.events)
+	seq := second.mender.events.stamp().Seq
+	for i := 0; i < 3; i++ {
+		first.mender.events.stamp()
+	}
+	assert.Equal(t, seq+1, second.mender.events.stamp().Seq)
+
+	var done []chan error
+	for _, agent := range agents {
+		ch := make(chan error, 1)
+		go func(agent *MenderAgent) {
+			ch <- agent.Run()
+		}(agent)
+		done = append(done, ch)
+	}
+
+	// stopping one agent leaves the other running
+	first.Stop()
+	assert.NoError(t, <-done[0])
+	select {
+	case err := <-done[1]:
+		t.Fatalf("agent stopped along with the other one: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	second.Stop()
+	assert.NoError(t, <-done[1])
+
+	// both agents bootstrapped in their own data store
+	for _, agent := range agents {
+		key, err := NewDirStore(agent.dataStore).ReadAll(defaultKeyFile)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, key)
+	}
+}
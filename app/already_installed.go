@@ -0,0 +1,146 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/pkg/errors"
+)
+
+// How deployment of the artifact running already is recognized: by its
+// name, and payload digests recorded when it was installed if there are any,
+// or by payload digests only, which are compared with the active root
+// filesystem on disk if none were recorded.
+const (
+	alreadyInstalledCheckName   = "name"
+	alreadyInstalledCheckDigest = "digest"
+)
+
+// Deployment metadata field the server sets to have the artifact installed
+// even if it is installed already.
+const deploymentForceField = "force"
+
+// Root filesystem images are a whole number of blocks of this size; the
+// digest of the image is looked for at every block boundary of the active
+// root filesystem, as the size of the image is not known before download.
+const rootfsDigestBlockSize = 1024
+
+func validateAlreadyInstalledCheck(check string) error {
+	switch check {
+	case "", alreadyInstalledCheckName, alreadyInstalledCheckDigest:
+		return nil
+	}
+	return errors.Errorf("invalid already installed check %q, expected one of %q, %q",
+		check, alreadyInstalledCheckName, alreadyInstalledCheckDigest)
+}
+
+func deploymentForced(update client.UpdateResponse) bool {
+	switch v := update.DeploymentMetadata[deploymentForceField].(type) {
+	case bool:
+		return v
+	case string:
+		return strings.EqualFold(v, "true")
+	}
+	return false
+}
+
+// Artifact of the deployment is installed again, even though it runs already,
+// because the server asks for it and the device is configured to obey.
+func (m *mender) forceReinstall(update client.UpdateResponse) bool {
+	return m.config.ReinstallForcedDeployments && deploymentForced(update)
+}
+
+// Whether artifact with the same name as the running one is checked by
+// payload digests only.
+func (m *mender) checkInstalledDigests() bool {
+	return m.config.AlreadyInstalledCheck == alreadyInstalledCheckDigest
+}
+
+// Implemented by devices able to read the root filesystem they run.
+type activeRootfsReader interface {
+	OpenActiveRootfs() (io.ReadCloser, error)
+}
+
+func (d *device) OpenActiveRootfs() (io.ReadCloser, error) {
+	if d.rootfsFiles != nil {
+		active, err := d.rootfsFiles.active()
+		if err != nil {
+			return nil, err
+		}
+		return os.Open(d.rootfsFiles.path(active))
+	}
+	active, err := d.GetActive()
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(active)
+}
+
+// Tells if the active root filesystem is the payload of the artifact with
+// given payload digests; root filesystem artifacts have a single payload.
+func (m *mender) activeRootfsMatches(digests map[string]string) bool {
+	dev, ok := m.UInstallCommitRebooter.(activeRootfsReader)
+	if !ok || len(digests) != 1 {
+		return false
+	}
+	var digest string
+	for _, d := range digests {
+		digest = d
+	}
+
+	r, err := dev.OpenActiveRootfs()
+	if err != nil {
+		log.Warnf("failed to open active root filesystem: %v", err)
+		return false
+	}
+	defer r.Close()
+
+	log.Info("comparing active root filesystem with artifact payload")
+	match, err := hasDigestPrefix(r, digest)
+	if err != nil {
+		log.Warnf("failed to compute digest of active root filesystem: %v", err)
+		return false
+	}
+	return match
+}
+
+// Tells if leading whole blocks of r have the digest.
+func hasDigestPrefix(r io.Reader, digest string) (bool, error) {
+	h, want, err := installer.NewDigestHash(digest)
+	if err != nil {
+		return false, err
+	}
+	buf := make([]byte, rootfsDigestBlockSize)
+	sum := make([]byte, hex.EncodedLen(h.Size()))
+	for {
+		if _, err := io.ReadFull(r, buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		h.Write(buf)
+		hex.Encode(sum, h.Sum(nil))
+		if bytes.EqualFold(sum, want) {
+			return true, nil
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender-artifact/parser"
+	atutils "github.com/mendersoftware/mender-artifact/test_utils"
+	awriter "github.com/mendersoftware/mender-artifact/writer"
+	"github.com/mendersoftware/mender/app/testutils"
+	"github.com/mendersoftware/mender/client"
+	cltest "github.com/mendersoftware/mender/client/test"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeploymentForced(t *testing.T) {
+	update := client.UpdateResponse{}
+	assert.False(t, deploymentForced(update))
+
+	update.DeploymentMetadata = map[string]interface{}{"force": true}
+	assert.True(t, deploymentForced(update))
+	update.DeploymentMetadata = map[string]interface{}{"force": "TRUE"}
+	assert.True(t, deploymentForced(update))
+	update.DeploymentMetadata = map[string]interface{}{"force": false}
+	assert.False(t, deploymentForced(update))
+
+	m := newTestMender(nil, MenderConfig{}, testMenderPieces{})
+	update.DeploymentMetadata = map[string]interface{}{"force": true}
+	assert.False(t, m.forceReinstall(update))
+	m.config.ReinstallForcedDeployments = true
+	assert.True(t, m.forceReinstall(update))
+
+	assert.NoError(t, validateAlreadyInstalledCheck(""))
+	assert.NoError(t, validateAlreadyInstalledCheck(alreadyInstalledCheckDigest))
+	assert.Error(t, validateAlreadyInstalledCheck("checksum"))
+}
+
+func TestHasDigestPrefix(t *testing.T) {
+	image := bytes.Repeat([]byte("x"), 2*rootfsDigestBlockSize)
+	sum := sha256.Sum256(image)
+	digest := hex.EncodeToString(sum[:])
+
+	// image followed by the rest of the partition
+	disk := append(append([]byte{}, image...), bytes.Repeat([]byte("y"), 3000)...)
+	match, err := hasDigestPrefix(bytes.NewReader(disk), digest)
+	assert.NoError(t, err)
+	assert.True(t, match)
+
+	match, err = hasDigestPrefix(bytes.NewReader(disk[1:]), digest)
+	assert.NoError(t, err)
+	assert.False(t, match)
+
+	_, err = hasDigestPrefix(bytes.NewReader(disk), "md5:00")
+	assert.Error(t, err)
+}
+
+// Device running root filesystem with given content.
+type rootfsReaderDevice struct {
+	testutils.FakeDevice
+	rootfs []byte
+}
+
+func (d *rootfsReaderDevice) OpenActiveRootfs() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(d.rootfs)), nil
+}
+
+func TestMenderAlreadyInstalledDigest(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-installed-")
+	defer os.RemoveAll(td)
+
+	image := bytes.Repeat([]byte("rootfs"), 1024)[:4*rootfsDigestBlockSize]
+	entries := append([]atutils.TestDirEntry{}, atutils.RootfsImageStructOK...)
+	for i := range entries {
+		if entries[i].Path == "0000/data/update.ext4" {
+			entries[i].Content = image
+		}
+	}
+	root := path.Join(td, "update-root")
+	assert.NoError(t, atutils.MakeFakeUpdateDir(root, entries))
+	aw := awriter.NewWriter("mender", 1, []string{"vexpress-qemu"}, "mender-1.1")
+	aw.Register(&parser.RootfsParser{})
+	upath := path.Join(td, "update.mender")
+	assert.NoError(t, aw.Write(root, upath))
+	art, err := ioutil.ReadFile(upath)
+	assert.NoError(t, err)
+
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=vexpress-qemu\n"), 0644)
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=mender-1.1\n"), 0644)
+
+	update := client.UpdateResponse{ID: "foo"}
+	update.Artifact.ArtifactName = "mender-1.1"
+
+	dev := &rootfsReaderDevice{rootfs: append(append([]byte{}, image...), 0, 0, 0)}
+	mender := newTestMender(nil, MenderConfig{
+		AlreadyInstalledCheck: alreadyInstalledCheckDigest,
+	}, testMenderPieces{
+		MenderPieces: MenderPieces{
+			store:  utils.NewMemStore(),
+			device: dev,
+		},
+	})
+	mender.deviceTypeFile = deviceType
+	mender.artifactInfoFile = artifactInfo
+	verify := func() menderError {
+		mender.updater = testutils.FakeUpdater{
+			FetchUpdateHeaderReturnReadCloser: ioutil.NopCloser(bytes.NewReader(art)),
+		}
+		return mender.VerifyUpdateHeader(context.Background(), update)
+	}
+
+	// no payloads recorded; the running root filesystem is the payload
+	merr := verify()
+	assert.NotNil(t, merr)
+	assert.Equal(t, os.ErrExist, merr.Cause())
+
+	// hotfix redeployed under the same name
+	dev.rootfs[0] = 'R'
+	assert.Nil(t, verify())
+
+	// header can not be read; not skipped by name alone
+	mender.updater = testutils.FakeUpdater{
+		FetchUpdateHeaderReturnReadCloser: ioutil.NopCloser(bytes.NewReader(art[:10])),
+	}
+	assert.Nil(t, mender.VerifyUpdateHeader(context.Background(), update))
+
+	// forced deployment is installed even if it is the same
+	dev.rootfs[0] = image[0]
+	mender.config.ReinstallForcedDeployments = true
+	update.DeploymentMetadata = map[string]interface{}{"force": true}
+	assert.Nil(t, verify())
+}
+
+func TestCheckUpdateForcedReinstall(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-installed-")
+	defer os.RemoveAll(td)
+
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=fake-id\n"), 0600)
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=hammer\n"), 0600)
+
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+	srv.Update.Has = true
+	srv.Update.Current = client.CurrentUpdate{
+		Artifact:   "fake-id",
+		DeviceType: "hammer",
+	}
+	srv.Update.Data.Artifact.ArtifactName = "fake-id"
+	srv.Update.Data.DeploymentMetadata = map[string]interface{}{"force": true}
+
+	mender := newTestMender(nil, MenderConfig{ServerURL: srv.URL}, testMenderPieces{})
+	mender.artifactInfoFile = artifactInfo
+	mender.deviceTypeFile = deviceType
+
+	_, err := mender.CheckUpdate(context.Background())
+	assert.Equal(t, NewTransientError(os.ErrExist), err)
+
+	mender.config.ReinstallForcedDeployments = true
+	up, err := mender.CheckUpdate(context.Background())
+	assert.NoError(t, err)
+	assert.NotNil(t, up)
+
+	// same name is not enough when checking digests
+	mender.config.ReinstallForcedDeployments = false
+	mender.config.AlreadyInstalledCheck = alreadyInstalledCheckDigest
+	up, err = mender.CheckUpdate(context.Background())
+	assert.NoError(t, err)
+	assert.NotNil(t, up)
+}
@@ -0,0 +1,394 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	appSlotA = "a"
+	appSlotB = "b"
+	// symlink pointing to the slot applications are run from
+	appSlotCurrent = "current"
+	// present while update of application slot is not committed; holds
+	// the slot to go back to on rollback
+	appSlotPending = "pending"
+	// slot active before the last committed update
+	appSlotPrevious = "previous"
+)
+
+var ErrAppSlotsNotConfigured = errors.New("application slots not configured")
+
+// A/B slots of application directory on the data partition, updated
+// independently of the root filesystem. Applications are run from the
+// `current` link; switching it is atomic, so that application-only updates
+// become active, and are rolled back, without rebooting the device.
+//
+//	<dir>/a, <dir>/b            application slots
+//	<dir>/a.artifact_info, ...  name of the artifact installed in the slot
+//	<dir>/current -> a          active slot
+//	<dir>/pending               previous slot, until the update is committed
+//	<dir>/previous              previous slot, once the update is committed
+type appSlots struct {
+	dir string
+}
+
+func newAppSlots(dir string) *appSlots {
+	if dir == "" {
+		return nil
+	}
+	return &appSlots{dir: dir}
+}
+
+// Returns active slot; empty if no application was installed yet.
+func (a *appSlots) active() (string, error) {
+	slot, err := os.Readlink(filepath.Join(a.dir, appSlotCurrent))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Wrapf(err, "failed to read active application slot")
+	}
+	return slot, nil
+}
+
+func (a *appSlots) inactive() (string, error) {
+	active, err := a.active()
+	if err != nil {
+		return "", err
+	}
+	if active == appSlotA {
+		return appSlotB, nil
+	}
+	return appSlotA, nil
+}
+
+func (a *appSlots) artifactInfoFile(slot string) string {
+	return filepath.Join(a.dir, slot+".artifact_info")
+}
+
+// Name of the artifact installed in the active slot.
+func (a *appSlots) artifactName() string {
+	active, err := a.active()
+	if err != nil || active == "" {
+		return ""
+	}
+	return getManifestData("artifact_name", a.artifactInfoFile(active))
+}
+
+// Unpack application tarball into the inactive slot, replacing whatever was
+// there.
+func (a *appSlots) install(artifactName string, r io.Reader) error {
+	slot, err := a.inactive()
+	if err != nil {
+		return err
+	}
+	if a.pending() {
+		return errors.New("update of application slot not committed yet")
+	}
+	dir := filepath.Join(a.dir, slot)
+	log.Infof("installing application artifact %s into slot %s", artifactName, dir)
+
+	os.Remove(filepath.Join(a.dir, appSlotPrevious))
+	// artifact info is written last; missing one tells the install did
+	// not finish
+	os.Remove(a.artifactInfoFile(slot))
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.Wrapf(err, "failed to clean application slot %s", slot)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create application slot %s", slot)
+	}
+	if err := untar(r, dir); err != nil {
+		return errors.Wrapf(err, "failed to unpack application into slot %s", slot)
+	}
+	if err := ioutil.WriteFile(a.artifactInfoFile(slot),
+		[]byte(fmt.Sprintf("artifact_name=%s\n", artifactName)), 0644); err != nil {
+		return errors.Wrapf(err, "failed to save application artifact name")
+	}
+	syncFilesystems()
+	return nil
+}
+
+// Switch applications to the inactive slot, remembering the active one for
+// rollback.
+func (a *appSlots) enable() error {
+	active, err := a.active()
+	if err != nil {
+		return err
+	}
+	slot, err := a.inactive()
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(a.dir, appSlotPending),
+		[]byte(active), 0644); err != nil {
+		return errors.Wrapf(err, "failed to mark application update pending")
+	}
+	syncFilesystems()
+
+	log.Infof("switching applications to slot %s", slot)
+	return a.switchTo(slot)
+}
+
+func (a *appSlots) switchTo(slot string) error {
+	current := filepath.Join(a.dir, appSlotCurrent)
+	if slot == "" {
+		if err := os.Remove(current); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "failed to remove active application slot")
+		}
+		syncFilesystems()
+		return nil
+	}
+
+	tmp := current + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(slot, tmp); err != nil {
+		return errors.Wrapf(err, "failed to switch application slot")
+	}
+	if err := os.Rename(tmp, current); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "failed to switch application slot")
+	}
+	syncFilesystems()
+	return nil
+}
+
+func (a *appSlots) pending() bool {
+	_, err := os.Stat(filepath.Join(a.dir, appSlotPending))
+	return err == nil
+}
+
+func (a *appSlots) commit() error {
+	log.Info("committing application update")
+	if err := os.Rename(filepath.Join(a.dir, appSlotPending),
+		filepath.Join(a.dir, appSlotPrevious)); err != nil {
+		return errors.Wrapf(err, "failed to commit application update")
+	}
+	syncFilesystems()
+	return nil
+}
+
+// Switch applications back to the slot that was active before the update,
+// whether the update was committed already or not.
+func (a *appSlots) rollback() error {
+	pending := filepath.Join(a.dir, appSlotPending)
+	previous, err := ioutil.ReadFile(pending)
+	if os.IsNotExist(err) {
+		pending = filepath.Join(a.dir, appSlotPrevious)
+		previous, err = ioutil.ReadFile(pending)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "no application update to roll back")
+	}
+
+	log.Infof("rolling back applications to slot %q", string(previous))
+	if err := a.switchTo(string(previous)); err != nil {
+		return err
+	}
+	if err := os.Remove(pending); err != nil {
+		return errors.Wrapf(err, "failed to finish application rollback")
+	}
+	syncFilesystems()
+	return nil
+}
+
+// Unpack tar archive into dir; entries must not point outside of it, nor
+// be written through symlinks pointing outside of it.
+func untar(r io.Reader, dir string) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		name, err := untarPath(root, hdr)
+		if err != nil {
+			return err
+		} else if name == "" {
+			continue
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(name, mode)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeFileFrom(name, tr, mode)
+		case tar.TypeSymlink:
+			err = symlinkInDir(root, hdr.Linkname, name)
+		default:
+			log.Warnf("skipping unsupported archive entry %s", hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// symlinks may have been redirected by entries unpacked after them
+	return checkSymlinks(root)
+}
+
+// Path the archive entry is to be unpacked to, or "" for the root directory
+// itself.
+func untarPath(root string, hdr *tar.Header) (string, error) {
+	name := filepath.Join(root, hdr.Name)
+	if name == root && hdr.Typeflag == tar.TypeDir {
+		return "", nil
+	}
+	if name == root || !inDir(root, name) {
+		return "", errors.Errorf("invalid path %q in archive", hdr.Name)
+	}
+	// entry is created in the directory it resolves to, which may have been
+	// created through symlinks in the archive
+	parent, err := resolveInDir(root, filepath.Dir(name))
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid path %q in archive", hdr.Name)
+	}
+	return filepath.Join(parent, filepath.Base(name)), nil
+}
+
+func checkSymlinks(root string) error {
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return err
+		}
+		if _, err := resolveInDir(root, p); err != nil {
+			return errors.Wrapf(err, "invalid symlink %q in archive", p)
+		}
+		return nil
+	})
+}
+
+// Whether `name` is `dir` or within it.
+func inDir(dir, name string) bool {
+	return name == dir || strings.HasPrefix(name, dir+string(filepath.Separator))
+}
+
+// resolveInDir returns the path `name` resolves to, following symlinks, and
+// fails if it is not within `root`; parts of the path not existing yet are
+// taken as they are.
+func resolveInDir(root, name string) (string, error) {
+	var rest []string
+	for p := name; ; p = filepath.Dir(p) {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			resolved = filepath.Join(append([]string{resolved}, rest...)...)
+			if !inDir(root, resolved) {
+				return "", errors.Errorf("%s resolves outside of %s", name, root)
+			}
+			return resolved, nil
+		}
+		if !os.IsNotExist(err) || p == root {
+			return "", err
+		}
+		if target, lerr := os.Readlink(p); lerr == nil {
+			// dangling symlink
+			if filepath.IsAbs(target) {
+				return "", errors.Errorf("%s points to absolute path %s", p, target)
+			}
+			return resolveInDir(root, filepath.Join(append(
+				[]string{filepath.Dir(p), target}, rest...)...))
+		}
+		rest = append([]string{filepath.Base(p)}, rest...)
+	}
+}
+
+// Create symlink `name` to `target`, which must be relative and must not
+// point outside of `root`.
+func symlinkInDir(root, target, name string) error {
+	if filepath.IsAbs(target) {
+		return errors.Errorf("symlink %s points to absolute path %s", name, target)
+	}
+	if _, err := resolveInDir(root, filepath.Join(filepath.Dir(name), target)); err != nil {
+		return errors.Wrapf(err, "invalid symlink %s", name)
+	}
+	return os.Symlink(target, name)
+}
+
+func writeFileFrom(name string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	// never write through symlink
+	f, err := os.OpenFile(name,
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// InstallApp unpacks application-only update into the inactive application
+// slot; the following EnableUpdatedPartition() switches applications over
+// instead of the root filesystem.
+func (d *device) InstallApp(artifactName string, r io.Reader, size int64) error {
+	if d.apps == nil {
+		return ErrAppSlotsNotConfigured
+	}
+	log.Debugf("installing application update of size: %d", size)
+	d.appUpdate = true
+	d.bundleUpdate = false
+	return d.apps.install(artifactName, r)
+}
+
+// Whether the update in progress is application-only, or application slots
+// were switched and the update is waiting for commit or rollback.
+func (d *device) AppUpdatePending() bool {
+	return d.apps != nil && (d.appUpdate || d.apps.pending())
+}
+
+func (d *device) AppArtifactName() string {
+	if d.apps == nil {
+		return ""
+	}
+	return d.apps.artifactName()
+}
+
+// Device with application slots.
+type appSlotDevice interface {
+	AppUpdatePending() bool
+	AppArtifactName() string
+}
+
+// Whether the enabled update takes effect only after rebooting the device;
+// application-only updates are active right away.
+func (m *mender) RebootRequired() bool {
+	if dev, ok := m.UInstallCommitRebooter.(appSlotDevice); ok {
+		return !dev.AppUpdatePending()
+	}
+	return true
+}
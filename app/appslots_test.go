@@ -0,0 +1,228 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeAppTar(t *testing.T, files map[string]string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for name, content := range files {
+		assert.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+		}))
+		tw.Write([]byte(content))
+	}
+	assert.NoError(t, tw.Close())
+	return buf
+}
+
+func readAppFile(t *testing.T, dir, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, appSlotCurrent, name))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func TestAppSlots(t *testing.T) {
+	oldSync := syncFilesystems
+	syncFilesystems = func() {}
+	defer func() { syncFilesystems = oldSync }()
+
+	tdir, err := ioutil.TempDir("", "appslots")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	dev := &device{apps: newAppSlots(tdir)}
+	assert.False(t, dev.AppUpdatePending())
+	assert.Equal(t, "", dev.AppArtifactName())
+
+	// first install
+	err = dev.InstallApp("app-1",
+		makeAppTar(t, map[string]string{"bin/app": "v1"}), 0)
+	assert.NoError(t, err)
+	assert.True(t, dev.AppUpdatePending())
+	assert.NoError(t, dev.EnableUpdatedPartition())
+	has, err := dev.HasUpdate()
+	assert.NoError(t, err)
+	assert.True(t, has)
+	assert.Equal(t, "v1", readAppFile(t, tdir, "bin/app"))
+	assert.Equal(t, "app-1", dev.AppArtifactName())
+	assert.NoError(t, dev.CommitUpdate())
+	assert.False(t, dev.apps.pending())
+
+	// second install goes to the other slot, rollback switches back
+	dev = &device{apps: newAppSlots(tdir)}
+	err = dev.InstallApp("app-2",
+		makeAppTar(t, map[string]string{"bin/app": "v2"}), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", readAppFile(t, tdir, "bin/app"))
+	assert.NoError(t, dev.EnableUpdatedPartition())
+	assert.Equal(t, "v2", readAppFile(t, tdir, "bin/app"))
+	active, _ := dev.apps.active()
+	assert.Equal(t, appSlotB, active)
+
+	// pending update survives restart of the client
+	dev = &device{apps: newAppSlots(tdir)}
+	assert.True(t, dev.AppUpdatePending())
+	assert.NoError(t, dev.Rollback())
+	assert.False(t, dev.AppUpdatePending())
+	assert.Equal(t, "v1", readAppFile(t, tdir, "bin/app"))
+	assert.Equal(t, "app-1", dev.AppArtifactName())
+
+	// committed update can still be rolled back, e.g. if reporting
+	// success fails
+	dev = &device{apps: newAppSlots(tdir)}
+	assert.NoError(t, dev.InstallApp("app-3",
+		makeAppTar(t, map[string]string{"bin/app": "v3"}), 0))
+	assert.NoError(t, dev.EnableUpdatedPartition())
+	assert.NoError(t, dev.CommitUpdate())
+	assert.True(t, dev.AppUpdatePending())
+	assert.NoError(t, dev.Rollback())
+	assert.Equal(t, "v1", readAppFile(t, tdir, "bin/app"))
+
+	// rolling back the very first install leaves no application active
+	tdir2, _ := ioutil.TempDir("", "appslots")
+	defer os.RemoveAll(tdir2)
+	dev = &device{apps: newAppSlots(tdir2)}
+	assert.NoError(t, dev.InstallApp("app-1",
+		makeAppTar(t, map[string]string{"bin/app": "v1"}), 0))
+	assert.NoError(t, dev.EnableUpdatedPartition())
+	assert.NoError(t, dev.Rollback())
+	active, err = dev.apps.active()
+	assert.NoError(t, err)
+	assert.Equal(t, "", active)
+
+	// not configured
+	dev = &device{}
+	err = dev.InstallApp("app-1", makeAppTar(t, nil), 0)
+	assert.Equal(t, ErrAppSlotsNotConfigured, err)
+	assert.False(t, dev.AppUpdatePending())
+}
+
+func TestUntar(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "untar")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	err = untar(makeAppTar(t, map[string]string{"a/b/c": "data"}), tdir)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(tdir, "a/b/c"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+
+	err = untar(makeAppTar(t, map[string]string{"../escape": "data"}), tdir)
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(filepath.Dir(tdir), "escape"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// Archive of entries in the given order; symlinks are given as "->target".
+func makeLinkTar(t *testing.T, entries [][2]string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e[0], Mode: 0644}
+		if strings.HasPrefix(e[1], "->") {
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = strings.TrimPrefix(e[1], "->")
+		} else {
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(e[1]))
+		}
+		assert.NoError(t, tw.WriteHeader(hdr))
+		tw.Write([]byte(e[1][:hdr.Size]))
+	}
+	assert.NoError(t, tw.Close())
+	return buf
+}
+
+func TestUntarSymlinks(t *testing.T) {
+	outside, err := ioutil.TempDir("", "outside")
+	assert.NoError(t, err)
+	defer os.RemoveAll(outside)
+
+	for name, c := range map[string]struct {
+		entries [][2]string
+		valid   bool
+	}{
+		"within slot": {[][2]string{
+			{"lib/libapp.so.1", "data"},
+			{"lib/libapp.so", "->libapp.so.1"},
+			{"bin", "->lib"},
+			{"bin/app", "app"},
+		}, true},
+		"absolute": {[][2]string{
+			{"etc", "->" + outside},
+		}, false},
+		"escaping": {[][2]string{
+			{"lib/up", "->../.."},
+		}, false},
+		"file written through symlink": {[][2]string{
+			{"app.conf", "->default.conf"},
+			{"app.conf", "data"},
+		}, false},
+		// a/b/c is the slot itself, so one too many levels up
+		"through symlink chain": {[][2]string{
+			{"a/b/c", "->../.."},
+			{"up", "->a/b/c/../../.."},
+		}, false},
+		// the same chain, with the link followed created last
+		"redirected later": {[][2]string{
+			{"up", "->a/b/c/../../.."},
+			{"a/b/c", "->../.."},
+		}, false},
+		"dangling outside": {[][2]string{
+			{"up", "->missing/../../x"},
+		}, false},
+	} {
+		tdir, err := ioutil.TempDir("", "untar")
+		assert.NoError(t, err)
+		defer os.RemoveAll(tdir)
+
+		err = untar(makeLinkTar(t, c.entries), tdir)
+		if c.valid {
+			assert.NoError(t, err, name)
+		} else {
+			assert.Error(t, err, name)
+		}
+		files, _ := ioutil.ReadDir(outside)
+		assert.Len(t, files, 0, name)
+	}
+
+	tdir, _ := ioutil.TempDir("", "untar")
+	defer os.RemoveAll(tdir)
+	assert.NoError(t, untar(makeLinkTar(t, [][2]string{
+		{"lib/libapp.so.1", "data"},
+		{"bin", "->lib"},
+		{"bin/app", "app"},
+	}), tdir))
+	data, err := ioutil.ReadFile(filepath.Join(tdir, "lib/app"))
+	assert.NoError(t, err)
+	assert.Equal(t, "app", string(data))
+}
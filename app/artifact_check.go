@@ -0,0 +1,100 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Before the download, availability of the artifact is checked with HEAD
+// request. Pre-signed artifact URLs expire, eg. while the device retries a
+// failed download or waits for the maintenance window; the URL is then
+// refreshed from the server rather than the download retried until attempts
+// run out. Artifact removed from the storage fails the deployment at once;
+// network failures are retried as usual.
+
+func (m *mender) checkArtifact(ctx context.Context, update client.UpdateResponse) error {
+	if update.URIExpired(time.Now()) {
+		return errors.Wrapf(client.ErrArtifactURLExpired, "expired %s",
+			update.Artifact.Source.Expire)
+	}
+	return m.updater.CheckArtifact(ctx, m.downloadAPI, update.URI())
+}
+
+// CheckArtifactAvailable checks that the artifact of the update can be
+// downloaded. Returns the update with artifact URL refreshed from the server,
+// if the one given expired; fatal error if the artifact is gone or the
+// deployment is no longer active, transient error if availability could not
+// be checked.
+func (m *mender) CheckArtifactAvailable(ctx context.Context,
+	update client.UpdateResponse) (client.UpdateResponse, menderError) {
+	if m.config.SkipArtifactAvailabilityCheck {
+		return update, nil
+	}
+
+	err := m.checkArtifact(ctx, update)
+	switch errors.Cause(err) {
+	case nil:
+		return update, nil
+	case client.ErrArtifactGone, client.ErrArtifactURLExpired:
+	default:
+		return update, NewTransientError(errors.Wrapf(err,
+			"failed to check availability of artifact"))
+	}
+
+	// server may have moved the artifact, or issues a new URL for it
+	log.Infof("artifact of deployment %s not available (%v), refreshing its URL",
+		update.ID, err)
+	next, merr := m.refreshArtifactURL(ctx, update)
+	if merr != nil {
+		return update, merr
+	}
+
+	// expiry time is not trusted this time; device clock may be off
+	err = m.updater.CheckArtifact(ctx, m.downloadAPI, next.URI())
+	switch errors.Cause(err) {
+	case nil:
+		log.Infof("artifact URL of deployment %s refreshed", update.ID)
+		return next, nil
+	case client.ErrArtifactGone:
+		return update, NewFatalError(errors.Wrapf(err, "artifact of deployment %s",
+			update.ID))
+	}
+	return update, NewTransientError(errors.Wrapf(err,
+		"failed to check availability of artifact"))
+}
+
+// refreshArtifactURL asks the server for the deployment again, for a new
+// artifact URL. Returns fatal error if the deployment is no longer active.
+func (m *mender) refreshArtifactURL(ctx context.Context,
+	update client.UpdateResponse) (client.UpdateResponse, menderError) {
+	current, err := m.updater.GetScheduledUpdate(ctx, m.api.Request(m.authToken),
+		m.config.ServerURL, m.currentUpdate(ctx))
+	m.endpoints.record(endpointDeployments, err, time.Now())
+	if err != nil {
+		return update, NewTransientError(errors.Wrapf(err,
+			"failed to refresh artifact URL of deployment %s", update.ID))
+	}
+	next, ok := current.(client.UpdateResponse)
+	if !ok || next.ID != update.ID {
+		return update, NewFatalError(errors.Wrapf(ErrDeploymentRevoked,
+			"deployment %s", update.ID))
+	}
+	return next, nil
+}
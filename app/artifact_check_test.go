@@ -0,0 +1,143 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckArtifactAvailable(t *testing.T) {
+	// deployment the server has for the device, and artifact URL it issues
+	active := "dep-1"
+	issued := "/artifacts/release-2?sig=2"
+	// status of HEAD requests by artifact URL
+	artifacts := map[string]int{}
+	var heads, checks int
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/artifacts/") {
+			assert.Equal(t, http.MethodHead, r.Method)
+			heads++
+			status, ok := artifacts[r.URL.RequestURI()]
+			if !ok {
+				status = http.StatusNotFound
+			}
+			w.WriteHeader(status)
+			return
+		}
+		checks++
+		if active == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		var update client.UpdateResponse
+		update.ID = active
+		update.Artifact.ArtifactName = "release-2"
+		update.Artifact.CompatibleDevices = []string{"hammer"}
+		update.Artifact.Source.URI = srv.URL + issued
+		data, _ := json.Marshal(update)
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	td, _ := ioutil.TempDir("", "artifactcheck")
+	defer os.RemoveAll(td)
+
+	mender := newTestMender(nil, MenderConfig{ServerURL: srv.URL}, testMenderPieces{})
+	mender.artifactInfoFile = path.Join(td, "artifact_info")
+	mender.deviceTypeFile = path.Join(td, "device_type")
+	ioutil.WriteFile(mender.artifactInfoFile, []byte("artifact_name=release-1"), 0600)
+	ioutil.WriteFile(mender.deviceTypeFile, []byte("device_type=hammer"), 0600)
+
+	update := client.UpdateResponse{ID: "dep-1"}
+	update.Artifact.Source.URI = srv.URL + "/artifacts/release-2?sig=1"
+	ctx := context.Background()
+
+	// available
+	artifacts["/artifacts/release-2?sig=1"] = http.StatusOK
+	next, merr := mender.CheckArtifactAvailable(ctx, update)
+	assert.Nil(t, merr)
+	assert.Equal(t, update, next)
+	assert.Equal(t, 0, checks)
+
+	// HEAD not supported by the artifact server
+	artifacts["/artifacts/release-2?sig=1"] = http.StatusMethodNotAllowed
+	_, merr = mender.CheckArtifactAvailable(ctx, update)
+	assert.Nil(t, merr)
+
+	// URL expired, new one is issued
+	artifacts["/artifacts/release-2?sig=1"] = http.StatusForbidden
+	artifacts["/artifacts/release-2?sig=2"] = http.StatusOK
+	next, merr = mender.CheckArtifactAvailable(ctx, update)
+	assert.Nil(t, merr)
+	assert.Equal(t, "dep-1", next.ID)
+	assert.Equal(t, srv.URL+"/artifacts/release-2?sig=2", next.URI())
+	assert.Equal(t, 1, checks)
+
+	// expiry time given by the server passed; not even checked with HEAD
+	heads = 0
+	expired := update
+	expired.Artifact.Source.Expire = "2017-03-01T11:00:00.000+0000"
+	artifacts["/artifacts/release-2?sig=1"] = http.StatusOK
+	next, merr = mender.CheckArtifactAvailable(ctx, expired)
+	assert.Nil(t, merr)
+	assert.Equal(t, srv.URL+"/artifacts/release-2?sig=2", next.URI())
+	assert.Equal(t, 1, heads)
+
+	// new URL expired too, most likely clock skew of the server
+	artifacts["/artifacts/release-2?sig=1"] = http.StatusForbidden
+	artifacts["/artifacts/release-2?sig=2"] = http.StatusForbidden
+	_, merr = mender.CheckArtifactAvailable(ctx, update)
+	assert.Error(t, merr)
+	assert.False(t, merr.IsFatal())
+
+	// artifact removed from the storage
+	issued = "/artifacts/release-2?sig=1"
+	delete(artifacts, "/artifacts/release-2?sig=1")
+	_, merr = mender.CheckArtifactAvailable(ctx, update)
+	assert.Error(t, merr)
+	assert.True(t, merr.IsFatal())
+	assert.Equal(t, client.ErrArtifactGone, errors.Cause(merr.Cause()))
+
+	// deployment aborted meanwhile
+	active = ""
+	_, merr = mender.CheckArtifactAvailable(ctx, update)
+	assert.Error(t, merr)
+	assert.True(t, merr.IsFatal())
+	assert.Equal(t, ErrDeploymentRevoked, errors.Cause(merr.Cause()))
+
+	// disabled
+	mender.config.SkipArtifactAvailabilityCheck = true
+	_, merr = mender.CheckArtifactAvailable(ctx, update)
+	assert.Nil(t, merr)
+	mender.config.SkipArtifactAvailabilityCheck = false
+
+	// artifact server unreachable
+	srv.Close()
+	_, merr = mender.CheckArtifactAvailable(ctx, update)
+	assert.Error(t, merr)
+	assert.False(t, merr.IsFatal())
+}
@@ -0,0 +1,142 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+const (
+	artifactFilterAccept = "accept"
+	artifactFilterReject = "reject"
+)
+
+var ErrArtifactRejected = errors.New("artifact rejected by device filter")
+
+// ArtifactFilterRule selects artifacts by name and metadata. A rule matches
+// an artifact if its name matches the NamePattern regular expression (when
+// given) and all Metadata entries are equal to the values in the artifact
+// metadata. Once any accept rules are configured, only artifacts matching
+// one of them are installed; artifacts matching any reject rule never are.
+type ArtifactFilterRule struct {
+	Action      string
+	NamePattern string
+	Metadata    map[string]string
+}
+
+type artifactRule struct {
+	desc     string
+	name     *regexp.Regexp
+	metadata map[string]string
+}
+
+type artifactFilter struct {
+	accept []artifactRule
+	reject []artifactRule
+}
+
+// Returns nil filter, accepting all artifacts, if there are no rules.
+func newArtifactFilter(rules []ArtifactFilterRule) (*artifactFilter, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	f := &artifactFilter{}
+	for i, r := range rules {
+		ar := artifactRule{
+			desc:     describeArtifactRule(r),
+			metadata: r.Metadata,
+		}
+		if r.NamePattern == "" && len(r.Metadata) == 0 {
+			return nil, errors.Errorf("artifact filter rule %d matches all artifacts", i)
+		}
+		if r.NamePattern != "" {
+			re, err := regexp.Compile(r.NamePattern)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid name pattern in artifact filter rule %d", i)
+			}
+			ar.name = re
+		}
+
+		switch r.Action {
+		case artifactFilterAccept:
+			f.accept = append(f.accept, ar)
+		case artifactFilterReject:
+			f.reject = append(f.reject, ar)
+		default:
+			return nil, errors.Errorf("invalid action %q in artifact filter rule %d, "+
+				"expected %q or %q", r.Action, i, artifactFilterAccept, artifactFilterReject)
+		}
+	}
+	return f, nil
+}
+
+func describeArtifactRule(r ArtifactFilterRule) string {
+	var conds []string
+	if r.NamePattern != "" {
+		conds = append(conds, fmt.Sprintf("name=~%s", r.NamePattern))
+	}
+	keys := make([]string, 0, len(r.Metadata))
+	for k := range r.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		conds = append(conds, fmt.Sprintf("metadata.%s=%s", k, r.Metadata[k]))
+	}
+	return strings.Join(conds, " ")
+}
+
+func (r *artifactRule) matches(update client.UpdateResponse) bool {
+	if r.name != nil && !r.name.MatchString(update.ArtifactName()) {
+		return false
+	}
+	for k, v := range r.metadata {
+		mv, ok := update.Artifact.Metadata[k]
+		if !ok || fmt.Sprint(mv) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// check returns an error wrapping ErrArtifactRejected if the artifact of the
+// update may not be installed on this device.
+func (f *artifactFilter) check(update client.UpdateResponse) error {
+	if f == nil {
+		return nil
+	}
+	for _, r := range f.reject {
+		if r.matches(update) {
+			return errors.Wrapf(ErrArtifactRejected, "artifact %s matches reject rule %q",
+				update.ArtifactName(), r.desc)
+		}
+	}
+	if len(f.accept) == 0 {
+		return nil
+	}
+	for _, r := range f.accept {
+		if r.matches(update) {
+			return nil
+		}
+	}
+	return errors.Wrapf(ErrArtifactRejected, "artifact %s matches no accept rule",
+		update.ArtifactName())
+}
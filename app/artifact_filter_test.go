@@ -0,0 +1,110 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeFilterUpdate(t *testing.T, name, metadata string) client.UpdateResponse {
+	var update client.UpdateResponse
+	update.Artifact.ArtifactName = name
+	if metadata != "" {
+		assert.NoError(t, json.Unmarshal([]byte(metadata), &update.Artifact.Metadata))
+	}
+	return update
+}
+
+func TestArtifactFilterInvalid(t *testing.T) {
+	f, err := newArtifactFilter(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, f)
+	// nil filter accepts everything
+	assert.NoError(t, f.check(makeFilterUpdate(t, "test-1", "")))
+
+	for _, rules := range [][]ArtifactFilterRule{
+		{{Action: "drop", NamePattern: "^test-"}},
+		{{Action: artifactFilterAccept, NamePattern: "(release"}},
+		{{Action: artifactFilterReject}},
+	} {
+		_, err = newArtifactFilter(rules)
+		assert.Error(t, err, "%v", rules)
+	}
+}
+
+func TestArtifactFilter(t *testing.T) {
+	f, err := newArtifactFilter([]ArtifactFilterRule{
+		{Action: artifactFilterAccept, NamePattern: "^release-"},
+		{Action: artifactFilterReject, Metadata: map[string]string{"experimental": "true"}},
+	})
+	assert.NoError(t, err)
+
+	tc := []struct {
+		name     string
+		metadata string
+		accepted bool
+	}{
+		{"release-1", "", true},
+		{"release-2", `{"experimental": false}`, true},
+		{"test-1", "", false},
+		{"my-release-1", "", false},
+		{"release-3", `{"experimental": true}`, false},
+		{"release-4", `{"experimental": "true", "channel": "beta"}`, false},
+	}
+	for _, c := range tc {
+		err := f.check(makeFilterUpdate(t, c.name, c.metadata))
+		if c.accepted {
+			assert.NoError(t, err, c.name)
+		} else {
+			assert.Equal(t, ErrArtifactRejected, errors.Cause(err), c.name)
+			assert.Equal(t, "artifact_rejected", errorCode(err))
+		}
+	}
+
+	err = f.check(makeFilterUpdate(t, "release-3", `{"experimental": true}`))
+	assert.Contains(t, err.Error(), `reject rule "metadata.experimental=true"`)
+	err = f.check(makeFilterUpdate(t, "test-1", ""))
+	assert.Contains(t, err.Error(), "matches no accept rule")
+
+	// reject rules only; anything not rejected is accepted
+	f, err = newArtifactFilter([]ArtifactFilterRule{
+		{Action: artifactFilterReject, NamePattern: "^test-",
+			Metadata: map[string]string{"channel": "beta"}},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, f.check(makeFilterUpdate(t, "test-1", "")))
+	assert.NoError(t, f.check(makeFilterUpdate(t, "release-1", `{"channel": "beta"}`)))
+	assert.Error(t, f.check(makeFilterUpdate(t, "test-1", `{"channel": "beta"}`)))
+}
+
+func TestMenderFilterUpdate(t *testing.T) {
+	m := newTestMender(nil, MenderConfig{
+		ArtifactFilters: []ArtifactFilterRule{{Action: "maybe", NamePattern: "x"}},
+	}, testMenderPieces{})
+	assert.Nil(t, m)
+
+	m = newTestMender(nil, MenderConfig{
+		ArtifactFilters: []ArtifactFilterRule{
+			{Action: artifactFilterAccept, NamePattern: "^release-"},
+		},
+	}, testMenderPieces{})
+	assert.NotNil(t, m)
+	assert.NoError(t, m.FilterUpdate(makeFilterUpdate(t, "release-1", "")))
+	assert.Error(t, m.FilterUpdate(makeFilterUpdate(t, "test-1", "")))
+}
@@ -11,11 +11,12 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
-package main
+package app
 
 import (
 	"os"
 	"strings"
+	"time"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
@@ -41,13 +42,79 @@ const (
 	authTokenName = "authtoken"
 
 	noAuthToken = client.EmptyAuthToken
+
+	// tokens with less than this fraction of their lifetime left are
+	// considered no longer valid and are refreshed while the client is idle,
+	// so that they do not expire in the middle of an update
+	authTokenRefreshFraction = 10
+	// but not later than this before they expire, unless short-lived
+	minAuthTokenRefreshMargin = 5 * time.Minute
+	// margin for tokens whose lifetime is not known
+	defaultAuthTokenRefreshMargin = 30 * time.Minute
 )
 
+// How long before expiry a token valid for `lifetime` (0 if not known) is
+// refreshed.
+func authTokenRefreshMargin(lifetime time.Duration) time.Duration {
+	if lifetime <= 0 {
+		return defaultAuthTokenRefreshMargin
+	}
+	margin := lifetime / authTokenRefreshFraction
+	if margin < minAuthTokenRefreshMargin {
+		margin = minAuthTokenRefreshMargin
+	}
+	// token must stay usable for a while at least
+	if margin > lifetime/2 {
+		margin = lifetime / 2
+	}
+	return margin
+}
+
+// Time when the authorization token should be refreshed. Returns zero time if
+// token expiration time is not known.
+func authTokenRefreshTime(token client.AuthToken) time.Time {
+	exp, err := token.Expiry()
+	if err != nil {
+		return time.Time{}
+	}
+	var lifetime time.Duration
+	if iat, err := token.IssuedAt(); err == nil {
+		lifetime = exp.Sub(iat)
+	}
+	return exp.Add(-authTokenRefreshMargin(lifetime))
+}
+
+// AuthDataFiller adds to the authorization request data, after identity data,
+// public key and tenant token are filled. Called for every request, so that
+// the data is current.
+type AuthDataFiller func(*client.AuthReqData) error
+
+// Fillers reporting versions of the client and of the installed artifact, and
+// the device type; details missing on the device are left out.
+func deviceAuthData(artifactInfoFile, deviceTypeFile string) []AuthDataFiller {
+	return []AuthDataFiller{
+		func(authd *client.AuthReqData) error {
+			authd.ClientVersion = VersionString()
+			return nil
+		},
+		func(authd *client.AuthReqData) error {
+			authd.ArtifactName = getManifestData("artifact_name", artifactInfoFile)
+			return nil
+		},
+		func(authd *client.AuthReqData) error {
+			authd.DeviceType = getManifestData("device_type", deviceTypeFile)
+			return nil
+		},
+	}
+}
+
 type MenderAuthManager struct {
 	store       Store
 	keyStore    *Keystore
 	idSrc       IdentityDataGetter
 	tenantToken client.AuthToken
+	tokenName   string
+	fillers     []AuthDataFiller
 }
 
 type AuthManagerConfig struct {
@@ -55,6 +122,8 @@ type AuthManagerConfig struct {
 	KeyStore       *Keystore          // key storage
 	IdentitySource IdentityDataGetter // provider of identity data
 	TenantToken    []byte             // tenant token
+	AuthTokenName  string             // name of token in data store (optional)
+	AuthData       []AuthDataFiller   // additional request data (optional)
 }
 
 func NewAuthManager(conf AuthManagerConfig) AuthManager {
@@ -69,6 +138,12 @@ func NewAuthManager(conf AuthManagerConfig) AuthManager {
 		keyStore:    conf.KeyStore,
 		idSrc:       conf.IdentitySource,
 		tenantToken: client.AuthToken(conf.TenantToken),
+		tokenName:   conf.AuthTokenName,
+		fillers:     conf.AuthData,
+	}
+
+	if mgr.tokenName == "" {
+		mgr.tokenName = authTokenName
 	}
 
 	if err := mgr.keyStore.Load(); err != nil && !IsNoKeys(err) {
@@ -89,7 +164,12 @@ func (m *MenderAuthManager) IsAuthorized() bool {
 		return false
 	}
 
-	// TODO check if JWT is valid?
+	if refresh := authTokenRefreshTime(adata); !refresh.IsZero() &&
+		!time.Now().Before(refresh) {
+		exp, _ := adata.Expiry()
+		log.Infof("authorization token expires at %v, needs refreshing", exp)
+		return false
+	}
 
 	return true
 }
@@ -119,6 +199,12 @@ func (m *MenderAuthManager) MakeAuthRequest() (*client.AuthRequest, error) {
 	// fill tenant token
 	authd.TenantToken = string(tentok)
 
+	for _, fill := range m.fillers {
+		if err := fill(&authd); err != nil {
+			return nil, errors.Wrapf(err, "failed to fill auth request data")
+		}
+	}
+
 	log.Debugf("authorization data: %v", authd)
 
 	reqdata, err := authd.ToBytes()
@@ -144,14 +230,14 @@ func (m *MenderAuthManager) RecvAuthResponse(data []byte) error {
 		return errors.New("empty auth response data")
 	}
 
-	if err := m.store.WriteAll(authTokenName, data); err != nil {
+	if err := m.store.WriteAll(m.tokenName, data); err != nil {
 		return errors.Wrapf(err, "failed to save auth token")
 	}
 	return nil
 }
 
 func (m *MenderAuthManager) AuthToken() (client.AuthToken, error) {
-	data, err := m.store.ReadAll(authTokenName)
+	data, err := m.store.ReadAll(m.tokenName)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return noAuthToken, nil
@@ -165,7 +251,7 @@ func (m *MenderAuthManager) AuthToken() (client.AuthToken, error) {
 func (m *MenderAuthManager) RemoveAuthToken() error {
 	// remove token only if we have one
 	if aToken, err := m.AuthToken(); err == nil && aToken != noAuthToken {
-		return m.store.Remove(authTokenName)
+		return m.store.Remove(m.tokenName)
 	}
 	return nil
 }
@@ -11,11 +11,17 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
-package main
+package app
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/mendersoftware/mender/client"
 	"github.com/mendersoftware/mender/utils"
@@ -155,6 +161,59 @@ func TestAuthManagerRequest(t *testing.T) {
 	assert.Equal(t, sign, req.Signature)
 }
 
+func TestAuthManagerRequestData(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "authdata")
+	defer os.RemoveAll(tdir)
+	artifactInfo := path.Join(tdir, "artifact_info")
+	deviceType := path.Join(tdir, "device_type")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=release-1\n"), 0644)
+
+	ms := utils.NewMemStore()
+	cmdr := newTestOSCalls("mac=foobar", 0)
+	am := NewAuthManager(AuthManagerConfig{
+		AuthDataStore: ms,
+		IdentitySource: IdentityDataRunner{
+			cmdr: &cmdr,
+		},
+		KeyStore: NewKeystore(ms, "key"),
+		AuthData: deviceAuthData(artifactInfo, deviceType),
+	})
+	assert.NoError(t, am.GenerateKey())
+
+	// device type is not known yet
+	req, err := am.MakeAuthRequest()
+	assert.NoError(t, err)
+	var ard map[string]interface{}
+	assert.NoError(t, json.Unmarshal(req.Data, &ard))
+	assert.Equal(t, VersionString(), ard["client_version"])
+	assert.Equal(t, "release-1", ard["artifact_name"])
+	assert.NotContains(t, ard, "device_type")
+
+	// data is read for every request
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=release-2\n"), 0644)
+	ioutil.WriteFile(deviceType, []byte("device_type=beaglebone\n"), 0644)
+	req, err = am.MakeAuthRequest()
+	assert.NoError(t, err)
+	var authd client.AuthReqData
+	assert.NoError(t, json.Unmarshal(req.Data, &authd))
+	assert.Equal(t, "release-2", authd.ArtifactName)
+	assert.Equal(t, "beaglebone", authd.DeviceType)
+
+	// fillers failing fail the request
+	am = NewAuthManager(AuthManagerConfig{
+		AuthDataStore: ms,
+		IdentitySource: IdentityDataRunner{
+			cmdr: &cmdr,
+		},
+		KeyStore: NewKeystore(ms, "key"),
+		AuthData: []AuthDataFiller{func(*client.AuthReqData) error {
+			return fmt.Errorf("no data")
+		}},
+	})
+	_, err = am.MakeAuthRequest()
+	assert.Error(t, err)
+}
+
 func TestAuthManagerResponse(t *testing.T) {
 	ms := utils.NewMemStore()
 
@@ -185,3 +244,66 @@ func TestAuthManagerResponse(t *testing.T) {
 	assert.Equal(t, []byte("fooresp"), tokdata)
 	assert.True(t, am.IsAuthorized())
 }
+
+// build an unsigned JWT expiring at given time
+func makeTestJWT(exp time.Time) client.AuthToken {
+	return makeTestJWTClaims(fmt.Sprintf(`{"exp":%d}`, exp.Unix()))
+}
+
+func makeTestJWTClaims(claims string) client.AuthToken {
+	enc := base64.RawURLEncoding
+	return client.AuthToken(enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) +
+		"." + enc.EncodeToString([]byte(claims)) +
+		"." + enc.EncodeToString([]byte("signature")))
+}
+
+func TestAuthManagerTokenExpiry(t *testing.T) {
+	ms := utils.NewMemStore()
+
+	cmdr := newTestOSCalls("mac=foobar", 0)
+	am := NewAuthManager(AuthManagerConfig{
+		AuthDataStore: ms,
+		IdentitySource: IdentityDataRunner{
+			cmdr: &cmdr,
+		},
+		KeyStore: NewKeystore(ms, "key"),
+	})
+	assert.NotNil(t, am)
+
+	// token valid for another week
+	ms.WriteAll(authTokenName, []byte(makeTestJWT(time.Now().Add(7*24*time.Hour))))
+	assert.True(t, am.IsAuthorized())
+
+	// about to expire
+	ms.WriteAll(authTokenName,
+		[]byte(makeTestJWT(time.Now().Add(defaultAuthTokenRefreshMargin/2))))
+	assert.False(t, am.IsAuthorized())
+
+	// expired already
+	ms.WriteAll(authTokenName, []byte(makeTestJWT(time.Now().Add(-time.Hour))))
+	assert.False(t, am.IsAuthorized())
+
+	// opaque token, expiration unknown
+	ms.WriteAll(authTokenName, []byte("footoken"))
+	assert.True(t, am.IsAuthorized())
+
+	exp := time.Now().Add(time.Hour)
+	assert.Equal(t, time.Unix(exp.Unix(), 0).Add(-defaultAuthTokenRefreshMargin),
+		authTokenRefreshTime(makeTestJWT(exp)))
+	assert.True(t, authTokenRefreshTime("footoken").IsZero())
+
+	// token valid for a week is refreshed some 17 hours before it expires
+	week := makeTestJWTClaims(`{"iat":1500000000,"exp":1500604800}`)
+	assert.Equal(t, time.Unix(1500604800, 0).Add(-604800*time.Second/10),
+		authTokenRefreshTime(week))
+}
+
+func TestAuthTokenRefreshMargin(t *testing.T) {
+	assert.Equal(t, defaultAuthTokenRefreshMargin, authTokenRefreshMargin(0))
+	assert.Equal(t, 24*time.Hour, authTokenRefreshMargin(10*24*time.Hour))
+	assert.Equal(t, 6*time.Minute, authTokenRefreshMargin(time.Hour))
+	// lower bound
+	assert.Equal(t, minAuthTokenRefreshMargin, authTokenRefreshMargin(20*time.Minute))
+	// short-lived token is still used for half of its lifetime
+	assert.Equal(t, 2*time.Minute, authTokenRefreshMargin(4*time.Minute))
+}
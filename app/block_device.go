@@ -11,7 +11,7 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
-package main
+package app
 
 import (
 	"os"
@@ -68,6 +68,14 @@ func (bd *BlockDevice) Write(p []byte) (int, error) {
 	return w, err
 }
 
+// Sync flushes data written so far to the block device.
+func (bd *BlockDevice) Sync() error {
+	if bd.out == nil {
+		return nil
+	}
+	return bd.out.Sync()
+}
+
 // Close closes underlying block device automatically syncing any unwritten
 // data. Othewise, behaves like io.Closer.
 func (bd *BlockDevice) Close() error {
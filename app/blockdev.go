@@ -0,0 +1,87 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mendersoftware/log"
+)
+
+var (
+	// overridden in tests
+	devDiskDir  = "/dev/disk"
+	sysBlockDir = "/sys/block"
+)
+
+// fstab style device tags and the /dev/disk directories udev creates the
+// corresponding links in
+var deviceTagDirs = map[string]string{
+	"UUID":      "by-uuid",
+	"PARTUUID":  "by-partuuid",
+	"LABEL":     "by-label",
+	"PARTLABEL": "by-partlabel",
+}
+
+// Resolves device given either as a tag (PARTUUID=..., LABEL=...) or a path,
+// possibly a symlink like /dev/disk/by-partuuid/..., to the device node path.
+// If the device can not be resolved, it is returned unchanged.
+func resolveDeviceName(dev string) string {
+	if dev == "" {
+		return dev
+	}
+	if i := strings.Index(dev, "="); i > 0 {
+		if dir, ok := deviceTagDirs[strings.ToUpper(dev[:i])]; ok {
+			dev = path.Join(devDiskDir, dir, dev[i+1:])
+		}
+	}
+	resolved, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		log.Debugf("Can not resolve device %s: %v", dev, err)
+		return dev
+	}
+	return resolved
+}
+
+// Returns the block device backing dev; device-mapper devices (LUKS, verity)
+// are followed down to the single partition they are built on, so that they
+// can be compared with the configured root partitions.
+func underlyingDevice(dev string) string {
+	dev = resolveDeviceName(dev)
+
+	// nested mappings (eg. verity on top of LUKS) are followed as well, but
+	// not indefinitely
+	for i := 0; i < 8; i++ {
+		name := path.Base(dev)
+		if !strings.HasPrefix(name, "dm-") {
+			break
+		}
+		slaves, err := ioutil.ReadDir(path.Join(sysBlockDir, name, "slaves"))
+		if err != nil {
+			log.Warnf("Can not find devices backing %s: %v", dev, err)
+			break
+		}
+		if len(slaves) != 1 {
+			log.Warnf("Device %s is backed by %d devices; can not tell which "+
+				"one is the root partition", dev, len(slaves))
+			break
+		}
+		log.Debugf("Device %s is backed by %s", dev, slaves[0].Name())
+		dev = path.Join(path.Dir(dev), slaves[0].Name())
+	}
+	return dev
+}
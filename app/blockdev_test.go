@@ -0,0 +1,87 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnderlyingDevice(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "blockdev")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	oldDisk, oldSys := devDiskDir, sysBlockDir
+	devDiskDir = path.Join(tdir, "dev/disk")
+	sysBlockDir = path.Join(tdir, "sys/block")
+	defer func() {
+		devDiskDir, sysBlockDir = oldDisk, oldSys
+	}()
+
+	dev := path.Join(tdir, "dev")
+	for _, d := range []string{"dev/disk/by-partuuid", "dev/disk/by-label", "dev/mapper",
+		"sys/block/dm-0/slaves/mmcblk0p2", "sys/block/dm-1/slaves/dm-0",
+		"sys/block/dm-2/slaves/sda1", "sys/block/dm-2/slaves/sdb1"} {
+		assert.NoError(t, os.MkdirAll(path.Join(tdir, d), 0755))
+	}
+	for _, n := range []string{"mmcblk0p2", "mmcblk0p3", "dm-0", "dm-1", "dm-2"} {
+		assert.NoError(t, ioutil.WriteFile(path.Join(dev, n), nil, 0644))
+	}
+	assert.NoError(t, os.Symlink("../../mmcblk0p2", path.Join(dev, "disk/by-partuuid/abcd-02")))
+	assert.NoError(t, os.Symlink("../../mmcblk0p3", path.Join(dev, "disk/by-label/rootfs-b")))
+	assert.NoError(t, os.Symlink("../dm-0", path.Join(dev, "mapper/rootfs")))
+
+	tc := []struct {
+		dev      string
+		resolved string
+		under    string
+	}{
+		{path.Join(dev, "mmcblk0p2"), path.Join(dev, "mmcblk0p2"), path.Join(dev, "mmcblk0p2")},
+		{"PARTUUID=abcd-02", path.Join(dev, "mmcblk0p2"), path.Join(dev, "mmcblk0p2")},
+		{"LABEL=rootfs-b", path.Join(dev, "mmcblk0p3"), path.Join(dev, "mmcblk0p3")},
+		{path.Join(dev, "disk/by-label/rootfs-b"), path.Join(dev, "mmcblk0p3"), path.Join(dev, "mmcblk0p3")},
+		// LUKS or verity
+		{path.Join(dev, "mapper/rootfs"), path.Join(dev, "dm-0"), path.Join(dev, "mmcblk0p2")},
+		// verity on top of LUKS
+		{path.Join(dev, "dm-1"), path.Join(dev, "dm-1"), path.Join(dev, "mmcblk0p2")},
+		// spans several devices, can not tell
+		{path.Join(dev, "dm-2"), path.Join(dev, "dm-2"), path.Join(dev, "dm-2")},
+		// unknown devices are left alone
+		{"PARTUUID=none", path.Join(devDiskDir, "by-partuuid/none"), path.Join(devDiskDir, "by-partuuid/none")},
+		{"/dev/mmc2", "/dev/mmc2", "/dev/mmc2"},
+		{"", "", ""},
+	}
+
+	for _, c := range tc {
+		assert.Equal(t, c.resolved, resolveDeviceName(c.dev), c.dev)
+		assert.Equal(t, c.under, underlyingDevice(c.dev), c.dev)
+	}
+
+	// configured partitions are compared by the partition they resolve to
+	p := partitions{
+		StatCommander:     new(osCalls),
+		BootEnvReadWriter: new(uBootEnv),
+		rootfsPartA:       "PARTUUID=abcd-02",
+		rootfsPartB:       "LABEL=rootfs-b",
+		active:            path.Join(dev, "mmcblk0p2"),
+	}
+	inactive, err := p.GetInactive()
+	assert.NoError(t, err)
+	assert.Equal(t, path.Join(dev, "mmcblk0p3"), inactive)
+}
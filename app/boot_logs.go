@@ -0,0 +1,146 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mendersoftware/log"
+)
+
+// After the bootloader rolled back a new image that never came up, the
+// kernel log saved in pstore and the journal of the failed boot are the
+// only clue why; their tails are copied to the deployment log, which is
+// uploaded with the failure report.
+const (
+	defaultPstoreDir = "/sys/fs/pstore"
+
+	defaultBootLogLines = 200
+)
+
+type bootLogCollector struct {
+	pstoreDir string
+	cmdr      Commander
+	// last lines taken from each source
+	lines int
+}
+
+func newBootLogCollector(config MenderConfig) *bootLogCollector {
+	if config.RollbackBootLogLines < 0 {
+		return nil
+	}
+	c := &bootLogCollector{
+		pstoreDir: defaultPstoreDir,
+		cmdr:      &osCalls{},
+		lines:     defaultBootLogLines,
+	}
+	if config.RollbackBootLogLines > 0 {
+		c.lines = config.RollbackBootLogLines
+	}
+	return c
+}
+
+// tail returns last n lines read from r.
+func tail(r io.Reader, n int) []string {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	return lines
+}
+
+// Kernel log and console of the previous boot saved in pstore (ramoops);
+// returns lines by file name.
+func (b *bootLogCollector) pstore() map[string][]string {
+	files, err := ioutil.ReadDir(b.pstoreDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("failed to read pstore: %v", err)
+		}
+		return nil
+	}
+	logs := map[string][]string{}
+	for _, fi := range files {
+		if fi.IsDir() || !(strings.HasPrefix(fi.Name(), "dmesg-") ||
+			strings.HasPrefix(fi.Name(), "console-")) {
+			continue
+		}
+		f, err := os.Open(filepath.Join(b.pstoreDir, fi.Name()))
+		if err != nil {
+			log.Warnf("failed to read pstore: %v", err)
+			continue
+		}
+		logs[fi.Name()] = tail(f, b.lines)
+		f.Close()
+	}
+	return logs
+}
+
+// Journal of the previous boot; empty if journal is not persistent.
+func (b *bootLogCollector) journal() []string {
+	out, err := b.cmdr.Command("journalctl", "--boot=-1", "--no-pager",
+		"--lines="+strconv.Itoa(b.lines), "--output=short-monotonic").Output()
+	if err != nil {
+		log.Debugf("previous boot journal not available: %v", err)
+		return nil
+	}
+	return tail(bytes.NewReader(out), b.lines)
+}
+
+// collect copies logs of the previous boot to the deployment log.
+func (b *bootLogCollector) collect() {
+	if b == nil {
+		return
+	}
+
+	pstore := b.pstore()
+	names := make([]string, 0, len(pstore))
+	for name := range pstore {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	journal := b.journal()
+	if len(names) == 0 && len(journal) == 0 {
+		log.Info("no logs of the previous boot found")
+		return
+	}
+
+	log.Infof("attaching logs of the previous boot")
+	for _, name := range names {
+		for _, line := range pstore[name] {
+			logWithFields(logrus.Fields{
+				LogFieldSource: "pstore/" + name,
+			}).Infof("%s", line)
+		}
+	}
+	for _, line := range journal {
+		logWithFields(logrus.Fields{
+			LogFieldSource: "journal",
+		}).Infof("%s", line)
+	}
+}
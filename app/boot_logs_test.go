@@ -0,0 +1,76 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBootLogCollectorConfig(t *testing.T) {
+	b := newBootLogCollector(MenderConfig{})
+	assert.NotNil(t, b)
+	assert.Equal(t, defaultBootLogLines, b.lines)
+	assert.Equal(t, defaultPstoreDir, b.pstoreDir)
+
+	b = newBootLogCollector(MenderConfig{RollbackBootLogLines: 10})
+	assert.Equal(t, 10, b.lines)
+
+	b = newBootLogCollector(MenderConfig{RollbackBootLogLines: -1})
+	assert.Nil(t, b)
+	// disabled collector does nothing
+	b.collect()
+}
+
+func TestBootLogTail(t *testing.T) {
+	assert.Equal(t, []string{"c", "d"}, tail(strings.NewReader("a\nb\nc\nd\n"), 2))
+	assert.Equal(t, []string{"a"}, tail(strings.NewReader("a"), 2))
+	assert.Empty(t, tail(strings.NewReader(""), 2))
+}
+
+func TestBootLogPstore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pstore")
+	defer os.RemoveAll(dir)
+
+	b := &bootLogCollector{pstoreDir: filepath.Join(dir, "missing"), lines: 2}
+	assert.Empty(t, b.pstore())
+
+	ioutil.WriteFile(filepath.Join(dir, "dmesg-ramoops-0"),
+		[]byte("boot\nmount failed\nKernel panic\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "console-ramoops-0"),
+		[]byte("init\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "pmsg-ramoops-0"),
+		[]byte("user\n"), 0600)
+
+	b.pstoreDir = dir
+	assert.Equal(t, map[string][]string{
+		"dmesg-ramoops-0":   {"mount failed", "Kernel panic"},
+		"console-ramoops-0": {"init"},
+	}, b.pstore())
+}
+
+func TestBootLogJournal(t *testing.T) {
+	cmdr := newTestOSCalls("one\ntwo\nthree", 0)
+	b := &bootLogCollector{cmdr: &cmdr, lines: 2}
+	assert.Equal(t, []string{"two", "three"}, b.journal())
+
+	// no persistent journal
+	cmdr = newTestOSCalls("", 1)
+	assert.Empty(t, b.journal())
+}
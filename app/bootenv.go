@@ -11,16 +11,23 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
-package main
+package app
 
 import (
 	"bufio"
-	"errors"
 	"fmt"
 	"os/exec"
+	"sort"
 	"strings"
+	"syscall"
 
 	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+var (
+	// needed so that we can override it when testing
+	syncFilesystems = syscall.Sync
 )
 
 type uBootEnv struct {
@@ -68,6 +75,39 @@ func (e *uBootEnv) WriteEnv(vars BootVars) error {
 	return nil
 }
 
+// Ordering barrier for boot environment updates: write vars, flush all
+// filesystem buffers to persistent storage and read the variables back. Only
+// once this returns without an error the new values are guaranteed to be seen
+// by the bootloader, even if power is lost right after. Callers must not take
+// any further steps relying on the new values if an error is returned.
+func writeEnvBarrier(env BootEnvReadWriter, vars BootVars) error {
+	if err := env.WriteEnv(vars); err != nil {
+		return err
+	}
+
+	syncFilesystems()
+
+	names := make([]string, 0, len(vars))
+	for k := range vars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	readback, err := env.ReadEnv(names...)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read back boot environment")
+	}
+
+	for _, k := range names {
+		if readback[k] != vars[k] {
+			log.Errorf("boot environment variable %s is %q after write, expected %q",
+				k, readback[k], vars[k])
+			return errors.Errorf("boot environment verification failed for %s", k)
+		}
+	}
+	return nil
+}
+
 func getEnvironmentVariable(cmd *exec.Cmd) (BootVars, error) {
 	cmdReader, err := cmd.StdoutPipe()
 
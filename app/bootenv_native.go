@@ -0,0 +1,346 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// How the bootloader environment is accessed.
+const (
+	// fw_printenv and fw_setenv from u-boot-tools
+	bootEnvAccessFwUtils = "fw-utils"
+	// directly, in the same format and with the same locking as fw_printenv
+	// and fw_setenv
+	bootEnvAccessNative = "native"
+
+	defaultBootEnvConfigFile = "/etc/fw_env.config"
+)
+
+var (
+	// lock file shared with u-boot-tools; overridden in tests
+	bootEnvLockFile = "/var/lock/fw_printenv.lock"
+)
+
+// Set up access to the bootloader environment as configured.
+func NewBootEnv(config MenderConfig) (BootEnvReadWriter, error) {
+	switch config.BootEnvAccess {
+	case "", bootEnvAccessFwUtils:
+		return NewEnvironment(new(osCalls)), nil
+	case bootEnvAccessNative:
+		configFile := config.BootEnvConfigFile
+		if configFile == "" {
+			configFile = defaultBootEnvConfigFile
+		}
+		return &nativeBootEnv{configFile: configFile}, nil
+	default:
+		return nil, errors.Errorf("invalid boot environment access %q, "+
+			"must be %s or %s", config.BootEnvAccess,
+			bootEnvAccessFwUtils, bootEnvAccessNative)
+	}
+}
+
+// U-Boot environment read and written without u-boot-tools. The locations
+// come from fw_env.config, read on every access like the tools do. Each copy
+// is a CRC32 of the data, a flag byte telling which copy is newer if there
+// are two of them, and NUL separated name=value pairs ending with an empty
+// one. Only block devices and files are supported; flash (MTD) devices need
+// erasing and are left to u-boot-tools.
+type nativeBootEnv struct {
+	configFile string
+}
+
+// one copy of the environment
+type bootEnvLocation struct {
+	device string
+	offset int64
+	size   int64
+}
+
+func parseBootEnvConfig(configFile string) ([]bootEnvLocation, error) {
+	f, err := os.Open(configFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read boot environment config")
+	}
+	defer f.Close()
+
+	var locations []bootEnvLocation
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, errors.Errorf("invalid line in %s: %q", configFile, line)
+		}
+		if strings.HasPrefix(fields[0], "/dev/mtd") {
+			return nil, errors.Errorf("flash device %s not supported, "+
+				"use %s boot environment access", fields[0], bootEnvAccessFwUtils)
+		}
+		offset, err := strconv.ParseInt(fields[1], 0, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid offset in %s", configFile)
+		}
+		size, err := strconv.ParseInt(fields[2], 0, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid size in %s", configFile)
+		}
+		locations = append(locations, bootEnvLocation{fields[0], offset, size})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read boot environment config")
+	}
+	if len(locations) == 0 || len(locations) > 2 {
+		return nil, errors.Errorf("%s must list one or two environment copies, "+
+			"has %d", configFile, len(locations))
+	}
+	for _, l := range locations {
+		if l.size != locations[0].size || l.size <= 5 {
+			return nil, errors.Errorf("invalid environment size in %s", configFile)
+		}
+	}
+	return locations, nil
+}
+
+// copy of the environment as read from its location
+type bootEnvCopy struct {
+	location bootEnvLocation
+	flag     byte
+	data     []byte
+	valid    bool
+}
+
+func readBootEnvCopy(l bootEnvLocation, redundant bool) (*bootEnvCopy, error) {
+	f, err := os.Open(l.device)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open boot environment")
+	}
+	defer f.Close()
+
+	buf := make([]byte, l.size)
+	if _, err := f.ReadAt(buf, l.offset); err != nil {
+		return nil, errors.Wrapf(err, "failed to read boot environment from %s",
+			l.device)
+	}
+	c := &bootEnvCopy{location: l, data: buf[4:]}
+	if redundant {
+		c.flag = buf[4]
+		c.data = buf[5:]
+	}
+	c.valid = binary.LittleEndian.Uint32(buf) == crc32.ChecksumIEEE(c.data)
+	return c, nil
+}
+
+func (c *bootEnvCopy) write(redundant bool) error {
+	buf := make([]byte, 0, c.location.size)
+	buf = append(buf, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(buf, crc32.ChecksumIEEE(c.data))
+	if redundant {
+		buf = append(buf, c.flag)
+	}
+	buf = append(buf, c.data...)
+
+	f, err := os.OpenFile(c.location.device, os.O_WRONLY, 0)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open boot environment")
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(buf, c.location.offset); err != nil {
+		return errors.Wrapf(err, "failed to write boot environment to %s",
+			c.location.device)
+	}
+	return f.Sync()
+}
+
+// Returns the copy in use and the other one, if there are two.
+func (e *nativeBootEnv) load() (*bootEnvCopy, *bootEnvCopy, error) {
+	locations, err := parseBootEnvConfig(e.configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	redundant := len(locations) == 2
+	var copies []*bootEnvCopy
+	for _, l := range locations {
+		c, err := readBootEnvCopy(l, redundant)
+		if err != nil {
+			return nil, nil, err
+		}
+		copies = append(copies, c)
+	}
+	if !redundant {
+		if !copies[0].valid {
+			return nil, nil, errors.New("boot environment has bad CRC")
+		}
+		return copies[0], nil, nil
+	}
+
+	a, b := copies[0], copies[1]
+	switch {
+	case !a.valid && !b.valid:
+		return nil, nil, errors.New("both copies of boot environment have bad CRC")
+	case !b.valid:
+		return a, b, nil
+	case !a.valid:
+		return b, a, nil
+	}
+	// the flag is incremented with every write, wrapping around
+	switch {
+	case a.flag == 255 && b.flag == 0:
+		return b, a, nil
+	case b.flag == 255 && a.flag == 0:
+		return a, b, nil
+	case b.flag > a.flag:
+		return b, a, nil
+	default:
+		return a, b, nil
+	}
+}
+
+// Environment lock, same as the one u-boot-tools hold.
+func lockBootEnv() (func(), error) {
+	f, err := os.OpenFile(bootEnvLockFile, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open boot environment lock")
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "failed to lock boot environment")
+	}
+	// closing releases the lock
+	return func() { f.Close() }, nil
+}
+
+type bootEnvVar struct {
+	name, value string
+}
+
+func parseBootEnvData(data []byte) []bootEnvVar {
+	var vars []bootEnvVar
+	for _, entry := range bytes.Split(data, []byte{0}) {
+		if len(entry) == 0 {
+			break
+		}
+		kv := strings.SplitN(string(entry), "=", 2)
+		if len(kv) != 2 {
+			log.Warnf("ignoring malformed boot environment entry %q", entry)
+			continue
+		}
+		vars = append(vars, bootEnvVar{kv[0], kv[1]})
+	}
+	return vars
+}
+
+func (e *nativeBootEnv) ReadEnv(names ...string) (BootVars, error) {
+	unlock, err := lockBootEnv()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	current, _, err := e.load()
+	if err != nil {
+		return nil, err
+	}
+	all := make(BootVars)
+	for _, v := range parseBootEnvData(current.data) {
+		all[v.name] = v.value
+	}
+	if len(names) == 0 {
+		return all, nil
+	}
+	vars := make(BootVars)
+	for _, name := range names {
+		value, ok := all[name]
+		if !ok {
+			return nil, errors.Errorf("boot environment variable %s not defined",
+				name)
+		}
+		vars[name] = value
+	}
+	return vars, nil
+}
+
+// Sets the variables; empty value removes the variable, like fw_setenv does.
+// With two copies, the one not in use is written, so that the environment
+// is updated atomically.
+func (e *nativeBootEnv) WriteEnv(vars BootVars) error {
+	unlock, err := lockBootEnv()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, other, err := e.load()
+	if err != nil {
+		return err
+	}
+
+	var updated []bootEnvVar
+	set := make(map[string]bool)
+	for _, v := range parseBootEnvData(current.data) {
+		if value, ok := vars[v.name]; ok {
+			set[v.name] = true
+			if value == "" {
+				continue
+			}
+			v.value = value
+		}
+		updated = append(updated, v)
+	}
+	var added []string
+	for name, value := range vars {
+		if !set[name] && value != "" {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	for _, name := range added {
+		updated = append(updated, bootEnvVar{name, vars[name]})
+	}
+
+	data := make([]byte, 0, len(current.data))
+	for _, v := range updated {
+		if strings.ContainsAny(v.name, "=\x00") || strings.Contains(v.value, "\x00") {
+			return errors.Errorf("invalid boot environment variable %q", v.name)
+		}
+		data = append(data, v.name+"="+v.value+"\x00"...)
+	}
+	// terminating empty entry
+	if len(data)+1 > len(current.data) {
+		return errors.Errorf("boot environment too large: %d bytes, "+
+			"at most %d fit", len(data)+1, len(current.data))
+	}
+	data = append(data, make([]byte, len(current.data)-len(data))...)
+
+	if other == nil {
+		current.data = data
+		return current.write(false)
+	}
+	other.data = data
+	other.flag = current.flag + 1
+	return other.write(true)
+}
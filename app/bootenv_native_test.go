@@ -0,0 +1,212 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testBootEnvSize = 0x100
+
+// Writes environment copy with given entries at offset of the file.
+func writeTestBootEnv(t *testing.T, file string, offset int64, redundant bool,
+	flag byte, entries ...string) {
+
+	data := []byte(strings.Join(entries, "\x00") + "\x00\x00")
+	buf := make([]byte, testBootEnvSize)
+	hdr := 4
+	if redundant {
+		buf[4] = flag
+		hdr = 5
+	}
+	copy(buf[hdr:], data)
+	binary.LittleEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[hdr:]))
+
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
+	assert.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteAt(buf, offset)
+	assert.NoError(t, err)
+}
+
+func setupNativeBootEnv(t *testing.T, tdir string, config string) *nativeBootEnv {
+	bootEnvLockFile = path.Join(tdir, "fw_printenv.lock")
+	configFile := path.Join(tdir, "fw_env.config")
+	assert.NoError(t, ioutil.WriteFile(configFile, []byte(config), 0644))
+	env, err := NewBootEnv(MenderConfig{
+		BootEnvAccess:     bootEnvAccessNative,
+		BootEnvConfigFile: configFile,
+	})
+	assert.NoError(t, err)
+	return env.(*nativeBootEnv)
+}
+
+func TestNewBootEnv(t *testing.T) {
+	env, err := NewBootEnv(MenderConfig{})
+	assert.NoError(t, err)
+	assert.IsType(t, &uBootEnv{}, env)
+
+	env, err = NewBootEnv(MenderConfig{BootEnvAccess: bootEnvAccessNative})
+	assert.NoError(t, err)
+	assert.Equal(t, defaultBootEnvConfigFile, env.(*nativeBootEnv).configFile)
+
+	_, err = NewBootEnv(MenderConfig{BootEnvAccess: "magic"})
+	assert.Error(t, err)
+}
+
+func TestNativeBootEnvSingle(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "bootenv")
+	defer os.RemoveAll(tdir)
+	oldLock := bootEnvLockFile
+	defer func() { bootEnvLockFile = oldLock }()
+
+	dev := path.Join(tdir, "disk")
+	writeTestBootEnv(t, dev, 0x400, false, 0,
+		"mender_boot_part=2", "upgrade_available=0", "bootargs=a=b c")
+	env := setupNativeBootEnv(t, tdir,
+		fmt.Sprintf("# comment\n\n%s 0x400 0x%x\n", dev, testBootEnvSize))
+
+	vars, err := env.ReadEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "2", "upgrade_available": "0",
+		"bootargs": "a=b c"}, vars)
+
+	vars, err = env.ReadEnv("mender_boot_part")
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "2"}, vars)
+
+	_, err = env.ReadEnv("mender_boot_part", "non_existing_var")
+	assert.Error(t, err)
+
+	// update, add and remove
+	assert.NoError(t, env.WriteEnv(BootVars{"mender_boot_part": "3",
+		"bootcount": "0", "upgrade_available": ""}))
+	vars, err = env.ReadEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "3", "bootcount": "0",
+		"bootargs": "a=b c"}, vars)
+
+	// readable by u-boot-tools: order kept, new variables at the end
+	raw, _ := ioutil.ReadFile(dev)
+	data := raw[0x404 : 0x400+testBootEnvSize]
+	assert.Equal(t, binary.LittleEndian.Uint32(raw[0x400:]), crc32.ChecksumIEEE(data))
+	assert.True(t, strings.HasPrefix(string(data),
+		"mender_boot_part=3\x00bootargs=a=b c\x00bootcount=0\x00\x00"))
+
+	assert.Error(t, env.WriteEnv(BootVars{"big": strings.Repeat("x", testBootEnvSize)}))
+	assert.Error(t, env.WriteEnv(BootVars{"a=b": "c"}))
+
+	// corrupted environment is not used
+	f, _ := os.OpenFile(dev, os.O_RDWR, 0)
+	f.WriteAt([]byte("garbage"), 0x420)
+	f.Close()
+	_, err = env.ReadEnv()
+	assert.Error(t, err)
+	assert.Error(t, env.WriteEnv(BootVars{"bootcount": "1"}))
+}
+
+func TestNativeBootEnvRedundant(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "bootenv")
+	defer os.RemoveAll(tdir)
+	oldLock := bootEnvLockFile
+	defer func() { bootEnvLockFile = oldLock }()
+
+	dev := path.Join(tdir, "disk")
+	env := setupNativeBootEnv(t, tdir, fmt.Sprintf("%s 0x0 0x%x\n%s 0x%x 0x%x\n",
+		dev, testBootEnvSize, dev, testBootEnvSize, testBootEnvSize))
+
+	readPart := func() string {
+		vars, err := env.ReadEnv("mender_boot_part")
+		assert.NoError(t, err)
+		return vars["mender_boot_part"]
+	}
+
+	// newer copy is used
+	writeTestBootEnv(t, dev, 0, true, 4, "mender_boot_part=2")
+	writeTestBootEnv(t, dev, testBootEnvSize, true, 5, "mender_boot_part=3")
+	assert.Equal(t, "3", readPart())
+
+	// flag wraps around
+	writeTestBootEnv(t, dev, 0, true, 0, "mender_boot_part=2")
+	writeTestBootEnv(t, dev, testBootEnvSize, true, 255, "mender_boot_part=3")
+	assert.Equal(t, "2", readPart())
+
+	// copy not in use is written, with flag incremented
+	assert.NoError(t, env.WriteEnv(BootVars{"mender_boot_part": "3"}))
+	assert.Equal(t, "3", readPart())
+	raw, _ := ioutil.ReadFile(dev)
+	assert.Equal(t, byte(1), raw[testBootEnvSize+4])
+	assert.Equal(t, byte(0), raw[4])
+
+	assert.NoError(t, env.WriteEnv(BootVars{"mender_boot_part": "2"}))
+	assert.Equal(t, "2", readPart())
+	raw, _ = ioutil.ReadFile(dev)
+	assert.Equal(t, byte(2), raw[4])
+
+	// copy with bad CRC is not used, and is written next
+	f, _ := os.OpenFile(dev, os.O_RDWR, 0)
+	f.WriteAt([]byte("garbage"), 0x20)
+	f.Close()
+	assert.Equal(t, "3", readPart())
+	assert.NoError(t, env.WriteEnv(BootVars{"mender_boot_part": "2"}))
+	assert.Equal(t, "2", readPart())
+
+	// both copies bad
+	f, _ = os.OpenFile(dev, os.O_RDWR, 0)
+	f.WriteAt([]byte("garbage"), 0x20)
+	f.WriteAt([]byte("garbage"), testBootEnvSize+0x20)
+	f.Close()
+	_, err := env.ReadEnv()
+	assert.Error(t, err)
+}
+
+func TestNativeBootEnvConfig(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "bootenv")
+	defer os.RemoveAll(tdir)
+	oldLock := bootEnvLockFile
+	defer func() { bootEnvLockFile = oldLock }()
+
+	for _, config := range []string{
+		"",
+		"/dev/mmcblk0 0x400000\n",
+		"/dev/mmcblk0 offset 0x4000\n",
+		"/dev/mmcblk0 0x400000 size\n",
+		"/dev/mmcblk0 0x400000 0x4000\n/dev/mmcblk0 0x800000 0x2000\n",
+		"/dev/mmcblk0 0 1\n/dev/mmcblk0 1 1\n/dev/mmcblk0 2 1\n",
+		"/dev/mtd1 0x0 0x4000 0x10000\n",
+	} {
+		env := setupNativeBootEnv(t, tdir, config)
+		_, err := env.ReadEnv()
+		assert.Error(t, err, config)
+	}
+
+	// missing device
+	env := setupNativeBootEnv(t, tdir, "/non/existing 0x0 0x4000\n")
+	_, err := env.ReadEnv()
+	assert.Error(t, err)
+
+	// missing config
+	env = &nativeBootEnv{configFile: path.Join(tdir, "missing")}
+	_, err = env.ReadEnv()
+	assert.Error(t, err)
+}
@@ -11,9 +11,14 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
-package main
+package app
 
-import "testing"
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
 
 //if no config file is present
 //Cannot parse config file: No such file or directory
@@ -128,3 +133,103 @@ func Test_EnvRead_NonExisting_FailsReading(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+var errPowerLoss = errors.New("power lost")
+
+// Boot environment simulating power loss. Written variables reach persistent
+// storage only after a filesystem sync, reads always come from persistent
+// storage. Once opsLeft reaches 0 the power is gone and nothing succeeds
+// anymore; negative opsLeft means no power loss at all.
+type crashingBootEnv struct {
+	persisted BootVars
+	pending   BootVars
+	opsLeft   int
+}
+
+func newCrashingBootEnv(persisted BootVars, opsLeft int) *crashingBootEnv {
+	return &crashingBootEnv{
+		persisted: persisted,
+		pending:   BootVars{},
+		opsLeft:   opsLeft,
+	}
+}
+
+func (e *crashingBootEnv) powered() bool {
+	if e.opsLeft == 0 {
+		return false
+	}
+	if e.opsLeft > 0 {
+		e.opsLeft--
+	}
+	return true
+}
+
+func (e *crashingBootEnv) WriteEnv(vars BootVars) error {
+	if !e.powered() {
+		return errPowerLoss
+	}
+	for k, v := range vars {
+		e.pending[k] = v
+	}
+	return nil
+}
+
+func (e *crashingBootEnv) ReadEnv(names ...string) (BootVars, error) {
+	if !e.powered() {
+		return nil, errPowerLoss
+	}
+	vars := BootVars{}
+	for _, n := range names {
+		vars[n] = e.persisted[n]
+	}
+	if len(names) == 0 {
+		// all of them, like fw_printenv
+		for k, v := range e.persisted {
+			vars[k] = v
+		}
+	}
+	return vars, nil
+}
+
+func (e *crashingBootEnv) sync() {
+	if !e.powered() {
+		return
+	}
+	for k, v := range e.pending {
+		e.persisted[k] = v
+	}
+	e.pending = BootVars{}
+}
+
+func TestWriteEnvBarrier(t *testing.T) {
+	oldSync := syncFilesystems
+	defer func() {
+		syncFilesystems = oldSync
+	}()
+
+	env := newCrashingBootEnv(BootVars{"upgrade_available": "1"}, -1)
+	syncFilesystems = env.sync
+
+	err := writeEnvBarrier(env, BootVars{"upgrade_available": "0", "bootcount": "0"})
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"upgrade_available": "0", "bootcount": "0"}, env.persisted)
+
+	// data never reaches the storage, readback must catch that
+	env = newCrashingBootEnv(BootVars{"upgrade_available": "1"}, -1)
+	syncFilesystems = func() {}
+
+	err = writeEnvBarrier(env, BootVars{"upgrade_available": "0"})
+	assert.Error(t, err)
+
+	// write failure
+	env = newCrashingBootEnv(BootVars{}, 0)
+	syncFilesystems = env.sync
+	err = writeEnvBarrier(env, BootVars{"upgrade_available": "0"})
+	assert.Equal(t, errPowerLoss, err)
+
+	// readback failure
+	env = newCrashingBootEnv(BootVars{}, 2)
+	syncFilesystems = env.sync
+	err = writeEnvBarrier(env, BootVars{"upgrade_available": "0"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,196 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/pkg/errors"
+)
+
+// Commands run in the phases of a bundle update; {bundle} in the arguments
+// is replaced with the path of the bundle. Commands not given are skipped.
+type BundleCommands struct {
+	// installs the bundle and makes the device boot into it
+	Install []string
+	// run once the device is running fine after installing the bundle
+	Commit []string
+	// makes the device boot the previous version again
+	Rollback []string
+}
+
+// Commands of supported bundle formats, used unless configured otherwise.
+// SWUpdate has no standard way of confirming or reverting an update, it
+// depends on the bootloader integration.
+var defaultBundleCommands = map[string]BundleCommands{
+	installer.RAUCBundleUpdateType: {
+		Install:  []string{"rauc", "install", "{bundle}"},
+		Commit:   []string{"rauc", "status", "mark-good"},
+		Rollback: []string{"rauc", "status", "mark-active", "other"},
+	},
+	installer.SWUpdateBundleUpdateType: {
+		Install: []string{"swupdate", "-i", "{bundle}"},
+	},
+}
+
+// present while bundle update is not committed; holds the format of the
+// bundle
+const bundlePendingName = "pending"
+
+// Update bundles of other update frameworks (RAUC, SWUpdate), installed with
+// their own tools, so that fleets can be moved over without repackaging the
+// updates first. The tools take care of writing and activating the update on
+// install; the client only tells them to commit or roll back.
+type externalBundles struct {
+	Commander
+	dir      string
+	commands map[string]BundleCommands
+}
+
+func newExternalBundles(cmd Commander, dir string,
+	commands map[string]BundleCommands) *externalBundles {
+	if len(commands) == 0 {
+		return nil
+	}
+	b := &externalBundles{Commander: cmd, dir: dir,
+		commands: make(map[string]BundleCommands)}
+	for format, c := range commands {
+		def := defaultBundleCommands[format]
+		if c.Install == nil {
+			c.Install = def.Install
+		}
+		if c.Commit == nil {
+			c.Commit = def.Commit
+		}
+		if c.Rollback == nil {
+			c.Rollback = def.Rollback
+		}
+		b.commands[format] = c
+	}
+	return b
+}
+
+func validateBundleCommands(commands map[string]BundleCommands) error {
+	for format, c := range commands {
+		if _, ok := defaultBundleCommands[format]; !ok {
+			return errors.Errorf("unknown bundle format %q", format)
+		}
+		if c.Install == nil && defaultBundleCommands[format].Install == nil {
+			return errors.Errorf("no install command for %s bundles", format)
+		}
+	}
+	return nil
+}
+
+func (b *externalBundles) run(args []string, bundle string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	expanded := make([]string, len(args))
+	for i, a := range args {
+		expanded[i] = strings.Replace(a, "{bundle}", bundle, -1)
+	}
+	log.Infof("running %s", strings.Join(expanded, " "))
+	out, err := b.Command(expanded[0], expanded[1:]...).CombinedOutput()
+	if len(out) > 0 {
+		log.Infof("%s output: %s", expanded[0], out)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "%s failed", expanded[0])
+	}
+	return nil
+}
+
+// Format of the bundle installed and not committed yet; empty if none.
+func (b *externalBundles) pending() string {
+	data, err := ioutil.ReadFile(filepath.Join(b.dir, bundlePendingName))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func (b *externalBundles) install(format string, r io.Reader) error {
+	commands, ok := b.commands[format]
+	if !ok {
+		return errors.Wrapf(installer.ErrBundlesUnsupported,
+			"%s bundles not configured", format)
+	}
+	if b.pending() != "" {
+		return errors.New("bundle update not committed yet")
+	}
+	if err := os.MkdirAll(b.dir, 0700); err != nil {
+		return errors.Wrapf(err, "failed to create bundle directory")
+	}
+
+	// the tools need the bundle as file
+	bundle := filepath.Join(b.dir, "update."+format)
+	defer os.Remove(bundle)
+	if err := writeFileFrom(bundle, r, 0600); err != nil {
+		return errors.Wrapf(err, "failed to store %s bundle", format)
+	}
+	if err := b.run(commands.Install, bundle); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(b.dir, bundlePendingName),
+		[]byte(format), 0644); err != nil {
+		return errors.Wrapf(err, "failed to mark bundle update pending")
+	}
+	syncFilesystems()
+	return nil
+}
+
+// Run commit or rollback command of the pending bundle update, which is
+// finished then.
+func (b *externalBundles) finish(commit bool) error {
+	format := b.pending()
+	commands := b.commands[format]
+	args, phase := commands.Rollback, "rollback"
+	if commit {
+		args, phase = commands.Commit, "commit"
+	}
+	log.Infof("%s of %s bundle update", phase, format)
+	if err := b.run(args, ""); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(b.dir, bundlePendingName)); err != nil {
+		return errors.Wrapf(err, "failed to finish %s bundle update", format)
+	}
+	syncFilesystems()
+	return nil
+}
+
+// InstallBundle installs update bundle of another update framework with its
+// tool; the bundle is active then and EnableUpdatedPartition() does nothing.
+func (d *device) InstallBundle(format string, r io.Reader, size int64) error {
+	if d.bundles == nil {
+		return installer.ErrBundlesUnsupported
+	}
+	log.Debugf("installing %s bundle of size: %d", format, size)
+	d.appUpdate = false
+	d.bundleUpdate = true
+	return d.bundles.install(format, r)
+}
+
+// Whether bundle update was installed and waits for commit or rollback.
+func (d *device) bundleUpdatePending() bool {
+	return d.bundles != nil && d.bundles.pending() != ""
+}
@@ -0,0 +1,124 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/installer"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExternalBundleCommands(t *testing.T) {
+	assert.Nil(t, newExternalBundles(&luksTestCommander{}, "/data", nil))
+
+	b := newExternalBundles(&luksTestCommander{}, "/data", map[string]BundleCommands{
+		"rauc":     {Commit: []string{"true"}},
+		"swupdate": {Commit: []string{"fw_setenv", "ustate", "0"}},
+	})
+	assert.Equal(t, BundleCommands{
+		Install:  []string{"rauc", "install", "{bundle}"},
+		Commit:   []string{"true"},
+		Rollback: []string{"rauc", "status", "mark-active", "other"},
+	}, b.commands["rauc"])
+	assert.Equal(t, []string{"swupdate", "-i", "{bundle}"}, b.commands["swupdate"].Install)
+	assert.Nil(t, b.commands["swupdate"].Rollback)
+
+	assert.NoError(t, validateBundleCommands(nil))
+	assert.NoError(t, validateBundleCommands(map[string]BundleCommands{"rauc": {}}))
+	assert.Error(t, validateBundleCommands(map[string]BundleCommands{"mender": {}}))
+
+	_, err := NewMender(MenderConfig{
+		ExternalBundleInstallers: map[string]BundleCommands{"ostree": {}},
+	}, MenderPieces{store: utils.NewMemStore()})
+	assert.Error(t, err)
+}
+
+func TestDeviceInstallBundle(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "bundles")
+	defer os.RemoveAll(tdir)
+	oldSync := syncFilesystems
+	defer func() { syncFilesystems = oldSync }()
+	syncFilesystems = func() {}
+
+	// without bundles configured
+	dev := NewDevice(nil, nil, deviceConfig{})
+	err := dev.InstallBundle("rauc", bytes.NewBufferString("bundle"), 6)
+	assert.Equal(t, installer.ErrBundlesUnsupported, err)
+
+	cmd := &luksTestCommander{retCodes: map[string]int{}}
+	dir := path.Join(tdir, "bundles")
+	dev = NewDevice(nil, nil, deviceConfig{
+		bundleDir:      dir,
+		bundleCommands: map[string]BundleCommands{"rauc": {}},
+	})
+	dev.bundles.Commander = cmd
+
+	err = dev.InstallBundle("swupdate", bytes.NewBufferString("bundle"), 6)
+	assert.Equal(t, installer.ErrBundlesUnsupported, errors.Cause(err))
+
+	// failed install leaves nothing behind
+	cmd.retCodes["install"] = 1
+	assert.Error(t, dev.InstallBundle("rauc", bytes.NewBufferString("bundle"), 6))
+	assert.False(t, dev.bundleUpdatePending())
+	files, _ := ioutil.ReadDir(dir)
+	assert.Empty(t, files)
+
+	cmd.retCodes["install"] = 0
+	cmd.calls = nil
+	assert.NoError(t, dev.InstallBundle("rauc", bytes.NewBufferString("bundle"), 6))
+	bundle := path.Join(dir, "update.rauc")
+	assert.Equal(t, []string{"rauc install " + bundle}, cmd.calls)
+	_, err = os.Stat(bundle)
+	assert.True(t, os.IsNotExist(err))
+
+	// activated by rauc already
+	cmd.calls = nil
+	assert.NoError(t, dev.EnableUpdatedPartition())
+	assert.Empty(t, cmd.calls)
+
+	// pending across restarts
+	dev = NewDevice(nil, nil, deviceConfig{
+		bundleDir:      dir,
+		bundleCommands: map[string]BundleCommands{"rauc": {}},
+	})
+	dev.bundles.Commander = cmd
+	has, err := dev.HasUpdate()
+	assert.NoError(t, err)
+	assert.True(t, has)
+	assert.Error(t, dev.InstallBundle("rauc", bytes.NewBufferString("bundle"), 6))
+
+	// failed commit can be retried
+	cmd.retCodes["status"] = 1
+	assert.Error(t, dev.CommitUpdate())
+	assert.True(t, dev.bundleUpdatePending())
+	cmd.retCodes["status"] = 0
+	cmd.calls = nil
+	assert.NoError(t, dev.CommitUpdate())
+	assert.Equal(t, []string{"rauc status mark-good"}, cmd.calls)
+	assert.False(t, dev.bundleUpdatePending())
+
+	// rollback
+	assert.NoError(t, dev.InstallBundle("rauc", bytes.NewBufferString("bundle"), 6))
+	cmd.calls = nil
+	assert.NoError(t, dev.Rollback())
+	assert.Equal(t, []string{"rauc status mark-active other"}, cmd.calls)
+	assert.False(t, dev.bundleUpdatePending())
+}
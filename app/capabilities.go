@@ -0,0 +1,138 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/installer"
+)
+
+// Speeds measured during the last update, kept for the capability hints sent
+// with update checks (ReportDeviceCapabilities).
+const transferRatesName = "transfer-rates"
+
+// Free space is reported in steps, so that update checks do not differ, and
+// conditional checks are not defeated, with every file written on the device.
+const freeSpaceStepMB = 16
+
+type transferRates struct {
+	// download speed, bytes per second
+	LinkSpeed int64 `json:"link_speed,omitempty"`
+	// artifact download and install, bytes per second
+	InstallRate int64 `json:"install_rate,omitempty"`
+}
+
+func loadTransferRates(store Store) transferRates {
+	var r transferRates
+	data, err := store.ReadAll(transferRatesName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("failed to read transfer rates: %v", err)
+		}
+		return r
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		log.Warnf("discarding broken transfer rates: %v", err)
+		return transferRates{}
+	}
+	return r
+}
+
+func (r transferRates) save(store Store) {
+	data, _ := json.Marshal(r)
+	if err := store.WriteAll(transferRatesName, data); err != nil {
+		log.Errorf("failed to save transfer rates: %v", err)
+	}
+}
+
+// Reader passing on the data of the image stream it wraps.
+type imageStreamWrapper interface {
+	imageStream() io.Reader
+}
+
+// Rates of the artifact of size installed in elapsed time; download speed
+// is taken from the image stream if it reports it.
+func measureTransferRates(size int64, elapsed time.Duration,
+	image interface{}) transferRates {
+	var r transferRates
+	if secs := elapsed.Seconds(); size > 0 && secs > 0 {
+		r.InstallRate = int64(float64(size) / secs)
+	}
+	for {
+		w, ok := image.(imageStreamWrapper)
+		if !ok {
+			break
+		}
+		image = w.imageStream()
+	}
+	if dr, ok := image.(client.FetchDiagnosticsReporter); ok {
+		r.LinkSpeed = dr.FetchDiagnostics().Throughput
+	}
+	return r
+}
+
+// Device telling what types of updates it can install.
+type payloadTypesLister interface {
+	payloadTypes() []string
+}
+
+func (d *device) payloadTypes() []string {
+	types := []string{installer.RootfsUpdateType}
+	if d.apps != nil {
+		types = append(types, installer.AppSlotUpdateType)
+	}
+	if d.bundles != nil {
+		var formats []string
+		for format := range d.bundles.commands {
+			formats = append(formats, format)
+		}
+		sort.Strings(formats)
+		types = append(types, formats...)
+	}
+	return types
+}
+
+// Capability hints for update checks; nil if they are not to be reported.
+func (m *mender) deviceCapabilities() *client.DeviceCapabilities {
+	if !m.config.ReportDeviceCapabilities {
+		return nil
+	}
+	rates := loadTransferRates(m.store)
+	c := &client.DeviceCapabilities{
+		LinkSpeed:   rates.LinkSpeed,
+		InstallRate: rates.InstallRate,
+		// delta artifacts are not supported yet
+		SupportsDelta: false,
+	}
+	if m.scratch != nil {
+		if avail, err := m.scratch.available(m.scratch.path); err == nil {
+			c.FreeSpaceMB = int64(avail>>20) / freeSpaceStepMB * freeSpaceStepMB
+		} else {
+			log.Debugf("free space of %s not known: %v", m.scratch.path, err)
+		}
+	}
+	if dev, ok := m.UInstallCommitRebooter.(payloadTypesLister); ok {
+		c.PayloadTypes = dev.payloadTypes()
+	} else {
+		c.PayloadTypes = []string{installer.RootfsUpdateType}
+	}
+	return c
+}
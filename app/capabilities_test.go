@@ -0,0 +1,127 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeFetchDiagnostics struct {
+	throughput int64
+}
+
+func (f fakeFetchDiagnostics) FetchDiagnostics() client.FetchDiagnostics {
+	return client.FetchDiagnostics{Throughput: f.throughput}
+}
+
+func TestTransferRates(t *testing.T) {
+	store := utils.NewMemStore()
+	assert.Equal(t, transferRates{}, loadTransferRates(store))
+
+	r := measureTransferRates(10<<20, 10*time.Second, fakeFetchDiagnostics{2 << 20})
+	assert.Equal(t, transferRates{LinkSpeed: 2 << 20, InstallRate: 1 << 20}, r)
+	// download speed of the stream wrapped for install
+	r = measureTransferRates(10<<20, 10*time.Second, &contextReader{
+		r: &abortCheckReader{r: struct {
+			io.ReadCloser
+			fakeFetchDiagnostics
+		}{fakeFetchDiagnostics: fakeFetchDiagnostics{2 << 20}}},
+	})
+	assert.Equal(t, transferRates{LinkSpeed: 2 << 20, InstallRate: 1 << 20}, r)
+	r.save(store)
+	assert.Equal(t, r, loadTransferRates(store))
+
+	// stream without diagnostics, nothing measured
+	assert.Equal(t, transferRates{InstallRate: 100},
+		measureTransferRates(100, time.Second, nil))
+	assert.Equal(t, transferRates{}, measureTransferRates(100, 0, nil))
+
+	store.WriteAll(transferRatesName, []byte("garbage"))
+	assert.Equal(t, transferRates{}, loadTransferRates(store))
+}
+
+func TestDevicePayloadTypes(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "payload-types")
+	defer os.RemoveAll(tdir)
+
+	dev := &device{}
+	assert.Equal(t, []string{"rootfs-image"}, dev.payloadTypes())
+
+	dev.apps = newAppSlots(tdir)
+	dev.bundles = newExternalBundles(&osCalls{}, tdir, map[string]BundleCommands{
+		"swupdate": {},
+		"rauc":     {},
+	})
+	assert.Equal(t, []string{"rootfs-image", "app-slot", "rauc", "swupdate"},
+		dev.payloadTypes())
+}
+
+func TestDeviceCapabilities(t *testing.T) {
+	mender := newTestMender(nil, MenderConfig{}, testMenderPieces{})
+	assert.Nil(t, mender.deviceCapabilities())
+
+	mender = newTestMender(nil, MenderConfig{ReportDeviceCapabilities: true},
+		testMenderPieces{})
+	mender.scratch = &scratchDir{
+		path: "/data/mender/scratch",
+		available: func(string) (uint64, error) {
+			return 100<<20 + 12345, nil
+		},
+	}
+	transferRates{LinkSpeed: 1000, InstallRate: 500}.save(mender.store)
+
+	assert.Equal(t, &client.DeviceCapabilities{
+		// rounded down to the step
+		FreeSpaceMB:  96,
+		LinkSpeed:    1000,
+		InstallRate:  500,
+		PayloadTypes: []string{"rootfs-image"},
+	}, mender.deviceCapabilities())
+
+	// sent with update checks
+	var query map[string][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	td, _ := ioutil.TempDir("", "capabilities")
+	defer os.RemoveAll(td)
+	mender.artifactInfoFile = path.Join(td, "artifact_info")
+	mender.deviceTypeFile = path.Join(td, "device_type")
+	ioutil.WriteFile(mender.artifactInfoFile, []byte("artifact_name=release-1"), 0600)
+	ioutil.WriteFile(mender.deviceTypeFile, []byte("device_type=hammer"), 0600)
+	mender.config.ServerURL = srv.URL
+
+	_, merr := mender.CheckUpdate(context.Background())
+	assert.Nil(t, merr)
+	assert.Equal(t, []string{"96"}, query["free_space_mb"])
+	assert.Equal(t, []string{"1000"}, query["link_speed"])
+	assert.Equal(t, []string{"500"}, query["install_rate"])
+	assert.Equal(t, []string{"rootfs-image"}, query["payload_types"])
+	assert.Equal(t, []string{"false"}, query["supports_delta"])
+}
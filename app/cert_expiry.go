@@ -0,0 +1,80 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+)
+
+// how long before certificate expiry to start warning, unless configured
+const defaultCertExpiryWarning = 30 * 24 * time.Hour
+
+func (m *mender) getCertExpiryWarningPeriod() time.Duration {
+	if m.config.CertificateExpiryWarningDays > 0 {
+		return time.Duration(m.config.CertificateExpiryWarningDays) * 24 * time.Hour
+	}
+	return defaultCertExpiryWarning
+}
+
+// Check certificates the device needs for talking to the server (chain
+// presented by the server, trusted CA and client certificate files) for
+// approaching expiry. Returns warnings, which are logged as well.
+func (m *mender) checkCertExpiry(now time.Time) []string {
+	var certs []client.CertExpiry
+	if m.api != nil {
+		certs = append(certs, m.api.ServerCertExpiry()...)
+	}
+	for _, file := range []string{
+		m.config.ServerCertificate,
+		m.config.HttpsClient.Certificate,
+	} {
+		if file == "" {
+			continue
+		}
+		fc, err := client.LoadCertExpiry(file)
+		if err != nil {
+			log.Warnf("failed to check certificate expiry: %v", err)
+			continue
+		}
+		certs = append(certs, fc...)
+	}
+
+	warnings := certExpiryWarnings(certs, now, m.getCertExpiryWarningPeriod())
+	for _, w := range warnings {
+		log.Warn(w)
+	}
+	return warnings
+}
+
+func certExpiryWarnings(certs []client.CertExpiry, now time.Time,
+	period time.Duration) []string {
+	var warnings []string
+	for _, cert := range certs {
+		if cert.NotAfter.After(now.Add(period)) {
+			continue
+		}
+		verb := "expires"
+		if cert.NotAfter.Before(now) {
+			verb = "expired"
+		}
+		warnings = append(warnings, fmt.Sprintf("%s certificate %q %s on %s",
+			cert.Source, cert.Subject, verb,
+			cert.NotAfter.UTC().Format(time.RFC3339)))
+	}
+	return warnings
+}
@@ -0,0 +1,56 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertExpiryWarnings(t *testing.T) {
+	now := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	certs := []client.CertExpiry{
+		{Source: "server", Subject: "fine", NotAfter: now.Add(365 * 24 * time.Hour)},
+		{Source: "server", Subject: "soon", NotAfter: now.Add(24 * time.Hour)},
+		{Source: "ca.crt", Subject: "gone", NotAfter: now.Add(-time.Hour)},
+	}
+	assert.Equal(t, []string{
+		`server certificate "soon" expires on 2017-06-02T00:00:00Z`,
+		`ca.crt certificate "gone" expired on 2017-05-31T23:00:00Z`,
+	}, certExpiryWarnings(certs, now, defaultCertExpiryWarning))
+
+	assert.Empty(t, certExpiryWarnings(certs[:1], now, defaultCertExpiryWarning))
+	assert.Empty(t, certExpiryWarnings(nil, now, defaultCertExpiryWarning))
+}
+
+func TestCheckCertExpiry(t *testing.T) {
+	m := newTestMender(nil, MenderConfig{
+		ServerCertificate: "../client/server.crt",
+	}, testMenderPieces{})
+	assert.Equal(t, defaultCertExpiryWarning, m.getCertExpiryWarningPeriod())
+	// valid until 2084
+	assert.Empty(t, m.checkCertExpiry(time.Now()))
+	assert.Len(t, m.checkCertExpiry(time.Date(2084, 1, 1, 0, 0, 0, 0, time.UTC)), 1)
+
+	m.config.CertificateExpiryWarningDays = 7
+	assert.Equal(t, 7*24*time.Hour, m.getCertExpiryWarningPeriod())
+	assert.Empty(t, m.checkCertExpiry(time.Date(2084, 1, 1, 0, 0, 0, 0, time.UTC)))
+
+	// unreadable files are skipped
+	m.config.HttpsClient.Certificate = "non-existing.crt"
+	assert.Empty(t, m.checkCertExpiry(time.Now()))
+}
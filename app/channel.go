@@ -0,0 +1,67 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"os"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+const updateChannelName = "update-channel"
+
+var (
+	ErrInvalidUpdateChannel = errors.New("invalid update channel name")
+
+	validUpdateChannel = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+)
+
+// Read update channel (stable, beta, canary, ...) selected for the device.
+// Empty string is returned if no channel was selected, in which case the
+// server decides which artifacts the device gets.
+func loadUpdateChannel(store Store) (string, error) {
+	data, err := store.ReadAll(updateChannelName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", errors.Wrapf(err, "failed to read update channel")
+	}
+	return string(data), nil
+}
+
+// Save update channel selected for the device. Empty channel removes the
+// selection.
+func storeUpdateChannel(store Store, channel string) error {
+	if channel == "" {
+		// remove only if there is one
+		if current, err := loadUpdateChannel(store); err != nil || current == "" {
+			return err
+		}
+		if err := store.Remove(updateChannelName); err != nil {
+			return errors.Wrapf(err, "failed to remove update channel")
+		}
+		return nil
+	}
+
+	if !validUpdateChannel.MatchString(channel) {
+		return errors.Wrapf(ErrInvalidUpdateChannel, "channel %q", channel)
+	}
+
+	if err := store.WriteAll(updateChannelName, []byte(channel)); err != nil {
+		return errors.Wrapf(err, "failed to save update channel")
+	}
+	return nil
+}
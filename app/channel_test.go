@@ -0,0 +1,71 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateChannel(t *testing.T) {
+	ms := utils.NewMemStore()
+
+	// nothing selected
+	ch, err := loadUpdateChannel(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, "", ch)
+	// clearing when nothing is selected is fine
+	assert.NoError(t, storeUpdateChannel(ms, ""))
+
+	assert.NoError(t, storeUpdateChannel(ms, "beta"))
+	ch, err = loadUpdateChannel(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, "beta", ch)
+
+	err = storeUpdateChannel(ms, "beta; rm -rf")
+	assert.Error(t, err)
+	assert.Equal(t, ErrInvalidUpdateChannel, errors.Cause(err))
+	// previous selection is kept
+	ch, _ = loadUpdateChannel(ms)
+	assert.Equal(t, "beta", ch)
+
+	assert.NoError(t, storeUpdateChannel(ms, ""))
+	ch, err = loadUpdateChannel(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, "", ch)
+
+	// store failures are reported
+	ms.Disable(true)
+	_, err = loadUpdateChannel(ms)
+	assert.Error(t, err)
+	assert.Error(t, storeUpdateChannel(ms, "stable"))
+}
+
+func TestMenderUpdateChannel(t *testing.T) {
+	ms := utils.NewMemStore()
+	mender := newTestMender(nil, MenderConfig{},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+			},
+		})
+	assert.Equal(t, "", mender.GetUpdateChannel())
+
+	// selection done through the store is picked up right away
+	assert.NoError(t, storeUpdateChannel(ms, "canary"))
+	assert.Equal(t, "canary", mender.GetUpdateChannel())
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+const checkUpdateTimeout = time.Minute
+
+// Authorize with the server and ask it for an update, without installing it.
+// Returns ErrNoUpdateAvailable or ErrAlreadyInstalled if there is nothing to
+// install.
+func doCheckUpdate(config *MenderConfig, dataStore string, out io.Writer) error {
+	mp, err := commonInit(config, dataStore, NewIdentityDataGetter())
+	if err != nil {
+		return err
+	}
+	defer mp.store.Close()
+
+	controller, err := NewMender(*config, *mp)
+	if err != nil {
+		return errors.Wrap(err, "error initializing mender controller")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkUpdateTimeout)
+	defer cancel()
+
+	if merr := controller.Bootstrap(); merr != nil {
+		return merr.Cause()
+	}
+	if merr := controller.Authorize(ctx); merr != nil {
+		return merr.Cause()
+	}
+	update, merr := controller.CheckUpdate(ctx)
+	if merr != nil && merr.Cause() != os.ErrExist {
+		return merr.Cause()
+	}
+	if update == nil {
+		printCheckUpdate(out, nil, false)
+		return ErrNoUpdateAvailable
+	}
+	installed := merr != nil ||
+		update.ArtifactName() == controller.GetCurrentArtifactName()
+	printCheckUpdate(out, update, installed)
+	if installed {
+		return ErrAlreadyInstalled
+	}
+	return nil
+}
+
+func printCheckUpdate(out io.Writer, update *client.UpdateResponse, installed bool) {
+	if isJSONOutput(out) {
+		result := struct {
+			Available    bool   `json:"available"`
+			Installed    bool   `json:"installed"`
+			ArtifactName string `json:"artifact_name,omitempty"`
+			DeploymentID string `json:"deployment_id,omitempty"`
+		}{}
+		if update != nil {
+			result.Available = !installed
+			result.Installed = installed
+			result.ArtifactName = update.ArtifactName()
+			result.DeploymentID = update.ID
+		}
+		printJSON(out, result)
+		return
+	}
+	switch {
+	case update == nil:
+		fmt.Fprintln(out, "no update available")
+	case installed:
+		fmt.Fprintf(out, "artifact %s is installed already (deployment %s)\n",
+			update.ArtifactName(), update.ID)
+	default:
+		fmt.Fprintf(out, "update available: %s (deployment %s)\n",
+			update.ArtifactName(), update.ID)
+	}
+}
+
+// Commit the update waiting for it; ErrNothingToCommit if there is none.
+// Payloads recorded in store when the update was installed are provided from
+// now on.
+func doCommit(device UInstallCommitRebooter, store Store) error {
+	has, err := device.HasUpdate()
+	if err != nil {
+		return errors.Wrapf(err, "failed to check for update to commit")
+	}
+	if !has {
+		return ErrNothingToCommit
+	}
+	if err := device.CommitUpdate(); err != nil {
+		return err
+	}
+	commitArtifactProvides(store)
+	return nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// How much of the inactive partition is zeroed after a failed install; covers
+// the superblocks of all filesystems the bootloader could try to boot.
+const cleanupZeroSize = 1024 * 1024
+
+var errCleanupBootPartition = errors.New("inactive partition is set to be " +
+	"booted, not cleaning it up")
+
+// Implemented by devices able to clean up after a failed install.
+type updateCleaner interface {
+	CleanupUpdate(zeroPartition bool) error
+}
+
+// Remove what was left behind by failed or aborted install. Partially
+// installed application slot is removed; otherwise, if `zeroPartition` is set,
+// the head of the inactive partition is zeroed, so that it can not be booted
+// by accident.
+func (d *device) CleanupUpdate(zeroPartition bool) error {
+	// install interrupted by power loss is recognized by the slot left
+	// without artifact info
+	if d.apps != nil && (d.appUpdate || d.apps.partialInstall()) {
+		d.appUpdate = false
+		return d.apps.cleanup()
+	}
+	if !zeroPartition {
+		return nil
+	}
+	if d.rootfsFiles != nil {
+		return d.cleanupRootfsFile()
+	}
+
+	inactive, err := d.GetInactive()
+	if err != nil {
+		return err
+	}
+	_, num := splitPartitionNumber(inactive)
+	env, err := d.ReadEnv("mender_boot_part")
+	if err != nil {
+		return err
+	}
+	if env["mender_boot_part"] == num {
+		return errCleanupBootPartition
+	}
+	return zeroPartitionHead(inactive)
+}
+
+func zeroPartitionHead(part string) error {
+	b := &BlockDevice{Path: part}
+	size, err := b.Size()
+	if err != nil {
+		return errors.Wrapf(err, "failed to read size of %s", part)
+	}
+	if size > cleanupZeroSize {
+		size = cleanupZeroSize
+	}
+
+	log.Infof("zeroing first %d bytes of partition %s", size, part)
+	_, err = b.Write(make([]byte, size))
+	if cerr := b.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to zero partition %s", part)
+	}
+	return nil
+}
+
+// Application install into the inactive slot started, but did not finish.
+func (a *appSlots) partialInstall() bool {
+	if a.pending() {
+		return false
+	}
+	// previous slot is removed once install into it starts
+	if _, err := os.Stat(filepath.Join(a.dir, appSlotPrevious)); err == nil {
+		return false
+	}
+	slot, err := a.inactive()
+	if err != nil {
+		return false
+	}
+	if _, err := os.Stat(filepath.Join(a.dir, slot)); err != nil {
+		return false
+	}
+	_, err = os.Stat(a.artifactInfoFile(slot))
+	return os.IsNotExist(err)
+}
+
+// Remove contents of the inactive slot.
+func (a *appSlots) cleanup() error {
+	if a.pending() {
+		// installed already; rolled back instead
+		return nil
+	}
+	slot, err := a.inactive()
+	if err != nil {
+		return err
+	}
+	log.Infof("removing partially installed application slot %s", slot)
+	if err := os.Remove(a.artifactInfoFile(slot)); err != nil &&
+		!os.IsNotExist(err) {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(a.dir, slot)); err != nil {
+		return errors.Wrapf(err, "failed to clean application slot %s", slot)
+	}
+	syncFilesystems()
+	return nil
+}
+
+// Clean up after failed install, if the device supports it.
+func (m *mender) CleanupUpdate() error {
+	// nothing was changed by the update
+	m.DropDataSnapshot()
+
+	c, ok := m.UInstallCommitRebooter.(updateCleaner)
+	if !ok {
+		return nil
+	}
+	return c.CleanupUpdate(m.config.CleanupZeroPartitionHead)
+}
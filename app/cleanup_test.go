@@ -0,0 +1,95 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCleanupUpdatePartition(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "cleanup")
+	defer os.RemoveAll(tdir)
+	part := path.Join(tdir, "part3")
+
+	old := BlockDeviceGetSizeOf
+	defer func() { BlockDeviceGetSizeOf = old }()
+	BlockDeviceGetSizeOf = makeBlockDeviceSize(t, 4096, nil, part)
+
+	image := bytes.Repeat([]byte{0xaa}, 8192)
+	assert.NoError(t, ioutil.WriteFile(part, image, 0644))
+
+	env := newCrashingBootEnv(BootVars{"mender_boot_part": "2"}, -1)
+	dev := &device{
+		BootEnvReadWriter: env,
+		partitions:        &partitions{inactive: part},
+	}
+
+	// not configured
+	assert.NoError(t, dev.CleanupUpdate(false))
+	data, _ := ioutil.ReadFile(part)
+	assert.Equal(t, image, data)
+
+	// zeroed up to the size of the partition
+	assert.NoError(t, dev.CleanupUpdate(true))
+	data, _ = ioutil.ReadFile(part)
+	assert.Equal(t, make([]byte, 4096), data[:4096])
+	assert.Equal(t, image[4096:], data[4096:])
+
+	// never touch the partition the bootloader is about to boot
+	assert.NoError(t, ioutil.WriteFile(part, image, 0644))
+	env.persisted["mender_boot_part"] = "3"
+	assert.Equal(t, errCleanupBootPartition, dev.CleanupUpdate(true))
+	data, _ = ioutil.ReadFile(part)
+	assert.Equal(t, image, data)
+}
+
+func TestCleanupUpdateAppSlots(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "cleanup")
+	defer os.RemoveAll(tdir)
+
+	apps := newAppSlots(tdir)
+	assert.NoError(t, apps.install("app-1", makeAppTar(t, map[string]string{"bin/app": "app-1"})))
+	assert.NoError(t, apps.enable())
+	assert.NoError(t, apps.commit())
+	assert.False(t, apps.partialInstall())
+
+	// install into slot b interrupted
+	assert.NoError(t, os.Remove(filepath.Join(tdir, appSlotPrevious)))
+	assert.NoError(t, os.MkdirAll(filepath.Join(tdir, appSlotB, "bin"), 0755))
+	assert.True(t, apps.partialInstall())
+
+	// the partition is left alone
+	dev := &device{apps: apps}
+	assert.NoError(t, dev.CleanupUpdate(true))
+	assert.False(t, apps.partialInstall())
+	_, err := os.Stat(filepath.Join(tdir, appSlotB))
+	assert.True(t, os.IsNotExist(err))
+	active, _ := apps.active()
+	assert.Equal(t, appSlotA, active)
+
+	// installed, but not committed yet; rolled back instead
+	assert.NoError(t, apps.install("app-2", makeAppTar(t, map[string]string{"bin/app": "app-2"})))
+	assert.NoError(t, apps.enable())
+	dev.appUpdate = true
+	assert.NoError(t, dev.CleanupUpdate(false))
+	assert.True(t, apps.pending())
+	assert.False(t, dev.appUpdate)
+}
@@ -0,0 +1,129 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Output formats of CLI commands; JSON output is meant for provisioning
+// tools and test rigs.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// Writer CLI commands print their results to in JSON.
+type jsonOutput struct {
+	io.Writer
+}
+
+func newCLIOutput(w io.Writer, format string) (io.Writer, error) {
+	switch format {
+	case "", outputText:
+		return w, nil
+	case outputJSON:
+		return &jsonOutput{w}, nil
+	}
+	return nil, errors.Errorf("invalid output format %q, expected %q or %q",
+		format, outputText, outputJSON)
+}
+
+func isJSONOutput(out io.Writer) bool {
+	_, ok := out.(*jsonOutput)
+	return ok
+}
+
+func printJSON(out io.Writer, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", data)
+	return err
+}
+
+func printVersion(out io.Writer) {
+	if isJSONOutput(out) {
+		printJSON(out, struct {
+			Version string `json:"version"`
+			Runtime string `json:"runtime"`
+		}{VersionString(), runtime.Version()})
+		return
+	}
+	fmt.Fprintf(out, "%s\nruntime: %s\n", VersionString(), runtime.Version())
+}
+
+func printArtifactName(out io.Writer, name string) {
+	if isJSONOutput(out) {
+		printJSON(out, struct {
+			ArtifactName string `json:"artifact_name"`
+		}{name})
+		return
+	}
+	fmt.Fprintln(out, name)
+}
+
+type installHistoryEntry struct {
+	ArtifactName string     `json:"artifact_name"`
+	DeploymentID string     `json:"deployment_id"`
+	Started      time.Time  `json:"started"`
+	Finished     *time.Time `json:"finished,omitempty"`
+	Result       string     `json:"result"`
+}
+
+func printInstallHistoryJSON(out io.Writer, history []InstallRecord) {
+	entries := make([]installHistoryEntry, 0, len(history))
+	for _, rec := range history {
+		e := installHistoryEntry{
+			ArtifactName: rec.ArtifactName,
+			DeploymentID: rec.DeploymentID,
+			Started:      rec.Started,
+			Result:       rec.Result,
+		}
+		if !rec.Finished.IsZero() {
+			finished := rec.Finished
+			e.Finished = &finished
+		}
+		entries = append(entries, e)
+	}
+	printJSON(out, entries)
+}
+
+type violationEntry struct {
+	Rule       string `json:"rule"`
+	Detail     string `json:"detail"`
+	Repairable bool   `json:"repairable"`
+}
+
+func printViolationsJSON(out io.Writer, violations []invariantViolation) {
+	entries := make([]violationEntry, 0, len(violations))
+	for _, v := range violations {
+		entries = append(entries, violationEntry{
+			Rule:       v.Rule,
+			Detail:     v.Detail,
+			Repairable: v.repairable(),
+		})
+	}
+	printJSON(out, struct {
+		Consistent bool             `json:"consistent"`
+		Violations []violationEntry `json:"violations"`
+	}{len(violations) == 0, entries})
+}
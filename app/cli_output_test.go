@@ -0,0 +1,79 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCLIOutputFormat(t *testing.T) {
+	out := &bytes.Buffer{}
+
+	w, err := newCLIOutput(out, "")
+	assert.NoError(t, err)
+	assert.False(t, isJSONOutput(w))
+	w, err = newCLIOutput(out, outputText)
+	assert.NoError(t, err)
+	assert.False(t, isJSONOutput(w))
+	w, err = newCLIOutput(out, outputJSON)
+	assert.NoError(t, err)
+	assert.True(t, isJSONOutput(w))
+
+	_, err = newCLIOutput(out, "yaml")
+	assert.Error(t, err)
+}
+
+func TestPrintVersion(t *testing.T) {
+	out := &bytes.Buffer{}
+	printVersion(out)
+	assert.Equal(t, VersionString()+"\nruntime: "+runtime.Version()+"\n", out.String())
+
+	out.Reset()
+	printVersion(&jsonOutput{out})
+	var v map[string]string
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &v))
+	assert.Equal(t, map[string]string{
+		"version": VersionString(),
+		"runtime": runtime.Version(),
+	}, v)
+}
+
+func TestPrintArtifactName(t *testing.T) {
+	out := &bytes.Buffer{}
+	printArtifactName(out, "release-1")
+	assert.Equal(t, "release-1\n", out.String())
+
+	out.Reset()
+	printArtifactName(&jsonOutput{out}, "release-1")
+	assert.JSONEq(t, `{"artifact_name": "release-1"}`, out.String())
+}
+
+func TestPrintViolationsJSON(t *testing.T) {
+	out := &bytes.Buffer{}
+	printViolations(&jsonOutput{out}, nil)
+	assert.JSONEq(t, `{"consistent": true, "violations": []}`, out.String())
+}
+
+func TestDoMainOutputFormat(t *testing.T) {
+	err := DoMain([]string{"-no-syslog", "-output", "yaml", "-version"})
+	assert.Error(t, err)
+
+	err = DoMain([]string{"-no-syslog", "-show-artifact", "-show-history"})
+	assert.Equal(t, errMsgAmbiguousArgumentsGiven, err)
+}
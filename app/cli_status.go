@@ -0,0 +1,166 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"flag"
+	"net"
+	"net/url"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Results of one-shot command line operations (-rootfs, -check-update,
+// -commit, ...). By default the client exits with 0 on success, including
+// results telling the status of the device (reboot required, no update), and
+// with 1 on any error, as it always did. Provisioning scripts that need to
+// tell the results apart give each its own status with ExitCodes in the
+// configuration file.
+const (
+	exitResultSuccess          = "success"
+	exitResultError            = "error"
+	exitResultUsage            = "usage-error"
+	exitResultNetwork          = "network-error"
+	exitResultRebootRequired   = "reboot-required"
+	exitResultNoUpdate         = "no-update"
+	exitResultAlreadyInstalled = "already-installed"
+	exitResultAuth             = "authorization-error"
+	exitResultInstall          = "install-error"
+)
+
+var defaultExitCodes = map[string]int{
+	exitResultSuccess:          0,
+	exitResultError:            1,
+	exitResultUsage:            1,
+	exitResultNetwork:          1,
+	exitResultRebootRequired:   0,
+	exitResultNoUpdate:         0,
+	exitResultAlreadyInstalled: 0,
+	exitResultAuth:             1,
+	exitResultInstall:          1,
+}
+
+// exit statuses in effect, defaults overridden by the configuration
+var exitCodes = defaultExitCodes
+
+var (
+	// ErrNoUpdateAvailable is returned by -check-update if the server has
+	// no update for the device.
+	ErrNoUpdateAvailable = errors.New("no update available")
+	// ErrAlreadyInstalled is returned by -check-update if the update
+	// the server has for the device is the artifact running already.
+	ErrAlreadyInstalled = errors.New("artifact is installed already")
+	// ErrNothingToCommit is returned by -commit if there is no update
+	// waiting to be committed.
+	ErrNothingToCommit = errors.New("no update to commit")
+)
+
+// Error of a command line operation with the result it is reported as.
+type resultError struct {
+	result string
+	err    error
+}
+
+func (e *resultError) Error() string {
+	return e.err.Error()
+}
+
+func withExitResult(result string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &resultError{result, err}
+}
+
+func validateExitCodes(codes map[string]int) error {
+	for result, code := range codes {
+		if _, ok := defaultExitCodes[result]; !ok {
+			return errors.Errorf("invalid result %q in exit codes", result)
+		}
+		if code < 0 || code > 255 {
+			return errors.Errorf("invalid exit code %d of result %q", code, result)
+		}
+	}
+	return nil
+}
+
+func setExitCodes(codes map[string]int) error {
+	if err := validateExitCodes(codes); err != nil {
+		return err
+	}
+	exitCodes = make(map[string]int, len(defaultExitCodes))
+	for result, code := range defaultExitCodes {
+		exitCodes[result] = code
+	}
+	for result, code := range codes {
+		exitCodes[result] = code
+	}
+	return nil
+}
+
+func exitResult(err error) string {
+	switch err {
+	case nil, flag.ErrHelp:
+		return exitResultSuccess
+	case errMsgNoArgumentsGiven, errMsgAmbiguousArgumentsGiven,
+		errMsgIncompatibleLogOptions:
+		return exitResultUsage
+	}
+
+	for {
+		if re, ok := err.(*resultError); ok {
+			return re.result
+		}
+		switch err {
+		case ErrRebootRequired:
+			return exitResultRebootRequired
+		case ErrNoUpdateAvailable, ErrNothingToCommit:
+			return exitResultNoUpdate
+		case ErrAlreadyInstalled:
+			return exitResultAlreadyInstalled
+		case client.ErrNotAuthorized, client.AuthErrorUnauthorized,
+			client.AuthErrorRejected:
+			return exitResultAuth
+		}
+		switch err.(type) {
+		case net.Error, *url.Error:
+			return exitResultNetwork
+		}
+		cause, ok := err.(interface {
+			Cause() error
+		})
+		if !ok {
+			return exitResultError
+		}
+		err = cause.Cause()
+	}
+}
+
+// ExitCode returns the status the client exits with after DoMain returned
+// the error.
+func ExitCode(err error) int {
+	return exitCodes[exitResult(err)]
+}
+
+// IsFailure tells if DoMain failed, rather than returning status of the
+// device, eg. that no update is available, as error.
+func IsFailure(err error) bool {
+	switch exitResult(err) {
+	case exitResultSuccess, exitResultRebootRequired, exitResultNoUpdate,
+		exitResultAlreadyInstalled:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"flag"
+	"net/url"
+	"testing"
+
+	"github.com/mendersoftware/mender/app/testutils"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitCode(t *testing.T) {
+	defer setExitCodes(nil)
+
+	// compatible defaults: errors exit with 1, the rest with 0
+	assert.Equal(t, 0, ExitCode(nil))
+	assert.Equal(t, 0, ExitCode(flag.ErrHelp))
+	assert.Equal(t, 1, ExitCode(errors.New("foo")))
+	assert.Equal(t, 1, ExitCode(errMsgAmbiguousArgumentsGiven))
+	assert.Equal(t, 0, ExitCode(ErrRebootRequired))
+	assert.Equal(t, 0, ExitCode(ErrNothingToCommit))
+	assert.Equal(t, 0, ExitCode(ErrAlreadyInstalled))
+
+	// distinct statuses are opt-in
+	assert.NoError(t, setExitCodes(map[string]int{
+		exitResultUsage:            2,
+		exitResultNetwork:          3,
+		exitResultRebootRequired:   4,
+		exitResultNoUpdate:         5,
+		exitResultAlreadyInstalled: 6,
+		exitResultAuth:             7,
+		exitResultInstall:          8,
+	}))
+	assert.Equal(t, 0, ExitCode(nil))
+	assert.Equal(t, 1, ExitCode(errors.New("foo")))
+	assert.Equal(t, 2, ExitCode(errMsgAmbiguousArgumentsGiven))
+	_, err := argsParse([]string{"-no-such-flag"})
+	assert.Equal(t, 2, ExitCode(err))
+	assert.Equal(t, 3, ExitCode(errors.Wrapf(&url.Error{
+		Op: "Get", URL: "https://localhost", Err: errors.New("refused"),
+	}, "failed to check update")))
+	assert.Equal(t, 4, ExitCode(ErrRebootRequired))
+	assert.Equal(t, 5, ExitCode(ErrNoUpdateAvailable))
+	assert.Equal(t, 5, ExitCode(ErrNothingToCommit))
+	assert.Equal(t, 6, ExitCode(ErrAlreadyInstalled))
+	assert.Equal(t, 7, ExitCode(errors.Wrap(client.AuthErrorRejected, "bootstrap")))
+	assert.Equal(t, 8, ExitCode(withExitResult(exitResultInstall,
+		errors.Wrap(errors.New("no space left"), "failed to install"))))
+
+	assert.False(t, IsFailure(nil))
+	assert.False(t, IsFailure(ErrRebootRequired))
+	assert.False(t, IsFailure(ErrAlreadyInstalled))
+	assert.True(t, IsFailure(errors.New("foo")))
+
+	assert.NoError(t, setExitCodes(map[string]int{
+		exitResultRebootRequired: 10,
+	}))
+	assert.Equal(t, 0, ExitCode(ErrNoUpdateAvailable))
+	assert.Equal(t, 10, ExitCode(ErrRebootRequired))
+	assert.Equal(t, 0, ExitCode(ErrAlreadyInstalled))
+
+	assert.Error(t, setExitCodes(map[string]int{"bogus": 1}))
+	assert.Error(t, setExitCodes(map[string]int{exitResultError: 256}))
+
+	assert.NoError(t, setExitCodes(nil))
+	assert.Equal(t, 0, ExitCode(ErrNoUpdateAvailable))
+}
+
+func TestCommitExitResult(t *testing.T) {
+	assert.Equal(t, ErrNothingToCommit, doCommit(testutils.FakeDevice{}, nil))
+	assert.NoError(t, doCommit(testutils.FakeDevice{RetHasUpdate: true}, nil))
+	assert.Error(t, doCommit(testutils.FakeDevice{
+		RetHasUpdateError: errors.New("no environment"),
+	}, nil))
+}
+
+func TestPrintCheckUpdate(t *testing.T) {
+	update := &client.UpdateResponse{ID: "foo"}
+	update.Artifact.ArtifactName = "release-2"
+
+	out := &bytes.Buffer{}
+	printCheckUpdate(out, update, false)
+	assert.Equal(t, "update available: release-2 (deployment foo)\n", out.String())
+
+	out.Reset()
+	printCheckUpdate(out, update, true)
+	assert.Equal(t, "artifact release-2 is installed already (deployment foo)\n",
+		out.String())
+
+	out.Reset()
+	printCheckUpdate(out, nil, false)
+	assert.Equal(t, "no update available\n", out.String())
+
+	out.Reset()
+	printCheckUpdate(&jsonOutput{out}, update, false)
+	assert.JSONEq(t, `{"available": true, "installed": false,
+		"artifact_name": "release-2", "deployment_id": "foo"}`, out.String())
+}
+
+func TestCheckUpdateArgs(t *testing.T) {
+	opts, err := argsParse([]string{"-no-syslog", "-check-update"})
+	assert.NoError(t, err)
+	assert.True(t, *opts.checkUpdate)
+	assert.Equal(t, lockModeCLI, instanceLockMode(opts))
+
+	_, err = argsParse([]string{"-no-syslog", "-check-update", "-commit"})
+	assert.Equal(t, errMsgAmbiguousArgumentsGiven, err)
+}
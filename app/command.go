@@ -0,0 +1,283 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// Commands the server can issue to the device.
+const (
+	CommandCheckUpdate  = "check-update"
+	CommandCollectLogs  = "collect-logs"
+	CommandReboot       = "reboot"
+	CommandDecommission = "decommission"
+	// lift the quarantine after repeatedly failed deployments
+	CommandClearQuarantine = "clear-quarantine"
+	// raise log level and trace API requests for a while
+	CommandDebugLogging = "debug-logging"
+)
+
+const (
+	// IDs of executed commands which have not expired yet, protects
+	// against replays
+	executedCommandsName = "executed-commands"
+	// commands expiring later than this from now are rejected, so that
+	// executed ones need not be remembered for longer
+	maxCommandLifetime = 24 * time.Hour
+)
+
+var (
+	ErrCommandNotAllowed  = errors.New("device command not allowed")
+	ErrCommandSignature   = errors.New("device command signature verification failed")
+	ErrCommandExpired     = errors.New("device command expired")
+	ErrCommandReplayed    = errors.New("device command already executed")
+	ErrCommandOtherDevice = errors.New("device command issued for other device")
+)
+
+// DeviceCommand is an action the server asks the device to perform. Commands
+// are signed by the server for a single device, and executed only if allowed
+// in configuration.
+type DeviceCommand struct {
+	ID       string `json:"id"`
+	Name     string `json:"command"`
+	DeviceID string `json:"device_id"`
+	// at most maxCommandLifetime ahead of the device clock
+	Expires time.Time `json:"expires"`
+	// deployment to collect logs of
+	DeploymentID string `json:"deployment_id,omitempty"`
+	// debug logging: level (default debug), API request tracing, and
+	// how long for (default 30 minutes, at most 4 hours)
+	LogLevel        string `json:"log_level,omitempty"`
+	APITrace        bool   `json:"api_trace,omitempty"`
+	DurationSeconds int    `json:"duration,omitempty"`
+}
+
+type commandVerifier struct {
+	key     *rsa.PublicKey
+	allowed map[string]bool
+	store   Store
+}
+
+// Set up device command verification. Returns nil if commands are not enabled
+// in configuration.
+func newCommandVerifier(config MenderConfig, store Store) (*commandVerifier, error) {
+	if config.CommandSigningKey == "" || len(config.AllowedCommands) == 0 {
+		return nil, nil
+	}
+
+	if store == nil {
+		return nil, errors.New("device commands need data store")
+	}
+
+	key, err := loadPublicKey(config.CommandSigningKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load command signing key")
+	}
+
+	v := &commandVerifier{
+		key:     key,
+		allowed: make(map[string]bool),
+		store:   store,
+	}
+	for _, c := range config.AllowedCommands {
+		switch c {
+		case CommandCheckUpdate, CommandCollectLogs, CommandReboot,
+			CommandDecommission, CommandClearQuarantine, CommandDebugLogging:
+			v.allowed[c] = true
+		default:
+			return nil, errors.Errorf("unknown device command %q", c)
+		}
+	}
+	return v, nil
+}
+
+func loadPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block")
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA public key")
+	}
+	return key, nil
+}
+
+// Verify command received from the server. Both command and signature are
+// base64 encoded, signature covers decoded command data. deviceID is the ID
+// the server knows the device by.
+func (v *commandVerifier) verify(command, signature, deviceID string,
+	now time.Time) (*DeviceCommand, error) {
+	data, err := base64.StdEncoding.DecodeString(command)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode device command")
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode device command signature")
+	}
+
+	digest := sha256.Sum256(data)
+	if err := rsa.VerifyPKCS1v15(v.key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, ErrCommandSignature
+	}
+
+	var cmd DeviceCommand
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse device command")
+	}
+
+	if cmd.ID == "" {
+		return nil, errors.New("device command without ID")
+	}
+	if cmd.DeviceID == "" || cmd.DeviceID != deviceID {
+		return nil, errors.Wrapf(ErrCommandOtherDevice, "device %q", cmd.DeviceID)
+	}
+	if !v.allowed[cmd.Name] {
+		return nil, errors.Wrapf(ErrCommandNotAllowed, "command %q", cmd.Name)
+	}
+	if !now.Before(cmd.Expires) {
+		return nil, ErrCommandExpired
+	}
+	if cmd.Expires.After(now.Add(maxCommandLifetime)) {
+		return nil, errors.Errorf("device command expires at %v, more than %v ahead",
+			cmd.Expires, maxCommandLifetime)
+	}
+
+	executed := v.executed(now)
+	if _, ok := executed[cmd.ID]; ok {
+		return nil, ErrCommandReplayed
+	}
+
+	// remember command before it is executed, until it expires; commands
+	// are not retried
+	executed[cmd.ID] = cmd.Expires
+	data, _ = json.Marshal(executed)
+	if err := v.store.WriteAll(executedCommandsName, data); err != nil {
+		return nil, errors.Wrapf(err, "failed to save executed device commands")
+	}
+
+	return &cmd, nil
+}
+
+// Expiry times of executed commands which have not expired at now, keyed by
+// command ID.
+func (v *commandVerifier) executed(now time.Time) map[string]time.Time {
+	executed := make(map[string]time.Time)
+
+	data, err := v.store.ReadAll(executedCommandsName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("failed to read executed device commands: %v", err)
+		}
+		return executed
+	}
+
+	var expires map[string]time.Time
+	if err := json.Unmarshal(data, &expires); err != nil {
+		// IDs of last commands saved by earlier versions; expiry of
+		// the commands is not known
+		var ids []string
+		if err := json.Unmarshal(data, &ids); err != nil {
+			log.Errorf("failed to parse executed device commands: %v", err)
+			return executed
+		}
+		for _, id := range ids {
+			executed[id] = now.Add(maxCommandLifetime)
+		}
+		return executed
+	}
+	for id, exp := range expires {
+		if now.Before(exp) {
+			executed[id] = exp
+		}
+	}
+	return executed
+}
+
+// Verify and queue device command received from the server.
+func (m *mender) receiveCommand(command, signature string) {
+	if command == "" {
+		return
+	}
+
+	if m.commands == nil {
+		log.Warnf("device commands not enabled, ignoring command from server")
+		return
+	}
+
+	deviceID, err := m.authToken.DeviceID()
+	if err != nil {
+		log.Errorf("rejecting device command, device ID not known: %v", err)
+		return
+	}
+
+	cmd, err := m.commands.verify(command, signature, deviceID, time.Now())
+	if err != nil {
+		log.Errorf("rejecting device command: %v", err)
+		return
+	}
+
+	log.Infof("received device command %s (%s)", cmd.Name, cmd.ID)
+	m.pendingCommand = cmd
+}
+
+// Returns device command waiting to be executed, nil if there is none.
+func (m *mender) PendingCommand() *DeviceCommand {
+	cmd := m.pendingCommand
+	m.pendingCommand = nil
+	return cmd
+}
+
+// Remove device credentials, so that it needs to be accepted again by the
+// server.
+func (m *mender) Decommission() menderError {
+	// device identifies with new key from now on
+	return m.resetAuthorization(true)
+}
+
+func (m *mender) resetAuthorization(regenerateKey bool) menderError {
+	if err := m.authMgr.RemoveAuthToken(); err != nil {
+		return NewFatalError(errors.Wrapf(err, "failed to remove authorization token"))
+	}
+	m.authToken = noAuthToken
+	if regenerateKey {
+		m.forceBootstrap = true
+	}
+	return nil
+}
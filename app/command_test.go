@@ -0,0 +1,263 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// generates server signing key, returns the key and path to public key file
+func makeCommandSigningKey(t *testing.T, dir string) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+
+	kpath := path.Join(dir, "server-pub.pem")
+	err = ioutil.WriteFile(kpath, pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: der,
+	}), 0600)
+	assert.NoError(t, err)
+	return key, kpath
+}
+
+// returns base64 encoded command and signature
+func signCommand(t *testing.T, key *rsa.PrivateKey, cmd DeviceCommand) (string, string) {
+	data, err := json.Marshal(cmd)
+	assert.NoError(t, err)
+	digest := sha256.Sum256(data)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	assert.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(data),
+		base64.StdEncoding.EncodeToString(sig)
+}
+
+func TestNewCommandVerifier(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	_, kpath := makeCommandSigningKey(t, tdir)
+	ms := utils.NewMemStore()
+
+	// not enabled
+	v, err := newCommandVerifier(MenderConfig{}, ms)
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+	v, err = newCommandVerifier(MenderConfig{CommandSigningKey: kpath}, ms)
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+
+	v, err = newCommandVerifier(MenderConfig{
+		CommandSigningKey: kpath,
+		AllowedCommands:   []string{CommandReboot, CommandCheckUpdate},
+	}, ms)
+	assert.NoError(t, err)
+	assert.NotNil(t, v)
+
+	_, err = newCommandVerifier(MenderConfig{
+		CommandSigningKey: kpath,
+		AllowedCommands:   []string{"rm-rf"},
+	}, ms)
+	assert.Error(t, err)
+
+	_, err = newCommandVerifier(MenderConfig{
+		CommandSigningKey: path.Join(tdir, "missing.pem"),
+		AllowedCommands:   []string{CommandReboot},
+	}, ms)
+	assert.Error(t, err)
+
+	_, err = newCommandVerifier(MenderConfig{
+		CommandSigningKey: kpath,
+		AllowedCommands:   []string{CommandReboot},
+	}, nil)
+	assert.Error(t, err)
+}
+
+func TestCommandVerify(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	key, kpath := makeCommandSigningKey(t, tdir)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	ms := utils.NewMemStore()
+	v, err := newCommandVerifier(MenderConfig{
+		CommandSigningKey: kpath,
+		AllowedCommands:   []string{CommandReboot},
+	}, ms)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	reboot := DeviceCommand{
+		ID:       "cmd-1",
+		Name:     CommandReboot,
+		DeviceID: "device-1",
+		Expires:  now.Add(time.Hour),
+	}
+
+	// signed with wrong key
+	c, s := signCommand(t, otherKey, reboot)
+	_, err = v.verify(c, s, "device-1", now)
+	assert.Equal(t, ErrCommandSignature, err)
+
+	// garbage
+	_, err = v.verify("not base64!", s, "device-1", now)
+	assert.Error(t, err)
+
+	// command not allowed
+	c, s = signCommand(t, key, DeviceCommand{
+		ID:       "cmd-2",
+		Name:     CommandDecommission,
+		DeviceID: "device-1",
+		Expires:  now.Add(time.Hour),
+	})
+	_, err = v.verify(c, s, "device-1", now)
+	assert.Equal(t, ErrCommandNotAllowed, errors.Cause(err))
+
+	// issued for other device, or for any
+	c, s = signCommand(t, key, reboot)
+	_, err = v.verify(c, s, "device-2", now)
+	assert.Equal(t, ErrCommandOtherDevice, errors.Cause(err))
+	anyDevice := reboot
+	anyDevice.DeviceID = ""
+	c, s = signCommand(t, key, anyDevice)
+	_, err = v.verify(c, s, "", now)
+	assert.Equal(t, ErrCommandOtherDevice, errors.Cause(err))
+
+	// expired
+	c, s = signCommand(t, key, reboot)
+	_, err = v.verify(c, s, "device-1", now.Add(2*time.Hour))
+	assert.Equal(t, ErrCommandExpired, err)
+
+	// valid for too long
+	longLived := reboot
+	longLived.Expires = now.Add(maxCommandLifetime + time.Minute)
+	lc, ls := signCommand(t, key, longLived)
+	_, err = v.verify(lc, ls, "device-1", now)
+	assert.Error(t, err)
+
+	// all good
+	cmd, err := v.verify(c, s, "device-1", now)
+	assert.NoError(t, err)
+	assert.Equal(t, reboot.ID, cmd.ID)
+	assert.Equal(t, CommandReboot, cmd.Name)
+
+	// replay, however many commands come in between
+	for i := 0; i < 50; i++ {
+		cmd := reboot
+		cmd.ID = fmt.Sprintf("cmd-%d", i+10)
+		c, s := signCommand(t, key, cmd)
+		_, err = v.verify(c, s, "device-1", now)
+		assert.NoError(t, err)
+	}
+	_, err = v.verify(c, s, "device-1", now.Add(59*time.Minute))
+	assert.Equal(t, ErrCommandReplayed, err)
+
+	// commands are remembered until they expire
+	assert.Len(t, v.executed(now), 51)
+	assert.Len(t, v.executed(now.Add(time.Hour)), 0)
+	later := reboot
+	later.ID = "cmd-later"
+	later.Expires = now.Add(3 * time.Hour)
+	c, s = signCommand(t, key, later)
+	_, err = v.verify(c, s, "device-1", now.Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.Len(t, v.executed(now.Add(2*time.Hour)), 1)
+
+	// IDs saved by earlier versions are kept for the longest lifetime
+	ms.WriteAll(executedCommandsName, []byte(`["cmd-1","cmd-2"]`))
+	executed := v.executed(now)
+	assert.Len(t, executed, 2)
+	assert.Equal(t, now.Add(maxCommandLifetime), executed["cmd-1"])
+	c, s = signCommand(t, key, reboot)
+	_, err = v.verify(c, s, "device-1", now)
+	assert.Equal(t, ErrCommandReplayed, err)
+}
+
+func TestMenderReceiveCommand(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	key, kpath := makeCommandSigningKey(t, tdir)
+
+	cmd := DeviceCommand{
+		ID:       "cmd-1",
+		Name:     CommandCheckUpdate,
+		DeviceID: "device-1",
+		Expires:  time.Now().Add(time.Hour),
+	}
+	c, s := signCommand(t, key, cmd)
+
+	// commands are not enabled
+	mender := newDefaultTestMender()
+	mender.receiveCommand(c, s)
+	assert.Nil(t, mender.PendingCommand())
+
+	mender = newTestMender(nil, MenderConfig{
+		CommandSigningKey: kpath,
+		AllowedCommands:   []string{CommandCheckUpdate},
+	}, testMenderPieces{})
+	assert.NotNil(t, mender.commands)
+
+	mender.receiveCommand("", "")
+	assert.Nil(t, mender.PendingCommand())
+
+	// device ID not known before the device is authorized
+	mender.receiveCommand(c, s)
+	assert.Nil(t, mender.PendingCommand())
+
+	mender.authToken = makeTestJWTClaims(`{"sub":"device-1"}`)
+	mender.receiveCommand(c, s)
+	pending := mender.PendingCommand()
+	assert.NotNil(t, pending)
+	assert.Equal(t, cmd.ID, pending.ID)
+	// command is handed out once
+	assert.Nil(t, mender.PendingCommand())
+}
+
+func TestMenderDecommission(t *testing.T) {
+	authMgr := &testAuthManager{
+		authorized: true,
+		authtoken:  client.AuthToken("token"),
+	}
+	mender := newTestMender(nil, MenderConfig{}, testMenderPieces{
+		MenderPieces: MenderPieces{
+			authMgr: authMgr,
+		},
+	})
+	assert.NoError(t, mender.Authorize(context.Background()))
+	assert.Equal(t, client.AuthToken("token"), mender.authToken)
+
+	assert.Nil(t, mender.Decommission())
+	assert.Equal(t, noAuthToken, mender.authToken)
+	assert.True(t, mender.needsBootstrap())
+}
@@ -0,0 +1,54 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+)
+
+// Once an update is committed, what earlier deployments and interrupted runs
+// left behind in the data partition is removed, so that it does not fill up
+// over time on small devices. Nothing removed is needed for the rollback of
+// the committed update, as there is none anymore.
+
+// CleanupCommitted runs the post-commit cleanup; failures are logged, and do
+// not fail the deployment.
+func (m *mender) CleanupCommitted(update client.UpdateResponse) {
+	log.Debugf("cleaning up after commit of deployment %s", update.ID)
+
+	// payloads provided, should writing the committed record have failed
+	commitArtifactProvides(m.store)
+
+	// superseded data snapshots
+	m.DropDataSnapshot()
+
+	// temporary files and directories of earlier deployments
+	if m.scratch != nil {
+		if err := m.scratch.removeLeftovers(); err != nil {
+			log.Warnf("failed to clean up scratch directory: %v", err)
+		}
+	}
+	if m.deploymentDirs != nil {
+		m.deploymentDirs.removeExcept(safeFileName(update.ID))
+	}
+
+	// deployment logs beyond retention
+	if days := m.config.DeploymentLogRetentionDays; days > 0 {
+		m.logManager.Prune(time.Duration(days)*24*time.Hour, update.ID)
+	}
+	syncFilesystems()
+}
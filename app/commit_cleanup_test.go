@@ -0,0 +1,92 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCleanupCommitted(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	logDir := filepath.Join(tdir, "logs")
+	os.Mkdir(logDir, 0755)
+	old := time.Now().Add(-10 * 24 * time.Hour)
+	oldLog := filepath.Join(logDir, "deployments.0002.old.log")
+	ioutil.WriteFile(oldLog, []byte("{}\n"), 0644)
+	os.Chtimes(oldLog, old, old)
+	recentLog := filepath.Join(logDir, "deployments.0002.recent.log")
+	ioutil.WriteFile(recentLog, []byte("{}\n"), 0644)
+	// log of the committed deployment is kept however old
+	currentLog := filepath.Join(logDir, "deployments.0001.foo.log")
+	ioutil.WriteFile(currentLog, []byte("{}\n"), 0644)
+	os.Chtimes(currentLog, old, old)
+
+	s := newScratchDir(&MenderConfig{}, tdir)
+	assert.NoError(t, s.prepare())
+	leftover := filepath.Join(s.path, "delta-base123")
+	ioutil.WriteFile(leftover, []byte("base"), 0600)
+	staleDir := filepath.Join(s.path, deploymentDirsName, "stale")
+	currentDir := filepath.Join(s.path, deploymentDirsName, "foo")
+	os.MkdirAll(staleDir, 0700)
+	os.MkdirAll(currentDir, 0700)
+
+	ms := utils.NewMemStore()
+	// commit interrupted before the pending record was removed
+	(&artifactProvides{ArtifactName: "mender-1.1"}).save(ms, pendingProvidesName)
+
+	mender := newTestMender(nil, MenderConfig{
+		DeploymentLogRetentionDays: 7,
+	}, testMenderPieces{MenderPieces: MenderPieces{
+		store:        ms,
+		scratch:      s,
+		dataSnapshot: newDataSnapshot(MenderConfig{DataSnapshotPaths: []string{"/data"}}, tdir, ms),
+	}})
+	mender.logManager = NewDeploymentLogManager(logDir)
+	snapshotTmp := filepath.Join(tdir, dataSnapshotFile+".tmp")
+	ioutil.WriteFile(snapshotTmp, []byte("partial"), 0600)
+
+	mender.CleanupCommitted(client.UpdateResponse{ID: "foo"})
+
+	for _, gone := range []string{oldLog, leftover, staleDir, snapshotTmp} {
+		_, err := os.Stat(gone)
+		assert.True(t, os.IsNotExist(err), gone)
+	}
+	for _, kept := range []string{recentLog, currentLog, currentDir} {
+		_, err := os.Stat(kept)
+		assert.NoError(t, err, kept)
+	}
+	p := loadArtifactProvides(ms, providesName)
+	if assert.NotNil(t, p) {
+		assert.Equal(t, "mender-1.1", p.ArtifactName)
+	}
+	assert.Nil(t, loadArtifactProvides(ms, pendingProvidesName))
+
+	// logs are kept until rotated out unless retention is configured
+	ioutil.WriteFile(oldLog, []byte("{}\n"), 0644)
+	os.Chtimes(oldLog, old, old)
+	mender.config.DeploymentLogRetentionDays = 0
+	mender.CleanupCommitted(client.UpdateResponse{ID: "foo"})
+	_, err := os.Stat(oldLog)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,288 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// What to do once applications hold the commit for longer than allowed.
+const (
+	commitHoldCommit   = "commit"
+	commitHoldRollback = "rollback"
+)
+
+// default ceiling for holding the commit
+var defaultCommitHoldTimeout = 10 * time.Minute
+
+const (
+	commitHoldsName     = "commit-holds"
+	commitHoldStartName = "commit-hold-start"
+)
+
+// Applications not linking the client hold the commit by creating a file
+// named after themselves in this directory, with the reason as its content,
+// and release it by removing the file.
+var defaultCommitHoldDir = path.Join(getStateDirPath(), "commit_holds")
+
+// how often holds placed through files are checked while held
+var commitHoldPollInterval = 15 * time.Second
+
+// Applications holding the commit of a freshly installed update, e.g. while
+// migrating their data to the new artifact. Holds are placed and released
+// from other goroutines than the one running the state machine, which waits
+// for the last hold to be released, or to expire. Holds are kept in the
+// store, so that they survive restart of the client.
+type commitHolds struct {
+	lock sync.Mutex
+	// holder -> reason
+	holds map[string]string
+	// signalled once no holds are left
+	released chan struct{}
+	store    Store
+	// holds placed through files, if set
+	dir string
+}
+
+func newCommitHolds(store Store, dir string) *commitHolds {
+	ch := &commitHolds{store: store, dir: dir}
+	if store == nil {
+		return ch
+	}
+	data, err := store.ReadAll(commitHoldsName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("failed to read commit holds: %v", err)
+		}
+		return ch
+	}
+	if err := json.Unmarshal(data, &ch.holds); err != nil {
+		log.Warnf("discarding broken commit holds: %v", err)
+		ch.holds = nil
+	}
+	return ch
+}
+
+// must be called with lock held
+func (ch *commitHolds) save() {
+	if ch.store == nil {
+		return
+	}
+	var err error
+	if len(ch.holds) == 0 {
+		err = ch.store.Remove(commitHoldsName)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	} else {
+		data, _ := json.Marshal(ch.holds)
+		err = ch.store.WriteAll(commitHoldsName, data)
+	}
+	if err != nil {
+		log.Errorf("failed to save commit holds: %v", err)
+	}
+}
+
+// Holds placed through files in the hold directory: holder -> reason.
+func (ch *commitHolds) fileHolds() map[string]string {
+	if ch.dir == "" {
+		return nil
+	}
+	files, err := ioutil.ReadDir(ch.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("failed to read commit holds: %v", err)
+		}
+		return nil
+	}
+	holds := make(map[string]string)
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		reason, _ := ioutil.ReadFile(path.Join(ch.dir, f.Name()))
+		holds[f.Name()] = strings.TrimSpace(string(reason))
+	}
+	return holds
+}
+
+func (ch *commitHolds) releasedChan() <-chan struct{} {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	if ch.released == nil {
+		ch.released = make(chan struct{}, 1)
+	}
+	return ch.released
+}
+
+func (ch *commitHolds) hold(holder, reason string) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	if ch.holds == nil {
+		ch.holds = make(map[string]string)
+	}
+	ch.holds[holder] = reason
+	ch.save()
+}
+
+func (ch *commitHolds) release(holder string) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	if _, ok := ch.holds[holder]; !ok {
+		return
+	}
+	delete(ch.holds, holder)
+	ch.save()
+	if len(ch.holds) == 0 && ch.released != nil {
+		select {
+		case ch.released <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Returns sorted list of holders, each with reason of holding the commit.
+func (ch *commitHolds) list() []string {
+	files := ch.fileHolds()
+
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	holders := make([]string, 0, len(ch.holds)+len(files))
+	for _, holds := range []map[string]string{ch.holds, files} {
+		for h, r := range holds {
+			if r != "" {
+				h = fmt.Sprintf("%s (%s)", h, r)
+			}
+			holders = append(holders, h)
+		}
+	}
+	sort.Strings(holders)
+	return holders
+}
+
+func validateCommitHoldAction(action string) error {
+	switch action {
+	case "", commitHoldCommit, commitHoldRollback:
+		return nil
+	}
+	return errors.Errorf("invalid commit hold expiry action %q, expected %q or %q",
+		action, commitHoldCommit, commitHoldRollback)
+}
+
+// HoldCommit delays committing the update until ReleaseCommit() is called
+// with the same holder, or the hold expires.
+func (m *mender) HoldCommit(holder, reason string) {
+	log.Infof("update commit held by %s: %s", holder, reason)
+	m.commitHolds.hold(holder, reason)
+}
+
+func (m *mender) ReleaseCommit(holder string) {
+	log.Infof("update commit released by %s", holder)
+	m.commitHolds.release(holder)
+}
+
+// Returns applications currently holding the commit.
+func (m *mender) CommitHolds() []string {
+	return m.commitHolds.list()
+}
+
+// Returns channel signalled once applications released all holds.
+func (m *mender) CommitHoldReleased() <-chan struct{} {
+	return m.commitHolds.releasedChan()
+}
+
+// Returns how long applications may hold the commit and what to do once the
+// hold expires.
+func (m *mender) GetCommitHoldPolicy() (time.Duration, string) {
+	timeout := time.Duration(m.config.CommitHoldTimeoutSeconds) * time.Second
+	if timeout == 0 {
+		timeout = defaultCommitHoldTimeout
+	}
+	action := m.config.CommitHoldExpiredAction
+	if action == "" {
+		action = commitHoldRollback
+	}
+	return timeout, action
+}
+
+// startCommitHold returns the time applications started holding the commit,
+// which is now unless the hold started already, before restart too.
+func (ctx *StateContext) startCommitHold(now time.Time) time.Time {
+	if ctx == nil {
+		return now
+	}
+	if ctx.commitHoldStart.IsZero() {
+		ctx.commitHoldStart = loadCommitHoldStart(ctx.store)
+	}
+	if ctx.commitHoldStart.IsZero() {
+		ctx.commitHoldStart = now
+		if ctx.store != nil {
+			data, _ := now.MarshalText()
+			if err := ctx.store.WriteAll(commitHoldStartName, data); err != nil {
+				log.Errorf("failed to save commit hold start: %v", err)
+			}
+		}
+	}
+	return ctx.commitHoldStart
+}
+
+// endCommitHold forgets the start of the hold; returns whether applications
+// were holding the commit.
+func (ctx *StateContext) endCommitHold() bool {
+	if ctx == nil {
+		return false
+	}
+	held := !ctx.commitHoldStart.IsZero() || !loadCommitHoldStart(ctx.store).IsZero()
+	ctx.commitHoldStart = time.Time{}
+	if held && ctx.store != nil {
+		if err := ctx.store.Remove(commitHoldStartName); err != nil && !os.IsNotExist(err) {
+			log.Errorf("failed to remove commit hold start: %v", err)
+		}
+	}
+	return held
+}
+
+func loadCommitHoldStart(store Store) time.Time {
+	var start time.Time
+	if store == nil {
+		return start
+	}
+	if data, err := store.ReadAll(commitHoldStartName); err == nil {
+		if err := start.UnmarshalText(data); err != nil {
+			log.Warnf("discarding broken commit hold start: %v", err)
+		}
+	}
+	return start
+}
+
+// Status report substate telling who decided about the commit.
+func commitHoldSubState(holders []string, timeout time.Duration, action string) string {
+	return fmt.Sprintf("commit held by %s for longer than %v; %s decided by client",
+		strings.Join(holders, ", "), timeout, action)
+}
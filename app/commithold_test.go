@@ -0,0 +1,130 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommitHolds(t *testing.T) {
+	mender := newDefaultTestMender()
+	assert.Empty(t, mender.CommitHolds())
+
+	mender.HoldCommit("foo", "migrating database")
+	mender.HoldCommit("bar", "")
+	assert.Equal(t, []string{"bar", "foo (migrating database)"}, mender.CommitHolds())
+
+	mender.ReleaseCommit("foo")
+	assert.Equal(t, []string{"bar"}, mender.CommitHolds())
+	mender.ReleaseCommit("bar")
+	assert.Empty(t, mender.CommitHolds())
+
+	// releasing unknown holder is fine
+	mender.ReleaseCommit("baz")
+}
+
+func TestCommitHoldsPersistent(t *testing.T) {
+	store := utils.NewMemStore()
+	holds := newCommitHolds(store, "")
+	holds.hold("foo", "migrating database")
+	holds.hold("bar", "")
+
+	// restarted client keeps the holds
+	holds = newCommitHolds(store, "")
+	assert.Equal(t, []string{"bar", "foo (migrating database)"}, holds.list())
+	holds.release("foo")
+	holds.release("bar")
+	_, err := store.ReadAll(commitHoldsName)
+	assert.True(t, os.IsNotExist(err))
+	assert.Empty(t, newCommitHolds(store, "").list())
+
+	assert.NoError(t, store.WriteAll(commitHoldsName, []byte("broken")))
+	assert.Empty(t, newCommitHolds(store, "").list())
+}
+
+func TestCommitHoldFiles(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "commitholds")
+	defer os.RemoveAll(tdir)
+
+	holds := newCommitHolds(nil, path.Join(tdir, "commit_holds"))
+	// no directory, no holds
+	assert.Empty(t, holds.list())
+
+	assert.NoError(t, os.Mkdir(holds.dir, 0755))
+	assert.NoError(t, ioutil.WriteFile(path.Join(holds.dir, "db"),
+		[]byte("migrating\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(holds.dir, "web"), nil, 0644))
+	assert.NoError(t, os.Mkdir(path.Join(holds.dir, "subdir"), 0755))
+	holds.hold("app", "")
+	assert.Equal(t, []string{"app", "db (migrating)", "web"}, holds.list())
+
+	// released by removing the file
+	assert.NoError(t, os.Remove(path.Join(holds.dir, "db")))
+	assert.Equal(t, []string{"app", "web"}, holds.list())
+}
+
+func TestCommitHoldReleased(t *testing.T) {
+	mender := newDefaultTestMender()
+	released := mender.CommitHoldReleased()
+
+	mender.HoldCommit("foo", "")
+	mender.HoldCommit("bar", "")
+	mender.ReleaseCommit("foo")
+	select {
+	case <-released:
+		t.Fatal("released while still held")
+	default:
+	}
+
+	// signalled once, even if released repeatedly
+	mender.ReleaseCommit("bar")
+	mender.ReleaseCommit("bar")
+	<-released
+	select {
+	case <-released:
+		t.Fatal("release signalled twice")
+	default:
+	}
+}
+
+func TestCommitHoldPolicy(t *testing.T) {
+	mender := newDefaultTestMender()
+	timeout, action := mender.GetCommitHoldPolicy()
+	assert.Equal(t, defaultCommitHoldTimeout, timeout)
+	assert.Equal(t, commitHoldRollback, action)
+
+	mender = newTestMender(nil, MenderConfig{
+		CommitHoldTimeoutSeconds: 60,
+		CommitHoldExpiredAction:  commitHoldCommit,
+	}, testMenderPieces{})
+	timeout, action = mender.GetCommitHoldPolicy()
+	assert.Equal(t, time.Minute, timeout)
+	assert.Equal(t, commitHoldCommit, action)
+
+	_, err := NewMender(MenderConfig{CommitHoldExpiredAction: "reboot"}, MenderPieces{})
+	assert.Error(t, err)
+}
+
+func TestCommitHoldSubState(t *testing.T) {
+	assert.Equal(t, "commit held by db (migrating) for longer than 1m0s; "+
+		"rollback decided by client",
+		commitHoldSubState([]string{"db (migrating)"}, time.Minute, commitHoldRollback))
+}
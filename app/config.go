@@ -0,0 +1,405 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"reflect"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Configuration read from the configuration file; durations kept in
+// XxxSeconds fields may also be given with unit under the key Xxx (see
+// normalizeConfig).
+type MenderConfig struct {
+	ClientProtocol string
+	DeviceKey      string
+	HttpsClient    struct {
+		Certificate string
+		Key         string
+		SkipVerify  bool
+	}
+	RootfsPartA string
+	RootfsPartB string
+	// Discover the A/B partition pair from the mounted root device and
+	// the bootloader environment instead of requiring RootfsPartA/B.
+	RootfsPartAutoDetect bool
+	// Key file unlocking LUKS containers the root filesystems are stored in;
+	// when set, updates are written to the encrypted container on the
+	// inactive partition.
+	RootfsLUKSKeyFile            string
+	UpdatePollIntervalSeconds    int
+	InventoryPollIntervalSeconds int
+	RetryPollIntervalSeconds     int
+	ServerURL                    string
+	ServerCertificate            string
+	UpdateLogPath                string
+	// Server the device is being migrated to. During the migration window
+	// the device is authorized with and submits inventory to both servers,
+	// and switches over to this one once instructed by the current server.
+	MigrationServerURL string
+	// Time of day range (HH:MM-HH:MM, local time) when updates may be
+	// installed; updates received outside of it are deferred.
+	UpdateMaintenanceWindow string
+	// Public key (PEM) used for verifying commands issued by the server,
+	// and list of commands the device accepts. Commands are disabled unless
+	// both are given.
+	CommandSigningKey string
+	AllowedCommands   []string
+	// Time limit for a single inventory script; scripts that do not finish
+	// in time are killed and reported in inventory.
+	InventoryScriptTimeoutSeconds int
+	// How long applications may hold the commit of an update (default 10
+	// minutes), and whether to commit or roll back (default) once the hold
+	// expires.
+	CommitHoldTimeoutSeconds int
+	CommitHoldExpiredAction  string
+	// Time applications get to flush their data after being notified about
+	// the reboot into the new artifact.
+	RebootGracePeriodSeconds int
+	// Who reboots the device into the new artifact: "self" (default), or
+	// external reboot manager notified with D-Bus signal ("signal"), or
+	// supervisor of the client which exits with a distinct code ("exit").
+	RebootMode string
+	// Additional headers sent with every request to the server (eg. tags
+	// required for routing by gateways), and User-Agent header; occurrences
+	// of {device_type} and {version} in it are replaced with device type
+	// and client version.
+	HttpHeaders map[string]string
+	UserAgent   string
+	// Report the most recently installed artifacts, with results, in
+	// inventory.
+	InventoryInstallHistory bool
+	// Directory on the data partition holding A/B slots of applications,
+	// updated with app-slot artifacts independently of the root
+	// filesystem.
+	AppSlotsDir string
+	// How many days before expiry of server, CA or client certificates
+	// to start warning in logs and inventory (default 30).
+	CertificateExpiryWarningDays int
+	// Rules removing sensitive data (tokens, credentials in URLs, serial
+	// numbers, ...) from deployment logs before they are stored and
+	// uploaded: regular expressions whose matches are replaced, and keys
+	// whose values are replaced in key=value or "key": "value" pairs and
+	// in structured log fields.
+	LogRedactPatterns []string
+	LogRedactKeys     []string
+	// Zero the head of the inactive partition after a failed or aborted
+	// install, so that the partially written image can not be booted.
+	CleanupZeroPartitionHead bool
+	// Directory for temporary files the update process can not avoid (eg.
+	// delta reconstruction); defaults to a directory in the data store.
+	// Artifact data is never written to the system temporary directory.
+	ScratchDir string
+	// Rules accepting or rejecting deployments by artifact name and
+	// metadata, protecting devices from mistakenly targeted deployments.
+	ArtifactFilters []ArtifactFilterRule
+	// Command the update payload is streamed to on standard input while it
+	// is installed (eg. malware scanner, IMA measurement); the update is
+	// enabled only if it exits with status 0. Time to wait for the verdict
+	// once the payload is written (default 300 seconds), and whether to
+	// "reject" (default) or "accept" the update if the scanner fails to
+	// run or times out.
+	PayloadScanCommand        []string
+	PayloadScanTimeoutSeconds int
+	PayloadScanFailurePolicy  string
+	// TPM PCR (1-23) the digest of the artifact is extended into when it
+	// is installed and committed, and tpm2-tools context file of the
+	// attestation key used for the PCR quote reported in inventory.
+	// Measurements are disabled if the PCR is not set.
+	TPMMeasurementPCR int
+	TPMAttestationKey string
+	// How many last lines of the kernel log (pstore) and journal of the
+	// failed boot to attach to the deployment log after the bootloader
+	// rolled back the update (default 200); negative value disables it.
+	RollbackBootLogLines int
+	// Command run, without waiting for it, on update events: one of
+	// update-available, download-complete, install-complete, rollback;
+	// event details are passed in MENDER_EVENT, MENDER_DEPLOYMENT_ID and
+	// MENDER_ARTIFACT_NAME environment variables.
+	NotifyCommand []string
+	// Events the command is run on; all if empty.
+	NotifyEvents []string
+	// Bounds of the update polling interval the server may request in its
+	// responses (default 1 minute and 24 hours).
+	PollIntervalHintMinSeconds int
+	PollIntervalHintMaxSeconds int
+	// Fields added to every status report and deployment log upload, for
+	// backends routing them by e.g. site id or customer tag; the script,
+	// run once, may print more of them as key=value lines.
+	ReportFields       map[string]string
+	ReportFieldsScript string
+	// DNS-over-HTTPS resolver (JSON API, e.g. https://1.1.1.1/dns-query)
+	// the server hostname is resolved with when the system resolver fails.
+	DNSOverHTTPSResolver string
+	// Send device lifecycle events (boot, rollback, deferred update,
+	// connectivity loss) to the server, in batches of given size (default
+	// 50), keeping at most given number of them queued while the server is
+	// unreachable (default 500).
+	DeviceEvents          bool
+	DeviceEventsBatchSize int
+	DeviceEventsQueueSize int
+	// Network interface or VRF device connections to the server and
+	// artifact downloads are bound to (SO_BINDTODEVICE), eg. to keep update
+	// traffic on the management network of a multi-homed gateway; the
+	// download device defaults to the API one.
+	APIBindDevice      string
+	DownloadBindDevice string
+	// Once the device is rejected or decommissioned by the server, its
+	// authorization data are removed and the key is either kept or
+	// regenerated ("keep" (default) or "regenerate"); authorization is
+	// tried again after the interval (default 6 hours). The server refuses
+	// rejected devices with 403, or with 401 just like pending ones; the
+	// device is taken as rejected after this many 401s in a row (default
+	// 10).
+	RejectedKeyPolicy            string
+	RejectedRetryIntervalSeconds int
+	RejectedUnauthorizedAttempts int
+	// Device API version update checks are made with: 1 (default), 2, or
+	// "auto" for the newest one the server supports, eg. while the server
+	// is being upgraded.
+	ServerAPIVersion string
+	// Record every operation done to the device (partition writes, boot
+	// environment changes, reboots) with its result, per deployment; see
+	// -show-device-audit.
+	DeviceOperationAudit bool
+	// File with the key sensitive entries of the data store (authorization
+	// and tenant tokens, queued device events) are encrypted with.
+	StoreEncryptionKeyFile string
+	// Limits of requests to the server: how many may be in progress at
+	// once (downloads included) and how many may be started per minute;
+	// 0 means no limit. Requests waiting are started by priority: final
+	// status reports first, log uploads last.
+	APIMaxConcurrentRequests int
+	APIMaxRequestsPerMinute  int
+	// How the bootloader environment is accessed: "fw-utils" (default)
+	// runs fw_printenv and fw_setenv, "native" reads and writes it
+	// directly, using the locations from BootEnvConfigFile (default
+	// /etc/fw_env.config). Flash (MTD) devices need "fw-utils".
+	BootEnvAccess     string
+	BootEnvConfigFile string
+	// Directory with root filesystem images (rootfs-a.img, rootfs-b.img),
+	// for devices booting a loop-mounted image instead of a partition. The
+	// image to boot is named by the mender_rootfs_file bootloader variable.
+	RootfsImageDir string
+	// Update bundles of other update frameworks accepted, keyed by format
+	// ("rauc" or "swupdate"), with commands run to install, commit and
+	// roll them back; commands left out are the defaults of the format.
+	ExternalBundleInstallers map[string]BundleCommands
+	// Send hints about the device (free space, measured download and
+	// install speed, update types it can install) with update checks, for
+	// the server to pick the artifact suited for it.
+	ReportDeviceCapabilities bool
+	// URL of a file on the artifact host (or the CDN serving artifacts)
+	// partially downloaded before update checks, at most once an hour, to
+	// measure latency and speed of the link; the results are sent with the
+	// device capabilities, for the server to prefer delta artifacts on slow
+	// links. Empty (default) disables the probe.
+	LinkProbeURL string
+	// Time limits of states in seconds, keyed by state name: update-fetch
+	// (default 30 minutes), update-install (default 60 minutes, includes
+	// the download) and update-commit (default 10 minutes); 0 disables
+	// the limit. Deployment in a state which takes longer fails, and the
+	// update is rolled back if it is installed already.
+	StateTimeoutsSeconds map[string]int
+	// Time after the update check (default 1 hour) the deployment is
+	// confirmed with the server to be still active before it is downloaded
+	// and installed, eg. after failed downloads were retried for long;
+	// negative value disables it.
+	RevalidateUpdateAfterSeconds int
+	// Script applying device configuration deployed by the server; it gets
+	// the configuration document (JSON) on standard input and must exit
+	// with status 0 once it is applied. Configuration applied before is
+	// restored with the same script if it fails. Configuration is checked
+	// for at the interval (default is the update poll interval), and the
+	// script is given the time (default 300 seconds) to finish.
+	ConfigurationApplyScript         string
+	ConfigurationPollIntervalSeconds int
+	ConfigurationApplyTimeoutSeconds int
+	// Time to wait at start, at most, for the network to come up (default
+	// route exists and the server name resolves) and for the clock to be
+	// synchronized; the daemon carries on once it is up. 0 (default)
+	// disables the wait.
+	WaitForNetworkTimeoutSeconds  int
+	WaitForTimeSyncTimeoutSeconds int
+	// How deployment of the artifact running already is recognized and
+	// skipped: "name" (default) by artifact name, and by payload digests
+	// recorded when it was installed if there are any; "digest" by payload
+	// digests only, compared with the active root filesystem on disk if
+	// none were recorded. Deployments the server marks "force" are
+	// installed even if the artifact runs already, if enabled.
+	AlreadyInstalledCheck      string
+	ReinstallForcedDeployments bool
+	// Number of deployments failing in a row after which the device
+	// declines deployments, until the quarantine is cleared with
+	// -clear-quarantine or by the clear-quarantine command of the server;
+	// 0 (default) disables it.
+	QuarantineAfterFailedDeployments int
+	// Exit statuses of command line operations, keyed by result: success,
+	// error, usage-error, network-error, reboot-required, no-update,
+	// already-installed, authorization-error and install-error. By default
+	// errors exit with 1 and the rest with 0; results not given keep their
+	// default status.
+	ExitCodes map[string]int
+	// Size of the log ring in the data store keeping the last lines logged
+	// by the daemon across reboots (-show-log), in KiB; 0 means default
+	// (512 KiB, some thousands of lines), negative value disables it.
+	LogRingBufferSizeKB int
+	// Files and directories of the data partition saved to the data store
+	// before the update is installed, up to the size (default 64 MiB) of
+	// file contents; the update is installed without the snapshot if it
+	// is larger. Once the update is rolled back, the restore script is run
+	// with the deployment ID and snapshot location in the environment;
+	// files are restored if it exits with status 0.
+	DataSnapshotPaths         []string
+	DataSnapshotMaxSizeKB     int
+	DataSnapshotRestoreScript string
+	// Inhibitors of install and reboot: block-mode shutdown locks of
+	// systemd-logind (systemd-inhibit --what=shutdown), and files in the
+	// directory, named after who inhibits, the first line telling why.
+	// Install is deferred, and reboot waits, while there are any, at most
+	// for the time given (default 1 hour).
+	UpdateInhibitorsSystemd bool
+	UpdateInhibitorDir      string
+	UpdateInhibitMaxSeconds int
+	// Deployment logs older than this many days are removed once an update
+	// is committed; 0 (default) keeps them until rotated out.
+	DeploymentLogRetentionDays int
+	// Do not check with HEAD request that the artifact is available before
+	// downloading it; for artifact servers rejecting HEAD requests.
+	SkipArtifactAvailabilityCheck bool
+	// How many times download interrupted midway is resumed from where it
+	// stopped; 0 means default (5), negative value disables resuming.
+	DownloadResumeAttempts int
+	// Address (host:port) of statsd server update metrics are sent to, with
+	// labels as DogStatsD tags; empty disables.
+	MetricsStatsdAddress string
+	// OpenTelemetry collector endpoint update metrics are sent to with
+	// OTLP/HTTP, e.g. http://collector:4318/v1/metrics; empty disables.
+	MetricsOTLPEndpoint string
+	// Size in bytes of the buffer update image is written to storage with.
+	// 0 means the buffer and how often written data are synced are tuned
+	// while installing, from throughput of the storage and memory available;
+	// set it to use fixed buffer and sync only once the image is written.
+	InstallWriteBufferSize int
+}
+
+const defaultUserAgent = "mender/{version} ({device_type})"
+
+func LoadConfig(configFile string) (*MenderConfig, error) {
+	var confFromFile MenderConfig
+
+	if err := readConfigFile(&confFromFile, configFile); err != nil {
+		// Some error occured while loading config file.
+		// Use default configuration.
+		log.Infof("Error loading configuration from file: %s (%s)", configFile, err.Error())
+		return nil, err
+	}
+
+	if confFromFile.DeviceKey == "" {
+		log.Infof("device key path not configured, fallback to default %s",
+			defaultKeyFile)
+		confFromFile.DeviceKey = defaultKeyFile
+	}
+
+	return &confFromFile, nil
+}
+
+func readConfigFile(config interface{}, fileName string) error {
+	log.Debug("Reading Mender configuration from file " + fileName)
+	conf, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	if t := reflect.TypeOf(config); t != nil && t.Kind() == reflect.Ptr &&
+		t.Elem().Kind() == reflect.Struct {
+		normalized, warnings, err := normalizeConfig(conf, t.Elem(), "")
+		if err != nil {
+			return configParseError(err)
+		}
+		for _, w := range warnings {
+			log.Warn(w)
+		}
+		conf = normalized
+	}
+
+	if err := json.Unmarshal(conf, &config); err != nil {
+		return configParseError(err)
+	}
+	return nil
+}
+
+func configParseError(err error) error {
+	switch err.(type) {
+	case *json.SyntaxError:
+		return errors.New("Error parsing mender configuration file: " + err.Error())
+	}
+	return errors.New("Error parsing config file: " + err.Error())
+}
+
+func (c MenderConfig) GetHttpConfig() client.Config {
+	return client.Config{
+		CertFile:   c.HttpsClient.Certificate,
+		CertKey:    c.HttpsClient.Key,
+		ServerCert: c.ServerCertificate,
+		IsHttps:    c.ClientProtocol == "https",
+		NoVerify:   c.HttpsClient.SkipVerify,
+	}
+}
+
+func (c MenderConfig) GetHttpHeaders(deviceType string) http.Header {
+	headers := http.Header{}
+	for name, value := range c.HttpHeaders {
+		headers.Set(name, value)
+	}
+
+	ua := c.UserAgent
+	if ua == "" {
+		ua = headers.Get("User-Agent")
+	}
+	if ua == "" {
+		ua = defaultUserAgent
+	}
+	ua = strings.NewReplacer("{device_type}", deviceType,
+		"{version}", VersionString()).Replace(ua)
+	headers.Set("User-Agent", ua)
+
+	return headers
+}
+
+func (c MenderConfig) GetDeviceConfig() deviceConfig {
+	return deviceConfig{
+		rootfsPartA:    c.RootfsPartA,
+		rootfsPartB:    c.RootfsPartB,
+		autoDetect:     c.RootfsPartAutoDetect,
+		luksKeyFile:    c.RootfsLUKSKeyFile,
+		rootfsImageDir: c.RootfsImageDir,
+		appSlotsDir:    c.AppSlotsDir,
+		bundleDir:      path.Join(defaultDataStore, "bundles"),
+		bundleCommands: c.ExternalBundleInstallers,
+		writeBuffer:    c.InstallWriteBufferSize,
+	}
+}
+
+func (c MenderConfig) GetDeploymentLogLocation() string {
+	return c.UpdateLogPath
+}
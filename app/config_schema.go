@@ -0,0 +1,202 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Keys of the configuration file are matched with fields of the
+// configuration structure case-insensitively, as encoding/json does, and:
+//
+//   - time limits and intervals, kept in XxxSeconds fields, may also be
+//     given as durations with unit ("30m", "12h") under the key Xxx; both
+//     keys take either second counts or durations,
+//   - keys renamed over time are deprecated aliases of the new ones,
+//   - unknown keys, most likely typos, are warned about.
+//
+// Configuration files written for earlier versions are read as before.
+
+// Deprecated key -> key replacing it; none so far.
+var configRenamedKeys = map[string]string{}
+
+// suffix of fields holding durations in seconds; int, or map of them
+const configSecondsSuffix = "Seconds"
+
+type configField struct {
+	field reflect.StructField
+}
+
+func configKeyName(f reflect.StructField) string {
+	if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag != "" && tag != "-" {
+		return tag
+	}
+	return f.Name
+}
+
+func isSecondsField(f reflect.StructField) bool {
+	if !strings.HasSuffix(f.Name, configSecondsSuffix) {
+		return false
+	}
+	t := f.Type
+	if t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Int
+}
+
+// Fields of the structure by lower case key, both the field name and, for
+// durations, the key without the suffix.
+func configFields(t reflect.Type) map[string]configField {
+	fields := make(map[string]configField)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("json") == "-" {
+			continue
+		}
+		name := configKeyName(f)
+		fields[strings.ToLower(name)] = configField{field: f}
+		if isSecondsField(f) {
+			fields[strings.ToLower(strings.TrimSuffix(name, configSecondsSuffix))] =
+				configField{field: f}
+		}
+	}
+	return fields
+}
+
+// parseConfigSeconds parses a duration given as a number of seconds, or as
+// a string with unit ("90s", "30m", "12h"); the result is in seconds.
+func parseConfigSeconds(raw json.RawMessage) (int, error) {
+	var n int
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return 0, errors.Errorf("invalid duration %s", raw)
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		return n, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.Errorf("invalid duration %q", s)
+	}
+	if d%time.Second != 0 {
+		return 0, errors.Errorf("duration %q is not whole seconds", s)
+	}
+	return int(d / time.Second), nil
+}
+
+// Value of the seconds field, given as durations.
+func configSecondsValue(f reflect.StructField, raw json.RawMessage) (json.RawMessage, error) {
+	if f.Type.Kind() != reflect.Map {
+		n, err := parseConfigSeconds(raw)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(n)
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return nil, errors.Errorf("expected object of durations")
+	}
+	seconds := make(map[string]int, len(values))
+	for k, v := range values {
+		n, err := parseConfigSeconds(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s", k)
+		}
+		seconds[k] = n
+	}
+	return json.Marshal(seconds)
+}
+
+// normalizeConfig maps keys of the configuration object to fields of the
+// structure of type t, converting durations to seconds. Returns the object
+// ready to be decoded into the structure, and warnings about deprecated and
+// unknown keys; prefix is prepended to key names in messages.
+func normalizeConfig(data []byte, t reflect.Type, prefix string) (json.RawMessage,
+	[]string, error) {
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, nil, err
+	}
+	keys := make([]string, 0, len(raw))
+	for k := range raw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fields := configFields(t)
+	renamed := make(map[string]string, len(configRenamedKeys))
+	for old, key := range configRenamedKeys {
+		renamed[strings.ToLower(old)] = key
+	}
+
+	var warnings []string
+	out := make(map[string]json.RawMessage, len(raw))
+	// key setting each field
+	setBy := make(map[string]string, len(raw))
+	for _, key := range keys {
+		value := raw[key]
+		name := strings.ToLower(key)
+		if prefix == "" && renamed[name] != "" {
+			warnings = append(warnings, fmt.Sprintf(
+				"configuration key %s%s is deprecated, use %s%s instead",
+				prefix, key, prefix, renamed[name]))
+			name = strings.ToLower(renamed[name])
+		}
+		cf, ok := fields[name]
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf(
+				"unknown configuration key %s%s", prefix, key))
+			continue
+		}
+
+		fieldName := configKeyName(cf.field)
+		if other, ok := setBy[fieldName]; ok {
+			return nil, nil, errors.Errorf("configuration keys %s%s and %s%s "+
+				"set the same option", prefix, other, prefix, key)
+		}
+		setBy[fieldName] = key
+
+		var err error
+		switch {
+		case isSecondsField(cf.field):
+			value, err = configSecondsValue(cf.field, value)
+		case cf.field.Type.Kind() == reflect.Struct && string(value) != "null":
+			var nested []string
+			value, nested, err = normalizeConfig(value, cf.field.Type,
+				prefix+fieldName+".")
+			warnings = append(warnings, nested...)
+		}
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "configuration key %s%s", prefix, key)
+		}
+		out[fieldName] = value
+	}
+
+	normalized, err := json.Marshal(out)
+	return normalized, warnings, err
+}
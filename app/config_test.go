@@ -11,13 +11,18 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
-package main
+package app
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
 	"os"
+	"path"
 	"reflect"
 	"testing"
 
+	"github.com/mendersoftware/log"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -74,16 +79,16 @@ func Test_readConfigFile_brokenContent_returnsError(t *testing.T) {
 	defer os.Remove("mender.config")
 
 	configFile.WriteString(testBrokenConfig)
-	var confFromFile menderConfig
+	var confFromFile MenderConfig
 
 	err := readConfigFile(&confFromFile, "mender.config")
 	assert.Error(t, err)
 
-	assert.Equal(t, menderConfig{}, confFromFile)
+	assert.Equal(t, MenderConfig{}, confFromFile)
 }
 
-func validateConfiguration(t *testing.T, actual *menderConfig) {
-	expectedConfig := menderConfig{
+func validateConfiguration(t *testing.T, actual *MenderConfig) {
+	expectedConfig := MenderConfig{
 		ClientProtocol: "https",
 		DeviceKey:      defaultKeyFile,
 		HttpsClient: struct {
@@ -133,3 +138,99 @@ func Test_loadConfig_correctConfFile_returnsConfigurationDeviceKey(t *testing.T)
 	assert.NotNil(t, config)
 	assert.Equal(t, "/foo/bar", config.DeviceKey)
 }
+
+func TestGetHttpHeaders(t *testing.T) {
+	oldVersion := Version
+	Version = "1.2.3"
+	defer func() { Version = oldVersion }()
+
+	h := MenderConfig{}.GetHttpHeaders("qemux86")
+	assert.Equal(t, "mender/1.2.3 (qemux86)", h.Get("User-Agent"))
+	assert.Len(t, h, 1)
+
+	h = MenderConfig{
+		HttpHeaders: map[string]string{
+			"x-forwarded-client": "fleet-a",
+			"X-Site":             "oslo",
+		},
+		UserAgent: "acme-gateway {device_type}/{version}",
+	}.GetHttpHeaders("rpi3")
+	assert.Equal(t, "acme-gateway rpi3/1.2.3", h.Get("User-Agent"))
+	assert.Equal(t, "fleet-a", h.Get("X-Forwarded-Client"))
+	assert.Equal(t, "oslo", h.Get("X-Site"))
+
+	// User-Agent given among the headers
+	h = MenderConfig{
+		HttpHeaders: map[string]string{"User-Agent": "custom/{version}"},
+	}.GetHttpHeaders("rpi3")
+	assert.Equal(t, "custom/1.2.3", h.Get("User-Agent"))
+}
+
+func TestConfigDurations(t *testing.T) {
+	normalized, warnings, err := normalizeConfig([]byte(`{
+		"UpdatePollInterval": "30m",
+		"inventoryPollInterval": 3600,
+		"RetryPollIntervalSeconds": 30,
+		"RebootGracePeriodSeconds": "2m",
+		"RevalidateUpdateAfter": "-1s",
+		"StateTimeouts": {"update-fetch": "1h", "update-commit": 0}
+	}`), reflect.TypeOf(MenderConfig{}), "")
+	assert.NoError(t, err)
+	// both spellings are fine
+	assert.Empty(t, warnings)
+
+	var config MenderConfig
+	assert.NoError(t, json.Unmarshal(normalized, &config))
+	assert.Equal(t, 1800, config.UpdatePollIntervalSeconds)
+	assert.Equal(t, 3600, config.InventoryPollIntervalSeconds)
+	assert.Equal(t, 30, config.RetryPollIntervalSeconds)
+	assert.Equal(t, 120, config.RebootGracePeriodSeconds)
+	assert.Equal(t, -1, config.RevalidateUpdateAfterSeconds)
+	assert.Equal(t, map[string]int{"update-fetch": 3600, "update-commit": 0},
+		config.StateTimeoutsSeconds)
+
+	for _, c := range []string{
+		`{"UpdatePollInterval": "soon"}`,
+		`{"UpdatePollInterval": "1500ms"}`,
+		`{"UpdatePollInterval": true}`,
+		`{"StateTimeouts": {"update-fetch": "1 hour"}}`,
+		// same option twice
+		`{"UpdatePollInterval": "30m", "UpdatePollIntervalSeconds": 1800}`,
+	} {
+		_, _, err := normalizeConfig([]byte(c), reflect.TypeOf(MenderConfig{}), "")
+		assert.Error(t, err, c)
+	}
+}
+
+func TestConfigDeprecatedAndUnknownKeys(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "config")
+	defer os.RemoveAll(tdir)
+	name := path.Join(tdir, "mender.conf")
+	ioutil.WriteFile(name, []byte(`{
+		"ClientPollInterval": "60s",
+		"ServerUrl": "https://mender.example.com",
+		"ServreCertificate": "/etc/mender/server.crt",
+		"HttpsClient": {"Certificate": "/data/client.crt", "Kye": "/data/client.key"}
+	}`), 0644)
+
+	oldRenamed := configRenamedKeys
+	configRenamedKeys = map[string]string{"ClientPollInterval": "UpdatePollInterval"}
+	defer func() { configRenamedKeys = oldRenamed }()
+
+	var buf bytes.Buffer
+	oldOutput := log.Log.Out
+	log.SetOutput(&buf)
+	defer log.SetOutput(oldOutput)
+
+	config, err := LoadConfig(name)
+	assert.NoError(t, err)
+	assert.Equal(t, 60, config.UpdatePollIntervalSeconds)
+	assert.Equal(t, "https://mender.example.com", config.ServerURL)
+	assert.Equal(t, "/data/client.crt", config.HttpsClient.Certificate)
+	assert.Equal(t, "", config.ServerCertificate)
+
+	assert.Contains(t, buf.String(), "configuration key ClientPollInterval is "+
+		"deprecated, use UpdatePollInterval instead")
+	assert.Contains(t, buf.String(), "unknown configuration key ServreCertificate")
+	assert.Contains(t, buf.String(), "unknown configuration key HttpsClient.Kye")
+}
@@ -0,0 +1,185 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+const (
+	// configuration last applied successfully
+	appliedConfigurationName = "applied-configuration"
+
+	defaultConfigurationApplyTimeout = 5 * time.Minute
+)
+
+var ErrConfigurationApply = errors.New("failed to apply device configuration")
+
+// Device configuration deployed by the server is applied by the configured
+// script, which gets the configuration document on standard input and its
+// ID in MENDER_CONFIGURATION_ID. If the script fails, it is run again with
+// the configuration applied before, so that the device is not left half
+// configured. Configuration applied on the device is reported back.
+type configurationManager struct {
+	script  string
+	timeout time.Duration
+	store   Store
+}
+
+// Returns nil manager if no apply script is configured.
+func newConfigurationManager(config MenderConfig,
+	store Store) (*configurationManager, error) {
+
+	if config.ConfigurationApplyScript == "" {
+		return nil, nil
+	}
+	if store == nil {
+		return nil, errors.New("device configuration needs data store")
+	}
+	cm := &configurationManager{
+		script:  config.ConfigurationApplyScript,
+		timeout: defaultConfigurationApplyTimeout,
+		store:   store,
+	}
+	if config.ConfigurationApplyTimeoutSeconds > 0 {
+		cm.timeout = time.Duration(config.ConfigurationApplyTimeoutSeconds) * time.Second
+	}
+	return cm, nil
+}
+
+// applied returns configuration applied last, nil if there is none.
+func (cm *configurationManager) applied() *client.DeviceConfiguration {
+	data, err := cm.store.ReadAll(appliedConfigurationName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("failed to read applied configuration: %v", err)
+		}
+		return nil
+	}
+	var config client.DeviceConfiguration
+	if err := json.Unmarshal(data, &config); err != nil {
+		log.Errorf("failed to parse applied configuration: %v", err)
+		return nil
+	}
+	return &config
+}
+
+func (cm *configurationManager) run(ctx context.Context,
+	config client.DeviceConfiguration) error {
+
+	ctx, cancel := context.WithTimeout(ctx, cm.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, cm.script)
+	cmd.Env = append(os.Environ(), "MENDER_CONFIGURATION_ID="+config.ID)
+	cmd.Stdin = bytes.NewReader(config.Configuration)
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		log.Infof("configuration apply script output: %s", out)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.Errorf("configuration apply script %s timed out after %v",
+			cm.script, cm.timeout)
+	}
+	return errors.Wrapf(err, "configuration apply script %s failed", cm.script)
+}
+
+// apply applies the configuration, or restores the one applied before if
+// that fails; returns configuration applied on the device once done.
+func (cm *configurationManager) apply(ctx context.Context,
+	config client.DeviceConfiguration) (*client.DeviceConfiguration, error) {
+
+	previous := cm.applied()
+	if previous != nil && previous.ID == config.ID {
+		log.Debugf("configuration %s is applied already", config.ID)
+		return previous, nil
+	}
+
+	log.Infof("applying device configuration %s", config.ID)
+	err := cm.run(ctx, config)
+	if err == nil {
+		data, err := json.Marshal(config)
+		if err == nil {
+			err = cm.store.WriteAll(appliedConfigurationName, data)
+		}
+		if err != nil {
+			// configuration is applied anyway; it is applied again
+			// next time
+			log.Errorf("failed to save applied configuration: %v", err)
+		}
+		return &config, nil
+	}
+	log.Errorf("%v", err)
+	err = errors.Wrapf(ErrConfigurationApply, "configuration %s: %v", config.ID, err)
+
+	if previous == nil {
+		return nil, err
+	}
+	log.Infof("restoring device configuration %s", previous.ID)
+	if rerr := cm.run(ctx, *previous); rerr != nil {
+		log.Errorf("failed to restore configuration %s: %v", previous.ID, rerr)
+		return nil, err
+	}
+	return previous, err
+}
+
+// Returns how often device configuration is checked for; 0 if device
+// configuration is not enabled.
+func (m *mender) GetConfigurationPollInterval() time.Duration {
+	if m.configuration == nil {
+		return 0
+	}
+	if m.config.ConfigurationPollIntervalSeconds > 0 {
+		return time.Duration(m.config.ConfigurationPollIntervalSeconds) * time.Second
+	}
+	return m.GetUpdatePollInterval()
+}
+
+// Fetch configuration pending for the device, apply it and report
+// configuration applied on the device back to the server.
+func (m *mender) UpdateConfiguration(ctx context.Context) menderError {
+	if m.configuration == nil {
+		return nil
+	}
+	pending, err := client.GetConfiguration(ctx, m.api.Request(m.authToken),
+		m.config.ServerURL)
+	if err != nil {
+		return NewTransientError(errors.Wrapf(err, "failed to check for configuration"))
+	}
+	if pending == nil {
+		log.Debugf("no configuration pending")
+		return nil
+	}
+
+	applied, err := m.configuration.apply(ctx, *pending)
+	if applied != nil {
+		if rerr := client.ReportConfiguration(ctx, m.api.Request(m.authToken),
+			m.config.ServerURL, *applied); rerr != nil {
+			log.Errorf("failed to report applied configuration: %v", rerr)
+		}
+	}
+	if err != nil {
+		return NewFatalError(err)
+	}
+	return nil
+}
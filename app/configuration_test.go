@@ -0,0 +1,171 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// Apply script saving the configuration to a file, failing for "bad" one.
+func writeConfigurationScript(t *testing.T, dir string) string {
+	script := path.Join(dir, "apply")
+	err := ioutil.WriteFile(script, []byte("#!/bin/sh\n"+
+		"cat > "+path.Join(dir, "config")+"\n"+
+		"echo $MENDER_CONFIGURATION_ID > "+path.Join(dir, "id")+"\n"+
+		"grep -q bad "+path.Join(dir, "config")+" && exit 1\n"+
+		"exit 0\n"), 0755)
+	assert.NoError(t, err)
+	return script
+}
+
+func TestConfigurationManager(t *testing.T) {
+	cm, err := newConfigurationManager(MenderConfig{}, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, cm)
+
+	_, err = newConfigurationManager(MenderConfig{
+		ConfigurationApplyScript: "apply",
+	}, nil)
+	assert.Error(t, err)
+
+	tdir, _ := ioutil.TempDir("", "mender-configuration")
+	defer os.RemoveAll(tdir)
+
+	store := utils.NewMemStore()
+	cm, err = newConfigurationManager(MenderConfig{
+		ConfigurationApplyScript: writeConfigurationScript(t, tdir),
+	}, store)
+	assert.NoError(t, err)
+	assert.Nil(t, cm.applied())
+
+	first := client.DeviceConfiguration{
+		ID:            "config-1",
+		Configuration: []byte(`{"ntp":"pool.ntp.org"}`),
+	}
+	applied, err := cm.apply(context.Background(), first)
+	assert.NoError(t, err)
+	assert.Equal(t, &first, applied)
+	assert.Equal(t, &first, cm.applied())
+	data, _ := ioutil.ReadFile(path.Join(tdir, "config"))
+	assert.Equal(t, `{"ntp":"pool.ntp.org"}`, string(data))
+	data, _ = ioutil.ReadFile(path.Join(tdir, "id"))
+	assert.Equal(t, "config-1\n", string(data))
+
+	// failed configuration is rolled back to the previous one
+	bad := client.DeviceConfiguration{
+		ID:            "config-2",
+		Configuration: []byte(`{"ntp":"bad"}`),
+	}
+	applied, err = cm.apply(context.Background(), bad)
+	assert.Error(t, err)
+	assert.Equal(t, ErrConfigurationApply, errors.Cause(err))
+	assert.Equal(t, &first, applied)
+	assert.Equal(t, &first, cm.applied())
+	data, _ = ioutil.ReadFile(path.Join(tdir, "config"))
+	assert.Equal(t, `{"ntp":"pool.ntp.org"}`, string(data))
+
+	// nothing to roll back to
+	store.Remove(appliedConfigurationName)
+	applied, err = cm.apply(context.Background(), bad)
+	assert.Error(t, err)
+	assert.Nil(t, applied)
+}
+
+func TestConfigurationManagerTimeout(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mender-configuration")
+	defer os.RemoveAll(tdir)
+
+	script := path.Join(tdir, "apply")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\nexec sleep 10\n"), 0755)
+	cm, _ := newConfigurationManager(MenderConfig{
+		ConfigurationApplyScript:         script,
+		ConfigurationApplyTimeoutSeconds: 1,
+	}, utils.NewMemStore())
+
+	applied, err := cm.apply(context.Background(), client.DeviceConfiguration{
+		ID:            "config-1",
+		Configuration: []byte(`{}`),
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "timed out")
+	assert.Nil(t, applied)
+}
+
+func TestMenderUpdateConfiguration(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mender-configuration")
+	defer os.RemoveAll(tdir)
+
+	var pending string
+	var reported []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if pending == "" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.Write([]byte(pending))
+		case http.MethodPut:
+			reported, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer ts.Close()
+
+	mender := newTestMender(nil, MenderConfig{
+		ServerURL:                 ts.URL,
+		UpdatePollIntervalSeconds: 60,
+	}, testMenderPieces{})
+	assert.Equal(t, time.Duration(0), mender.GetConfigurationPollInterval())
+	assert.Nil(t, mender.UpdateConfiguration(context.Background()))
+
+	mender = newTestMender(nil, MenderConfig{
+		ServerURL:                 ts.URL,
+		UpdatePollIntervalSeconds: 60,
+		ConfigurationApplyScript:  writeConfigurationScript(t, tdir),
+	}, testMenderPieces{})
+	assert.Equal(t, time.Minute, mender.GetConfigurationPollInterval())
+
+	// nothing pending, nothing reported
+	assert.Nil(t, mender.UpdateConfiguration(context.Background()))
+	assert.Nil(t, reported)
+
+	pending = `{"id": "config-1", "configuration": {"ntp": "pool.ntp.org"}}`
+	assert.Nil(t, mender.UpdateConfiguration(context.Background()))
+	var config client.DeviceConfiguration
+	assert.NoError(t, json.Unmarshal(reported, &config))
+	assert.Equal(t, "config-1", config.ID)
+
+	// failed configuration is reported as the one restored
+	reported = nil
+	pending = `{"id": "config-2", "configuration": {"ntp": "bad"}}`
+	merr := mender.UpdateConfiguration(context.Background())
+	assert.NotNil(t, merr)
+	assert.True(t, merr.IsFatal())
+	assert.NoError(t, json.Unmarshal(reported, &config))
+	assert.Equal(t, "config-1", config.ID)
+}
@@ -0,0 +1,108 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+)
+
+const connectionCheckTimeout = time.Minute
+
+var errConnectionCheckFailed = errors.New("connection check failed")
+
+// Check connectivity with the server like the daemon would connect to it,
+// reporting result and latency of each step. Nothing is stored; the check
+// can be run while the daemon is running.
+func doCheckConnection(config *MenderConfig, dataStore string, out io.Writer) error {
+	api, err := client.New(config.GetHttpConfig())
+	if err != nil {
+		return errors.Wrap(err, "error creating HTTP client")
+	}
+	api.SetHeaders(config.GetHttpHeaders(GetDeviceType(defaultDeviceTypeFile)))
+	if err := api.SetBindDevice(config.APIBindDevice); err != nil {
+		return err
+	}
+
+	tentok, err := loadTenantToken(dataStore, defaultTenantTokenFile,
+		config.StoreEncryptionKeyFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load tenant token")
+	}
+	authmgr := NewAuthManager(AuthManagerConfig{
+		// authorization token obtained is discarded
+		AuthDataStore:  utils.NewMemStore(),
+		KeyStore:       getKeyStore(dataStore, config.DeviceKey),
+		IdentitySource: NewIdentityDataGetter(),
+		TenantToken:    tentok,
+		AuthData:       deviceAuthData(defaultArtifactInfoFile, defaultDeviceTypeFile),
+	})
+	var auth client.AuthDataMessenger
+	if authmgr != nil && authmgr.HasKey() {
+		auth = authmgr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectionCheckTimeout)
+	defer cancel()
+	steps := client.CheckConnection(ctx, api, config.ServerURL, auth)
+
+	printConnectionCheck(out, config.ServerURL, steps)
+	for _, s := range steps {
+		if s.Result != client.CheckOK {
+			return errConnectionCheckFailed
+		}
+	}
+	return nil
+}
+
+type connectionCheckEntry struct {
+	Name      string  `json:"name"`
+	Result    string  `json:"result"`
+	Detail    string  `json:"detail,omitempty"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+func printConnectionCheck(out io.Writer, server string, steps []client.ConnectionCheckStep) {
+	if isJSONOutput(out) {
+		entries := make([]connectionCheckEntry, 0, len(steps))
+		for _, s := range steps {
+			entries = append(entries, connectionCheckEntry{
+				Name:      s.Name,
+				Result:    s.Result,
+				Detail:    s.Detail,
+				LatencyMs: float64(s.Latency) / float64(time.Millisecond),
+			})
+		}
+		printJSON(out, struct {
+			Server string                 `json:"server"`
+			Steps  []connectionCheckEntry `json:"steps"`
+		}{server, entries})
+		return
+	}
+
+	fmt.Fprintf(out, "checking connection to %s\n", server)
+	for _, s := range steps {
+		latency := "-"
+		if s.Result != client.CheckSkipped {
+			latency = s.Latency.String()
+		}
+		fmt.Fprintf(out, "%-12s %-8s %12s  %s\n", s.Name, s.Result, latency, s.Detail)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintConnectionCheck(t *testing.T) {
+	steps := []client.ConnectionCheckStep{
+		{Name: client.CheckStepDNS, Result: client.CheckOK,
+			Detail: "resolved", Latency: 1500 * time.Microsecond},
+		{Name: client.CheckStepTCP, Result: client.CheckFailed,
+			Detail: "connection refused", Latency: time.Millisecond},
+		{Name: client.CheckStepTLS, Result: client.CheckSkipped},
+	}
+
+	out := &bytes.Buffer{}
+	printConnectionCheck(out, "https://mender.example.com", steps)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 4)
+	assert.Equal(t, "checking connection to https://mender.example.com", lines[0])
+	assert.Equal(t, []string{"dns", "ok", "1.5ms", "resolved"}, strings.Fields(lines[1]))
+	assert.Equal(t, []string{"tcp", "failed", "1ms", "connection", "refused"},
+		strings.Fields(lines[2]))
+	assert.Equal(t, []string{"tls", "skipped", "-"}, strings.Fields(lines[3]))
+
+	out.Reset()
+	printConnectionCheck(&jsonOutput{out}, "https://mender.example.com", steps)
+	var res struct {
+		Server string
+		Steps  []connectionCheckEntry
+	}
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &res))
+	assert.Equal(t, "https://mender.example.com", res.Server)
+	assert.Equal(t, connectionCheckEntry{
+		Name:      "dns",
+		Result:    "ok",
+		Detail:    "resolved",
+		LatencyMs: 1.5,
+	}, res.Steps[0])
+	assert.Len(t, res.Steps, 3)
+}
+
+func TestDoCheckConnection(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	// device not bootstrapped, no key for authorization
+	out := &bytes.Buffer{}
+	err := doCheckConnection(&MenderConfig{
+		ServerURL: ts.URL,
+		DeviceKey: "devkey",
+	}, tdir, out)
+	assert.Equal(t, errConnectionCheckFailed, err)
+	assert.Contains(t, out.String(), "bootstrap first")
+	// nothing is stored
+	files, _ := ioutil.ReadDir(tdir)
+	assert.Empty(t, files)
+}
+
+func TestCheckConnectionOption(t *testing.T) {
+	opts, err := argsParse([]string{"-no-syslog", "-check-connection"})
+	assert.NoError(t, err)
+	assert.True(t, *opts.checkConn)
+	assert.Equal(t, "", instanceLockMode(opts))
+
+	_, err = argsParse([]string{"-no-syslog", "-check-connection", "-daemon"})
+	assert.Equal(t, errMsgAmbiguousArgumentsGiven, err)
+}
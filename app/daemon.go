@@ -0,0 +1,170 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// Config section
+
+type menderDaemon struct {
+	mender Controller
+	stop   context.CancelFunc
+	sctx   StateContext
+	store  Store
+	// event sequence persisted in store; detached when store is closed
+	events *eventSequence
+	guard  stateLoopGuard
+	audit  *resourceAudit
+	// cancels context of the last time limited state
+	stateCancel context.CancelFunc
+	// inventory submission running alongside a deployment
+	inventory *backgroundInventory
+	// waits for network and clock before the state machine starts
+	readiness *readinessGate
+}
+
+func NewDaemon(mender Controller, store Store) *menderDaemon {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	daemon := menderDaemon{
+		mender: mender,
+		stop:   cancel,
+		sctx: StateContext{
+			context: ctx,
+			store:   store,
+		},
+		store: store,
+	}
+	return &daemon
+}
+
+// StopDaemon cancels the context of the state machine; any wait, client call
+// or install in progress is interrupted immediately.
+func (d *menderDaemon) StopDaemon() {
+	d.stop()
+}
+
+func (d *menderDaemon) Cleanup() {
+	if d.store != nil {
+		// event stamps must not be persisted to the closed store
+		if d.events != nil {
+			d.events.setStore(nil)
+		}
+		if err := d.store.Close(); err != nil {
+			log.Errorf("failed to close data store: %v", err)
+		}
+		d.store = nil
+	}
+}
+
+func (d *menderDaemon) shouldStop() bool {
+	return d.sctx.Context().Err() != nil
+}
+
+func (d *menderDaemon) Run() error {
+	defer func() {
+		if d.stateCancel != nil {
+			d.stateCancel()
+			d.stateCancel = nil
+		}
+		d.stopInventory()
+	}()
+	// authorizing before the device is online is bound to fail
+	if !d.readiness.wait(d.sctx.Context()) {
+		return nil
+	}
+	// backoff is not reset by restarting
+	d.sctx.retry = loadRetryBackoff(d.store)
+	// finishing deployment in progress goes first
+	if d.sctx.resuming = deploymentInProgress(d.store); d.sctx.resuming {
+		log.Infof("resuming deployment in progress")
+	}
+
+	// figure out the state
+	for {
+		state, cancelled := d.runState()
+		if d.shouldStop() {
+			return nil
+		}
+		if state.Id() == MenderStateError {
+			es, ok := state.(*ErrorState)
+			if ok {
+				if es.IsFatal() {
+					if es.cause.Cause() == ErrRebootRequired {
+						return ErrRebootRequired
+					}
+					return es.cause
+				}
+			} else {
+				return errors.New("failed")
+			}
+		}
+		if cancelled || state.Id() == MenderStateDone {
+			break
+		}
+
+		if d.guard.transition(time.Now(), state.Id()) {
+			log.Errorf("state loop detected: more than %d state transitions "+
+				"within %v, last %s -> %s; backing off for %v",
+				maxStateTransitions, stateLoopWindow,
+				d.mender.GetState().Id(), state.Id(), stateLoopBackoff)
+			markStateLoop(d.store, time.Now())
+			state = stateLoopWaitState
+		} else if state.Id() == MenderStateCheckWait {
+			// deployment, if any, is over
+			d.sctx.resuming = false
+			// inventory with the loop flag has been sent by now
+			clearStateLoop(d.store)
+			// back to idle, all resources used by the cycle should
+			// have been released
+			if err := d.audit.cycle(); err != nil {
+				return err
+			}
+		}
+
+		d.scheduleInventory(state)
+		d.mender.SetState(state)
+	}
+	return nil
+}
+
+// scheduleInventory starts background inventory submission when the state
+// machine enters a deployment state and stops it once the deployment moves on.
+func (d *menderDaemon) scheduleInventory(next State) {
+	if backgroundInventoryStates[next.Id()] {
+		if d.inventory == nil {
+			d.inventory = startBackgroundInventory(d.sctx.Context(),
+				d.mender, d.sctx.lastInventoryUpdate)
+		}
+		return
+	}
+	d.stopInventory()
+}
+
+func (d *menderDaemon) stopInventory() {
+	if d.inventory == nil {
+		return
+	}
+	if last := d.inventory.stop(); last.After(d.sctx.lastInventoryUpdate) {
+		d.sctx.lastInventoryUpdate = last
+	}
+	d.inventory = nil
+}
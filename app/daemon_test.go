@@ -11,13 +11,11 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
-package main
+package app
 
 import (
-	"io"
-	"io/ioutil"
+	"context"
 	"net/http"
-	"os"
 	"testing"
 	"time"
 
@@ -27,60 +25,6 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-type fakeDevice struct {
-	retReboot         error
-	retInstallUpdate  error
-	retEnablePart     error
-	retCommit         error
-	retRollback       error
-	retHasUpdate      bool
-	retHasUpdateError error
-	consumeUpdate     bool
-}
-
-func (f fakeDevice) Reboot() error {
-	return f.retReboot
-}
-
-func (f fakeDevice) Rollback() error {
-	return f.retRollback
-}
-
-func (f fakeDevice) InstallUpdate(from io.ReadCloser, sz int64) error {
-	if f.consumeUpdate {
-		_, err := io.Copy(ioutil.Discard, from)
-		return err
-	}
-	return f.retInstallUpdate
-}
-
-func (f fakeDevice) EnableUpdatedPartition() error {
-	return f.retEnablePart
-}
-
-func (f fakeDevice) CommitUpdate() error {
-	return f.retCommit
-}
-
-func (f fakeDevice) HasUpdate() (bool, error) {
-	return f.retHasUpdate, f.retHasUpdateError
-}
-
-type fakeUpdater struct {
-	GetScheduledUpdateReturnIface interface{}
-	GetScheduledUpdateReturnError error
-	fetchUpdateReturnReadCloser   io.ReadCloser
-	fetchUpdateReturnSize         int64
-	fetchUpdateReturnError        error
-}
-
-func (f fakeUpdater) GetScheduledUpdate(api client.ApiRequester, url string) (interface{}, error) {
-	return f.GetScheduledUpdateReturnIface, f.GetScheduledUpdateReturnError
-}
-func (f fakeUpdater) FetchUpdate(api client.ApiRequester, url string) (io.ReadCloser, int64, error) {
-	return f.fetchUpdateReturnReadCloser, f.fetchUpdateReturnSize, f.fetchUpdateReturnError
-}
-
 func fakeProcessUpdate(response *http.Response) (interface{}, error) {
 	return nil, nil
 }
@@ -95,7 +39,7 @@ func (f *fakePreDoneState) Handle(ctx *StateContext, c Controller) (State, bool)
 
 func TestDaemon(t *testing.T) {
 	store := utils.NewMemStore()
-	mender := newTestMender(nil, menderConfig{},
+	mender := newTestMender(nil, MenderConfig{},
 		testMenderPieces{
 			MenderPieces: MenderPieces{
 				store: store,
@@ -133,9 +77,9 @@ type daemonTestController struct {
 	updateCheckCount int
 }
 
-func (d *daemonTestController) CheckUpdate() (*client.UpdateResponse, menderError) {
+func (d *daemonTestController) CheckUpdate(ctx context.Context) (*client.UpdateResponse, menderError) {
 	d.updateCheckCount = d.updateCheckCount + 1
-	return d.stateTestController.CheckUpdate()
+	return d.stateTestController.CheckUpdate(ctx)
 }
 
 func (d *daemonTestController) RunState(ctx *StateContext) (State, bool) {
@@ -159,16 +103,48 @@ func TestDaemonRun(t *testing.T) {
 	}
 	daemon := NewDaemon(dtc, utils.NewMemStore())
 
-	tempDir, _ := ioutil.TempDir("", "logs")
-	DeploymentLogger = NewDeploymentLogManager(tempDir)
-	defer os.RemoveAll(tempDir)
-
-	go daemon.Run()
+	done := make(chan struct{})
+	go func() {
+		daemon.Run()
+		close(done)
+	}()
 
 	timespolled := 5
 	time.Sleep(time.Duration(timespolled) * pollInterval)
 	daemon.StopDaemon()
+	<-done
 
 	t.Logf("poke count: %v", dtc.updateCheckCount)
 	assert.False(t, dtc.updateCheckCount < (timespolled-1))
 }
+
+func TestDaemonStop(t *testing.T) {
+	dtc := &daemonTestController{
+		stateTestController{
+			pollIntvl: time.Hour,
+			state:     checkWaitState,
+		},
+		0,
+	}
+	daemon := NewDaemon(dtc, utils.NewMemStore())
+	// nothing is due for the next hour
+	daemon.sctx.lastUpdateCheck = time.Now()
+	daemon.sctx.lastInventoryUpdate = time.Now()
+
+	done := make(chan error)
+	go func() {
+		done <- daemon.Run()
+	}()
+
+	// stopping should interrupt the wait right away
+	time.Sleep(10 * time.Millisecond)
+	daemon.StopDaemon()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatalf("daemon did not stop")
+	}
+	assert.Equal(t, 0, dtc.updateCheckCount)
+}
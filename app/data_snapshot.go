@@ -0,0 +1,347 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Files of the data partition listed in DataSnapshotPaths are saved to a tar
+// file in the data store before the update is installed. Should the update be
+// rolled back, the restore script is asked whether the files are to be
+// restored, eg. because the new artifact migrated application data to a
+// format the previous one cannot read.
+const (
+	dataSnapshotFile = "data-snapshot.tar"
+	// snapshot information, in the store
+	dataSnapshotName = "data-snapshot"
+
+	defaultDataSnapshotMaxSizeKB = 64 * 1024
+	dataSnapshotRestoreTimeout   = 5 * time.Minute
+)
+
+var errDataSnapshotTooLarge = errors.New("data snapshot size limit exceeded")
+
+type dataSnapshotInfo struct {
+	DeploymentID string    `json:"deployment_id"`
+	Time         time.Time `json:"time"`
+	// paths saved, and paths not present when the snapshot was taken; the
+	// latter are removed on restore
+	Paths   []string `json:"paths"`
+	Missing []string `json:"missing,omitempty"`
+}
+
+type dataSnapshot struct {
+	paths []string
+	// limit of file contents saved, in bytes
+	maxSize int64
+	file    string
+	script  string
+	store   Store
+}
+
+// Returns nil if no paths are configured.
+func newDataSnapshot(config MenderConfig, dataStore string, store Store) *dataSnapshot {
+	if len(config.DataSnapshotPaths) == 0 {
+		return nil
+	}
+	s := &dataSnapshot{
+		maxSize: defaultDataSnapshotMaxSizeKB * 1024,
+		file:    filepath.Join(dataStore, dataSnapshotFile),
+		script:  config.DataSnapshotRestoreScript,
+		store:   store,
+	}
+	for _, p := range config.DataSnapshotPaths {
+		s.paths = append(s.paths, filepath.Clean(p))
+	}
+	if config.DataSnapshotMaxSizeKB > 0 {
+		s.maxSize = int64(config.DataSnapshotMaxSizeKB) * 1024
+	}
+	return s
+}
+
+func (s *dataSnapshot) info() *dataSnapshotInfo {
+	data, err := s.store.ReadAll(dataSnapshotName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("failed to read data snapshot information: %v", err)
+		}
+		return nil
+	}
+	var info dataSnapshotInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		log.Errorf("failed to parse data snapshot information: %v", err)
+		return nil
+	}
+	return &info
+}
+
+// take saves the files, replacing the snapshot taken before.
+func (s *dataSnapshot) take(deploymentID string) error {
+	s.drop()
+
+	info := dataSnapshotInfo{DeploymentID: deploymentID, Time: time.Now().UTC()}
+	tmp := s.file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create data snapshot")
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	var size int64
+	for _, p := range s.paths {
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			info.Missing = append(info.Missing, p)
+			continue
+		}
+		err := filepath.Walk(p, func(name string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.Mode().IsRegular() {
+				size += fi.Size()
+				if size > s.maxSize {
+					return errors.Wrapf(errDataSnapshotTooLarge,
+						"more than %d bytes", s.maxSize)
+				}
+			}
+			return addTarEntry(tw, name, fi)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to snapshot %s", p)
+		}
+		info.Paths = append(info.Paths, p)
+	}
+	if err := tw.Close(); err != nil {
+		return errors.Wrapf(err, "failed to write data snapshot")
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to write data snapshot")
+	}
+	if err := os.Rename(tmp, s.file); err != nil {
+		return errors.Wrapf(err, "failed to write data snapshot")
+	}
+
+	data, _ := json.Marshal(info)
+	if err := s.store.WriteAll(dataSnapshotName, data); err != nil {
+		os.Remove(s.file)
+		return errors.Wrapf(err, "failed to save data snapshot information")
+	}
+	log.Infof("data snapshot of %s taken (%d bytes)", strings.Join(info.Paths, ", "), size)
+	return nil
+}
+
+func addTarEntry(tw *tar.Writer, name string, fi os.FileInfo) error {
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(name); err != nil {
+			return err
+		}
+	} else if !fi.Mode().IsRegular() && !fi.IsDir() {
+		log.Warnf("data snapshot: skipping special file %s", name)
+		return nil
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = strings.TrimPrefix(name, "/")
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(tw, f, fi.Size())
+	return err
+}
+
+// restoreRequested runs the restore script, which requests the restore by
+// exiting with status 0.
+func (s *dataSnapshot) restoreRequested(info *dataSnapshotInfo) bool {
+	if s.script == "" {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dataSnapshotRestoreTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, s.script)
+	cmd.Env = append(os.Environ(),
+		"MENDER_DEPLOYMENT_ID="+info.DeploymentID,
+		"MENDER_DATA_SNAPSHOT="+s.file,
+		"MENDER_DATA_SNAPSHOT_PATHS="+strings.Join(append(info.Paths, info.Missing...), ":"))
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		log.Infof("data snapshot restore script output: %s", out)
+	}
+	if err != nil {
+		log.Infof("data snapshot restore not requested by %s: %v", s.script, err)
+		return false
+	}
+	return true
+}
+
+// restore puts the files saved before the deployment back, if the restore
+// script requests it; the snapshot is dropped afterwards.
+func (s *dataSnapshot) restore(deploymentID string) error {
+	info := s.info()
+	if info == nil || info.DeploymentID != deploymentID {
+		return nil
+	}
+	if !s.restoreRequested(info) {
+		s.drop()
+		return nil
+	}
+
+	log.Infof("restoring data snapshot of %s", strings.Join(info.Paths, ", "))
+	// files the new artifact added are gone too
+	for _, p := range append(info.Paths, info.Missing...) {
+		if err := os.RemoveAll(p); err != nil {
+			return errors.Wrapf(err, "failed to restore data snapshot")
+		}
+	}
+	if err := extractDataSnapshot(s.file, info.Paths); err != nil {
+		// snapshot is kept; restore is done again if the daemon is
+		// restarted
+		return errors.Wrapf(err, "failed to restore data snapshot")
+	}
+	syncFilesystems()
+	s.drop()
+	return nil
+}
+
+// Whether name is one of paths, or inside one.
+func underPaths(name string, paths []string) bool {
+	for _, p := range paths {
+		if name == p || strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func extractDataSnapshot(file string, paths []string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := filepath.Clean("/" + hdr.Name)
+		if !underPaths(name, paths) {
+			return errors.Errorf("unexpected file %s in data snapshot", name)
+		}
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(name, mode.Perm())
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, name)
+		case tar.TypeReg:
+			var out *os.File
+			out, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+			if err == nil {
+				_, err = io.Copy(out, tr)
+				if cerr := out.Close(); err == nil {
+					err = cerr
+				}
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// ownership is restored as far as permitted
+		os.Lchown(name, hdr.Uid, hdr.Gid)
+		if hdr.Typeflag != tar.TypeSymlink {
+			os.Chmod(name, mode.Perm())
+			os.Chtimes(name, hdr.ModTime, hdr.ModTime)
+		}
+	}
+}
+
+func (s *dataSnapshot) drop() {
+	// including snapshot left partially written by interrupted take
+	for _, name := range []string{s.file, s.file + ".tmp"} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			log.Errorf("failed to remove data snapshot: %v", err)
+		}
+	}
+	if _, err := s.store.ReadAll(dataSnapshotName); err != nil {
+		return
+	}
+	if err := s.store.Remove(dataSnapshotName); err != nil {
+		log.Errorf("failed to remove data snapshot information: %v", err)
+	}
+}
+
+// SnapshotData saves the configured data files before the update is
+// installed. The update is installed even if that fails.
+func (m *mender) SnapshotData(update client.UpdateResponse) {
+	if m.dataSnapshot == nil {
+		return
+	}
+	if err := m.dataSnapshot.take(update.ID); err != nil {
+		log.Errorf("update is installed without data snapshot: %v", err)
+		m.dataSnapshot.drop()
+	}
+}
+
+// RestoreDataSnapshot restores the data files saved before the rolled back
+// update was installed, if requested.
+func (m *mender) RestoreDataSnapshot(update client.UpdateResponse) {
+	if m.dataSnapshot == nil {
+		return
+	}
+	if err := m.dataSnapshot.restore(update.ID); err != nil {
+		log.Errorf("%v", err)
+	}
+}
+
+// DropDataSnapshot removes data files saved, once they are no longer needed.
+func (m *mender) DropDataSnapshot() {
+	if m.dataSnapshot == nil {
+		return
+	}
+	m.dataSnapshot.drop()
+}
@@ -0,0 +1,148 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDataSnapshot(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "datasnapshot")
+	defer os.RemoveAll(tdir)
+	data := path.Join(tdir, "data")
+	os.MkdirAll(path.Join(data, "app", "db"), 0755)
+	ioutil.WriteFile(path.Join(data, "app", "db", "schema"), []byte("v1"), 0640)
+	os.Symlink("db/schema", path.Join(data, "app", "current"))
+	ioutil.WriteFile(path.Join(data, "settings.conf"), []byte("a=1"), 0600)
+
+	// restore requested only for deployment foo
+	script := path.Join(tdir, "restore")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\n"+
+		"echo \"$MENDER_DATA_SNAPSHOT_PATHS\" > "+path.Join(tdir, "paths")+"\n"+
+		"test \"$MENDER_DEPLOYMENT_ID\" = foo\n"), 0755)
+
+	ms := utils.NewMemStore()
+	assert.Nil(t, newDataSnapshot(MenderConfig{}, tdir, ms))
+	s := newDataSnapshot(MenderConfig{
+		DataSnapshotPaths: []string{path.Join(data, "app"),
+			path.Join(data, "settings.conf"), path.Join(data, "cache/")},
+		DataSnapshotRestoreScript: script,
+	}, tdir, ms)
+	assert.NoError(t, s.take("foo"))
+	info := s.info()
+	assert.Equal(t, "foo", info.DeploymentID)
+	assert.Equal(t, []string{path.Join(data, "app"), path.Join(data, "settings.conf")},
+		info.Paths)
+	assert.Equal(t, []string{path.Join(data, "cache")}, info.Missing)
+
+	// the new artifact migrates the data
+	ioutil.WriteFile(path.Join(data, "app", "db", "schema"), []byte("v2"), 0640)
+	ioutil.WriteFile(path.Join(data, "app", "db", "index"), []byte("v2"), 0640)
+	os.Remove(path.Join(data, "settings.conf"))
+	os.MkdirAll(path.Join(data, "cache"), 0755)
+
+	// other deployments are not restored
+	assert.NoError(t, s.restore("bar"))
+	assert.NotNil(t, s.info())
+
+	assert.NoError(t, s.restore("foo"))
+	schema, _ := ioutil.ReadFile(path.Join(data, "app", "db", "schema"))
+	assert.Equal(t, "v1", string(schema))
+	link, _ := os.Readlink(path.Join(data, "app", "current"))
+	assert.Equal(t, "db/schema", link)
+	fi, err := os.Stat(path.Join(data, "settings.conf"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	}
+	_, err = os.Stat(path.Join(data, "app", "db", "index"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(data, "cache"))
+	assert.True(t, os.IsNotExist(err))
+	paths, _ := ioutil.ReadFile(path.Join(tdir, "paths"))
+	assert.Equal(t, strings.Join([]string{path.Join(data, "app"),
+		path.Join(data, "settings.conf"), path.Join(data, "cache")}, ":"),
+		strings.TrimSpace(string(paths)))
+
+	// snapshot is gone once restored
+	assert.Nil(t, s.info())
+	_, err = os.Stat(path.Join(tdir, dataSnapshotFile))
+	assert.True(t, os.IsNotExist(err))
+
+	// not restored unless the script requests it
+	assert.NoError(t, s.take("bar"))
+	ioutil.WriteFile(path.Join(data, "app", "db", "schema"), []byte("v2"), 0640)
+	assert.NoError(t, s.restore("bar"))
+	schema, _ = ioutil.ReadFile(path.Join(data, "app", "db", "schema"))
+	assert.Equal(t, "v2", string(schema))
+	assert.Nil(t, s.info())
+}
+
+func TestDataSnapshotTooLarge(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "datasnapshot")
+	defer os.RemoveAll(tdir)
+	ioutil.WriteFile(path.Join(tdir, "big"), bytes.Repeat([]byte("a"), 2048), 0600)
+
+	ms := utils.NewMemStore()
+	s := newDataSnapshot(MenderConfig{
+		DataSnapshotPaths:     []string{path.Join(tdir, "big")},
+		DataSnapshotMaxSizeKB: 1,
+	}, tdir, ms)
+	err := s.take("foo")
+	assert.Equal(t, errDataSnapshotTooLarge, errors.Cause(err))
+	assert.Nil(t, s.info())
+	_, err = os.Stat(path.Join(tdir, dataSnapshotFile))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStateDataSnapshot(t *testing.T) {
+
+	update := client.UpdateResponse{ID: "foo"}
+	ctx := StateContext{store: utils.NewMemStore()}
+
+	// taken before install
+	sc := &stateTestController{}
+	data := "test"
+	s, _ := NewUpdateInstallState(ioutil.NopCloser(bytes.NewBufferString(data)),
+		int64(len(data)), update).Handle(&ctx, sc)
+	assert.IsType(t, &RebootState{}, s)
+	assert.Equal(t, []string{"snapshot"}, sc.dataSnapshot)
+
+	// dropped once committed
+	sc = &stateTestController{}
+	s, _ = NewUpdateCommitState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Equal(t, []string{"drop"}, sc.dataSnapshot)
+
+	// restored once the bootloader rolled back...
+	sc = &stateTestController{}
+	s, _ = NewUpdateVerifyState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Equal(t, []string{"restore"}, sc.dataSnapshot)
+
+	// ...or application update was rolled back
+	sc = &stateTestController{appUpdate: true}
+	s, _ = NewRollbackState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Equal(t, []string{"restore"}, sc.dataSnapshot)
+}
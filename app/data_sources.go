@@ -0,0 +1,100 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// IdentitySource supplies identity data of the device, in place of the
+// identity script, for programs embedding the agent: attributes keyed by
+// name, with string or []string values. The data must not change, as the
+// server tells devices apart by it.
+type IdentitySource func() (map[string]interface{}, error)
+
+// InventorySource supplies inventory attributes of the device, in addition
+// to the ones of inventory scripts, for programs embedding the agent:
+// attributes keyed by name, with string or []string values; names of
+// attributes the client reports itself are reserved. Sources are
+// called from the goroutine submitting the inventory, which may run
+// alongside a deployment.
+type InventorySource func() (map[string]interface{}, error)
+
+// Adapts identity source to the interface of the identity script runner.
+type identitySourceGetter struct {
+	src IdentitySource
+}
+
+func (g identitySourceGetter) Get() (string, error) {
+	attrs, err := g.src()
+	if err != nil {
+		return "", errors.Wrapf(err, "identity source failed")
+	}
+	if len(attrs) == 0 {
+		return "", errors.New("no identity data collected")
+	}
+	encdata, err := json.Marshal(IdentityData(attrs))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to encode identity data")
+	}
+	return string(encdata), nil
+}
+
+// Returns identity data getter of the source; identity script runner if
+// there is none.
+func newIdentityGetter(src IdentitySource) IdentityDataGetter {
+	if src == nil {
+		return NewIdentityDataGetter()
+	}
+	return identitySourceGetter{src}
+}
+
+// AddInventorySource registers source of inventory attributes; must be
+// called before the daemon runs.
+func (m *mender) AddInventorySource(src InventorySource) {
+	m.inventorySources = append(m.inventorySources, src)
+}
+
+// Adds attributes of all inventory sources to idata; attributes of sources
+// registered later take precedence. Failed sources are skipped, attributes
+// reserved for the client or not of string type dropped.
+func (m *mender) collectInventorySources(idata client.InventoryData) client.InventoryData {
+	for i, src := range m.inventorySources {
+		attrs, err := src()
+		if err != nil {
+			log.Errorf("inventory source %d failed: %v", i, err)
+			continue
+		}
+		if idata == nil {
+			idata = make(client.InventoryData, 0, len(attrs))
+		}
+		collected := make([]client.InventoryAttribute, 0, len(attrs))
+		for name, value := range attrs {
+			if err := checkInventoryAttr(name, value); err != nil {
+				log.Errorf("inventory source %d: %v", i, err)
+				continue
+			}
+			collected = append(collected, client.InventoryAttribute{
+				Name:  name,
+				Value: value,
+			})
+		}
+		idata.ReplaceAttributes(collected)
+	}
+	return idata
+}
@@ -0,0 +1,122 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mendersoftware/mender/app/testutils"
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentitySource(t *testing.T) {
+	_, ok := newIdentityGetter(nil).(*IdentityDataRunner)
+	assert.True(t, ok)
+
+	g := newIdentityGetter(func() (map[string]interface{}, error) {
+		return map[string]interface{}{
+			"mac": "de:ad:be:ef:00:01",
+			"sn":  []string{"1234", "5678"},
+		}, nil
+	})
+	id, err := g.Get()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"mac": "de:ad:be:ef:00:01", "sn": ["1234", "5678"]}`, id)
+
+	g = newIdentityGetter(func() (map[string]interface{}, error) {
+		return nil, nil
+	})
+	_, err = g.Get()
+	assert.Error(t, err)
+
+	g = newIdentityGetter(func() (map[string]interface{}, error) {
+		return nil, errors.New("no network interfaces")
+	})
+	_, err = g.Get()
+	assert.Error(t, err)
+}
+
+func TestInventorySources(t *testing.T) {
+	mender := newDefaultTestMender()
+	// no sources, nothing added
+	assert.Nil(t, mender.collectInventorySources(nil))
+
+	mender.AddInventorySource(func() (map[string]interface{}, error) {
+		return map[string]interface{}{"app_version": "1.0", "site": "oslo"}, nil
+	})
+	mender.AddInventorySource(func() (map[string]interface{}, error) {
+		return nil, errors.New("sensor offline")
+	})
+	mender.AddInventorySource(func() (map[string]interface{}, error) {
+		return map[string]interface{}{"site": "bergen"}, nil
+	})
+	// attributes of the client and of other types are dropped
+	mender.AddInventorySource(func() (map[string]interface{}, error) {
+		return map[string]interface{}{
+			"artifact_name":      "spoofed",
+			"mender_client/mode": "spoofed",
+			"uptime":             42,
+		}, nil
+	})
+
+	// sources override scripts and each other in order
+	idata := mender.collectInventorySources(client.InventoryData{
+		{Name: "site", Value: "trondheim"},
+		{Name: "kernel", Value: "4.9"},
+	})
+	attrs := map[string]interface{}{}
+	for _, a := range idata {
+		attrs[a.Name] = a.Value
+	}
+	assert.Equal(t, map[string]interface{}{
+		"app_version": "1.0",
+		"site":        "bergen",
+		"kernel":      "4.9",
+	}, attrs)
+}
+
+func TestMenderAgentDataSources(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	identityCalls := 0
+	agent, err := newMenderAgent(AgentConfig{
+		Config: MenderConfig{
+			ServerURL: "https://localhost",
+		},
+		DataStore: tdir,
+		Identity: func() (map[string]interface{}, error) {
+			identityCalls++
+			return map[string]interface{}{"mac": "de:ad:be:ef:00:01"}, nil
+		},
+	}, &testutils.FakeDevice{})
+	assert.NoError(t, err)
+	defer agent.daemon.Cleanup()
+
+	agent.AddInventorySource(func() (map[string]interface{}, error) {
+		return map[string]interface{}{"app_version": "1.0"}, nil
+	})
+	assert.Len(t, agent.mender.inventorySources, 1)
+
+	// identity comes from the source, not the script
+	assert.Nil(t, agent.mender.Bootstrap())
+	_, err = agent.mender.authMgr.MakeAuthRequest()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, identityCalls)
+}
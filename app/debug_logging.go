@@ -0,0 +1,114 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// The debug-logging device command raises log verbosity of the daemon, and
+// optionally makes it log every API request, for remote debugging of a
+// misbehaving device. Both are reverted once the time given in the command
+// is up, or when the daemon is restarted. Log level is set by the state
+// machine only, as logging reads it unguarded; it is restored with the
+// first state transition after the time is up.
+const (
+	defaultDebugLoggingDuration = 30 * time.Minute
+	maxDebugLoggingDuration     = 4 * time.Hour
+)
+
+type debugLogging struct {
+	// level configured, restored once debug logging ends; set while it is
+	// active
+	saved *logrus.Level
+	until time.Time
+	// clients whose requests are traced
+	apis []*client.ApiClient
+}
+
+// Duration requested by the command, within bounds.
+func debugLoggingDuration(seconds int) time.Duration {
+	d := time.Duration(seconds) * time.Second
+	switch {
+	case seconds <= 0:
+		return defaultDebugLoggingDuration
+	case d > maxDebugLoggingDuration:
+		return maxDebugLoggingDuration
+	}
+	return d
+}
+
+// enable raises log level (never lowers it) and traces API requests if asked
+// to, until the time is up; debug logging enabled before is replaced.
+func (d *debugLogging) enable(level string, trace bool, duration time.Duration) error {
+	lvl := log.DebugLevel
+	if level != "" {
+		var err error
+		if lvl, err = log.ParseLevel(level); err != nil {
+			return errors.Wrapf(err, "invalid log level")
+		}
+	}
+
+	if d.saved == nil {
+		saved := log.Log.Level
+		d.saved = &saved
+	}
+	if lvl < *d.saved {
+		lvl = *d.saved
+	}
+	log.SetLevel(lvl)
+	d.until = time.Now().Add(duration)
+	for _, api := range d.apis {
+		if trace {
+			api.SetTraceUntil(d.until)
+		} else {
+			api.SetTraceUntil(time.Time{})
+		}
+	}
+
+	log.Infof("debug logging enabled until %v: log level %s, api tracing %v",
+		d.until.Format(time.RFC3339), lvl, trace)
+	return nil
+}
+
+// expire reverts to the level configured if the time is up at `now`.
+func (d *debugLogging) expire(now time.Time) {
+	if d != nil && d.saved != nil && !now.Before(d.until) {
+		d.disable()
+	}
+}
+
+// disable reverts to the level configured.
+func (d *debugLogging) disable() {
+	if d.saved == nil {
+		return
+	}
+	for _, api := range d.apis {
+		api.SetTraceUntil(time.Time{})
+	}
+	log.SetLevel(*d.saved)
+	d.saved = nil
+	log.Infof("debug logging disabled")
+}
+
+// EnableDebugLogging acts on the debug-logging device command.
+func (m *mender) EnableDebugLogging(command DeviceCommand) error {
+	return m.debugLogging.enable(command.LogLevel, command.APITrace,
+		debugLoggingDuration(command.DurationSeconds))
+}
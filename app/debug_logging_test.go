@@ -0,0 +1,77 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugLoggingDuration(t *testing.T) {
+	assert.Equal(t, defaultDebugLoggingDuration, debugLoggingDuration(0))
+	assert.Equal(t, 10*time.Minute, debugLoggingDuration(600))
+	assert.Equal(t, maxDebugLoggingDuration, debugLoggingDuration(7*24*3600))
+}
+
+func TestDebugLogging(t *testing.T) {
+	oldLevel := log.Log.Level
+	defer log.SetLevel(oldLevel)
+	log.SetLevel(log.WarnLevel)
+
+	api, _ := client.New(client.Config{})
+	d := &debugLogging{apis: []*client.ApiClient{api}}
+
+	assert.Error(t, d.enable("chatty", false, time.Hour))
+	assert.Equal(t, log.WarnLevel, log.Log.Level)
+
+	assert.NoError(t, d.enable("", true, time.Hour))
+	assert.Equal(t, log.DebugLevel, log.Log.Level)
+
+	// enabled again, replacing the earlier; level configured is kept
+	assert.NoError(t, d.enable("info", false, 50*time.Millisecond))
+	assert.Equal(t, log.InfoLevel, log.Log.Level)
+
+	// reverted once the time is up
+	d.expire(time.Now())
+	assert.Equal(t, log.InfoLevel, log.Log.Level)
+	d.expire(time.Now().Add(time.Minute))
+	assert.Nil(t, d.saved)
+	assert.Equal(t, log.WarnLevel, log.Log.Level)
+
+	// never lowers the level
+	log.SetLevel(log.DebugLevel)
+	assert.NoError(t, d.enable("error", false, time.Hour))
+	assert.Equal(t, log.DebugLevel, log.Log.Level)
+	d.disable()
+	assert.Equal(t, log.DebugLevel, log.Log.Level)
+}
+
+func TestDebugLoggingExpiresOnTransition(t *testing.T) {
+	oldLevel := log.Log.Level
+	defer log.SetLevel(oldLevel)
+	log.SetLevel(log.WarnLevel)
+
+	m := newTestMender(nil, MenderConfig{}, testMenderPieces{})
+	assert.NoError(t, m.EnableDebugLogging(DeviceCommand{DurationSeconds: 3600}))
+	m.SetState(checkWaitState)
+	assert.Equal(t, log.DebugLevel, log.Log.Level)
+
+	m.debugLogging.until = time.Now()
+	m.SetState(updateCheckState)
+	assert.Equal(t, log.WarnLevel, log.Log.Level)
+}
@@ -0,0 +1,125 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mendersoftware/log"
+)
+
+// Files a deployment leaves behind for debugging (outputs of the payload
+// scanner and of the notification command) go to a directory of its own in
+// the scratch directory, named by the deployment ID. The directory is
+// removed once the final status of the deployment is reported; directories
+// of deployments abandoned before that are removed when the next one
+// starts. Deployment logs are kept in the log directory, as the server may
+// ask for them later.
+const deploymentDirsName = "deployments"
+
+type deploymentDirs struct {
+	path string
+}
+
+// Returns nil if there is no scratch directory to keep deployment
+// directories in.
+func newDeploymentDirs(scratch *scratchDir) *deploymentDirs {
+	if scratch == nil {
+		return nil
+	}
+	return &deploymentDirs{
+		path: filepath.Join(scratch.path, deploymentDirsName),
+	}
+}
+
+// Returns name safe to use in a path for a deployment ID or payload name
+// received from the server.
+func safeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+	if name == "" || strings.Trim(name, ".") == "" {
+		return "_"
+	}
+	return name
+}
+
+// dir returns directory of the deployment, creating it if needed; empty
+// string if it can not be created.
+func (d *deploymentDirs) dir(deploymentID string) string {
+	if d == nil || deploymentID == "" {
+		return ""
+	}
+	path := filepath.Join(d.path, safeFileName(deploymentID))
+	if err := os.MkdirAll(path, 0700); err != nil {
+		log.Errorf("failed to create deployment directory %s: %v", path, err)
+		return ""
+	}
+	return path
+}
+
+// begin removes directories of deployments other than the one starting.
+func (d *deploymentDirs) begin(deploymentID string) {
+	if d != nil {
+		d.removeExcept(safeFileName(deploymentID))
+	}
+}
+
+// end removes directories once the deployment is over.
+func (d *deploymentDirs) end() {
+	if d != nil {
+		d.removeExcept("")
+	}
+}
+
+func (d *deploymentDirs) removeExcept(keep string) {
+	dirs, err := ioutil.ReadDir(d.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("failed to read deployment directories: %v", err)
+		}
+		return
+	}
+	for _, fi := range dirs {
+		if fi.Name() == keep {
+			continue
+		}
+		path := filepath.Join(d.path, fi.Name())
+		log.Debugf("removing deployment directory %s", path)
+		if err := os.RemoveAll(path); err != nil {
+			log.Warnf("failed to remove deployment directory %s: %v", path, err)
+		}
+	}
+}
+
+// Tells whether the transition ends the deployment: its final status has
+// been reported (or could not be, and was given up on).
+func deploymentEnded(from, to State) bool {
+	if to.Id() != MenderStateInit {
+		return false
+	}
+	switch from.Id() {
+	case MenderStateUpdateStatusReport, MenderStateReportStatusError:
+		return true
+	}
+	return false
+}
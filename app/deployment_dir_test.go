@@ -0,0 +1,103 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSafeFileName(t *testing.T) {
+	assert.Equal(t, "4b6b0b5e-7c1a-4c1e-9f3e-0a1b2c3d4e5f",
+		safeFileName("4b6b0b5e-7c1a-4c1e-9f3e-0a1b2c3d4e5f"))
+	assert.Equal(t, "rootfs.ext4", safeFileName("rootfs.ext4"))
+	assert.Equal(t, ".._etc_passwd", safeFileName("../etc/passwd"))
+	assert.Equal(t, "_", safeFileName(".."))
+	assert.Equal(t, "_", safeFileName(""))
+}
+
+func TestDeploymentDirs(t *testing.T) {
+	// nothing to do without scratch directory
+	var none *deploymentDirs
+	assert.Nil(t, newDeploymentDirs(nil))
+	assert.Equal(t, "", none.dir("foo"))
+	none.begin("foo")
+	none.end()
+
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	s := newScratchDir(&MenderConfig{}, tdir)
+	assert.NoError(t, s.prepare())
+	d := newDeploymentDirs(s)
+
+	assert.Equal(t, "", d.dir(""))
+	stale := d.dir("stale")
+	assert.Equal(t, filepath.Join(s.path, deploymentDirsName, "stale"), stale)
+	current := d.dir("current")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(current, "output"), nil, 0600))
+
+	// directory of the deployment in progress survives restart
+	assert.NoError(t, s.prepare())
+	_, err := os.Stat(filepath.Join(current, "output"))
+	assert.NoError(t, err)
+
+	// abandoned deployments are removed once the next one starts
+	d.begin("current")
+	_, err = os.Stat(stale)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(current)
+	assert.NoError(t, err)
+
+	d.end()
+	_, err = os.Stat(current)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMenderDeploymentDirs(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	s := newScratchDir(&MenderConfig{}, tdir)
+	assert.NoError(t, s.prepare())
+
+	mender := newTestMender(nil, MenderConfig{
+		NotifyCommand: []string{"/bin/sh", "-c", "echo $MENDER_EVENT"},
+	}, testMenderPieces{MenderPieces: MenderPieces{scratch: s}})
+	update := client.UpdateResponse{ID: "foo"}
+	dir := filepath.Join(s.path, deploymentDirsName, "foo")
+
+	// output of the notification command is kept with the deployment
+	mender.SetState(NewUpdateFetchState(update))
+	mender.notifier.wait()
+	data, err := ioutil.ReadFile(filepath.Join(dir, "notify-update-available.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, "update-available\n", string(data))
+
+	// failed report does not end the deployment
+	mender.SetState(NewUpdateStatusReportState(update, client.StatusSuccess))
+	mender.SetState(NewReportErrorState(update, client.StatusSuccess))
+	mender.SetState(NewRollbackState(update))
+	mender.notifier.wait()
+	_, err = os.Stat(dir)
+	assert.NoError(t, err)
+
+	mender.SetState(NewUpdateStatusReportState(update, client.StatusFailure))
+	mender.SetState(initState)
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+}
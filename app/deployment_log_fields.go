@@ -0,0 +1,160 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/pkg/errors"
+)
+
+// Structured fields of deployment log entries; these end up as separate keys
+// of the uploaded JSON so that the server can aggregate failure causes
+// without parsing messages. Fields are logged with logWithFields(), the
+// regular log gets the message alone.
+const (
+	LogFieldState        = "state"
+	LogFieldSubState     = "substate"
+	LogFieldBytesWritten = "bytes_written"
+	LogFieldErrorCode    = "error_code"
+	// origin of log lines collected from elsewhere (eg. previous boot)
+	LogFieldSource = "source"
+)
+
+// fieldLogger logs messages with fields attached; see logWithFields.
+type fieldLogger logrus.Fields
+
+// logWithFields returns logger of messages with the fields attached. Hooks of
+// the log get the fields in the entry data, the regular log gets the message
+// only, under the module of the caller as other messages.
+func logWithFields(fields logrus.Fields) fieldLogger {
+	return fieldLogger(fields)
+}
+
+func (f fieldLogger) Debugf(format string, args ...interface{}) {
+	f.logf(logrus.DebugLevel, format, args...)
+}
+
+func (f fieldLogger) Infof(format string, args ...interface{}) {
+	f.logf(logrus.InfoLevel, format, args...)
+}
+
+func (f fieldLogger) Warnf(format string, args ...interface{}) {
+	f.logf(logrus.WarnLevel, format, args...)
+}
+
+func (f fieldLogger) Errorf(format string, args ...interface{}) {
+	f.logf(logrus.ErrorLevel, format, args...)
+}
+
+// logf logs the message the way the log package does, handing the fields to
+// the hooks along with it.
+func (f fieldLogger) logf(level logrus.Level, format string, args ...interface{}) {
+	module := callerModule(3)
+	if !logHooks.logsModule(module) {
+		return
+	}
+	entry := log.Log.WithField("module", module)
+
+	hookEntry := *entry.WithFields(logrus.Fields(f))
+	hookEntry.Time = time.Now()
+	hookEntry.Message = fmt.Sprintf(format, args...)
+	hookEntry.Level = level
+	logHooks.Fire(&hookEntry)
+
+	switch level {
+	case logrus.DebugLevel:
+		entry.Debugf(format, args...)
+	case logrus.InfoLevel:
+		entry.Infof(format, args...)
+	case logrus.WarnLevel:
+		entry.Warnf(format, args...)
+	case logrus.ErrorLevel:
+		entry.Errorf(format, args...)
+	}
+}
+
+// Name of the file (without extension) of the function skip frames up the
+// stack, the module the log package gives messages logged there.
+func callerModule(skip int) string {
+	_, file, _, ok := runtime.Caller(skip)
+	if !ok {
+		return "<unknown>"
+	}
+	file = file[strings.LastIndexByte(file, '/')+1:]
+	if ext := strings.LastIndexByte(file, '.'); ext >= 0 {
+		file = file[:ext]
+	}
+	return file
+}
+
+// Codes of errors known by value.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{installer.ErrChecksumMismatch, "checksum_mismatch"},
+	{installer.ErrIncompatibleArtifact, "incompatible_artifact"},
+	{installer.ErrAppSlotsUnsupported, "app_slots_unsupported"},
+	{client.ErrDeploymentAborted, "deployment_aborted"},
+	{ErrArtifactRejected, "artifact_rejected"},
+	{ErrPayloadRejected, "payload_rejected"},
+	{ErrPayloadScanFailed, "payload_scan_failed"},
+	{ErrStateTimeout, "state_timeout"},
+	{ErrDeploymentRevoked, "deployment_revoked"},
+	{ErrDeploymentSkipped, "deployment_skipped"},
+	{syscall.ENOSPC, "no_space"},
+}
+
+// Short, stable identifier of what caused an error, for the error_code field
+// of deployment logs.
+func errorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	if merr, ok := err.(menderError); ok {
+		err = merr.Cause()
+	}
+	err = errors.Cause(err)
+
+	for _, c := range errorCodes {
+		if err == c.err {
+			return c.code
+		}
+	}
+
+	switch e := err.(type) {
+	case *os.PathError:
+		if e.Err == syscall.ENOSPC {
+			return "no_space"
+		}
+		return "io_error"
+	case *client.HTTPError:
+		return fmt.Sprintf("http_%d", e.StatusCode)
+	case *url.Error, net.Error:
+		return "network_" + client.ClassifyError(err).String()
+	}
+	return "unknown"
+}
@@ -0,0 +1,186 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogWithFields(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+
+	deploymentLogger := NewDeploymentLogManager(tempDir)
+	hook := NewDeploymentLogHook(deploymentLogger)
+	hook.events = &eventSequence{}
+	addLogHook(hook)
+
+	deploymentLogger.Enable("3333-4444")
+	logWithFields(logrus.Fields{
+		LogFieldState:     MenderStateUpdateInstall.String(),
+		LogFieldErrorCode: "no_space",
+	}).Errorf("install failed: %s", "disk full")
+	log.Info("plain message")
+	logWithFields(logrus.Fields{LogFieldBytesWritten: 1024}).Infof(
+		"wrote %d bytes", 1024)
+	deploymentLogger.Disable()
+
+	f, err := os.Open(path.Join(tempDir,
+		fmt.Sprintf(logFileNameScheme, 1, "3333-4444")))
+	assert.NoError(t, err)
+	defer f.Close()
+
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry map[string]interface{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	assert.Len(t, entries, 3)
+
+	assert.Equal(t, "install failed: disk full", entries[0]["message"])
+	assert.Equal(t, "error", entries[0]["level"])
+	assert.Equal(t, "update-install", entries[0]["state"])
+	assert.Equal(t, "no_space", entries[0]["error_code"])
+	assert.Contains(t, entries[0], "seq")
+
+	// fields do not leak to other messages
+	assert.Equal(t, "plain message", entries[1]["message"])
+	assert.NotContains(t, entries[1], "state")
+	assert.NotContains(t, entries[1], "error_code")
+
+	assert.Equal(t, float64(1024), entries[2]["bytes_written"])
+	assert.NotContains(t, entries[2], "state")
+}
+
+type captureLogHook struct {
+	lock    sync.Mutex
+	entries []logrus.Entry
+}
+
+func (h *captureLogHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.ErrorLevel, logrus.InfoLevel}
+}
+
+func (h *captureLogHook) Fire(entry *logrus.Entry) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.entries = append(h.entries, *entry)
+	return nil
+}
+
+func TestLogWithFieldsConcurrent(t *testing.T) {
+	hook := &captureLogHook{}
+	addLogHook(hook)
+
+	// identical messages logged at once keep their own fields
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			logWithFields(logrus.Fields{LogFieldBytesWritten: i}).Infof(
+				"concurrent message")
+		}(i)
+	}
+	wg.Wait()
+	logStateError(NewUpdateInstallState(nil, 0, client.UpdateResponse{}),
+		syscall.ENOSPC, "state error message")
+
+	hook.lock.Lock()
+	defer hook.lock.Unlock()
+	seen := map[interface{}]bool{}
+	for _, e := range hook.entries {
+		switch e.Message {
+		case "concurrent message":
+			seen[e.Data[LogFieldBytesWritten]] = true
+			// module is the file logging, as for other messages
+			assert.Equal(t, "deployment_log_fields_test", e.Data["module"])
+		case "state error message":
+			assert.Equal(t, "state", e.Data["module"])
+			assert.Equal(t, "update-install", e.Data[LogFieldState])
+			assert.Equal(t, "no_space", e.Data[LogFieldErrorCode])
+		}
+	}
+	assert.Len(t, seen, 20)
+}
+
+func TestLogWithFieldsModuleFilter(t *testing.T) {
+	hook := &captureLogHook{}
+	addLogHook(hook)
+
+	var out bytes.Buffer
+	oldOut := log.Log.Out
+	log.SetOutput(&out)
+	defer log.SetOutput(oldOut)
+
+	setLogModuleFilter([]string{"state"})
+	logWithFields(logrus.Fields{LogFieldSource: "test"}).Infof("filtered out")
+	logStateError(NewUpdateInstallState(nil, 0, client.UpdateResponse{}),
+		syscall.ENOSPC, "filtered in")
+	setLogModuleFilter(nil)
+
+	hook.lock.Lock()
+	defer hook.lock.Unlock()
+	assert.Len(t, hook.entries, 1)
+	assert.Equal(t, "filtered in", hook.entries[0].Message)
+	// regular log gets the message and module, no fields
+	assert.Contains(t, out.String(), "filtered in")
+	assert.Contains(t, out.String(), "module=state")
+	assert.NotContains(t, out.String(), "filtered out")
+	assert.NotContains(t, out.String(), LogFieldErrorCode)
+}
+
+func TestErrorCode(t *testing.T) {
+	rsp := &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}}
+
+	for code, err := range map[string]error{
+		"": nil,
+		"checksum_mismatch": NewFatalError(
+			errors.Wrap(installer.ErrChecksumMismatch, "install failed")),
+		"incompatible_artifact": installer.ErrIncompatibleArtifact,
+		"deployment_aborted":    NewTransientError(client.ErrDeploymentAborted),
+		"no_space":              syscall.ENOSPC,
+		"io_error": &os.PathError{Op: "write", Path: "/dev/foo",
+			Err: syscall.EIO},
+		"http_404": errors.Wrap(client.NewHTTPError(rsp, "fetch"), "failed"),
+		"network_dns": &url.Error{Op: "Get", URL: "https://foo",
+			Err: &net.DNSError{Err: "no such host", Name: "foo"}},
+		"unknown": errors.New("something else"),
+	} {
+		assert.Equal(t, code, errorCode(err), "%v", err)
+	}
+	assert.Equal(t, "no_space", errorCode(&os.PathError{Op: "write",
+		Path: "/data/foo", Err: syscall.ENOSPC}))
+}
@@ -11,7 +11,7 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
-package main
+package app
 
 import (
 	"encoding/json"
@@ -22,8 +22,13 @@ import (
 
 type DeploymentHook struct {
 	logManager *DeploymentLogManager
+	// stamps entries in the order of the status reports of the client; entries
+	// are not stamped if not set
+	events *eventSequence
 	// we are keeping it here to have logrus dependency in one place
 	formater logrus.Formatter
+	// strips sensitive data from messages; nil if not configured
+	redactor *logRedactor
 }
 
 type DeploymentJSONFormatter struct {
@@ -32,7 +37,10 @@ type DeploymentJSONFormatter struct {
 }
 
 func (f *DeploymentJSONFormatter) Format(entry *logrus.Entry) ([]byte, error) {
-	data := make(logrus.Fields, 3)
+	data := make(logrus.Fields, 3+len(entry.Data))
+	for k, v := range entry.Data {
+		data[k] = v
+	}
 
 	timestampFormat := f.TimestampFormat
 	if timestampFormat == "" {
@@ -75,9 +83,23 @@ func (dh DeploymentHook) Fire(entry *logrus.Entry) error {
 
 	// customize log message to contain only message, level and time
 	dLog := logrus.NewEntry(entry.Logger)
-	dLog.Message = entry.Message
+	dLog.Message = dh.redactor.redact(entry.Message)
 	dLog.Level = entry.Level
 	dLog.Time = entry.Time
+	dLog.Data = logrus.Fields{}
+	// let the server order entries even if the clock is off
+	if dh.events != nil {
+		st := dh.events.stamp()
+		dLog.Data["seq"] = st.Seq
+		dLog.Data["uptime"] = st.Uptime.Seconds()
+	}
+	for k, v := range entry.Data {
+		// module is for the regular log only
+		if k != "module" {
+			dLog.Data[k] = v
+		}
+	}
+	dh.redactor.redactFields(dLog.Data)
 
 	message, err := dh.formater.Format(dLog)
 	if err != nil {
@@ -11,7 +11,7 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
-package main
+package app
 
 import (
 	"bufio"
@@ -25,6 +25,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 // error messages
@@ -63,6 +64,8 @@ func (fl *FileLogger) Deinit() error {
 	return fl.logFile.Close()
 }
 
+// DeploymentLogManager keeps the logs of deployments; a nil manager keeps
+// none.
 type DeploymentLogManager struct {
 	logLocation  string
 	deploymentID string
@@ -115,7 +118,7 @@ func (dlm *DeploymentLogManager) haveEnoughSpaceForStoringLogs() bool {
 }
 
 func (dlm *DeploymentLogManager) Enable(deploymentID string) error {
-	if dlm.loggingEnabled {
+	if dlm == nil || dlm.loggingEnabled {
 		return nil
 	}
 
@@ -141,7 +144,7 @@ func (dlm *DeploymentLogManager) Enable(deploymentID string) error {
 }
 
 func (dlm *DeploymentLogManager) Disable() error {
-	if !dlm.loggingEnabled {
+	if dlm == nil || !dlm.loggingEnabled {
 		return nil
 	}
 
@@ -221,6 +224,28 @@ func (dlm DeploymentLogManager) Rotate() {
 	}
 }
 
+// Prune removes log files last written more than maxAge ago, except the log
+// of the deployment given.
+func (dlm *DeploymentLogManager) Prune(maxAge time.Duration, keepID string) {
+	if dlm == nil {
+		return
+	}
+	logFiles, err := dlm.getSortedLogFiles()
+	if err != nil {
+		return
+	}
+	for _, file := range logFiles {
+		if keepID != "" && strings.Contains(file, keepID) {
+			continue
+		}
+		fi, err := os.Stat(file)
+		if err != nil || time.Since(fi.ModTime()) <= maxAge {
+			continue
+		}
+		os.Remove(file)
+	}
+}
+
 func (dlm DeploymentLogManager) findLogsForSpecificID(deploymentID string) (string, error) {
 	logFiles, err := dlm.getSortedLogFiles()
 	if err != nil {
@@ -238,7 +263,7 @@ func (dlm DeploymentLogManager) findLogsForSpecificID(deploymentID string) (stri
 
 // GetLogs is returnig logs as a JSON string. Function is having the same
 // signature as json.Marshal() ([]byte, error)
-func (dlm DeploymentLogManager) GetLogs(deploymentID string) ([]byte, error) {
+func (dlm *DeploymentLogManager) GetLogs(deploymentID string) ([]byte, error) {
 	// opaque individual raw JSON entries into `{"messages:" [...]}` format
 	type formattedDeploymentLogs struct {
 		Messages []json.RawMessage `json:"messages"`
@@ -248,6 +273,9 @@ func (dlm DeploymentLogManager) GetLogs(deploymentID string) ([]byte, error) {
 	// to JSON we will end up with `{"messages":null}` instead of `{"messages":[]}`
 	logsList := make([]json.RawMessage, 0)
 
+	if dlm == nil {
+		return json.Marshal(formattedDeploymentLogs{logsList})
+	}
 	logFileName, err := dlm.findLogsForSpecificID(deploymentID)
 	// log file for specific deployment id does not exist
 	if err == os.ErrNotExist {
@@ -11,9 +11,10 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
-package main
+package app
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -259,7 +260,9 @@ func TestDeploymentLoggingHook(t *testing.T) {
 	defer os.RemoveAll(tempDir)
 
 	deploymentLogger := NewDeploymentLogManager(tempDir)
-	log.AddHook(NewDeploymentLogHook(deploymentLogger))
+	hook := NewDeploymentLogHook(deploymentLogger)
+	hook.events = &eventSequence{}
+	addLogHook(hook)
 
 	log.Info("test1")
 
@@ -273,9 +276,16 @@ func TestDeploymentLoggingHook(t *testing.T) {
 	log.Info("test3")
 
 	// test correct format of log messages
-	if !logFileContains(fileLocation, `{"level":"debug","message":"test2","timestamp":"`) {
+	if !logFileContains(fileLocation, `{"level":"debug","message":"test2","seq":`) {
 		t.FailNow()
 	}
+	data, err := ioutil.ReadFile(fileLocation)
+	assert.NoError(t, err)
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(data, &entry))
+	assert.Contains(t, entry, "timestamp")
+	assert.True(t, entry["seq"].(float64) > 0)
+	assert.True(t, entry["uptime"].(float64) > 0)
 }
 
 func TestGetLogs(t *testing.T) {
@@ -0,0 +1,96 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+const deploymentRequestTimeout = time.Minute
+
+// RequestDeployment asks the server to deploy the named artifact to this
+// device; the deployment is picked up by the daemon with the next update
+// check. Returns ID of the deployment if the server tells it.
+func (m *mender) RequestDeployment(ctx context.Context, artifactName string) (string, menderError) {
+	id, err := client.RequestDeployment(ctx, m.api.Request(m.authToken),
+		m.config.ServerURL, client.DeploymentRequest{ArtifactName: artifactName})
+	if err != nil {
+		if err == client.ErrNotAuthorized {
+			if remErr := m.authMgr.RemoveAuthToken(); remErr != nil {
+				log.Warn("can not remove rejected authentication token")
+			}
+		}
+		if err == client.ErrDeploymentRequestNotSupported ||
+			errors.Cause(err) == client.ErrArtifactNotFound {
+			return "", NewFatalError(err)
+		}
+		return "", NewTransientError(err)
+	}
+	log.Infof("requested deployment of %s (deployment %q)", artifactName, id)
+	return id, nil
+}
+
+// Authorize with the server and request deployment of the artifact.
+func doRequestDeployment(config *MenderConfig, dataStore, artifactName string,
+	out io.Writer) error {
+
+	mp, err := commonInit(config, dataStore, NewIdentityDataGetter())
+	if err != nil {
+		return err
+	}
+	defer mp.store.Close()
+
+	controller, err := NewMender(*config, *mp)
+	if err != nil {
+		return errors.Wrap(err, "error initializing mender controller")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deploymentRequestTimeout)
+	defer cancel()
+
+	if merr := controller.Bootstrap(); merr != nil {
+		return merr.Cause()
+	}
+	if merr := controller.Authorize(ctx); merr != nil {
+		return merr.Cause()
+	}
+	id, merr := controller.RequestDeployment(ctx, artifactName)
+	if merr != nil {
+		return merr.Cause()
+	}
+	printDeploymentRequest(out, artifactName, id)
+	return nil
+}
+
+func printDeploymentRequest(out io.Writer, artifactName, id string) {
+	if isJSONOutput(out) {
+		printJSON(out, struct {
+			ArtifactName string `json:"artifact_name"`
+			DeploymentID string `json:"deployment_id,omitempty"`
+		}{artifactName, id})
+		return
+	}
+	if id == "" {
+		fmt.Fprintf(out, "deployment of %s requested\n", artifactName)
+		return
+	}
+	fmt.Fprintf(out, "deployment of %s requested: %s\n", artifactName, id)
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMenderRequestDeployment(t *testing.T) {
+	status := http.StatusCreated
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			auth = r.Header.Get("Authorization")
+			w.WriteHeader(status)
+			w.Write([]byte(`{"id": "foo"}`))
+		}))
+	defer srv.Close()
+
+	authMgr := &testAuthManager{authorized: true, authtoken: "token"}
+	mender := newTestMender(nil, MenderConfig{ServerURL: srv.URL},
+		testMenderPieces{MenderPieces: MenderPieces{authMgr: authMgr}})
+	assert.NoError(t, mender.Authorize(context.Background()))
+
+	id, merr := mender.RequestDeployment(context.Background(), "release-2")
+	assert.Nil(t, merr)
+	assert.Equal(t, "foo", id)
+	assert.Equal(t, "Bearer token", auth)
+
+	// no point in retrying
+	status = http.StatusNotFound
+	_, merr = mender.RequestDeployment(context.Background(), "release-2")
+	assert.True(t, merr.IsFatal())
+	status = http.StatusUnprocessableEntity
+	_, merr = mender.RequestDeployment(context.Background(), "release-2")
+	assert.True(t, merr.IsFatal())
+
+	status = http.StatusServiceUnavailable
+	_, merr = mender.RequestDeployment(context.Background(), "release-2")
+	assert.False(t, merr.IsFatal())
+
+	status = http.StatusUnauthorized
+	_, merr = mender.RequestDeployment(context.Background(), "release-2")
+	assert.False(t, merr.IsFatal())
+}
+
+func TestPrintDeploymentRequest(t *testing.T) {
+	out := &bytes.Buffer{}
+	printDeploymentRequest(out, "release-2", "foo")
+	assert.Equal(t, "deployment of release-2 requested: foo\n", out.String())
+
+	out.Reset()
+	printDeploymentRequest(out, "release-2", "")
+	assert.Equal(t, "deployment of release-2 requested\n", out.String())
+
+	out.Reset()
+	printDeploymentRequest(&jsonOutput{out}, "release-2", "foo")
+	assert.JSONEq(t, `{"artifact_name": "release-2", "deployment_id": "foo"}`, out.String())
+}
+
+func TestRequestDeploymentArgs(t *testing.T) {
+	opts, err := argsParse([]string{"-no-syslog", "-request-deployment", "release-2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "release-2", *opts.requestDeploy)
+	assert.Equal(t, lockModeCLI, instanceLockMode(opts))
+
+	_, err = argsParse([]string{"-no-syslog", "-request-deployment", "release-2", "-daemon"})
+	assert.Equal(t, errMsgAmbiguousArgumentsGiven, err)
+}
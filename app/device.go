@@ -0,0 +1,302 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io"
+	"strconv"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+type deviceConfig struct {
+	rootfsPartA string
+	rootfsPartB string
+	autoDetect  bool
+	luksKeyFile string
+	appSlotsDir string
+	// root filesystem images are kept here instead of on partitions
+	rootfsImageDir string
+	// bundles of other update frameworks are stored here while installed
+	bundleDir      string
+	bundleCommands map[string]BundleCommands
+	// size of buffer the image is written with; tuned while writing if 0
+	writeBuffer int
+}
+
+type device struct {
+	BootEnvReadWriter
+	Commander
+	*partitions
+	luks *luksContainer
+	apps *appSlots
+	// root filesystem is updated as image file, unless nil
+	rootfsFiles *rootfsFiles
+	bundles     *externalBundles
+	// update in progress is bundle installed by its tool
+	bundleUpdate bool
+	// update in progress went into application slot
+	appUpdate bool
+	// operations are audited unless nil
+	audit *deviceAudit
+	// fixed size of buffer the image is written with, or 0
+	writeBuffer int
+}
+
+func NewDevice(env BootEnvReadWriter, sc StatCommander, config deviceConfig) *device {
+	partitions := partitions{
+		StatCommander:     sc,
+		BootEnvReadWriter: env,
+		rootfsPartA:       config.rootfsPartA,
+		rootfsPartB:       config.rootfsPartB,
+		autoDetect:        config.autoDetect,
+		active:            "",
+		inactive:          "",
+	}
+	device := device{
+		BootEnvReadWriter: env,
+		Commander:         sc,
+		partitions:        &partitions,
+		luks:              newLUKSContainer(sc, config.luksKeyFile),
+		apps:              newAppSlots(config.appSlotsDir),
+		rootfsFiles:       newRootfsFiles(config.rootfsImageDir),
+		bundles: newExternalBundles(sc, config.bundleDir,
+			config.bundleCommands),
+		writeBuffer: config.writeBuffer,
+	}
+	return &device
+}
+
+func (d *device) setAudit(audit *deviceAudit) {
+	d.audit = audit
+}
+
+func (d *device) Reboot() error {
+	op := d.audit.start(deviceOpReboot, "", nil)
+	err := d.Command("reboot").Run()
+	op.finish(err, nil)
+	return err
+}
+
+// All writes of the boot environment done by the device go through here.
+func (d *device) WriteEnv(vars BootVars) error {
+	details := make(map[string]string, len(vars))
+	for k, v := range vars {
+		details[k] = v
+	}
+	op := d.audit.start(deviceOpSetEnv, "", details)
+	err := d.BootEnvReadWriter.WriteEnv(vars)
+	op.finish(err, nil)
+	return err
+}
+
+func (d *device) Rollback() error {
+	if d.AppUpdatePending() {
+		// even if already committed, e.g. when reporting success failed
+		return d.apps.rollback()
+	}
+	if d.bundleUpdatePending() {
+		return d.bundles.finish(false)
+	}
+	if d.rootfsFiles != nil {
+		return d.rollbackRootfsFile()
+	}
+
+	// first get inactive partition
+	inactivePartition, err := d.getInactivePartition()
+	if err != nil {
+		return err
+	}
+	log.Infof("setting partition for rollback: %s", inactivePartition)
+
+	if d.luks != nil {
+		// nothing better to do than rolling back anyway, but make it
+		// clear why the device might not come up
+		if err := d.luks.Verify(d.inactive); err != nil {
+			log.Errorf("partition for rollback can not be unlocked: %v", err)
+		}
+	}
+
+	err = d.WriteEnv(BootVars{"mender_boot_part": inactivePartition, "upgrade_available": "0"})
+	if err != nil {
+		return err
+	}
+	log.Debug("Marking inactive partition as a boot candidate successful.")
+	return nil
+}
+
+func (d *device) InstallUpdate(image io.ReadCloser, size int64) error {
+
+	d.appUpdate = false
+	d.bundleUpdate = false
+
+	log.Debugf("Trying to install update of size: %d", size)
+	if image == nil || size < 0 {
+		return errors.New("Have invalid update. Aborting.")
+	}
+
+	if d.rootfsFiles != nil {
+		return d.installRootfsFile(image, size)
+	}
+
+	inactivePartition, err := d.GetInactive()
+	if err != nil {
+		return err
+	}
+
+	target := inactivePartition
+	if d.luks != nil {
+		if target, err = d.luks.Open(inactivePartition); err != nil {
+			log.Errorf("failed to open LUKS container on %s: %v",
+				inactivePartition, err)
+			return err
+		}
+		defer func() {
+			if cerr := d.luks.Close(); cerr != nil {
+				log.Errorf("failed to close LUKS container on %s: %v",
+					inactivePartition, cerr)
+			}
+		}()
+	}
+
+	b := &BlockDevice{Path: target}
+
+	if bsz, err := b.Size(); err != nil {
+		log.Errorf("failed to read size of block device %s: %v",
+			target, err)
+		return err
+	} else if bsz < uint64(size) {
+		log.Errorf("update (%v bytes) is larger than the size of device %s (%v bytes)",
+			size, target, bsz)
+		return syscall.ENOSPC
+	}
+
+	op := d.audit.start(deviceOpWritePartition, target,
+		map[string]string{"size": strconv.FormatInt(size, 10)})
+	w, err := tunedCopy(b, image, d.writeBuffer)
+	if err != nil {
+		logWithFields(logrus.Fields{
+			LogFieldBytesWritten: w,
+			LogFieldErrorCode:    errorCode(err),
+		}).Errorf("failed to write image data to device %v: %v", target, err)
+	}
+
+	logWithFields(logrus.Fields{LogFieldBytesWritten: w}).Infof(
+		"wrote %v/%v bytes of update to device %v", w, size, target)
+
+	if err == nil && w != size {
+		// image stream ended early; never leave truncated image behind
+		// unnoticed
+		err = errors.Wrapf(io.ErrUnexpectedEOF,
+			"wrote %v bytes of update, expected %v", w, size)
+	}
+
+	if cerr := b.Close(); cerr != nil {
+		log.Errorf("closing device %v failed: %v", target, cerr)
+		if err == nil {
+			err = cerr
+		}
+	}
+	op.finish(err, map[string]string{"written": strconv.FormatInt(w, 10)})
+
+	return err
+}
+
+func (d *device) getInactivePartition() (string, error) {
+	inactivePartition, err := d.GetInactive()
+	if err != nil {
+		return "", errors.New("Error obtaining inactive partition: " + err.Error())
+	}
+
+	log.Debugf("Marking inactive partition (%s) as the new boot candidate.", inactivePartition)
+
+	partitionNumber := inactivePartition[len(inactivePartition)-1:]
+	if _, err := strconv.Atoi(partitionNumber); err != nil {
+		return "", errors.New("Invalid inactive partition: " + inactivePartition)
+	}
+
+	return partitionNumber, nil
+}
+
+func (d *device) EnableUpdatedPartition() error {
+	if d.appUpdate {
+		return d.apps.enable()
+	}
+	if d.bundleUpdate {
+		log.Info("bundle activated by its installer already")
+		return nil
+	}
+	if d.rootfsFiles != nil {
+		return d.enableRootfsFile()
+	}
+
+	inactivePartition, err := d.getInactivePartition()
+	if err != nil {
+		return err
+	}
+
+	if d.luks != nil {
+		// never make the device boot into partition it can not unlock
+		if err := d.luks.Verify(d.inactive); err != nil {
+			return errors.Wrapf(err, "can not enable updated partition")
+		}
+	}
+
+	log.Info("Enabling partition with new image installed to be a boot candidate: ", string(inactivePartition))
+	// For now we are only setting boot variables; all of them are written
+	// in a single atomic update, so that the new partition never becomes a
+	// boot candidate without the upgrade_available flag enabling rollback
+	err = writeEnvBarrier(d, BootVars{"upgrade_available": "1", "mender_boot_part": inactivePartition, "bootcount": "0"})
+	if err != nil {
+		return err
+	}
+
+	log.Debug("Marking inactive partition as a boot candidate successful.")
+
+	return nil
+}
+
+func (d *device) CommitUpdate() error {
+	if d.apps != nil && d.apps.pending() {
+		return d.apps.commit()
+	}
+	if d.bundleUpdatePending() {
+		return d.bundles.finish(true)
+	}
+	log.Info("Commiting update")
+	// For now set only appropriate boot flags
+	return writeEnvBarrier(d, BootVars{"upgrade_available": "0"})
+}
+
+func (d *device) HasUpdate() (bool, error) {
+	if d.apps != nil && d.apps.pending() {
+		return true, nil
+	}
+	if d.bundleUpdatePending() {
+		return true, nil
+	}
+	env, err := d.ReadEnv("upgrade_available")
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read environment variable")
+	}
+	upgradeAvailable := env["upgrade_available"]
+
+	if upgradeAvailable == "1" {
+		return true, nil
+	}
+	return false, nil
+}
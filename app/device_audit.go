@@ -0,0 +1,244 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// Audit of operations the client performs on the device (writing partitions,
+// setting bootloader variables, rebooting), for reconstructing what exactly
+// was done to the hardware when a deployment failure is disputed. Each
+// operation is recorded before it is started and again with its result, so
+// an operation interrupted by power loss shows up without result.
+const deviceAuditName = "device-audit"
+
+var (
+	// number of most recent deployments audit is kept for
+	maxAuditedDeployments = 5
+	// operations recorded per deployment
+	maxAuditedOps = 200
+)
+
+// Device operations audited.
+const (
+	deviceOpWritePartition = "write-partition"
+	deviceOpSetEnv         = "set-env"
+	deviceOpReboot         = "reboot"
+)
+
+type DeviceOp struct {
+	Op      string            `json:"op"`
+	Target  string            `json:"target,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+	Started time.Time         `json:"started"`
+	// nil if the operation never finished
+	Finished *time.Time `json:"finished,omitempty"`
+	// "ok" or the error; empty if the operation never finished
+	Result string `json:"result,omitempty"`
+}
+
+type DeploymentAudit struct {
+	// empty for operations done before any deployment was audited
+	DeploymentID string `json:"deployment_id"`
+	// deployment metadata from the update response, if any
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	Ops      []DeviceOp             `json:"ops"`
+}
+
+// Read device audit, most recent deployment first.
+func loadDeviceAudit(store Store) ([]DeploymentAudit, error) {
+	data, err := store.ReadAll(deviceAuditName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to read device audit")
+	}
+	var audit []DeploymentAudit
+	if err := json.Unmarshal(data, &audit); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse device audit")
+	}
+	return audit, nil
+}
+
+type deviceAudit struct {
+	store Store
+
+	lock        sync.Mutex
+	deployments []DeploymentAudit
+}
+
+func newDeviceAudit(store Store) *deviceAudit {
+	deployments, err := loadDeviceAudit(store)
+	if err != nil {
+		log.Warnf("discarding device audit: %v", err)
+	}
+	if len(deployments) == 0 {
+		deployments = []DeploymentAudit{{}}
+	}
+	return &deviceAudit{store: store, deployments: deployments}
+}
+
+// must be called with lock held
+func (a *deviceAudit) save() {
+	data, _ := json.Marshal(a.deployments)
+	if err := a.store.WriteAll(deviceAuditName, data); err != nil {
+		log.Errorf("failed to save device audit: %v", err)
+	}
+}
+
+// Audit operations of given deployment from now on.
+func (a *deviceAudit) begin(deploymentID string, metadata map[string]interface{}) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.deployments[0].DeploymentID == deploymentID {
+		return
+	}
+	a.deployments = append([]DeploymentAudit{{
+		DeploymentID: deploymentID,
+		Metadata:     metadata,
+	}}, a.deployments...)
+	if len(a.deployments) > maxAuditedDeployments {
+		a.deployments = a.deployments[:maxAuditedDeployments]
+	}
+	a.save()
+}
+
+// Operation being audited.
+type auditedOp struct {
+	audit *deviceAudit
+	// deployment and index of the operation in it
+	deploymentID string
+	index        int
+}
+
+// Record operation about to be started.
+func (a *deviceAudit) start(op, target string, details map[string]string) *auditedOp {
+	if a == nil {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	d := &a.deployments[0]
+	if len(d.Ops) >= maxAuditedOps {
+		log.Warnf("device audit of deployment %q full, not recording %s",
+			d.DeploymentID, op)
+		return nil
+	}
+	d.Ops = append(d.Ops, DeviceOp{
+		Op:      op,
+		Target:  target,
+		Details: details,
+		Started: time.Now(),
+	})
+	a.save()
+	return &auditedOp{audit: a, deploymentID: d.DeploymentID, index: len(d.Ops) - 1}
+}
+
+// Record result of the operation, along with details known only afterwards.
+func (o *auditedOp) finish(err error, details map[string]string) {
+	if o == nil {
+		return
+	}
+	a := o.audit
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	d := &a.deployments[0]
+	if d.DeploymentID != o.deploymentID {
+		// next deployment began meanwhile
+		return
+	}
+	op := &d.Ops[o.index]
+	now := time.Now()
+	op.Finished = &now
+	op.Result = "ok"
+	if err != nil {
+		op.Result = err.Error()
+	}
+	for k, v := range details {
+		if op.Details == nil {
+			op.Details = make(map[string]string)
+		}
+		op.Details[k] = v
+	}
+	a.save()
+}
+
+// Device which can audit its operations.
+type auditedDevice interface {
+	setAudit(audit *deviceAudit)
+}
+
+func printDeviceAudit(out io.Writer, audit []DeploymentAudit) {
+	if isJSONOutput(out) {
+		if audit == nil {
+			audit = []DeploymentAudit{}
+		}
+		printJSON(out, audit)
+		return
+	}
+	if len(audit) == 0 {
+		fmt.Fprintln(out, "no device operations recorded")
+		return
+	}
+	for _, d := range audit {
+		id := d.DeploymentID
+		if id == "" {
+			if len(d.Ops) == 0 {
+				continue
+			}
+			id = "-"
+		}
+		fmt.Fprintf(out, "deployment %s\n", id)
+		if len(d.Metadata) > 0 {
+			metadata, _ := json.Marshal(d.Metadata)
+			fmt.Fprintf(out, "\tmetadata\t%s\n", metadata)
+		}
+		for _, op := range d.Ops {
+			var details []string
+			for k, v := range op.Details {
+				details = append(details, k+"="+v)
+			}
+			sort.Strings(details)
+			result := op.Result
+			if result == "" {
+				result = "unfinished"
+			}
+			target := op.Target
+			if target == "" {
+				target = "-"
+			}
+			fmt.Fprintf(out, "\t%s\t%s\t%s\t%s\t%s\n",
+				op.Started.Format(time.RFC3339), op.Op, target,
+				strings.Join(details, " "), result)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceAudit(t *testing.T) {
+	store := utils.NewMemStore()
+	audit := newDeviceAudit(store)
+
+	// operations before any deployment go to an anonymous entry
+	audit.start(deviceOpReboot, "", nil).finish(nil, nil)
+
+	audit.begin("dep-1", nil)
+	op := audit.start(deviceOpWritePartition, "/dev/mmcblk0p3",
+		map[string]string{"size": "100"})
+	// interrupted operation stays unfinished
+	audit.start(deviceOpSetEnv, "", BootVars{"upgrade_available": "1"})
+	op.finish(errors.New("no space"), map[string]string{"written": "50"})
+	// same deployment again does not start a new entry
+	audit.begin("dep-1", nil)
+
+	deployments, err := loadDeviceAudit(store)
+	assert.NoError(t, err)
+	assert.Len(t, deployments, 2)
+	assert.Equal(t, "dep-1", deployments[0].DeploymentID)
+	assert.Equal(t, "", deployments[1].DeploymentID)
+	assert.Len(t, deployments[1].Ops, 1)
+	assert.Equal(t, "ok", deployments[1].Ops[0].Result)
+
+	ops := deployments[0].Ops
+	assert.Len(t, ops, 2)
+	assert.Equal(t, deviceOpWritePartition, ops[0].Op)
+	assert.Equal(t, "/dev/mmcblk0p3", ops[0].Target)
+	assert.Equal(t, map[string]string{"size": "100", "written": "50"}, ops[0].Details)
+	assert.Equal(t, "no space", ops[0].Result)
+	assert.NotNil(t, ops[0].Finished)
+	assert.Equal(t, deviceOpSetEnv, ops[1].Op)
+	assert.Equal(t, "", ops[1].Result)
+	assert.Nil(t, ops[1].Finished)
+
+	// audit survives restart
+	audit = newDeviceAudit(store)
+	op = audit.start(deviceOpReboot, "", nil)
+	deployments, _ = loadDeviceAudit(store)
+	assert.Len(t, deployments[0].Ops, 3)
+
+	// operation finishing after next deployment began is not misattributed
+	audit.begin("dep-2", map[string]interface{}{"campaign": "spring"})
+	op.finish(nil, nil)
+	deployments, _ = loadDeviceAudit(store)
+	assert.Equal(t, "dep-2", deployments[0].DeploymentID)
+	assert.Equal(t, map[string]interface{}{"campaign": "spring"}, deployments[0].Metadata)
+	assert.Empty(t, deployments[0].Ops)
+	assert.Nil(t, deployments[1].Ops[2].Finished)
+
+	// only most recent deployments are kept
+	for i := 3; i <= maxAuditedDeployments+2; i++ {
+		audit.begin("dep-"+string('0'+rune(i)), nil)
+	}
+	deployments, _ = loadDeviceAudit(store)
+	assert.Len(t, deployments, maxAuditedDeployments)
+	assert.Equal(t, "dep-7", deployments[0].DeploymentID)
+
+	// operations beyond limit are not recorded
+	oldMax := maxAuditedOps
+	defer func() { maxAuditedOps = oldMax }()
+	maxAuditedOps = 1
+	assert.NotNil(t, audit.start(deviceOpReboot, "", nil))
+	assert.Nil(t, audit.start(deviceOpReboot, "", nil))
+
+	// disabled audit records nothing
+	var disabled *deviceAudit
+	disabled.begin("dep-1", nil)
+	disabled.start(deviceOpReboot, "", nil).finish(nil, nil)
+}
+
+func TestDeviceAuditedOps(t *testing.T) {
+	store := utils.NewMemStore()
+	audit := newDeviceAudit(store)
+	audit.begin("dep-1", nil)
+
+	runner := newTestOSCalls("", 0)
+	testDevice := NewDevice(&uBootEnv{&runner}, &runner, deviceConfig{})
+	testDevice.setAudit(audit)
+
+	vars := BootVars{"upgrade_available": "1"}
+	assert.NoError(t, testDevice.WriteEnv(vars))
+	// audit keeps its own copy
+	vars["upgrade_available"] = "0"
+
+	runner = newTestOSCalls("", 1)
+	assert.Error(t, testDevice.Reboot())
+
+	tdir, _ := ioutil.TempDir("", "audit")
+	defer os.RemoveAll(tdir)
+	part := path.Join(tdir, "part")
+	assert.NoError(t, ioutil.WriteFile(part, nil, 0644))
+	testDevice.partitions = &partitions{inactive: part}
+	old := BlockDeviceGetSizeOf
+	defer func() { BlockDeviceGetSizeOf = old }()
+	BlockDeviceGetSizeOf = func(file *os.File) (uint64, error) { return 100, nil }
+	image := ioutil.NopCloser(bytes.NewBufferString("image"))
+	assert.NoError(t, testDevice.InstallUpdate(image, 5))
+
+	deployments, err := loadDeviceAudit(store)
+	assert.NoError(t, err)
+	ops := deployments[0].Ops
+	assert.Len(t, ops, 3)
+	assert.Equal(t, deviceOpSetEnv, ops[0].Op)
+	assert.Equal(t, map[string]string{"upgrade_available": "1"}, ops[0].Details)
+	assert.Equal(t, "ok", ops[0].Result)
+	assert.Equal(t, deviceOpReboot, ops[1].Op)
+	assert.NotEqual(t, "ok", ops[1].Result)
+	assert.NotEmpty(t, ops[1].Result)
+	assert.Equal(t, deviceOpWritePartition, ops[2].Op)
+	assert.Equal(t, part, ops[2].Target)
+	assert.Equal(t, "5", ops[2].Details["size"])
+	assert.Equal(t, "ok", ops[2].Result)
+}
+
+func TestShowDeviceAudit(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, doShowDeviceAudit(tdir, out))
+	assert.Equal(t, "no device operations recorded\n", out.String())
+
+	db := NewDBStore(tdir)
+	audit := newDeviceAudit(db)
+	audit.begin("dep-1", nil)
+	audit.start(deviceOpWritePartition, "/dev/sda3",
+		map[string]string{"size": "10"}).finish(nil, nil)
+	audit.start(deviceOpReboot, "", nil)
+	db.Close()
+
+	out.Reset()
+	assert.NoError(t, doShowDeviceAudit(tdir, out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 3)
+	assert.Equal(t, "deployment dep-1", lines[0])
+	assert.Equal(t, []string{"write-partition", "/dev/sda3", "size=10", "ok"},
+		strings.Split(lines[1], "\t")[2:])
+	assert.Equal(t, []string{"reboot", "-", "", "unfinished"},
+		strings.Split(lines[2], "\t")[2:])
+
+	out.Reset()
+	assert.NoError(t, doShowDeviceAudit(tdir, &jsonOutput{out}))
+	var deployments []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &deployments))
+	assert.Len(t, deployments, 2)
+	assert.Equal(t, "dep-1", deployments[0]["deployment_id"])
+}
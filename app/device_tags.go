@@ -0,0 +1,145 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+const deviceTagsTimeout = time.Minute
+
+// Parse tags given as comma separated name=value pairs.
+func parseDeviceTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		name := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || name == "" {
+			return nil, errors.Errorf("invalid device tag %q, expected name=value", pair)
+		}
+		tags[name] = strings.TrimSpace(kv[1])
+	}
+	return tags, nil
+}
+
+// SetDeviceTags assigns the device to the group, unless empty, and sets its
+// tags on the server, where the server lets devices do so.
+func (m *mender) SetDeviceTags(ctx context.Context, group string,
+	tags map[string]string) menderError {
+	api := m.api.Request(m.authToken)
+	if group != "" {
+		if err := client.SetDeviceGroup(ctx, api, m.config.ServerURL, group); err != nil {
+			return m.deviceTagsError(err)
+		}
+		log.Infof("device assigned to group %s", group)
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	attrs := make([]client.InventoryAttribute, 0, len(tags))
+	for _, name := range names {
+		attrs = append(attrs, client.InventoryAttribute{Name: name, Value: tags[name]})
+	}
+	if err := client.SetDeviceTags(ctx, api, m.config.ServerURL, attrs); err != nil {
+		return m.deviceTagsError(err)
+	}
+	log.Infof("device tags set: %v", tags)
+	return nil
+}
+
+func (m *mender) deviceTagsError(err error) menderError {
+	if err == client.ErrNotAuthorized {
+		if remErr := m.authMgr.RemoveAuthToken(); remErr != nil {
+			log.Warn("can not remove rejected authentication token")
+		}
+	}
+	if err == client.ErrDeviceTaggingNotSupported {
+		return NewFatalError(err)
+	}
+	return NewTransientError(err)
+}
+
+// Authorize with the server and set group and tags of the device.
+func doSetDeviceTags(config *MenderConfig, dataStore, group, tagList string,
+	out io.Writer) error {
+	tags, err := parseDeviceTags(tagList)
+	if err != nil {
+		return err
+	}
+
+	mp, err := commonInit(config, dataStore, NewIdentityDataGetter())
+	if err != nil {
+		return err
+	}
+	defer mp.store.Close()
+
+	controller, err := NewMender(*config, *mp)
+	if err != nil {
+		return errors.Wrap(err, "error initializing mender controller")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deviceTagsTimeout)
+	defer cancel()
+
+	if merr := controller.Bootstrap(); merr != nil {
+		return merr.Cause()
+	}
+	if merr := controller.Authorize(ctx); merr != nil {
+		return merr.Cause()
+	}
+	if merr := controller.SetDeviceTags(ctx, group, tags); merr != nil {
+		return merr.Cause()
+	}
+	printDeviceTags(out, group, tags)
+	return nil
+}
+
+func printDeviceTags(out io.Writer, group string, tags map[string]string) {
+	if isJSONOutput(out) {
+		printJSON(out, struct {
+			Group string            `json:"group,omitempty"`
+			Tags  map[string]string `json:"tags,omitempty"`
+		}{group, tags})
+		return
+	}
+	if group != "" {
+		fmt.Fprintf(out, "group: %s\n", group)
+	}
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "tag: %s=%s\n", name, tags[name])
+	}
+}
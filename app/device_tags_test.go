@@ -0,0 +1,102 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDeviceTags(t *testing.T) {
+	tags, err := parseDeviceTags("line=factory-3, site = oslo,,empty=")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"line": "factory-3", "site": "oslo",
+		"empty": ""}, tags)
+
+	tags, err = parseDeviceTags("")
+	assert.NoError(t, err)
+	assert.Empty(t, tags)
+
+	_, err = parseDeviceTags("line")
+	assert.Error(t, err)
+	_, err = parseDeviceTags("=x")
+	assert.Error(t, err)
+}
+
+func TestMenderSetDeviceTags(t *testing.T) {
+	status := http.StatusNoContent
+	requests := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			data, _ := ioutil.ReadAll(r.Body)
+			requests[r.URL.Path] = string(data)
+			w.WriteHeader(status)
+		}))
+	defer srv.Close()
+
+	authMgr := &testAuthManager{authorized: true, authtoken: "token"}
+	mender := newTestMender(nil, MenderConfig{ServerURL: srv.URL},
+		testMenderPieces{MenderPieces: MenderPieces{authMgr: authMgr}})
+	assert.NoError(t, mender.Authorize(context.Background()))
+
+	merr := mender.SetDeviceTags(context.Background(), "factory-line-3",
+		map[string]string{"site": "oslo", "line": "3"})
+	assert.Nil(t, merr)
+	assert.JSONEq(t, `{"group": "factory-line-3"}`,
+		requests["/api/devices/v1/inventory/device/group"])
+	assert.JSONEq(t, `[{"name": "line", "value": "3"}, {"name": "site", "value": "oslo"}]`,
+		requests["/api/devices/v1/inventory/device/tags"])
+
+	// only tags
+	requests = map[string]string{}
+	assert.Nil(t, mender.SetDeviceTags(context.Background(), "",
+		map[string]string{"site": "oslo"}))
+	assert.Len(t, requests, 1)
+
+	// no point in retrying
+	status = http.StatusNotFound
+	merr = mender.SetDeviceTags(context.Background(), "g", nil)
+	assert.True(t, merr.IsFatal())
+
+	status = http.StatusServiceUnavailable
+	merr = mender.SetDeviceTags(context.Background(), "g", nil)
+	assert.False(t, merr.IsFatal())
+}
+
+func TestPrintDeviceTags(t *testing.T) {
+	out := &bytes.Buffer{}
+	printDeviceTags(out, "g", map[string]string{"b": "2", "a": "1"})
+	assert.Equal(t, "group: g\ntag: a=1\ntag: b=2\n", out.String())
+
+	out.Reset()
+	printDeviceTags(&jsonOutput{out}, "", map[string]string{"a": "1"})
+	assert.JSONEq(t, `{"tags": {"a": "1"}}`, out.String())
+}
+
+func TestSetDeviceTagsArgs(t *testing.T) {
+	opts, err := argsParse([]string{"-no-syslog", "-set-group", "g", "-set-tags", "a=1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "g", *opts.setGroup)
+	assert.Equal(t, "a=1", *opts.setTags)
+	assert.Equal(t, lockModeCLI, instanceLockMode(opts))
+
+	_, err = argsParse([]string{"-no-syslog", "-set-tags", "a=1", "-commit"})
+	assert.Equal(t, errMsgAmbiguousArgumentsGiven, err)
+}
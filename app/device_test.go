@@ -11,18 +11,23 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
-package main
+package app
 
 import (
-	"errors"
+	"bytes"
+	"io"
+	"io/ioutil"
 	"os"
+	"path"
+	"syscall"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
 func Test_commitUpdate(t *testing.T) {
-	runner := newTestOSCalls("", 0)
+	runner := newTestOSCalls("upgrade_available=0", 0)
 	fakeEnv := uBootEnv{&runner}
 	device := device{}
 	device.BootEnvReadWriter = &fakeEnv
@@ -54,7 +59,7 @@ func Test_enableUpdatedPartition_wrongPartitinNumber_fails(t *testing.T) {
 }
 
 func Test_enableUpdatedPartition_correctPartitinNumber(t *testing.T) {
-	runner := newTestOSCalls("", 0)
+	runner := newTestOSCalls("upgrade_available=1\nmender_boot_part=2\nbootcount=0", 0)
 	fakeEnv := uBootEnv{&runner}
 
 	testPart := partitions{}
@@ -72,6 +77,12 @@ func Test_enableUpdatedPartition_correctPartitinNumber(t *testing.T) {
 	if err := testDevice.EnableUpdatedPartition(); err == nil {
 		t.FailNow()
 	}
+
+	// variables do not read back as written
+	runner = newTestOSCalls("upgrade_available=0\nmender_boot_part=2\nbootcount=0", 0)
+	if err := testDevice.EnableUpdatedPartition(); err == nil {
+		t.FailNow()
+	}
 }
 
 func Test_installUpdate_existingAndNonInactivePartition(t *testing.T) {
@@ -111,6 +122,33 @@ func Test_installUpdate_existingAndNonInactivePartition(t *testing.T) {
 	BlockDeviceGetSizeOf = old
 }
 
+func TestInstallUpdateLargeImage(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "install")
+	defer os.RemoveAll(tdir)
+	part := path.Join(tdir, "part")
+	assert.NoError(t, ioutil.WriteFile(part, nil, 0644))
+
+	testDevice := device{partitions: &partitions{inactive: part}}
+
+	// sizes beyond 4 GiB must survive on 32-bit platforms as well
+	const gib = int64(1024 * 1024 * 1024)
+	devSize := uint64(6 * gib)
+	old := BlockDeviceGetSizeOf
+	defer func() { BlockDeviceGetSizeOf = old }()
+	BlockDeviceGetSizeOf = func(file *os.File) (uint64, error) { return devSize, nil }
+
+	// image stream ending early is detected
+	image := ioutil.NopCloser(bytes.NewBufferString("short image"))
+	err := testDevice.InstallUpdate(image, 5*gib)
+	assert.Equal(t, io.ErrUnexpectedEOF, errors.Cause(err))
+
+	// size wrapping around 32 bits does not fit either
+	devSize = uint64(4*gib + 10)
+	image = ioutil.NopCloser(bytes.NewBufferString("short image"))
+	err = testDevice.InstallUpdate(image, 5*gib+10)
+	assert.Equal(t, syscall.ENOSPC, err)
+}
+
 func Test_FetchUpdate_existingAndNonExistingUpdateFile(t *testing.T) {
 	image, _ := os.Create("imageFile")
 	imageContent := "test content"
@@ -169,3 +207,75 @@ func TestDeviceHasUpdate(t *testing.T) {
 	assert.True(t, has)
 	assert.NoError(t, err)
 }
+
+// Run update sequence on a device that loses power after a given number of boot
+// environment operations, for every possible crash point. No matter where the
+// power is lost, the new partition must never be set up to boot without
+// rollback (upgrade_available=0) unless the image was verified and enabled.
+func TestBootFlagsPowerLoss(t *testing.T) {
+	oldSync := syncFilesystems
+	defer func() {
+		syncFilesystems = oldSync
+	}()
+
+	for _, verified := range []bool{true, false} {
+		for crashAt := 0; ; crashAt++ {
+			env := newCrashingBootEnv(BootVars{
+				"mender_boot_part":  "1",
+				"upgrade_available": "0",
+				"bootcount":         "0",
+			}, crashAt)
+			syncFilesystems = env.sync
+
+			dev := device{
+				BootEnvReadWriter: env,
+				partitions: &partitions{
+					inactive: "part2",
+				},
+			}
+
+			enabled := false
+			completed := func() bool {
+				// install fails if the image digest does not match,
+				// partition is never enabled then
+				if !verified {
+					return true
+				}
+				if err := dev.EnableUpdatedPartition(); err != nil {
+					return false
+				}
+				enabled = true
+
+				// booted to new image and all good, commit
+				if err := dev.CommitUpdate(); err != nil {
+					return false
+				}
+				return true
+			}()
+
+			p := env.persisted
+			if p["mender_boot_part"] == "2" {
+				assert.True(t, verified,
+					"unverified image enabled, crash at %d", crashAt)
+				if p["upgrade_available"] == "0" {
+					assert.True(t, enabled,
+						"update committed before enabled, crash at %d", crashAt)
+				} else {
+					assert.Equal(t, "1", p["upgrade_available"])
+					assert.Equal(t, "0", p["bootcount"])
+				}
+			} else {
+				assert.Equal(t, "1", p["mender_boot_part"])
+				assert.Equal(t, "0", p["upgrade_available"])
+			}
+
+			if completed {
+				if verified {
+					assert.Equal(t, "2", p["mender_boot_part"])
+					assert.Equal(t, "0", p["upgrade_available"])
+				}
+				break
+			}
+		}
+	}
+}
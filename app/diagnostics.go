@@ -0,0 +1,180 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Diagnostic queries answered by Diagnose(); all of them are read-only, so
+// that support tooling can gather facts about the device without shell
+// access.
+const (
+	// size and free space of filesystems the client writes to
+	DiagnosticDiskUsage = "disk-usage"
+	// bootloader environment
+	DiagnosticBootEnv = "bootenv"
+	// most recent state transitions since the client started
+	DiagnosticStateTransitions = "state-transitions"
+	// connectivity with the server, as with -check-connection
+	DiagnosticNetwork = "network"
+	// health of server APIs as seen by requests made so far
+	DiagnosticEndpoints = "endpoints"
+)
+
+var ErrUnknownDiagnostic = errors.New("unknown diagnostic query")
+
+// number of state transitions remembered
+var maxRecordedTransitions = 50
+
+type stateTransition struct {
+	Time time.Time `json:"time"`
+	From string    `json:"from"`
+	To   string    `json:"to"`
+}
+
+// Most recent state transitions, in order.
+type transitionLog struct {
+	lock        sync.Mutex
+	transitions []stateTransition
+}
+
+func (l *transitionLog) record(from, to MenderState, now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.transitions = append(l.transitions,
+		stateTransition{now, from.String(), to.String()})
+	if len(l.transitions) > maxRecordedTransitions {
+		l.transitions = l.transitions[len(l.transitions)-maxRecordedTransitions:]
+	}
+}
+
+func (l *transitionLog) get() []stateTransition {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]stateTransition{}, l.transitions...)
+}
+
+func (m *mender) diagnose(query, dataStore string, out io.Writer) error {
+	switch query {
+	case DiagnosticDiskUsage:
+		printDiskUsage(out, diskUsage(&m.config, dataStore))
+		return nil
+	case DiagnosticBootEnv:
+		env, ok := m.UInstallCommitRebooter.(BootEnvReadWriter)
+		if !ok {
+			return errors.New("device has no bootloader environment")
+		}
+		vars, err := env.ReadEnv()
+		if err != nil {
+			return errors.Wrapf(err, "failed to read bootloader environment")
+		}
+		printBootEnv(out, vars)
+		return nil
+	case DiagnosticStateTransitions:
+		printStateTransitions(out, m.transitions.get())
+		return nil
+	case DiagnosticNetwork:
+		return doCheckConnection(&m.config, dataStore, out)
+	case DiagnosticEndpoints:
+		printEndpointHealth(out, m.endpoints.snapshot())
+		return nil
+	}
+	return errors.Wrapf(ErrUnknownDiagnostic, "%q", query)
+}
+
+type filesystemUsage struct {
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	Total     uint64 `json:"total"`
+	Available uint64 `json:"available"`
+	Error     string `json:"error,omitempty"`
+}
+
+func diskUsage(config *MenderConfig, dataStore string) []filesystemUsage {
+	paths := []struct{ name, path string }{
+		{"root", "/"},
+		{"data", dataStore},
+		{"scratch", newScratchDir(config, dataStore).path},
+		{"app-slots", config.AppSlotsDir},
+		{"rootfs-images", config.RootfsImageDir},
+	}
+	var usage []filesystemUsage
+	for _, p := range paths {
+		if p.path == "" {
+			continue
+		}
+		u := filesystemUsage{Name: p.name, Path: p.path}
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(p.path, &stat); err != nil {
+			u.Error = err.Error()
+		} else {
+			u.Total = stat.Blocks * uint64(stat.Bsize)
+			u.Available = stat.Bavail * uint64(stat.Bsize)
+		}
+		usage = append(usage, u)
+	}
+	return usage
+}
+
+func printDiskUsage(out io.Writer, usage []filesystemUsage) {
+	if isJSONOutput(out) {
+		printJSON(out, usage)
+		return
+	}
+	for _, u := range usage {
+		if u.Error != "" {
+			fmt.Fprintf(out, "%-14s %s: %s\n", u.Name, u.Path, u.Error)
+			continue
+		}
+		fmt.Fprintf(out, "%-14s %s: %d of %d bytes available\n",
+			u.Name, u.Path, u.Available, u.Total)
+	}
+}
+
+func printBootEnv(out io.Writer, vars BootVars) {
+	if isJSONOutput(out) {
+		printJSON(out, vars)
+		return
+	}
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "%s=%s\n", name, vars[name])
+	}
+}
+
+func printStateTransitions(out io.Writer, transitions []stateTransition) {
+	if isJSONOutput(out) {
+		if transitions == nil {
+			transitions = []stateTransition{}
+		}
+		printJSON(out, transitions)
+		return
+	}
+	for _, t := range transitions {
+		fmt.Fprintf(out, "%s\t%s -> %s\n", t.Time.Format(time.RFC3339),
+			t.From, t.To)
+	}
+}
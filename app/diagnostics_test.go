@@ -0,0 +1,116 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/mendersoftware/mender/app/testutils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// device with bootloader environment
+type envFakeDevice struct {
+	testutils.FakeDevice
+	*crashingBootEnv
+}
+
+func TestDiagnose(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "diagnose")
+	defer os.RemoveAll(tdir)
+
+	env := newCrashingBootEnv(BootVars{"upgrade_available": "0",
+		"mender_boot_part": "2"}, -1)
+	mender := newTestMender(nil, MenderConfig{
+		AppSlotsDir: path.Join(tdir, "missing"),
+	}, testMenderPieces{
+		MenderPieces: MenderPieces{
+			device: &envFakeDevice{crashingBootEnv: env},
+		},
+	})
+
+	out := &bytes.Buffer{}
+	err := mender.diagnose("shell", tdir, out)
+	assert.Equal(t, ErrUnknownDiagnostic, errors.Cause(err))
+
+	assert.NoError(t, mender.diagnose(DiagnosticBootEnv, tdir, out))
+	assert.Equal(t, "mender_boot_part=2\nupgrade_available=0\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, mender.diagnose(DiagnosticDiskUsage, tdir, &jsonOutput{out}))
+	var usage []filesystemUsage
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &usage))
+	assert.Len(t, usage, 4)
+	assert.Equal(t, "/", usage[0].Path)
+	assert.Equal(t, tdir, usage[1].Path)
+	assert.Empty(t, usage[1].Error)
+	assert.NotZero(t, usage[1].Total)
+	assert.Equal(t, "scratch", usage[2].Name)
+	assert.Equal(t, "app-slots", usage[3].Name)
+	assert.NotEmpty(t, usage[3].Error)
+
+	// only most recent transitions are kept
+	oldMax := maxRecordedTransitions
+	defer func() { maxRecordedTransitions = oldMax }()
+	maxRecordedTransitions = 2
+	mender.SetState(checkWaitState)
+	mender.SetState(updateCheckState)
+	mender.SetState(inventoryUpdateState)
+	out.Reset()
+	assert.NoError(t, mender.diagnose(DiagnosticStateTransitions, tdir, out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.True(t, strings.HasSuffix(lines[0], "\tcheck-wait -> update-check"), lines[0])
+	assert.True(t, strings.HasSuffix(lines[1], "\tupdate-check -> inventory-update"), lines[1])
+
+	// device without bootloader environment
+	mender = newTestMender(nil, MenderConfig{}, testMenderPieces{})
+	assert.Error(t, mender.diagnose(DiagnosticBootEnv, tdir, out))
+	out.Reset()
+	assert.NoError(t, mender.diagnose(DiagnosticStateTransitions, tdir, &jsonOutput{out}))
+	assert.Equal(t, "[]\n", out.String())
+}
+
+func TestAgentDiagnose(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "diagnose")
+	defer os.RemoveAll(tdir)
+
+	agent, err := newMenderAgent(AgentConfig{
+		Config: MenderConfig{
+			// nothing listens there
+			ServerURL: "http://127.0.0.1:1",
+		},
+		DataStore: tdir,
+	}, &testutils.FakeDevice{})
+	assert.NoError(t, err)
+	defer agent.daemon.store.Close()
+
+	out := &bytes.Buffer{}
+	assert.Error(t, agent.Diagnose(DiagnosticDiskUsage, "xml", out))
+
+	assert.NoError(t, agent.Diagnose(DiagnosticDiskUsage, "text", out))
+	assert.Contains(t, out.String(), tdir)
+
+	out.Reset()
+	err = agent.Diagnose(DiagnosticNetwork, "json", out)
+	assert.Equal(t, errConnectionCheckFailed, err)
+	assert.Contains(t, out.String(), `"server": "http://127.0.0.1:1"`)
+}
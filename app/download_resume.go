@@ -0,0 +1,173 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Download interrupted midway is resumed from where it stopped, rather than
+// failing the install and starting over with the next attempt. Pre-signed
+// artifact URLs may expire while the artifact is downloaded over a slow link;
+// a new one is requested from the server then.
+const (
+	defaultDownloadResumeAttempts = 5
+	downloadResumeBackoff         = time.Second
+	maxDownloadResumeBackoff      = 30 * time.Second
+)
+
+func (m *mender) downloadResumeAttempts() int {
+	switch {
+	case m.config.DownloadResumeAttempts < 0:
+		return 0
+	case m.config.DownloadResumeAttempts > 0:
+		return m.config.DownloadResumeAttempts
+	}
+	return defaultDownloadResumeAttempts
+}
+
+// Whether the download failed because the pre-signed URL expired.
+func artifactURLExpired(err error) bool {
+	cause := errors.Cause(err)
+	if herr, ok := cause.(*client.HTTPError); ok {
+		return herr.StatusCode == http.StatusForbidden
+	}
+	return cause == client.ErrArtifactURLExpired
+}
+
+type resumingDownload struct {
+	ctx context.Context
+	m   *mender
+	// artifact URL is replaced once refreshed
+	update client.UpdateResponse
+	body   io.ReadCloser
+	size   int64
+	offset int64
+	// resume attempts left
+	attempts int
+	backoff  time.Duration
+}
+
+func (d *resumingDownload) Read(p []byte) (int, error) {
+	for {
+		n, err := d.body.Read(p)
+		d.offset += int64(n)
+		if err == io.EOF && d.offset < d.size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if !d.resume(err) {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume requests the rest of the artifact; false if it could not.
+func (d *resumingDownload) resume(cause error) bool {
+	if d.attempts <= 0 || d.ctx.Err() != nil {
+		return false
+	}
+	d.attempts--
+	log.Warnf("download of artifact interrupted at %d of %d bytes: %v; resuming in %v",
+		d.offset, d.size, cause, d.backoff)
+	select {
+	case <-time.After(acceleratedWait(d.ctx, d.backoff)):
+	case <-d.ctx.Done():
+		return false
+	}
+	if d.backoff *= 2; d.backoff > maxDownloadResumeBackoff {
+		d.backoff = maxDownloadResumeBackoff
+	}
+	d.body.Close()
+
+	body, err := d.m.updater.FetchUpdateFrom(d.ctx, d.m.downloadAPI, d.update.URI(),
+		d.offset)
+	if artifactURLExpired(err) && d.update.ID != "" {
+		log.Infof("artifact URL of deployment %s expired, refreshing it", d.update.ID)
+		next, merr := d.m.refreshArtifactURL(d.ctx, d.update)
+		if merr != nil {
+			log.Errorf("failed to resume download: %v", merr)
+			return false
+		}
+		d.update = next
+		body, err = d.m.updater.FetchUpdateFrom(d.ctx, d.m.downloadAPI, d.update.URI(),
+			d.offset)
+	}
+	if err != nil {
+		log.Errorf("failed to resume download: %v", err)
+		return false
+	}
+	d.body = body
+	log.Infof("download of artifact resumed at %d bytes", d.offset)
+	return true
+}
+
+func (d *resumingDownload) Close() error {
+	return d.body.Close()
+}
+
+// FetchDiagnostics reports on the download since it was last resumed.
+func (d *resumingDownload) FetchDiagnostics() client.FetchDiagnostics {
+	if dr, ok := d.body.(client.FetchDiagnosticsReporter); ok {
+		return dr.FetchDiagnostics()
+	}
+	return client.FetchDiagnostics{}
+}
+
+// FetchUpdate starts download of the artifact of the deployment. Retried
+// download failing because the artifact URL expired meanwhile is started again
+// with new URL from the server; download interrupted midway is resumed.
+func (m *mender) FetchUpdate(ctx context.Context,
+	update client.UpdateResponse) (io.ReadCloser, int64, error) {
+	in, size, err := m.updater.FetchUpdate(ctx, m.downloadAPI, update.URI())
+	if artifactURLExpired(err) && update.ID != "" {
+		log.Infof("artifact URL of deployment %s expired, refreshing it", update.ID)
+		next, merr := m.refreshArtifactURL(ctx, update)
+		if merr != nil {
+			log.Errorf("%v", merr)
+			return nil, -1, err
+		}
+		update = next
+		in, size, err = m.updater.FetchUpdate(ctx, m.downloadAPI, update.URI())
+	}
+	if err != nil {
+		return nil, -1, err
+	}
+
+	attempts := m.downloadResumeAttempts()
+	if attempts == 0 || size <= 0 {
+		return in, size, nil
+	}
+	return &resumingDownload{
+		ctx:      ctx,
+		m:        m,
+		update:   update,
+		body:     in,
+		size:     size,
+		attempts: attempts,
+		backoff:  downloadResumeBackoff,
+	}, size, nil
+}
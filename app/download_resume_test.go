@@ -0,0 +1,144 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchUpdateResume(t *testing.T) {
+	image := strings.Repeat("0123456789", 1000)
+	// URL the server issues, and URLs valid
+	issued := "/artifacts/release-2?sig=1"
+	valid := map[string]bool{"/artifacts/release-2?sig=1": true}
+	// bytes sent before the connection drops, per request
+	cutAt := []int{}
+	var ranges []string
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/artifacts/") {
+			var update client.UpdateResponse
+			update.ID = "dep-1"
+			update.Artifact.ArtifactName = "release-2"
+			update.Artifact.CompatibleDevices = []string{"hammer"}
+			update.Artifact.Source.URI = srv.URL + issued
+			data, _ := json.Marshal(update)
+			w.Write(data)
+			return
+		}
+		if !valid[r.URL.RequestURI()] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		ranges = append(ranges, r.Header.Get("Range"))
+		var start int
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			w.Header().Set("Content-Range", "bytes "+strconv.Itoa(start)+"-"+
+				strconv.Itoa(len(image)-1)+"/"+strconv.Itoa(len(image)))
+			w.Header().Set("Content-Length", strconv.Itoa(len(image)-start))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(image)))
+		}
+		data := image[start:]
+		if len(cutAt) > 0 {
+			data = data[:cutAt[0]]
+			cutAt = cutAt[1:]
+		}
+		io.WriteString(w, data)
+	}))
+	defer srv.Close()
+
+	td, _ := ioutil.TempDir("", "resume")
+	defer os.RemoveAll(td)
+
+	mender := newTestMender(nil, MenderConfig{ServerURL: srv.URL}, testMenderPieces{})
+	mender.artifactInfoFile = path.Join(td, "artifact_info")
+	mender.deviceTypeFile = path.Join(td, "device_type")
+	ioutil.WriteFile(mender.artifactInfoFile, []byte("artifact_name=release-1"), 0600)
+	ioutil.WriteFile(mender.deviceTypeFile, []byte("device_type=hammer"), 0600)
+
+	update := client.UpdateResponse{ID: "dep-1"}
+	update.Artifact.Source.URI = srv.URL + "/artifacts/release-2?sig=1"
+	ctx := withTimerAcceleration(context.Background(),
+		downloadResumeBackoff/time.Millisecond)
+
+	// interrupted twice, resumed where it stopped
+	cutAt = []int{1000, 2500}
+	in, size, err := mender.FetchUpdate(ctx, update)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(image)), size)
+	data, err := ioutil.ReadAll(in)
+	in.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, image, string(data))
+	assert.Equal(t, []string{"", "bytes=1000-", "bytes=3500-"}, ranges)
+
+	// URL expired while downloading
+	ranges = nil
+	cutAt = []int{1000}
+	in, _, err = mender.FetchUpdate(ctx, update)
+	assert.NoError(t, err)
+	valid = map[string]bool{"/artifacts/release-2?sig=2": true}
+	issued = "/artifacts/release-2?sig=2"
+	data, err = ioutil.ReadAll(in)
+	in.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, image, string(data))
+	assert.Equal(t, []string{"", "bytes=1000-"}, ranges)
+
+	// retried download with expired URL
+	ranges = nil
+	in, _, err = mender.FetchUpdate(ctx, update)
+	assert.NoError(t, err)
+	data, err = ioutil.ReadAll(in)
+	in.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, image, string(data))
+
+	// attempts run out
+	update.Artifact.Source.URI = srv.URL + issued
+	mender.config.DownloadResumeAttempts = 1
+	cutAt = []int{1000, 1000}
+	in, _, err = mender.FetchUpdate(ctx, update)
+	assert.NoError(t, err)
+	data, err = ioutil.ReadAll(in)
+	in.Close()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Len(t, data, 2000)
+
+	// disabled
+	mender.config.DownloadResumeAttempts = -1
+	cutAt = []int{1000}
+	in, _, err = mender.FetchUpdate(ctx, update)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(in)
+	in.Close()
+	assert.Error(t, err)
+}
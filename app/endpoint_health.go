@@ -0,0 +1,132 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Server APIs health is tracked for. The server may be only partially down,
+// eg. authorizing devices while the deployments service is failing; one
+// failing API must not stop the client from using the others.
+const (
+	endpointAuth        = "auth"
+	endpointDeployments = "deployments"
+	endpointInventory   = "inventory"
+)
+
+type EndpointHealth struct {
+	Healthy bool `json:"healthy"`
+	// consecutive failed requests
+	Failures    int       `json:"failures,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	LastFailure time.Time `json:"last_failure,omitempty"`
+}
+
+type endpointHealth struct {
+	lock      sync.Mutex
+	endpoints map[string]*EndpointHealth
+}
+
+func newEndpointHealth() *endpointHealth {
+	return &endpointHealth{endpoints: make(map[string]*EndpointHealth)}
+}
+
+func (h *endpointHealth) get(endpoint string) *EndpointHealth {
+	e, ok := h.endpoints[endpoint]
+	if !ok {
+		e = &EndpointHealth{Healthy: true}
+		h.endpoints[endpoint] = e
+	}
+	return e
+}
+
+// record outcome of request to the endpoint; nil err is success
+func (h *endpointHealth) record(endpoint string, err error, now time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	e := h.get(endpoint)
+	if err == nil {
+		if !e.Healthy {
+			log.Infof("%s API recovered after %d failed requests", endpoint, e.Failures)
+		}
+		e.Healthy = true
+		e.Failures = 0
+		e.LastError = ""
+		e.LastSuccess = now
+		return
+	}
+	if e.Healthy {
+		log.Warnf("%s API unavailable: %v", endpoint, err)
+	}
+	e.Healthy = false
+	e.Failures++
+	e.LastError = err.Error()
+	e.LastFailure = now
+}
+
+// Health of endpoints requests were made to so far.
+func (h *endpointHealth) snapshot() map[string]EndpointHealth {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s := make(map[string]EndpointHealth, len(h.endpoints))
+	for name, e := range h.endpoints {
+		s[name] = *e
+	}
+	return s
+}
+
+// isEndpointOutage tells if the request failed because the API it was made to
+// is failing on the server side (5xx), while the server itself is reachable;
+// such failures are not fixed by authorizing again.
+func isEndpointOutage(err error) bool {
+	herr, ok := errors.Cause(err).(*client.HTTPError)
+	return ok && herr.StatusCode >= http.StatusInternalServerError
+}
+
+func printEndpointHealth(out io.Writer, health map[string]EndpointHealth) {
+	if isJSONOutput(out) {
+		printJSON(out, health)
+		return
+	}
+	if len(health) == 0 {
+		fmt.Fprintln(out, "no requests made to the server")
+		return
+	}
+	names := make([]string, 0, len(health))
+	for name := range health {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		e := health[name]
+		if e.Healthy {
+			fmt.Fprintf(out, "%-12s ok\n", name)
+			continue
+		}
+		fmt.Fprintf(out, "%-12s failing (%d requests, last at %s): %s\n", name,
+			e.Failures, e.LastFailure.Format(time.RFC3339), e.LastError)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpointHealth(t *testing.T) {
+	h := newEndpointHealth()
+	now := time.Now()
+
+	h.record(endpointAuth, nil, now)
+	h.record(endpointDeployments, errors.New("500"), now)
+	h.record(endpointDeployments, errors.New("502"), now.Add(time.Minute))
+
+	s := h.snapshot()
+	assert.Len(t, s, 2)
+	assert.True(t, s[endpointAuth].Healthy)
+	assert.Equal(t, now, s[endpointAuth].LastSuccess)
+	assert.False(t, s[endpointDeployments].Healthy)
+	assert.Equal(t, 2, s[endpointDeployments].Failures)
+	assert.Equal(t, "502", s[endpointDeployments].LastError)
+	assert.Equal(t, now.Add(time.Minute), s[endpointDeployments].LastFailure)
+
+	h.record(endpointDeployments, nil, now.Add(2*time.Minute))
+	s = h.snapshot()
+	assert.True(t, s[endpointDeployments].Healthy)
+	assert.Equal(t, 0, s[endpointDeployments].Failures)
+	assert.Equal(t, "", s[endpointDeployments].LastError)
+
+	// snapshot is a copy
+	s[endpointAuth] = EndpointHealth{}
+	assert.True(t, h.snapshot()[endpointAuth].Healthy)
+}
+
+func TestIsEndpointOutage(t *testing.T) {
+	assert.True(t, isEndpointOutage(&client.HTTPError{StatusCode: 500}))
+	assert.True(t, isEndpointOutage(&client.HTTPError{StatusCode: 503}))
+	assert.False(t, isEndpointOutage(&client.HTTPError{StatusCode: 404}))
+	assert.False(t, isEndpointOutage(client.ErrNotAuthorized))
+	assert.False(t, isEndpointOutage(errors.New("connection refused")))
+	assert.False(t, isEndpointOutage(nil))
+}
+
+func TestPrintEndpointHealth(t *testing.T) {
+	out := &bytes.Buffer{}
+	printEndpointHealth(out, nil)
+	assert.Equal(t, "no requests made to the server\n", out.String())
+
+	failed := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	health := map[string]EndpointHealth{
+		endpointInventory: {Healthy: true},
+		endpointDeployments: {Failures: 3, LastError: "internal server error",
+			LastFailure: failed},
+	}
+	out.Reset()
+	printEndpointHealth(out, health)
+	assert.Equal(t, []string{
+		"deployments  failing (3 requests, last at 2017-01-02T03:04:05Z): " +
+			"internal server error",
+		"inventory    ok",
+	}, strings.Split(strings.TrimSpace(out.String()), "\n"))
+
+	out.Reset()
+	printEndpointHealth(&jsonOutput{out}, health)
+	var parsed map[string]EndpointHealth
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &parsed))
+	assert.Equal(t, 3, parsed[endpointDeployments].Failures)
+}
+
+func TestMenderPartialOutage(t *testing.T) {
+	// deployments service is down, inventory works
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/deployments/") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	td, _ := ioutil.TempDir("", "mender-outage")
+	defer os.RemoveAll(td)
+	artifactInfo := path.Join(td, "artifact_info")
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=release-1"), 0600)
+	ioutil.WriteFile(deviceType, []byte("device_type=hammer"), 0600)
+
+	mender := newTestMender(nil, MenderConfig{ServerURL: srv.URL}, testMenderPieces{})
+	mender.artifactInfoFile = artifactInfo
+	mender.deviceTypeFile = deviceType
+
+	_, merr := mender.CheckUpdate(context.Background())
+	assert.Error(t, merr)
+	assert.True(t, isEndpointOutage(merr.Cause()))
+	assert.NoError(t, mender.InventoryRefresh(context.Background()))
+
+	health := mender.endpoints.snapshot()
+	assert.False(t, health[endpointDeployments].Healthy)
+	assert.True(t, health[endpointInventory].Healthy)
+
+	// state machine keeps going with inventory instead of starting over
+	s, _ := updateCheckState.Handle(new(StateContext), mender)
+	assert.IsType(t, &CheckWaitState{}, s)
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, mender.diagnose(DiagnosticEndpoints, td, out))
+	assert.Contains(t, out.String(), "deployments  failing (2 requests")
+	assert.Contains(t, out.String(), "inventory    ok")
+}
@@ -0,0 +1,125 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"golang.org/x/sys/unix"
+)
+
+const eventSequenceName = "event-sequence"
+
+// Sequence numbers are persisted in blocks, so that they keep growing across
+// restarts without writing to the store on every event.
+const eventSequenceBlock = 1000
+
+// Client-side stamp of an event (status report, deployment log entry) letting
+// the server order events from devices with bad or jumping clocks.
+type eventStamp struct {
+	Seq  uint64
+	Time time.Time
+	// time since boot, including suspend; 0 if not known
+	Uptime time.Duration
+}
+
+// Source of monotonic event sequence numbers.
+type eventSequence struct {
+	lock  sync.Mutex
+	store Store
+	next  uint64
+	// numbers below are reserved in the store
+	reserved uint64
+}
+
+// newEventSequence returns the sequence continuing the one persisted in
+// `store`; nothing is persisted if `store` is nil.
+func newEventSequence(store Store) *eventSequence {
+	s := &eventSequence{}
+	s.setStore(store)
+	return s
+}
+
+// Continue the sequence persisted in `store`.
+func (s *eventSequence) setStore(store Store) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// no logging here; the deployment log hook would need the lock
+	s.store = store
+	s.reserved = 0
+	if store == nil {
+		return
+	}
+	data, err := store.ReadAll(eventSequenceName)
+	if err != nil {
+		return
+	}
+	reserved, err := strconv.ParseUint(string(data), 10, 64)
+	if err != nil {
+		// starting over; numbers may repeat
+		return
+	}
+	// anything up to reserved may have been used already
+	if reserved > s.next {
+		s.next = reserved
+	}
+}
+
+func (s *eventSequence) stamp() eventStamp {
+	var err error
+
+	s.lock.Lock()
+	s.next++
+	if s.store != nil && s.next >= s.reserved {
+		s.reserved = s.next + eventSequenceBlock
+		err = s.store.WriteAll(eventSequenceName,
+			[]byte(strconv.FormatUint(s.reserved, 10)))
+	}
+	st := eventStamp{
+		Seq:    s.next,
+		Time:   time.Now(),
+		Uptime: uptime(),
+	}
+	s.lock.Unlock()
+
+	// logging stamps the deployment log entry as well, so not while
+	// holding the lock
+	if err != nil {
+		// not fatal; numbers may repeat after restart only
+		log.Debugf("failed to save event sequence: %v", err)
+	}
+	return st
+}
+
+// Stamp status report with next event stamp.
+func (s *eventSequence) stampStatusReport(report client.StatusReport) client.StatusReport {
+	st := s.stamp()
+	report.Seq = st.Seq
+	report.Time = st.Time.UTC().Format(time.RFC3339Nano)
+	report.Uptime = st.Uptime.Seconds()
+	return report
+}
+
+func uptime() time.Duration {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_BOOTTIME, &ts); err != nil {
+		return 0
+	}
+	return time.Duration(ts.Nano())
+}
@@ -0,0 +1,78 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventSequence(t *testing.T) {
+	ms := utils.NewMemStore()
+	s := &eventSequence{}
+	s.setStore(ms)
+
+	first := s.stamp()
+	assert.Equal(t, uint64(1), first.Seq)
+	assert.True(t, first.Uptime > 0)
+	assert.WithinDuration(t, time.Now(), first.Time, time.Minute)
+
+	// block of numbers reserved at once
+	data, err := ms.ReadAll(eventSequenceName)
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(1+eventSequenceBlock), string(data))
+	for i := 2; i <= eventSequenceBlock; i++ {
+		assert.Equal(t, uint64(i), s.stamp().Seq)
+	}
+	data, _ = ms.ReadAll(eventSequenceName)
+	assert.Equal(t, strconv.Itoa(1+eventSequenceBlock), string(data))
+	assert.Equal(t, uint64(eventSequenceBlock+1), s.stamp().Seq)
+	data, _ = ms.ReadAll(eventSequenceName)
+	assert.Equal(t, strconv.Itoa(1+2*eventSequenceBlock), string(data))
+
+	// numbers keep growing after restart
+	s = &eventSequence{}
+	s.setStore(ms)
+	assert.Equal(t, uint64(2*eventSequenceBlock+2), s.stamp().Seq)
+
+	// broken or unwritable store does not stop the sequence
+	ms.WriteAll(eventSequenceName, []byte("garbage"))
+	s = &eventSequence{}
+	s.setStore(ms)
+	ms.ReadOnly(true)
+	assert.Equal(t, uint64(1), s.stamp().Seq)
+	assert.Equal(t, uint64(2), s.stamp().Seq)
+	ms.ReadOnly(false)
+
+	s = &eventSequence{}
+	s.setStore(nil)
+	assert.Equal(t, uint64(1), s.stamp().Seq)
+}
+
+func TestStampStatusReport(t *testing.T) {
+	s := newEventSequence(utils.NewMemStore())
+	r1 := s.stampStatusReport(client.StatusReport{Status: client.StatusSuccess})
+	r2 := s.stampStatusReport(client.StatusReport{Status: client.StatusSuccess})
+	assert.Equal(t, client.StatusSuccess, r1.Status)
+	assert.True(t, r2.Seq > r1.Seq)
+	assert.True(t, r2.Uptime >= r1.Uptime)
+	ts, err := time.Parse(time.RFC3339Nano, r1.Time)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), ts, time.Minute)
+}
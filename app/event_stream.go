@@ -0,0 +1,255 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Device lifecycle events (boots, rollbacks, deferred updates, loss of
+// connectivity) are queued in the store and sent to the server in batches
+// whenever it is reachable, giving the backend more than the status of the
+// deployment in progress.
+const (
+	deviceEventsName = "device-events"
+	// boot the last boot event was recorded for
+	lastBootIDName = "last-boot-id"
+
+	defaultDeviceEventsBatchSize = 50
+	// oldest events are dropped when the server is unreachable for long
+	defaultDeviceEventsQueueSize = 500
+)
+
+var bootIDFile = "/proc/sys/kernel/random/boot_id"
+
+type deviceEventSender func(ctx context.Context, events []client.DeviceEvent) error
+
+type eventStream struct {
+	store  Store
+	events *eventSequence
+	batch  int
+	max    int
+
+	// held while sending, so that events are sent once
+	sending sync.Mutex
+
+	lock  sync.Mutex
+	queue []client.DeviceEvent
+	// server does not accept events
+	disabled bool
+	// when the server was found unreachable; zero if it is not
+	offlineSince time.Time
+}
+
+// Returns nil if device events are not enabled.
+func newEventStream(config MenderConfig, store Store,
+	events *eventSequence) *eventStream {
+	if !config.DeviceEvents {
+		return nil
+	}
+	s := &eventStream{
+		store:  store,
+		events: events,
+		batch:  defaultDeviceEventsBatchSize,
+		max:    defaultDeviceEventsQueueSize,
+	}
+	if config.DeviceEventsBatchSize > 0 {
+		s.batch = config.DeviceEventsBatchSize
+	}
+	if config.DeviceEventsQueueSize > 0 {
+		s.max = config.DeviceEventsQueueSize
+	}
+	if store == nil {
+		return s
+	}
+	data, err := store.ReadAll(deviceEventsName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("failed to read queued device events: %v", err)
+		}
+		return s
+	}
+	if err := json.Unmarshal(data, &s.queue); err != nil {
+		log.Warnf("discarding broken queue of device events: %v", err)
+		s.queue = nil
+	}
+	return s
+}
+
+// must be called with lock held
+func (s *eventStream) save() {
+	if s.store == nil {
+		return
+	}
+	var err error
+	if len(s.queue) == 0 {
+		err = s.store.Remove(deviceEventsName)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	} else {
+		data, _ := json.Marshal(s.queue)
+		err = s.store.WriteAll(deviceEventsName, data)
+	}
+	if err != nil {
+		log.Errorf("failed to store queued device events: %v", err)
+	}
+}
+
+// record queues event to be sent to the server.
+func (s *eventStream) record(eventType, deploymentID string, data map[string]string) {
+	if s == nil {
+		return
+	}
+	st := s.events.stamp()
+	event := client.DeviceEvent{
+		Type:         eventType,
+		Seq:          st.Seq,
+		Time:         st.Time.UTC().Format(time.RFC3339Nano),
+		Uptime:       st.Uptime.Seconds(),
+		DeploymentID: deploymentID,
+		Data:         data,
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.disabled {
+		return
+	}
+	s.queue = append(s.queue, event)
+	if dropped := len(s.queue) - s.max; dropped > 0 {
+		log.Debugf("device event queue full, dropping %d oldest events", dropped)
+		s.queue = s.queue[dropped:]
+	}
+	s.save()
+}
+
+// recordBoot queues boot event, once per boot.
+func (s *eventStream) recordBoot(artifactName string) {
+	if s == nil || s.store == nil {
+		return
+	}
+	bootID := currentBootID()
+	if bootID == "" {
+		return
+	}
+	if last, err := s.store.ReadAll(lastBootIDName); err == nil &&
+		string(last) == bootID {
+		return
+	}
+	s.record(client.EventBoot, "", map[string]string{
+		"boot_id":       bootID,
+		"artifact_name": artifactName,
+	})
+	if err := s.store.WriteAll(lastBootIDName, []byte(bootID)); err != nil {
+		log.Errorf("failed to store boot ID: %v", err)
+	}
+}
+
+// isConnectivityError tells if request failed without reaching the server.
+func isConnectivityError(err error) bool {
+	err = errors.Cause(err)
+	if uerr, ok := err.(*url.Error); ok {
+		err = uerr.Err
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// connectivity records loss of connectivity to the server when request
+// fails with `err`, and its restoration once request succeeds again.
+func (s *eventStream) connectivity(err error, now time.Time) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	offlineSince := s.offlineSince
+	switch {
+	case err == nil:
+		s.offlineSince = time.Time{}
+	case isConnectivityError(err) && offlineSince.IsZero():
+		s.offlineSince = now
+	}
+	s.lock.Unlock()
+
+	switch {
+	case err == nil && !offlineSince.IsZero():
+		s.record(client.EventConnectivityRestored, "", map[string]string{
+			"offline_seconds": strconv.Itoa(int(now.Sub(offlineSince).Seconds())),
+		})
+	case err != nil && isConnectivityError(err) && offlineSince.IsZero():
+		s.record(client.EventConnectivityLost, "", map[string]string{
+			"error": err.Error(),
+		})
+	}
+}
+
+// send sends queued events in batches; events failed to send are kept for
+// the next time.
+func (s *eventStream) send(ctx context.Context, sender deviceEventSender) {
+	if s == nil {
+		return
+	}
+	s.sending.Lock()
+	defer s.sending.Unlock()
+
+	for {
+		s.lock.Lock()
+		n := len(s.queue)
+		if n > s.batch {
+			n = s.batch
+		}
+		batch := append([]client.DeviceEvent(nil), s.queue[:n]...)
+		s.lock.Unlock()
+		if n == 0 {
+			return
+		}
+
+		err := sender(ctx, batch)
+		if err == client.ErrEventsNotSupported {
+			log.Info("server does not accept device events, not recording them")
+			s.lock.Lock()
+			s.disabled = true
+			s.queue = nil
+			s.save()
+			s.lock.Unlock()
+			return
+		}
+		if err != nil {
+			log.Warnf("failed to send device events: %v", err)
+			return
+		}
+
+		s.lock.Lock()
+		// events recorded meanwhile are at the end of the queue, while
+		// the oldest ones may have been dropped to make room for them
+		last := batch[n-1].Seq
+		for len(s.queue) > 0 && s.queue[0].Seq <= last {
+			s.queue = s.queue[1:]
+		}
+		s.save()
+		s.lock.Unlock()
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func eventTypes(events []client.DeviceEvent) []string {
+	var types []string
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestEventStreamQueue(t *testing.T) {
+	assert.Nil(t, newEventStream(MenderConfig{}, utils.NewMemStore(), nil))
+	// nil stream records nothing
+	var none *eventStream
+	none.record(client.EventBoot, "", nil)
+	none.send(context.Background(), nil)
+
+	store := utils.NewMemStore()
+	config := MenderConfig{
+		DeviceEvents:          true,
+		DeviceEventsBatchSize: 2,
+		DeviceEventsQueueSize: 3,
+	}
+	s := newEventStream(config, store, newEventSequence(store))
+	for _, e := range []string{"a", "b", "c", "d"} {
+		s.record(e, "", nil)
+	}
+	// oldest dropped
+	assert.Equal(t, []string{"b", "c", "d"}, eventTypes(s.queue))
+	assert.True(t, s.queue[0].Seq < s.queue[1].Seq)
+	assert.NotEmpty(t, s.queue[0].Time)
+
+	// queue survives restart
+	s = newEventStream(config, store, newEventSequence(store))
+	assert.Equal(t, []string{"b", "c", "d"}, eventTypes(s.queue))
+
+	var sent [][]string
+	failing := false
+	sender := func(ctx context.Context, events []client.DeviceEvent) error {
+		if failing {
+			return errors.New("server unreachable")
+		}
+		sent = append(sent, eventTypes(events))
+		return nil
+	}
+
+	failing = true
+	s.send(context.Background(), sender)
+	assert.Len(t, s.queue, 3)
+
+	failing = false
+	s.send(context.Background(), sender)
+	assert.Equal(t, [][]string{{"b", "c"}, {"d"}}, sent)
+	assert.Empty(t, s.queue)
+	_, err := store.ReadAll(deviceEventsName)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestEventStreamRecordedWhileSending(t *testing.T) {
+	s := newEventStream(MenderConfig{
+		DeviceEvents:          true,
+		DeviceEventsQueueSize: 2,
+	}, nil, newEventSequence(nil))
+	s.record("a", "", nil)
+	s.record("b", "", nil)
+
+	var sent []string
+	s.send(context.Background(), func(ctx context.Context, events []client.DeviceEvent) error {
+		if sent == nil {
+			// pushes "a" out of the queue
+			s.record("c", "", nil)
+		}
+		sent = append(sent, eventTypes(events)...)
+		return nil
+	})
+	assert.Equal(t, []string{"a", "b", "c"}, sent)
+	assert.Empty(t, s.queue)
+}
+
+func TestEventStreamNotSupported(t *testing.T) {
+	store := utils.NewMemStore()
+	s := newEventStream(MenderConfig{DeviceEvents: true}, store,
+		newEventSequence(store))
+	s.record("a", "", nil)
+
+	s.send(context.Background(), func(ctx context.Context, events []client.DeviceEvent) error {
+		return client.ErrEventsNotSupported
+	})
+	assert.Empty(t, s.queue)
+	_, err := store.ReadAll(deviceEventsName)
+	assert.True(t, os.IsNotExist(err))
+
+	s.record("b", "", nil)
+	assert.Empty(t, s.queue)
+}
+
+func TestEventStreamConnectivity(t *testing.T) {
+	s := newEventStream(MenderConfig{DeviceEvents: true}, nil,
+		newEventSequence(nil))
+	now := time.Now()
+
+	// server reached
+	s.connectivity(client.NewHTTPError(&http.Response{StatusCode: 500}, "failed"), now)
+	s.connectivity(nil, now)
+	assert.Empty(t, s.queue)
+
+	netErr := errors.Wrap(&net.OpError{Op: "dial", Net: "tcp",
+		Err: errors.New("connection refused")}, "update check failed")
+	s.connectivity(netErr, now)
+	s.connectivity(netErr, now.Add(time.Minute))
+	s.connectivity(nil, now.Add(2*time.Minute))
+	s.connectivity(nil, now.Add(3*time.Minute))
+
+	assert.Equal(t, []string{client.EventConnectivityLost,
+		client.EventConnectivityRestored}, eventTypes(s.queue))
+	assert.Contains(t, s.queue[0].Data["error"], "connection refused")
+	assert.Equal(t, "120", s.queue[1].Data["offline_seconds"])
+}
+
+func TestEventStreamBoot(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-boot-id")
+	defer os.RemoveAll(td)
+	oldBootIDFile := bootIDFile
+	bootIDFile = filepath.Join(td, "boot_id")
+	defer func() { bootIDFile = oldBootIDFile }()
+
+	store := utils.NewMemStore()
+	ioutil.WriteFile(bootIDFile, []byte("boot-1\n"), 0644)
+	s := newEventStream(MenderConfig{DeviceEvents: true}, store,
+		newEventSequence(store))
+	s.recordBoot("release-1")
+	// once per boot
+	s = newEventStream(MenderConfig{DeviceEvents: true}, store,
+		newEventSequence(store))
+	s.recordBoot("release-1")
+
+	ioutil.WriteFile(bootIDFile, []byte("boot-2\n"), 0644)
+	s.recordBoot("release-2")
+
+	assert.Equal(t, []string{client.EventBoot, client.EventBoot}, eventTypes(s.queue))
+	assert.Equal(t, map[string]string{"boot_id": "boot-1", "artifact_name": "release-1"},
+		s.queue[0].Data)
+	assert.Equal(t, "boot-2", s.queue[1].Data["boot_id"])
+}
+
+func TestMenderDeviceEvents(t *testing.T) {
+	var received []client.DeviceEvent
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/devices/v1/devices/events":
+			var body struct {
+				Events []client.DeviceEvent `json:"events"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			received = append(received, body.Events...)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer ts.Close()
+
+	td, _ := ioutil.TempDir("", "mender-boot-id")
+	defer os.RemoveAll(td)
+	oldBootIDFile := bootIDFile
+	bootIDFile = filepath.Join(td, "boot_id")
+	defer func() { bootIDFile = oldBootIDFile }()
+	ioutil.WriteFile(bootIDFile, []byte("boot-1\n"), 0644)
+
+	mender := newTestMender(nil, MenderConfig{ServerURL: ts.URL, DeviceEvents: true},
+		testMenderPieces{MenderPieces: MenderPieces{store: utils.NewMemStore()}})
+	update := client.UpdateResponse{ID: "foo"}
+	update.Artifact.ArtifactName = "release-2"
+
+	err := mender.ReportUpdateDeferred(context.Background(), update,
+		time.Now().Add(time.Hour), "maintenance window")
+	assert.Nil(t, err)
+	mender.SetState(NewRollbackState(update))
+
+	_, err = mender.CheckUpdate(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{client.EventBoot, client.EventUpdateDeferred,
+		client.EventRollback}, eventTypes(received))
+	assert.Equal(t, "boot-1", received[0].Data["boot_id"])
+	assert.Equal(t, "foo", received[1].DeploymentID)
+	assert.Equal(t, "maintenance window", received[1].Data["reason"])
+	assert.Equal(t, "release-2", received[2].Data["artifact_name"])
+	assert.Empty(t, mender.eventStream.queue)
+}
@@ -0,0 +1,143 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+const installHistoryName = "install-history"
+
+// number of most recent installs kept in the history
+var maxInstallHistory = 10
+
+// Single artifact install attempt. Result is the last deployment status
+// reached; downloading means the attempt never finished (e.g. the device
+// lost power).
+type InstallRecord struct {
+	ArtifactName string
+	DeploymentID string
+	Started      time.Time
+	Finished     time.Time
+	Result       string
+}
+
+// Read install history, most recent install first.
+func loadInstallHistory(store Store) ([]InstallRecord, error) {
+	data, err := store.ReadAll(installHistoryName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to read install history")
+	}
+	var history []InstallRecord
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse install history")
+	}
+	return history, nil
+}
+
+// Add install attempt to the history, or update the attempt of the same
+// deployment if it is the most recent one. Only the newest
+// maxInstallHistory attempts are kept.
+func recordInstall(store Store, rec InstallRecord) error {
+	history, err := loadInstallHistory(store)
+	if err != nil {
+		// broken history must not stop updates; start a new one
+		log.Warnf("discarding install history: %v", err)
+		history = nil
+	}
+
+	if len(history) > 0 && history[0].DeploymentID == rec.DeploymentID {
+		if !history[0].Started.IsZero() {
+			rec.Started = history[0].Started
+		}
+		history[0] = rec
+	} else {
+		history = append([]InstallRecord{rec}, history...)
+	}
+	if len(history) > maxInstallHistory {
+		history = history[:maxInstallHistory]
+	}
+
+	data, err := json.Marshal(history)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode install history")
+	}
+	if err := store.WriteAll(installHistoryName, data); err != nil {
+		return errors.Wrapf(err, "failed to save install history")
+	}
+	return nil
+}
+
+// Record progress of the deployment in install history; failures are only
+// logged as the history is informational.
+func recordInstallStatus(store Store, update client.UpdateResponse, status string) {
+	if store == nil {
+		return
+	}
+	rec := InstallRecord{
+		ArtifactName: update.ArtifactName(),
+		DeploymentID: update.ID,
+		Result:       status,
+	}
+	now := time.Now().UTC()
+	if status == client.StatusDownloading {
+		rec.Started = now
+	} else {
+		rec.Finished = now
+	}
+	if err := recordInstall(store, rec); err != nil {
+		log.Errorf("failed to record install of %s: %v", rec.ArtifactName, err)
+	}
+}
+
+// Summary of the history suitable for inventory, e.g.
+// ["release-2 (failure)", "release-1 (success)"].
+func installHistorySummary(history []InstallRecord) []string {
+	summary := make([]string, 0, len(history))
+	for _, rec := range history {
+		summary = append(summary, fmt.Sprintf("%s (%s)", rec.ArtifactName, rec.Result))
+	}
+	return summary
+}
+
+func printInstallHistory(out io.Writer, history []InstallRecord) {
+	if isJSONOutput(out) {
+		printInstallHistoryJSON(out, history)
+		return
+	}
+	if len(history) == 0 {
+		fmt.Fprintln(out, "no artifacts installed yet")
+		return
+	}
+	for _, rec := range history {
+		finished := "-"
+		if !rec.Finished.IsZero() {
+			finished = rec.Finished.Format(time.RFC3339)
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\n",
+			rec.Started.Format(time.RFC3339), finished,
+			rec.ArtifactName, rec.DeploymentID, rec.Result)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTestUpdate(id, artifact string) client.UpdateResponse {
+	var update client.UpdateResponse
+	update.ID = id
+	update.Artifact.ArtifactName = artifact
+	return update
+}
+
+func TestInstallHistory(t *testing.T) {
+	ms := utils.NewMemStore()
+
+	history, err := loadInstallHistory(ms)
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+
+	// download and result of the same deployment make single record
+	recordInstallStatus(ms, makeTestUpdate("dep-1", "release-1"), client.StatusDownloading)
+	history, err = loadInstallHistory(ms)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	started := history[0].Started
+	assert.False(t, started.IsZero())
+	assert.True(t, history[0].Finished.IsZero())
+
+	// retried download keeps the start time
+	time.Sleep(time.Millisecond)
+	recordInstallStatus(ms, makeTestUpdate("dep-1", "release-1"), client.StatusDownloading)
+	recordInstallStatus(ms, makeTestUpdate("dep-1", "release-1"), client.StatusSuccess)
+	history, err = loadInstallHistory(ms)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, "release-1", history[0].ArtifactName)
+	assert.Equal(t, "dep-1", history[0].DeploymentID)
+	assert.Equal(t, client.StatusSuccess, history[0].Result)
+	assert.True(t, started.Equal(history[0].Started))
+	assert.False(t, history[0].Finished.IsZero())
+
+	recordInstallStatus(ms, makeTestUpdate("dep-2", "release-2"), client.StatusDownloading)
+	recordInstallStatus(ms, makeTestUpdate("dep-2", "release-2"), client.StatusFailure)
+	history, err = loadInstallHistory(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"release-2 (failure)", "release-1 (success)"},
+		installHistorySummary(history))
+
+	// history is bounded, oldest records go first
+	for i := 0; i < maxInstallHistory; i++ {
+		recordInstallStatus(ms, makeTestUpdate("dep-x", "release-x"),
+			client.StatusAlreadyInstalled)
+		recordInstallStatus(ms, makeTestUpdate("dep-y", "release-y"),
+			client.StatusAlreadyInstalled)
+	}
+	history, err = loadInstallHistory(ms)
+	assert.NoError(t, err)
+	assert.Len(t, history, maxInstallHistory)
+	assert.Equal(t, "dep-y", history[0].DeploymentID)
+
+	// broken history is replaced
+	ms.WriteAll(installHistoryName, []byte("garbage"))
+	_, err = loadInstallHistory(ms)
+	assert.Error(t, err)
+	recordInstallStatus(ms, makeTestUpdate("dep-3", "release-3"), client.StatusSuccess)
+	history, err = loadInstallHistory(ms)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+
+	// no store, nothing happens
+	recordInstallStatus(nil, makeTestUpdate("dep-3", "release-3"), client.StatusSuccess)
+}
+
+func TestShowInstallHistory(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "history")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, doShowInstallHistory(tdir, out))
+	assert.Equal(t, "no artifacts installed yet\n", out.String())
+
+	db := NewDBStore(tdir)
+	recordInstallStatus(db, makeTestUpdate("dep-1", "release-1"), client.StatusDownloading)
+	db.Close()
+
+	out.Reset()
+	assert.NoError(t, doShowInstallHistory(tdir, out))
+	fields := strings.Split(strings.TrimSpace(out.String()), "\t")
+	assert.Len(t, fields, 5)
+	assert.Equal(t, []string{"-", "release-1", "dep-1", "downloading"}, fields[1:])
+
+	out.Reset()
+	assert.NoError(t, doShowInstallHistory(tdir, &jsonOutput{out}))
+	var entries []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &entries))
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "release-1", entries[0]["artifact_name"])
+	assert.Equal(t, "dep-1", entries[0]["deployment_id"])
+	assert.Equal(t, "downloading", entries[0]["result"])
+	assert.NotContains(t, entries[0], "finished")
+}
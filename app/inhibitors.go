@@ -0,0 +1,255 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Backup jobs, user sessions and the like block disruptive phases of the
+// update, install and reboot, while they run: with block-mode shutdown
+// inhibitor locks of systemd-logind (systemd-inhibit --what=shutdown), or
+// with files in the inhibitor directory, named after who inhibits, the first
+// line telling why. Install is deferred, and reboot waits, at most for the
+// time allowed; the update proceeds then.
+const (
+	defaultMaxInhibit = time.Hour
+	// how often reboot checks whether the inhibitors are gone
+	inhibitRecheckInterval = time.Minute
+)
+
+type updateInhibitors struct {
+	systemd bool
+	dir     string
+	cmdr    Commander
+	max     time.Duration
+
+	lock sync.Mutex
+	// since when install has been inhibited; zero if it is not
+	since time.Time
+}
+
+// Returns nil if no inhibitors are configured.
+func newUpdateInhibitors(config MenderConfig) *updateInhibitors {
+	if !config.UpdateInhibitorsSystemd && config.UpdateInhibitorDir == "" {
+		return nil
+	}
+	u := &updateInhibitors{
+		systemd: config.UpdateInhibitorsSystemd,
+		dir:     config.UpdateInhibitorDir,
+		cmdr:    &osCalls{},
+		max:     defaultMaxInhibit,
+	}
+	if config.UpdateInhibitMaxSeconds > 0 {
+		u.max = time.Duration(config.UpdateInhibitMaxSeconds) * time.Second
+	}
+	return u
+}
+
+// Split busctl output into values; strings are quoted, with C escapes.
+func busctlFields(out string) ([]string, error) {
+	var fields []string
+	for out = strings.TrimSpace(out); out != ""; out = strings.TrimSpace(out) {
+		if out[0] != '"' {
+			end := strings.IndexAny(out, " \t\n")
+			if end < 0 {
+				end = len(out)
+			}
+			fields = append(fields, out[:end])
+			out = out[end:]
+			continue
+		}
+		// find the closing quote, skipping escaped characters
+		end := 1
+		for ; end < len(out) && out[end] != '"'; end++ {
+			if out[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(out) {
+			return nil, errors.New("unterminated string")
+		}
+		s, err := strconv.Unquote(out[:end+1])
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, s)
+		out = out[end+1:]
+	}
+	return fields, nil
+}
+
+// Block-mode shutdown locks of systemd-logind, as "who (why)".
+func (u *updateInhibitors) systemdLocks() ([]string, error) {
+	out, err := u.cmdr.Command("busctl", "call", "org.freedesktop.login1",
+		"/org/freedesktop/login1", "org.freedesktop.login1.Manager",
+		"ListInhibitors").Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list inhibitor locks")
+	}
+	// a(ssssuu) N what who why mode uid pid ...
+	fields, err := busctlFields(string(out))
+	if err != nil || len(fields) < 2 || (len(fields)-2)%6 != 0 {
+		return nil, errors.Errorf("unexpected inhibitor lock list: %s", out)
+	}
+	var locks []string
+	for i := 2; i < len(fields); i += 6 {
+		what, who, why, mode := fields[i], fields[i+1], fields[i+2], fields[i+3]
+		if mode != "block" || !strings.Contains(":"+what+":", ":shutdown:") {
+			continue
+		}
+		locks = append(locks, who+" ("+why+")")
+	}
+	return locks, nil
+}
+
+// Files in the inhibitor directory, as "who (why)".
+func (u *updateInhibitors) dirLocks() ([]string, error) {
+	files, err := ioutil.ReadDir(u.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to list inhibitor files")
+	}
+	var locks []string
+	for _, fi := range files {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		why := ""
+		if f, err := os.Open(filepath.Join(u.dir, fi.Name())); err == nil {
+			scanner := bufio.NewScanner(f)
+			if scanner.Scan() {
+				why = strings.TrimSpace(scanner.Text())
+			}
+			f.Close()
+		}
+		if why == "" {
+			why = "no reason given"
+		}
+		locks = append(locks, fi.Name()+" ("+why+")")
+	}
+	return locks, nil
+}
+
+// Inhibitors present now. Inhibitors failing to be listed are logged, and
+// do not block the update.
+func (u *updateInhibitors) list() []string {
+	if u == nil {
+		return nil
+	}
+	var inhibitors []string
+	if u.systemd {
+		locks, err := u.systemdLocks()
+		if err != nil {
+			log.Warnf("%v", err)
+		}
+		inhibitors = append(inhibitors, locks...)
+	}
+	if u.dir != "" {
+		locks, err := u.dirLocks()
+		if err != nil {
+			log.Warnf("%v", err)
+		}
+		inhibitors = append(inhibitors, locks...)
+	}
+	return inhibitors
+}
+
+// DeferUpdate defers install while there are inhibitors, until the time
+// allowed is up.
+func (u *updateInhibitors) DeferUpdate(update client.UpdateResponse,
+	now time.Time) (time.Time, string) {
+	inhibitors := u.list()
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if len(inhibitors) == 0 {
+		u.since = time.Time{}
+		return time.Time{}, ""
+	}
+	if u.since.IsZero() {
+		u.since = now
+	}
+	until := u.since.Add(u.max)
+	if !now.Before(until) {
+		log.Warnf("install inhibited for longer than %v, proceeding despite %s",
+			u.max, strings.Join(inhibitors, ", "))
+		return time.Time{}, ""
+	}
+	return until, "inhibited by " + strings.Join(inhibitors, ", ")
+}
+
+// UpdateInhibitors returns inhibitors blocking disruptive update phases now.
+func (m *mender) UpdateInhibitors() []string {
+	return m.inhibitors.list()
+}
+
+// GetMaxInhibit returns the time inhibitors may block the reboot for.
+func (m *mender) GetMaxInhibit() time.Duration {
+	if m.inhibitors == nil {
+		return 0
+	}
+	return m.inhibitors.max
+}
+
+// Wait for inhibitors of the reboot to go away, at most for the time
+// allowed; who inhibits is reported with the rebooting status. Returns false
+// if the wait was cancelled.
+func waitForRebootInhibitors(ctx *StateContext, c Controller, s CancellableState,
+	update client.UpdateResponse) bool {
+	max := c.GetMaxInhibit()
+	var waited time.Duration
+	var reported string
+	for {
+		inhibitors := c.UpdateInhibitors()
+		if len(inhibitors) == 0 {
+			return true
+		}
+		who := strings.Join(inhibitors, ", ")
+		if waited >= max {
+			log.Warnf("reboot inhibited for longer than %v, rebooting despite %s",
+				max, who)
+			return true
+		}
+		if who != reported {
+			log.Infof("reboot inhibited by %s", who)
+			if merr := c.ReportUpdateSubState(ctx.Context(), update,
+				client.StatusRebooting, "reboot inhibited by "+who); merr != nil {
+				log.Warnf("failed to report reboot inhibitors: %v", merr)
+			}
+			reported = who
+		}
+		wait := inhibitRecheckInterval
+		if max-waited < wait {
+			wait = max - waited
+		}
+		if !s.Wait(ctx.Context(), wait) {
+			return false
+		}
+		waited += wait
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateInhibitorsConfig(t *testing.T) {
+	assert.Nil(t, newUpdateInhibitors(MenderConfig{}))
+
+	u := newUpdateInhibitors(MenderConfig{UpdateInhibitorsSystemd: true})
+	assert.NotNil(t, u)
+	assert.Equal(t, defaultMaxInhibit, u.max)
+
+	u = newUpdateInhibitors(MenderConfig{
+		UpdateInhibitorDir:      "/run/mender/inhibit",
+		UpdateInhibitMaxSeconds: 120,
+	})
+	assert.False(t, u.systemd)
+	assert.Equal(t, 2*time.Minute, u.max)
+
+	// nothing inhibits unless configured
+	var none *updateInhibitors
+	assert.Nil(t, none.list())
+}
+
+func TestBusctlFields(t *testing.T) {
+	fields, err := busctlFields(`a(ssssuu) 1 "shutdown:sleep" "backup" ` +
+		`"copying \"home\"" "block" 0 1234` + "\n")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a(ssssuu)", "1", "shutdown:sleep", "backup",
+		`copying "home"`, "block", "0", "1234"}, fields)
+
+	_, err = busctlFields(`a(ssssuu) 1 "shutdown`)
+	assert.Error(t, err)
+}
+
+func TestUpdateInhibitorsSystemd(t *testing.T) {
+	cmdr := newTestOSCalls(`a(ssssuu) 3 "shutdown:sleep" "backup" "nightly backup" `+
+		`"block" 0 1234 "shutdown" "NetworkManager" "tear down networks" `+
+		`"delay" 0 567 "sleep:idle" "video" "playing" "block" 1000 890`, 0)
+	u := &updateInhibitors{systemd: true, cmdr: &cmdr, max: time.Hour}
+	assert.Equal(t, []string{"backup (nightly backup)"}, u.list())
+
+	// no locks
+	cmdr = newTestOSCalls(`a(ssssuu) 0`, 0)
+	assert.Nil(t, u.list())
+
+	// locks failing to be listed do not block the update
+	cmdr = newTestOSCalls("", 1)
+	assert.Nil(t, u.list())
+	cmdr = newTestOSCalls("garbage", 0)
+	assert.Nil(t, u.list())
+}
+
+func TestUpdateInhibitorsDir(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "inhibit")
+	defer os.RemoveAll(dir)
+
+	u := &updateInhibitors{dir: path.Join(dir, "missing"), max: time.Hour}
+	assert.Nil(t, u.list())
+
+	u.dir = dir
+	assert.Nil(t, u.list())
+
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "backup"),
+		[]byte("nightly backup\nstarted 02:00\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "kiosk"), nil, 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, ".hidden"), []byte("x"), 0644))
+	assert.NoError(t, os.Mkdir(path.Join(dir, "subdir"), 0755))
+	assert.Equal(t, []string{"backup (nightly backup)", "kiosk (no reason given)"},
+		u.list())
+}
+
+func TestUpdateInhibitorsDeferUpdate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "inhibit")
+	defer os.RemoveAll(dir)
+
+	u := &updateInhibitors{dir: dir, max: time.Hour}
+	update := client.UpdateResponse{ID: "foo"}
+	now := time.Date(2017, 3, 1, 2, 0, 0, 0, time.UTC)
+
+	until, reason := u.DeferUpdate(update, now)
+	assert.True(t, until.IsZero())
+	assert.Equal(t, "", reason)
+
+	ioutil.WriteFile(path.Join(dir, "backup"), []byte("nightly backup"), 0644)
+	until, reason = u.DeferUpdate(update, now)
+	assert.Equal(t, now.Add(time.Hour), until)
+	assert.Equal(t, "inhibited by backup (nightly backup)", reason)
+
+	// deferred until the time allowed from when inhibiting started
+	until, _ = u.DeferUpdate(update, now.Add(30*time.Minute))
+	assert.Equal(t, now.Add(time.Hour), until)
+
+	// time allowed is up
+	until, reason = u.DeferUpdate(update, now.Add(time.Hour))
+	assert.True(t, until.IsZero())
+	assert.Equal(t, "", reason)
+
+	// inhibitors gone and back
+	os.Remove(path.Join(dir, "backup"))
+	until, _ = u.DeferUpdate(update, now.Add(2*time.Hour))
+	assert.True(t, until.IsZero())
+	ioutil.WriteFile(path.Join(dir, "backup"), []byte("nightly backup"), 0644)
+	until, _ = u.DeferUpdate(update, now.Add(3*time.Hour))
+	assert.Equal(t, now.Add(4*time.Hour), until)
+}
+
+func TestStateRebootInhibited(t *testing.T) {
+
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	ctx := StateContext{
+		store: utils.NewMemStore(),
+	}
+	sc := &stateTestController{
+		inhibitors: []string{"backup (nightly backup)"},
+		maxInhibit: 3 * time.Minute,
+	}
+
+	// reboot once the time allowed is up
+	rs := NewRebootState(update)
+	rs.(*RebootState).CancellableState = &cancellableStateTest{BaseState{
+		id: MenderStateReboot,
+	}}
+	s, c := rs.Handle(&ctx, sc)
+	assert.IsType(t, &FinalState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, "reboot inhibited by backup (nightly backup)", sc.reportSubState)
+	assert.Equal(t, []string{"notify-reboot", "reboot"}, sc.calls)
+
+	// wait interrupted
+	sc.calls = nil
+	rs = NewRebootState(update)
+	cctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ctx.context = cctx
+	s, c = rs.Handle(&ctx, sc)
+	assert.Equal(t, rs, s)
+	assert.True(t, c)
+	assert.Nil(t, sc.calls)
+
+	// not inhibited
+	sc = &stateTestController{}
+	ctx.context = nil
+	s, _ = NewRebootState(update).Handle(&ctx, sc)
+	assert.IsType(t, &FinalState{}, s)
+	assert.Equal(t, "", sc.reportSubState)
+	assert.Equal(t, []string{"notify-reboot", "reboot"}, sc.calls)
+}
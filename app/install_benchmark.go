@@ -0,0 +1,382 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/pkg/errors"
+)
+
+// Targets the payload is written to when benchmarking artifact install.
+const (
+	benchmarkTargetScratch   = "scratch"
+	benchmarkTargetPartition = "partition"
+)
+
+// Phases of artifact install measured by the benchmark.
+const (
+	benchmarkPhaseDownload   = "download"
+	benchmarkPhaseDecompress = "decompress"
+	benchmarkPhaseWrite      = "write"
+	benchmarkPhaseSync       = "sync"
+)
+
+type benchmarkPhase struct {
+	Name     string
+	Bytes    int64
+	Duration time.Duration
+}
+
+// Bytes per second, or 0 if the phase took no measurable time.
+func (p benchmarkPhase) throughput() float64 {
+	if p.Duration <= 0 {
+		return 0
+	}
+	return float64(p.Bytes) / p.Duration.Seconds()
+}
+
+type installBenchmark struct {
+	Artifact string
+	Target   string
+	Phases   []benchmarkPhase
+}
+
+// Storage the benchmark writes the payload to. Whatever was written is undone
+// by restore, which is called even if the benchmark failed.
+type benchmarkTarget interface {
+	open(size int64) (*os.File, error)
+	restore() error
+}
+
+// Payload written to a temporary file in the scratch directory; measures
+// the data partition rather than the partition updates go to, but never
+// touches the latter.
+type scratchBenchmarkTarget struct {
+	scratch *scratchDir
+	file    *os.File
+}
+
+func (t *scratchBenchmarkTarget) open(size int64) (*os.File, error) {
+	f, err := t.scratch.TempFile("benchmark-", size)
+	if err != nil {
+		return nil, err
+	}
+	t.file = f
+	return f, nil
+}
+
+func (t *scratchBenchmarkTarget) restore() error {
+	if t.file == nil {
+		return nil
+	}
+	t.file.Close()
+	err := os.Remove(t.file.Name())
+	t.file = nil
+	return err
+}
+
+// Payload written to the inactive partition. The part of the partition
+// about to be overwritten is copied to the scratch directory first and
+// written back afterwards, so that the image installed there (eg. the one to
+// roll back to) survives the benchmark.
+type partitionBenchmarkTarget struct {
+	path    string
+	scratch *scratchDir
+	file    *os.File
+	backup  *os.File
+	// bytes of the partition saved in backup
+	saved int64
+}
+
+func (t *partitionBenchmarkTarget) open(size int64) (*os.File, error) {
+	f, err := os.OpenFile(t.path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	t.file = f
+
+	psize, err := BlockDeviceGetSizeOf(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read size of %s", t.path)
+	}
+	if uint64(size) > psize {
+		return nil, errors.Errorf("payload (%d bytes) is larger than partition %s (%d bytes)",
+			size, t.path, psize)
+	}
+
+	backup, err := t.scratch.TempFile("benchmark-backup-", size)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can not save content of %s", t.path)
+	}
+	t.backup = backup
+	log.Infof("saving %d bytes of %s before benchmark", size, t.path)
+	if t.saved, err = io.CopyN(backup, f, size); err != nil {
+		return nil, errors.Wrapf(err, "failed to save content of %s", t.path)
+	}
+	if err := backup.Sync(); err != nil {
+		return nil, errors.Wrapf(err, "failed to save content of %s", t.path)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (t *partitionBenchmarkTarget) restore() error {
+	var err error
+	if t.file != nil && t.backup != nil && t.saved > 0 {
+		log.Infof("restoring %d bytes of %s", t.saved, t.path)
+		err = t.copyBack()
+		if err != nil {
+			log.Errorf("failed to restore content of %s; backup kept in %s: %v",
+				t.path, t.backup.Name(), err)
+		}
+	}
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+	if t.backup != nil {
+		t.backup.Close()
+		if err == nil {
+			os.Remove(t.backup.Name())
+		}
+		t.backup = nil
+	}
+	return err
+}
+
+func (t *partitionBenchmarkTarget) copyBack() error {
+	if _, err := t.backup.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(t.file, t.backup, t.saved); err != nil {
+		return err
+	}
+	return t.file.Sync()
+}
+
+// Installer taking the place of the device while benchmarking; payloads are
+// discarded, or written to the target with time spent in writes and in the
+// final sync accounted separately.
+type benchmarkInstaller struct {
+	target benchmarkTarget
+	bytes  int64
+	write  time.Duration
+	sync   time.Duration
+}
+
+func (b *benchmarkInstaller) InstallUpdate(image io.ReadCloser, size int64) error {
+	if b.target == nil {
+		n, err := io.Copy(ioutil.Discard, image)
+		b.bytes += n
+		return err
+	}
+
+	f, err := b.target.open(size)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(&timedWriter{w: f, spent: &b.write}, image)
+	b.bytes += n
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = f.Sync()
+	b.sync += time.Since(start)
+	return err
+}
+
+func (b *benchmarkInstaller) EnableUpdatedPartition() error {
+	return nil
+}
+
+type timedWriter struct {
+	w     io.Writer
+	spent *time.Duration
+}
+
+func (t *timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.w.Write(p)
+	*t.spent += time.Since(start)
+	return n, err
+}
+
+// Artifact is read twice: once with payloads discarded, which measures
+// decompression (and checksum verification) alone, and once with payloads
+// written to the target. Remote artifacts are downloaded to the scratch
+// directory first.
+func runInstallBenchmark(location string, httpConfig client.Config, dt string,
+	scratch *scratchDir, target benchmarkTarget) (*installBenchmark, error) {
+	report := installBenchmark{Artifact: location}
+
+	file := location
+	if strings.HasPrefix(location, "http:") || strings.HasPrefix(location, "https:") {
+		phase, name, err := benchmarkDownload(location, httpConfig, scratch)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(name)
+		report.Phases = append(report.Phases, phase)
+		file = name
+	}
+
+	decompress := benchmarkInstaller{}
+	start := time.Now()
+	if err := benchmarkInstall(file, dt, &decompress); err != nil {
+		return nil, err
+	}
+	report.Phases = append(report.Phases, benchmarkPhase{
+		Name:     benchmarkPhaseDecompress,
+		Bytes:    decompress.bytes,
+		Duration: time.Since(start),
+	})
+
+	write := benchmarkInstaller{target: target}
+	err := benchmarkInstall(file, dt, &write)
+	if rerr := target.restore(); rerr != nil && err == nil {
+		err = errors.Wrapf(rerr, "failed to restore benchmark target")
+	}
+	if err != nil {
+		return nil, err
+	}
+	report.Phases = append(report.Phases,
+		benchmarkPhase{Name: benchmarkPhaseWrite, Bytes: write.bytes, Duration: write.write},
+		benchmarkPhase{Name: benchmarkPhaseSync, Bytes: write.bytes, Duration: write.sync})
+	return &report, nil
+}
+
+func benchmarkDownload(url string, httpConfig client.Config,
+	scratch *scratchDir) (benchmarkPhase, string, error) {
+	phase := benchmarkPhase{Name: benchmarkPhaseDownload}
+	api, err := client.New(httpConfig)
+	if err != nil {
+		return phase, "", errors.Wrap(err, "error creating HTTP client")
+	}
+
+	start := time.Now()
+	image, size, err := client.NewUpdate().FetchUpdate(context.Background(), api, url)
+	if err != nil {
+		return phase, "", err
+	}
+	defer image.Close()
+
+	f, err := scratch.TempFile("benchmark-artifact-", size)
+	if err != nil {
+		return phase, "", err
+	}
+	defer f.Close()
+	phase.Bytes, err = io.Copy(f, image)
+	phase.Duration = time.Since(start)
+	if err != nil {
+		os.Remove(f.Name())
+		return phase, "", errors.Wrapf(err, "failed to download %s", url)
+	}
+	return phase, f.Name(), nil
+}
+
+func benchmarkInstall(file string, dt string, b *benchmarkInstaller) error {
+	image, _, err := FetchUpdateFromFile(file)
+	if err != nil {
+		return err
+	}
+	return installer.Install(image, dt, b)
+}
+
+// Benchmark install of the artifact and print the report; used for sizing
+// maintenance windows. The device is left as it was.
+func doBenchmarkInstall(config *MenderConfig, device *device, dataStore string,
+	location string, targetName string, out io.Writer) error {
+	scratch := newScratchDir(config, dataStore)
+	if err := scratch.prepare(); err != nil {
+		return err
+	}
+
+	var target benchmarkTarget
+	switch targetName {
+	case "", benchmarkTargetScratch:
+		targetName = benchmarkTargetScratch
+		target = &scratchBenchmarkTarget{scratch: scratch}
+	case benchmarkTargetPartition:
+		if device.rootfsFiles != nil {
+			return errors.New("root filesystem is updated as image file, " +
+				"use scratch benchmark target")
+		}
+		inactive, err := device.GetInactive()
+		if err != nil {
+			return err
+		}
+		target = &partitionBenchmarkTarget{path: inactive, scratch: scratch}
+	default:
+		return errors.Errorf("invalid benchmark target %q, expected %q or %q",
+			targetName, benchmarkTargetScratch, benchmarkTargetPartition)
+	}
+
+	report, err := runInstallBenchmark(location, config.GetHttpConfig(),
+		GetDeviceType(defaultDeviceTypeFile), scratch, target)
+	if err != nil {
+		return err
+	}
+	report.Target = targetName
+	printInstallBenchmark(out, report)
+	return nil
+}
+
+type benchmarkPhaseEntry struct {
+	Name           string  `json:"name"`
+	Bytes          int64   `json:"bytes"`
+	DurationMs     float64 `json:"duration_ms"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+}
+
+func printInstallBenchmark(out io.Writer, report *installBenchmark) {
+	if isJSONOutput(out) {
+		entries := make([]benchmarkPhaseEntry, 0, len(report.Phases))
+		for _, p := range report.Phases {
+			entries = append(entries, benchmarkPhaseEntry{
+				Name:           p.Name,
+				Bytes:          p.Bytes,
+				DurationMs:     float64(p.Duration) / float64(time.Millisecond),
+				BytesPerSecond: p.throughput(),
+			})
+		}
+		printJSON(out, struct {
+			Artifact string                `json:"artifact"`
+			Target   string                `json:"target"`
+			Phases   []benchmarkPhaseEntry `json:"phases"`
+		}{report.Artifact, report.Target, entries})
+		return
+	}
+
+	fmt.Fprintf(out, "install benchmark of %s (target: %s)\n", report.Artifact, report.Target)
+	for _, p := range report.Phases {
+		fmt.Fprintf(out, "%-12s %12d bytes %12s %10.2f MiB/s\n", p.Name, p.Bytes,
+			p.Duration.Round(time.Millisecond), p.throughput()/(1024*1024))
+	}
+}
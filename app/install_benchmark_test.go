@@ -0,0 +1,148 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func benchmarkPhaseNames(report *installBenchmark) []string {
+	var names []string
+	for _, p := range report.Phases {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+func TestInstallBenchmarkScratch(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	artifact := writeTestArtifact(t, tdir, "release-1")
+	scratch := newScratchDir(&MenderConfig{}, tdir)
+	assert.NoError(t, scratch.prepare())
+
+	report, err := runInstallBenchmark(artifact, MenderConfig{}.GetHttpConfig(),
+		"vexpress-qemu", scratch, &scratchBenchmarkTarget{scratch: scratch})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{benchmarkPhaseDecompress, benchmarkPhaseWrite,
+		benchmarkPhaseSync}, benchmarkPhaseNames(report))
+	for _, p := range report.Phases {
+		assert.True(t, p.Bytes > 0, p.Name)
+	}
+
+	// nothing left behind
+	left, err := ioutil.ReadDir(scratch.path)
+	assert.NoError(t, err)
+	assert.Empty(t, left)
+
+	// incompatible artifact is not benchmarked
+	_, err = runInstallBenchmark(artifact, MenderConfig{}.GetHttpConfig(),
+		"other-device", scratch, &scratchBenchmarkTarget{scratch: scratch})
+	assert.Error(t, err)
+}
+
+func TestInstallBenchmarkPartitionRestored(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	artifact := writeTestArtifact(t, tdir, "release-1")
+	scratch := newScratchDir(&MenderConfig{}, tdir)
+	assert.NoError(t, scratch.prepare())
+
+	part := path.Join(tdir, "part")
+	content := bytes.Repeat([]byte("rollback image "), 1000)
+	assert.NoError(t, ioutil.WriteFile(part, content, 0600))
+
+	old := BlockDeviceGetSizeOf
+	defer func() { BlockDeviceGetSizeOf = old }()
+	BlockDeviceGetSizeOf = func(f *os.File) (uint64, error) {
+		return uint64(len(content)), nil
+	}
+
+	target := &partitionBenchmarkTarget{path: part, scratch: scratch}
+	report, err := runInstallBenchmark(artifact, MenderConfig{}.GetHttpConfig(),
+		"vexpress-qemu", scratch, target)
+	assert.NoError(t, err)
+	assert.Len(t, report.Phases, 3)
+
+	data, err := ioutil.ReadFile(part)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	left, err := ioutil.ReadDir(scratch.path)
+	assert.NoError(t, err)
+	assert.Empty(t, left)
+
+	// payload does not fit
+	BlockDeviceGetSizeOf = func(f *os.File) (uint64, error) {
+		return 1, nil
+	}
+	target = &partitionBenchmarkTarget{path: part, scratch: scratch}
+	_, err = runInstallBenchmark(artifact, MenderConfig{}.GetHttpConfig(),
+		"vexpress-qemu", scratch, target)
+	assert.Error(t, err)
+	data, _ = ioutil.ReadFile(part)
+	assert.Equal(t, content, data)
+}
+
+func TestPrintInstallBenchmark(t *testing.T) {
+	report := &installBenchmark{
+		Artifact: "release-1.mender",
+		Target:   benchmarkTargetScratch,
+		Phases: []benchmarkPhase{
+			{Name: benchmarkPhaseWrite, Bytes: 2 * 1024 * 1024, Duration: time.Second},
+			{Name: benchmarkPhaseSync, Bytes: 1024},
+		},
+	}
+
+	var buf bytes.Buffer
+	printInstallBenchmark(&buf, report)
+	assert.Contains(t, buf.String(), "target: scratch")
+	assert.Contains(t, buf.String(), "2.00 MiB/s")
+
+	buf.Reset()
+	out, _ := newCLIOutput(&buf, outputJSON)
+	printInstallBenchmark(out, report)
+	var parsed struct {
+		Target string `json:"target"`
+		Phases []struct {
+			Name           string  `json:"name"`
+			BytesPerSecond float64 `json:"bytes_per_second"`
+		} `json:"phases"`
+	}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &parsed))
+	assert.Equal(t, benchmarkTargetScratch, parsed.Target)
+	assert.Equal(t, float64(2*1024*1024), parsed.Phases[0].BytesPerSecond)
+	// no division by zero
+	assert.Equal(t, float64(0), parsed.Phases[1].BytesPerSecond)
+}
+
+func TestBenchmarkInstallArgs(t *testing.T) {
+	opts, err := argsParse([]string{"-benchmark-install", "release-1.mender",
+		"-benchmark-target", benchmarkTargetPartition})
+	assert.NoError(t, err)
+	assert.Equal(t, "release-1.mender", *opts.benchInstall)
+	assert.Equal(t, lockModeCLI, instanceLockMode(opts))
+
+	_, err = argsParse([]string{"-benchmark-install", "a.mender", "-commit"})
+	assert.Equal(t, errMsgAmbiguousArgumentsGiven, err)
+}
@@ -0,0 +1,232 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mendersoftware/log"
+)
+
+// Image is written to storage with buffer and sync interval tuned while
+// writing: fast storage (eMMC, SSD) gets large buffers and few syncs, while
+// the buffer shrinks and dirty data are flushed often once the device runs
+// short of memory, instead of leaving it all in the page cache.
+const (
+	minInstallBuffer     = 64 * 1024
+	initialInstallBuffer = 256 * 1024
+	maxInstallBuffer     = 4 * 1024 * 1024
+
+	// bounds of data written between syncs
+	minInstallSyncBytes = 4 * 1024 * 1024
+	maxInstallSyncBytes = 256 * 1024 * 1024
+	// time the data written between syncs should take to write
+	installSyncPeriod = time.Second
+
+	// buffer and sync interval are tuned after this much is written, or
+	// 8 buffers, whichever is more
+	installTuneWindow = 8 * 1024 * 1024
+
+	// memory available below which the device is considered short of it
+	lowMemoryBytes = 32 * 1024 * 1024
+)
+
+var procMeminfo = "/proc/meminfo"
+
+// Memory available for new allocations without swapping, in bytes, or -1 if
+// not known.
+func memAvailable() int64 {
+	f, err := os.Open(procMeminfo)
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// MemAvailable:     123456 kB
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return -1
+		}
+		return kb * 1024
+	}
+	return -1
+}
+
+type syncWriter interface {
+	io.Writer
+	Sync() error
+}
+
+type installTuner struct {
+	// buffer size, and bytes written between syncs
+	buffer    int
+	syncBytes int64
+	// throughput of the last window, and whether growing the buffer still
+	// makes writing faster
+	lastRate float64
+	growing  bool
+	// fixed buffer size; nothing is tuned, and data are synced only once
+	// written, if set
+	static int
+}
+
+func newInstallTuner(static int) *installTuner {
+	t := &installTuner{
+		buffer:    initialInstallBuffer,
+		syncBytes: minInstallSyncBytes,
+		growing:   true,
+		static:    static,
+	}
+	if static > 0 {
+		t.buffer = static
+		t.syncBytes = math.MaxInt64
+	}
+	return t
+}
+
+func (t *installTuner) window() int64 {
+	if w := 8 * int64(t.buffer); w > installTuneWindow {
+		return w
+	}
+	return installTuneWindow
+}
+
+// adjust tunes the buffer and sync interval to the throughput (bytes per
+// second) writing the last window and the memory available (-1 if not
+// known).
+func (t *installTuner) adjust(rate float64, available int64) {
+	if t.static > 0 {
+		return
+	}
+	t.adjustBuffer(rate, available)
+	t.lastRate = rate
+	t.adjustSync(rate, available)
+}
+
+func (t *installTuner) adjustBuffer(rate float64, available int64) {
+	switch {
+	case available >= 0 && available < lowMemoryBytes:
+		t.buffer /= 2
+		t.growing = false
+	case t.growing && (t.lastRate == 0 || rate > t.lastRate*1.05):
+		t.buffer *= 2
+	case t.growing && rate < t.lastRate*0.95:
+		// larger buffer made it slower; back off and stay there
+		t.buffer /= 2
+		t.growing = false
+	}
+
+	limit := maxInstallBuffer
+	if available >= 0 && available/64 < int64(limit) {
+		// leave the memory to the rest of the system
+		limit = int(available / 64)
+	}
+	if t.buffer > limit {
+		t.buffer = limit
+	}
+	if t.buffer < minInstallBuffer {
+		t.buffer = minInstallBuffer
+	}
+}
+
+func (t *installTuner) adjustSync(rate float64, available int64) {
+	t.syncBytes = int64(rate * installSyncPeriod.Seconds())
+	if available >= 0 && t.syncBytes > available/4 {
+		// dirty pages count against memory available
+		t.syncBytes = available / 4
+	}
+	if t.syncBytes > maxInstallSyncBytes {
+		t.syncBytes = maxInstallSyncBytes
+	}
+	if t.syncBytes < minInstallSyncBytes {
+		t.syncBytes = minInstallSyncBytes
+	}
+}
+
+// fill reads into buf until it is full or reading fails; unlike
+// io.ReadFull, errors of src are returned as they are.
+func fill(src io.Reader, buf []byte) (int, error) {
+	var n int
+	for n < len(buf) {
+		r, err := src.Read(buf[n:])
+		n += r
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// tunedCopy writes src to dst, syncing it every now and then. Buffer size is
+// tuned on the way unless `static` is set.
+func tunedCopy(dst syncWriter, src io.Reader, static int) (int64, error) {
+	t := newInstallTuner(static)
+	buf := make([]byte, t.buffer)
+
+	var written, windowBytes, unsynced int64
+	// time spent writing and syncing, not waiting for data
+	var windowTime time.Duration
+	for {
+		n, rerr := fill(src, buf)
+		if n > 0 {
+			start := time.Now()
+			w, err := dst.Write(buf[:n])
+			written += int64(w)
+			windowBytes += int64(w)
+			unsynced += int64(w)
+			if err == nil && w != n {
+				err = io.ErrShortWrite
+			}
+			if err == nil && unsynced >= t.syncBytes {
+				err = dst.Sync()
+				unsynced = 0
+			}
+			windowTime += time.Since(start)
+			if err != nil {
+				return written, err
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+
+		if windowBytes >= t.window() && windowTime > 0 {
+			rate := float64(windowBytes) / windowTime.Seconds()
+			available := memAvailable()
+			t.adjust(rate, available)
+			if t.buffer != len(buf) {
+				buf = make([]byte, t.buffer)
+			}
+			log.Debugf("writing at %.1f MiB/s with %d MiB available: "+
+				"buffer %d KiB, sync every %d MiB", rate/(1024*1024),
+				available/(1024*1024), t.buffer/1024, t.syncBytes/(1024*1024))
+			windowBytes, windowTime = 0, 0
+		}
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+type testSyncWriter struct {
+	bytes.Buffer
+	writes []int
+	syncs  int
+}
+
+func (w *testSyncWriter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, len(p))
+	return w.Buffer.Write(p)
+}
+
+func (w *testSyncWriter) Sync() error {
+	w.syncs++
+	return nil
+}
+
+func TestMemAvailable(t *testing.T) {
+	td, _ := ioutil.TempDir("", "meminfo")
+	defer os.RemoveAll(td)
+	old := procMeminfo
+	defer func() { procMeminfo = old }()
+
+	procMeminfo = path.Join(td, "meminfo")
+	assert.Equal(t, int64(-1), memAvailable())
+
+	ioutil.WriteFile(procMeminfo, []byte("MemTotal:        1012340 kB\n"+
+		"MemFree:          123456 kB\n"+
+		"MemAvailable:     524288 kB\n"), 0644)
+	assert.Equal(t, int64(512*1024*1024), memAvailable())
+
+	// kernels older than 3.14
+	ioutil.WriteFile(procMeminfo, []byte("MemTotal:        1012340 kB\n"), 0644)
+	assert.Equal(t, int64(-1), memAvailable())
+}
+
+func TestInstallTunerAdjust(t *testing.T) {
+	const mib = 1024 * 1024
+	plenty := int64(1024 * mib)
+
+	// faster with every larger buffer, up to the maximum
+	tuner := newInstallTuner(0)
+	rate := float64(20 * mib)
+	for i := 0; i < 10; i++ {
+		tuner.adjust(rate, plenty)
+		rate *= 1.5
+	}
+	assert.Equal(t, maxInstallBuffer, tuner.buffer)
+	assert.Equal(t, int64(maxInstallSyncBytes), tuner.syncBytes)
+
+	// larger buffer made no difference, kept
+	tuner = newInstallTuner(0)
+	tuner.adjust(20*mib, plenty)
+	assert.Equal(t, 2*initialInstallBuffer, tuner.buffer)
+	assert.Equal(t, int64(20*mib), tuner.syncBytes)
+	tuner.adjust(20*mib, plenty)
+	assert.Equal(t, 2*initialInstallBuffer, tuner.buffer)
+
+	// larger buffer made it slower, backs off for good
+	tuner.adjust(10*mib, plenty)
+	assert.Equal(t, initialInstallBuffer, tuner.buffer)
+	tuner.adjust(30*mib, plenty)
+	assert.Equal(t, initialInstallBuffer, tuner.buffer)
+
+	// buffer limited by memory available, syncs often to keep dirty data low
+	tuner = newInstallTuner(0)
+	for i := 1; i <= 5; i++ {
+		tuner.adjust(float64(i*100*mib), plenty)
+	}
+	assert.Equal(t, maxInstallBuffer, tuner.buffer)
+	tuner.adjust(600*mib, 40*mib)
+	assert.Equal(t, 40*mib/64, tuner.buffer)
+	assert.Equal(t, int64(10*mib), tuner.syncBytes)
+
+	// short of memory, buffer shrinks and stays small
+	tuner.adjust(600*mib, 16*mib)
+	assert.Equal(t, 16*mib/64, tuner.buffer)
+	assert.Equal(t, int64(minInstallSyncBytes), tuner.syncBytes)
+	for i := 0; i < 5; i++ {
+		tuner.adjust(600*mib, 16*mib)
+	}
+	assert.Equal(t, minInstallBuffer, tuner.buffer)
+	tuner.adjust(600*mib, plenty)
+	assert.Equal(t, minInstallBuffer, tuner.buffer)
+
+	// memory not known
+	tuner = newInstallTuner(0)
+	tuner.adjust(1*mib, -1)
+	assert.Equal(t, 2*initialInstallBuffer, tuner.buffer)
+	assert.Equal(t, int64(minInstallSyncBytes), tuner.syncBytes)
+
+	// fixed buffer
+	tuner = newInstallTuner(8192)
+	tuner.adjust(100*mib, 16*mib)
+	assert.Equal(t, 8192, tuner.buffer)
+}
+
+func TestTunedCopy(t *testing.T) {
+	image := bytes.Repeat([]byte("0123456789abcdef"), 2*1024*1024)
+
+	w := &testSyncWriter{}
+	n, err := tunedCopy(w, bytes.NewReader(image), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(image)), n)
+	assert.Equal(t, image, w.Bytes())
+	assert.Equal(t, initialInstallBuffer, w.writes[0])
+	assert.True(t, w.syncs > 0)
+
+	// fixed buffer, synced by the caller once written
+	w = &testSyncWriter{}
+	n, err = tunedCopy(w, bytes.NewReader(image[:100000]), 8192)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100000), n)
+	assert.Equal(t, image[:100000], w.Bytes())
+	assert.Len(t, w.writes, 13)
+	assert.Equal(t, 0, w.syncs)
+
+	// reading fails midway; what was read is written
+	w = &testSyncWriter{}
+	failing := io.MultiReader(bytes.NewReader(image[:1000]),
+		&errorReader{err: io.ErrUnexpectedEOF})
+	n, err = tunedCopy(w, failing, 0)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, int64(1000), n)
+
+	// writing fails
+	n, err = tunedCopy(&failingSyncWriter{}, bytes.NewReader(image), 0)
+	assert.Error(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+// sizedReader yields `left` bytes of whatever is in the buffer, without the
+// cost of filling it.
+type sizedReader struct {
+	left int64
+}
+
+func (r *sizedReader) Read(p []byte) (int, error) {
+	if r.left == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	r.left -= int64(len(p))
+	return len(p), nil
+}
+
+type countingSyncWriter struct {
+	io.Writer
+	written int64
+	syncs   int
+}
+
+func (w *countingSyncWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *countingSyncWriter) Sync() error {
+	w.syncs++
+	return nil
+}
+
+func TestTunedCopyLargeImage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams more than 4 GiB")
+	}
+
+	// image does not fit in 32 bits; neither do the partition size and
+	// the progress counters, on 32-bit platforms
+	const size = int64(4*1024*1024*1024 + 4096 + 1)
+
+	// partition of exactly the image size, as BlockDevice writes to it
+	part := &utils.LimitedWriter{W: ioutil.Discard, N: uint64(size)}
+	dst := &countingSyncWriter{Writer: part}
+	var out bytes.Buffer
+	progress := &utils.ProgressWriter{Out: &out, N: size}
+
+	n, err := tunedCopy(dst, io.TeeReader(&sizedReader{left: size}, progress), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, size, n)
+	assert.Equal(t, size, dst.written)
+	assert.True(t, dst.syncs > 0)
+	assert.Equal(t, uint64(0), part.N)
+	assert.NotContains(t, out.String(), "going over")
+	assert.Equal(t, " 100% 4194308 KiB\n", out.String()[out.Len()-18:])
+
+	// partition is full now
+	_, err = dst.Write([]byte{0})
+	assert.Equal(t, syscall.ENOSPC, err)
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+type failingSyncWriter struct{}
+
+func (w *failingSyncWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("no space left")
+}
+
+func (w *failingSyncWriter) Sync() error {
+	return nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// Only one mender process at a time may operate on the device and the state
+// data; daemon and CLI operations modifying them hold an flock on the lock
+// file in the data store. The lock goes away together with its holder, the
+// file itself is left behind and tells who held the lock last.
+const (
+	instanceLockName = "mender.lock"
+
+	// mode of the lock holder
+	lockModeDaemon = "daemon"
+	lockModeCLI    = "cli"
+
+	defaultTakeoverTimeout = 30 * time.Second
+	takeoverPollInterval   = 100 * time.Millisecond
+)
+
+var ErrInstanceLocked = errors.New("another mender instance is running")
+
+type instanceLock struct {
+	file *os.File
+}
+
+type lockOwner struct {
+	pid  int
+	mode string
+}
+
+func (o lockOwner) String() string {
+	return fmt.Sprintf("pid %d (%s)", o.pid, o.mode)
+}
+
+func (o lockOwner) alive() bool {
+	if o.pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(o.pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+func readLockOwner(f *os.File) (lockOwner, bool) {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return lockOwner{}, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return lockOwner{}, false
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return lockOwner{}, false
+	}
+	return lockOwner{pid: pid, mode: fields[1]}, true
+}
+
+// acquireInstanceLock takes the instance lock in dataStore without waiting;
+// returns error wrapping ErrInstanceLocked if another instance holds it.
+func acquireInstanceLock(dataStore, mode string) (*instanceLock, error) {
+	name := filepath.Join(dataStore, instanceLockName)
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open lock file %s", name)
+	}
+
+	owner, known := readLockOwner(f)
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err != syscall.EWOULDBLOCK {
+			return nil, errors.Wrapf(err, "failed to lock %s", name)
+		}
+		if !known {
+			return nil, errors.Wrapf(ErrInstanceLocked, "%s locked", name)
+		}
+		if !owner.alive() {
+			// lock file descriptor leaked to a child of the dead
+			// holder
+			return nil, errors.Wrapf(ErrInstanceLocked,
+				"%s locked by process inherited from %s", name, owner)
+		}
+		return nil, errors.Wrapf(ErrInstanceLocked, "%s locked by %s", name, owner)
+	}
+
+	if known && owner.pid != os.Getpid() {
+		log.Warnf("found stale instance lock of %s, which did not exit cleanly", owner)
+	}
+
+	l := &instanceLock{file: f}
+	if err := l.setOwner(lockOwner{pid: os.Getpid(), mode: mode}); err != nil {
+		l.Release()
+		return nil, errors.Wrapf(err, "failed to write lock file %s", name)
+	}
+	return l, nil
+}
+
+// takeoverInstanceLock takes the instance lock, asking the running daemon
+// holding it to stop and waiting for it to exit first. Operations of CLI
+// instances are never interrupted.
+func takeoverInstanceLock(dataStore, mode string, timeout time.Duration) (*instanceLock, error) {
+	l, err := acquireInstanceLock(dataStore, mode)
+	if errors.Cause(err) != ErrInstanceLocked {
+		return l, err
+	}
+
+	f, ferr := os.Open(filepath.Join(dataStore, instanceLockName))
+	if ferr != nil {
+		return nil, err
+	}
+	owner, known := readLockOwner(f)
+	f.Close()
+	if !known || !owner.alive() {
+		return nil, err
+	}
+	if owner.mode != lockModeDaemon {
+		return nil, errors.Wrapf(err, "only daemon can be taken over")
+	}
+
+	log.Infof("asking mender daemon, %s, to stop", owner)
+	if kerr := syscall.Kill(owner.pid, syscall.SIGTERM); kerr != nil {
+		return nil, errors.Wrapf(kerr, "failed to stop %s", owner)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		l, err = acquireInstanceLock(dataStore, mode)
+		if errors.Cause(err) != ErrInstanceLocked {
+			if err == nil {
+				log.Infof("took over from %s", owner)
+			}
+			return l, err
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.Wrapf(err, "daemon did not stop in %v", timeout)
+		}
+		time.Sleep(takeoverPollInterval)
+	}
+}
+
+func (l *instanceLock) setOwner(owner lockOwner) error {
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := l.file.WriteAt([]byte(fmt.Sprintf("%d %s\n", owner.pid, owner.mode)), 0)
+	return err
+}
+
+// Release clears the owner, so that the next instance does not take the
+// lock file for a stale one, and releases the lock.
+func (l *instanceLock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	l.file.Truncate(0)
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
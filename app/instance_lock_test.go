@@ -0,0 +1,141 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstanceLock(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	name := path.Join(tdir, instanceLockName)
+
+	l, err := acquireInstanceLock(tdir, lockModeDaemon)
+	assert.NoError(t, err)
+	data, _ := ioutil.ReadFile(name)
+	assert.Equal(t, fmt.Sprintf("%d daemon\n", os.Getpid()), string(data))
+
+	// second instance
+	_, err = acquireInstanceLock(tdir, lockModeCLI)
+	assert.Equal(t, ErrInstanceLocked, errors.Cause(err))
+	assert.Contains(t, err.Error(), fmt.Sprintf("pid %d (daemon)", os.Getpid()))
+
+	assert.NoError(t, l.Release())
+	assert.NoError(t, l.Release())
+	data, _ = ioutil.ReadFile(name)
+	assert.Empty(t, data)
+
+	l, err = acquireInstanceLock(tdir, lockModeCLI)
+	assert.NoError(t, err)
+	l.Release()
+
+	// holder crashed, leaving its pid behind
+	assert.NoError(t, ioutil.WriteFile(name, []byte("999999999 daemon\n"), 0600))
+	l, err = acquireInstanceLock(tdir, lockModeCLI)
+	assert.NoError(t, err)
+	data, _ = ioutil.ReadFile(name)
+	assert.Equal(t, fmt.Sprintf("%d cli\n", os.Getpid()), string(data))
+	l.Release()
+
+	_, err = acquireInstanceLock(path.Join(tdir, "missing"), lockModeCLI)
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrInstanceLocked, errors.Cause(err))
+}
+
+// Lock held on behalf of child process standing in for another instance;
+// the lock is released once the child is gone.
+func lockForChild(t *testing.T, dataStore, mode string) *exec.Cmd {
+	cmd := exec.Command("sleep", "30")
+	assert.NoError(t, cmd.Start())
+
+	l, err := acquireInstanceLock(dataStore, mode)
+	assert.NoError(t, err)
+	assert.NoError(t, l.setOwner(lockOwner{pid: cmd.Process.Pid, mode: mode}))
+	go func() {
+		cmd.Wait()
+		l.Release()
+	}()
+	return cmd
+}
+
+func TestInstanceLockTakeover(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	// nothing to take over
+	l, err := takeoverInstanceLock(tdir, lockModeCLI, time.Second)
+	assert.NoError(t, err)
+	l.Release()
+
+	// running daemon is stopped
+	lockForChild(t, tdir, lockModeDaemon)
+	l, err = takeoverInstanceLock(tdir, lockModeCLI, 5*time.Second)
+	assert.NoError(t, err)
+	l.Release()
+
+	// CLI operations are not interrupted
+	cli := lockForChild(t, tdir, lockModeCLI)
+	_, err = takeoverInstanceLock(tdir, lockModeCLI, time.Second)
+	assert.Equal(t, ErrInstanceLocked, errors.Cause(err))
+	cli.Process.Kill()
+}
+
+func TestInstanceLockMode(t *testing.T) {
+	for args, mode := range map[string]string{
+		"-daemon":               lockModeDaemon,
+		"-commit":               lockModeCLI,
+		"-rootfs=image":         lockModeCLI,
+		"-bootstrap":            lockModeCLI,
+		"-switch-partition":     lockModeCLI,
+		"-check-state":          lockModeCLI,
+		"-show-history":         "",
+		"-update-channel=beta":  "",
+		"-check-state-snapshot": "",
+	} {
+		if args == "-check-state-snapshot" {
+			args += "=snapshot.json"
+		}
+		opts, err := argsParse([]string{"-no-syslog", args})
+		assert.NoError(t, err)
+		assert.Equal(t, mode, instanceLockMode(opts), args)
+	}
+
+	opts, err := argsParse([]string{"-no-syslog", "-daemon", "-test-loop",
+		"-test-loop-server", "https://test.mender.io"})
+	assert.NoError(t, err)
+	assert.Equal(t, "", instanceLockMode(opts))
+}
+
+func TestDoMainInstanceLocked(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	l, err := acquireInstanceLock(tdir, lockModeDaemon)
+	assert.NoError(t, err)
+	defer l.Release()
+
+	err = DoMain([]string{"-data", tdir, "-config", "../mender.conf.example",
+		"-no-syslog", "-commit"})
+	assert.Equal(t, ErrInstanceLocked, errors.Cause(err))
+}
@@ -0,0 +1,271 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// Persistent update state of the device, as seen right after boot or after
+// a simulated power loss; checked against invariants that must hold no
+// matter when the power was cut.
+type stateSnapshot struct {
+	// nil if no update is in progress
+	StateData *StateData `json:",omitempty"`
+	// mender_boot_part, upgrade_available and bootcount
+	BootEnv BootVars
+	// mounted root filesystem and the other one
+	ActivePartition   string
+	InactivePartition string
+	// currently running artifact
+	ArtifactName string
+	// nil if the marker does not exist
+	UpdateMarker *updateMarker `json:",omitempty"`
+}
+
+// Broken invariant, and the changes making the state consistent again.
+type invariantViolation struct {
+	Rule   string
+	Detail string
+	// bootloader variables to set; nil if none
+	RepairEnv BootVars
+	// update marker state to write; empty if none
+	RepairMarker string
+}
+
+func (v invariantViolation) String() string {
+	return v.Rule + ": " + v.Detail
+}
+
+func (v invariantViolation) repairable() bool {
+	return v.RepairEnv != nil || v.RepairMarker != ""
+}
+
+// states in which the new artifact was not verified to boot yet
+var unverifiedStates = map[MenderState]bool{
+	MenderStateUpdateFetch:           true,
+	MenderStateUpdateInstall:         true,
+	MenderStateFetchInstallRetryWait: true,
+	MenderStateReboot:                true,
+}
+
+func checkInvariants(s stateSnapshot) []invariantViolation {
+	var violations []invariantViolation
+
+	_, activeNum := splitPartitionNumber(s.ActivePartition)
+	_, inactiveNum := splitPartitionNumber(s.InactivePartition)
+	bootPart := s.BootEnv["mender_boot_part"]
+	pending := s.BootEnv["upgrade_available"] == "1"
+
+	// bootloader must always have a partition to boot
+	if bootPart != activeNum && bootPart != inactiveNum {
+		v := invariantViolation{
+			Rule: "boot-partition",
+			Detail: fmt.Sprintf("mender_boot_part %q is neither %s nor %s",
+				bootPart, s.ActivePartition, s.InactivePartition),
+		}
+		if activeNum != "" {
+			v.RepairEnv = BootVars{
+				"mender_boot_part":  activeNum,
+				"upgrade_available": "0",
+				"bootcount":         "0",
+			}
+		}
+		return append(violations, v)
+	}
+
+	// nobody will ever commit, nor roll back, the update
+	if pending && s.StateData == nil {
+		v := invariantViolation{
+			Rule:   "pending-without-state",
+			Detail: "upgrade_available is set, but no update is in progress",
+		}
+		if bootPart == activeNum {
+			// running the new artifact which was never verified; go
+			// back to the previous one
+			v.RepairEnv = BootVars{
+				"mender_boot_part":  inactiveNum,
+				"upgrade_available": "0",
+				"bootcount":         "0",
+			}
+		} else {
+			v.RepairEnv = BootVars{
+				"mender_boot_part":  activeNum,
+				"upgrade_available": "0",
+				"bootcount":         "0",
+			}
+		}
+		violations = append(violations, v)
+	}
+
+	// applications must not be told about committed update which may still
+	// be rolled back
+	if m := s.UpdateMarker; m != nil && m.State == updateMarkerCommitted {
+		if pending {
+			violations = append(violations, invariantViolation{
+				Rule: "committed-unverified",
+				Detail: fmt.Sprintf("update marker of %s is committed, "+
+					"but upgrade_available is set", m.ArtifactName),
+				RepairMarker: updateMarkerUncommitted,
+			})
+		} else if sd := s.StateData; sd != nil &&
+			sd.UpdateInfo.ID == m.DeploymentID && unverifiedStates[sd.Name] {
+			violations = append(violations, invariantViolation{
+				Rule: "committed-unverified",
+				Detail: fmt.Sprintf("update marker of %s is committed, "+
+					"but the update is in %s state", m.ArtifactName, sd.Name),
+				RepairMarker: updateMarkerUncommitted,
+			})
+		}
+	}
+
+	return violations
+}
+
+// Collect the update state of the device.
+func (d *device) snapshotState(store Store, markerFile,
+	artifactName string) (stateSnapshot, error) {
+
+	s := stateSnapshot{ArtifactName: artifactName}
+
+	var err error
+	if s.ActivePartition, err = d.GetActive(); err != nil {
+		return s, err
+	}
+	if s.InactivePartition, err = d.GetInactive(); err != nil {
+		return s, err
+	}
+	if s.BootEnv, err = d.ReadEnv("mender_boot_part", "upgrade_available",
+		"bootcount"); err != nil {
+		return s, err
+	}
+
+	sd, err := LoadStateData(store)
+	switch {
+	case err == nil:
+		s.StateData = &sd
+	case !os.IsNotExist(err):
+		return s, errors.Wrapf(err, "failed to load state data")
+	}
+
+	if markerFile != "" {
+		s.UpdateMarker, err = readUpdateMarker(markerFile)
+		if err != nil && !os.IsNotExist(err) {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// Write the changes fixing `violations`.
+func (d *device) repairState(markerFile string, s stateSnapshot,
+	violations []invariantViolation) error {
+
+	for _, v := range violations {
+		if v.RepairEnv != nil {
+			log.Warnf("repairing %s: setting %v", v.Rule, v.RepairEnv)
+			if err := writeEnvBarrier(d, v.RepairEnv); err != nil {
+				return err
+			}
+		}
+		if v.RepairMarker != "" && s.UpdateMarker != nil {
+			log.Warnf("repairing %s: marking update %s", v.Rule, v.RepairMarker)
+			marker := *s.UpdateMarker
+			marker.State = v.RepairMarker
+			if err := writeUpdateMarker(markerFile, marker); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func printViolations(out io.Writer, violations []invariantViolation) {
+	if isJSONOutput(out) {
+		printViolationsJSON(out, violations)
+		return
+	}
+	if len(violations) == 0 {
+		fmt.Fprintln(out, "update state is consistent")
+		return
+	}
+	for _, v := range violations {
+		fmt.Fprintln(out, v)
+	}
+}
+
+// Check the update state of the device, fixing whatever can be fixed.
+// Returns error if the state is still inconsistent.
+func doCheckState(d *device, dataStore string, out io.Writer) error {
+	dbstore := NewDBStore(dataStore)
+	if dbstore == nil {
+		return errors.New("failed to initialize DB store")
+	}
+	defer dbstore.Close()
+
+	s, err := d.snapshotState(dbstore, defaultUpdateMarkerFile,
+		getManifestData("artifact_name", defaultArtifactInfoFile))
+	if err != nil {
+		return errors.Wrapf(err, "failed to read update state")
+	}
+	if data, err := json.Marshal(s); err == nil {
+		log.Debugf("update state: %s", data)
+	}
+	return checkAndRepairState(d, defaultUpdateMarkerFile, s, out)
+}
+
+func checkAndRepairState(d *device, markerFile string, s stateSnapshot,
+	out io.Writer) error {
+
+	violations := checkInvariants(s)
+	printViolations(out, violations)
+	if err := d.repairState(markerFile, s, violations); err != nil {
+		return errors.Wrapf(err, "failed to repair update state")
+	}
+	for _, v := range violations {
+		if !v.repairable() {
+			return errInconsistentState
+		}
+	}
+	return nil
+}
+
+var errInconsistentState = errors.New("update state is inconsistent")
+
+// Check snapshot of the update state taken elsewhere, e.g. by power loss
+// test rig; nothing is repaired.
+func doCheckStateSnapshot(file string, out io.Writer) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var s stateSnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.Wrapf(err, "failed to parse state snapshot %s", file)
+	}
+
+	violations := checkInvariants(s)
+	printViolations(out, violations)
+	if len(violations) > 0 {
+		return errInconsistentState
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckInvariants(t *testing.T) {
+	env := func(bootPart, pending string) BootVars {
+		return BootVars{
+			"mender_boot_part":  bootPart,
+			"upgrade_available": pending,
+			"bootcount":         "0",
+		}
+	}
+	snapshot := func(e BootVars) stateSnapshot {
+		return stateSnapshot{
+			BootEnv:           e,
+			ActivePartition:   "/dev/mmcblk0p2",
+			InactivePartition: "/dev/mmcblk0p3",
+			ArtifactName:      "release-1",
+		}
+	}
+
+	// idle device
+	assert.Empty(t, checkInvariants(snapshot(env("2", "0"))))
+
+	// partition switched for next boot
+	assert.Empty(t, checkInvariants(snapshot(env("3", "0"))))
+
+	// booted the new artifact, about to commit
+	s := snapshot(env("2", "1"))
+	s.StateData = &StateData{Name: MenderStateReboot,
+		UpdateInfo: makeStateDataUpdate("foo", "release-1")}
+	s.UpdateMarker = &updateMarker{State: updateMarkerUncommitted,
+		ArtifactName: "release-1", DeploymentID: "foo"}
+	assert.Empty(t, checkInvariants(s))
+
+	// nothing to boot
+	v := checkInvariants(snapshot(env("5", "1")))
+	assert.Len(t, v, 1)
+	assert.Equal(t, "boot-partition", v[0].Rule)
+	assert.Equal(t, env("2", "0"), v[0].RepairEnv)
+
+	// running unverified artifact nobody will commit; roll back
+	v = checkInvariants(snapshot(env("2", "1")))
+	assert.Len(t, v, 1)
+	assert.Equal(t, "pending-without-state", v[0].Rule)
+	assert.Equal(t, env("3", "0"), v[0].RepairEnv)
+
+	// new artifact not booted yet; stay with the running one
+	v = checkInvariants(snapshot(env("3", "1")))
+	assert.Len(t, v, 1)
+	assert.Equal(t, env("2", "0"), v[0].RepairEnv)
+
+	// committed, but the bootloader would still roll back
+	s.UpdateMarker.State = updateMarkerCommitted
+	v = checkInvariants(s)
+	assert.Len(t, v, 1)
+	assert.Equal(t, "committed-unverified", v[0].Rule)
+	assert.Equal(t, updateMarkerUncommitted, v[0].RepairMarker)
+
+	// committed before even booting the new artifact
+	s.BootEnv = env("3", "0")
+	s.StateData.Name = MenderStateUpdateInstall
+	v = checkInvariants(s)
+	assert.Len(t, v, 1)
+	assert.Equal(t, "committed-unverified", v[0].Rule)
+
+	// marker of an older deployment
+	s.UpdateMarker.DeploymentID = "bar"
+	assert.Empty(t, checkInvariants(s))
+}
+
+func makeStateDataUpdate(id, name string) client.UpdateResponse {
+	update := client.UpdateResponse{ID: id}
+	update.Artifact.ArtifactName = name
+	return update
+}
+
+func TestCheckAndRepairState(t *testing.T) {
+	oldSync := syncFilesystems
+	defer func() { syncFilesystems = oldSync }()
+
+	tdir, _ := ioutil.TempDir("", "invariants")
+	defer os.RemoveAll(tdir)
+	markerFile := path.Join(tdir, "update_marker")
+
+	env := newCrashingBootEnv(BootVars{
+		"mender_boot_part":  "2",
+		"upgrade_available": "1",
+		"bootcount":         "1",
+	}, -1)
+	syncFilesystems = env.sync
+	dev := &device{
+		BootEnvReadWriter: env,
+		partitions: &partitions{
+			active:   "/dev/mmcblk0p2",
+			inactive: "/dev/mmcblk0p3",
+		},
+	}
+	marker := updateMarker{State: updateMarkerCommitted,
+		ArtifactName: "release-2", DeploymentID: "foo"}
+	assert.NoError(t, writeUpdateMarker(markerFile, marker))
+
+	ms := utils.NewMemStore()
+	s, err := dev.snapshotState(ms, markerFile, "release-2")
+	assert.NoError(t, err)
+	assert.Nil(t, s.StateData)
+	assert.Equal(t, &marker, s.UpdateMarker)
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, checkAndRepairState(dev, markerFile, s, out))
+	assert.Contains(t, out.String(), "pending-without-state")
+	assert.Contains(t, out.String(), "committed-unverified")
+
+	assert.Equal(t, BootVars{
+		"mender_boot_part":  "3",
+		"upgrade_available": "0",
+		"bootcount":         "0",
+	}, env.persisted)
+	m, err := readUpdateMarker(markerFile)
+	assert.NoError(t, err)
+	assert.Equal(t, updateMarkerUncommitted, m.State)
+
+	// consistent now
+	s, err = dev.snapshotState(ms, markerFile, "release-2")
+	assert.NoError(t, err)
+	out.Reset()
+	assert.NoError(t, checkAndRepairState(dev, markerFile, s, out))
+	assert.Equal(t, "update state is consistent\n", out.String())
+
+	// state data is picked up
+	StoreStateData(ms, StateData{Name: MenderStateUpdateCommit})
+	s, err = dev.snapshotState(ms, "", "release-2")
+	assert.NoError(t, err)
+	assert.Equal(t, MenderStateUpdateCommit, s.StateData.Name)
+	assert.Nil(t, s.UpdateMarker)
+}
+
+func TestCheckStateSnapshot(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "invariants")
+	defer os.RemoveAll(tdir)
+	file := path.Join(tdir, "snapshot.json")
+
+	s := stateSnapshot{
+		BootEnv: BootVars{
+			"mender_boot_part":  "2",
+			"upgrade_available": "1",
+		},
+		ActivePartition:   "/dev/sda2",
+		InactivePartition: "/dev/sda3",
+		StateData:         &StateData{Name: MenderStateUpdateCommit},
+	}
+	data, _ := json.Marshal(s)
+	assert.NoError(t, ioutil.WriteFile(file, data, 0644))
+	out := &bytes.Buffer{}
+	assert.NoError(t, doCheckStateSnapshot(file, out))
+
+	s.StateData = nil
+	data, _ = json.Marshal(s)
+	assert.NoError(t, ioutil.WriteFile(file, data, 0644))
+	out.Reset()
+	assert.Equal(t, errInconsistentState, doCheckStateSnapshot(file, out))
+	assert.Contains(t, out.String(), "pending-without-state")
+
+	out.Reset()
+	assert.Equal(t, errInconsistentState, doCheckStateSnapshot(file, &jsonOutput{out}))
+	var result struct {
+		Consistent bool
+		Violations []violationEntry
+	}
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &result))
+	assert.False(t, result.Consistent)
+	assert.Len(t, result.Violations, 1)
+	assert.Equal(t, "pending-without-state", result.Violations[0].Rule)
+	assert.True(t, result.Violations[0].Repairable)
+
+	assert.NoError(t, ioutil.WriteFile(file, []byte("garbage"), 0644))
+	assert.Error(t, doCheckStateSnapshot(file, out))
+
+	err := DoMain([]string{"-check-state", "-switch-partition"})
+	assert.Equal(t, errMsgAmbiguousArgumentsGiven, err)
+}
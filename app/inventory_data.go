@@ -0,0 +1,250 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	inventoryToolPrefix = "mender-inventory-"
+	// lists inventory tools that were killed for not finishing in time
+	inventoryTimedOutAttr = "mender_inventory_timed_out"
+)
+
+var (
+	// default time limit for a single inventory tool
+	inventoryToolTimeout = 30 * time.Second
+	// inventory tools are not expected to produce more than a few lines of
+	// output
+	inventoryToolMaxOutput int64 = 64 * 1024
+)
+
+func NewInventoryDataRunner(scriptsDir string) InventoryDataRunner {
+	return InventoryDataRunner{
+		dir:       scriptsDir,
+		cmd:       &osCalls{},
+		timeout:   inventoryToolTimeout,
+		maxOutput: inventoryToolMaxOutput,
+	}
+}
+
+type InventoryDataRunner struct {
+	dir string
+	cmd Commander
+	// limits applied to each of the tools
+	timeout   time.Duration
+	maxOutput int64
+}
+
+func listRunnable(dpath string) ([]string, error) {
+	finfos, err := ioutil.ReadDir(dpath)
+	if err != nil {
+		// don't care about any FileInfo that were read up to this point
+		return nil, errors.Wrapf(err, "failed to readdir")
+	}
+
+	runnable := []string{}
+	for _, finfo := range finfos {
+		if !strings.HasPrefix(finfo.Name(), inventoryToolPrefix) {
+			continue
+		}
+
+		runBits := os.FileMode(syscall.S_IXUSR | syscall.S_IXGRP | syscall.S_IXOTH)
+		if finfo.Mode()&runBits == 0 {
+			continue
+		}
+
+		runnable = append(runnable, path.Join(dpath, finfo.Name()))
+	}
+
+	return runnable, nil
+}
+
+var errInventoryToolTimeout = errors.New("inventory tool timed out")
+
+// Run all inventory tools concurrently, each limited in time and size of its
+// output. Data of the tools is merged in the order the tools are listed, so
+// that the result does not depend on which tool finished first.
+func (id *InventoryDataRunner) Get() (client.InventoryData, error) {
+	tools, err := listRunnable(id.dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list tools for inventory data")
+	}
+
+	results := make([]map[string][]string, len(tools))
+	errs := make([]error, len(tools))
+
+	var wg sync.WaitGroup
+	for i, t := range tools {
+		wg.Add(1)
+		go func(i int, t string) {
+			defer wg.Done()
+			results[i], errs[i] = id.runTool(t)
+		}(i, t)
+	}
+	wg.Wait()
+
+	idec := NewInventoryDataDecoder()
+	var timedOut, rejected []string
+	for i, t := range tools {
+		if errs[i] == errInventoryToolTimeout {
+			log.Errorf("inventory tool %s did not finish within %v, killed",
+				t, id.timeout)
+			timedOut = append(timedOut, path.Base(t))
+			continue
+		} else if errs[i] != nil {
+			log.Errorf("inventory tool %s failed: %v", t, errs[i])
+			continue
+		}
+		// tools must not spoof attributes of the client
+		for name, value := range results[i] {
+			if err := checkInventoryAttr(name, value); err != nil {
+				log.Errorf("inventory tool %s: %v", t, err)
+				delete(results[i], name)
+				rejected = append(rejected, name)
+			}
+		}
+		idec.AppendFromRaw(results[i])
+	}
+	if len(timedOut) > 0 {
+		idec.AppendFromRaw(map[string][]string{inventoryTimedOutAttr: timedOut})
+	}
+	if len(rejected) > 0 {
+		idec.AppendFromRaw(map[string][]string{inventoryRejectedAttr: rejected})
+	}
+	return idec.GetInventoryData(), nil
+}
+
+type toolOutput struct {
+	data []byte
+	err  error
+}
+
+func (id *InventoryDataRunner) runTool(t string) (map[string][]string, error) {
+	cmd := id.cmd.Command(t)
+	// tools are often scripts; their children must go away with them
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open stdout")
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "failed to start")
+	}
+
+	outc := make(chan toolOutput, 1)
+	go func() {
+		// read one byte over the limit to tell if the output was too large
+		data, err := ioutil.ReadAll(io.LimitReader(out, id.maxOutput+1))
+		if err == nil && int64(len(data)) > id.maxOutput {
+			killToolGroup(cmd)
+			err = errors.Errorf("output exceeds %d bytes", id.maxOutput)
+		}
+		if werr := cmd.Wait(); werr != nil && err == nil {
+			log.Warnf("inventory tool %s wait failed: %v", t, werr)
+		}
+		outc <- toolOutput{data, err}
+	}()
+
+	var res toolOutput
+	select {
+	case res = <-outc:
+	case <-time.After(id.timeout):
+		// the goroutine collecting output finishes once the tool is gone
+		killToolGroup(cmd)
+		return nil, errInventoryToolTimeout
+	}
+
+	if res.err != nil {
+		return nil, res.err
+	}
+
+	p := utils.KeyValParser{}
+	if err := p.Parse(bytes.NewReader(res.data)); err != nil {
+		return nil, errors.Wrapf(err, "unparsable output")
+	}
+	return p.Collect(), nil
+}
+
+func killToolGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+type InventoryDataDecoder struct {
+	data map[string]client.InventoryAttribute
+}
+
+func NewInventoryDataDecoder() *InventoryDataDecoder {
+	return &InventoryDataDecoder{
+		make(map[string]client.InventoryAttribute),
+	}
+}
+
+func (id *InventoryDataDecoder) GetInventoryData() client.InventoryData {
+	if len(id.data) == 0 {
+		return nil
+	}
+	idata := make(client.InventoryData, 0, len(id.data))
+	for _, v := range id.data {
+		idata = append(idata, v)
+	}
+	return idata
+}
+
+func (id *InventoryDataDecoder) AppendFromRaw(raw map[string][]string) {
+	for k, v := range raw {
+		if data, ok := id.data[k]; ok {
+			var newVal []string
+			switch data.Value.(type) {
+			case string:
+				newVal = []string{data.Value.(string)}
+			case []string:
+				newVal = data.Value.([]string)
+			}
+			newVal = append(newVal, v...)
+			id.data[k] = client.InventoryAttribute{
+				Name:  k,
+				Value: newVal,
+			}
+		} else {
+			if len(v) == 1 {
+				id.data[k] = client.InventoryAttribute{
+					Name:  k,
+					Value: v[0],
+				}
+			} else {
+				id.data[k] = client.InventoryAttribute{
+					Name:  k,
+					Value: v,
+				}
+			}
+		}
+	}
+}
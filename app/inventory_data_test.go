@@ -0,0 +1,169 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInventoryDataDecoder(t *testing.T) {
+
+	idec := NewInventoryDataDecoder()
+	assert.NotNil(t, idec)
+
+	idec.AppendFromRaw(map[string][]string{
+		"foo": []string{"bar"},
+	})
+
+	assert.Contains(t, idec.GetInventoryData(), client.InventoryAttribute{"foo", "bar"})
+
+	idec.AppendFromRaw(map[string][]string{
+		"foo": []string{"baz"},
+	})
+	assert.Contains(t, idec.data, "foo")
+	assert.Contains(t, idec.GetInventoryData(),
+		client.InventoryAttribute{"foo", []string{"bar", "baz"}})
+
+	idec.AppendFromRaw(map[string][]string{
+		"bar": []string{"zen"},
+	})
+	assert.Contains(t, idec.GetInventoryData(),
+		client.InventoryAttribute{"foo", []string{"bar", "baz"}})
+	assert.Contains(t, idec.GetInventoryData(), client.InventoryAttribute{"bar", "zen"})
+
+	idata := idec.GetInventoryData()
+	assert.Len(t, idata, 2)
+	assert.Contains(t, idata, client.InventoryAttribute{"foo", []string{"bar", "baz"}})
+	assert.Contains(t, idata, client.InventoryAttribute{"bar", "zen"})
+}
+
+func TestInventoryDataRunner(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "inventorytest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	// forks, so that killing just the shell would leave sleep running
+	hung := "echo hung=yes\nsleep 10 &\necho $! > " + path.Join(tdir, "hung.pid") +
+		"\nwait\n"
+	tools := map[string]string{
+		"mender-inventory-foo":   "echo foo=bar\necho foo=baz\n",
+		"mender-inventory-bar":   "echo bar=zen\n",
+		"mender-inventory-hung":  hung,
+		"mender-inventory-large": "while true; do echo large=aaaaaaaaaaaaaaaa; done\n",
+		"not-inventory-tool":     "echo ignored=true\n",
+	}
+	for name, script := range tools {
+		err := ioutil.WriteFile(path.Join(tdir, name),
+			[]byte("#!/bin/sh\n"+script), 0755)
+		assert.NoError(t, err)
+	}
+
+	runner := NewInventoryDataRunner(tdir)
+	runner.timeout = 500 * time.Millisecond
+	runner.maxOutput = 1024
+
+	start := time.Now()
+	idata, err := runner.Get()
+	assert.NoError(t, err)
+	// tools run concurrently, the hung one does not hold up the others
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	assert.Len(t, idata, 3)
+	assert.Contains(t, idata, client.InventoryAttribute{Name: "foo",
+		Value: []string{"bar", "baz"}})
+	assert.Contains(t, idata, client.InventoryAttribute{Name: "bar", Value: "zen"})
+	assert.Contains(t, idata, client.InventoryAttribute{Name: inventoryTimedOutAttr,
+		Value: "mender-inventory-hung"})
+
+	// children of the hung tool are killed with it
+	data, err := ioutil.ReadFile(path.Join(tdir, "hung.pid"))
+	assert.NoError(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	assert.NoError(t, err)
+	gone := false
+	for i := 0; i < 100 && !gone; i++ {
+		gone = processGone(pid)
+		if !gone {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	assert.True(t, gone)
+}
+
+// Process does not exist, or is dead and waits to be reaped.
+func processGone(pid int) bool {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return syscall.Kill(pid, 0) == syscall.ESRCH
+	}
+	// pid (comm) state ...
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func TestInventoryToolReservedAttributes(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "inventorytest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	err = ioutil.WriteFile(path.Join(tdir, "mender-inventory-rogue"),
+		[]byte("#!/bin/sh\necho artifact_name=release-9\n"+
+			"echo mender_client/version=9.0\necho os=linux\n"), 0755)
+	assert.NoError(t, err)
+
+	runner := NewInventoryDataRunner(tdir)
+	idata, err := runner.Get()
+	assert.NoError(t, err)
+
+	assert.Len(t, idata, 2)
+	assert.Contains(t, idata, client.InventoryAttribute{Name: "os", Value: "linux"})
+	rejected := findInventoryAttr(idata, inventoryRejectedAttr)
+	if assert.NotNil(t, rejected) {
+		names := rejected.Value.([]string)
+		sort.Strings(names)
+		assert.Equal(t, []string{"artifact_name", "mender_client/version"}, names)
+	}
+}
+
+func TestCheckInventoryAttr(t *testing.T) {
+	assert.NoError(t, checkInventoryAttr("os", "linux"))
+	assert.NoError(t, checkInventoryAttr("ipv4", []string{"10.0.0.1", "10.0.0.2"}))
+	assert.Error(t, checkInventoryAttr("", "linux"))
+	assert.Error(t, checkInventoryAttr("device_type", "raspberrypi4"))
+	assert.Error(t, checkInventoryAttr("mender_client/foo", "bar"))
+	assert.Error(t, checkInventoryAttr("uptime", 42))
+	assert.Error(t, checkInventoryAttr("nested", map[string]string{"a": "b"}))
+}
+
+func findInventoryAttr(idata client.InventoryData, name string) *client.InventoryAttribute {
+	for i := range idata {
+		if idata[i].Name == name {
+			return &idata[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// namespace of attributes the client may add in the future; reserved,
+	// like the names of attributes it reports already
+	clientInventoryNamespace = "mender_client/"
+	// lists attributes of inventory tools which were rejected
+	inventoryRejectedAttr = clientInventoryNamespace + "rejected_attributes"
+)
+
+// Attributes reported by the client itself; the server checks compatibility
+// of deployments with device_type and artifact_name, so none of them can be
+// set by inventory tools or sources.
+var clientInventoryAttrs = map[string]bool{
+	"device_type":                true,
+	"artifact_name":              true,
+	"app_artifact_name":          true,
+	"update_channel":             true,
+	"mender_client_version":      true,
+	"mender_state_loop_detected": true,
+	"mender_quarantined":         true,
+	"mender_cert_expiry_warning": true,
+	"mender_install_history":     true,
+	"mender_tpm_pcr":             true,
+	"mender_tpm_artifact_digest": true,
+	"mender_tpm_quote":           true,
+	inventoryTimedOutAttr:        true,
+}
+
+func isClientInventoryAttr(name string) bool {
+	return clientInventoryAttrs[name] ||
+		strings.HasPrefix(name, clientInventoryNamespace)
+}
+
+// Check attribute of inventory tool or source: its name must not be one
+// of the client, and its value a string or list of strings.
+func checkInventoryAttr(name string, value interface{}) error {
+	if name == "" {
+		return errors.New("inventory attribute with empty name")
+	}
+	if isClientInventoryAttr(name) {
+		return errors.Errorf("inventory attribute %s is reserved for the client", name)
+	}
+	switch value.(type) {
+	case string, []string:
+		return nil
+	}
+	return errors.Errorf("inventory attribute %s has value of type %T, "+
+		"expected string or list of strings", name, value)
+}
@@ -0,0 +1,95 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/mendersoftware/log"
+)
+
+// States during which inventory is submitted by a background task, as the
+// state machine does not pass through InventoryUpdateState while a
+// deployment is being downloaded or installed.
+var backgroundInventoryStates = map[MenderState]bool{
+	MenderStateUpdateFetch:           true,
+	MenderStateUpdateInstall:         true,
+	MenderStateFetchInstallRetryWait: true,
+}
+
+// Inventory as of the start of the deployment, and where to submit it to.
+type inventorySnapshot struct {
+	interval time.Duration
+	submit   func(ctx context.Context) error
+}
+
+type backgroundInventory struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	// time of the last submission, owned by the task until done is closed
+	last time.Time
+}
+
+// startBackgroundInventory submits inventory every inventory poll interval,
+// counting from last, until stopped or parent is cancelled. Must be called by
+// the state machine goroutine.
+func startBackgroundInventory(parent context.Context, c Controller,
+	last time.Time) *backgroundInventory {
+	snapshot := c.InventorySnapshot()
+
+	ctx, cancel := context.WithCancel(parent)
+	bi := &backgroundInventory{
+		cancel: cancel,
+		done:   make(chan struct{}),
+		last:   last,
+	}
+	go bi.run(ctx, snapshot)
+	return bi
+}
+
+func (bi *backgroundInventory) run(ctx context.Context, inv inventorySnapshot) {
+	defer close(bi.done)
+	for {
+		wait := time.Until(bi.last.Add(inv.interval))
+		if wait < 0 {
+			wait = 0
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		bi.last = time.Now()
+		if err := inv.submit(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Warnf("failed to refresh inventory in background: %v", err)
+		} else {
+			log.Debugf("background inventory refresh complete")
+		}
+	}
+}
+
+// stop cancels the task and waits for it to finish; returns time of the last
+// submission attempt.
+func (bi *backgroundInventory) stop() time.Time {
+	bi.cancel()
+	<-bi.done
+	return bi.last
+}
@@ -0,0 +1,98 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+)
+
+type inventoryTaskController struct {
+	stateTestController
+	submitted int32
+}
+
+func (c *inventoryTaskController) InventorySnapshot() inventorySnapshot {
+	return inventorySnapshot{
+		interval: c.pollIntvl,
+		submit: func(ctx context.Context) error {
+			atomic.AddInt32(&c.submitted, 1)
+			return errors.New("inventory failed")
+		},
+	}
+}
+
+func TestBackgroundInventory(t *testing.T) {
+	c := &inventoryTaskController{
+		stateTestController: stateTestController{pollIntvl: 10 * time.Millisecond},
+	}
+
+	// last submission is overdue, first one goes out right away; failures
+	// do not stop the task
+	start := time.Now()
+	bi := startBackgroundInventory(context.Background(), c, time.Time{})
+	time.Sleep(100 * time.Millisecond)
+	last := bi.stop()
+	assert.True(t, atomic.LoadInt32(&c.submitted) > 1)
+	assert.True(t, last.After(start))
+
+	// no submissions once stopped
+	n := atomic.LoadInt32(&c.submitted)
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, n, atomic.LoadInt32(&c.submitted))
+
+	// not due yet
+	c.pollIntvl = time.Hour
+	bi = startBackgroundInventory(context.Background(), c, time.Now())
+	time.Sleep(20 * time.Millisecond)
+	bi.stop()
+	assert.Equal(t, n, atomic.LoadInt32(&c.submitted))
+
+	// cancelled with the parent context
+	ctx, cancel := context.WithCancel(context.Background())
+	bi = startBackgroundInventory(ctx, c, time.Now())
+	cancel()
+	select {
+	case <-bi.done:
+	case <-time.After(time.Second):
+		t.Fatal("background inventory not stopped with the daemon")
+	}
+}
+
+func TestDaemonScheduleInventory(t *testing.T) {
+	c := &inventoryTaskController{
+		stateTestController: stateTestController{pollIntvl: 10 * time.Millisecond},
+	}
+	d := NewDaemon(c, nil)
+	update := client.UpdateResponse{ID: "foo"}
+
+	d.scheduleInventory(NewUpdateFetchState(update))
+	assert.NotNil(t, d.inventory)
+	bi := d.inventory
+	d.scheduleInventory(NewUpdateInstallState(nil, 0, update))
+	assert.Equal(t, bi, d.inventory)
+	time.Sleep(50 * time.Millisecond)
+
+	// deployment is over, daemon takes over time of the last submission
+	d.scheduleInventory(checkWaitState)
+	assert.Nil(t, d.inventory)
+	assert.True(t, atomic.LoadInt32(&c.submitted) > 0)
+	assert.False(t, d.sctx.lastInventoryUpdate.IsZero())
+}
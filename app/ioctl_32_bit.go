@@ -14,7 +14,7 @@
 
 // +build arm 386
 
-package main
+package app
 
 // Taken from <sys/mount.h>
 const BLKGETSIZE64 ioctlRequestValue = 0x80041272
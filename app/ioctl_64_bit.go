@@ -14,7 +14,7 @@
 
 // +build amd64
 
-package main
+package app
 
 // Taken from <sys/mount.h>
 const BLKGETSIZE64 ioctlRequestValue = 0x80081272
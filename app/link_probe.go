@@ -0,0 +1,78 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+)
+
+const (
+	// enough to get past TCP slow start on most links, little enough not
+	// to matter on metered ones
+	linkProbeSize    = 256 * 1024
+	linkProbeTimeout = 10 * time.Second
+)
+
+var (
+	// the link is probed again only after the interval, not with every
+	// update check
+	linkProbeInterval = time.Hour
+)
+
+// Probes latency and download speed of the link to the artifact host
+// (LinkProbeURL) for the capability hints of update checks, so that the
+// server can prefer delta artifacts on slow links and full images on fast
+// ones.
+type linkProber struct {
+	url    string
+	last   time.Time
+	result client.LinkProbe
+}
+
+func newLinkProber(config MenderConfig) *linkProber {
+	if config.LinkProbeURL == "" || !config.ReportDeviceCapabilities {
+		return nil
+	}
+	return &linkProber{url: config.LinkProbeURL}
+}
+
+// Result of the last probe, probing again if it is too old. Failed probe
+// gives empty result, not to be reported.
+func (m *mender) probeLink(ctx context.Context) client.LinkProbe {
+	p := m.linkProber
+	if p == nil {
+		return client.LinkProbe{}
+	}
+	if !p.last.IsZero() && time.Since(p.last) < linkProbeInterval {
+		return p.result
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, linkProbeTimeout)
+	defer cancel()
+	result, err := client.ProbeLink(ctx, m.downloadAPI, p.url, linkProbeSize)
+	if err != nil {
+		log.Warnf("failed to probe link to artifact host: %v", err)
+		result = client.LinkProbe{}
+	} else {
+		log.Debugf("link to artifact host: latency %d ms, %d bytes/s",
+			result.LatencyMs, result.Speed)
+	}
+	p.last = time.Now()
+	p.result = result
+	return result
+}
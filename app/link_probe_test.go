@@ -0,0 +1,68 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinkProbe(t *testing.T) {
+	probes := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes++
+		http.ServeContent(w, r, "probe", time.Time{},
+			bytes.NewReader(make([]byte, linkProbeSize)))
+	}))
+	defer ts.Close()
+
+	// probe only goes with capability hints
+	mender := newTestMender(nil, MenderConfig{LinkProbeURL: ts.URL},
+		testMenderPieces{})
+	assert.Nil(t, mender.linkProber)
+	assert.Nil(t, mender.currentUpdate(context.Background()).Capabilities)
+
+	mender = newTestMender(nil, MenderConfig{
+		LinkProbeURL:             ts.URL,
+		ReportDeviceCapabilities: true,
+	}, testMenderPieces{})
+	caps := mender.currentUpdate(context.Background()).Capabilities
+	assert.Equal(t, 1, probes)
+	if assert.NotNil(t, caps) {
+		assert.True(t, caps.ProbeSpeed > 0)
+	}
+
+	// not probed with every update check
+	mender.currentUpdate(context.Background())
+	assert.Equal(t, 1, probes)
+
+	defer func(old time.Duration) {
+		linkProbeInterval = old
+	}(linkProbeInterval)
+	linkProbeInterval = 0
+	mender.currentUpdate(context.Background())
+	assert.Equal(t, 2, probes)
+
+	// failed probe is not reported
+	ts.Close()
+	caps = mender.currentUpdate(context.Background()).Capabilities
+	assert.Equal(t, int64(0), caps.ProbeSpeed)
+	assert.Equal(t, int64(0), caps.ProbeLatencyMs)
+}
@@ -0,0 +1,129 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"log/syslog"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mendersoftware/log"
+
+	logrus_syslog "github.com/Sirupsen/logrus/hooks/syslog"
+)
+
+// Hooks of the log (deployment log, log ring, syslog) are kept here rather
+// than in the log package, which passes its hooks the module of messages
+// only; messages logged with logWithFields() reach these hooks with their
+// fields. The set is added to the log package as a single hook, so that
+// other messages reach the hooks the usual way.
+type logHookSet struct {
+	lock  sync.RWMutex
+	hooks logrus.LevelHooks
+	// modules logged, all if empty; the log package filters other messages
+	modules []string
+}
+
+var (
+	logHooks        = &logHookSet{hooks: make(logrus.LevelHooks)}
+	logHooksAddOnce sync.Once
+)
+
+// addLogHook adds hook getting messages of its levels, whatever the level of
+// the log is.
+func addLogHook(hook logrus.Hook) {
+	logHooksAddOnce.Do(func() {
+		log.AddHook(logHooks)
+	})
+	logHooks.lock.Lock()
+	defer logHooks.lock.Unlock()
+	logHooks.hooks.Add(hook)
+}
+
+// setLogModuleFilter makes only messages of the modules logged.
+func setLogModuleFilter(modules []string) {
+	log.SetModuleFilter(modules)
+	logHooks.lock.Lock()
+	defer logHooks.lock.Unlock()
+	logHooks.modules = modules
+}
+
+func (s *logHookSet) logsModule(module string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if len(s.modules) == 0 {
+		return true
+	}
+	for _, m := range s.modules {
+		if m == module {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *logHookSet) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel,
+		logrus.FatalLevel,
+		logrus.ErrorLevel,
+		logrus.WarnLevel,
+		logrus.InfoLevel,
+		logrus.DebugLevel}
+}
+
+func (s *logHookSet) Fire(entry *logrus.Entry) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.hooks.Fire(entry.Level, entry)
+}
+
+// Messages are passed to syslog through a logger of its own, formatting them
+// without colors and timestamps; logrus colors output of any logger not
+// writing to a terminal.
+type syslogHook struct {
+	hook   *logrus_syslog.SyslogHook
+	logger *logrus.Logger
+}
+
+// addSyslogHook makes messages logged to syslog as well, debug messages
+// excepted.
+func addSyslogHook() error {
+	hook, err := logrus_syslog.NewSyslogHook("", "", syslog.LOG_DEBUG, "mender")
+	if err != nil {
+		return err
+	}
+	logger := logrus.New()
+	logger.Formatter = &logrus.TextFormatter{
+		DisableColors:    true,
+		DisableTimestamp: true,
+	}
+	addLogHook(&syslogHook{hook: hook, logger: logger})
+	return nil
+}
+
+func (h *syslogHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel,
+		logrus.FatalLevel,
+		logrus.ErrorLevel,
+		logrus.WarnLevel,
+		logrus.InfoLevel}
+}
+
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	copy := *entry
+	copy.Logger = h.logger
+	// syslog being unavailable must not fail the other hooks
+	h.hook.Fire(&copy)
+	return nil
+}
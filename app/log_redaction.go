@@ -0,0 +1,86 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"regexp"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const redactedValue = "<redacted>"
+
+// Removes sensitive data from deployment log entries before these are
+// stored, and later uploaded, according to the rules from configuration.
+type logRedactor struct {
+	// matches are replaced as a whole
+	patterns []*regexp.Regexp
+	// `key=value` and `"key": "value"` pairs in messages; only the value
+	// is replaced
+	keyPatterns []*regexp.Regexp
+	// structured fields whose values are replaced
+	keys map[string]bool
+}
+
+// Returns nil redactor if there is nothing to redact.
+func newLogRedactor(patterns, keys []string) (*logRedactor, error) {
+	if len(patterns) == 0 && len(keys) == 0 {
+		return nil, nil
+	}
+
+	r := &logRedactor{keys: make(map[string]bool, len(keys))}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid log redaction pattern %q", p)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	for _, k := range keys {
+		if k == "" {
+			continue
+		}
+		r.keys[k] = true
+		r.keyPatterns = append(r.keyPatterns, regexp.MustCompile(
+			`(?i)("?\b`+regexp.QuoteMeta(k)+`\b"?\s*[:=]\s*"?)[^\s"&,;]+`))
+	}
+	return r, nil
+}
+
+func (r *logRedactor) redact(s string) string {
+	if r == nil {
+		return s
+	}
+	for _, re := range r.patterns {
+		s = re.ReplaceAllLiteralString(s, redactedValue)
+	}
+	for _, re := range r.keyPatterns {
+		s = re.ReplaceAllString(s, "${1}"+redactedValue)
+	}
+	return s
+}
+
+func (r *logRedactor) redactFields(fields logrus.Fields) {
+	if r == nil {
+		return
+	}
+	for k, v := range fields {
+		if r.keys[k] {
+			fields[k] = redactedValue
+		} else if s, ok := v.(string); ok {
+			fields[k] = r.redact(s)
+		}
+	}
+}
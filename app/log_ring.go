@@ -0,0 +1,282 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Last lines logged by the daemon are kept in a memory mapped file in the
+// data store, so that they survive crashes and reboots; unlike deployment
+// logs, they cover the time before and between deployments as well. Shown
+// with -show-log.
+const logRingFile = "daemon.logring"
+
+const (
+	defaultLogRingSizeKB = 512
+	logRingMagic         = "MLOGRING"
+	logRingVersion       = 1
+	// magic, version, reserved, capacity, bytes written in total
+	logRingHeaderSize = 8 + 4 + 4 + 8 + 8
+)
+
+// Size of the log ring configured; 0 if disabled.
+func logRingSize(config MenderConfig) int {
+	switch {
+	case config.LogRingBufferSizeKB < 0:
+		return 0
+	case config.LogRingBufferSizeKB == 0:
+		return defaultLogRingSizeKB * 1024
+	}
+	return config.LogRingBufferSizeKB * 1024
+}
+
+type logRing struct {
+	lock sync.Mutex
+	file *os.File
+	// whole file: header followed by data
+	mem  []byte
+	data []byte
+}
+
+// Open the log ring file, creating it if there is none; lines of file of
+// different size are discarded.
+func openLogRing(name string, size int) (*logRing, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open log ring")
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "failed to open log ring")
+	}
+	total := logRingHeaderSize + size
+	fresh := fi.Size() != int64(total)
+	if fresh {
+		if err := f.Truncate(0); err == nil {
+			err = f.Truncate(int64(total))
+		}
+		if err != nil {
+			f.Close()
+			return nil, errors.Wrapf(err, "failed to size log ring")
+		}
+	}
+
+	mem, err := unix.Mmap(int(f.Fd()), 0, total, unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_SHARED)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "failed to map log ring")
+	}
+	r := &logRing{file: f, mem: mem, data: mem[logRingHeaderSize:]}
+	if fresh || !r.valid() {
+		r.reset()
+	}
+	return r, nil
+}
+
+func (r *logRing) valid() bool {
+	return string(r.mem[0:8]) == logRingMagic &&
+		binary.LittleEndian.Uint32(r.mem[8:12]) == logRingVersion &&
+		binary.LittleEndian.Uint64(r.mem[16:24]) == uint64(len(r.data))
+}
+
+func (r *logRing) reset() {
+	for i := range r.mem {
+		r.mem[i] = 0
+	}
+	copy(r.mem[0:8], logRingMagic)
+	binary.LittleEndian.PutUint32(r.mem[8:12], logRingVersion)
+	binary.LittleEndian.PutUint64(r.mem[16:24], uint64(len(r.data)))
+}
+
+// Append the line, overwriting the oldest ones once the ring is full.
+func (r *logRing) write(line []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	size := uint64(len(r.data))
+	written := binary.LittleEndian.Uint64(r.mem[24:32])
+	if uint64(len(line)) > size {
+		line = line[uint64(len(line))-size:]
+	}
+	off := written % size
+	n := copy(r.data[off:], line)
+	copy(r.data, line[n:])
+	// counter is updated last, so that lines interrupted by crash are
+	// overwritten by the next ones
+	binary.LittleEndian.PutUint64(r.mem[24:32], written+uint64(len(line)))
+}
+
+// Flush the ring to the disk.
+func (r *logRing) sync() error {
+	return r.file.Sync()
+}
+
+func (r *logRing) close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	err := unix.Munmap(r.mem)
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Lines of the log ring file, the oldest first.
+func readLogRing(name string) ([]string, error) {
+	mem, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(mem) < logRingHeaderSize || string(mem[0:8]) != logRingMagic {
+		return nil, errors.Errorf("%s is not a log ring", name)
+	}
+	if v := binary.LittleEndian.Uint32(mem[8:12]); v != logRingVersion {
+		return nil, errors.Errorf("unsupported log ring version %d", v)
+	}
+	data := mem[logRingHeaderSize:]
+	size := binary.LittleEndian.Uint64(mem[16:24])
+	if size != uint64(len(data)) || size == 0 {
+		return nil, errors.Errorf("broken log ring %s", name)
+	}
+
+	written := binary.LittleEndian.Uint64(mem[24:32])
+	var buf []byte
+	if written <= size {
+		buf = data[:written]
+	} else {
+		off := written % size
+		buf = append(append([]byte{}, data[off:]...), data[:off]...)
+		// the oldest line was partially overwritten
+		if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+			buf = buf[i+1:]
+		}
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// Hook logging daemon log entries to the ring.
+type logRingHook struct {
+	ring     *logRing
+	redactor *logRedactor
+}
+
+func (h *logRingHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel,
+		logrus.FatalLevel,
+		logrus.ErrorLevel,
+		logrus.WarnLevel,
+		logrus.InfoLevel,
+		logrus.DebugLevel}
+}
+
+func (h *logRingHook) Fire(entry *logrus.Entry) error {
+	var line bytes.Buffer
+	fmt.Fprintf(&line, "%s %s %s", entry.Time.UTC().Format("2006-01-02T15:04:05.000Z"),
+		strings.ToUpper(entry.Level.String()), h.redactor.redact(entry.Message))
+
+	fields := make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		fields[k] = v
+	}
+	h.redactor.redactFields(fields)
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&line, " %s=%v", k, fields[k])
+	}
+	// one entry per line
+	msg := bytes.Replace(line.Bytes(), []byte("\n"), []byte(" "), -1)
+	h.ring.write(append(msg, '\n'))
+
+	if entry.Level <= logrus.ErrorLevel {
+		// keep what led to the error even if power is lost right after
+		return h.ring.sync()
+	}
+	return nil
+}
+
+var (
+	// log ring of the process; the hook stays installed, and the ring
+	// mapped, until the process exits
+	activeLogRing     *logRing
+	activeLogRingLock sync.Mutex
+)
+
+// Start logging to the log ring in the data store, if enabled and not
+// started already.
+func startLogRing(config MenderConfig, dataStore string, redactor *logRedactor) {
+	size := logRingSize(config)
+	if size == 0 {
+		return
+	}
+	activeLogRingLock.Lock()
+	defer activeLogRingLock.Unlock()
+	if activeLogRing != nil {
+		return
+	}
+	ring, err := openLogRing(path.Join(dataStore, logRingFile), size)
+	if err != nil {
+		log.Warnf("daemon log is not kept in the data store: %v", err)
+		return
+	}
+	addLogHook(&logRingHook{ring: ring, redactor: redactor})
+	activeLogRing = ring
+}
+
+func doShowLog(dataStore string, out io.Writer) error {
+	lines, err := readLogRing(path.Join(dataStore, logRingFile))
+	if os.IsNotExist(err) {
+		return errors.New("no daemon log kept in the data store")
+	} else if err != nil {
+		return err
+	}
+	if isJSONOutput(out) {
+		if lines == nil {
+			lines = []string{}
+		}
+		printJSON(out, lines)
+		return nil
+	}
+	for _, line := range lines {
+		fmt.Fprintln(out, line)
+	}
+	return nil
+}
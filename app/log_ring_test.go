@@ -0,0 +1,136 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogRing(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "logring")
+	defer os.RemoveAll(tdir)
+	name := path.Join(tdir, logRingFile)
+
+	ring, err := openLogRing(name, 64)
+	assert.NoError(t, err)
+	lines, err := readLogRing(name)
+	assert.NoError(t, err)
+	assert.Empty(t, lines)
+
+	ring.write([]byte("first line\n"))
+	ring.write([]byte("second line\n"))
+	lines, err = readLogRing(name)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first line", "second line"}, lines)
+
+	// wraps around, dropping the oldest lines
+	for i := 0; i < 10; i++ {
+		ring.write([]byte(fmt.Sprintf("line %d\n", i)))
+	}
+	lines, err = readLogRing(name)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"line 1", "line 2", "line 3", "line 4", "line 5",
+		"line 6", "line 7", "line 8", "line 9"}, lines)
+	assert.NoError(t, ring.close())
+
+	// kept when reopened...
+	ring, err = openLogRing(name, 64)
+	assert.NoError(t, err)
+	ring.write([]byte("line 10\n"))
+	lines, _ = readLogRing(name)
+	assert.Equal(t, "line 10", lines[len(lines)-1])
+	assert.Equal(t, "line 3", lines[0])
+	assert.NoError(t, ring.close())
+
+	// ...but not when resized
+	ring, err = openLogRing(name, 128)
+	assert.NoError(t, err)
+	lines, _ = readLogRing(name)
+	assert.Empty(t, lines)
+	assert.NoError(t, ring.close())
+
+	ioutil.WriteFile(name, []byte("garbage"), 0600)
+	_, err = readLogRing(name)
+	assert.Error(t, err)
+}
+
+func TestLogRingSize(t *testing.T) {
+	assert.Equal(t, defaultLogRingSizeKB*1024, logRingSize(MenderConfig{}))
+	assert.Equal(t, 4096, logRingSize(MenderConfig{LogRingBufferSizeKB: 4}))
+	assert.Equal(t, 0, logRingSize(MenderConfig{LogRingBufferSizeKB: -1}))
+}
+
+func TestLogRingHook(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "logring")
+	defer os.RemoveAll(tdir)
+
+	ring, err := openLogRing(path.Join(tdir, logRingFile), 4096)
+	assert.NoError(t, err)
+	defer ring.close()
+	redactor, err := newLogRedactor(nil, []string{"token"})
+	assert.NoError(t, err)
+	hook := &logRingHook{ring: ring, redactor: redactor}
+
+	when := time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)
+	assert.NoError(t, hook.Fire(&logrus.Entry{
+		Time:    when,
+		Level:   logrus.InfoLevel,
+		Message: "authorized\nwith token=secret",
+		Data:    logrus.Fields{"token": "secret", "attempt": 2},
+	}))
+	assert.NoError(t, hook.Fire(&logrus.Entry{
+		Time:    when,
+		Level:   logrus.ErrorLevel,
+		Message: "update failed",
+		Data:    logrus.Fields{},
+	}))
+
+	out := bytes.NewBuffer(nil)
+	assert.NoError(t, doShowLog(tdir, out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Equal(t, "2017-03-01T10:00:00.000Z INFO authorized with token="+
+		redactedValue+" attempt=2 token="+redactedValue, lines[0])
+	assert.Equal(t, "2017-03-01T10:00:00.000Z ERROR update failed", lines[1])
+
+	out.Reset()
+	assert.NoError(t, doShowLog(tdir, &jsonOutput{out}))
+	var shown []string
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &shown))
+	assert.Equal(t, lines, shown)
+}
+
+func TestShowLogCommand(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "logring")
+	defer os.RemoveAll(tdir)
+
+	assert.Error(t, doShowLog(tdir, bytes.NewBuffer(nil)))
+
+	opts, err := argsParse([]string{"-no-syslog", "-show-log"})
+	assert.NoError(t, err)
+	assert.True(t, *opts.showLog)
+	_, err = argsParse([]string{"-no-syslog", "-show-log", "-daemon"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"os"
+	"time"
+
+	"github.com/mendersoftware/log"
+)
+
+// holds time when state loop was detected; present until the state machine
+// gets back to regular operation
+const stateLoopName = "state-loop-detected"
+
+var (
+	// number of state transitions within stateLoopWindow that is considered
+	// a loop; regular operation never gets anywhere close
+	maxStateTransitions = 100
+	stateLoopWindow     = time.Minute
+	// how long to wait after a loop was detected, before starting over
+	stateLoopBackoff = 30 * time.Minute
+)
+
+// States of a deployment in progress. The state machine is not sent to back
+// off in any of them, as that would drop the deployment without reporting
+// its status; it backs off once the deployment is over.
+var deploymentStates = map[MenderState]bool{
+	MenderStateUpdateFetch:           true,
+	MenderStateFetchInstallRetryWait: true,
+	MenderStateUpdateInstall:         true,
+	MenderStateUpdateCleanup:         true,
+	MenderStateReboot:                true,
+	MenderStateUpdateVerify:          true,
+	MenderStateUpdateCommit:          true,
+	MenderStateUpdateCommitHold:      true,
+	MenderStateRollback:              true,
+	MenderStateUpdateError:           true,
+	MenderStateUpdateStatusReport:    true,
+	MenderStateReportStatusError:     true,
+}
+
+// Watchdog catching the state machine cycling through states without making
+// progress (e.g. Error -> Init -> Bootstrapped -> Error due to persistent
+// configuration error), hammering the flash and the server.
+type stateLoopGuard struct {
+	// times of transitions within the last stateLoopWindow
+	transitions []time.Time
+	// loop detected in the middle of a deployment, not acted upon yet
+	pending bool
+	// the test loop cycles through updates with accelerated timers, at a
+	// rate that is indistinguishable from a loop
+	disabled bool
+}
+
+// Record state transition to `next` happening at time `now`. Returns true if a
+// loop was detected and the state machine should back off instead of going to
+// `next`; never while a deployment is in progress.
+func (g *stateLoopGuard) transition(now time.Time, next MenderState) bool {
+	if g.disabled {
+		return false
+	}
+	cutoff := now.Add(-stateLoopWindow)
+
+	i := 0
+	for i < len(g.transitions) && !g.transitions[i].After(cutoff) {
+		i++
+	}
+	g.transitions = append(g.transitions[i:], now)
+
+	if len(g.transitions) > maxStateTransitions {
+		g.transitions = nil
+		if !g.pending && deploymentStates[next] {
+			log.Warnf("state loop detected during deployment; backing off " +
+				"once it is finished")
+		}
+		g.pending = true
+	}
+	if g.pending && !deploymentStates[next] {
+		g.transitions = nil
+		g.pending = false
+		return true
+	}
+	return false
+}
+
+func markStateLoop(store Store, when time.Time) {
+	if store == nil {
+		return
+	}
+	if err := store.WriteAll(stateLoopName,
+		[]byte(when.UTC().Format(time.RFC3339))); err != nil {
+		log.Errorf("failed to save state loop marker: %v", err)
+	}
+}
+
+func clearStateLoop(store Store) {
+	if store == nil {
+		return
+	}
+	if _, err := store.ReadAll(stateLoopName); err != nil {
+		return
+	}
+	log.Infof("state machine is back to regular operation")
+	if err := store.Remove(stateLoopName); err != nil {
+		log.Errorf("failed to remove state loop marker: %v", err)
+	}
+}
+
+// Time when state loop was detected, empty if the state machine is working
+// normally.
+func stateLoopDetected(store Store) string {
+	if store == nil {
+		return ""
+	}
+	data, err := store.ReadAll(stateLoopName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("failed to read state loop marker: %v", err)
+		}
+		return ""
+	}
+	return string(data)
+}
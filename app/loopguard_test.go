@@ -0,0 +1,125 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateLoopGuard(t *testing.T) {
+	defer func(max int) {
+		maxStateTransitions = max
+	}(maxStateTransitions)
+	maxStateTransitions = 3
+
+	var g stateLoopGuard
+	now := time.Now()
+
+	// transitions spread over time are fine
+	for i := 0; i < 10; i++ {
+		assert.False(t, g.transition(now.Add(time.Duration(i)*stateLoopWindow/2),
+			MenderStateInit))
+	}
+
+	now = now.Add(time.Hour)
+	assert.False(t, g.transition(now, MenderStateInit))
+	assert.False(t, g.transition(now, MenderStateError))
+	assert.False(t, g.transition(now, MenderStateInit))
+	assert.True(t, g.transition(now, MenderStateError))
+	// counting starts over
+	assert.False(t, g.transition(now, MenderStateInit))
+
+	// deployment in progress is not interrupted, backing off waits until
+	// it is over
+	now = now.Add(time.Hour)
+	assert.False(t, g.transition(now, MenderStateUpdateCheck))
+	assert.False(t, g.transition(now, MenderStateUpdateFetch))
+	assert.False(t, g.transition(now, MenderStateUpdateInstall))
+	assert.False(t, g.transition(now, MenderStateReboot))
+	assert.False(t, g.transition(now.Add(time.Hour), MenderStateUpdateVerify))
+	assert.False(t, g.transition(now.Add(time.Hour), MenderStateUpdateStatusReport))
+	assert.True(t, g.transition(now.Add(time.Hour), MenderStateCheckWait))
+	assert.False(t, g.transition(now.Add(time.Hour), MenderStateInventoryUpdate))
+
+	// states resuming a deployment after restart are deployment states
+	for id, resume := range stateResumeTable {
+		if resume != nil {
+			assert.True(t, deploymentStates[id], id.String())
+		}
+	}
+}
+
+func TestStateLoopMarker(t *testing.T) {
+	ms := utils.NewMemStore()
+
+	assert.Equal(t, "", stateLoopDetected(ms))
+	// clearing is fine even if nothing is there
+	clearStateLoop(ms)
+
+	when := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	markStateLoop(ms, when)
+	assert.Equal(t, "2017-01-02T03:04:05Z", stateLoopDetected(ms))
+
+	clearStateLoop(ms)
+	assert.Equal(t, "", stateLoopDetected(ms))
+
+	// nil store is fine too
+	assert.NotPanics(t, func() {
+		markStateLoop(nil, when)
+		clearStateLoop(nil)
+		assert.Equal(t, "", stateLoopDetected(nil))
+	})
+}
+
+func TestDaemonStateLoop(t *testing.T) {
+	defer func(max int) {
+		maxStateTransitions = max
+	}(maxStateTransitions)
+	maxStateTransitions = 10
+
+	// persistent bootstrap error makes the state machine go around
+	// init -> error -> init
+	dtc := &daemonTestController{
+		stateTestController{
+			bootstrapErr: NewTransientError(errors.New("bad config")),
+			state:        initState,
+		},
+		0,
+	}
+	store := utils.NewMemStore()
+	daemon := NewDaemon(dtc, store)
+
+	done := make(chan error)
+	go func() {
+		done <- daemon.Run()
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	daemon.StopDaemon()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatalf("daemon did not stop")
+	}
+
+	// the daemon should be backing off now
+	assert.Equal(t, MenderStateLoopWait, dtc.GetState().Id())
+	assert.NotEqual(t, "", stateLoopDetected(store))
+}
@@ -0,0 +1,104 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"path"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+const luksUpdateMapping = "mender-update"
+
+var (
+	// overridden in tests
+	luksMapperDir = "/dev/mapper"
+)
+
+// Encrypted root filesystem support; the new image is written to LUKS
+// container on the inactive partition, which is unlocked with the key from
+// configured key file. If the container is missing or can not be unlocked
+// with the key, it is created anew.
+type luksContainer struct {
+	Commander
+	keyFile string
+}
+
+func newLUKSContainer(cmd Commander, keyFile string) *luksContainer {
+	if keyFile == "" {
+		return nil
+	}
+	return &luksContainer{cmd, keyFile}
+}
+
+func (l *luksContainer) cryptsetup(args ...string) error {
+	out, err := l.Command("cryptsetup", args...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "cryptsetup %s failed: %s", args[0], out)
+	}
+	return nil
+}
+
+func (l *luksContainer) isLUKS(part string) bool {
+	return l.Command("cryptsetup", "isLuks", part).Run() == nil
+}
+
+// Unlocks the container on the partition, creating it if needed, and returns
+// the path of the device the image should be written to.
+func (l *luksContainer) Open(part string) (string, error) {
+	// left behind by an interrupted update
+	l.Close()
+
+	if l.isLUKS(part) {
+		err := l.cryptsetup("open", "--type", "luks", "--key-file", l.keyFile,
+			part, luksUpdateMapping)
+		if err == nil {
+			log.Infof("Unlocked LUKS container on %s", part)
+			return path.Join(luksMapperDir, luksUpdateMapping), nil
+		}
+		log.Warnf("Can not unlock LUKS container on %s with the configured key, "+
+			"creating new one: %v", part, err)
+	}
+
+	log.Infof("Creating LUKS container on %s", part)
+	if err := l.cryptsetup("luksFormat", "--batch-mode", "--type", "luks",
+		"--key-file", l.keyFile, part); err != nil {
+		return "", err
+	}
+	if err := l.cryptsetup("open", "--type", "luks", "--key-file", l.keyFile,
+		part, luksUpdateMapping); err != nil {
+		return "", err
+	}
+	return path.Join(luksMapperDir, luksUpdateMapping), nil
+}
+
+// Locks the container of the inactive partition, if open.
+func (l *luksContainer) Close() error {
+	if l.Command("cryptsetup", "status", luksUpdateMapping).Run() != nil {
+		// not open
+		return nil
+	}
+	return l.cryptsetup("close", luksUpdateMapping)
+}
+
+// Checks that the partition can be unlocked with the configured key, that
+// is, booting it will not get stuck at the passphrase prompt.
+func (l *luksContainer) Verify(part string) error {
+	if !l.isLUKS(part) {
+		return errors.Errorf("%s is not a LUKS container", part)
+	}
+	return l.cryptsetup("open", "--test-passphrase", "--type", "luks",
+		"--key-file", l.keyFile, part)
+}
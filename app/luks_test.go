@@ -0,0 +1,144 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// records cryptsetup invocations; commands fail with exit code given for
+// their cryptsetup action
+type luksTestCommander struct {
+	retCodes map[string]int
+	calls    []string
+}
+
+func (c *luksTestCommander) Command(name string, args ...string) *exec.Cmd {
+	c.calls = append(c.calls, strings.Join(append([]string{name}, args...), " "))
+	ret := 0
+	if len(args) > 0 {
+		ret = c.retCodes[args[0]]
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=TestHelperProcessSuccess", "--",
+		strconv.Itoa(ret), "")
+	cmd.Env = []string{"NEED_MENDER_TEST_HELPER_PROCESS=1"}
+	return cmd
+}
+
+func TestLUKSContainerOpen(t *testing.T) {
+	assert.Nil(t, newLUKSContainer(&luksTestCommander{}, ""))
+
+	// existing container, not open
+	cmd := &luksTestCommander{retCodes: map[string]int{"status": 4}}
+	l := newLUKSContainer(cmd, "/data/rootfs.key")
+	dev, err := l.Open("/dev/mmcblk0p3")
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/mapper/mender-update", dev)
+	assert.Equal(t, []string{
+		"cryptsetup status mender-update",
+		"cryptsetup isLuks /dev/mmcblk0p3",
+		"cryptsetup open --type luks --key-file /data/rootfs.key /dev/mmcblk0p3 mender-update",
+	}, cmd.calls)
+
+	// left open by interrupted update, no container on the partition
+	cmd = &luksTestCommander{retCodes: map[string]int{"isLuks": 1}}
+	l = newLUKSContainer(cmd, "/data/rootfs.key")
+	_, err = l.Open("/dev/mmcblk0p3")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"cryptsetup status mender-update",
+		"cryptsetup close mender-update",
+		"cryptsetup isLuks /dev/mmcblk0p3",
+		"cryptsetup luksFormat --batch-mode --type luks --key-file /data/rootfs.key /dev/mmcblk0p3",
+		"cryptsetup open --type luks --key-file /data/rootfs.key /dev/mmcblk0p3 mender-update",
+	}, cmd.calls)
+
+	// key does not unlock the container, it is re-created but still fails
+	cmd = &luksTestCommander{retCodes: map[string]int{"status": 4, "open": 2}}
+	l = newLUKSContainer(cmd, "/data/rootfs.key")
+	_, err = l.Open("/dev/mmcblk0p3")
+	assert.Error(t, err)
+	assert.Contains(t, cmd.calls,
+		"cryptsetup luksFormat --batch-mode --type luks --key-file /data/rootfs.key /dev/mmcblk0p3")
+
+	cmd = &luksTestCommander{retCodes: map[string]int{"status": 4, "isLuks": 1, "luksFormat": 1}}
+	l = newLUKSContainer(cmd, "/data/rootfs.key")
+	_, err = l.Open("/dev/mmcblk0p3")
+	assert.Error(t, err)
+}
+
+func TestLUKSContainerVerify(t *testing.T) {
+	cmd := &luksTestCommander{}
+	l := newLUKSContainer(cmd, "/data/rootfs.key")
+	assert.NoError(t, l.Verify("/dev/mmcblk0p3"))
+	assert.Equal(t, "cryptsetup open --test-passphrase --type luks --key-file /data/rootfs.key /dev/mmcblk0p3",
+		cmd.calls[1])
+
+	cmd.retCodes = map[string]int{"isLuks": 1}
+	assert.Error(t, l.Verify("/dev/mmcblk0p3"))
+
+	cmd.retCodes = map[string]int{"open": 2}
+	assert.Error(t, l.Verify("/dev/mmcblk0p3"))
+}
+
+func TestInstallUpdateLUKS(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "luks")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	oldMapper := luksMapperDir
+	luksMapperDir = tdir
+	defer func() { luksMapperDir = oldMapper }()
+
+	target := path.Join(tdir, luksUpdateMapping)
+	assert.NoError(t, ioutil.WriteFile(target, nil, 0644))
+
+	oldSize := BlockDeviceGetSizeOf
+	BlockDeviceGetSizeOf = func(file *os.File) (uint64, error) { return 1024, nil }
+	defer func() { BlockDeviceGetSizeOf = oldSize }()
+
+	cmd := &luksTestCommander{}
+	testDevice := device{
+		partitions: &partitions{inactive: "/dev/mmcblk0p3"},
+		luks:       newLUKSContainer(cmd, "/data/rootfs.key"),
+	}
+
+	image, err := ioutil.TempFile(tdir, "image")
+	assert.NoError(t, err)
+	image.WriteString("test content")
+	image.Seek(0, 0)
+
+	assert.NoError(t, testDevice.InstallUpdate(image, 12))
+
+	// image went to the unlocked container, which is closed afterwards
+	data, err := ioutil.ReadFile(target)
+	assert.NoError(t, err)
+	assert.Equal(t, "test content", string(data))
+	assert.Equal(t, "cryptsetup close mender-update", cmd.calls[len(cmd.calls)-1])
+
+	// not enabled if the container can not be unlocked
+	env := newTestOSCalls("upgrade_available=1\nmender_boot_part=3\nbootcount=0", 0)
+	testDevice.BootEnvReadWriter = &uBootEnv{&env}
+	assert.NoError(t, testDevice.EnableUpdatedPartition())
+	cmd.retCodes = map[string]int{"open": 2}
+	assert.Error(t, testDevice.EnableUpdatedPartition())
+}
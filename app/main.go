@@ -0,0 +1,913 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"flag"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+
+	"github.com/pkg/errors"
+)
+
+type logOptionsType struct {
+	debug      *bool
+	info       *bool
+	logLevel   *string
+	logModules *string
+	logFile    *string
+	noSyslog   *bool
+}
+
+type runOptionsType struct {
+	version        *bool
+	config         *string
+	dataStore      *string
+	imageFile      *string
+	commit         *bool
+	bootstrap      *bool
+	daemon         *bool
+	bootstrapForce *bool
+	updateChannel  *string
+	testLoop       *bool
+	testLoopServer *string
+	showHistory    *bool
+	showAudit      *bool
+	switchPart     *bool
+	checkState     *bool
+	stateSnapshot  *string
+	takeover       *bool
+	showArtifact   *bool
+	checkConn      *bool
+	requestDeploy  *string
+	systemdUnit    *bool
+	benchInstall   *string
+	benchTarget    *string
+	setGroup       *string
+	setTags        *string
+	clearQuarant   *bool
+	checkUpdate    *bool
+	skipDeploy     *string
+	showLog        *bool
+	output         *string
+	// -update-channel given; empty channel clears the selection
+	setUpdateChannel bool
+	client.Config
+}
+
+var (
+	errMsgNoArgumentsGiven = errors.New("Must give one of -rootfs, " +
+		"-commit, -bootstrap or -daemon arguments")
+	errMsgAmbiguousArgumentsGiven = errors.New("Ambiguous parameters given " +
+		"- must give exactly one from: -rootfs, -commit, -bootstrap, -authorize, " +
+		"-update-channel, -show-history, -show-device-audit, " +
+		"-switch-partition, -check-state, " +
+		"-check-state-snapshot, -show-artifact, -check-connection, " +
+		"-request-deployment, -set-group/-set-tags, -benchmark-install, " +
+		"-clear-quarantine, -check-update, -skip-deployment, -show-log or -daemon")
+	errMsgIncompatibleLogOptions = errors.New("One or more " +
+		"incompatible log log options specified.")
+)
+
+var defaultConfFile string = path.Join(getConfDirPath(), "mender.conf")
+
+const defaultTenantTokenFile string = "authtentoken"
+
+// tenant token used with the server the device is being migrated to
+const migrationTenantTokenFile string = "authtentoken-migration"
+
+type Commander interface {
+	Command(name string, arg ...string) *exec.Cmd
+}
+
+type StatCommander interface {
+	Stat(string) (os.FileInfo, error)
+	Commander
+}
+
+// we need real OS implementation
+type osCalls struct {
+}
+
+func (osCalls) Command(name string, arg ...string) *exec.Cmd {
+	return exec.Command(name, arg...)
+}
+
+func (osCalls) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func argsParse(args []string) (runOptionsType, error) {
+	parsing := flag.NewFlagSet("mender", flag.ContinueOnError)
+
+	// FLAGS ---------------------------------------------------------------
+
+	version := parsing.Bool("version", false, "Show mender agent version and exit.")
+
+	config := parsing.String("config", defaultConfFile,
+		"Configuration file location.")
+
+	data := parsing.String("data", defaultDataStore,
+		"Mender state data location.")
+
+	commit := parsing.Bool("commit", false, "Commit current update.")
+
+	bootstrap := parsing.Bool("bootstrap", false, "Perform bootstrap and exit.")
+
+	imageFile := parsing.String("rootfs", "",
+		"Root filesystem URI to use for update. Can be either a local "+
+			"file or a URL.")
+
+	daemon := parsing.Bool("daemon", false, "Run as a daemon.")
+
+	testLoop := parsing.Bool("test-loop", false,
+		"Run daemon against in-memory device with accelerated timers; "+
+			"for soak testing only.")
+	testLoopServer := parsing.String("test-loop-server", "",
+		"Server the test loop runs against; must be a test server, not "+
+			"the one configured.")
+
+	switchPart := parsing.Bool("switch-partition", false,
+		"Make the device boot from the other root filesystem partition "+
+			"and reboot; for recovering from broken committed update.")
+
+	checkState := parsing.Bool("check-state", false,
+		"Check that update state, bootloader environment and update marker "+
+			"are consistent, repair them if not, and exit; run at boot "+
+			"before the daemon.")
+
+	stateSnapshot := parsing.String("check-state-snapshot", "",
+		"Check update state snapshot (JSON) taken elsewhere, e.g. in power "+
+			"loss tests, and exit.")
+
+	showHistory := parsing.Bool("show-history", false,
+		"Show recently installed artifacts and exit.")
+
+	showAudit := parsing.Bool("show-device-audit", false,
+		"Show operations done to the device during recent deployments and exit.")
+
+	updateChannel := parsing.String("update-channel", "",
+		"Select update channel (e.g. stable, beta) and exit. Empty "+
+			"value clears the selection.")
+
+	showArtifact := parsing.Bool("show-artifact", false,
+		"Show name of the currently installed artifact and exit.")
+
+	checkConn := parsing.Bool("check-connection", false,
+		"Check connectivity with the server step by step (DNS, TCP, TLS, "+
+			"authorization, deployments) and exit.")
+
+	requestDeploy := parsing.String("request-deployment", "",
+		"Ask the server to deploy the named artifact to this device (where "+
+			"the server supports it) and exit.")
+
+	systemdUnit := parsing.Bool("systemd-unit", false,
+		"Print systemd unit running the daemon with given -config and -data "+
+			"and exit.")
+
+	setGroup := parsing.String("set-group", "",
+		"Assign the device to the group on the server (where the server "+
+			"supports it) and exit; can be combined with -set-tags.")
+
+	setTags := parsing.String("set-tags", "",
+		"Set device tags on the server, given as comma separated "+
+			"name=value pairs (where the server supports it), and exit.")
+
+	clearQuarant := parsing.Bool("clear-quarantine", false,
+		"Accept deployments again after the device declined them because "+
+			"of repeatedly failed deployments, and exit.")
+
+	checkUpdate := parsing.Bool("check-update", false,
+		"Ask the server for an update without installing it and exit; exit "+
+			"status tells if there is none or it is installed already.")
+
+	showLog := parsing.Bool("show-log", false,
+		"Show the last lines logged by the daemon, kept in the data store "+
+			"across reboots, and exit.")
+
+	skipDeploy := parsing.String("skip-deployment", "",
+		"Decline the deployment with given ID, reporting it failed without "+
+			"installing it, and exit.")
+
+	benchInstall := parsing.String("benchmark-install", "",
+		"Measure download, decompression, write and sync throughput of "+
+			"installing given artifact (file or URL), print report and exit. "+
+			"The device is left as it was.")
+
+	benchTarget := parsing.String("benchmark-target", benchmarkTargetScratch,
+		"Where -benchmark-install writes the payload: 'scratch' (file in "+
+			"scratch directory) or 'partition' (inactive partition, its "+
+			"content is restored afterwards).")
+
+	output := parsing.String("output", outputText,
+		"Output format of commands showing information: 'text' or 'json'.")
+
+	takeover := parsing.Bool("takeover", false,
+		"Stop running mender daemon and proceed once it exits, instead of "+
+			"failing because another instance is running.")
+
+	// add bootstrap related command line options
+	certFile := parsing.String("certificate", "", "Client certificate")
+	certKey := parsing.String("cert-key", "", "Client certificate's private key")
+	serverCert := parsing.String("trusted-certs", "", "Trusted server certificates")
+	forcebootstrap := parsing.Bool("forcebootstrap", false, "Force bootstrap")
+	skipVerify := parsing.Bool("skipverify", false, "Skip certificate verification")
+
+	// add log related command line options
+	logFlags := addLogFlags(parsing)
+
+	// PARSING -------------------------------------------------------------
+
+	if err := parsing.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return runOptionsType{}, err
+		}
+		return runOptionsType{}, withExitResult(exitResultUsage, err)
+	}
+
+	runOptions := runOptionsType{
+		version:        version,
+		config:         config,
+		dataStore:      data,
+		imageFile:      imageFile,
+		commit:         commit,
+		bootstrap:      bootstrap,
+		daemon:         daemon,
+		bootstrapForce: forcebootstrap,
+		updateChannel:  updateChannel,
+		testLoop:       testLoop,
+		testLoopServer: testLoopServer,
+		showHistory:    showHistory,
+		showAudit:      showAudit,
+		switchPart:     switchPart,
+		checkState:     checkState,
+		stateSnapshot:  stateSnapshot,
+		takeover:       takeover,
+		showArtifact:   showArtifact,
+		checkConn:      checkConn,
+		requestDeploy:  requestDeploy,
+		systemdUnit:    systemdUnit,
+		benchInstall:   benchInstall,
+		benchTarget:    benchTarget,
+		setGroup:       setGroup,
+		setTags:        setTags,
+		clearQuarant:   clearQuarant,
+		checkUpdate:    checkUpdate,
+		skipDeploy:     skipDeploy,
+		showLog:        showLog,
+		output:         output,
+		Config: client.Config{
+			CertFile:   *certFile,
+			CertKey:    *certKey,
+			ServerCert: *serverCert,
+			NoVerify:   *skipVerify,
+		},
+	}
+
+	parsing.Visit(func(f *flag.Flag) {
+		if f.Name == "update-channel" {
+			runOptions.setUpdateChannel = true
+		}
+	})
+
+	//runOptions.bootstrap = httpsClientConfig{}
+
+	// FLAG LOGIC ----------------------------------------------------------
+
+	// we just want to see the version string, the rest does not
+	// matter
+	if *version == true {
+		return runOptions, nil
+	}
+
+	if err := parseLogFlags(logFlags); err != nil {
+		return runOptions, err
+	}
+
+	if moreThanOneRunOptionSelected(runOptions) {
+		return runOptions, errMsgAmbiguousArgumentsGiven
+	}
+
+	if *testLoop && !*daemon {
+		return runOptions, withExitResult(exitResultUsage,
+			errors.New("-test-loop can only be used with -daemon"))
+	}
+	if *testLoop && *testLoopServer == "" {
+		return runOptions, withExitResult(exitResultUsage,
+			errors.New("-test-loop requires -test-loop-server"))
+	}
+
+	return runOptions, nil
+}
+
+// Operation selected on the command line, and how to run it.
+type runOption struct {
+	selected func(opts *runOptionsType) bool
+	// mode of the instance lock held while running it; empty if the
+	// operation does not modify the device nor state data
+	lockMode string
+	// may be given along with other operations; runs instead of any
+	// following it in runOptionsTable
+	combinable bool
+	run        func(env *runEnv) error
+}
+
+// What the selected operation runs with.
+type runEnv struct {
+	opts   *runOptionsType
+	config *MenderConfig
+	device *device
+	out    io.Writer
+}
+
+// Operations in the order they are checked; the first one selected runs.
+var runOptionsTable = []runOption{
+	{
+		selected: func(opts *runOptionsType) bool { return *opts.imageFile != "" },
+		lockMode: lockModeCLI,
+		run: func(env *runEnv) error {
+			dt := GetDeviceType(defaultDeviceTypeFile)
+			store := NewDBStore(*env.opts.dataStore)
+			if store == nil {
+				return errors.New("failed to initialize DB store")
+			}
+			defer store.Close()
+			if err := doRootfs(env.device, *env.opts, dt, store); err != nil {
+				return err
+			}
+			if env.device.AppUpdatePending() {
+				return nil
+			}
+			// new artifact runs once the device is rebooted
+			return ErrRebootRequired
+		},
+	},
+	{
+		selected: func(opts *runOptionsType) bool { return *opts.commit },
+		lockMode: lockModeCLI,
+		run: func(env *runEnv) error {
+			store := NewDBStore(*env.opts.dataStore)
+			if store == nil {
+				return errors.New("failed to initialize DB store")
+			}
+			defer store.Close()
+			return doCommit(env.device, store)
+		},
+	},
+	{
+		selected: func(opts *runOptionsType) bool { return *opts.checkUpdate },
+		lockMode: lockModeCLI,
+		run: func(env *runEnv) error {
+			return doCheckUpdate(env.config, *env.opts.dataStore, env.out)
+		},
+	},
+	{
+		selected: func(opts *runOptionsType) bool { return *opts.skipDeploy != "" },
+		run: func(env *runEnv) error {
+			return doSkipDeployment(*env.opts.dataStore, *env.opts.skipDeploy)
+		},
+	},
+	{
+		selected: func(opts *runOptionsType) bool { return *opts.showLog },
+		run: func(env *runEnv) error {
+			return doShowLog(*env.opts.dataStore, env.out)
+		},
+	},
+	{
+		selected:   func(opts *runOptionsType) bool { return *opts.bootstrap },
+		lockMode:   lockModeCLI,
+		combinable: true,
+		run: func(env *runEnv) error {
+			return doBootstrapAuthorize(env.config, env.opts)
+		},
+	},
+	{
+		selected: func(opts *runOptionsType) bool { return opts.setUpdateChannel },
+		run: func(env *runEnv) error {
+			return doSetUpdateChannel(*env.opts.dataStore, *env.opts.updateChannel)
+		},
+	},
+	{
+		selected: func(opts *runOptionsType) bool { return *opts.switchPart },
+		lockMode: lockModeCLI,
+		run:      func(env *runEnv) error { return doSwitchPartition(env.device) },
+	},
+	{
+		selected: func(opts *runOptionsType) bool { return *opts.showHistory },
+		run: func(env *runEnv) error {
+			return doShowInstallHistory(*env.opts.dataStore, env.out)
+		},
+	},
+	{
+		selected: func(opts *runOptionsType) bool { return *opts.showAudit },
+		run: func(env *runEnv) error {
+			return doShowDeviceAudit(*env.opts.dataStore, env.out)
+		},
+	},
+	{
+		selected: func(opts *runOptionsType) bool { return *opts.checkConn },
+		run: func(env *runEnv) error {
+			return doCheckConnection(env.config, *env.opts.dataStore, env.out)
+		},
+	},
+	{
+		selected: func(opts *runOptionsType) bool { return *opts.requestDeploy != "" },
+		lockMode: lockModeCLI,
+		run: func(env *runEnv) error {
+			return doRequestDeployment(env.config, *env.opts.dataStore,
+				*env.opts.requestDeploy, env.out)
+		},
+	},
+	{
+		selected: func(opts *runOptionsType) bool {
+			return *opts.setGroup != "" || *opts.setTags != ""
+		},
+		lockMode: lockModeCLI,
+		run: func(env *runEnv) error {
+			return doSetDeviceTags(env.config, *env.opts.dataStore,
+				*env.opts.setGroup, *env.opts.setTags, env.out)
+		},
+	},
+	{
+		selected: func(opts *runOptionsType) bool { return *opts.clearQuarant },
+		run: func(env *runEnv) error {
+			return doClearQuarantine(*env.opts.dataStore)
+		},
+	},
+	{
+		selected: func(opts *runOptionsType) bool { return *opts.showArtifact },
+		run: func(env *runEnv) error {
+			printArtifactName(env.out,
+				getManifestData("artifact_name", defaultArtifactInfoFile))
+			return nil
+		},
+	},
+	{
+		selected: func(opts *runOptionsType) bool { return *opts.systemdUnit },
+		run: func(env *runEnv) error {
+			binary, err := os.Executable()
+			if err != nil {
+				return errors.Wrapf(err, "failed to locate mender binary")
+			}
+			printSystemdUnit(env.out, binary, *env.opts.config, *env.opts.dataStore)
+			return nil
+		},
+	},
+	{
+		selected: func(opts *runOptionsType) bool { return *opts.benchInstall != "" },
+		lockMode: lockModeCLI,
+		run: func(env *runEnv) error {
+			return doBenchmarkInstall(env.config, env.device, *env.opts.dataStore,
+				*env.opts.benchInstall, *env.opts.benchTarget, env.out)
+		},
+	},
+	{
+		selected: func(opts *runOptionsType) bool { return *opts.checkState },
+		lockMode: lockModeCLI,
+		run: func(env *runEnv) error {
+			return doCheckState(env.device, *env.opts.dataStore, env.out)
+		},
+	},
+	{
+		selected: func(opts *runOptionsType) bool { return *opts.stateSnapshot != "" },
+		run: func(env *runEnv) error {
+			return doCheckStateSnapshot(*env.opts.stateSnapshot, env.out)
+		},
+	},
+	{
+		// in-memory device, nothing to lock
+		selected: func(opts *runOptionsType) bool { return *opts.daemon && *opts.testLoop },
+		run: func(env *runEnv) error {
+			return runTestLoop(env.config, *env.opts.dataStore,
+				*env.opts.testLoopServer)
+		},
+	},
+	{
+		selected: func(opts *runOptionsType) bool { return *opts.daemon && !*opts.testLoop },
+		lockMode: lockModeDaemon,
+		run: func(env *runEnv) error {
+			agent, err := newMenderAgent(AgentConfig{
+				Config:         *env.config,
+				DataStore:      *env.opts.dataStore,
+				ForceBootstrap: *env.opts.bootstrapForce,
+			}, env.device)
+			if err != nil {
+				return err
+			}
+			stopOnSignal(agent)
+			return agent.Run()
+		},
+	},
+}
+
+// First operation selected in runOptionsTable, nil if none.
+func selectedRunOption(opts runOptionsType) *runOption {
+	for i := range runOptionsTable {
+		if runOptionsTable[i].selected(&opts) {
+			return &runOptionsTable[i]
+		}
+	}
+	return nil
+}
+
+func moreThanOneRunOptionSelected(runOptions runOptionsType) bool {
+	// check if more than one command line action is selected
+	var runOptionsCount int
+	for _, opt := range runOptionsTable {
+		if !opt.combinable && opt.selected(&runOptions) {
+			runOptionsCount++
+		}
+	}
+	return runOptionsCount > 1
+}
+
+func addLogFlags(f *flag.FlagSet) logOptionsType {
+
+	var logOptions logOptionsType
+
+	logOptions.debug = f.Bool("debug", false, "Debug log level. This is a "+
+		"shorthand for '-l debug'.")
+
+	logOptions.info = f.Bool("info", false, "Info log level. This is a "+
+		"shorthand for '-l info'.")
+
+	logOptions.logLevel = f.String("log-level", "", "Log level, which can be "+
+		"'debug', 'info', 'warning', 'error', 'fatal' or 'panic'. "+
+		"Earlier log levels will also log the subsequent levels (so "+
+		"'debug' will log everything). The default log level is "+
+		"'info'.")
+
+	logOptions.logModules = f.String("log-modules", "", "Filter logging by "+
+		"module. This is a comma separated list of modules to log, "+
+		"other modules will be omitted. To see which modules are "+
+		"available, take a look at a non-filtered log and select "+
+		"the modules appropriate for you.")
+
+	logOptions.noSyslog = f.Bool("no-syslog", false, "Disable logging to "+
+		"syslog. Note that debug message are never logged to syslog.")
+
+	logOptions.logFile = f.String("log-file", "", "File to log to.")
+
+	return logOptions
+
+}
+
+func parseLogFlags(args logOptionsType) error {
+	var logOptCount int
+
+	if *args.logLevel != "" {
+		level, err := log.ParseLevel(*args.logLevel)
+		if err != nil {
+			return err
+		}
+		log.SetLevel(level)
+		logOptCount++
+	}
+
+	if *args.info {
+		log.SetLevel(log.InfoLevel)
+		logOptCount++
+	}
+
+	if *args.debug {
+		log.SetLevel(log.DebugLevel)
+		logOptCount++
+	}
+
+	if logOptCount > 1 {
+		return errMsgIncompatibleLogOptions
+	} else if logOptCount == 0 {
+		// set info as a default log level
+		log.SetLevel(log.InfoLevel)
+	}
+
+	if *args.logFile != "" {
+		fd, err := os.Create(*args.logFile)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(fd)
+	}
+
+	if *args.logModules != "" {
+		modules := strings.Split(*args.logModules, ",")
+		setLogModuleFilter(modules)
+	}
+
+	if !*args.noSyslog {
+		if err := addSyslogHook(); err != nil {
+			log.Warnf("Could not connect to syslog daemon: %s. "+
+				"(use -no-syslog to disable completely)",
+				err.Error())
+		}
+	}
+
+	return nil
+}
+
+func ShowVersion() {
+	printVersion(os.Stdout)
+}
+
+func doBootstrapAuthorize(config *MenderConfig, opts *runOptionsType) error {
+	mp, err := commonInit(config, *opts.dataStore, NewIdentityDataGetter())
+	if err != nil {
+		return err
+	}
+
+	// need to close DB store manually, since we're not running under a
+	// daemonized version
+	defer mp.store.Close()
+
+	controller, err := NewMender(*config, *mp)
+	if err != nil {
+		return errors.Wrap(err, "error initializing mender controller")
+	}
+
+	if *opts.bootstrapForce {
+		controller.ForceBootstrap()
+	}
+
+	if merr := controller.Bootstrap(); merr != nil {
+		return merr.Cause()
+	}
+
+	if merr := controller.Authorize(context.Background()); merr != nil {
+		return merr.Cause()
+	}
+
+	return nil
+}
+
+func doSetUpdateChannel(dataStore string, channel string) error {
+	dbstore := NewDBStore(dataStore)
+	if dbstore == nil {
+		return errors.New("failed to initialize DB store")
+	}
+	defer dbstore.Close()
+
+	if err := storeUpdateChannel(dbstore, channel); err != nil {
+		return err
+	}
+
+	if channel == "" {
+		log.Info("update channel selection cleared")
+	} else {
+		log.Infof("update channel set to %s", channel)
+	}
+	return nil
+}
+
+type partitionSwitcher interface {
+	SwitchPartition() error
+	Reboot() error
+}
+
+func doSwitchPartition(device partitionSwitcher) error {
+	if err := device.SwitchPartition(); err != nil {
+		return err
+	}
+	log.Info("boot partition switched, rebooting")
+	return device.Reboot()
+}
+
+func doShowInstallHistory(dataStore string, out io.Writer) error {
+	dbstore := NewDBStore(dataStore)
+	if dbstore == nil {
+		return errors.New("failed to initialize DB store")
+	}
+	defer dbstore.Close()
+
+	history, err := loadInstallHistory(dbstore)
+	if err != nil {
+		return err
+	}
+	printInstallHistory(out, history)
+	return nil
+}
+
+func doShowDeviceAudit(dataStore string, out io.Writer) error {
+	dbstore := NewDBStore(dataStore)
+	if dbstore == nil {
+		return errors.New("failed to initialize DB store")
+	}
+	defer dbstore.Close()
+
+	audit, err := loadDeviceAudit(dbstore)
+	if err != nil {
+		return err
+	}
+	printDeviceAudit(out, audit)
+	return nil
+}
+
+func getKeyStore(datastore string, keyName string) *Keystore {
+	dirstore := NewDirStore(datastore)
+	return NewKeystore(dirstore, keyName)
+}
+
+func loadTenantToken(datastore string, name string, keyFile string) ([]byte, error) {
+	dirstore, err := newEncryptingStore(NewDirStore(datastore), keyFile)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := dirstore.ReadAll(name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// Encrypt the tenant tokens provisioned in plain text, if store encryption
+// is configured.
+func sealTenantTokens(datastore string, keyFile string) error {
+	dirstore, err := newEncryptingStore(NewDirStore(datastore), keyFile)
+	if err != nil {
+		return err
+	}
+	sealPlaintextEntries(dirstore)
+	return nil
+}
+
+func commonInit(config *MenderConfig, dataStore string,
+	identity IdentityDataGetter) (*MenderPieces, error) {
+	if err := sealTenantTokens(dataStore, config.StoreEncryptionKeyFile); err != nil {
+		return nil, err
+	}
+	tentok, err := loadTenantToken(dataStore, defaultTenantTokenFile,
+		config.StoreEncryptionKeyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load tenant token")
+	}
+
+	ks := getKeyStore(dataStore, config.DeviceKey)
+	if ks == nil {
+		return nil, errors.New("failed to setup key storage")
+	}
+
+	dbstore := NewDBStore(dataStore)
+	if dbstore == nil {
+		return nil, errors.New("failed to initialize DB store")
+	}
+	store, err := newEncryptingStore(dbstore, config.StoreEncryptionKeyFile)
+	if err != nil {
+		dbstore.Close()
+		return nil, err
+	}
+	sealPlaintextEntries(store)
+
+	authmgr := NewAuthManager(AuthManagerConfig{
+		AuthDataStore:  store,
+		KeyStore:       ks,
+		IdentitySource: identity,
+		TenantToken:    tentok,
+		AuthData:       deviceAuthData(defaultArtifactInfoFile, defaultDeviceTypeFile),
+	})
+	if authmgr == nil {
+		// close DB store explicitly
+		dbstore.Close()
+		return nil, errors.New("error initializing authentication manager")
+	}
+
+	scratch := newScratchDir(config, dataStore)
+	if err := scratch.prepare(); err != nil {
+		dbstore.Close()
+		return nil, err
+	}
+
+	mp := MenderPieces{
+		store:        store,
+		authMgr:      authmgr,
+		scratch:      scratch,
+		dataSnapshot: newDataSnapshot(*config, dataStore, store),
+	}
+
+	if config.MigrationServerURL != "" {
+		migtok, err := loadTenantToken(dataStore, migrationTenantTokenFile,
+			config.StoreEncryptionKeyFile)
+		if err != nil {
+			dbstore.Close()
+			return nil, errors.Wrapf(err, "failed to load migration tenant token")
+		}
+		// same device key is used with both servers, only authorization
+		// tokens are kept apart
+		mp.migrationAuthMgr = NewAuthManager(AuthManagerConfig{
+			AuthDataStore:  store,
+			KeyStore:       ks,
+			IdentitySource: identity,
+			TenantToken:    migtok,
+			AuthTokenName:  migrationAuthTokenName,
+			AuthData:       deviceAuthData(defaultArtifactInfoFile, defaultDeviceTypeFile),
+		})
+		if mp.migrationAuthMgr == nil {
+			dbstore.Close()
+			return nil, errors.New("error initializing migration authentication manager")
+		}
+	}
+
+	return &mp, nil
+}
+
+// Mode of the instance lock held while performing the selected operation;
+// empty if the operation does not modify the device nor state data.
+func instanceLockMode(opts runOptionsType) string {
+	if opt := selectedRunOption(opts); opt != nil {
+		return opt.lockMode
+	}
+	return ""
+}
+
+func lockInstance(opts runOptionsType) (*instanceLock, error) {
+	mode := instanceLockMode(opts)
+	if mode == "" {
+		return nil, nil
+	}
+	if *opts.takeover {
+		return takeoverInstanceLock(*opts.dataStore, mode, defaultTakeoverTimeout)
+	}
+	return acquireInstanceLock(*opts.dataStore, mode)
+}
+
+// Stop the agent gracefully on termination, eg. when taken over by another
+// instance.
+func stopOnSignal(agent *MenderAgent) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigs
+		log.Infof("received %v, stopping", sig)
+		agent.Stop()
+	}()
+}
+
+func DoMain(args []string) error {
+	runOptions, err := argsParse(args)
+	if err != nil {
+		return err
+	}
+
+	out, err := newCLIOutput(os.Stdout, *runOptions.output)
+	if err != nil {
+		return err
+	}
+
+	if *runOptions.version {
+		printVersion(out)
+		return nil
+	}
+
+	config, err := LoadConfig(*runOptions.config)
+	if err != nil {
+		return err
+	}
+	if err := setExitCodes(config.ExitCodes); err != nil {
+		return err
+	}
+
+	if runOptions.Config.NoVerify {
+		config.HttpsClient.SkipVerify = true
+	}
+
+	env, err := NewBootEnv(*config)
+	if err != nil {
+		return err
+	}
+	device := NewDevice(env, new(osCalls), config.GetDeviceConfig())
+
+	lock, err := lockInstance(runOptions)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	opt := selectedRunOption(runOptions)
+	if opt == nil {
+		return errMsgNoArgumentsGiven
+	}
+	return opt.run(&runEnv{
+		opts:   &runOptions,
+		config: config,
+		device: device,
+		out:    out,
+	})
+}
@@ -11,7 +11,7 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
-package main
+package app
 
 import (
 	"bytes"
@@ -36,24 +36,24 @@ func init() {
 }
 
 func TestMissingArgs(t *testing.T) {
-	err := doMain([]string{"-config", "mender.conf.example"})
-	assert.Error(t, err, "calling doMain() with no arguments should produce an error")
+	err := DoMain([]string{"-config", "../mender.conf.example"})
+	assert.Error(t, err, "calling DoMain() with no arguments should produce an error")
 	assert.Contains(t, err.Error(), errMsgNoArgumentsGiven.Error())
 }
 
 func TestAmbiguousArgumentsArgs(t *testing.T) {
-	err := doMain([]string{"-daemon", "-commit"})
+	err := DoMain([]string{"-daemon", "-commit"})
 	assert.Error(t, err)
 	assert.Equal(t, errMsgAmbiguousArgumentsGiven, err)
 }
 
 func TestLoggingOptions(t *testing.T) {
-	err := doMain([]string{"-commit", "-log-level", "crap"})
+	err := DoMain([]string{"-commit", "-log-level", "crap"})
 	assert.Error(t, err, "'crap' log level should have given error")
 	// Should have a reference to log level.
 	assert.Contains(t, err.Error(), "Level")
 
-	err = doMain([]string{"-info", "-log-level", "debug"})
+	err = DoMain([]string{"-info", "-log-level", "debug"})
 	assert.Error(t, err, "Incompatible log levels should have given error")
 	assert.Contains(t, err.Error(), errMsgIncompatibleLogOptions.Error())
 
@@ -65,11 +65,11 @@ func TestLoggingOptions(t *testing.T) {
 	// Ignore errors for now, we just want to know if the logging level was
 	// applied.
 	log.SetLevel(log.DebugLevel)
-	doMain([]string{"-log-level", "panic"})
+	DoMain([]string{"-log-level", "panic"})
 	log.Debugln("Should not show")
-	doMain([]string{"-debug"})
+	DoMain([]string{"-debug"})
 	log.Debugln("Should show")
-	doMain([]string{"-info"})
+	DoMain([]string{"-info"})
 	log.Debugln("Should also not show")
 
 	logdata := buf.String()
@@ -77,7 +77,7 @@ func TestLoggingOptions(t *testing.T) {
 	assert.NotContains(t, logdata, "Should not show")
 	assert.NotContains(t, logdata, "Should also not show")
 
-	doMain([]string{"-log-modules", "main_test,MyModule"})
+	DoMain([]string{"-log-modules", "main_test,MyModule"})
 	log.Errorln("Module filter should show main_test")
 	log.PushModule("MyModule")
 	log.Errorln("Module filter should show MyModule")
@@ -94,7 +94,7 @@ func TestLoggingOptions(t *testing.T) {
 		"Module filter should not show MyOtherModule") < 0)
 
 	defer os.Remove("test.log")
-	doMain([]string{"-log-file", "test.log"})
+	DoMain([]string{"-log-file", "test.log"})
 	log.Errorln("Should be in log file")
 	fd, err := os.Open("test.log")
 	assert.NoError(t, err)
@@ -105,7 +105,7 @@ func TestLoggingOptions(t *testing.T) {
 	assert.True(t, strings.Index(string(bytebuf[0:n]),
 		"Should be in log file") >= 0)
 
-	err = doMain([]string{"-no-syslog"})
+	err = DoMain([]string{"-no-syslog"})
 	// Just check that the flag can be specified.
 	assert.True(t, err != nil)
 	assert.True(t, strings.Index(err.Error(), "syslog") < 0)
@@ -127,7 +127,7 @@ func TestBinarySize(t *testing.T) {
 	if os.IsNotExist(err) {
 		// Try building first
 		programName = "/tmp/mender"
-		cmd := exec.Command("go", "build", "-o", programName)
+		cmd := exec.Command("go", "build", "-o", programName, "..")
 		err = cmd.Run()
 		if err != nil {
 			t.Fatalf("Could not build '%s': %s",
@@ -164,7 +164,7 @@ func TestVersion(t *testing.T) {
 	os.Stdout = tfile
 
 	// running with stderr pointing to temp file
-	err = doMain([]string{"-version"})
+	err = DoMain([]string{"-version"})
 
 	// restore previous stderr
 	os.Stdout = oldstdout
@@ -181,7 +181,7 @@ func TestVersion(t *testing.T) {
 		"unexpected version output '%s' expected '%s'", string(data), expected)
 }
 
-func writeConfig(t *testing.T, path string, conf menderConfig) {
+func writeConfig(t *testing.T, path string, conf MenderConfig) {
 	cf, err := os.Create(path)
 	assert.NoError(t, err)
 	defer cf.Close()
@@ -246,7 +246,7 @@ func TestMainBootstrap(t *testing.T) {
 
 	// setup test config
 	cpath := path.Join(tdir, "mender.config")
-	writeConfig(t, cpath, menderConfig{
+	writeConfig(t, cpath, MenderConfig{
 		ServerURL: ts.URL,
 	})
 
@@ -265,7 +265,7 @@ echo mac=00:11:22:33:44:55
 
 	// run bootstrap
 	db.Remove(authTokenName)
-	err = doMain([]string{"-data", tdir, "-config", cpath, "-debug", "-bootstrap"})
+	err = DoMain([]string{"-data", tdir, "-config", cpath, "-debug", "-bootstrap"})
 	assert.NoError(t, err)
 
 	// should have generated a key
@@ -280,7 +280,7 @@ echo mac=00:11:22:33:44:55
 
 	// force boostrap and run again, check if key was changed
 	db.Remove(authTokenName)
-	err = doMain([]string{"-data", tdir, "-config", cpath, "-debug", "-bootstrap", "-forcebootstrap"})
+	err = DoMain([]string{"-data", tdir, "-config", cpath, "-debug", "-bootstrap", "-forcebootstrap"})
 	assert.NoError(t, err)
 
 	keynew, err := ds.ReadAll(defaultKeyFile)
@@ -293,10 +293,72 @@ echo mac=00:11:22:33:44:55
 	// return non 200 status code, we should get an error as authorization has
 	// failed
 	responder.httpStatus = http.StatusUnauthorized
-	err = doMain([]string{"-data", tdir, "-config", cpath, "-debug", "-bootstrap", "-forcebootstrap"})
+	err = DoMain([]string{"-data", tdir, "-config", cpath, "-debug", "-bootstrap", "-forcebootstrap"})
 	assert.Error(t, err)
 
 	_, err = db.ReadAll(authTokenName)
 	assert.Error(t, err)
 	assert.True(t, os.IsNotExist(err))
 }
+
+func TestMainUpdateChannel(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	err = DoMain([]string{"-data", tdir, "-config", "../mender.conf.example",
+		"-update-channel", "beta"})
+	assert.NoError(t, err)
+
+	db := NewDBStore(tdir)
+	ch, err := loadUpdateChannel(db)
+	db.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "beta", ch)
+
+	// empty channel clears selection
+	err = DoMain([]string{"-data", tdir, "-config", "../mender.conf.example",
+		"-update-channel", ""})
+	assert.NoError(t, err)
+
+	db = NewDBStore(tdir)
+	ch, err = loadUpdateChannel(db)
+	db.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "", ch)
+
+	err = DoMain([]string{"-data", tdir, "-config", "../mender.conf.example",
+		"-update-channel", "no spaces"})
+	assert.Error(t, err)
+
+	err = DoMain([]string{"-daemon", "-update-channel", "beta"})
+	assert.Equal(t, errMsgAmbiguousArgumentsGiven, err)
+}
+
+type fakeSwitcher struct {
+	switchErr error
+	rebooted  bool
+}
+
+func (f *fakeSwitcher) SwitchPartition() error {
+	return f.switchErr
+}
+
+func (f *fakeSwitcher) Reboot() error {
+	f.rebooted = true
+	return nil
+}
+
+func TestMainSwitchPartition(t *testing.T) {
+	sw := &fakeSwitcher{}
+	assert.NoError(t, doSwitchPartition(sw))
+	assert.True(t, sw.rebooted)
+
+	// never reboot unless switched
+	sw = &fakeSwitcher{switchErr: ErrNoRootfsImage}
+	assert.Equal(t, ErrNoRootfsImage, doSwitchPartition(sw))
+	assert.False(t, sw.rebooted)
+
+	err := DoMain([]string{"-daemon", "-switch-partition"})
+	assert.Equal(t, errMsgAmbiguousArgumentsGiven, err)
+}
@@ -0,0 +1,1193 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mendersoftware/log"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/pkg/errors"
+)
+
+type BootVars map[string]string
+
+type BootEnvReadWriter interface {
+	ReadEnv(...string) (BootVars, error)
+	WriteEnv(BootVars) error
+}
+
+type UInstallCommitRebooter interface {
+	installer.UInstaller
+	CommitUpdate() error
+	Reboot() error
+	Rollback() error
+	HasUpdate() (bool, error)
+}
+
+type Controller interface {
+	Authorize(ctx context.Context) menderError
+	Bootstrap() menderError
+	GetCurrentArtifactName() string
+	GetUpdatePollInterval() time.Duration
+	GetInventoryPollInterval() time.Duration
+	GetRetryPollInterval() time.Duration
+	GetAuthTokenRefreshTime() time.Time
+	HasUpgrade() (bool, menderError)
+	CheckUpdate(ctx context.Context) (*client.UpdateResponse, menderError)
+	FetchUpdate(ctx context.Context, update client.UpdateResponse) (io.ReadCloser, int64, error)
+	VerifyUpdateHeader(ctx context.Context, update client.UpdateResponse) menderError
+	CheckArtifactAvailable(ctx context.Context,
+		update client.UpdateResponse) (client.UpdateResponse, menderError)
+	ReportUpdateStatus(ctx context.Context, update client.UpdateResponse, status string) menderError
+	ReportUpdateSubState(ctx context.Context, update client.UpdateResponse, status, subState string) menderError
+	// Report progress status in the background; see statusPipeline. Fails
+	// if an earlier background report found the deployment aborted.
+	ReportUpdateStatusAsync(ctx context.Context, update client.UpdateResponse, status string) menderError
+	ReportUpdateDeferred(ctx context.Context, update client.UpdateResponse, until time.Time, reason string) menderError
+	DeferUpdate(update client.UpdateResponse) (time.Time, string)
+	FilterUpdate(update client.UpdateResponse) error
+	// Install the artifact of the deployment; InstallUpdate of the
+	// UInstaller writes the image to the device only.
+	InstallArtifact(update client.UpdateResponse, from io.ReadCloser, size int64) error
+	PayloadVerdict(update client.UpdateResponse) error
+	// Copy logs of the previous, failed boot to the deployment log.
+	LogPreviousBoot()
+	SnapshotData(update client.UpdateResponse)
+	RestoreDataSnapshot(update client.UpdateResponse)
+	DropDataSnapshot()
+	// Remove leftovers of earlier deployments once the update is committed.
+	CleanupCommitted(update client.UpdateResponse)
+	PendingCommand() *DeviceCommand
+	Decommission() menderError
+	ClearQuarantine() menderError
+	EnableDebugLogging(command DeviceCommand) error
+	// Remove authorization data once the server rejected the device.
+	HandleRejection() menderError
+	GetRejectedRetryInterval() time.Duration
+	GetRejectedUnauthorizedAttempts() int
+	SetUpdateMarker(update client.UpdateResponse, state string)
+	CommitHolds() []string
+	CommitHoldReleased() <-chan struct{}
+	GetCommitHoldPolicy() (time.Duration, string)
+	GetStateTimeout(state MenderState) time.Duration
+	RevalidateUpdate(ctx context.Context, update client.UpdateResponse,
+		checked time.Time) menderError
+	GetRebootGracePeriod() time.Duration
+	// Inhibitors blocking install and reboot, and how long they may.
+	UpdateInhibitors() []string
+	GetMaxInhibit() time.Duration
+	NotifyReboot(update client.UpdateResponse, in time.Duration)
+	GetRebootMode() string
+	RebootRequired() bool
+	RequestReboot()
+	CleanupUpdate() error
+	UploadLog(ctx context.Context, update client.UpdateResponse, logs []byte) menderError
+	InventoryRefresh(ctx context.Context) error
+	// Inventory for submitting in the background during deployments; taken
+	// on the state machine goroutine, so that the background task does not
+	// touch the controller.
+	InventorySnapshot() inventorySnapshot
+	GetConfigurationPollInterval() time.Duration
+	UpdateConfiguration(ctx context.Context) menderError
+
+	UInstallCommitRebooter
+	StateRunner
+}
+
+const (
+	defaultKeyFile = "mender-agent.pem"
+
+	// leading part of the artifact fetched for verification before
+	// downloading the whole artifact; large enough to hold artifact info
+	// and header info
+	artifactHeaderFetchSize = 16 * 1024
+)
+
+var (
+	defaultArtifactInfoFile = path.Join(getConfDirPath(), "artifact_info")
+	defaultDeviceTypeFile   = path.Join(getStateDirPath(), "device_type")
+	defaultDataStore        = getStateDirPath()
+)
+
+type MenderState int
+
+const (
+	// initial state
+	MenderStateInit MenderState = iota
+	// client is bootstrapped, i.e. ready to go
+	MenderStateBootstrapped
+	// client has all authorization data available
+	MenderStateAuthorized
+	// wait before authorization attempt
+	MenderStateAuthorizeWait
+	// inventory update
+	MenderStateInventoryUpdate
+	// wait for new update or inventory sending
+	MenderStateCheckWait
+	// check update
+	MenderStateUpdateCheck
+	// update fetch
+	MenderStateUpdateFetch
+	// update install
+	MenderStateUpdateInstall
+	// wait before retrying fetch & install after first failing (timeout,
+	// for example)
+	MenderStateFetchInstallRetryWait
+	// varify update
+	MenderStateUpdateVerify
+	// commit needed
+	MenderStateUpdateCommit
+	// status report
+	MenderStateUpdateStatusReport
+	// errro reporting status
+	MenderStateReportStatusError
+	// reboot
+	MenderStateReboot
+	//rollback
+	MenderStateRollback
+	// error
+	MenderStateError
+	// update error
+	MenderStateUpdateError
+	// long wait after state loop was detected
+	MenderStateLoopWait
+	// update deferred by local policy
+	MenderStateUpdateDeferred
+	// execute command issued by the server
+	MenderStateDeviceCommand
+	// wait for applications to release the commit
+	MenderStateUpdateCommitHold
+	// clean up after failed install
+	MenderStateUpdateCleanup
+	// long wait after the device was rejected by the server
+	MenderStateRejected
+	// apply device configuration deployed by the server
+	MenderStateConfigurationUpdate
+	// exit state
+	MenderStateDone
+)
+
+var (
+	stateNames = map[MenderState]string{
+		MenderStateInit:                  "init",
+		MenderStateBootstrapped:          "bootstrapped",
+		MenderStateAuthorized:            "authorized",
+		MenderStateAuthorizeWait:         "authorize-wait",
+		MenderStateInventoryUpdate:       "inventory-update",
+		MenderStateCheckWait:             "check-wait",
+		MenderStateUpdateCheck:           "update-check",
+		MenderStateUpdateFetch:           "update-fetch",
+		MenderStateUpdateInstall:         "update-install",
+		MenderStateFetchInstallRetryWait: "fetch-install-retry-wait",
+		MenderStateUpdateVerify:          "update-verify",
+		MenderStateUpdateCommit:          "update-commit",
+		MenderStateUpdateStatusReport:    "update-status-report",
+		MenderStateReportStatusError:     "status-report-error",
+		MenderStateReboot:                "reboot",
+		MenderStateRollback:              "rollback",
+		MenderStateError:                 "error",
+		MenderStateUpdateError:           "update-error",
+		MenderStateLoopWait:              "state-loop-wait",
+		MenderStateUpdateDeferred:        "update-deferred",
+		MenderStateDeviceCommand:         "device-command",
+		MenderStateUpdateCommitHold:      "update-commit-hold",
+		MenderStateUpdateCleanup:         "update-cleanup",
+		MenderStateRejected:              "rejected",
+		MenderStateConfigurationUpdate:   "configuration-update",
+		MenderStateDone:                  "finished",
+	}
+)
+
+func (m MenderState) MarshalJSON() ([]byte, error) {
+	n, ok := stateNames[m]
+	if !ok {
+		return nil, fmt.Errorf("marshal error; unknown state %v", m)
+	}
+	return json.Marshal(n)
+}
+
+func (m MenderState) String() string {
+	return stateNames[m]
+}
+
+func (m *MenderState) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	for k, v := range stateNames {
+		if v == s {
+			*m = k
+			return nil
+		}
+	}
+	return fmt.Errorf("unmarshal error; unknown state %s", s)
+}
+
+type mender struct {
+	UInstallCommitRebooter
+	updater          client.Updater
+	state            State
+	config           MenderConfig
+	artifactInfoFile string
+	deviceTypeFile   string
+	forceBootstrap   bool
+	authReq          client.AuthRequester
+	authMgr          AuthManager
+	api              *client.ApiClient
+	// client for artifact downloads; the same as api unless bound to
+	// different network device
+	downloadAPI *client.ApiClient
+	authToken   client.AuthToken
+	store       Store
+	migration   *serverMigration
+	policies    []UpdatePolicy
+	// inventory attributes supplied by the program embedding the agent
+	inventorySources []InventorySource
+	artifactFilter   *artifactFilter
+	payloadScanner   *payloadScanner
+	tpm              *tpmMeasurement
+	bootLogs         *bootLogCollector
+	dataSnapshot     *dataSnapshot
+	inhibitors       *updateInhibitors
+	metrics          *metricsBus
+	notifier         *notifier
+	pollHint         *pollIntervalHint
+	reportFields     *reportFields
+	eventStream      *eventStream
+	events           *eventSequence
+	deviceAudit      *deviceAudit
+	// shared by all clients talking to the server
+	requestQueue     *client.RequestQueue
+	transitions      *transitionLog
+	endpoints        *endpointHealth
+	commands         *commandVerifier
+	debugLogging     *debugLogging
+	pendingCommand   *DeviceCommand
+	configuration    *configurationManager
+	updateMarkerFile string
+	cmdr             Commander
+	commitHolds      *commitHolds
+	statusReports    *statusPipeline
+	stateTimes       *stateTimes
+	scratch          *scratchDir
+	deploymentDirs   *deploymentDirs
+	linkProber       *linkProber
+	// deployment logs of the agent; none are kept if not set
+	logManager *DeploymentLogManager
+}
+
+type MenderPieces struct {
+	device  UInstallCommitRebooter
+	store   Store
+	authMgr AuthManager
+	// authorization manager for the migration server (optional)
+	migrationAuthMgr AuthManager
+	// location of temporary files of the update process (optional)
+	scratch *scratchDir
+	// data files saved before install (optional)
+	dataSnapshot *dataSnapshot
+}
+
+// Set up client for talking to the server as configured: headers, request
+// limits, fallback resolver and network device to bind to.
+func (m *mender) setupApiClient(api *client.ApiClient, device string) error {
+	api.SetHeaders(m.config.GetHttpHeaders(m.GetDeviceType()))
+	api.SetRequestQueue(m.requestQueue)
+	if m.config.DNSOverHTTPSResolver != "" {
+		if err := api.SetDoHResolver(m.config.DNSOverHTTPSResolver); err != nil {
+			return err
+		}
+	}
+	return api.SetBindDevice(device)
+}
+
+func NewMender(config MenderConfig, pieces MenderPieces) (*mender, error) {
+	api, err := client.New(config.GetHttpConfig())
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating HTTP client")
+	}
+	apiVersion, err := client.ParseApiVersion(config.ServerAPIVersion)
+	if err != nil {
+		return nil, err
+	}
+	updater := client.NewUpdate()
+	updater.SetApiVersion(apiVersion)
+
+	m := &mender{
+		UInstallCommitRebooter: pieces.device,
+		updater:                updater,
+		artifactInfoFile:       defaultArtifactInfoFile,
+		deviceTypeFile:         defaultDeviceTypeFile,
+		updateMarkerFile:       defaultUpdateMarkerFile,
+		cmdr:                   &osCalls{},
+		state:                  initState,
+		config:                 config,
+		authMgr:                pieces.authMgr,
+		authReq:                client.NewAuth(),
+		api:                    api,
+		authToken:              noAuthToken,
+		store:                  pieces.store,
+		commitHolds:            newCommitHolds(pieces.store, defaultCommitHoldDir),
+		scratch:                pieces.scratch,
+		deploymentDirs:         newDeploymentDirs(pieces.scratch),
+		bootLogs:               newBootLogCollector(config),
+		dataSnapshot:           pieces.dataSnapshot,
+		pollHint:               newPollIntervalHint(config),
+		reportFields:           newReportFields(config),
+		linkProber:             newLinkProber(config),
+		requestQueue: client.NewRequestQueue(config.APIMaxConcurrentRequests,
+			config.APIMaxRequestsPerMinute),
+		transitions: &transitionLog{},
+		endpoints:   newEndpointHealth(),
+	}
+	if err := m.setupApiClient(api, config.APIBindDevice); err != nil {
+		return nil, err
+	}
+	for _, setup := range menderSetup {
+		if err := setup(m, config, pieces); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Remaining parts of the controller, set up in order by NewMender; most are
+// optional and left nil unless configured.
+var menderSetup = []func(m *mender, config MenderConfig, pieces MenderPieces) error{
+	(*mender).setupDownloadAPI,
+	func(m *mender, config MenderConfig, pieces MenderPieces) error {
+		m.debugLogging = &debugLogging{apis: []*client.ApiClient{m.api}}
+		if m.downloadAPI != m.api {
+			m.debugLogging.apis = append(m.debugLogging.apis, m.downloadAPI)
+		}
+		m.statusReports = newStatusPipeline()
+		m.setupMigration(pieces.migrationAuthMgr)
+		return nil
+	},
+	func(m *mender, config MenderConfig, pieces MenderPieces) error {
+		// keep event sequence growing across restarts
+		m.events = newEventSequence(pieces.store)
+		m.stateTimes = newStateTimes(pieces.store, m.state.Id(), time.Now())
+		m.eventStream = newEventStream(config, pieces.store, m.events)
+		if dev, ok := pieces.device.(auditedDevice); ok && config.DeviceOperationAudit {
+			m.deviceAudit = newDeviceAudit(pieces.store)
+			dev.setAudit(m.deviceAudit)
+		}
+		m.eventStream.recordBoot(m.GetCurrentArtifactName())
+		return nil
+	},
+	func(m *mender, config MenderConfig, pieces MenderPieces) error {
+		return validateCommitHoldAction(config.CommitHoldExpiredAction)
+	},
+	func(m *mender, config MenderConfig, pieces MenderPieces) error {
+		return validateRebootMode(config.RebootMode)
+	},
+	func(m *mender, config MenderConfig, pieces MenderPieces) error {
+		return validateStateTimeouts(config.StateTimeoutsSeconds)
+	},
+	func(m *mender, config MenderConfig, pieces MenderPieces) error {
+		return validateRejectedKeyPolicy(config.RejectedKeyPolicy)
+	},
+	func(m *mender, config MenderConfig, pieces MenderPieces) error {
+		return validateAlreadyInstalledCheck(config.AlreadyInstalledCheck)
+	},
+	func(m *mender, config MenderConfig, pieces MenderPieces) error {
+		return validateBundleCommands(config.ExternalBundleInstallers)
+	},
+	func(m *mender, config MenderConfig, pieces MenderPieces) (err error) {
+		m.commands, err = newCommandVerifier(config, pieces.store)
+		return err
+	},
+	func(m *mender, config MenderConfig, pieces MenderPieces) (err error) {
+		m.artifactFilter, err = newArtifactFilter(config.ArtifactFilters)
+		return err
+	},
+	func(m *mender, config MenderConfig, pieces MenderPieces) (err error) {
+		m.payloadScanner, err = newPayloadScanner(config)
+		return err
+	},
+	func(m *mender, config MenderConfig, pieces MenderPieces) (err error) {
+		m.notifier, err = newNotifier(config)
+		if m.notifier != nil {
+			m.notifier.dirs = m.deploymentDirs
+		}
+		return err
+	},
+	func(m *mender, config MenderConfig, pieces MenderPieces) (err error) {
+		m.configuration, err = newConfigurationManager(config, pieces.store)
+		return err
+	},
+	func(m *mender, config MenderConfig, pieces MenderPieces) (err error) {
+		m.tpm, err = newTPMMeasurement(config, pieces.store, pieces.scratch)
+		return err
+	},
+	(*mender).setupUpdatePolicies,
+	(*mender).setupMetrics,
+}
+
+// Separate client for downloads if they are bound to another device than
+// the API requests.
+func (m *mender) setupDownloadAPI(config MenderConfig, pieces MenderPieces) error {
+	m.downloadAPI = m.api
+	if config.DownloadBindDevice == "" ||
+		config.DownloadBindDevice == config.APIBindDevice {
+		return nil
+	}
+	api, err := client.New(config.GetHttpConfig())
+	if err != nil {
+		return errors.Wrap(err, "error creating HTTP client")
+	}
+	if err := m.setupApiClient(api, config.DownloadBindDevice); err != nil {
+		return err
+	}
+	m.downloadAPI = api
+	return nil
+}
+
+func (m *mender) setupUpdatePolicies(config MenderConfig, pieces MenderPieces) error {
+	if config.UpdateMaintenanceWindow != "" {
+		mw, err := parseMaintenanceWindow(config.UpdateMaintenanceWindow)
+		if err != nil {
+			return err
+		}
+		m.AddUpdatePolicy(mw)
+	}
+	if m.inhibitors = newUpdateInhibitors(config); m.inhibitors != nil {
+		m.AddUpdatePolicy(m.inhibitors)
+	}
+	return nil
+}
+
+func (m *mender) setupMetrics(config MenderConfig, pieces MenderPieces) error {
+	m.metrics = newMetricsBus()
+	resource := map[string]string{}
+	if config.MetricsOTLPEndpoint != "" {
+		resource["mender.device_type"] = m.GetDeviceType()
+	}
+	exporters, err := configMetricsExporters(config, resource)
+	if err != nil {
+		return err
+	}
+	for _, e := range exporters {
+		m.AddMetricsExporter(e)
+	}
+	return nil
+}
+
+func getManifestData(dataType, manifestFile string) string {
+	// This is where Yocto stores buid information
+	manifest, err := os.Open(manifestFile)
+	if err != nil {
+		log.Error("Can not read manifest data.")
+		return ""
+	}
+
+	scanner := bufio.NewScanner(manifest)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		log.Debug("Read data from device manifest file: ", line)
+		if strings.HasPrefix(line, dataType) {
+			log.Debug("Found needed line: ", line)
+			lineID := strings.Split(line, "=")
+			if len(lineID) != 2 {
+				log.Errorf("Broken device manifest file: (%v)", lineID)
+				return ""
+			}
+			log.Debug("Current manifest data: ", strings.TrimSpace(lineID[1]))
+			return strings.TrimSpace(lineID[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Error(err)
+	}
+	return ""
+}
+
+func (m *mender) GetCurrentArtifactName() string {
+	return getManifestData("artifact_name", m.artifactInfoFile)
+}
+
+func (m *mender) GetDeviceType() string {
+	return getManifestData("device_type", m.deviceTypeFile)
+}
+
+// Update channel selected for the device; empty if none.
+func (m *mender) GetUpdateChannel() string {
+	if m.store == nil {
+		return ""
+	}
+	channel, err := loadUpdateChannel(m.store)
+	if err != nil {
+		log.Errorf("failed to load update channel: %v", err)
+	}
+	return channel
+}
+
+func GetCurrentArtifactName(artifactInfoFile string) string {
+	return getManifestData("artifact_name", artifactInfoFile)
+}
+
+func GetDeviceType(deviceTypeFile string) string {
+	return getManifestData("device_type", deviceTypeFile)
+}
+
+func (m *mender) HasUpgrade() (bool, menderError) {
+	has, err := m.UInstallCommitRebooter.HasUpdate()
+	if err != nil {
+		return false, NewFatalError(err)
+	}
+	return has, nil
+}
+
+func (m *mender) ForceBootstrap() {
+	m.forceBootstrap = true
+}
+
+func (m *mender) needsBootstrap() bool {
+	if m.forceBootstrap {
+		return true
+	}
+
+	if !m.authMgr.HasKey() {
+		log.Debugf("needs keys")
+		return true
+	}
+
+	return false
+}
+
+func (m *mender) Bootstrap() menderError {
+	if !m.needsBootstrap() {
+		return nil
+	}
+
+	return m.doBootstrap()
+}
+
+// cache authorization code
+func (m *mender) loadAuth() menderError {
+	if m.authToken != noAuthToken {
+		return nil
+	}
+
+	code, err := m.authMgr.AuthToken()
+	if err != nil {
+		return NewFatalError(errors.Wrap(err, "failed to cache authorization code"))
+	}
+
+	m.authToken = code
+	return nil
+}
+
+func (m *mender) Authorize(ctx context.Context) menderError {
+	if merr := m.authorize(ctx); merr != nil {
+		return merr
+	}
+
+	m.authorizeMigration(ctx)
+	return nil
+}
+
+func (m *mender) authorize(ctx context.Context) menderError {
+	if m.authMgr.IsAuthorized() {
+		log.Info("authorization data present and valid, skipping authorization attempt")
+		return m.loadAuth()
+	}
+
+	m.authToken = noAuthToken
+
+	api := &responseObserver{ApiRequester: m.api}
+	rsp, err := m.authReq.Request(ctx, api, m.config.ServerURL, m.authMgr)
+	if api.header != nil {
+		m.pollHint.update(api.header)
+	}
+	m.endpoints.record(endpointAuth, err, time.Now())
+	if err != nil {
+		if err == client.AuthErrorUnauthorized || err == client.AuthErrorRejected {
+			// make sure to remove auth token once device is rejected
+			if remErr := m.authMgr.RemoveAuthToken(); remErr != nil {
+				log.Warn("can not remove rejected authentication token")
+			}
+		}
+		return NewTransientError(errors.Wrap(err, "authorization request failed"))
+	}
+
+	err = m.authMgr.RecvAuthResponse(rsp)
+	if err != nil {
+		return NewTransientError(errors.Wrap(err, "failed to parse authorization response"))
+	}
+
+	log.Info("successfuly received new authorization data")
+
+	return m.loadAuth()
+}
+
+func (m *mender) doBootstrap() menderError {
+	if !m.authMgr.HasKey() || m.forceBootstrap {
+		log.Infof("device keys not present or bootstrap forced, generating")
+		if err := m.authMgr.GenerateKey(); err != nil {
+			return NewFatalError(err)
+		}
+
+	}
+
+	m.forceBootstrap = false
+
+	return nil
+}
+
+// Verify artifact header before downloading the whole artifact. Returns fatal
+// error if the artifact is not compatible with the device. The update is
+// let through if the header could not be checked, as the artifact is verified
+// again while it is being installed. Returns error with os.ErrExist cause if
+// the artifact provides what is installed already, unless the deployment
+// forces it to be installed again.
+func (m *mender) VerifyUpdateHeader(ctx context.Context,
+	update client.UpdateResponse) menderError {
+	hdr, err := m.updater.FetchUpdateHeader(ctx, m.downloadAPI, update.URI(),
+		artifactHeaderFetchSize)
+	if err != nil {
+		return NewTransientError(err)
+	}
+	defer hdr.Close()
+
+	digests, err := installer.ReadHeaderDigests(hdr, m.GetDeviceType(), update.ArtifactName())
+	if errors.Cause(err) == installer.ErrIncompatibleArtifact {
+		return NewFatalError(err)
+	}
+	sameName := update.ArtifactName() == m.GetCurrentArtifactName() &&
+		!m.forceReinstall(update)
+	if err != nil {
+		log.Warnf("failed to verify artifact header before download: %v", err)
+		if sameName && !m.checkInstalledDigests() {
+			// payloads can not be compared, names have to do
+			return NewTransientError(os.ErrExist)
+		}
+		return nil
+	}
+
+	if sameName {
+		p := loadArtifactProvides(m.store, providesName)
+		if p.provides(update.ArtifactName(), digests) {
+			log.Infof("payloads of artifact %s are installed already", update.ArtifactName())
+			return NewTransientError(os.ErrExist)
+		}
+		// payloads of the running artifact were not recorded
+		if m.checkInstalledDigests() && (p == nil || p.ArtifactName != update.ArtifactName()) &&
+			m.activeRootfsMatches(digests) {
+			log.Infof("active root filesystem is the payload of artifact %s",
+				update.ArtifactName())
+			return NewTransientError(os.ErrExist)
+		}
+		log.Warnf("artifact %s differs from the installed one of the same name, "+
+			"installing", update.ArtifactName())
+	}
+	return nil
+}
+
+// What the device runs, for update checks.
+func (m *mender) currentUpdate(ctx context.Context) client.CurrentUpdate {
+	capabilities := m.deviceCapabilities()
+	if capabilities != nil {
+		probe := m.probeLink(ctx)
+		capabilities.ProbeLatencyMs = probe.LatencyMs
+		capabilities.ProbeSpeed = probe.Speed
+	}
+	return client.CurrentUpdate{
+		Artifact:     m.GetCurrentArtifactName(),
+		DeviceType:   m.GetDeviceType(),
+		Channel:      m.GetUpdateChannel(),
+		Capabilities: capabilities,
+	}
+}
+
+// Check if new update is available. In case of errors, returns nil and error
+// that occurred. If no update is available *UpdateResponse is nil, otherwise it
+// contains update information.
+func (m *mender) CheckUpdate(ctx context.Context) (*client.UpdateResponse, menderError) {
+	currentArtifactName := m.GetCurrentArtifactName()
+	//TODO: if currentArtifactName == "" {
+	// 	return errors.New("")
+	// }
+
+	api := &responseObserver{ApiRequester: m.api.Request(m.authToken)}
+	haveUpdate, err := m.updater.GetScheduledUpdate(ctx, api,
+		m.config.ServerURL, m.currentUpdate(ctx))
+	if api.header != nil {
+		m.pollHint.update(api.header)
+	}
+	m.eventStream.connectivity(err, time.Now())
+	m.endpoints.record(endpointDeployments, err, time.Now())
+
+	if err != nil {
+		// remove authentication token if device is not authorized
+		if err == client.ErrNotAuthorized {
+			if remErr := m.authMgr.RemoveAuthToken(); remErr != nil {
+				log.Warn("can not remove rejected authentication token")
+			}
+		}
+		log.Error("Error receiving scheduled update data: ", err)
+		return nil, NewTransientError(err)
+	}
+
+	m.sendEvents(ctx)
+
+	if haveUpdate == nil {
+		log.Debug("no updates available")
+		// act on directives only when there is no deployment in progress
+		// with the current server
+		m.receiveCommand(api.header.Get(client.DeviceCommandHeader),
+			api.header.Get(client.DeviceCommandSignatureHeader))
+		m.handleMigrationDirective(api.header.Get(client.MigrateToHeader))
+		return nil, nil
+	}
+	update, ok := haveUpdate.(client.UpdateResponse)
+	if !ok {
+		return nil, NewTransientError(errors.Errorf("not an update response?"))
+	}
+
+	log.Debugf("received update response: %v", update)
+
+	if update.ArtifactName() == currentArtifactName {
+		if m.forceReinstall(update) {
+			log.Infof("deployment %s is forced, installing artifact %s again",
+				update.ID, currentArtifactName)
+			return &update, nil
+		}
+		if p := loadArtifactProvides(m.store, providesName); m.checkInstalledDigests() ||
+			(p != nil && p.ArtifactName == currentArtifactName) {
+			// name may have been reused; payloads are compared once
+			// artifact header is fetched
+			log.Infof("artifact %s is installed already, comparing payloads",
+				currentArtifactName)
+			return &update, nil
+		}
+		log.Info("Attempting to upgrade to currently installed artifact name, not performing upgrade.")
+		return &update, NewTransientError(os.ErrExist)
+	}
+	return &update, nil
+}
+
+func (m *mender) ReportUpdateStatus(ctx context.Context, update client.UpdateResponse,
+	status string) menderError {
+	return m.ReportUpdateSubState(ctx, update, status, "")
+}
+
+// Report update status along with substate giving details about it.
+func (m *mender) ReportUpdateSubState(ctx context.Context, update client.UpdateResponse,
+	status, subState string) menderError {
+	// earlier progress reports go first
+	if !m.statusReports.Flush(ctx) {
+		return NewTransientError(ctx.Err())
+	}
+	return m.reportStatus(ctx, update, status, subState)
+}
+
+func (m *mender) ReportUpdateStatusAsync(ctx context.Context, update client.UpdateResponse,
+	status string) menderError {
+	if m.statusReports.Aborted(update.ID) {
+		return NewFatalError(client.ErrDeploymentAborted)
+	}
+	// token and server may change by the time the report is sent
+	report := m.statusReport(update, status, "")
+	api := m.api.Request(m.authToken)
+	server := m.config.ServerURL
+	m.statusReports.Enqueue(ctx, update.ID, status, func(ctx context.Context) menderError {
+		return sendStatusReport(ctx, api, server, report)
+	})
+	return nil
+}
+
+func (m *mender) reportStatus(ctx context.Context, update client.UpdateResponse,
+	status, subState string) menderError {
+	return sendStatusReport(ctx, m.api.Request(m.authToken), m.config.ServerURL,
+		m.statusReport(update, status, subState))
+}
+
+func (m *mender) statusReport(update client.UpdateResponse,
+	status, subState string) client.StatusReport {
+	report := client.StatusReport{
+		DeploymentID: update.ID,
+		Status:       status,
+		SubState:     subState,
+		Extra:        m.reportFields.get(),
+	}
+	switch status {
+	case client.StatusSuccess, client.StatusFailure,
+		client.StatusAlreadyInstalled:
+		report.StateDurations = m.stateTimes.deploymentSeconds(update.ID,
+			time.Now())
+	}
+	return m.events.stampStatusReport(report)
+}
+
+func sendStatusReport(ctx context.Context, api client.ApiRequester, server string,
+	report client.StatusReport) menderError {
+	s := client.NewStatus()
+	err := s.Report(ctx, api, server, report)
+	if err != nil {
+		log.Error("error reporting update status: ", err)
+		if err == client.ErrDeploymentAborted {
+			return NewFatalError(err)
+		}
+		// request rejected by the server, retrying will not help
+		if client.ClassifyError(err) == client.ErrorClassTerminal {
+			return NewFatalError(err)
+		}
+		return NewTransientError(err)
+	}
+	return nil
+}
+
+// Report that installing the update was deferred by local policy.
+func (m *mender) ReportUpdateDeferred(ctx context.Context, update client.UpdateResponse,
+	until time.Time, reason string) menderError {
+	m.eventStream.record(client.EventUpdateDeferred, update.ID, map[string]string{
+		"until":  until.UTC().Format(time.RFC3339),
+		"reason": reason,
+	})
+	s := client.NewStatus()
+	err := s.Report(ctx, m.api.Request(m.authToken), m.config.ServerURL,
+		m.events.stampStatusReport(client.StatusReport{
+			DeploymentID: update.ID,
+			Status:       client.StatusDeferred,
+			SubState:     deferredSubState(until, reason),
+			Extra:        m.reportFields.get(),
+		}))
+	if err != nil {
+		log.Error("error reporting deferred update: ", err)
+		if err == client.ErrDeploymentAborted {
+			return NewFatalError(err)
+		}
+		return NewTransientError(err)
+	}
+	return nil
+}
+
+// Add local policy consulted before installing updates.
+func (m *mender) AddUpdatePolicy(p UpdatePolicy) {
+	m.policies = append(m.policies, p)
+}
+
+func (m *mender) AddMetricsExporter(e MetricsExporter) {
+	m.metrics.add(e)
+}
+
+// Check with update policies if update should be deferred. Returns zero time
+// if update can proceed, otherwise the latest time any of the policies asks
+// to defer the update until along with the reason.
+func (m *mender) DeferUpdate(update client.UpdateResponse) (time.Time, string) {
+	var until time.Time
+	var reason string
+
+	now := time.Now()
+	for _, p := range m.policies {
+		t, r := p.DeferUpdate(update, now)
+		if t.After(until) {
+			until = t
+			reason = r
+		}
+	}
+	return until, reason
+}
+
+// Check the artifact of the update against the configured artifact filter
+// rules.
+func (m *mender) FilterUpdate(update client.UpdateResponse) error {
+	if err := m.checkSkipped(update); err != nil {
+		return err
+	}
+	if err := m.checkQuarantine(); err != nil {
+		return err
+	}
+	return m.artifactFilter.check(update)
+}
+
+func (m *mender) UploadLog(ctx context.Context, update client.UpdateResponse,
+	logs []byte) menderError {
+	s := client.NewLog()
+	err := s.Upload(ctx, m.api.Request(m.authToken), m.config.ServerURL,
+		client.LogData{
+			DeploymentID: update.ID,
+			Messages:     logs,
+			Extra:        m.reportFields.get(),
+		})
+	if err != nil {
+		log.Error("error uploading logs: ", err)
+		if client.ClassifyError(err) == client.ErrorClassTerminal {
+			return NewFatalError(err)
+		}
+		return NewTransientError(err)
+	}
+	return nil
+}
+
+func (m mender) GetUpdatePollInterval() time.Duration {
+	t := time.Duration(m.config.UpdatePollIntervalSeconds) * time.Second
+	if t == 0 {
+		log.Warn("UpdatePollIntervalSeconds is not defined")
+		t = 30 * time.Minute
+	}
+	return m.pollHint.get(t)
+}
+
+func (m mender) GetInventoryPollInterval() time.Duration {
+	t := time.Duration(m.config.InventoryPollIntervalSeconds) * time.Second
+	if t == 0 {
+		log.Warn("InventoryPollIntervalSeconds is not defined")
+		t = 30 * time.Minute
+	}
+	return t
+}
+
+func (m mender) GetRetryPollInterval() time.Duration {
+	t := time.Duration(m.config.RetryPollIntervalSeconds) * time.Second
+	if t == 0 {
+		log.Warn("RetryPollIntervalSeconds is not defined")
+		t = 5 * time.Minute
+	}
+	return t
+}
+
+// Time when the current authorization token should be refreshed; zero time if
+// not known.
+func (m *mender) GetAuthTokenRefreshTime() time.Time {
+	return authTokenRefreshTime(m.authToken)
+}
+
+func (m *mender) SetState(s State) {
+	m.debugLogging.expire(time.Now())
+	logWithFields(logrus.Fields{LogFieldState: s.Id().String()}).Infof(
+		"Mender state: %s -> %s", m.state.Id(), s.Id())
+	deploymentID := ""
+	if fs, ok := s.(*UpdateFetchState); ok {
+		deploymentID = fs.update.ID
+		m.deviceAudit.begin(deploymentID, fs.update.DeploymentMetadata)
+		m.deploymentDirs.begin(deploymentID)
+	} else if deploymentEnded(m.state, s) {
+		m.deploymentDirs.end()
+	}
+	// seconds spent in states of the deployment ending
+	var durations map[string]float64
+	if usr, ok := s.(*UpdateStatusReportState); ok {
+		recordDeploymentResult(m.store, m.config.QuarantineAfterFailedDeployments,
+			usr.update.ID, usr.status, time.Now())
+		durations = m.stateTimes.deploymentSeconds(usr.update.ID, time.Now())
+	}
+	m.metrics.transition(s, durations, time.Now())
+	m.stateTimes.enter(s.Id(), deploymentID, time.Now())
+	m.transitions.record(m.state.Id(), s.Id(), time.Now())
+	if event, update := transitionEvent(m.state, s); update != nil {
+		m.notifier.notify(event, *update)
+		if event == notifyRollback {
+			m.eventStream.record(client.EventRollback, update.ID,
+				map[string]string{"artifact_name": update.ArtifactName()})
+		}
+	}
+	m.state = s
+}
+
+func (m *mender) GetState() State {
+	return m.state
+}
+
+func (m *mender) RunState(ctx *StateContext) (State, bool) {
+	return m.state.Handle(ctx, m)
+}
+
+// Send queued device events to the server.
+func (m *mender) sendEvents(ctx context.Context) {
+	m.eventStream.send(ctx, func(ctx context.Context, events []client.DeviceEvent) error {
+		return client.SendEvents(ctx, m.api.Request(m.authToken),
+			m.config.ServerURL, events)
+	})
+}
+
+func (m *mender) InventoryRefresh(ctx context.Context) error {
+	idata := m.inventoryData()
+
+	ic := client.NewInventory()
+	err := ic.Submit(ctx, m.api.Request(m.authToken), m.config.ServerURL, idata)
+	m.endpoints.record(endpointInventory, err, time.Now())
+	if err != nil {
+		return errors.Wrapf(err, "failed to submit inventory data")
+	}
+
+	if err := m.submitMigrationInventory(ctx, idata); err != nil {
+		log.Warn(err.Error())
+	}
+
+	return nil
+}
+
+func (m *mender) InventorySnapshot() inventorySnapshot {
+	idata := m.inventoryData()
+	api := m.api.Request(m.authToken)
+	server := m.config.ServerURL
+	return inventorySnapshot{
+		interval: m.GetInventoryPollInterval(),
+		submit: func(ctx context.Context) error {
+			return client.NewInventory().Submit(ctx, api, server, idata)
+		},
+	}
+}
+
+// Inventory of scripts and sources, along with attributes of the client.
+func (m *mender) inventoryData() client.InventoryData {
+	idg := NewInventoryDataRunner(path.Join(getDataDirPath(), "inventory"))
+	if m.config.InventoryScriptTimeoutSeconds > 0 {
+		idg.timeout = time.Duration(m.config.InventoryScriptTimeoutSeconds) * time.Second
+	}
+
+	idata, err := idg.Get()
+	if err != nil {
+		// at least report device type
+		log.Errorf("failed to obtain inventory data: %s", err.Error())
+	}
+	idata = m.collectInventorySources(idata)
+
+	reqAttr := m.clientInventoryAttributes()
+	if idata == nil {
+		idata = make(client.InventoryData, 0, len(reqAttr))
+	}
+	idata.ReplaceAttributes(reqAttr)
+	return idata
+}
+
+// Attributes describing the client itself and its state.
+func (m *mender) clientInventoryAttributes() []client.InventoryAttribute {
+	reqAttr := []client.InventoryAttribute{
+		{Name: "device_type", Value: m.GetDeviceType()},
+		{Name: "artifact_name", Value: m.GetCurrentArtifactName()},
+		{Name: "mender_client_version", Value: VersionString()},
+	}
+	if detected := stateLoopDetected(m.store); detected != "" {
+		reqAttr = append(reqAttr,
+			client.InventoryAttribute{Name: "mender_state_loop_detected", Value: detected})
+	}
+	if q := loadQuarantine(m.store); q.quarantined() {
+		reqAttr = append(reqAttr, client.InventoryAttribute{
+			Name:  "mender_quarantined",
+			Value: q.Since.UTC().Format(time.RFC3339),
+		})
+	}
+	if channel := m.GetUpdateChannel(); channel != "" {
+		reqAttr = append(reqAttr,
+			client.InventoryAttribute{Name: "update_channel", Value: channel})
+	}
+	if dev, ok := m.UInstallCommitRebooter.(appSlotDevice); ok {
+		if name := dev.AppArtifactName(); name != "" {
+			reqAttr = append(reqAttr,
+				client.InventoryAttribute{Name: "app_artifact_name", Value: name})
+		}
+	}
+	if warnings := m.checkCertExpiry(time.Now()); len(warnings) > 0 {
+		reqAttr = append(reqAttr, client.InventoryAttribute{
+			Name:  "mender_cert_expiry_warning",
+			Value: warnings,
+		})
+	}
+	if m.tpm != nil {
+		reqAttr = append(reqAttr, m.tpm.inventoryAttributes()...)
+	}
+	if m.config.InventoryInstallHistory {
+		if history, err := loadInstallHistory(m.store); err != nil {
+			log.Errorf("failed to load install history: %v", err)
+		} else if len(history) > 0 {
+			reqAttr = append(reqAttr, client.InventoryAttribute{
+				Name:  "mender_install_history",
+				Value: installHistorySummary(history),
+			})
+		}
+	}
+	return reqAttr
+}
+
+// InstallArtifact installs the artifact of the deployment from `from`, of
+// `size` bytes if known.
+func (m *mender) InstallArtifact(update client.UpdateResponse, from io.ReadCloser,
+	size int64) error {
+	image := from
+	var digest hash.Hash
+	if m.tpm != nil {
+		from, digest = m.tpm.hashArtifact(from)
+	}
+
+	started := time.Now()
+	var observe installer.PayloadObserver
+	if m.payloadScanner != nil {
+		observe = m.payloadScanner.observe
+	}
+	err := installRecordingProvides(from, m.GetDeviceType(), m.UInstallCommitRebooter,
+		m.store, observe)
+	if err != nil {
+		if m.payloadScanner != nil {
+			m.payloadScanner.abort()
+		}
+		return err
+	}
+
+	if m.tpm != nil {
+		// digest covers the whole artifact, including trailing padding
+		// the artifact reader does not consume
+		io.Copy(ioutil.Discard, from)
+		m.tpm.installed(digest)
+	}
+	if m.config.ReportDeviceCapabilities {
+		measureTransferRates(size, time.Since(started), image).save(m.store)
+	}
+	// whole artifact has been streamed by now
+	m.notifier.notify(notifyDownloadComplete, update)
+	return nil
+}
+
+func (m *mender) CommitUpdate() error {
+	if err := m.UInstallCommitRebooter.CommitUpdate(); err != nil {
+		return err
+	}
+	commitArtifactProvides(m.store)
+	if m.tpm != nil {
+		m.tpm.committed()
+	}
+	return nil
+}
+
+func (m *mender) LogPreviousBoot() {
+	m.bootLogs.collect()
+}
+
+// PayloadVerdict returns the verdict of the payload scanner on the update
+// installed last; nil if no scanner is configured.
+func (m *mender) PayloadVerdict(update client.UpdateResponse) error {
+	if m.payloadScanner != nil {
+		m.payloadScanner.outputDir = m.deploymentDirs.dir(update.ID)
+	}
+	return m.payloadScanner.verdict()
+}
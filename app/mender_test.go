@@ -11,15 +11,18 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
-package main
+package app
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"syscall"
@@ -29,6 +32,7 @@ import (
 	"github.com/mendersoftware/mender-artifact/parser"
 	atutils "github.com/mendersoftware/mender-artifact/test_utils"
 	"github.com/mendersoftware/mender-artifact/writer"
+	"github.com/mendersoftware/mender/app/testutils"
 	"github.com/mendersoftware/mender/client"
 	cltest "github.com/mendersoftware/mender/client/test"
 	"github.com/mendersoftware/mender/utils"
@@ -85,7 +89,7 @@ func Test_getArtifactName_haveArtifactName_returnsName(t *testing.T) {
 	assert.Equal(t, "mender-image", mender.GetCurrentArtifactName())
 }
 
-func newTestMender(runner *testOSCalls, config menderConfig, pieces testMenderPieces) *mender {
+func newTestMender(runner *testOSCalls, config MenderConfig, pieces testMenderPieces) *mender {
 	// fill out missing pieces
 
 	if pieces.store == nil {
@@ -93,7 +97,7 @@ func newTestMender(runner *testOSCalls, config menderConfig, pieces testMenderPi
 	}
 
 	if pieces.device == nil {
-		pieces.device = &fakeDevice{}
+		pieces.device = &testutils.FakeDevice{}
 	}
 
 	if pieces.authMgr == nil {
@@ -114,18 +118,24 @@ func newTestMender(runner *testOSCalls, config menderConfig, pieces testMenderPi
 	}
 
 	mender, _ := NewMender(config, pieces.MenderPieces)
+	if mender != nil {
+		// do not touch the real marker nor emit signals
+		mender.updateMarkerFile = ""
+		mender.commitHolds.dir = ""
+		mender.cmdr = nil
+	}
 	return mender
 }
 
 func newDefaultTestMender() *mender {
-	return newTestMender(nil, menderConfig{}, testMenderPieces{})
+	return newTestMender(nil, MenderConfig{}, testMenderPieces{})
 }
 
 func Test_ForceBootstrap(t *testing.T) {
 	// generate valid keys
 	ms := utils.NewMemStore()
 	mender := newTestMender(nil,
-		menderConfig{
+		MenderConfig{
 			DeviceKey: "temp.key",
 		},
 		testMenderPieces{
@@ -159,7 +169,7 @@ func Test_ForceBootstrap(t *testing.T) {
 
 func Test_Bootstrap(t *testing.T) {
 	mender := newTestMender(nil,
-		menderConfig{
+		MenderConfig{
 			DeviceKey: "temp.key",
 		},
 		testMenderPieces{},
@@ -185,7 +195,7 @@ func Test_BootstrappedHaveKeys(t *testing.T) {
 	assert.NoError(t, k.Save())
 
 	mender := newTestMender(nil,
-		menderConfig{
+		MenderConfig{
 			DeviceKey: "temp.key",
 		},
 		testMenderPieces{
@@ -210,7 +220,7 @@ func Test_BootstrapError(t *testing.T) {
 	ms.Disable(true)
 
 	var mender *mender
-	mender = newTestMender(nil, menderConfig{}, testMenderPieces{
+	mender = newTestMender(nil, MenderConfig{}, testMenderPieces{
 		MenderPieces: MenderPieces{
 			store: ms,
 		},
@@ -220,7 +230,7 @@ func Test_BootstrapError(t *testing.T) {
 	assert.Nil(t, mender.authMgr)
 
 	ms.Disable(false)
-	mender = newTestMender(nil, menderConfig{}, testMenderPieces{
+	mender = newTestMender(nil, MenderConfig{}, testMenderPieces{
 		MenderPieces: MenderPieces{
 			store: ms,
 		},
@@ -245,11 +255,11 @@ func Test_CheckUpdateSimple(t *testing.T) {
 
 	var mender *mender
 
-	mender = newTestMender(nil, menderConfig{
+	mender = newTestMender(nil, MenderConfig{
 		ServerURL: "bogusurl",
 	}, testMenderPieces{})
 
-	up, err := mender.CheckUpdate()
+	up, err := mender.CheckUpdate(context.Background())
 	assert.Error(t, err)
 	assert.Nil(t, up)
 
@@ -259,7 +269,7 @@ func Test_CheckUpdateSimple(t *testing.T) {
 	srv.Update.Has = true
 
 	mender = newTestMender(nil,
-		menderConfig{
+		MenderConfig{
 			ServerURL: srv.URL,
 		},
 		testMenderPieces{})
@@ -272,7 +282,7 @@ func Test_CheckUpdateSimple(t *testing.T) {
 	}
 
 	// test server expects current update information, request should fail
-	up, err = mender.CheckUpdate()
+	up, err = mender.CheckUpdate(context.Background())
 	assert.Error(t, err)
 	assert.Nil(t, nil)
 
@@ -286,30 +296,30 @@ func Test_CheckUpdateSimple(t *testing.T) {
 	// make artifact name same as current, will result in no updates being available
 	srv.Update.Data.Artifact.ArtifactName = currID
 
-	up, err = mender.CheckUpdate()
+	up, err = mender.CheckUpdate(context.Background())
 	assert.Equal(t, err, NewTransientError(os.ErrExist))
 	assert.NotNil(t, up)
 
 	// make artifact name different from current
 	srv.Update.Data.Artifact.ArtifactName = currID + "-fake"
 	srv.Update.Has = true
-	up, err = mender.CheckUpdate()
+	up, err = mender.CheckUpdate(context.Background())
 	assert.NoError(t, err)
 	assert.NotNil(t, up)
 	assert.Equal(t, *up, srv.Update.Data)
 
 	// pretend that we got 204 No Content from the server, i.e empty response body
 	srv.Update.Has = false
-	up, err = mender.CheckUpdate()
+	up, err = mender.CheckUpdate(context.Background())
 	assert.NoError(t, err)
 	assert.Nil(t, up)
 }
 
 func TestMenderHasUpgrade(t *testing.T) {
-	mender := newTestMender(nil, menderConfig{}, testMenderPieces{
+	mender := newTestMender(nil, MenderConfig{}, testMenderPieces{
 		MenderPieces: MenderPieces{
-			device: &fakeDevice{
-				retHasUpdate: true,
+			device: &testutils.FakeDevice{
+				RetHasUpdate: true,
 			},
 		},
 	})
@@ -318,10 +328,10 @@ func TestMenderHasUpgrade(t *testing.T) {
 	assert.NoError(t, err)
 	assert.True(t, h)
 
-	mender = newTestMender(nil, menderConfig{}, testMenderPieces{
+	mender = newTestMender(nil, MenderConfig{}, testMenderPieces{
 		MenderPieces: MenderPieces{
-			device: &fakeDevice{
-				retHasUpdate: false,
+			device: &testutils.FakeDevice{
+				RetHasUpdate: false,
 			},
 		},
 	})
@@ -330,10 +340,10 @@ func TestMenderHasUpgrade(t *testing.T) {
 	assert.NoError(t, err)
 	assert.False(t, h)
 
-	mender = newTestMender(nil, menderConfig{}, testMenderPieces{
+	mender = newTestMender(nil, MenderConfig{}, testMenderPieces{
 		MenderPieces: MenderPieces{
-			device: &fakeDevice{
-				retHasUpdateError: errors.New("failed"),
+			device: &testutils.FakeDevice{
+				RetHasUpdateError: errors.New("failed"),
 			},
 		},
 	})
@@ -342,7 +352,7 @@ func TestMenderHasUpgrade(t *testing.T) {
 }
 
 func TestMenderGetUpdatePollInterval(t *testing.T) {
-	mender := newTestMender(nil, menderConfig{
+	mender := newTestMender(nil, MenderConfig{
 		UpdatePollIntervalSeconds: 20,
 	}, testMenderPieces{})
 
@@ -351,7 +361,7 @@ func TestMenderGetUpdatePollInterval(t *testing.T) {
 }
 
 func TestMenderGetInventoryPollInterval(t *testing.T) {
-	mender := newTestMender(nil, menderConfig{
+	mender := newTestMender(nil, MenderConfig{
 		InventoryPollIntervalSeconds: 10,
 	}, testMenderPieces{})
 
@@ -425,7 +435,7 @@ func TestMenderAuthorize(t *testing.T) {
 	defer srv.Close()
 
 	mender := newTestMender(&runner,
-		menderConfig{
+		MenderConfig{
 			ServerURL: srv.URL,
 		},
 		testMenderPieces{
@@ -437,7 +447,7 @@ func TestMenderAuthorize(t *testing.T) {
 	assert.Equal(t, noAuthToken, mender.authToken)
 
 	// 1. client already authorized
-	err := mender.Authorize()
+	err := mender.Authorize(context.Background())
 	assert.NoError(t, err)
 	// no need to build send request if auth data is valid
 	assert.False(t, srv.Auth.Called)
@@ -446,7 +456,7 @@ func TestMenderAuthorize(t *testing.T) {
 	// 2. pretend caching of authorization code fails
 	authMgr.authtokenErr = errors.New("auth code load failed")
 	mender.authToken = noAuthToken
-	err = mender.Authorize()
+	err = mender.Authorize(context.Background())
 	assert.Error(t, err)
 	// no need to build send request if auth data is valid
 	assert.False(t, srv.Auth.Called)
@@ -455,7 +465,7 @@ func TestMenderAuthorize(t *testing.T) {
 
 	// 3. call the server, server denies authorization
 	authMgr.authorized = false
-	err = mender.Authorize()
+	err = mender.Authorize(context.Background())
 	assert.Error(t, err)
 	assert.False(t, err.IsFatal())
 	assert.True(t, srv.Auth.Called)
@@ -467,7 +477,7 @@ func TestMenderAuthorize(t *testing.T) {
 	// we need the server authorize the client
 	srv.Auth.Authorize = true
 	srv.Auth.Token = rspdata
-	err = mender.Authorize()
+	err = mender.Authorize(context.Background())
 	assert.Error(t, err)
 	assert.False(t, err.IsFatal())
 	assert.True(t, srv.Auth.Called)
@@ -480,7 +490,7 @@ func TestMenderAuthorize(t *testing.T) {
 	// server will authorize the client
 	srv.Auth.Authorize = true
 	srv.Auth.Token = rspdata
-	err = mender.Authorize()
+	err = mender.Authorize(context.Background())
 	// all good
 	assert.NoError(t, err)
 	// Authorize() should have reloaded the cache (token comes from mock
@@ -488,13 +498,34 @@ func TestMenderAuthorize(t *testing.T) {
 	assert.Equal(t, atok, mender.authToken)
 }
 
+func TestMenderAuthTokenRefreshTime(t *testing.T) {
+	exp := time.Now().Add(24 * time.Hour)
+	authMgr := &testAuthManager{
+		authorized: true,
+		authtoken:  makeTestJWT(exp),
+	}
+
+	mender := newTestMender(nil, MenderConfig{},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				authMgr: authMgr,
+			},
+		})
+	// not authorized yet, nothing to refresh
+	assert.True(t, mender.GetAuthTokenRefreshTime().IsZero())
+
+	assert.NoError(t, mender.Authorize(context.Background()))
+	assert.Equal(t, time.Unix(exp.Unix(), 0).Add(-defaultAuthTokenRefreshMargin),
+		mender.GetAuthTokenRefreshTime())
+}
+
 func TestMenderReportStatus(t *testing.T) {
 	srv := cltest.NewClientTestServer()
 	defer srv.Close()
 
 	ms := utils.NewMemStore()
 	mender := newTestMender(nil,
-		menderConfig{
+		MenderConfig{
 			ServerURL: srv.URL,
 		},
 		testMenderPieces{
@@ -506,14 +537,14 @@ func TestMenderReportStatus(t *testing.T) {
 
 	ms.WriteAll(authTokenName, []byte("tokendata"))
 
-	err := mender.Authorize()
+	err := mender.Authorize(context.Background())
 	assert.NoError(t, err)
 
 	srv.Auth.Verify = true
 	srv.Auth.Token = []byte("tokendata")
 
 	// 1. successful report
-	err = mender.ReportUpdateStatus(
+	err = mender.ReportUpdateStatus(context.Background(),
 		client.UpdateResponse{
 			ID: "foobar",
 		},
@@ -526,7 +557,7 @@ func TestMenderReportStatus(t *testing.T) {
 	srv.Reset()
 	srv.Auth.Token = []byte("footoken")
 	srv.Auth.Verify = true
-	err = mender.ReportUpdateStatus(
+	err = mender.ReportUpdateStatus(context.Background(),
 		client.UpdateResponse{
 			ID: "foobar",
 		},
@@ -540,7 +571,7 @@ func TestMenderReportStatus(t *testing.T) {
 	srv.Auth.Token = []byte("tokendata")
 	srv.Auth.Verify = true
 	srv.Status.Aborted = true
-	err = mender.ReportUpdateStatus(
+	err = mender.ReportUpdateStatus(context.Background(),
 		client.UpdateResponse{
 			ID: "foobar",
 		},
@@ -550,13 +581,94 @@ func TestMenderReportStatus(t *testing.T) {
 	assert.True(t, err.IsFatal())
 }
 
+func TestMenderReportStatusRejected(t *testing.T) {
+	status := http.StatusNotFound
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	mender := newTestMender(nil, MenderConfig{ServerURL: ts.URL}, testMenderPieces{})
+	update := client.UpdateResponse{ID: "foobar"}
+
+	// deployment is gone, retrying does not help
+	err := mender.ReportUpdateStatus(context.Background(), update, client.StatusSuccess)
+	assert.NotNil(t, err)
+	assert.True(t, err.IsFatal())
+
+	err = mender.UploadLog(context.Background(), update, []byte(`{"messages": []}`))
+	assert.NotNil(t, err)
+	assert.True(t, err.IsFatal())
+
+	// server overloaded, try again later
+	status = http.StatusServiceUnavailable
+	err = mender.ReportUpdateStatus(context.Background(), update, client.StatusSuccess)
+	assert.NotNil(t, err)
+	assert.False(t, err.IsFatal())
+
+	err = mender.UploadLog(context.Background(), update, []byte(`{"messages": []}`))
+	assert.NotNil(t, err)
+	assert.False(t, err.IsFatal())
+}
+
+func TestMenderReportSubState(t *testing.T) {
+	var report client.StatusReport
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&report)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	mender := newTestMender(nil, MenderConfig{ServerURL: ts.URL}, testMenderPieces{})
+
+	err := mender.ReportUpdateSubState(context.Background(),
+		client.UpdateResponse{ID: "foobar"}, client.StatusSuccess,
+		"commit released by applications")
+	assert.Nil(t, err)
+	assert.Equal(t, client.StatusSuccess, report.Status)
+	assert.Equal(t, "commit released by applications", report.SubState)
+}
+
+func TestMenderReportStateDurations(t *testing.T) {
+	var report client.StatusReport
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report = client.StatusReport{}
+		json.NewDecoder(r.Body).Decode(&report)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	mender := newTestMender(nil, MenderConfig{ServerURL: ts.URL}, testMenderPieces{})
+	update := client.UpdateResponse{ID: "foobar"}
+	mender.SetState(NewUpdateFetchState(update))
+	mender.SetState(NewUpdateInstallState(nil, 0, update))
+
+	// progress reports do not carry durations
+	err := mender.ReportUpdateStatus(context.Background(), update,
+		client.StatusInstalling)
+	assert.Nil(t, err)
+	assert.Nil(t, report.StateDurations)
+
+	err = mender.ReportUpdateStatus(context.Background(), update,
+		client.StatusSuccess)
+	assert.Nil(t, err)
+	assert.Contains(t, report.StateDurations, "update-fetch")
+	assert.Contains(t, report.StateDurations, "update-install")
+
+	// durations of other deployments are not reported
+	err = mender.ReportUpdateStatus(context.Background(),
+		client.UpdateResponse{ID: "other"}, client.StatusFailure)
+	assert.Nil(t, err)
+	assert.Nil(t, report.StateDurations)
+}
+
 func TestMenderLogUpload(t *testing.T) {
 	srv := cltest.NewClientTestServer()
 	defer srv.Close()
 
 	ms := utils.NewMemStore()
 	mender := newTestMender(nil,
-		menderConfig{
+		MenderConfig{
 			ServerURL: srv.URL,
 		},
 		testMenderPieces{
@@ -568,7 +680,7 @@ func TestMenderLogUpload(t *testing.T) {
 
 	ms.WriteAll(authTokenName, []byte("tokendata"))
 
-	err := mender.Authorize()
+	err := mender.Authorize(context.Background())
 	assert.NoError(t, err)
 
 	srv.Auth.Verify = true
@@ -580,7 +692,7 @@ func TestMenderLogUpload(t *testing.T) {
 { "time": "12:12:13", "level": "debug", "msg": "log bar" }]
 }`)
 
-	err = mender.UploadLog(
+	err = mender.UploadLog(context.Background(),
 		client.UpdateResponse{
 			ID: "foobar",
 		},
@@ -603,7 +715,7 @@ func TestMenderLogUpload(t *testing.T) {
 
 	// 2. pretend authorization fails, server expects a different token
 	srv.Auth.Token = []byte("footoken")
-	err = mender.UploadLog(
+	err = mender.UploadLog(context.Background(),
 		client.UpdateResponse{
 			ID: "foobar",
 		},
@@ -635,7 +747,7 @@ func TestAuthToken(t *testing.T) {
 
 	ms := utils.NewMemStore()
 	mender := newTestMender(nil,
-		menderConfig{
+		MenderConfig{
 			ServerURL: ts.URL,
 		},
 		testMenderPieces{
@@ -651,7 +763,7 @@ func TestAuthToken(t *testing.T) {
 
 	ts.Update.Unauthorized = true
 
-	_, updErr := mender.CheckUpdate()
+	_, updErr := mender.CheckUpdate(context.Background())
 	assert.EqualError(t, updErr.Cause(), client.ErrNotAuthorized.Error())
 
 	token, err = ms.ReadAll(authTokenName)
@@ -676,7 +788,7 @@ func TestMenderInventoryRefresh(t *testing.T) {
 
 	ms := utils.NewMemStore()
 	mender := newTestMender(nil,
-		menderConfig{
+		MenderConfig{
 			ServerURL: srv.URL,
 		},
 		testMenderPieces{
@@ -690,7 +802,7 @@ func TestMenderInventoryRefresh(t *testing.T) {
 
 	ms.WriteAll(authTokenName, []byte("tokendata"))
 
-	merr := mender.Authorize()
+	merr := mender.Authorize(context.Background())
 	assert.NoError(t, merr)
 
 	// prepare fake inventory scripts
@@ -710,7 +822,7 @@ func TestMenderInventoryRefresh(t *testing.T) {
 	// called with default inventory attributes only
 	srv.Auth.Verify = true
 	srv.Auth.Token = []byte("tokendata")
-	err = mender.InventoryRefresh()
+	err = mender.InventoryRefresh(context.Background())
 	assert.Nil(t, err)
 
 	assert.True(t, srv.Inventory.Called)
@@ -733,7 +845,7 @@ echo foo=bar`),
 	srv.Reset()
 	srv.Auth.Verify = true
 	srv.Auth.Token = []byte("tokendata")
-	err = mender.InventoryRefresh()
+	err = mender.InventoryRefresh(context.Background())
 	assert.Nil(t, err)
 	exp = []client.InventoryAttribute{
 		{Name: "device_type", Value: "foo-bar"},
@@ -745,9 +857,58 @@ echo foo=bar`),
 		assert.Contains(t, srv.Inventory.Attrs, a)
 	}
 
+	// 2a. flags and channel selection are reported too
+	markStateLoop(ms, time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC))
+	assert.NoError(t, storeUpdateChannel(ms, "beta"))
+	recordDeploymentResult(ms, 1, "dep-0", client.StatusFailure,
+		time.Date(2017, 1, 3, 0, 0, 0, 0, time.UTC))
+	srv.Reset()
+	srv.Auth.Verify = true
+	srv.Auth.Token = []byte("tokendata")
+	err = mender.InventoryRefresh(context.Background())
+	assert.Nil(t, err)
+	exp = []client.InventoryAttribute{
+		{Name: "mender_state_loop_detected", Value: "2017-01-02T03:04:05Z"},
+		{Name: "update_channel", Value: "beta"},
+		{Name: "mender_quarantined", Value: "2017-01-03T00:00:00Z"},
+	}
+	for _, a := range exp {
+		assert.Contains(t, srv.Inventory.Attrs, a)
+	}
+
+	// 2b. install history, if enabled
+	recordInstallStatus(ms, client.UpdateResponse{ID: "dep-1"}, client.StatusDownloading)
+	srv.Reset()
+	srv.Auth.Verify = true
+	srv.Auth.Token = []byte("tokendata")
+	assert.NoError(t, mender.InventoryRefresh(context.Background()))
+	for _, a := range srv.Inventory.Attrs {
+		assert.NotEqual(t, "mender_install_history", a.Name)
+	}
+
+	mender.config.InventoryInstallHistory = true
+	srv.Reset()
+	srv.Auth.Verify = true
+	srv.Auth.Token = []byte("tokendata")
+	assert.NoError(t, mender.InventoryRefresh(context.Background()))
+	assert.Contains(t, srv.Inventory.Attrs, client.InventoryAttribute{
+		Name: "mender_install_history", Value: []interface{}{" (downloading)"}})
+
+	// 2c. snapshot for the background task keeps the data and token it was
+	// taken with
+	snapshot := mender.InventorySnapshot()
+	mender.authToken = client.AuthToken("othertoken")
+	os.Remove(path.Join(invpath, "mender-inventory-foo"))
+	srv.Reset()
+	srv.Auth.Verify = true
+	srv.Auth.Token = []byte("tokendata")
+	assert.NoError(t, snapshot.submit(context.Background()))
+	assert.Contains(t, srv.Inventory.Attrs, client.InventoryAttribute{Name: "foo", Value: "bar"})
+	mender.authToken = client.AuthToken("tokendata")
+
 	// 3. pretend client is no longer authorized
 	srv.Auth.Token = []byte("footoken")
-	err = mender.InventoryRefresh()
+	err = mender.InventoryRefresh(context.Background())
 	assert.NotNil(t, err)
 
 	// restore old datadir path
@@ -787,10 +948,10 @@ func TestMenderInstallUpdate(t *testing.T) {
 	// prepare fake artifactInfo file, with bogus
 	deviceType := path.Join(td, "device_type")
 
-	mender := newTestMender(nil, menderConfig{},
+	mender := newTestMender(nil, MenderConfig{},
 		testMenderPieces{
 			MenderPieces: MenderPieces{
-				device: &fakeDevice{consumeUpdate: true},
+				device: &testutils.FakeDevice{ConsumeUpdate: true},
 			},
 		},
 	)
@@ -799,14 +960,14 @@ func TestMenderInstallUpdate(t *testing.T) {
 	// try some failure scenarios first
 
 	// EOF
-	err := mender.InstallUpdate(ioutil.NopCloser(&bytes.Buffer{}), 0)
+	err := mender.InstallArtifact(client.UpdateResponse{}, ioutil.NopCloser(&bytes.Buffer{}), 0)
 	assert.Error(t, err)
 	t.Logf("error: %v", err)
 
 	// some error from reader
 	mr := mockReader{}
 	mr.On("Read").Return(0, errors.New("failed"))
-	err = mender.InstallUpdate(ioutil.NopCloser(&mr), 0)
+	err = mender.InstallArtifact(client.UpdateResponse{}, ioutil.NopCloser(&mr), 0)
 	assert.Error(t, err)
 	t.Logf("error: %v", err)
 
@@ -822,30 +983,76 @@ func TestMenderInstallUpdate(t *testing.T) {
 	assert.NotNil(t, f)
 	// setup soem bogus device_type so that we don't match the update
 	ioutil.WriteFile(deviceType, []byte("device_type=bogusdevicetype\n"), 0644)
-	err = mender.InstallUpdate(f, 0)
+	err = mender.InstallArtifact(client.UpdateResponse{}, f, 0)
 	assert.Error(t, err)
 	f.Seek(0, 0)
 
 	// try with a legit device_type
 	ioutil.WriteFile(deviceType, []byte("device_type=vexpress-qemu\n"), 0644)
-	err = mender.InstallUpdate(f, 0)
+	err = mender.InstallArtifact(client.UpdateResponse{}, f, 0)
 	assert.NoError(t, err)
 	f.Seek(0, 0)
 
 	// now try with device throwing errors durin ginstall
-	mender = newTestMender(nil, menderConfig{},
+	mender = newTestMender(nil, MenderConfig{},
 		testMenderPieces{
 			MenderPieces: MenderPieces{
-				device: &fakeDevice{retInstallUpdate: errors.New("failed")},
+				device: &testutils.FakeDevice{RetInstallUpdate: errors.New("failed")},
 			},
 		},
 	)
 	mender.deviceTypeFile = deviceType
-	err = mender.InstallUpdate(f, 0)
+	err = mender.InstallArtifact(client.UpdateResponse{}, f, 0)
 	assert.Error(t, err)
 
 }
 
+func TestMenderVerifyUpdateHeader(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-verify-header-")
+	defer os.RemoveAll(td)
+
+	upath, err := makeFakeUpdate(t, path.Join(td, "update-root"), true)
+	assert.NoError(t, err)
+	art, err := ioutil.ReadFile(upath)
+	assert.NoError(t, err)
+
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=vexpress-qemu\n"), 0644)
+
+	update := client.UpdateResponse{}
+	update.Artifact.ArtifactName = "mender-1.1"
+
+	mender := newDefaultTestMender()
+	mender.deviceTypeFile = deviceType
+	mender.updater = testutils.FakeUpdater{
+		FetchUpdateHeaderReturnReadCloser: ioutil.NopCloser(bytes.NewReader(art)),
+	}
+	assert.Nil(t, mender.VerifyUpdateHeader(context.Background(), update))
+
+	// deployment for a different device type
+	ioutil.WriteFile(deviceType, []byte("device_type=bogusdevicetype\n"), 0644)
+	mender.updater = testutils.FakeUpdater{
+		FetchUpdateHeaderReturnReadCloser: ioutil.NopCloser(bytes.NewReader(art)),
+	}
+	merr := mender.VerifyUpdateHeader(context.Background(), update)
+	assert.Error(t, merr)
+	assert.True(t, merr.IsFatal())
+
+	// header could not be parsed, let the update through
+	mender.updater = testutils.FakeUpdater{
+		FetchUpdateHeaderReturnReadCloser: ioutil.NopCloser(bytes.NewReader(art[:10])),
+	}
+	assert.Nil(t, mender.VerifyUpdateHeader(context.Background(), update))
+
+	// fetching failed
+	mender.updater = testutils.FakeUpdater{
+		FetchUpdateHeaderReturnError: errors.New("connection reset"),
+	}
+	merr = mender.VerifyUpdateHeader(context.Background(), update)
+	assert.Error(t, merr)
+	assert.False(t, merr.IsFatal())
+}
+
 func TestMenderFetchUpdate(t *testing.T) {
 	srv := cltest.NewClientTestServer()
 	defer srv.Close()
@@ -854,7 +1061,7 @@ func TestMenderFetchUpdate(t *testing.T) {
 
 	ms := utils.NewMemStore()
 	mender := newTestMender(nil,
-		menderConfig{
+		MenderConfig{
 			ServerURL: srv.URL,
 		},
 		testMenderPieces{
@@ -864,7 +1071,7 @@ func TestMenderFetchUpdate(t *testing.T) {
 		})
 
 	ms.WriteAll(authTokenName, []byte("tokendata"))
-	merr := mender.Authorize()
+	merr := mender.Authorize(context.Background())
 	assert.NoError(t, merr)
 
 	// populate download data with random bytes
@@ -879,7 +1086,9 @@ func TestMenderFetchUpdate(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, rcount, len(rbytes))
 
-	img, sz, err := mender.FetchUpdate(srv.URL + "/api/devices/v1/download")
+	update := client.UpdateResponse{}
+	update.Artifact.Source.URI = srv.URL + "/api/devices/v1/download"
+	img, sz, err := mender.FetchUpdate(context.Background(), update)
 	assert.NoError(t, err)
 	assert.NotNil(t, img)
 	assert.EqualValues(t, len(rbytes), sz)
@@ -891,3 +1100,73 @@ func TestMenderFetchUpdate(t *testing.T) {
 
 	assert.True(t, bytes.Equal(rbytes, dl.Bytes()))
 }
+
+func TestMenderBindDevice(t *testing.T) {
+	mender := newTestMender(nil, MenderConfig{}, testMenderPieces{})
+	assert.True(t, mender.downloadAPI == mender.api)
+
+	mender = newTestMender(nil, MenderConfig{
+		APIBindDevice:      "lo",
+		DownloadBindDevice: "lo",
+	}, testMenderPieces{})
+	assert.True(t, mender.downloadAPI == mender.api)
+
+	// downloads go out different way
+	mender = newTestMender(nil, MenderConfig{
+		DownloadBindDevice: "lo",
+	}, testMenderPieces{})
+	assert.NotNil(t, mender.downloadAPI)
+	assert.False(t, mender.downloadAPI == mender.api)
+
+	_, err := NewMender(MenderConfig{APIBindDevice: "much-too-long-interface"},
+		MenderPieces{store: utils.NewMemStore()})
+	assert.Error(t, err)
+}
+
+func TestMenderRequestLimits(t *testing.T) {
+	mender := newTestMender(nil, MenderConfig{}, testMenderPieces{})
+	assert.Nil(t, mender.requestQueue)
+
+	mender = newTestMender(nil, MenderConfig{
+		APIMaxConcurrentRequests: 2,
+		DownloadBindDevice:       "lo",
+	}, testMenderPieces{})
+	assert.NotNil(t, mender.requestQueue)
+	assert.False(t, mender.downloadAPI == mender.api)
+}
+
+func TestMenderServerAPIVersion(t *testing.T) {
+	_, err := NewMender(MenderConfig{ServerAPIVersion: "9"},
+		MenderPieces{store: utils.NewMemStore()})
+	assert.Error(t, err)
+
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+
+	td, _ := ioutil.TempDir("", "mender-api-version")
+	defer os.RemoveAll(td)
+	artifactInfo := path.Join(td, "artifact_info")
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=fake-id"), 0600)
+	ioutil.WriteFile(deviceType, []byte("device_type=hammer"), 0600)
+
+	for _, version := range []string{"auto", "2"} {
+		mender := newTestMender(nil, MenderConfig{
+			ServerURL:        srv.URL,
+			ServerAPIVersion: version,
+		}, testMenderPieces{})
+		mender.artifactInfoFile = artifactInfo
+		mender.deviceTypeFile = deviceType
+
+		srv.Update.Current = client.CurrentUpdate{
+			Artifact:   "fake-id",
+			DeviceType: "hammer",
+		}
+		srv.Update.Has = true
+		srv.Update.Data.Artifact.ArtifactName = "fake-id-2"
+		up, err := mender.CheckUpdate(context.Background())
+		assert.Nil(t, err)
+		assert.NotNil(t, up)
+		assert.Equal(t, "fake-id-2", up.ArtifactName())
+	}
+}
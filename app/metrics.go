@@ -0,0 +1,214 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+)
+
+// Update metrics are pushed, as state transitions happen, to exporters:
+// statsd and OpenTelemetry (OTLP/HTTP) ones are built in, and programs
+// embedding the agent add their own. Fleets with an observability stack in
+// place get the metrics without scraping every device.
+
+type MetricType int
+
+const (
+	// number of events
+	MetricCounter MetricType = iota
+	// time taken, in seconds
+	MetricDuration
+)
+
+// Metric is a single sample passed to exporters.
+type Metric struct {
+	Name   string
+	Type   MetricType
+	Value  float64
+	Labels map[string]string
+	Time   time.Time
+}
+
+// MetricsExporter sends metrics to a monitoring system. Metrics are exported
+// in the background, one batch at a time; batches are dropped if exporting
+// does not keep up.
+type MetricsExporter interface {
+	ExportMetrics(metrics []Metric) error
+}
+
+// Names of metrics exported.
+const (
+	// time spent in a state, once it is left; labelled with the state
+	metricStateDuration = "mender.state.duration"
+	// deployments finished; labelled with the status and artifact name
+	metricDeploymentFinished = "mender.deployment.finished"
+	// time the deployment took, from download to the final status
+	metricDeploymentDuration = "mender.deployment.duration"
+	metricRollback           = "mender.rollback"
+)
+
+// batches waiting to be exported
+const metricsQueueSize = 64
+
+type metricsBus struct {
+	lock      sync.Mutex
+	exporters []MetricsExporter
+	queue     chan []Metric
+	pending   sync.WaitGroup
+	// export is started with the first exporter
+	started sync.Once
+
+	// state entered last, and when
+	state State
+	since time.Time
+	// deployment the final status was exported for; status reports may be
+	// retried
+	finished string
+}
+
+func newMetricsBus() *metricsBus {
+	return &metricsBus{queue: make(chan []Metric, metricsQueueSize)}
+}
+
+func (b *metricsBus) add(e MetricsExporter) {
+	b.lock.Lock()
+	b.exporters = append(b.exporters, e)
+	b.lock.Unlock()
+	b.started.Do(func() { go b.run() })
+}
+
+func (b *metricsBus) run() {
+	for metrics := range b.queue {
+		b.lock.Lock()
+		exporters := b.exporters
+		b.lock.Unlock()
+		for _, e := range exporters {
+			if err := e.ExportMetrics(metrics); err != nil {
+				log.Debugf("failed to export metrics: %v", err)
+			}
+		}
+		b.pending.Done()
+	}
+}
+
+// publish queues the metrics for export.
+func (b *metricsBus) publish(metrics []Metric) {
+	if b == nil || len(metrics) == 0 {
+		return
+	}
+	b.lock.Lock()
+	none := len(b.exporters) == 0
+	b.lock.Unlock()
+	if none {
+		return
+	}
+	b.pending.Add(1)
+	select {
+	case b.queue <- metrics:
+	default:
+		b.pending.Done()
+		log.Debugf("metrics export does not keep up, dropping %d metrics", len(metrics))
+	}
+}
+
+// wait for metrics published so far to be exported.
+func (b *metricsBus) wait() {
+	if b != nil {
+		b.pending.Wait()
+	}
+}
+
+// transition publishes metrics of the state machine moving to state `to`;
+// `durations` are seconds spent in states of the deployment, if one ends.
+func (b *metricsBus) transition(to State, durations map[string]float64, now time.Time) {
+	if b == nil {
+		return
+	}
+	var metrics []Metric
+	if b.state != nil {
+		metrics = append(metrics, Metric{
+			Name:   metricStateDuration,
+			Type:   MetricDuration,
+			Value:  now.Sub(b.since).Seconds(),
+			Labels: map[string]string{"state": b.state.Id().String()},
+			Time:   now,
+		})
+	}
+
+	switch s := to.(type) {
+	case *UpdateStatusReportState:
+		if s.update.ID == b.finished {
+			break
+		}
+		b.finished = s.update.ID
+		labels := map[string]string{
+			"status":        s.status,
+			"artifact_name": s.update.ArtifactName(),
+		}
+		metrics = append(metrics, Metric{
+			Name:   metricDeploymentFinished,
+			Type:   MetricCounter,
+			Value:  1,
+			Labels: labels,
+			Time:   now,
+		})
+		if len(durations) > 0 {
+			var total float64
+			for _, secs := range durations {
+				total += secs
+			}
+			metrics = append(metrics, Metric{
+				Name:   metricDeploymentDuration,
+				Type:   MetricDuration,
+				Value:  total,
+				Labels: labels,
+				Time:   now,
+			})
+		}
+	}
+	if event, update := transitionEvent(b.state, to); event == notifyRollback {
+		metrics = append(metrics, Metric{
+			Name:   metricRollback,
+			Type:   MetricCounter,
+			Value:  1,
+			Labels: map[string]string{"artifact_name": update.ArtifactName()},
+			Time:   now,
+		})
+	}
+
+	b.state = to
+	b.since = now
+	b.publish(metrics)
+}
+
+// Exporters configured; `resource` describes the device to exporters
+// supporting it.
+func configMetricsExporters(config MenderConfig,
+	resource map[string]string) ([]MetricsExporter, error) {
+	var exporters []MetricsExporter
+	if config.MetricsStatsdAddress != "" {
+		exporters = append(exporters, newStatsdExporter(config.MetricsStatsdAddress))
+	}
+	if config.MetricsOTLPEndpoint != "" {
+		e, err := newOTLPExporter(config.MetricsOTLPEndpoint, resource)
+		if err != nil {
+			return nil, err
+		}
+		exporters = append(exporters, e)
+	}
+	return exporters, nil
+}
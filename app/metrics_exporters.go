@@ -0,0 +1,245 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Metrics are sent to statsd over UDP, one datagram per batch: counters as
+// "name:1|c", durations as "name:<ms>|ms", labels as DogStatsD tags
+// ("|#key:value,..."), understood by Telegraf and Datadog agents among
+// others.
+type statsdExporter struct {
+	address string
+}
+
+// statsd datagrams are kept below the usual MTU
+const statsdMaxDatagram = 1432
+
+func newStatsdExporter(address string) *statsdExporter {
+	return &statsdExporter{address: address}
+}
+
+func sortedLabels(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Characters with meaning in statsd lines are replaced.
+var statsdReplacer = strings.NewReplacer(":", "_", "|", "_", ",", "_", "#", "_",
+	"\n", "_", "@", "_")
+
+func statsdLine(m Metric) string {
+	var line bytes.Buffer
+	line.WriteString(statsdReplacer.Replace(m.Name))
+	switch m.Type {
+	case MetricDuration:
+		fmt.Fprintf(&line, ":%s|ms", strconv.FormatFloat(m.Value*1000, 'f', -1, 64))
+	default:
+		fmt.Fprintf(&line, ":%s|c", strconv.FormatFloat(m.Value, 'f', -1, 64))
+	}
+	for i, k := range sortedLabels(m.Labels) {
+		if i == 0 {
+			line.WriteString("|#")
+		} else {
+			line.WriteString(",")
+		}
+		line.WriteString(statsdReplacer.Replace(k) + ":" +
+			statsdReplacer.Replace(m.Labels[k]))
+	}
+	return line.String()
+}
+
+func (e *statsdExporter) ExportMetrics(metrics []Metric) error {
+	conn, err := net.Dial("udp", e.address)
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to statsd")
+	}
+	defer conn.Close()
+
+	var datagram bytes.Buffer
+	flush := func() error {
+		if datagram.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(datagram.Bytes())
+		datagram.Reset()
+		return err
+	}
+	for _, m := range metrics {
+		line := statsdLine(m)
+		if datagram.Len() > 0 && datagram.Len()+1+len(line) > statsdMaxDatagram {
+			if err := flush(); err != nil {
+				return errors.Wrapf(err, "failed to send metrics to statsd")
+			}
+		}
+		if datagram.Len() > 0 {
+			datagram.WriteByte('\n')
+		}
+		datagram.WriteString(line)
+	}
+	if err := flush(); err != nil {
+		return errors.Wrapf(err, "failed to send metrics to statsd")
+	}
+	return nil
+}
+
+// Metrics are sent to OpenTelemetry collector with OTLP/HTTP, JSON encoded
+// (http://collector:4318/v1/metrics): counters as delta sums, durations as
+// gauges in seconds, the device described by resource attributes.
+type otlpExporter struct {
+	endpoint string
+	resource []otlpAttribute
+	client   *http.Client
+}
+
+const otlpExportTimeout = 10 * time.Second
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpDataPoint struct {
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	TimeUnixNano string          `json:"timeUnixNano"`
+	AsDouble     float64         `json:"asDouble"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+const otlpTemporalityDelta = 1
+
+type otlpMetric struct {
+	Name  string     `json:"name"`
+	Unit  string     `json:"unit,omitempty"`
+	Gauge *otlpGauge `json:"gauge,omitempty"`
+	Sum   *otlpSum   `json:"sum,omitempty"`
+}
+
+type otlpScopeMetrics struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+func otlpAttributes(labels map[string]string) []otlpAttribute {
+	var attrs []otlpAttribute
+	for _, k := range sortedLabels(labels) {
+		attr := otlpAttribute{Key: k}
+		attr.Value.StringValue = labels[k]
+		attrs = append(attrs, attr)
+	}
+	return attrs
+}
+
+func newOTLPExporter(endpoint string, resource map[string]string) (*otlpExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.Errorf("invalid OTLP endpoint %q", endpoint)
+	}
+	attrs := map[string]string{"service.name": "mender"}
+	for k, v := range resource {
+		attrs[k] = v
+	}
+	return &otlpExporter{
+		endpoint: endpoint,
+		resource: otlpAttributes(attrs),
+		client:   &http.Client{Timeout: otlpExportTimeout},
+	}, nil
+}
+
+func (e *otlpExporter) request(metrics []Metric) otlpRequest {
+	var sm otlpScopeMetrics
+	sm.Scope.Name = "mender"
+	for _, m := range metrics {
+		dp := otlpDataPoint{
+			Attributes:   otlpAttributes(m.Labels),
+			TimeUnixNano: strconv.FormatInt(m.Time.UnixNano(), 10),
+			AsDouble:     m.Value,
+		}
+		om := otlpMetric{Name: m.Name}
+		switch m.Type {
+		case MetricDuration:
+			om.Unit = "s"
+			om.Gauge = &otlpGauge{DataPoints: []otlpDataPoint{dp}}
+		default:
+			om.Sum = &otlpSum{
+				DataPoints:             []otlpDataPoint{dp},
+				AggregationTemporality: otlpTemporalityDelta,
+				IsMonotonic:            true,
+			}
+		}
+		sm.Metrics = append(sm.Metrics, om)
+	}
+
+	var rm otlpResourceMetrics
+	rm.Resource.Attributes = e.resource
+	rm.ScopeMetrics = []otlpScopeMetrics{sm}
+	return otlpRequest{ResourceMetrics: []otlpResourceMetrics{rm}}
+}
+
+func (e *otlpExporter) ExportMetrics(metrics []Metric) error {
+	data, err := json.Marshal(e.request(metrics))
+	if err != nil {
+		return err
+	}
+	rsp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrapf(err, "failed to send metrics to OTLP collector")
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return errors.Errorf("OTLP collector responded with status %d", rsp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+)
+
+type testMetricsExporter struct {
+	lock    sync.Mutex
+	metrics []Metric
+}
+
+func (e *testMetricsExporter) ExportMetrics(metrics []Metric) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.metrics = append(e.metrics, metrics...)
+	return nil
+}
+
+func (e *testMetricsExporter) names() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	var names []string
+	for _, m := range e.metrics {
+		names = append(names, m.Name)
+	}
+	e.metrics = nil
+	return names
+}
+
+func TestMetricsBusTransitions(t *testing.T) {
+	bus := newMetricsBus()
+	// no exporters, nothing queued
+	bus.transition(checkWaitState, nil, time.Now())
+	bus.wait()
+
+	exp := &testMetricsExporter{}
+	bus.add(exp)
+
+	update := client.UpdateResponse{ID: "dep-1"}
+	update.Artifact.ArtifactName = "release-2"
+	start := time.Now()
+
+	bus.transition(NewUpdateFetchState(update), nil, start.Add(2*time.Second))
+	bus.wait()
+	assert.Len(t, exp.metrics, 1)
+	assert.Equal(t, metricStateDuration, exp.metrics[0].Name)
+	assert.Equal(t, MetricDuration, exp.metrics[0].Type)
+	assert.Equal(t, map[string]string{"state": checkWaitState.Id().String()},
+		exp.metrics[0].Labels)
+	exp.names()
+
+	rollback := NewRollbackState(update)
+	bus.transition(rollback, nil, start.Add(3*time.Second))
+	bus.wait()
+	assert.Equal(t, []string{metricStateDuration, metricRollback}, exp.names())
+
+	durations := map[string]float64{"update-fetch": 1, "rollback": 5}
+	report := NewUpdateStatusReportState(update, client.StatusFailure)
+	bus.transition(report, durations, start.Add(8*time.Second))
+	bus.wait()
+	assert.Len(t, exp.metrics, 3)
+	finished := exp.metrics[1]
+	assert.Equal(t, metricDeploymentFinished, finished.Name)
+	assert.Equal(t, MetricCounter, finished.Type)
+	assert.Equal(t, map[string]string{"status": "failure", "artifact_name": "release-2"},
+		finished.Labels)
+	assert.Equal(t, metricDeploymentDuration, exp.metrics[2].Name)
+	assert.Equal(t, float64(6), exp.metrics[2].Value)
+	exp.names()
+
+	// retried status report is not counted again
+	bus.transition(checkWaitState, nil, start.Add(9*time.Second))
+	bus.transition(report, durations, start.Add(10*time.Second))
+	bus.wait()
+	assert.Equal(t, []string{metricStateDuration, metricStateDuration}, exp.names())
+
+	// nil bus is harmless
+	var none *metricsBus
+	none.transition(checkWaitState, nil, time.Now())
+	none.wait()
+}
+
+func TestStatsdLine(t *testing.T) {
+	assert.Equal(t, "mender.rollback:1|c", statsdLine(Metric{
+		Name: metricRollback, Type: MetricCounter, Value: 1}))
+	assert.Equal(t, "mender.state.duration:1500|ms|#state:update-fetch",
+		statsdLine(Metric{
+			Name:   metricStateDuration,
+			Type:   MetricDuration,
+			Value:  1.5,
+			Labels: map[string]string{"state": "update-fetch"},
+		}))
+	assert.Equal(t, "mender.deployment.finished:1|c|#artifact_name:rel_1_x,status:success",
+		statsdLine(Metric{
+			Name:   metricDeploymentFinished,
+			Value:  1,
+			Labels: map[string]string{"status": "success", "artifact_name": "rel|1,x"},
+		}))
+}
+
+func TestStatsdExporter(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// enough metrics to need more than one datagram
+	var metrics []Metric
+	for i := 0; i < 60; i++ {
+		metrics = append(metrics, Metric{
+			Name:   metricStateDuration,
+			Type:   MetricDuration,
+			Value:  0.25,
+			Labels: map[string]string{"state": "update-store"},
+		})
+	}
+	exp := newStatsdExporter(conn.LocalAddr().String())
+	assert.NoError(t, exp.ExportMetrics(metrics))
+
+	var lines []string
+	buf := make([]byte, 65536)
+	for len(lines) < len(metrics) {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if !assert.NoError(t, err) {
+			break
+		}
+		assert.True(t, n <= statsdMaxDatagram)
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+	assert.Len(t, lines, len(metrics))
+	assert.Equal(t, "mender.state.duration:250|ms|#state:update-store", lines[0])
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var req otlpRequest
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/metrics", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	_, err := newOTLPExporter("collector:4318", nil)
+	assert.Error(t, err)
+	_, err = configMetricsExporters(MenderConfig{MetricsOTLPEndpoint: "ftp://collector"}, nil)
+	assert.Error(t, err)
+
+	exporters, err := configMetricsExporters(MenderConfig{
+		MetricsStatsdAddress: "127.0.0.1:8125",
+		MetricsOTLPEndpoint:  srv.URL + "/v1/metrics",
+	}, map[string]string{"mender.device_type": "hammer"})
+	assert.NoError(t, err)
+	assert.Len(t, exporters, 2)
+	exp := exporters[1]
+
+	now := time.Unix(1500000000, 0)
+	assert.NoError(t, exp.ExportMetrics([]Metric{
+		{Name: metricDeploymentFinished, Type: MetricCounter, Value: 1,
+			Labels: map[string]string{"status": "success"}, Time: now},
+		{Name: metricDeploymentDuration, Type: MetricDuration, Value: 42, Time: now},
+	}))
+
+	assert.Len(t, req.ResourceMetrics, 1)
+	rm := req.ResourceMetrics[0]
+	assert.Len(t, rm.Resource.Attributes, 2)
+	assert.Equal(t, "mender.device_type", rm.Resource.Attributes[0].Key)
+	assert.Equal(t, "hammer", rm.Resource.Attributes[0].Value.StringValue)
+	assert.Equal(t, "service.name", rm.Resource.Attributes[1].Key)
+	assert.Equal(t, "mender", rm.Resource.Attributes[1].Value.StringValue)
+
+	ms := rm.ScopeMetrics[0].Metrics
+	assert.Len(t, ms, 2)
+	assert.Equal(t, metricDeploymentFinished, ms[0].Name)
+	assert.NotNil(t, ms[0].Sum)
+	assert.True(t, ms[0].Sum.IsMonotonic)
+	assert.Equal(t, otlpTemporalityDelta, ms[0].Sum.AggregationTemporality)
+	assert.Equal(t, "1500000000000000000", ms[0].Sum.DataPoints[0].TimeUnixNano)
+	assert.Equal(t, "status", ms[0].Sum.DataPoints[0].Attributes[0].Key)
+	assert.Equal(t, "s", ms[1].Unit)
+	assert.NotNil(t, ms[1].Gauge)
+	assert.Equal(t, float64(42), ms[1].Gauge.DataPoints[0].AsDouble)
+
+	status = http.StatusBadRequest
+	assert.Error(t, exp.ExportMetrics([]Metric{{Name: metricRollback, Value: 1, Time: now}}))
+}
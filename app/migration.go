@@ -0,0 +1,184 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+const (
+	migrationAuthTokenName = "authtoken-migration"
+
+	// holds URL of the server the device has switched over to
+	serverMigratedName = "server-migrated"
+)
+
+// Server the device is being migrated to, together with credentials used for
+// talking to it. The device is authorized with and reports inventory to both
+// the current and the migration server until the current server tells it to
+// switch over.
+type serverMigration struct {
+	url       string
+	authMgr   AuthManager
+	authToken client.AuthToken
+}
+
+// ApiRequester wrapper picking up directives (server migration, device
+// commands) that the server passes in response headers.
+type responseObserver struct {
+	client.ApiRequester
+	header http.Header
+}
+
+func (o *responseObserver) Do(req *http.Request) (*http.Response, error) {
+	rsp, err := o.ApiRequester.Do(req)
+	if err == nil && rsp != nil {
+		o.header = rsp.Header
+	}
+	return rsp, err
+}
+
+// Setup migration to the server given in configuration. If the device already
+// switched over in the past, the migration server becomes the current one
+// right away.
+func (m *mender) setupMigration(authMgr AuthManager) {
+	if m.config.MigrationServerURL == "" || authMgr == nil {
+		return
+	}
+
+	m.migration = &serverMigration{
+		url:       m.config.MigrationServerURL,
+		authMgr:   authMgr,
+		authToken: noAuthToken,
+	}
+
+	if m.store == nil {
+		return
+	}
+	migrated, err := m.store.ReadAll(serverMigratedName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("failed to read server migration status: %v", err)
+		}
+		return
+	}
+	if string(migrated) == m.migration.url {
+		log.Infof("device already migrated to server %s", m.migration.url)
+		m.switchServer()
+	}
+}
+
+// Make the migration server the current one. From now on the device no longer
+// talks to the old server.
+func (m *mender) switchServer() {
+	log.Infof("switching from server %s to %s", m.config.ServerURL,
+		m.migration.url)
+
+	m.config.ServerURL = m.migration.url
+	m.authMgr = m.migration.authMgr
+	m.authToken = m.migration.authToken
+	m.migration = nil
+}
+
+// Handle migration directive received from the current server. Only switching
+// to the configured migration server is allowed.
+func (m *mender) handleMigrationDirective(target string) {
+	if target == "" || m.migration == nil {
+		return
+	}
+
+	if target != m.migration.url {
+		log.Warnf("ignoring request to migrate to unknown server %s", target)
+		return
+	}
+
+	if m.store != nil {
+		if err := m.store.WriteAll(serverMigratedName, []byte(target)); err != nil {
+			log.Errorf("failed to save server migration status: %v", err)
+			return
+		}
+	}
+	m.switchServer()
+}
+
+// Authorize with the migration server. Errors are not fatal as the device
+// keeps on working with the current server.
+func (m *mender) authorizeMigration(ctx context.Context) {
+	mig := m.migration
+	if mig == nil {
+		return
+	}
+
+	if mig.authMgr.IsAuthorized() {
+		if mig.authToken == noAuthToken {
+			code, err := mig.authMgr.AuthToken()
+			if err != nil {
+				log.Warnf("failed to load migration server authorization: %v", err)
+				return
+			}
+			mig.authToken = code
+		}
+		return
+	}
+
+	mig.authToken = noAuthToken
+
+	rsp, err := m.authReq.Request(ctx, m.api, mig.url, mig.authMgr)
+	if err != nil {
+		if err == client.AuthErrorUnauthorized {
+			if remErr := mig.authMgr.RemoveAuthToken(); remErr != nil {
+				log.Warn("can not remove rejected migration authentication token")
+			}
+		}
+		log.Warnf("authorization with migration server %s failed: %v",
+			mig.url, err)
+		return
+	}
+
+	if err := mig.authMgr.RecvAuthResponse(rsp); err != nil {
+		log.Warnf("failed to parse migration server authorization response: %v", err)
+		return
+	}
+
+	code, err := mig.authMgr.AuthToken()
+	if err != nil {
+		log.Warnf("failed to load migration server authorization: %v", err)
+		return
+	}
+	mig.authToken = code
+	log.Infof("successfuly authorized with migration server %s", mig.url)
+}
+
+// Submit inventory data to the migration server, if the device is authorized
+// with it.
+func (m *mender) submitMigrationInventory(ctx context.Context,
+	idata client.InventoryData) error {
+	mig := m.migration
+	if mig == nil || mig.authToken == noAuthToken {
+		return nil
+	}
+
+	ic := client.NewInventory()
+	err := ic.Submit(ctx, m.api.Request(mig.authToken), mig.url, idata)
+	if err != nil {
+		return errors.Wrapf(err, "failed to submit inventory data to migration server")
+	}
+	return nil
+}
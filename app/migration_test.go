@@ -0,0 +1,162 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// minimal backend recording authorization tokens used by the device
+type migrationTestServer struct {
+	*httptest.Server
+	authCalled bool
+	migrateTo  string
+	// authorization header of last update check and inventory submission
+	updateAuth    string
+	inventoryAuth string
+}
+
+func newMigrationTestServer() *migrationTestServer {
+	s := &migrationTestServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/auth_requests"):
+				s.authCalled = true
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("token"))
+			case strings.Contains(r.URL.Path, "/deployments/next"):
+				s.updateAuth = r.Header.Get("Authorization")
+				if s.migrateTo != "" {
+					w.Header().Set(client.MigrateToHeader, s.migrateTo)
+				}
+				w.WriteHeader(http.StatusNoContent)
+			case strings.Contains(r.URL.Path, "/inventory/"):
+				s.inventoryAuth = r.Header.Get("Authorization")
+				w.WriteHeader(http.StatusOK)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	return s
+}
+
+func TestMenderServerMigration(t *testing.T) {
+	oldSrv := newMigrationTestServer()
+	defer oldSrv.Close()
+	newSrv := newMigrationTestServer()
+	defer newSrv.Close()
+
+	ms := utils.NewMemStore()
+	oldAuth := &testAuthManager{
+		authorized: true,
+		authtoken:  "old-token",
+	}
+	newAuth := &testAuthManager{
+		authtoken: "new-token",
+	}
+
+	mender := newTestMender(nil,
+		MenderConfig{
+			ServerURL:          oldSrv.URL,
+			MigrationServerURL: newSrv.URL,
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store:            ms,
+				authMgr:          oldAuth,
+				migrationAuthMgr: newAuth,
+			},
+		})
+	assert.NotNil(t, mender.migration)
+
+	// authorizes with both servers, only the migration server needs an auth
+	// request
+	assert.NoError(t, mender.Authorize(context.Background()))
+	assert.False(t, oldSrv.authCalled)
+	assert.True(t, newSrv.authCalled)
+	assert.Equal(t, []byte("token"), newAuth.rspData)
+	assert.Equal(t, client.AuthToken("old-token"), mender.authToken)
+	assert.Equal(t, client.AuthToken("new-token"), mender.migration.authToken)
+
+	// inventory goes to both
+	assert.NoError(t, mender.InventoryRefresh(context.Background()))
+	assert.Equal(t, "Bearer old-token", oldSrv.inventoryAuth)
+	assert.Equal(t, "Bearer new-token", newSrv.inventoryAuth)
+
+	// directive pointing to unknown server is ignored
+	oldSrv.migrateTo = "https://evil.example.com"
+	_, err := mender.CheckUpdate(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer old-token", oldSrv.updateAuth)
+	assert.NotNil(t, mender.migration)
+	assert.Equal(t, oldSrv.URL, mender.config.ServerURL)
+
+	// switch over
+	oldSrv.migrateTo = newSrv.URL
+	_, err = mender.CheckUpdate(context.Background())
+	assert.NoError(t, err)
+	assert.Nil(t, mender.migration)
+	assert.Equal(t, newSrv.URL, mender.config.ServerURL)
+	assert.Equal(t, client.AuthToken("new-token"), mender.authToken)
+	migrated, rerr := ms.ReadAll(serverMigratedName)
+	assert.NoError(t, rerr)
+	assert.Equal(t, newSrv.URL, string(migrated))
+
+	oldSrv.updateAuth = ""
+	_, err = mender.CheckUpdate(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "", oldSrv.updateAuth)
+	assert.Equal(t, "Bearer new-token", newSrv.updateAuth)
+
+	// switch over is persistent
+	mender = newTestMender(nil,
+		MenderConfig{
+			ServerURL:          oldSrv.URL,
+			MigrationServerURL: newSrv.URL,
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store:            ms,
+				authMgr:          oldAuth,
+				migrationAuthMgr: newAuth,
+			},
+		})
+	assert.Nil(t, mender.migration)
+	assert.Equal(t, newSrv.URL, mender.config.ServerURL)
+	assert.Equal(t, newAuth, mender.authMgr)
+}
+
+func TestMenderServerMigrationNotConfigured(t *testing.T) {
+	mender := newTestMender(nil, MenderConfig{},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				migrationAuthMgr: &testAuthManager{},
+			},
+		})
+	assert.Nil(t, mender.migration)
+
+	// directive is ignored
+	mender.handleMigrationDirective("https://new.example.com")
+	assert.Nil(t, mender.migration)
+	assert.Equal(t, "", mender.config.ServerURL)
+}
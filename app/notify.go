@@ -0,0 +1,179 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Events the notification command is run on.
+const (
+	notifyUpdateAvailable  = "update-available"
+	notifyDownloadComplete = "download-complete"
+	notifyInstallComplete  = "install-complete"
+	notifyRollback         = "rollback"
+)
+
+var notifyEvents = []string{
+	notifyUpdateAvailable,
+	notifyDownloadComplete,
+	notifyInstallComplete,
+	notifyRollback,
+}
+
+// Notifier runs configured command on selected update events, for
+// integrations that need nothing more than a shell script. The command is
+// not waited for; event details are passed in MENDER_EVENT,
+// MENDER_DEPLOYMENT_ID and MENDER_ARTIFACT_NAME environment variables, and
+// deployment metadata from the update response, if any, as JSON object in
+// MENDER_DEPLOYMENT_METADATA.
+type notifier struct {
+	command []string
+	events  map[string]bool
+	running sync.WaitGroup
+	// deployment directories command outputs are saved to, if any
+	dirs *deploymentDirs
+}
+
+// Returns nil notifier if no notification command is configured; all
+// events are selected if none are configured.
+func newNotifier(config MenderConfig) (*notifier, error) {
+	if len(config.NotifyCommand) == 0 {
+		return nil, nil
+	}
+	selected := config.NotifyEvents
+	if len(selected) == 0 {
+		selected = notifyEvents
+	}
+	n := &notifier{
+		command: config.NotifyCommand,
+		events:  make(map[string]bool),
+	}
+	for _, event := range selected {
+		if !isNotifyEvent(event) {
+			return nil, errors.Errorf("invalid notification event %q, expected one of %v",
+				event, notifyEvents)
+		}
+		n.events[event] = true
+	}
+	return n, nil
+}
+
+func isNotifyEvent(event string) bool {
+	for _, e := range notifyEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// transitionEvent returns event the state transition stands for, if any.
+func transitionEvent(from, to State) (string, *client.UpdateResponse) {
+	switch s := to.(type) {
+	case *UpdateFetchState:
+		return notifyUpdateAvailable, &s.update
+	case *RollbackState:
+		return notifyRollback, &s.update
+	case *RebootState:
+		if _, ok := from.(*UpdateInstallState); ok {
+			return notifyInstallComplete, &s.update
+		}
+	case *UpdateCommitState:
+		// update not needing a reboot
+		if _, ok := from.(*UpdateInstallState); ok {
+			return notifyInstallComplete, &s.update
+		}
+	case *UpdateStatusReportState:
+		// bootloader rolled back the new image
+		if _, ok := from.(*UpdateVerifyState); ok && s.status == client.StatusFailure {
+			return notifyRollback, &s.update
+		}
+	}
+	return "", nil
+}
+
+// notify starts the command if the event is selected.
+func (n *notifier) notify(event string, update client.UpdateResponse) {
+	if n == nil || !n.events[event] {
+		return
+	}
+	cmd := exec.Command(n.command[0], n.command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"MENDER_EVENT="+event,
+		"MENDER_DEPLOYMENT_ID="+update.ID,
+		"MENDER_ARTIFACT_NAME="+update.ArtifactName())
+	if len(update.DeploymentMetadata) > 0 {
+		if metadata, err := json.Marshal(update.DeploymentMetadata); err == nil {
+			cmd.Env = append(cmd.Env, "MENDER_DEPLOYMENT_METADATA="+string(metadata))
+		}
+	}
+	output := n.openOutput(event, update)
+	if output != nil {
+		cmd.Stdout = output
+		cmd.Stderr = output
+	}
+	if err := cmd.Start(); err != nil {
+		log.Errorf("failed to run notification command %s for %s: %v",
+			n.command[0], event, err)
+		if output != nil {
+			output.Close()
+		}
+		return
+	}
+	log.Debugf("running notification command %s for %s", n.command[0], event)
+
+	n.running.Add(1)
+	go func() {
+		defer n.running.Done()
+		if err := cmd.Wait(); err != nil {
+			log.Warnf("notification command %s for %s failed: %v",
+				n.command[0], event, err)
+		}
+		if output != nil {
+			output.Close()
+		}
+	}()
+}
+
+// openOutput opens file in the deployment directory output of the command is
+// appended to; nil if there is none.
+func (n *notifier) openOutput(event string, update client.UpdateResponse) *os.File {
+	dir := n.dirs.dir(update.ID)
+	if dir == "" {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "notify-"+event+".log"),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Warnf("failed to open output file of notification command: %v", err)
+		return nil
+	}
+	return f
+}
+
+// wait for notification commands started so far to finish.
+func (n *notifier) wait() {
+	if n != nil {
+		n.running.Wait()
+	}
+}
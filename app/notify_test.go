@@ -0,0 +1,123 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifierConfig(t *testing.T) {
+	n, err := newNotifier(MenderConfig{})
+	assert.NoError(t, err)
+	assert.Nil(t, n)
+	// nil notifier does nothing
+	n.notify(notifyRollback, client.UpdateResponse{})
+	n.wait()
+
+	n, err = newNotifier(MenderConfig{NotifyCommand: []string{"true"}})
+	assert.NoError(t, err)
+	for _, event := range notifyEvents {
+		assert.True(t, n.events[event])
+	}
+
+	n, err = newNotifier(MenderConfig{
+		NotifyCommand: []string{"true"},
+		NotifyEvents:  []string{notifyRollback},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{notifyRollback: true}, n.events)
+
+	_, err = newNotifier(MenderConfig{
+		NotifyCommand: []string{"true"},
+		NotifyEvents:  []string{"reboot"},
+	})
+	assert.Error(t, err)
+}
+
+func TestNotifierTransitionEvent(t *testing.T) {
+	update := client.UpdateResponse{ID: "foo"}
+
+	tc := []struct {
+		from, to State
+		event    string
+	}{
+		{checkWaitState, NewUpdateFetchState(update), notifyUpdateAvailable},
+		{NewUpdateInstallState(nil, 0, update), NewRebootState(update), notifyInstallComplete},
+		{NewUpdateInstallState(nil, 0, update), NewUpdateCommitState(update), notifyInstallComplete},
+		{NewUpdateVerifyState(update), NewUpdateCommitState(update), ""},
+		{NewUpdateInstallState(nil, 0, update), NewRollbackState(update), notifyRollback},
+		{NewUpdateVerifyState(update),
+			NewUpdateStatusReportState(update, client.StatusFailure), notifyRollback},
+		{NewUpdateVerifyState(update), NewRebootState(update), ""},
+		{NewUpdateCommitState(update),
+			NewUpdateStatusReportState(update, client.StatusFailure), ""},
+		{checkWaitState, inventoryUpdateState, ""},
+	}
+	for _, c := range tc {
+		event, u := transitionEvent(c.from, c.to)
+		assert.Equal(t, c.event, event, "%s -> %s", c.from.Id(), c.to.Id())
+		if c.event != "" {
+			assert.Equal(t, "foo", u.ID)
+		} else {
+			assert.Nil(t, u)
+		}
+	}
+}
+
+func TestNotifierNotify(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "notify")
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "events")
+
+	config := MenderConfig{
+		NotifyCommand: []string{"/bin/sh", "-c",
+			"echo $MENDER_EVENT $MENDER_DEPLOYMENT_ID $MENDER_ARTIFACT_NAME " +
+				"$MENDER_DEPLOYMENT_METADATA >> " + out},
+		NotifyEvents: []string{notifyUpdateAvailable, notifyInstallComplete},
+	}
+	mender := newTestMender(nil, config, testMenderPieces{})
+	assert.NotNil(t, mender)
+
+	update := client.UpdateResponse{ID: "foo"}
+	update.Artifact.ArtifactName = "bar"
+
+	mender.SetState(NewUpdateFetchState(update))
+	mender.notifier.wait()
+	update.DeploymentMetadata = map[string]interface{}{"campaign": "spring"}
+	mender.SetState(NewUpdateInstallState(nil, 0, update))
+	mender.SetState(NewRebootState(update))
+	mender.notifier.wait()
+	// not selected
+	mender.SetState(NewRollbackState(update))
+	mender.notifier.wait()
+
+	data, err := ioutil.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"update-available foo bar",
+		`install-complete foo bar {"campaign":"spring"}`,
+	}, strings.Split(strings.TrimSpace(string(data)), "\n"))
+
+	// command that cannot be started is only logged
+	mender.notifier.command = []string{filepath.Join(dir, "missing")}
+	mender.SetState(NewUpdateFetchState(update))
+	mender.notifier.wait()
+}
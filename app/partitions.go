@@ -11,10 +11,11 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
-package main
+package app
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"path"
 	"strings"
@@ -29,6 +30,14 @@ var (
 	ErrorPartitionNumberNotSet     = errors.New("RootfsPartA and RootfsPartB settings are not both set.")
 	ErrorPartitionNumberSame       = errors.New("RootfsPartA and RootfsPartB cannot be set to the same value.")
 	ErrorPartitionNoMatchActive    = errors.New("Active root partition matches neither RootfsPartA nor RootfsPartB.")
+	ErrorPartitionAutoDetect       = errors.New("Can not auto-detect RootfsPartA and RootfsPartB.")
+)
+
+// Bootloader environment variables holding the partition numbers of the
+// A/B root filesystems; used for discovering the partition pair.
+const (
+	bootEnvRootfsPartA = "mender_rootfsa_part"
+	bootEnvRootfsPartB = "mender_rootfsb_part"
 )
 
 type partitions struct {
@@ -36,6 +45,7 @@ type partitions struct {
 	BootEnvReadWriter
 	rootfsPartA string
 	rootfsPartB string
+	autoDetect  bool
 	active      string
 	inactive    string
 }
@@ -57,6 +67,11 @@ func (p *partitions) GetActive() (string, error) {
 }
 
 func (p *partitions) getAndCacheInactivePartition() (string, error) {
+	if p.autoDetect {
+		if err := p.detectPartitions(); err != nil {
+			return "", err
+		}
+	}
 	if p.rootfsPartA == "" || p.rootfsPartB == "" {
 		return "", ErrorPartitionNumberNotSet
 	}
@@ -69,10 +84,12 @@ func (p *partitions) getAndCacheInactivePartition() (string, error) {
 		return "", err
 	}
 
-	if active == p.rootfsPartA {
-		p.inactive = p.rootfsPartB
-	} else if active == p.rootfsPartB {
-		p.inactive = p.rootfsPartA
+	// configured partitions may be given as PARTUUID=, LABEL=, symlinks or
+	// device-mapper devices; compare the partitions they resolve to
+	if active == p.rootfsPartA || active == underlyingDevice(p.rootfsPartA) {
+		p.inactive = resolveDeviceName(p.rootfsPartB)
+	} else if active == p.rootfsPartB || active == underlyingDevice(p.rootfsPartB) {
+		p.inactive = resolveDeviceName(p.rootfsPartA)
 	} else {
 		return "", ErrorPartitionNoMatchActive
 	}
@@ -81,6 +98,98 @@ func (p *partitions) getAndCacheInactivePartition() (string, error) {
 	return p.inactive, nil
 }
 
+// Finds the A/B partition pair using the active (mounted) root partition and
+// partition numbers stored in the bootloader environment. Configured
+// RootfsPartA/B, if any, must agree with what was found.
+func (p *partitions) detectPartitions() error {
+	active, err := p.GetActive()
+	if err != nil {
+		return err
+	}
+
+	partA, partB, err := p.discoverPartitions(active)
+	if err != nil {
+		log.Errorf("Partition auto-detection failed: %v", err)
+		return ErrorPartitionAutoDetect
+	}
+
+	if (p.rootfsPartA != "" && p.rootfsPartA != partA) ||
+		(p.rootfsPartB != "" && p.rootfsPartB != partB) {
+		log.Errorf("Detected partitions %s and %s do not match configured "+
+			"RootfsPartA (%s) and RootfsPartB (%s)",
+			partA, partB, p.rootfsPartA, p.rootfsPartB)
+		return ErrorPartitionAutoDetect
+	}
+
+	log.Infof("Detected root partitions: A %s, B %s", partA, partB)
+	p.rootfsPartA = partA
+	p.rootfsPartB = partB
+	// only needs to be done once
+	p.autoDetect = false
+	return nil
+}
+
+func (p *partitions) discoverPartitions(active string) (string, string, error) {
+	base, activeNum := splitPartitionNumber(active)
+	if activeNum == "" {
+		return "", "", fmt.Errorf("active root %s is not a numbered partition", active)
+	}
+
+	env, err := p.ReadEnv(bootEnvRootfsPartA, bootEnvRootfsPartB)
+	if err != nil {
+		return "", "", fmt.Errorf("can not read %s and %s from boot environment: %v",
+			bootEnvRootfsPartA, bootEnvRootfsPartB, err)
+	}
+	numA, numB := env[bootEnvRootfsPartA], env[bootEnvRootfsPartB]
+	if !isPartitionNumber(numA) || !isPartitionNumber(numB) {
+		return "", "", fmt.Errorf("invalid partition numbers in boot environment: %s=%q, %s=%q",
+			bootEnvRootfsPartA, numA, bootEnvRootfsPartB, numB)
+	}
+	if numA == numB {
+		return "", "", fmt.Errorf("%s and %s are both set to %s",
+			bootEnvRootfsPartA, bootEnvRootfsPartB, numA)
+	}
+
+	var inactive string
+	switch activeNum {
+	case numA:
+		inactive = base + numB
+	case numB:
+		inactive = base + numA
+	default:
+		return "", "", fmt.Errorf("active root %s is neither partition %s nor %s",
+			active, numA, numB)
+	}
+
+	stat, err := p.Stat(inactive)
+	if err != nil {
+		return "", "", fmt.Errorf("inactive partition %s: %v", inactive, err)
+	}
+	if stat.Mode()&os.ModeDevice == 0 {
+		return "", "", fmt.Errorf("inactive partition %s is not a device", inactive)
+	}
+
+	return base + numA, base + numB, nil
+}
+
+// Splits partition device name into the device prefix and partition number,
+// eg. /dev/mmcblk0p2 -> /dev/mmcblk0p, 2.
+func splitPartitionNumber(dev string) (string, string) {
+	i := len(dev)
+	for i > 0 && dev[i-1] >= '0' && dev[i-1] <= '9' {
+		i--
+	}
+	return dev[:i], dev[i:]
+}
+
+func isPartitionNumber(num string) bool {
+	if num == "" {
+		return false
+	}
+	_, n := splitPartitionNumber(num)
+	return n == num
+}
+
 func getRootCandidateFromMount(data []byte) string {
 	for _, line := range strings.Split(string(data), "\n") {
 		fields := strings.Split(line, " ")
@@ -163,7 +272,7 @@ func (p *partitions) getAndCacheActivePartition(rootChecker func(StatCommander,
 	// First check if mountCandidate matches rootDevice
 	if mountCandidate != "" {
 		if rootChecker(p, mountCandidate, rootDevice) {
-			p.active = mountCandidate
+			p.active = underlyingDevice(mountCandidate)
 			log.Debugf("Setting active partition from mount candidate: %s", p.active)
 			return p.active, nil
 		}
@@ -181,6 +290,7 @@ func (p *partitions) getAndCacheActivePartition(rootChecker func(StatCommander,
 	if err != nil {
 		return "", err
 	}
+	activePartition = underlyingDevice(activePartition)
 
 	bootEnvBootPart, err := getBootEnvActivePartition(p.BootEnvReadWriter)
 	if err != nil {
@@ -11,7 +11,7 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
-package main
+package app
 
 import (
 	"errors"
@@ -224,3 +224,90 @@ func Test_getAllMountedDevices(t *testing.T) {
 	sort.Sort(actual)
 	assert.Equal(t, actual, sort.StringSlice(expected))
 }
+
+func Test_detectPartitions(t *testing.T) {
+	devInfo, err := os.Stat("/dev/null")
+	assert.NoError(t, err)
+	file, _ := os.Create("tempFile")
+	fileInfo, _ := file.Stat()
+	file.Close()
+	defer os.Remove("tempFile")
+
+	envCaller := newTestOSCalls("", 0)
+	fakeEnv := uBootEnv{&envCaller}
+
+	testData := []struct {
+		active      string
+		rootfsPartA string
+		rootfsPartB string
+		fakeEnv     string
+		fakeEnvRet  int
+		file        os.FileInfo
+		statErr     error
+		expectedA   string
+		expectedB   string
+		inactive    string
+		expectedErr error
+	}{
+		{"/dev/mmcblk0p2", "", "", "mender_rootfsa_part=2\nmender_rootfsb_part=3", 0,
+			devInfo, nil, "/dev/mmcblk0p2", "/dev/mmcblk0p3", "/dev/mmcblk0p3", nil},
+		{"/dev/sda3", "", "", "mender_rootfsa_part=2\nmender_rootfsb_part=3", 0,
+			devInfo, nil, "/dev/sda2", "/dev/sda3", "/dev/sda2", nil},
+		// configured partitions agree
+		{"/dev/sda3", "/dev/sda2", "", "mender_rootfsa_part=2\nmender_rootfsb_part=3", 0,
+			devInfo, nil, "/dev/sda2", "/dev/sda3", "/dev/sda2", nil},
+		// configured partitions do not agree
+		{"/dev/sda3", "/dev/sda5", "", "mender_rootfsa_part=2\nmender_rootfsb_part=3", 0,
+			devInfo, nil, "/dev/sda5", "", "", ErrorPartitionAutoDetect},
+		// variables missing from boot environment
+		{"/dev/sda3", "", "", "## Error: \"mender_rootfsa_part\" not defined", 1,
+			devInfo, nil, "", "", "", ErrorPartitionAutoDetect},
+		{"/dev/sda3", "", "", "mender_rootfsa_part=2\nmender_rootfsb_part=", 0,
+			devInfo, nil, "", "", "", ErrorPartitionAutoDetect},
+		{"/dev/sda3", "", "", "mender_rootfsa_part=2\nmender_rootfsb_part=b", 0,
+			devInfo, nil, "", "", "", ErrorPartitionAutoDetect},
+		// ambiguous layouts
+		{"/dev/sda3", "", "", "mender_rootfsa_part=3\nmender_rootfsb_part=3", 0,
+			devInfo, nil, "", "", "", ErrorPartitionAutoDetect},
+		{"/dev/sda4", "", "", "mender_rootfsa_part=2\nmender_rootfsb_part=3", 0,
+			devInfo, nil, "", "", "", ErrorPartitionAutoDetect},
+		{"/dev/root", "", "", "mender_rootfsa_part=2\nmender_rootfsb_part=3", 0,
+			devInfo, nil, "", "", "", ErrorPartitionAutoDetect},
+		// inactive partition is missing or not a device
+		{"/dev/sda3", "", "", "mender_rootfsa_part=2\nmender_rootfsb_part=3", 0,
+			nil, errors.New("no such file"), "", "", "", ErrorPartitionAutoDetect},
+		{"/dev/sda3", "", "", "mender_rootfsa_part=2\nmender_rootfsb_part=3", 0,
+			fileInfo, nil, "", "", "", ErrorPartitionAutoDetect},
+	}
+
+	for i, test := range testData {
+		envCaller.output = test.fakeEnv
+		envCaller.retCode = test.fakeEnvRet
+		p := partitions{
+			StatCommander:     fakeStatCommander{file: test.file, err: test.statErr},
+			BootEnvReadWriter: &fakeEnv,
+			rootfsPartA:       test.rootfsPartA,
+			rootfsPartB:       test.rootfsPartB,
+			autoDetect:        true,
+			active:            test.active,
+		}
+		inactive, err := p.GetInactive()
+		assert.Equal(t, test.expectedErr, err, "case %d", i)
+		assert.Equal(t, test.inactive, inactive, "case %d", i)
+		if err == nil {
+			assert.Equal(t, test.expectedA, p.rootfsPartA, "case %d", i)
+			assert.Equal(t, test.expectedB, p.rootfsPartB, "case %d", i)
+			assert.False(t, p.autoDetect)
+		}
+	}
+}
+
+func Test_splitPartitionNumber(t *testing.T) {
+	base, num := splitPartitionNumber("/dev/mmcblk0p12")
+	assert.Equal(t, "/dev/mmcblk0p", base)
+	assert.Equal(t, "12", num)
+
+	base, num = splitPartitionNumber("/dev/root")
+	assert.Equal(t, "/dev/root", base)
+	assert.Equal(t, "", num)
+}
@@ -14,7 +14,7 @@
 
 // +build !local
 
-package main
+package app
 
 var (
 	// needed so that we can override it when testing
@@ -14,7 +14,7 @@
 
 // +build local
 
-package main
+package app
 
 import (
 	"os"
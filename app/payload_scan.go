@@ -0,0 +1,276 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultPayloadScanTimeout = 5 * time.Minute
+
+	// what to do when the scanner could not give a verdict
+	payloadScanPolicyReject = "reject"
+	payloadScanPolicyAccept = "accept"
+
+	// scanner output kept for the deployment log
+	payloadScanMaxOutput = 4 * 1024
+)
+
+var (
+	ErrPayloadRejected   = errors.New("payload rejected by scanner")
+	ErrPayloadScanFailed = errors.New("payload scan failed")
+)
+
+func validatePayloadScanPolicy(policy string) error {
+	switch policy {
+	case "", payloadScanPolicyReject, payloadScanPolicyAccept:
+		return nil
+	}
+	return errors.Errorf("invalid payload scan failure policy %q, expected %q or %q",
+		policy, payloadScanPolicyReject, payloadScanPolicyAccept)
+}
+
+// Payload scanner is an external command (malware scanner, IMA measurement,
+// ...) the payload of the update is streamed to on standard input while it
+// is being installed; the name and size of the payload are passed in
+// MENDER_PAYLOAD_NAME and MENDER_PAYLOAD_SIZE environment variables. Exit
+// status 0 accepts the payload, anything else rejects it. The updated
+// partition is enabled only once all payloads are accepted.
+type payloadScanner struct {
+	command []string
+	// time to wait for the verdict once the whole payload is written
+	timeout      time.Duration
+	acceptFailed bool
+	// deployment directory outputs of scanners are saved to, if any
+	outputDir string
+
+	scans []*payloadScan
+}
+
+type payloadScan struct {
+	name   string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	output *cappedBuffer
+	done   chan error
+	// scanner could not be started
+	err error
+}
+
+// Returns nil scanner if no scanner command is configured.
+func newPayloadScanner(config MenderConfig) (*payloadScanner, error) {
+	if len(config.PayloadScanCommand) == 0 {
+		return nil, nil
+	}
+	if err := validatePayloadScanPolicy(config.PayloadScanFailurePolicy); err != nil {
+		return nil, err
+	}
+	ps := &payloadScanner{
+		command:      config.PayloadScanCommand,
+		timeout:      defaultPayloadScanTimeout,
+		acceptFailed: config.PayloadScanFailurePolicy == payloadScanPolicyAccept,
+	}
+	if config.PayloadScanTimeoutSeconds > 0 {
+		ps.timeout = time.Duration(config.PayloadScanTimeoutSeconds) * time.Second
+	}
+	return ps, nil
+}
+
+// observe starts the scanner for a payload; it is an installer.PayloadObserver.
+func (ps *payloadScanner) observe(name string, size int64) io.Writer {
+	scan := &payloadScan{
+		name:   name,
+		output: &cappedBuffer{max: payloadScanMaxOutput},
+		done:   make(chan error, 1),
+	}
+	ps.scans = append(ps.scans, scan)
+
+	scan.cmd = exec.Command(ps.command[0], ps.command[1:]...)
+	scan.cmd.Env = append(os.Environ(),
+		"MENDER_PAYLOAD_NAME="+name,
+		fmt.Sprintf("MENDER_PAYLOAD_SIZE=%d", size))
+	scan.cmd.Stdout = scan.output
+	scan.cmd.Stderr = scan.output
+	// scanner may be a script; its children must go away with it
+	scan.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	stdin, err := scan.cmd.StdinPipe()
+	if err == nil {
+		err = scan.cmd.Start()
+	}
+	if err != nil {
+		scan.err = errors.Wrapf(err, "failed to start payload scanner %s", ps.command[0])
+		log.Errorf("%v", scan.err)
+		return nil
+	}
+	scan.stdin = stdin
+	go func() {
+		scan.done <- scan.cmd.Wait()
+	}()
+
+	log.Infof("scanning payload %s with %s", name, ps.command[0])
+	return &scanWriter{w: stdin}
+}
+
+// verdict waits for all scanners started since the previous verdict and
+// returns error wrapping ErrPayloadRejected if any of them rejected its
+// payload, or ErrPayloadScanFailed if any could not give the verdict and
+// failed scans are not accepted. Nil scanner accepts everything.
+func (ps *payloadScanner) verdict() error {
+	if ps == nil {
+		return nil
+	}
+	scans := ps.scans
+	ps.scans = nil
+
+	var rejected, failed error
+	for _, scan := range scans {
+		err := scan.wait(ps.timeout)
+		if ps.outputDir != "" {
+			scan.saveOutput(ps.outputDir)
+		}
+		switch errors.Cause(err) {
+		case nil:
+			log.Infof("payload %s accepted by scanner", scan.name)
+		case ErrPayloadRejected:
+			log.Errorf("%v", err)
+			if rejected == nil {
+				rejected = err
+			}
+		default:
+			log.Errorf("%v", err)
+			if failed == nil {
+				failed = err
+			}
+		}
+	}
+
+	if rejected != nil {
+		return rejected
+	}
+	if failed != nil {
+		if ps.acceptFailed {
+			log.Warnf("accepting payload without scanner verdict, as configured")
+			return nil
+		}
+		return failed
+	}
+	return nil
+}
+
+// abort stops scanners of an install that failed.
+func (ps *payloadScanner) abort() {
+	if ps == nil {
+		return
+	}
+	for _, scan := range ps.scans {
+		if scan.err != nil {
+			continue
+		}
+		scan.stdin.Close()
+		scan.kill()
+		<-scan.done
+	}
+	ps.scans = nil
+}
+
+func (scan *payloadScan) wait(timeout time.Duration) error {
+	if scan.err != nil {
+		return errors.Wrap(ErrPayloadScanFailed, scan.err.Error())
+	}
+
+	// end of payload
+	scan.stdin.Close()
+
+	var err error
+	select {
+	case err = <-scan.done:
+	case <-time.After(timeout):
+		// the goroutine waiting for the scanner finishes once it is gone
+		scan.kill()
+		<-scan.done
+		return errors.Wrapf(ErrPayloadScanFailed, "no verdict on payload %s in %v",
+			scan.name, timeout)
+	}
+
+	if err == nil {
+		return nil
+	}
+	output := strings.TrimSpace(scan.output.String())
+	if _, ok := err.(*exec.ExitError); ok {
+		return errors.Wrapf(ErrPayloadRejected, "payload %s: %v: %s",
+			scan.name, err, output)
+	}
+	return errors.Wrapf(ErrPayloadScanFailed, "payload %s: %v: %s",
+		scan.name, err, output)
+}
+
+func (scan *payloadScan) saveOutput(dir string) {
+	name := filepath.Join(dir, "payload-scan-"+safeFileName(scan.name)+".log")
+	if err := ioutil.WriteFile(name, scan.output.Bytes(), 0600); err != nil {
+		log.Warnf("failed to save output of payload scanner: %v", err)
+	}
+}
+
+func (scan *payloadScan) kill() {
+	syscall.Kill(-scan.cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// Scanner may exit without reading all of the payload (eg. once it finds
+// something suspicious); that must not fail the install itself, the verdict
+// decides.
+type scanWriter struct {
+	w      io.Writer
+	failed bool
+}
+
+func (sw *scanWriter) Write(p []byte) (int, error) {
+	if !sw.failed {
+		if _, err := sw.w.Write(p); err != nil {
+			log.Debugf("payload scanner stopped reading: %v", err)
+			sw.failed = true
+		}
+	}
+	return len(p), nil
+}
+
+// Buffer keeping at most max leading bytes written to it.
+type cappedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (cb *cappedBuffer) Write(p []byte) (int, error) {
+	if room := cb.max - cb.Len(); room > 0 {
+		if len(p) > room {
+			cb.Buffer.Write(p[:room])
+		} else {
+			cb.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
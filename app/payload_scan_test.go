@@ -0,0 +1,170 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/app/testutils"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPayloadScanner(t *testing.T, script string, policy string) *payloadScanner {
+	ps, err := newPayloadScanner(MenderConfig{
+		PayloadScanCommand:        []string{"/bin/sh", "-c", script},
+		PayloadScanTimeoutSeconds: 1,
+		PayloadScanFailurePolicy:  policy,
+	})
+	assert.NoError(t, err)
+	return ps
+}
+
+func scanPayload(ps *payloadScanner, data []byte) error {
+	if w := ps.observe("rootfs.ext4", int64(len(data))); w != nil {
+		io.Copy(w, bytes.NewReader(data))
+	}
+	return ps.verdict()
+}
+
+func TestPayloadScannerConfig(t *testing.T) {
+	ps, err := newPayloadScanner(MenderConfig{})
+	assert.NoError(t, err)
+	assert.Nil(t, ps)
+	// nil scanner accepts everything
+	assert.NoError(t, ps.verdict())
+	ps.abort()
+
+	_, err = newPayloadScanner(MenderConfig{
+		PayloadScanCommand:       []string{"scan"},
+		PayloadScanFailurePolicy: "maybe",
+	})
+	assert.Error(t, err)
+
+	ps, err = newPayloadScanner(MenderConfig{
+		PayloadScanCommand: []string{"scan"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, defaultPayloadScanTimeout, ps.timeout)
+	assert.False(t, ps.acceptFailed)
+}
+
+func TestPayloadScanner(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	payload := bytes.Repeat([]byte("payload data "), 100000)
+
+	// scanner gets the whole payload, and its name and size
+	out := path.Join(tdir, "scanned")
+	ps := newTestPayloadScanner(t, `cat > `+out+`; `+
+		`echo "$MENDER_PAYLOAD_NAME $MENDER_PAYLOAD_SIZE" > `+out+`.env`, "")
+	assert.NoError(t, scanPayload(ps, payload))
+	scanned, err := ioutil.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, scanned)
+	env, err := ioutil.ReadFile(out + ".env")
+	assert.NoError(t, err)
+	assert.Equal(t, "rootfs.ext4 1300000\n", string(env))
+
+	// rejected, with scanner output in the error
+	ps = newTestPayloadScanner(t, "cat > /dev/null; echo EICAR found; exit 1", "")
+	err = scanPayload(ps, payload)
+	assert.Equal(t, ErrPayloadRejected, errors.Cause(err))
+	assert.Contains(t, err.Error(), "EICAR found")
+
+	// output is saved to the deployment directory
+	ps = newTestPayloadScanner(t, "cat > /dev/null; echo clean", "")
+	ps.outputDir = tdir
+	assert.NoError(t, scanPayload(ps, payload))
+	output, err := ioutil.ReadFile(path.Join(tdir, "payload-scan-rootfs.ext4.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, "clean\n", string(output))
+
+	// scanner giving up reading early does not break the install
+	ps = newTestPayloadScanner(t, "exit 3", "")
+	err = scanPayload(ps, payload)
+	assert.Equal(t, ErrPayloadRejected, errors.Cause(err))
+
+	// scanner hangs
+	ps = newTestPayloadScanner(t, "cat > /dev/null; sleep 10", "")
+	err = scanPayload(ps, payload)
+	assert.Equal(t, ErrPayloadScanFailed, errors.Cause(err))
+
+	ps = newTestPayloadScanner(t, "cat > /dev/null; sleep 10", payloadScanPolicyAccept)
+	assert.NoError(t, scanPayload(ps, payload))
+
+	// scanner missing
+	ps, _ = newPayloadScanner(MenderConfig{
+		PayloadScanCommand: []string{path.Join(tdir, "no-such-scanner")},
+	})
+	err = scanPayload(ps, payload)
+	assert.Equal(t, ErrPayloadScanFailed, errors.Cause(err))
+
+	ps.acceptFailed = true
+	assert.NoError(t, scanPayload(ps, payload))
+
+	// verdict is given once per install
+	ps = newTestPayloadScanner(t, "cat > /dev/null; exit 1", "")
+	assert.Error(t, scanPayload(ps, payload))
+	assert.NoError(t, ps.verdict())
+}
+
+func TestPayloadScannerAbort(t *testing.T) {
+	ps := newTestPayloadScanner(t, "sleep 10", "")
+	ps.observe("rootfs.ext4", 100)
+	ps.abort()
+	assert.Empty(t, ps.scans)
+	assert.NoError(t, ps.verdict())
+}
+
+func TestMenderPayloadScan(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	artifact, err := ioutil.ReadFile(writeTestArtifact(t, tdir, "release-1"))
+	assert.NoError(t, err)
+
+	m := newTestMender(nil, MenderConfig{
+		PayloadScanCommand: []string{"/bin/sh", "-c", "grep -q 'first update' && exit 1; exit 0"},
+	}, testMenderPieces{
+		MenderPieces: MenderPieces{
+			device: &testutils.FakeDevice{ConsumeUpdate: true},
+		},
+	})
+	assert.NotNil(t, m)
+	m.deviceTypeFile = path.Join(tdir, "device_type")
+	assert.NoError(t, ioutil.WriteFile(m.deviceTypeFile,
+		[]byte("device_type=vexpress-qemu\n"), 0644))
+
+	// payload is written, but not accepted
+	assert.NoError(t, m.InstallArtifact(client.UpdateResponse{},
+		ioutil.NopCloser(bytes.NewReader(artifact)), 0))
+	assert.Equal(t, ErrPayloadRejected, errors.Cause(m.PayloadVerdict(client.UpdateResponse{})))
+
+	// failed install stops the scanner
+	m.UInstallCommitRebooter = &testutils.FakeDevice{
+		RetInstallUpdate: errors.New("write failed"),
+	}
+	assert.Error(t, m.InstallArtifact(client.UpdateResponse{},
+		ioutil.NopCloser(bytes.NewReader(artifact)), 0))
+	assert.Empty(t, m.payloadScanner.scans)
+	assert.NoError(t, m.PayloadVerdict(client.UpdateResponse{}))
+}
@@ -0,0 +1,107 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// UpdatePolicy is a local policy (maintenance window, power state, user
+// confirmation, ...) deciding whether an update may be installed right away.
+// Deployment metadata the server sent along with the update is available to
+// policies in update.DeploymentMetadata.
+type UpdatePolicy interface {
+	// DeferUpdate returns the time until which the update should be
+	// deferred together with the reason, or zero time if the update may
+	// proceed.
+	DeferUpdate(update client.UpdateResponse, now time.Time) (time.Time, string)
+}
+
+// Maintenance window given as time of day range in local time; the window may
+// span midnight. Times of day are wall clock times, which on days of daylight
+// saving time changes are not the time elapsed since midnight.
+type maintenanceWindow struct {
+	start time.Duration
+	end   time.Duration
+}
+
+// timeOfDay returns wall clock time of day of t.
+func timeOfDay(t time.Time) time.Duration {
+	h, m, s := t.Clock()
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute +
+		time.Duration(s)*time.Second + time.Duration(t.Nanosecond())
+}
+
+// onDay returns time tod of the day `days` after the day of t, in the
+// location of t.
+func onDay(t time.Time, days int, tod time.Duration) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day()+days, int(tod/time.Hour),
+		int(tod%time.Hour/time.Minute), 0, 0, t.Location())
+}
+
+// Parse maintenance window in HH:MM-HH:MM format.
+func parseMaintenanceWindow(s string) (*maintenanceWindow, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, errors.Errorf("invalid maintenance window %q, expected HH:MM-HH:MM", s)
+	}
+
+	var mw maintenanceWindow
+	for i, dst := range []*time.Duration{&mw.start, &mw.end} {
+		var h, m int
+		if _, err := fmt.Sscanf(strings.TrimSpace(parts[i]), "%d:%d", &h, &m); err != nil ||
+			h < 0 || h > 23 || m < 0 || m > 59 {
+			return nil, errors.Errorf("invalid maintenance window time %q", parts[i])
+		}
+		*dst = time.Duration(h)*time.Hour + time.Duration(m)*time.Minute
+	}
+
+	if mw.start == mw.end {
+		return nil, errors.Errorf("empty maintenance window %q", s)
+	}
+	return &mw, nil
+}
+
+func (mw *maintenanceWindow) DeferUpdate(update client.UpdateResponse,
+	now time.Time) (time.Time, string) {
+	tod := timeOfDay(now)
+
+	var inside bool
+	if mw.start < mw.end {
+		inside = tod >= mw.start && tod < mw.end
+	} else {
+		// window spans midnight
+		inside = tod >= mw.start || tod < mw.end
+	}
+	if inside {
+		return time.Time{}, ""
+	}
+
+	next := onDay(now, 0, mw.start)
+	if !next.After(now) {
+		next = onDay(now, 1, mw.start)
+	}
+	return next, "outside of maintenance window"
+}
+
+// Status report substate of deferred deployment.
+func deferredSubState(until time.Time, reason string) string {
+	return fmt.Sprintf("deferred until %s: %s",
+		until.UTC().Format(time.RFC3339), reason)
+}
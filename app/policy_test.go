@@ -0,0 +1,134 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMaintenanceWindow(t *testing.T) {
+	mw, err := parseMaintenanceWindow("22:00-04:30")
+	assert.NoError(t, err)
+	assert.Equal(t, 22*time.Hour, mw.start)
+	assert.Equal(t, 4*time.Hour+30*time.Minute, mw.end)
+
+	for _, s := range []string{"", "22:00", "22:00-", "25:00-04:00",
+		"22:00-04:60", "foo-bar", "10:00-10:00", "1:00-2:00-3:00"} {
+		_, err := parseMaintenanceWindow(s)
+		assert.Error(t, err, "window %q should be invalid", s)
+	}
+}
+
+func TestMaintenanceWindow(t *testing.T) {
+	at := func(day, h, m int) time.Time {
+		return time.Date(2017, 1, day, h, m, 0, 0, time.Local)
+	}
+	update := client.UpdateResponse{}
+
+	mw, _ := parseMaintenanceWindow("02:00-04:00")
+	until, _ := mw.DeferUpdate(update, at(1, 3, 0))
+	assert.True(t, until.IsZero())
+
+	until, reason := mw.DeferUpdate(update, at(1, 1, 0))
+	assert.Equal(t, at(1, 2, 0), until)
+	assert.NotEmpty(t, reason)
+
+	until, _ = mw.DeferUpdate(update, at(1, 4, 0))
+	assert.Equal(t, at(2, 2, 0), until)
+
+	// window spanning midnight
+	mw, _ = parseMaintenanceWindow("22:00-02:00")
+	until, _ = mw.DeferUpdate(update, at(1, 23, 0))
+	assert.True(t, until.IsZero())
+	until, _ = mw.DeferUpdate(update, at(1, 1, 0))
+	assert.True(t, until.IsZero())
+	until, _ = mw.DeferUpdate(update, at(1, 12, 0))
+	assert.Equal(t, at(1, 22, 0), until)
+}
+
+func TestMaintenanceWindowDST(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	at := func(month time.Month, day, h, m int) time.Time {
+		return time.Date(2017, month, day, h, m, 0, 0, loc)
+	}
+	update := client.UpdateResponse{}
+	mw, _ := parseMaintenanceWindow("04:00-05:00")
+
+	// clocks go forward at 02:00 on March 26th; the day is 23 hours long
+	until, _ := mw.DeferUpdate(update, at(time.March, 25, 12, 0))
+	assert.Equal(t, at(time.March, 26, 4, 0), until)
+	assert.Equal(t, 4, until.Hour())
+	until, _ = mw.DeferUpdate(update, at(time.March, 26, 3, 30))
+	assert.Equal(t, at(time.March, 26, 4, 0), until)
+	until, _ = mw.DeferUpdate(update, at(time.March, 26, 4, 30))
+	assert.True(t, until.IsZero())
+	until, _ = mw.DeferUpdate(update, at(time.March, 26, 5, 0))
+	assert.Equal(t, at(time.March, 27, 4, 0), until)
+
+	// clocks go back at 03:00 on October 29th; the day is 25 hours long
+	until, _ = mw.DeferUpdate(update, at(time.October, 28, 12, 0))
+	assert.Equal(t, at(time.October, 29, 4, 0), until)
+	assert.Equal(t, 4, until.Hour())
+	until, _ = mw.DeferUpdate(update, at(time.October, 29, 4, 59))
+	assert.True(t, until.IsZero())
+	until, _ = mw.DeferUpdate(update, at(time.October, 29, 5, 0))
+	assert.Equal(t, at(time.October, 30, 4, 0), until)
+}
+
+type testUpdatePolicy struct {
+	until  time.Time
+	reason string
+}
+
+func (p testUpdatePolicy) DeferUpdate(update client.UpdateResponse,
+	now time.Time) (time.Time, string) {
+	return p.until, p.reason
+}
+
+func TestMenderDeferUpdate(t *testing.T) {
+	mender := newDefaultTestMender()
+	update := client.UpdateResponse{}
+
+	until, _ := mender.DeferUpdate(update)
+	assert.True(t, until.IsZero())
+
+	later := time.Now().Add(2 * time.Hour)
+	mender.AddUpdatePolicy(testUpdatePolicy{})
+	mender.AddUpdatePolicy(testUpdatePolicy{later, "waiting for confirmation"})
+	mender.AddUpdatePolicy(testUpdatePolicy{later.Add(-time.Hour), "battery low"})
+
+	// latest deferral wins
+	until, reason := mender.DeferUpdate(update)
+	assert.Equal(t, later, until)
+	assert.Equal(t, "waiting for confirmation", reason)
+
+	// maintenance window from configuration
+	_, err := NewMender(MenderConfig{UpdateMaintenanceWindow: "foo"}, MenderPieces{})
+	assert.Error(t, err)
+	m, err := NewMender(MenderConfig{UpdateMaintenanceWindow: "01:00-02:00"}, MenderPieces{})
+	assert.NoError(t, err)
+	assert.Len(t, m.policies, 1)
+}
+
+func TestDeferredSubState(t *testing.T) {
+	assert.Equal(t, "deferred until 2017-01-02T03:04:05Z: battery low",
+		deferredSubState(time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC), "battery low"))
+}
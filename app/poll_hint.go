@@ -0,0 +1,83 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+)
+
+// Bounds of the update polling interval the server can request, unless
+// configured otherwise.
+const (
+	defaultPollHintMin = time.Minute
+	defaultPollHintMax = 24 * time.Hour
+)
+
+// Update polling interval requested by the server, so that the backend can
+// make the whole fleet poll more or less often for a while (eg. during an
+// incident). The hint is honored for as long as the server keeps sending it,
+// within the bounds allowed by local configuration.
+type pollIntervalHint struct {
+	min, max time.Duration
+	// zero if the server does not request any
+	interval time.Duration
+}
+
+func newPollIntervalHint(config MenderConfig) *pollIntervalHint {
+	h := &pollIntervalHint{
+		min: defaultPollHintMin,
+		max: defaultPollHintMax,
+	}
+	if config.PollIntervalHintMinSeconds > 0 {
+		h.min = time.Duration(config.PollIntervalHintMinSeconds) * time.Second
+	}
+	if config.PollIntervalHintMaxSeconds > 0 {
+		h.max = time.Duration(config.PollIntervalHintMaxSeconds) * time.Second
+	}
+	return h
+}
+
+// update takes the hint from headers of a server response; response
+// without the hint ends the override.
+func (h *pollIntervalHint) update(header http.Header) {
+	interval, ok := client.PollIntervalHint(header)
+	if !ok {
+		if h.interval != 0 {
+			log.Infof("server no longer overrides update polling interval")
+			h.interval = 0
+		}
+		return
+	}
+	if interval < h.min {
+		interval = h.min
+	} else if interval > h.max {
+		interval = h.max
+	}
+	if interval != h.interval {
+		log.Infof("server overrides update polling interval: %v", interval)
+		h.interval = interval
+	}
+}
+
+// get returns interval requested by the server, or the configured one.
+func (h *pollIntervalHint) get(configured time.Duration) time.Duration {
+	if h == nil || h.interval == 0 {
+		return configured
+	}
+	return h.interval
+}
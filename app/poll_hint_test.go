@@ -0,0 +1,113 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPollIntervalHint(t *testing.T) {
+	h := newPollIntervalHint(MenderConfig{})
+	assert.Equal(t, defaultPollHintMin, h.min)
+	assert.Equal(t, defaultPollHintMax, h.max)
+
+	h = newPollIntervalHint(MenderConfig{
+		PollIntervalHintMinSeconds: 10,
+		PollIntervalHintMaxSeconds: 600,
+	})
+	assert.Equal(t, time.Minute, h.get(time.Minute))
+
+	hint := func(v string) http.Header {
+		header := http.Header{}
+		header.Set(client.PollIntervalHeader, v)
+		return header
+	}
+
+	h.update(hint("120"))
+	assert.Equal(t, 2*time.Minute, h.get(time.Minute))
+
+	// bounded by configuration
+	h.update(hint("1"))
+	assert.Equal(t, 10*time.Second, h.get(time.Minute))
+	h.update(hint("86400"))
+	assert.Equal(t, 10*time.Minute, h.get(time.Minute))
+
+	// invalid hint ends the override like a missing one
+	h.update(hint("soon"))
+	assert.Equal(t, time.Minute, h.get(time.Minute))
+	h.update(hint("30"))
+	h.update(http.Header{})
+	assert.Equal(t, time.Minute, h.get(time.Minute))
+
+	var nilHint *pollIntervalHint
+	assert.Equal(t, time.Minute, nilHint.get(time.Minute))
+}
+
+func TestMenderPollIntervalHint(t *testing.T) {
+	var authHint, updateHint string
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/auth_requests"):
+				if authHint != "" {
+					w.Header().Set(client.PollIntervalHeader, authHint)
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("token"))
+			case strings.Contains(r.URL.Path, "/deployments/next"):
+				if updateHint != "" {
+					w.Header().Set(client.PollIntervalHeader, updateHint)
+				}
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	defer srv.Close()
+
+	mender := newTestMender(nil,
+		MenderConfig{
+			ServerURL:                 srv.URL,
+			UpdatePollIntervalSeconds: 1800,
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				authMgr: &testAuthManager{authtoken: "token"},
+			},
+		})
+	assert.Equal(t, 30*time.Minute, mender.GetUpdatePollInterval())
+
+	authHint = "300"
+	assert.NoError(t, mender.Authorize(context.Background()))
+	assert.Equal(t, 5*time.Minute, mender.GetUpdatePollInterval())
+
+	updateHint = "7200"
+	_, err := mender.CheckUpdate(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Hour, mender.GetUpdatePollInterval())
+
+	// server stopped overriding
+	updateHint = ""
+	_, err = mender.CheckUpdate(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Minute, mender.GetUpdatePollInterval())
+}
@@ -0,0 +1,157 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/installer"
+)
+
+// What the running artifact provides: its name and digests of its payloads,
+// recorded when it is committed. Deployment of artifact of the same name is
+// skipped only if its payloads are the same too; names alone may be reused
+// for different builds.
+const (
+	// payloads of the installed, not yet committed artifact
+	pendingProvidesName = "artifact-provides-pending"
+	// payloads of the committed artifact
+	providesName = "artifact-provides"
+)
+
+type artifactProvides struct {
+	ArtifactName string `json:"artifact_name"`
+	// SHA-256 digests (hex) by payload name; artifacts with payload
+	// checksums of other algorithms never match and are installed again
+	PayloadDigests map[string]string `json:"payload_digests"`
+}
+
+func loadArtifactProvides(store Store, name string) *artifactProvides {
+	if store == nil {
+		return nil
+	}
+	data, err := store.ReadAll(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("failed to read %s: %v", name, err)
+		}
+		return nil
+	}
+	var p artifactProvides
+	if err := json.Unmarshal(data, &p); err != nil {
+		log.Warnf("discarding broken %s: %v", name, err)
+		return nil
+	}
+	return &p
+}
+
+// Entries are replaced as a whole by the store; readers see either the old
+// or the new record, never a partially written one.
+func (p *artifactProvides) save(store Store, name string) bool {
+	if store == nil {
+		return false
+	}
+	data, _ := json.Marshal(p)
+	if err := store.WriteAll(name, data); err != nil {
+		log.Errorf("failed to store %s: %v", name, err)
+		return false
+	}
+	return true
+}
+
+// commitArtifactProvides makes payloads of the installed artifact the ones
+// provided by the device. The pending record is removed only once the
+// committed one is written, so that commit interrupted in between is finished
+// by the post-commit cleanup.
+func commitArtifactProvides(store Store) {
+	p := loadArtifactProvides(store, pendingProvidesName)
+	if p == nil {
+		return
+	}
+	if p.save(store, providesName) {
+		store.Remove(pendingProvidesName)
+	}
+}
+
+// provides tells if the artifact with given name and payload digests is the
+// one recorded as provided.
+func (p *artifactProvides) provides(name string, digests map[string]string) bool {
+	if p == nil || p.ArtifactName != name || len(digests) == 0 ||
+		len(digests) != len(p.PayloadDigests) {
+		return false
+	}
+	for payload, digest := range digests {
+		if p.PayloadDigests[payload] != digest {
+			return false
+		}
+	}
+	return true
+}
+
+// Computes digests of payloads while they are being installed; its observe
+// method is an installer.PayloadObserver.
+type payloadDigester struct {
+	hashes map[string]hash.Hash
+}
+
+func newPayloadDigester() *payloadDigester {
+	return &payloadDigester{hashes: make(map[string]hash.Hash)}
+}
+
+func (d *payloadDigester) observe(name string, size int64) io.Writer {
+	h := sha256.New()
+	d.hashes[name] = h
+	return h
+}
+
+func (d *payloadDigester) provides(artifactName string) *artifactProvides {
+	p := &artifactProvides{
+		ArtifactName:   artifactName,
+		PayloadDigests: make(map[string]string),
+	}
+	for name, h := range d.hashes {
+		p.PayloadDigests[name] = hex.EncodeToString(h.Sum(nil))
+	}
+	return p
+}
+
+// installRecordingProvides installs the artifact on device and records the
+// digests of its payloads in store, to be provided once the update is
+// committed. Payload data goes to observe as well, if set.
+func installRecordingProvides(artifact io.ReadCloser, dt string,
+	device installer.UInstaller, store Store, observe installer.PayloadObserver) error {
+	digester := newPayloadDigester()
+	name, err := installer.InstallObserved(artifact, dt, device,
+		func(name string, size int64) io.Writer {
+			w := digester.observe(name, size)
+			if observe == nil {
+				return w
+			}
+			if o := observe(name, size); o != nil {
+				return io.MultiWriter(w, o)
+			}
+			return w
+		})
+	if err != nil {
+		return err
+	}
+	digester.provides(name).save(store, pendingProvidesName)
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/app/testutils"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArtifactProvides(t *testing.T) {
+	p := &artifactProvides{
+		ArtifactName:   "release-1",
+		PayloadDigests: map[string]string{"rootfs.ext4": "aa"},
+	}
+	assert.True(t, p.provides("release-1", map[string]string{"rootfs.ext4": "aa"}))
+	assert.False(t, p.provides("release-2", map[string]string{"rootfs.ext4": "aa"}))
+	assert.False(t, p.provides("release-1", map[string]string{"rootfs.ext4": "bb"}))
+	assert.False(t, p.provides("release-1", map[string]string{"other.ext4": "aa"}))
+	assert.False(t, p.provides("release-1", map[string]string{
+		"rootfs.ext4": "aa",
+		"app.tar":     "cc",
+	}))
+	assert.False(t, p.provides("release-1", nil))
+
+	var none *artifactProvides
+	assert.False(t, none.provides("release-1", map[string]string{"rootfs.ext4": "aa"}))
+
+	ms := utils.NewMemStore()
+	assert.Nil(t, loadArtifactProvides(ms, providesName))
+	commitArtifactProvides(ms)
+	assert.Nil(t, loadArtifactProvides(ms, providesName))
+
+	p.save(ms, pendingProvidesName)
+	commitArtifactProvides(ms)
+	assert.Equal(t, p, loadArtifactProvides(ms, providesName))
+	assert.Nil(t, loadArtifactProvides(ms, pendingProvidesName))
+
+	ms.WriteAll(providesName, []byte("garbage"))
+	assert.Nil(t, loadArtifactProvides(ms, providesName))
+}
+
+func TestMenderSkipInstalledPayloads(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-provides-")
+	defer os.RemoveAll(td)
+
+	upath, err := makeFakeUpdate(t, path.Join(td, "update-root"), true)
+	assert.NoError(t, err)
+	art, err := ioutil.ReadFile(upath)
+	assert.NoError(t, err)
+
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=vexpress-qemu\n"), 0644)
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=mender-1.0\n"), 0644)
+
+	update := client.UpdateResponse{ID: "foo"}
+	update.Artifact.ArtifactName = "mender-1.1"
+
+	ms := utils.NewMemStore()
+	mender := newTestMender(nil, MenderConfig{}, testMenderPieces{
+		MenderPieces: MenderPieces{
+			store:  ms,
+			device: &testutils.FakeDevice{ConsumeUpdate: true},
+		},
+	})
+	mender.deviceTypeFile = deviceType
+	mender.artifactInfoFile = artifactInfo
+
+	// payloads are recorded once the artifact is committed
+	assert.NoError(t, mender.InstallArtifact(update,
+		ioutil.NopCloser(bytes.NewReader(art)), int64(len(art))))
+	assert.Nil(t, loadArtifactProvides(ms, providesName))
+	assert.NoError(t, mender.CommitUpdate())
+	p := loadArtifactProvides(ms, providesName)
+	assert.NotNil(t, p)
+	assert.Equal(t, "mender-1.1", p.ArtifactName)
+	assert.Len(t, p.PayloadDigests, 1)
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=mender-1.1\n"), 0644)
+
+	// same artifact again is not downloaded
+	mender.updater = testutils.FakeUpdater{
+		FetchUpdateHeaderReturnReadCloser: ioutil.NopCloser(bytes.NewReader(art)),
+	}
+	merr := mender.VerifyUpdateHeader(context.Background(), update)
+	assert.NotNil(t, merr)
+	assert.Equal(t, os.ErrExist, merr.Cause())
+
+	// same name, different build
+	for name := range p.PayloadDigests {
+		p.PayloadDigests[name] = "0123"
+	}
+	p.save(ms, providesName)
+	mender.updater = testutils.FakeUpdater{
+		FetchUpdateHeaderReturnReadCloser: ioutil.NopCloser(bytes.NewReader(art)),
+	}
+	assert.Nil(t, mender.VerifyUpdateHeader(context.Background(), update))
+
+	// header can not be read, same name is what is left
+	mender.updater = testutils.FakeUpdater{
+		FetchUpdateHeaderReturnReadCloser: ioutil.NopCloser(bytes.NewReader(art[:10])),
+	}
+	merr = mender.VerifyUpdateHeader(context.Background(), update)
+	assert.NotNil(t, merr)
+	assert.Equal(t, os.ErrExist, merr.Cause())
+}
+
+func TestStateUpdateFetchAlreadyInstalled(t *testing.T) {
+
+	update := client.UpdateResponse{ID: "foo"}
+	ctx := StateContext{store: utils.NewMemStore()}
+	s, _ := NewUpdateFetchState(update).Handle(&ctx, &stateTestController{
+		verifyHeaderErr: NewTransientError(os.ErrExist),
+	})
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Equal(t, client.StatusAlreadyInstalled, s.(*UpdateStatusReportState).status)
+}
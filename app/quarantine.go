@@ -0,0 +1,143 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Consecutive failed deployments, and time the device was quarantined once
+// there were too many of them. Quarantined device declines deployments, so
+// that an update failing over and over again does not wear out the flash,
+// until the quarantine is cleared locally (-clear-quarantine) or by the
+// server (clear-quarantine command).
+const quarantineName = "deployment-quarantine"
+
+var ErrQuarantined = errors.New("device is quarantined after repeatedly failed deployments")
+
+type deploymentQuarantine struct {
+	FailedDeployments int       `json:"failed_deployments"`
+	LastDeploymentID  string    `json:"last_deployment_id,omitempty"`
+	Since             time.Time `json:"since,omitempty"`
+}
+
+func loadQuarantine(store Store) deploymentQuarantine {
+	var q deploymentQuarantine
+	if store == nil {
+		return q
+	}
+	data, err := store.ReadAll(quarantineName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("failed to read deployment quarantine: %v", err)
+		}
+		return q
+	}
+	if err := json.Unmarshal(data, &q); err != nil {
+		log.Warnf("discarding broken deployment quarantine: %v", err)
+		return deploymentQuarantine{}
+	}
+	return q
+}
+
+func (q deploymentQuarantine) quarantined() bool {
+	return !q.Since.IsZero()
+}
+
+// Count the final status of the deployment; the device is quarantined once
+// `threshold` deployments in a row failed. Status of the same deployment
+// reported again, eg. after restart, is counted once. Deployments declined
+// while quarantined, or skipped on the device, are not counted.
+func recordDeploymentResult(store Store, threshold int, deploymentID, status string,
+	now time.Time) {
+	if store == nil || threshold <= 0 {
+		return
+	}
+	q := loadQuarantine(store)
+	if q.quarantined() || q.LastDeploymentID == deploymentID ||
+		deploymentSkipped(store, deploymentID) {
+		return
+	}
+
+	switch status {
+	case client.StatusFailure:
+		q.FailedDeployments++
+	case client.StatusSuccess, client.StatusAlreadyInstalled:
+		q.FailedDeployments = 0
+	default:
+		return
+	}
+	q.LastDeploymentID = deploymentID
+	if q.FailedDeployments >= threshold {
+		log.Errorf("%d deployments in a row failed, declining deployments "+
+			"until the quarantine is cleared", q.FailedDeployments)
+		q.Since = now
+	}
+
+	data, _ := json.Marshal(&q)
+	if err := store.WriteAll(quarantineName, data); err != nil {
+		log.Errorf("failed to save deployment quarantine: %v", err)
+	}
+}
+
+func clearQuarantine(store Store) error {
+	if err := store.Remove(quarantineName); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to clear deployment quarantine")
+	}
+	return nil
+}
+
+// Deployments are declined while the device is quarantined.
+func (m *mender) checkQuarantine() error {
+	if m.config.QuarantineAfterFailedDeployments <= 0 {
+		return nil
+	}
+	if q := loadQuarantine(m.store); q.quarantined() {
+		return errors.Wrapf(ErrQuarantined, "%d failed deployments, since %s",
+			q.FailedDeployments, q.Since.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Lift the quarantine, as requested by the server.
+func (m *mender) ClearQuarantine() menderError {
+	if m.store == nil {
+		return nil
+	}
+	if err := clearQuarantine(m.store); err != nil {
+		return NewTransientError(err)
+	}
+	log.Info("deployment quarantine cleared")
+	return nil
+}
+
+func doClearQuarantine(dataStore string) error {
+	dbstore := NewDBStore(dataStore)
+	if dbstore == nil {
+		return errors.New("failed to initialize DB store")
+	}
+	defer dbstore.Close()
+
+	if err := clearQuarantine(dbstore); err != nil {
+		return err
+	}
+	log.Info("deployment quarantine cleared")
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeploymentQuarantine(t *testing.T) {
+	ms := utils.NewMemStore()
+	now := time.Now()
+
+	// disabled
+	recordDeploymentResult(ms, 0, "dep-1", client.StatusFailure, now)
+	assert.Equal(t, 0, loadQuarantine(ms).FailedDeployments)
+
+	recordDeploymentResult(ms, 3, "dep-1", client.StatusFailure, now)
+	recordDeploymentResult(ms, 3, "dep-2", client.StatusFailure, now)
+	// the same deployment reported again after restart
+	recordDeploymentResult(ms, 3, "dep-2", client.StatusFailure, now)
+	// not final
+	recordDeploymentResult(ms, 3, "dep-3", client.StatusDownloading, now)
+	assert.Equal(t, 2, loadQuarantine(ms).FailedDeployments)
+	assert.False(t, loadQuarantine(ms).quarantined())
+
+	// success breaks the run
+	recordDeploymentResult(ms, 3, "dep-3", client.StatusSuccess, now)
+	assert.Equal(t, 0, loadQuarantine(ms).FailedDeployments)
+
+	for _, id := range []string{"dep-4", "dep-5", "dep-6"} {
+		recordDeploymentResult(ms, 3, id, client.StatusFailure, now)
+	}
+	q := loadQuarantine(ms)
+	assert.True(t, q.quarantined())
+	assert.Equal(t, 3, q.FailedDeployments)
+
+	// declined deployments do not count
+	recordDeploymentResult(ms, 3, "dep-7", client.StatusFailure, now.Add(time.Hour))
+	assert.Equal(t, q.FailedDeployments, loadQuarantine(ms).FailedDeployments)
+
+	assert.NoError(t, clearQuarantine(ms))
+	assert.False(t, loadQuarantine(ms).quarantined())
+	assert.NoError(t, clearQuarantine(ms))
+
+	ms.WriteAll(quarantineName, []byte("garbage"))
+	assert.False(t, loadQuarantine(ms).quarantined())
+}
+
+func TestMenderQuarantine(t *testing.T) {
+	ms := utils.NewMemStore()
+	mender := newTestMender(nil, MenderConfig{QuarantineAfterFailedDeployments: 2},
+		testMenderPieces{MenderPieces: MenderPieces{store: ms}})
+
+	update := client.UpdateResponse{ID: "dep-1"}
+	assert.NoError(t, mender.FilterUpdate(update))
+
+	// final status of each deployment is counted on entering report state
+	mender.SetState(NewUpdateStatusReportState(update, client.StatusFailure))
+	update.ID = "dep-2"
+	mender.SetState(NewUpdateStatusReportState(update, client.StatusFailure))
+
+	err := mender.FilterUpdate(client.UpdateResponse{ID: "dep-3"})
+	assert.Equal(t, ErrQuarantined, errors.Cause(err))
+
+	assert.Nil(t, mender.ClearQuarantine())
+	assert.NoError(t, mender.FilterUpdate(client.UpdateResponse{ID: "dep-3"}))
+
+	// quarantine in place but not enabled
+	mender.SetState(NewUpdateStatusReportState(client.UpdateResponse{ID: "dep-3"},
+		client.StatusFailure))
+	mender.SetState(NewUpdateStatusReportState(client.UpdateResponse{ID: "dep-4"},
+		client.StatusFailure))
+	mender.config.QuarantineAfterFailedDeployments = 0
+	assert.NoError(t, mender.FilterUpdate(client.UpdateResponse{ID: "dep-5"}))
+}
+
+func TestStateClearQuarantineCommand(t *testing.T) {
+
+	sc := &stateTestController{}
+	s, _ := NewDeviceCommandState(DeviceCommand{Name: CommandClearQuarantine}).
+		Handle(new(StateContext), sc)
+	assert.Equal(t, checkWaitState, s)
+	assert.True(t, sc.unquarantined)
+}
+
+func TestClearQuarantineArgs(t *testing.T) {
+	opts, err := argsParse([]string{"-no-syslog", "-clear-quarantine"})
+	assert.NoError(t, err)
+	assert.True(t, *opts.clearQuarant)
+
+	_, err = argsParse([]string{"-no-syslog", "-clear-quarantine", "-daemon"})
+	assert.Equal(t, errMsgAmbiguousArgumentsGiven, err)
+}
@@ -0,0 +1,193 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// how often readiness is checked while waiting
+	readinessCheckInterval = time.Second
+	// set by systemd-timesyncd once the clock is synchronized
+	timesyncdSyncedFile = "/run/systemd/timesync/synchronized"
+	// adjtimex(2) state of unsynchronized clock
+	timeStateError = 5
+)
+
+var (
+	errNoDefaultRoute = errors.New("no default route")
+	errClockNotSynced = errors.New("clock is not synchronized")
+)
+
+// Right after boot the network may not be up and the clock not set yet;
+// authorizing with the server then fails for sure, either to connect or on
+// validity of certificates. The daemon waits, for at most the configured
+// time each, until the network is up (default route exists and the server
+// name resolves) and the clock is synchronized (by the kernel NTP
+// discipline or systemd-timesyncd), before it starts. It carries on anyway
+// once the time is up.
+type readinessCheck struct {
+	name    string
+	timeout time.Duration
+	check   func(ctx context.Context) error
+}
+
+type readinessGate struct {
+	checks []readinessCheck
+}
+
+// Returns nil gate if no waits are configured.
+func newReadinessGate(config MenderConfig) *readinessGate {
+	g := &readinessGate{}
+	if config.WaitForNetworkTimeoutSeconds > 0 {
+		host := serverHost(config.ServerURL)
+		g.checks = append(g.checks, readinessCheck{
+			name:    "network",
+			timeout: time.Duration(config.WaitForNetworkTimeoutSeconds) * time.Second,
+			check: func(ctx context.Context) error {
+				return networkOnline(ctx, "/proc/net", host)
+			},
+		})
+	}
+	if config.WaitForTimeSyncTimeoutSeconds > 0 {
+		g.checks = append(g.checks, readinessCheck{
+			name:    "time synchronization",
+			timeout: time.Duration(config.WaitForTimeSyncTimeoutSeconds) * time.Second,
+			check: func(ctx context.Context) error {
+				return clockSynced(timesyncdSyncedFile)
+			},
+		})
+	}
+	if len(g.checks) == 0 {
+		return nil
+	}
+	return g
+}
+
+func serverHost(server string) string {
+	u, err := url.Parse(server)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// wait for all checks to pass or time out; returns false if ctx was
+// cancelled meanwhile.
+func (g *readinessGate) wait(ctx context.Context) bool {
+	if g == nil {
+		return true
+	}
+	for _, c := range g.checks {
+		if !c.wait(ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c readinessCheck) wait(ctx context.Context) bool {
+	started := time.Now()
+	deadline := started.Add(c.timeout)
+	for {
+		err := c.check(ctx)
+		if err == nil {
+			if waited := time.Since(started); waited >= readinessCheckInterval {
+				log.Infof("%s ready after %v", c.name, waited.Truncate(time.Second))
+			}
+			return true
+		}
+		if !time.Now().Before(deadline) {
+			log.Warnf("%s not ready after %v (%v), carrying on", c.name, c.timeout, err)
+			return true
+		}
+		log.Debugf("waiting for %s: %v", c.name, err)
+
+		wait := readinessCheckInterval
+		if left := time.Until(deadline); left < wait {
+			wait = left
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+}
+
+// networkOnline checks that there is a default route (IPv4 or IPv6) in
+// procNet and that host, if given, resolves.
+func networkOnline(ctx context.Context, procNet, host string) error {
+	if !hasDefaultRoute(procNet+"/route", 1, "00000000") &&
+		!hasDefaultRoute(procNet+"/ipv6_route", 0, strings.Repeat("0", 32)) {
+		return errNoDefaultRoute
+	}
+	if host == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, readinessCheckInterval*5)
+	defer cancel()
+	if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+		return errors.Wrapf(err, "failed to resolve %s", host)
+	}
+	return nil
+}
+
+// Tells whether the route table lists a route with destination `dest` in
+// the given column; the table header, if any, does not match.
+func hasDefaultRoute(table string, column int, dest string) bool {
+	f, err := os.Open(table)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) > column && fields[column] == dest {
+			return true
+		}
+	}
+	return false
+}
+
+// clockSynced checks the clock was synchronized, as told by the kernel or
+// the flag file of systemd-timesyncd.
+func clockSynced(syncedFile string) error {
+	if _, err := os.Stat(syncedFile); err == nil {
+		return nil
+	}
+	state, err := syscall.Adjtimex(&syscall.Timex{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to read clock state")
+	}
+	if state == timeStateError {
+		return errClockNotSynced
+	}
+	return nil
+}
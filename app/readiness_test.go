@@ -0,0 +1,116 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadinessGateConfig(t *testing.T) {
+	assert.Nil(t, newReadinessGate(MenderConfig{}))
+	// nil gate does not wait
+	var none *readinessGate
+	assert.True(t, none.wait(context.Background()))
+
+	g := newReadinessGate(MenderConfig{
+		ServerURL:                     "https://hosted.mender.io",
+		WaitForNetworkTimeoutSeconds:  60,
+		WaitForTimeSyncTimeoutSeconds: 120,
+	})
+	assert.Len(t, g.checks, 2)
+	assert.Equal(t, time.Minute, g.checks[0].timeout)
+	assert.Equal(t, 2*time.Minute, g.checks[1].timeout)
+
+	assert.Equal(t, "hosted.mender.io", serverHost("https://hosted.mender.io:443/"))
+	assert.Equal(t, "", serverHost(""))
+}
+
+func TestReadinessGateWait(t *testing.T) {
+	calls := 0
+	g := &readinessGate{checks: []readinessCheck{{
+		name:    "network",
+		timeout: time.Minute,
+		check: func(ctx context.Context) error {
+			if calls++; calls < 2 {
+				return errNoDefaultRoute
+			}
+			return nil
+		},
+	}}}
+	assert.True(t, g.wait(context.Background()))
+	assert.Equal(t, 2, calls)
+
+	// carries on once the time is up
+	g.checks[0].timeout = 10 * time.Millisecond
+	g.checks[0].check = func(ctx context.Context) error {
+		return errors.New("not ready")
+	}
+	assert.True(t, g.wait(context.Background()))
+
+	// cancelled
+	g.checks[0].timeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, g.wait(ctx))
+}
+
+func TestNetworkOnline(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	// no route tables at all
+	assert.Equal(t, errNoDefaultRoute, networkOnline(context.Background(), tdir, ""))
+
+	routes := "Iface\tDestination\tGateway\tFlags\n" +
+		"eth0\t000200C0\t00000000\t0001\n"
+	ioutil.WriteFile(filepath.Join(tdir, "route"), []byte(routes), 0600)
+	assert.Equal(t, errNoDefaultRoute, networkOnline(context.Background(), tdir, ""))
+
+	ioutil.WriteFile(filepath.Join(tdir, "route"),
+		[]byte(routes+"eth0\t00000000\t010200C0\t0003\n"), 0600)
+	assert.NoError(t, networkOnline(context.Background(), tdir, ""))
+	assert.NoError(t, networkOnline(context.Background(), tdir, "127.0.0.1"))
+	assert.Error(t, networkOnline(context.Background(), tdir, "no-such-host.invalid"))
+
+	// IPv6 only
+	os.Remove(filepath.Join(tdir, "route"))
+	ioutil.WriteFile(filepath.Join(tdir, "ipv6_route"),
+		[]byte("00000000000000000000000000000000 00 00000000000000000000000000000000 00 "+
+			"fe800000000000000000000000000001 00000400 00000001 00000000 00450003 eth0\n"),
+		0600)
+	assert.NoError(t, networkOnline(context.Background(), tdir, ""))
+}
+
+func TestClockSynced(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	synced := filepath.Join(tdir, "synchronized")
+	ioutil.WriteFile(synced, nil, 0600)
+	assert.NoError(t, clockSynced(synced))
+
+	// falls back to the kernel state, which depends on the host
+	err := clockSynced(filepath.Join(tdir, "missing"))
+	if err != nil {
+		assert.Equal(t, errClockNotSynced, err)
+	}
+}
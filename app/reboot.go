@@ -0,0 +1,114 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// Who reboots the device into the new artifact.
+const (
+	// the client reboots the device itself (default)
+	rebootModeSelf = "self"
+	// the client asks external reboot manager with D-Bus signal and waits
+	rebootModeSignal = "signal"
+	// the client exits with ErrRebootRequired, the supervisor reboots
+	rebootModeExit = "exit"
+)
+
+const rebootRequestedSignal = "RebootRequested"
+
+// ErrRebootRequired is returned once boot flags are set and the reboot is
+// left to the supervisor of the client; the state machine resumes after the
+// reboot.
+var ErrRebootRequired = errors.New("reboot required to finish the update")
+
+var (
+	// how long to wait for external reboot manager before asking again
+	externalRebootWait = time.Hour
+)
+
+func validateRebootMode(mode string) error {
+	switch mode {
+	case "", rebootModeSelf, rebootModeSignal, rebootModeExit:
+		return nil
+	}
+	return errors.Errorf("invalid reboot mode %q, expected one of %q, %q, %q",
+		mode, rebootModeSelf, rebootModeSignal, rebootModeExit)
+}
+
+func (m *mender) GetRebootMode() string {
+	if m.config.RebootMode == "" {
+		return rebootModeSelf
+	}
+	return m.config.RebootMode
+}
+
+// Ask external reboot manager to reboot the device.
+func (m *mender) RequestReboot() {
+	log.Infof("requesting reboot from external reboot manager")
+	m.emitSignal(rebootRequestedSignal)
+}
+
+// ID of the current boot, or "" if not known.
+func currentBootID() string {
+	data, err := ioutil.ReadFile(bootIDFile)
+	if err != nil {
+		log.Debugf("failed to read boot ID: %v", err)
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// State rebooting the device, which is also the state to stay in while
+// waiting for the reboot.
+type rebootingState interface {
+	State
+	Wait(ctx context.Context, wait time.Duration) bool
+}
+
+// Reboot the device, or hand the reboot off as configured. State data must be
+// stored before, so that the update is verified once the device comes back.
+func rebootDevice(ctx *StateContext, c Controller, s rebootingState) (State, bool) {
+	switch c.GetRebootMode() {
+	case rebootModeExit:
+		log.Info("boot flags set, leaving reboot to the supervisor")
+		return NewErrorState(NewFatalError(ErrRebootRequired)), false
+
+	case rebootModeSignal:
+		for {
+			c.RequestReboot()
+			if !s.Wait(ctx.Context(), externalRebootWait) {
+				return s, true
+			}
+			log.Warnf("device not rebooted within %v", externalRebootWait)
+		}
+	}
+
+	log.Info("rebooting device")
+
+	if err := c.Reboot(); err != nil {
+		log.Errorf("error rebooting device: %v", err)
+		return NewErrorState(NewFatalError(err)), false
+	}
+
+	// we can not reach this point
+	return doneState, false
+}
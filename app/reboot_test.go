@@ -0,0 +1,48 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebootMode(t *testing.T) {
+	mender := newDefaultTestMender()
+	assert.Equal(t, rebootModeSelf, mender.GetRebootMode())
+
+	mender = newTestMender(nil, MenderConfig{RebootMode: rebootModeExit},
+		testMenderPieces{})
+	assert.Equal(t, rebootModeExit, mender.GetRebootMode())
+
+	_, err := NewMender(MenderConfig{RebootMode: "kexec"}, MenderPieces{})
+	assert.Error(t, err)
+}
+
+func TestDaemonRebootRequired(t *testing.T) {
+	store := utils.NewMemStore()
+	mender := newTestMender(nil, MenderConfig{RebootMode: rebootModeExit},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: store,
+			},
+		})
+	mender.state = NewRebootState(client.UpdateResponse{ID: "foo"})
+
+	d := NewDaemon(mender, store)
+	assert.Equal(t, ErrRebootRequired, d.Run())
+}
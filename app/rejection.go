@@ -0,0 +1,68 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// What to do with the device key once the device is rejected or
+// decommissioned by the server: keep it, so that the device can be accepted
+// again as is, or generate new one, so that it shows up as new device.
+const (
+	rejectedKeyKeep       = "keep"
+	rejectedKeyRegenerate = "regenerate"
+)
+
+// the server is not asked again sooner after rejecting the device
+const defaultRejectedRetryInterval = 6 * time.Hour
+
+// Pending devices are refused with 401 too, so the device is taken as
+// rejected only after that many in a row.
+const defaultRejectedUnauthorizedAttempts = 10
+
+func validateRejectedKeyPolicy(policy string) error {
+	switch policy {
+	case "", rejectedKeyKeep, rejectedKeyRegenerate:
+		return nil
+	}
+	return errors.Errorf("invalid rejected key policy %q, expected one of %q, %q",
+		policy, rejectedKeyKeep, rejectedKeyRegenerate)
+}
+
+// Remove authorization data of the device rejected by the server, generating
+// new key on next bootstrap if configured to.
+func (m *mender) HandleRejection() menderError {
+	regenerate := m.config.RejectedKeyPolicy == rejectedKeyRegenerate
+	log.Warnf("device rejected by the server, removing authorization data "+
+		"(regenerating key: %v)", regenerate)
+	return m.resetAuthorization(regenerate)
+}
+
+func (m *mender) GetRejectedRetryInterval() time.Duration {
+	if m.config.RejectedRetryIntervalSeconds > 0 {
+		return time.Duration(m.config.RejectedRetryIntervalSeconds) * time.Second
+	}
+	return defaultRejectedRetryInterval
+}
+
+func (m *mender) GetRejectedUnauthorizedAttempts() int {
+	if m.config.RejectedUnauthorizedAttempts > 0 {
+		return m.config.RejectedUnauthorizedAttempts
+	}
+	return defaultRejectedUnauthorizedAttempts
+}
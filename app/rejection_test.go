@@ -0,0 +1,66 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMenderHandleRejection(t *testing.T) {
+	_, err := NewMender(MenderConfig{RejectedKeyPolicy: "forget"},
+		MenderPieces{store: utils.NewMemStore()})
+	assert.Error(t, err)
+
+	mender := newTestMender(nil, MenderConfig{}, testMenderPieces{})
+	mender.authToken = "token"
+	assert.Equal(t, defaultRejectedRetryInterval, mender.GetRejectedRetryInterval())
+	assert.Equal(t, defaultRejectedUnauthorizedAttempts,
+		mender.GetRejectedUnauthorizedAttempts())
+	assert.Nil(t, mender.HandleRejection())
+	assert.Equal(t, noAuthToken, mender.authToken)
+	// key is kept by default
+	assert.False(t, mender.forceBootstrap)
+
+	mender = newTestMender(nil, MenderConfig{
+		RejectedKeyPolicy:            rejectedKeyRegenerate,
+		RejectedRetryIntervalSeconds: 60,
+		RejectedUnauthorizedAttempts: 3,
+	}, testMenderPieces{})
+	assert.Equal(t, time.Minute, mender.GetRejectedRetryInterval())
+	assert.Equal(t, 3, mender.GetRejectedUnauthorizedAttempts())
+	assert.Nil(t, mender.HandleRejection())
+	assert.True(t, mender.forceBootstrap)
+}
+
+func TestMenderAuthorizeRejected(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer ts.Close()
+
+	mender := newTestMender(nil, MenderConfig{ServerURL: ts.URL}, testMenderPieces{})
+	assert.Nil(t, mender.Bootstrap())
+	merr := mender.Authorize(context.Background())
+	assert.NotNil(t, merr)
+	assert.Equal(t, client.AuthErrorRejected, errors.Cause(merr))
+}
@@ -0,0 +1,101 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+)
+
+// Some backends route status reports and deployment logs by fields of
+// their own, such as site id or customer tag; configured fields are added to
+// every status report and log upload. The script, if configured, prints
+// key=value lines and is run once, when the fields are first needed; fixed
+// fields take precedence over the ones printed by the script.
+type reportFields struct {
+	fixed  map[string]string
+	script string
+	cmdr   Commander
+
+	lock   sync.Mutex
+	fields map[string]string
+}
+
+// Returns nil if no report fields are configured.
+func newReportFields(config MenderConfig) *reportFields {
+	if len(config.ReportFields) == 0 && config.ReportFieldsScript == "" {
+		return nil
+	}
+	return &reportFields{
+		fixed:  config.ReportFields,
+		script: config.ReportFieldsScript,
+		cmdr:   &osCalls{},
+	}
+}
+
+func (r *reportFields) runScript() (map[string]string, error) {
+	out, err := r.cmdr.Command(r.script).Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to run report fields script %s",
+			r.script)
+	}
+	p := utils.KeyValParser{}
+	if err := p.Parse(bytes.NewReader(out)); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse output of report fields script %s",
+			r.script)
+	}
+	fields := make(map[string]string)
+	for k, v := range p.Collect() {
+		fields[k] = strings.Join(v, ",")
+	}
+	return fields, nil
+}
+
+// get returns fields added to reports; if the script fails, only the fixed
+// fields are returned and the script is run again next time.
+func (r *reportFields) get() map[string]string {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.fields != nil {
+		return r.fields
+	}
+	fields := make(map[string]string)
+	cache := true
+	if r.script != "" {
+		scripted, err := r.runScript()
+		if err != nil {
+			log.Warn(err)
+			cache = false
+		}
+		for k, v := range scripted {
+			fields[k] = v
+		}
+	}
+	for k, v := range r.fixed {
+		fields[k] = v
+	}
+	if cache {
+		r.fields = fields
+	}
+	return fields
+}
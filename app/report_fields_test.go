@@ -0,0 +1,66 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportFields(t *testing.T) {
+	assert.Nil(t, newReportFields(MenderConfig{}))
+	// nil fields add nothing
+	var none *reportFields
+	assert.Nil(t, none.get())
+
+	r := newReportFields(MenderConfig{
+		ReportFields: map[string]string{"site": "oslo"},
+	})
+	assert.Equal(t, map[string]string{"site": "oslo"}, r.get())
+
+	// fixed fields override the scripted ones, repeated keys are joined
+	cmdr := newTestOSCalls("site=bergen\nvariant=a\nvariant=b", 0)
+	r = newReportFields(MenderConfig{
+		ReportFields:       map[string]string{"site": "oslo"},
+		ReportFieldsScript: "report-fields",
+	})
+	r.cmdr = &cmdr
+	expected := map[string]string{"site": "oslo", "variant": "a,b"}
+	assert.Equal(t, expected, r.get())
+
+	// script output is cached
+	failing := newTestOSCalls("", 1)
+	r.cmdr = &failing
+	assert.Equal(t, expected, r.get())
+}
+
+func TestReportFieldsScriptFailure(t *testing.T) {
+	r := newReportFields(MenderConfig{
+		ReportFields:       map[string]string{"site": "oslo"},
+		ReportFieldsScript: "report-fields",
+	})
+	failing := newTestOSCalls("", 1)
+	r.cmdr = &failing
+	assert.Equal(t, map[string]string{"site": "oslo"}, r.get())
+
+	malformed := newTestOSCalls("no separator", 0)
+	r.cmdr = &malformed
+	assert.Equal(t, map[string]string{"site": "oslo"}, r.get())
+
+	// script is run again until it succeeds
+	cmdr := newTestOSCalls("tag=acme", 0)
+	r.cmdr = &cmdr
+	assert.Equal(t, map[string]string{"site": "oslo", "tag": "acme"}, r.get())
+}
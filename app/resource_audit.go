@@ -0,0 +1,133 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+var ErrResourceLeak = errors.New("resource usage keeps growing")
+
+// Snapshot of resources held by the process.
+type resourceUsage struct {
+	Goroutines int
+	// -1 if the number of open file descriptors is not known
+	OpenFDs   int
+	HeapAlloc uint64
+}
+
+func (r resourceUsage) String() string {
+	return fmt.Sprintf("goroutines: %d, open fds: %d, heap: %d bytes",
+		r.Goroutines, r.OpenFDs, r.HeapAlloc)
+}
+
+func sampleResourceUsage() resourceUsage {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	fds := -1
+	if entries, err := ioutil.ReadDir("/proc/self/fd"); err == nil {
+		// not counting the descriptor used for reading the directory
+		fds = len(entries) - 1
+	}
+
+	return resourceUsage{
+		Goroutines: runtime.NumGoroutine(),
+		OpenFDs:    fds,
+		HeapAlloc:  mem.HeapAlloc,
+	}
+}
+
+var (
+	// completed cycles before usage is considered settled and taken as the
+	// baseline; caches, connection pools etc. are populated by then
+	resourceAuditWarmup = 10
+	// growth over the baseline which is still fine
+	goroutineBudget = 10
+	fdBudget        = 10
+	heapBudget      = uint64(16 * 1024 * 1024)
+)
+
+// Accounting of goroutines, open file descriptors and heap across state
+// machine cycles (every return to idle state, or every boot in test loop).
+// Usage growing past the budget over the baseline means there is a leak;
+// with strict auditing that is an error, otherwise it is just logged. The
+// daemon is audited in test loop only.
+type resourceAudit struct {
+	strict   bool
+	cycles   int
+	baseline resourceUsage
+	last     resourceUsage
+	sample   func() resourceUsage
+}
+
+func newResourceAudit(strict bool) *resourceAudit {
+	return &resourceAudit{
+		strict: strict,
+		sample: sampleResourceUsage,
+	}
+}
+
+// Record usage at the end of a cycle. Returns ErrResourceLeak if usage grew
+// over budget and auditing is strict; nothing is audited if a is nil.
+func (a *resourceAudit) cycle() error {
+	if a == nil {
+		return nil
+	}
+	a.cycles++
+	if a.strict {
+		// only live objects count
+		runtime.GC()
+	}
+	a.last = a.sample()
+	log.Debugf("resource usage after %d cycles: %v", a.cycles, a.last)
+
+	if a.cycles < resourceAuditWarmup {
+		return nil
+	}
+	if a.cycles == resourceAuditWarmup {
+		a.baseline = a.last
+		log.Infof("resource usage baseline: %v", a.baseline)
+		return nil
+	}
+
+	if err := a.checkGrowth(); err != nil {
+		log.Errorf("resource usage after %d cycles: %v (baseline %v): %v",
+			a.cycles, a.last, a.baseline, err)
+		if a.strict {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *resourceAudit) checkGrowth() error {
+	switch {
+	case a.last.Goroutines > a.baseline.Goroutines+goroutineBudget:
+		return errors.Wrapf(ErrResourceLeak, "%d goroutines",
+			a.last.Goroutines)
+	case a.baseline.OpenFDs >= 0 && a.last.OpenFDs > a.baseline.OpenFDs+fdBudget:
+		return errors.Wrapf(ErrResourceLeak, "%d open file descriptors",
+			a.last.OpenFDs)
+	case a.last.HeapAlloc > a.baseline.HeapAlloc+heapBudget:
+		return errors.Wrapf(ErrResourceLeak, "%d bytes of heap",
+			a.last.HeapAlloc)
+	}
+	return nil
+}
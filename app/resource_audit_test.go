@@ -0,0 +1,82 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResourceAudit(t *testing.T) {
+	usage := resourceUsage{Goroutines: 5, OpenFDs: 8, HeapAlloc: 1024}
+	fake := func() resourceUsage { return usage }
+
+	a := newResourceAudit(true)
+	a.sample = fake
+	for i := 0; i < resourceAuditWarmup; i++ {
+		// anything goes during warmup
+		usage.Goroutines += 100
+		assert.NoError(t, a.cycle())
+	}
+	assert.Equal(t, usage, a.baseline)
+
+	// growth within budget
+	usage.Goroutines += goroutineBudget
+	usage.OpenFDs += fdBudget
+	usage.HeapAlloc += heapBudget
+	assert.NoError(t, a.cycle())
+
+	usage.OpenFDs++
+	err := a.cycle()
+	assert.Equal(t, ErrResourceLeak, errors.Cause(err))
+	usage.OpenFDs--
+
+	usage.Goroutines++
+	err = a.cycle()
+	assert.Equal(t, ErrResourceLeak, errors.Cause(err))
+	usage.Goroutines--
+
+	usage.HeapAlloc++
+	err = a.cycle()
+	assert.Equal(t, ErrResourceLeak, errors.Cause(err))
+
+	// non-strict audit only logs
+	a.strict = false
+	assert.NoError(t, a.cycle())
+	assert.Equal(t, resourceAuditWarmup+5, a.cycles)
+
+	// unknown fd count is not checked
+	a = newResourceAudit(true)
+	a.sample = func() resourceUsage { return resourceUsage{OpenFDs: -1} }
+	for i := 0; i < resourceAuditWarmup; i++ {
+		assert.NoError(t, a.cycle())
+	}
+	a.sample = fake
+	usage = resourceUsage{OpenFDs: 1000}
+	assert.NoError(t, a.cycle())
+
+	// daemon is not audited outside test loop
+	a = NewDaemon(nil, nil).audit
+	assert.Nil(t, a)
+	assert.NoError(t, a.cycle())
+}
+
+func TestSampleResourceUsage(t *testing.T) {
+	u := sampleResourceUsage()
+	assert.True(t, u.Goroutines > 0)
+	assert.True(t, u.OpenFDs >= 3)
+	assert.True(t, u.HeapAlloc > 0)
+}
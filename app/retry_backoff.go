@@ -0,0 +1,202 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/mendersoftware/log"
+)
+
+const retryBackoffName = "retry-backoff"
+
+// authorization retry interval while resuming deployment after restart
+const resumeAuthRetryInterval = 15 * time.Second
+
+// Retry counters and deadlines of the state machine; persistent, so that a
+// device retrying during a server outage does not start over with the
+// shortest intervals every time it is power cycled.
+type retryBackoff struct {
+	AuthAttempts int
+	// next authorization attempt must not be made before
+	AuthNotBefore time.Time
+	// requests refused with 401 in a row, by the server or its API
+	Unauthorized int
+	// deployment being fetched and installed
+	FetchDeploymentID string
+	FetchAttempts     int
+	FetchNotBefore    time.Time
+}
+
+func loadRetryBackoff(store Store) retryBackoff {
+	var r retryBackoff
+	if store == nil {
+		return r
+	}
+	data, err := store.ReadAll(retryBackoffName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("failed to read retry backoff: %v", err)
+		}
+		return r
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		log.Warnf("discarding broken retry backoff: %v", err)
+		return retryBackoff{}
+	}
+	if r.AuthAttempts != 0 || r.FetchAttempts != 0 {
+		log.Infof("resuming retry backoff: %d authorization attempts, "+
+			"%d fetch attempts of deployment %q",
+			r.AuthAttempts, r.FetchAttempts, r.FetchDeploymentID)
+	}
+	return r
+}
+
+func (r *retryBackoff) save(store Store) {
+	if store == nil {
+		return
+	}
+	var err error
+	if *r == (retryBackoff{}) {
+		err = store.Remove(retryBackoffName)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	} else {
+		data, _ := json.Marshal(r)
+		err = store.WriteAll(retryBackoffName, data)
+	}
+	if err != nil {
+		log.Errorf("failed to save retry backoff: %v", err)
+	}
+}
+
+// Authorization retry interval: starts at the retry poll interval and doubles
+// with each attempt, up to the update poll interval.
+func getAuthRetry(tried int, retryInterval, maxInterval time.Duration) time.Duration {
+	if maxInterval < retryInterval {
+		maxInterval = retryInterval
+	}
+	interval := retryInterval
+	for i := 0; i < tried && interval < maxInterval; i++ {
+		interval *= 2
+	}
+	if interval > maxInterval {
+		return maxInterval
+	}
+	return interval
+}
+
+// authRetryWait returns how long to wait before the next authorization
+// attempt; a deadline set before restart is honored.
+func (ctx *StateContext) authRetryWait(now time.Time,
+	retryInterval, maxInterval time.Duration) time.Duration {
+	if !ctx.retry.AuthNotBefore.After(now) {
+		intvl := getAuthRetry(ctx.retry.AuthAttempts, retryInterval, maxInterval)
+		ctx.retry.AuthAttempts++
+		ctx.retry.AuthNotBefore = now.Add(intvl)
+		ctx.retry.save(ctx.store)
+	}
+	return ctx.retry.AuthNotBefore.Sub(now)
+}
+
+// rejectedRetryWait holds off authorization for the interval, across
+// restarts too, and returns how long to wait.
+func (ctx *StateContext) rejectedRetryWait(now time.Time, interval time.Duration) time.Duration {
+	if ctx == nil {
+		return interval
+	}
+	ctx.retry.AuthNotBefore = now.Add(interval)
+	// identity may be accepted once the wait is over; it gets the full
+	// count of attempts again
+	ctx.retry.Unauthorized = 0
+	ctx.retry.save(ctx.store)
+	return interval
+}
+
+// unauthorized counts the request refused with 401, and returns whether the
+// device is to be taken as rejected.
+func (ctx *StateContext) unauthorized(threshold int) bool {
+	if ctx == nil {
+		return false
+	}
+	ctx.retry.Unauthorized++
+	ctx.retry.save(ctx.store)
+	log.Infof("request refused as unauthorized %d times in a row, "+
+		"device taken as rejected after %d", ctx.retry.Unauthorized, threshold)
+	return ctx.retry.Unauthorized >= threshold
+}
+
+func (ctx *StateContext) authRetryPending(now time.Time) bool {
+	return ctx != nil && ctx.retry.AuthNotBefore.After(now)
+}
+
+func (ctx *StateContext) authSucceeded() {
+	if ctx == nil || (ctx.retry.AuthAttempts == 0 && ctx.retry.Unauthorized == 0) {
+		return
+	}
+	ctx.retry.AuthAttempts = 0
+	ctx.retry.Unauthorized = 0
+	ctx.retry.AuthNotBefore = time.Time{}
+	ctx.retry.save(ctx.store)
+}
+
+func (ctx *StateContext) isResuming() bool {
+	return ctx != nil && ctx.resuming
+}
+
+// deploymentInProgress tells if the daemon is starting in the middle of a
+// deployment, eg. with the new artifact waiting for verification.
+func deploymentInProgress(store Store) bool {
+	if store == nil {
+		return false
+	}
+	_, err := LoadStateData(store)
+	return err == nil
+}
+
+// fetchRetryPending tells if the deployment must not be fetched yet.
+func (ctx *StateContext) fetchRetryPending(deploymentID string, now time.Time) bool {
+	return ctx.retry.FetchDeploymentID == deploymentID &&
+		ctx.retry.FetchNotBefore.After(now)
+}
+
+// restoreFetchInstallAttempts picks up attempts made before restart.
+func (ctx *StateContext) restoreFetchInstallAttempts(deploymentID string) {
+	if ctx.fetchInstallAttempts == 0 && ctx.retry.FetchDeploymentID == deploymentID {
+		ctx.fetchInstallAttempts = ctx.retry.FetchAttempts
+	}
+}
+
+func (ctx *StateContext) fetchInstallRetried(deploymentID string, next time.Time) {
+	ctx.fetchInstallAttempts++
+	ctx.retry.FetchDeploymentID = deploymentID
+	ctx.retry.FetchAttempts = ctx.fetchInstallAttempts
+	ctx.retry.FetchNotBefore = next
+	ctx.retry.save(ctx.store)
+}
+
+// restart counter so that we are able to retry next time
+func (ctx *StateContext) resetFetchInstallAttempts() {
+	ctx.fetchInstallAttempts = 0
+	if ctx.retry.FetchDeploymentID == "" {
+		return
+	}
+	ctx.retry.FetchDeploymentID = ""
+	ctx.retry.FetchAttempts = 0
+	ctx.retry.FetchNotBefore = time.Time{}
+	ctx.retry.save(ctx.store)
+}
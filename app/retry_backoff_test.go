@@ -0,0 +1,176 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetAuthRetry(t *testing.T) {
+	tc := []struct {
+		tried    int
+		interval time.Duration
+	}{
+		{0, time.Minute},
+		{1, 2 * time.Minute},
+		{2, 4 * time.Minute},
+		{3, 5 * time.Minute},
+		{100, 5 * time.Minute},
+	}
+	for _, c := range tc {
+		assert.Equal(t, c.interval, getAuthRetry(c.tried, time.Minute, 5*time.Minute))
+	}
+	// update poll interval shorter than the retry one
+	assert.Equal(t, time.Minute, getAuthRetry(3, time.Minute, 0))
+}
+
+func TestRetryBackoffStore(t *testing.T) {
+	ms := utils.NewMemStore()
+	assert.Equal(t, retryBackoff{}, loadRetryBackoff(ms))
+	assert.Equal(t, retryBackoff{}, loadRetryBackoff(nil))
+
+	now := time.Now().UTC().Round(time.Second)
+	r := retryBackoff{
+		AuthAttempts:      2,
+		AuthNotBefore:     now,
+		FetchDeploymentID: "foo",
+		FetchAttempts:     3,
+		FetchNotBefore:    now.Add(time.Minute),
+	}
+	r.save(ms)
+	assert.Equal(t, r, loadRetryBackoff(ms))
+
+	// nothing left to retry
+	r = retryBackoff{}
+	r.save(ms)
+	_, err := ms.ReadAll(retryBackoffName)
+	assert.Error(t, err)
+	r.save(ms)
+
+	ms.WriteAll(retryBackoffName, []byte("garbage"))
+	assert.Equal(t, retryBackoff{}, loadRetryBackoff(ms))
+}
+
+func TestStateAuthRetryPersistent(t *testing.T) {
+	ms := utils.NewMemStore()
+	ctx := &StateContext{store: ms}
+	now := time.Now()
+
+	assert.Equal(t, time.Minute, ctx.authRetryWait(now, time.Minute, time.Hour))
+	assert.Equal(t, 2*time.Minute,
+		ctx.authRetryWait(now.Add(time.Minute), time.Minute, time.Hour))
+
+	// restarted while waiting; backoff continues where it was
+	ctx = &StateContext{store: ms, retry: loadRetryBackoff(ms)}
+	assert.Equal(t, 2, ctx.retry.AuthAttempts)
+	s, _ := bootstrappedState.Handle(ctx, &stateTestController{
+		authorize: NewFatalError(errors.New("must not authorize yet")),
+	})
+	assert.IsType(t, &AuthorizeWaitState{}, s)
+	assert.Equal(t, time.Minute,
+		ctx.authRetryWait(now.Add(2*time.Minute), time.Minute, time.Hour))
+	assert.Equal(t, 4*time.Minute,
+		ctx.authRetryWait(now.Add(3*time.Minute), time.Minute, time.Hour))
+
+	// successful authorization starts over
+	ctx.retry.AuthNotBefore = time.Time{}
+	s, _ = bootstrappedState.Handle(ctx, &stateTestController{})
+	assert.IsType(t, &AuthorizedState{}, s)
+	assert.Equal(t, retryBackoff{}, loadRetryBackoff(ms))
+	assert.Equal(t, retryBackoff{}, ctx.retry)
+}
+
+func TestStateFetchRetryPersistent(t *testing.T) {
+	ms := utils.NewMemStore()
+	ctx := &StateContext{store: ms}
+	update := client.UpdateResponse{ID: "foo"}
+
+	fir := NewFetchInstallRetryState(NewUpdateFetchState(update), update,
+		NewTransientError(errors.New("fetch failed")))
+	fir.(*FetchInstallRetryState).CancellableState = &cancellableStateTest{BaseState{
+		id: MenderStateFetchInstallRetryWait,
+	}}
+	for i := 0; i < 4; i++ {
+		s, _ := fir.Handle(ctx, &stateTestController{pollIntvl: time.Hour})
+		assert.IsType(t, &UpdateFetchState{}, s)
+	}
+	r := loadRetryBackoff(ms)
+	assert.Equal(t, "foo", r.FetchDeploymentID)
+	assert.Equal(t, 4, r.FetchAttempts)
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), r.FetchNotBefore, time.Minute)
+
+	// restarted; the deployment is not fetched before the deadline
+	ctx = &StateContext{store: ms, retry: r}
+	s, _ := updateCheckState.Handle(ctx, &stateTestController{updateResp: &update})
+	assert.IsType(t, &FetchInstallRetryState{}, s)
+	s.(*FetchInstallRetryState).CancellableState = &cancellableStateTest{BaseState{
+		id: MenderStateFetchInstallRetryWait,
+	}}
+	s, _ = s.Handle(ctx, &stateTestController{pollIntvl: time.Hour})
+	assert.IsType(t, &UpdateFetchState{}, s)
+	assert.Equal(t, 4, loadRetryBackoff(ms).FetchAttempts)
+
+	// next failure continues with the attempts made before restart
+	s, _ = fir.Handle(ctx, &stateTestController{pollIntvl: time.Hour})
+	assert.IsType(t, &UpdateFetchState{}, s)
+	assert.Equal(t, 5, ctx.fetchInstallAttempts)
+	assert.Equal(t, 5, loadRetryBackoff(ms).FetchAttempts)
+
+	// other deployment is fetched right away
+	other := client.UpdateResponse{ID: "bar"}
+	s, _ = updateCheckState.Handle(ctx, &stateTestController{updateResp: &other})
+	assert.IsType(t, &UpdateFetchState{}, s)
+
+	// giving up clears the backoff
+	ctx.resetFetchInstallAttempts()
+	assert.Equal(t, retryBackoff{}, loadRetryBackoff(ms))
+}
+
+func TestStateResumingDeployment(t *testing.T) {
+	ms := utils.NewMemStore()
+	assert.False(t, deploymentInProgress(ms))
+	assert.False(t, deploymentInProgress(nil))
+	StoreStateData(ms, StateData{
+		Name:       MenderStateReboot,
+		UpdateInfo: client.UpdateResponse{ID: "foo"},
+	})
+	assert.True(t, deploymentInProgress(ms))
+
+	// backoff from before restart does not delay finishing the deployment
+	ctx := &StateContext{
+		store:    ms,
+		resuming: true,
+		retry: retryBackoff{
+			AuthAttempts:  5,
+			AuthNotBefore: time.Now().Add(time.Hour),
+		},
+	}
+	s, _ := bootstrappedState.Handle(ctx, &stateTestController{})
+	assert.IsType(t, &AuthorizedState{}, s)
+
+	tstart := time.Now()
+	s, _ = authorizeWaitState.Handle(ctx, &stateTestController{
+		retryIntvl: 10 * time.Millisecond,
+		pollIntvl:  time.Hour,
+	})
+	assert.IsType(t, &BootstrappedState{}, s)
+	assert.WithinDuration(t, time.Now(), tstart, 100*time.Millisecond)
+	assert.Equal(t, 0, ctx.retry.AuthAttempts)
+}
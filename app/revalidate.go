@@ -0,0 +1,69 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Deployment found by an update check may be aborted, or its artifact revoked,
+// while the device waits to download it, eg. retrying a failed download for
+// hours. Unless it was checked recently, the deployment is confirmed to be
+// still active before the artifact is downloaded and written to the device.
+var defaultRevalidateUpdateAfter = 1 * time.Hour
+
+var ErrDeploymentRevoked = errors.New("deployment no longer active on the server")
+
+func (m *mender) revalidateUpdateAfter() time.Duration {
+	switch {
+	case m.config.RevalidateUpdateAfterSeconds < 0:
+		return 0
+	case m.config.RevalidateUpdateAfterSeconds > 0:
+		return time.Duration(m.config.RevalidateUpdateAfterSeconds) * time.Second
+	}
+	return defaultRevalidateUpdateAfter
+}
+
+// RevalidateUpdate checks with the server that the deployment found at
+// checked time is still the one for the device; nothing is done if it was
+// checked recently. Returns fatal error with ErrDeploymentRevoked cause if
+// the deployment is no longer active, transient error if it could not be
+// checked.
+func (m *mender) RevalidateUpdate(ctx context.Context, update client.UpdateResponse,
+	checked time.Time) menderError {
+	after := m.revalidateUpdateAfter()
+	if after == 0 || time.Since(checked) < after {
+		return nil
+	}
+	log.Infof("deployment %s found %v ago, checking it is still active",
+		update.ID, time.Since(checked).Truncate(time.Second))
+
+	current, err := m.updater.GetScheduledUpdate(ctx, m.api.Request(m.authToken),
+		m.config.ServerURL, m.currentUpdate(ctx))
+	m.endpoints.record(endpointDeployments, err, time.Now())
+	if err != nil {
+		return NewTransientError(errors.Wrapf(err, "failed to revalidate deployment %s",
+			update.ID))
+	}
+	if next, ok := current.(client.UpdateResponse); !ok || next.ID != update.ID {
+		return NewFatalError(errors.Wrapf(ErrDeploymentRevoked, "deployment %s",
+			update.ID))
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevalidateUpdate(t *testing.T) {
+	// deployment the server has for the device, if any
+	var active string
+	var checks int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks++
+		if active == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		var update client.UpdateResponse
+		update.ID = active
+		update.Artifact.ArtifactName = "release-2"
+		update.Artifact.CompatibleDevices = []string{"hammer"}
+		update.Artifact.Source.URI = "https://artifacts/release-2"
+		data, _ := json.Marshal(update)
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	td, _ := ioutil.TempDir("", "revalidate")
+	defer os.RemoveAll(td)
+
+	mender := newTestMender(nil, MenderConfig{ServerURL: srv.URL}, testMenderPieces{})
+	mender.artifactInfoFile = path.Join(td, "artifact_info")
+	mender.deviceTypeFile = path.Join(td, "device_type")
+	ioutil.WriteFile(mender.artifactInfoFile, []byte("artifact_name=release-1"), 0600)
+	ioutil.WriteFile(mender.deviceTypeFile, []byte("device_type=hammer"), 0600)
+
+	update := client.UpdateResponse{ID: "dep-1"}
+	ctx := context.Background()
+
+	// checked recently
+	assert.Nil(t, mender.RevalidateUpdate(ctx, update, time.Now()))
+	assert.Equal(t, 0, checks)
+
+	long := time.Now().Add(-2 * time.Hour)
+	active = "dep-1"
+	assert.Nil(t, mender.RevalidateUpdate(ctx, update, long))
+	assert.Equal(t, 1, checks)
+
+	// aborted, or replaced with another deployment
+	for _, a := range []string{"", "dep-2"} {
+		active = a
+		merr := mender.RevalidateUpdate(ctx, update, long)
+		assert.Error(t, merr)
+		assert.True(t, merr.IsFatal())
+		assert.Equal(t, ErrDeploymentRevoked, errors.Cause(merr.Cause()))
+	}
+
+	// server unreachable
+	srv.Close()
+	merr := mender.RevalidateUpdate(ctx, update, long)
+	assert.Error(t, merr)
+	assert.False(t, merr.IsFatal())
+
+	// disabled
+	mender.config.RevalidateUpdateAfterSeconds = -1
+	assert.Nil(t, mender.RevalidateUpdate(ctx, update, long))
+	mender.config.RevalidateUpdateAfterSeconds = 3 * 3600
+	assert.Nil(t, mender.RevalidateUpdate(ctx, update, long))
+}
@@ -11,9 +11,10 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
-package main
+package app
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -27,8 +28,11 @@ import (
 	"github.com/pkg/errors"
 )
 
-// This will be run manually from command line ONLY
-func doRootfs(device installer.UInstaller, args runOptionsType, dt string) error {
+// This will be run manually from command line ONLY. Digests of the payloads
+// installed are recorded in store, if set, to be provided once the update is
+// committed.
+func doRootfs(device installer.UInstaller, args runOptionsType, dt string,
+	store Store) error {
 	var image io.ReadCloser
 	var imageSize int64
 	var err error
@@ -55,7 +59,7 @@ func doRootfs(device installer.UInstaller, args runOptionsType, dt string) error
 
 		log.Debug("Client initialized. Start downloading image.")
 
-		image, imageSize, err = upclient.FetchUpdate(ac, updateLocation)
+		image, imageSize, err = upclient.FetchUpdate(context.Background(), ac, updateLocation)
 		log.Debugf("Image downloaded: %d [%v] [%v]", imageSize, image, err)
 	} else {
 		// perform update from local file
@@ -77,16 +81,16 @@ func doRootfs(device installer.UInstaller, args runOptionsType, dt string) error
 	}
 	tr := io.TeeReader(image, p)
 
-	err = installer.Install(ioutil.NopCloser(tr), dt, device)
+	err = installRecordingProvides(ioutil.NopCloser(tr), dt, device, store, nil)
 	if err != nil {
 		log.Errorf("Installation failed: %s", err.Error())
-		return err
+		return withExitResult(exitResultInstall, err)
 	}
 
 	err = device.EnableUpdatedPartition()
 	if err != nil {
 		log.Errorf("Enabling updated partition failed: %s", err.Error())
-		return err
+		return withExitResult(exitResultInstall, err)
 	}
 
 	return nil
@@ -0,0 +1,233 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// Root filesystem kept as image files on a larger partition and loop-mounted
+// by the bootloader or initramfs, for devices that can not be repartitioned.
+// The image to boot is named by a bootloader variable, which is switched and
+// rolled back like mender_boot_part is with partitions:
+//
+//	<dir>/rootfs-a.img, <dir>/rootfs-b.img  root filesystem images
+//	mender_rootfs_file=rootfs-a.img         image to boot
+const (
+	rootfsFileA = "rootfs-a.img"
+	rootfsFileB = "rootfs-b.img"
+
+	bootEnvRootfsFile = "mender_rootfs_file"
+)
+
+var (
+	// Returns the file the root filesystem is loop-mounted from;
+	// overridden in tests.
+	rootfsBackingFile = loopBackingFile
+)
+
+type rootfsFiles struct {
+	dir string
+}
+
+func newRootfsFiles(dir string) *rootfsFiles {
+	if dir == "" {
+		return nil
+	}
+	return &rootfsFiles{dir: dir}
+}
+
+// Backing file of the loop device the root filesystem is mounted from.
+func loopBackingFile() (string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat("/", &st); err != nil {
+		return "", errors.Wrapf(err, "can not stat root filesystem")
+	}
+	major, minor := splitDevNumber(uint64(st.Dev))
+	sysFile := fmt.Sprintf("/sys/dev/block/%d:%d/loop/backing_file",
+		major, minor)
+	data, err := ioutil.ReadFile(sysFile)
+	if err != nil {
+		return "", errors.Wrapf(err, "root filesystem is not loop-mounted")
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Major and minor number of Linux device number.
+func splitDevNumber(dev uint64) (uint64, uint64) {
+	major := (dev>>8)&0xfff | (dev>>32)&0xfffff000
+	minor := dev&0xff | (dev>>12)&0xffffff00
+	return major, minor
+}
+
+// Image the running root filesystem is mounted from.
+func (r *rootfsFiles) active() (string, error) {
+	backing, err := rootfsBackingFile()
+	if err != nil {
+		return "", err
+	}
+	for _, name := range []string{rootfsFileA, rootfsFileB} {
+		if filepath.Clean(backing) == filepath.Join(r.dir, name) {
+			return name, nil
+		}
+	}
+	return "", errors.Errorf("root filesystem is mounted from %s, "+
+		"not an image in %s", backing, r.dir)
+}
+
+func (r *rootfsFiles) inactive() (string, error) {
+	active, err := r.active()
+	if err != nil {
+		return "", err
+	}
+	if active == rootfsFileA {
+		return rootfsFileB, nil
+	}
+	return rootfsFileA, nil
+}
+
+func (r *rootfsFiles) path(name string) string {
+	return filepath.Join(r.dir, name)
+}
+
+// Write the image in place of the inactive one. The old image is removed
+// first, as there is often no room for three of them; the new one gets its
+// name only once completely written.
+func (d *device) installRootfsFile(image io.Reader, size int64) error {
+	name, err := d.rootfsFiles.inactive()
+	if err != nil {
+		return err
+	}
+	target := d.rootfsFiles.path(name)
+	tmp := target + ".tmp"
+	os.Remove(tmp)
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove old root filesystem image")
+	}
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(d.rootfsFiles.dir, &fs); err != nil {
+		return errors.Wrapf(err, "failed to read free space in %s",
+			d.rootfsFiles.dir)
+	}
+	if free := uint64(fs.Bavail) * uint64(fs.Bsize); free < uint64(size) {
+		log.Errorf("update (%v bytes) is larger than free space in %s (%v bytes)",
+			size, d.rootfsFiles.dir, free)
+		return syscall.ENOSPC
+	}
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create root filesystem image")
+	}
+
+	op := d.audit.start(deviceOpWritePartition, target,
+		map[string]string{"size": strconv.FormatInt(size, 10)})
+	w, err := tunedCopy(f, image, d.writeBuffer)
+	logWithFields(logrus.Fields{LogFieldBytesWritten: w}).Infof(
+		"wrote %v/%v bytes of update to %v", w, size, tmp)
+	if err == nil && w != size {
+		err = errors.Wrapf(io.ErrUnexpectedEOF,
+			"wrote %v bytes of update, expected %v", w, size)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, target)
+	}
+	op.finish(err, map[string]string{"written": strconv.FormatInt(w, 10)})
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "failed to write root filesystem image")
+	}
+	syncFilesystems()
+	return nil
+}
+
+func (d *device) enableRootfsFile() error {
+	name, err := d.rootfsFiles.inactive()
+	if err != nil {
+		return err
+	}
+	if err := checkRootfsImage(d.rootfsFiles.path(name)); err != nil {
+		return errors.Wrapf(err, "can not enable updated root filesystem")
+	}
+	log.Infof("enabling root filesystem image %s as boot candidate", name)
+	return writeEnvBarrier(d, BootVars{
+		"upgrade_available": "1",
+		bootEnvRootfsFile:   name,
+		"bootcount":         "0",
+	})
+}
+
+func (d *device) rollbackRootfsFile() error {
+	name, err := d.rootfsFiles.inactive()
+	if err != nil {
+		return err
+	}
+	log.Infof("setting root filesystem image for rollback: %s", name)
+	return d.WriteEnv(BootVars{bootEnvRootfsFile: name, "upgrade_available": "0"})
+}
+
+func (d *device) switchRootfsFile() error {
+	name, err := d.rootfsFiles.inactive()
+	if err != nil {
+		return err
+	}
+	if err := checkRootfsImage(d.rootfsFiles.path(name)); err != nil {
+		return errors.Wrapf(err, "can not switch root filesystem")
+	}
+	log.Infof("switching boot root filesystem image to %s", name)
+	return writeEnvBarrier(d, BootVars{
+		bootEnvRootfsFile:   name,
+		"upgrade_available": "0",
+		"bootcount":         "0",
+	})
+}
+
+// Remove image of failed install, unless it is the one to boot.
+func (d *device) cleanupRootfsFile() error {
+	name, err := d.rootfsFiles.inactive()
+	if err != nil {
+		return err
+	}
+	os.Remove(d.rootfsFiles.path(name + ".tmp"))
+	env, err := d.ReadEnv()
+	if err != nil {
+		return err
+	}
+	if env[bootEnvRootfsFile] == name {
+		return errCleanupBootPartition
+	}
+	log.Infof("removing root filesystem image %s", name)
+	if err := os.Remove(d.rootfsFiles.path(name)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove root filesystem image")
+	}
+	return nil
+}
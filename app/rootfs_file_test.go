@@ -0,0 +1,121 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func testRootfsImage(content string) []byte {
+	image := make([]byte, 2048)
+	copy(image, squashfsMagic+content)
+	return image
+}
+
+func TestRootfsFileUpdate(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "rootfs-file")
+	defer os.RemoveAll(tdir)
+
+	env := newCrashingBootEnv(BootVars{bootEnvRootfsFile: rootfsFileA,
+		"upgrade_available": "0"}, -1)
+	oldSync := syncFilesystems
+	oldBacking := rootfsBackingFile
+	defer func() {
+		syncFilesystems = oldSync
+		rootfsBackingFile = oldBacking
+	}()
+	syncFilesystems = env.sync
+	running := path.Join(tdir, rootfsFileA)
+	rootfsBackingFile = func() (string, error) { return running, nil }
+
+	dev := NewDevice(env, nil, deviceConfig{rootfsImageDir: tdir})
+	imageA := testRootfsImage("a")
+	assert.NoError(t, ioutil.WriteFile(path.Join(tdir, rootfsFileA), imageA, 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(tdir, rootfsFileB), []byte("old"), 0644))
+
+	// truncated image is not left behind
+	image := testRootfsImage("b")
+	err := dev.InstallUpdate(ioutil.NopCloser(bytes.NewReader(image[:100])),
+		int64(len(image)))
+	assert.Equal(t, io.ErrUnexpectedEOF, errors.Cause(err))
+	_, err = os.Stat(path.Join(tdir, rootfsFileB))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(tdir, rootfsFileB+".tmp"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Error(t, dev.EnableUpdatedPartition())
+
+	// image goes next to the running one
+	assert.NoError(t, dev.InstallUpdate(ioutil.NopCloser(bytes.NewReader(image)),
+		int64(len(image))))
+	data, _ := ioutil.ReadFile(path.Join(tdir, rootfsFileB))
+	assert.Equal(t, image, data)
+	data, _ = ioutil.ReadFile(path.Join(tdir, rootfsFileA))
+	assert.Equal(t, imageA, data)
+
+	assert.NoError(t, dev.EnableUpdatedPartition())
+	assert.Equal(t, rootfsFileB, env.persisted[bootEnvRootfsFile])
+	assert.Equal(t, "1", env.persisted["upgrade_available"])
+	has, err := dev.HasUpdate()
+	assert.NoError(t, err)
+	assert.True(t, has)
+
+	// booted into the new image, which fails
+	running = path.Join(tdir, rootfsFileB)
+	assert.NoError(t, dev.Rollback())
+	env.sync()
+	assert.Equal(t, rootfsFileA, env.persisted[bootEnvRootfsFile])
+	assert.Equal(t, "0", env.persisted["upgrade_available"])
+
+	// image to boot is not cleaned up
+	running = path.Join(tdir, rootfsFileA)
+	env.persisted[bootEnvRootfsFile] = rootfsFileB
+	assert.Equal(t, errCleanupBootPartition, dev.CleanupUpdate(true))
+	env.persisted[bootEnvRootfsFile] = rootfsFileA
+	assert.NoError(t, dev.CleanupUpdate(false))
+	_, err = os.Stat(path.Join(tdir, rootfsFileB))
+	assert.NoError(t, err)
+	assert.NoError(t, dev.CleanupUpdate(true))
+	_, err = os.Stat(path.Join(tdir, rootfsFileB))
+	assert.True(t, os.IsNotExist(err))
+
+	// switching needs bootable image
+	assert.Error(t, dev.SwitchPartition())
+	assert.NoError(t, ioutil.WriteFile(path.Join(tdir, rootfsFileB), image, 0644))
+	assert.NoError(t, dev.SwitchPartition())
+	assert.Equal(t, rootfsFileB, env.persisted[bootEnvRootfsFile])
+
+	// not running from the images
+	running = "/dev/mmcblk0p2"
+	assert.Error(t, dev.InstallUpdate(ioutil.NopCloser(bytes.NewReader(image)),
+		int64(len(image))))
+}
+
+func TestSplitDevNumber(t *testing.T) {
+	major, minor := splitDevNumber(0x801)
+	assert.Equal(t, uint64(8), major)
+	assert.Equal(t, uint64(1), minor)
+
+	// large numbers are split across the device number
+	major, minor = splitDevNumber(0x100012303045)
+	assert.Equal(t, uint64(0x1030), major)
+	assert.Equal(t, uint64(0x12345), minor)
+}
@@ -11,7 +11,7 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
-package main
+package app
 
 import (
 	"errors"
@@ -21,7 +21,9 @@ import (
 	"testing"
 
 	"github.com/mendersoftware/mender-artifact/test_utils"
+	"github.com/mendersoftware/mender/app/testutils"
 	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
 
 	"github.com/mendersoftware/mender-artifact/parser"
 	"github.com/mendersoftware/mender-artifact/writer"
@@ -29,7 +31,7 @@ import (
 )
 
 func Test_doManualUpdate_noParams_fail(t *testing.T) {
-	if err := doRootfs(new(device), runOptionsType{}, ""); err == nil {
+	if err := doRootfs(new(device), runOptionsType{}, "", nil); err == nil {
 		t.FailNow()
 	}
 }
@@ -40,7 +42,7 @@ func Test_doManualUpdate_invalidHttpsClientConfig_updateFails(t *testing.T) {
 	runOptions.imageFile = &iamgeFileName
 	runOptions.ServerCert = "non-existing"
 
-	if err := doRootfs(new(device), runOptions, ""); err == nil {
+	if err := doRootfs(new(device), runOptions, "", nil); err == nil {
 		t.FailNow()
 	}
 }
@@ -51,7 +53,7 @@ func Test_doManualUpdate_nonExistingFile_fail(t *testing.T) {
 	imageFileName := "non-existing"
 	fakeRunOptions.imageFile = &imageFileName
 
-	if err := doRootfs(&fakeDevice, fakeRunOptions, ""); err == nil {
+	if err := doRootfs(&fakeDevice, fakeRunOptions, "", nil); err == nil {
 		t.FailNow()
 	}
 }
@@ -62,7 +64,7 @@ func Test_doManualUpdate_networkUpdateNoClient_fail(t *testing.T) {
 	imageFileName := "http://non-existing"
 	fakeRunOptions.imageFile = &imageFileName
 
-	if err := doRootfs(&fakeDevice, fakeRunOptions, ""); err == nil {
+	if err := doRootfs(&fakeDevice, fakeRunOptions, "", nil); err == nil {
 		t.FailNow()
 	}
 }
@@ -76,14 +78,14 @@ func Test_doManualUpdate_networkClientExistsNoServer_fail(t *testing.T) {
 	fakeRunOptions.Config =
 		client.Config{"client.crt", "client.key", "server.crt", true, false}
 
-	if err := doRootfs(&fakeDevice, fakeRunOptions, ""); err == nil {
+	if err := doRootfs(&fakeDevice, fakeRunOptions, "", nil); err == nil {
 		t.FailNow()
 	}
 }
 
 func Test_doManualUpdate_installFailing_updateFails(t *testing.T) {
-	fakeDevice := fakeDevice{}
-	fakeDevice.retInstallUpdate = errors.New("")
+	fakeDevice := testutils.FakeDevice{}
+	fakeDevice.RetInstallUpdate = errors.New("")
 	fakeRunOptions := runOptionsType{}
 	imageFileName := "imageFile"
 	fakeRunOptions.imageFile = &imageFileName
@@ -96,7 +98,7 @@ func Test_doManualUpdate_installFailing_updateFails(t *testing.T) {
 
 	defer os.Remove("imageFile")
 
-	if err := doRootfs(fakeDevice, fakeRunOptions, ""); err == nil {
+	if err := doRootfs(fakeDevice, fakeRunOptions, "", nil); err == nil {
 		t.FailNow()
 	}
 }
@@ -135,11 +137,23 @@ func Test_doManualUpdate_existingFile_updateSuccess(t *testing.T) {
 
 	// test
 
-	fakeDevice := fakeDevice{consumeUpdate: true}
+	fakeDevice := testutils.FakeDevice{ConsumeUpdate: true}
 	fakeRunOptions := runOptionsType{}
 	imageFileName := f.Name()
 	fakeRunOptions.imageFile = &imageFileName
 
-	err = doRootfs(fakeDevice, fakeRunOptions, "vexpress-qemu")
+	store := utils.NewMemStore()
+	err = doRootfs(fakeDevice, fakeRunOptions, "vexpress-qemu", store)
 	assert.NoError(t, err)
+
+	// payloads are provided once the update is committed
+	assert.Nil(t, loadArtifactProvides(store, providesName))
+	pending := loadArtifactProvides(store, pendingProvidesName)
+	assert.NotNil(t, pending)
+	assert.Equal(t, "mender-1.1", pending.ArtifactName)
+	assert.Len(t, pending.PayloadDigests, 1)
+
+	assert.NoError(t, doCommit(testutils.FakeDevice{RetHasUpdate: true}, store))
+	assert.Equal(t, pending, loadArtifactProvides(store, providesName))
+	assert.Nil(t, loadArtifactProvides(store, pendingProvidesName))
 }
@@ -0,0 +1,111 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// Artifact payloads are streamed from the network straight to the
+// partition and never spooled to disk. Data that can not be streamed (eg.
+// base images for delta reconstruction) goes to the scratch directory,
+// which is kept on the data partition unless configured otherwise: /tmp
+// is commonly tmpfs, and filling it on low memory devices runs the device
+// out of memory.
+const defaultScratchDirName = "scratch"
+
+// Space left free on the scratch filesystem after a temporary file has
+// been allocated, so that logs and the database can still be written.
+const scratchReserveBytes = 4 * 1024 * 1024
+
+var ErrScratchSpace = errors.New("not enough space in scratch directory")
+
+type scratchDir struct {
+	path string
+	// overridable for tests
+	available func(path string) (uint64, error)
+}
+
+func newScratchDir(config *MenderConfig, dataStore string) *scratchDir {
+	path := config.ScratchDir
+	if path == "" {
+		path = filepath.Join(dataStore, defaultScratchDirName)
+	}
+	return &scratchDir{
+		path:      path,
+		available: availableSpace,
+	}
+}
+
+func availableSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	// Available blocks * size per block = available space in bytes
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// prepare creates the scratch directory and removes files left behind by
+// an interrupted run; directories of deployments are kept, as the deployment
+// in progress carries on.
+func (s *scratchDir) prepare() error {
+	if err := os.MkdirAll(s.path, 0700); err != nil {
+		return errors.Wrapf(err, "failed to create scratch directory %s", s.path)
+	}
+	return s.removeLeftovers()
+}
+
+// removeLeftovers removes files of the scratch directory other than
+// directories of deployments.
+func (s *scratchDir) removeLeftovers() error {
+	leftovers, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read scratch directory %s", s.path)
+	}
+	for _, fi := range leftovers {
+		if fi.Name() == deploymentDirsName {
+			continue
+		}
+		name := filepath.Join(s.path, fi.Name())
+		log.Debugf("removing stale scratch file %s", name)
+		if err := os.RemoveAll(name); err != nil {
+			log.Warnf("failed to remove stale scratch file %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// TempFile creates a temporary file in the scratch directory after checking
+// that size bytes can be stored in it. The caller removes the file.
+func (s *scratchDir) TempFile(prefix string, size int64) (*os.File, error) {
+	if size < 0 {
+		size = 0
+	}
+	avail, err := s.available(s.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to check free space in %s", s.path)
+	}
+	if avail < uint64(size)+scratchReserveBytes {
+		return nil, errors.Wrapf(ErrScratchSpace, "%s: need %d bytes, %d available",
+			s.path, uint64(size)+scratchReserveBytes, avail)
+	}
+	return ioutil.TempFile(s.path, prefix)
+}
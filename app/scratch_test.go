@@ -0,0 +1,85 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScratchDirDefault(t *testing.T) {
+	s := newScratchDir(&MenderConfig{}, "/data/mender")
+	assert.Equal(t, "/data/mender/scratch", s.path)
+
+	s = newScratchDir(&MenderConfig{ScratchDir: "/mnt/scratch"}, "/data/mender")
+	assert.Equal(t, "/mnt/scratch", s.path)
+}
+
+func TestScratchDirPrepare(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	s := newScratchDir(&MenderConfig{}, tdir)
+	assert.NoError(t, s.prepare())
+	fi, err := os.Stat(path.Join(tdir, "scratch"))
+	assert.NoError(t, err)
+	assert.True(t, fi.IsDir())
+
+	// leftovers of an interrupted run are removed
+	assert.NoError(t, ioutil.WriteFile(path.Join(s.path, "stale"), []byte("x"), 0600))
+	assert.NoError(t, os.Mkdir(path.Join(s.path, "stale-dir"), 0700))
+	assert.NoError(t, s.prepare())
+	left, err := ioutil.ReadDir(s.path)
+	assert.NoError(t, err)
+	assert.Empty(t, left)
+
+	// scratch directory can not be created
+	assert.NoError(t, ioutil.WriteFile(path.Join(tdir, "file"), nil, 0600))
+	s = newScratchDir(&MenderConfig{ScratchDir: path.Join(tdir, "file", "scratch")}, tdir)
+	assert.Error(t, s.prepare())
+}
+
+func TestScratchDirTempFile(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	s := newScratchDir(&MenderConfig{}, tdir)
+	assert.NoError(t, s.prepare())
+
+	f, err := s.TempFile("delta", 1024)
+	assert.NoError(t, err)
+	f.Close()
+	assert.Equal(t, s.path, path.Dir(f.Name()))
+
+	s.available = func(string) (uint64, error) {
+		return scratchReserveBytes + 100, nil
+	}
+	f, err = s.TempFile("delta", 100)
+	assert.NoError(t, err)
+	f.Close()
+
+	_, err = s.TempFile("delta", 101)
+	assert.Equal(t, ErrScratchSpace, errors.Cause(err))
+
+	s.available = func(string) (uint64, error) {
+		return 0, errors.New("statfs failed")
+	}
+	_, err = s.TempFile("delta", 1)
+	assert.Error(t, err)
+}
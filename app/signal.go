@@ -0,0 +1,60 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+)
+
+const (
+	// D-Bus object and interface of signals notifying applications about
+	// the progress of updates
+	dbusObjectPath = "/io/mender/Update"
+	dbusInterface  = "io.mender.Update"
+
+	// signal sent before the device is rebooted into the new artifact
+	rebootScheduledSignal = "RebootScheduled"
+)
+
+// Emit D-Bus signal on the system bus. Arguments are given in dbus-send format
+// (type:value). Signals are best effort; failures are only logged.
+func (m *mender) emitSignal(name string, args ...string) {
+	if m.cmdr == nil {
+		return
+	}
+	cmdArgs := append([]string{"--system", "--type=signal",
+		dbusObjectPath, dbusInterface + "." + name}, args...)
+	if err := m.cmdr.Command("dbus-send", cmdArgs...).Run(); err != nil {
+		log.Warnf("failed to emit %s signal: %v", name, err)
+	}
+}
+
+// Returns time applications get for flushing their data once they are
+// notified about the upcoming reboot.
+func (m *mender) GetRebootGracePeriod() time.Duration {
+	return time.Duration(m.config.RebootGracePeriodSeconds) * time.Second
+}
+
+// Tell applications that the device is going to be rebooted into the new
+// artifact in `in`.
+func (m *mender) NotifyReboot(update client.UpdateResponse, in time.Duration) {
+	log.Infof("notifying applications about reboot in %v", in)
+	m.emitSignal(rebootScheduledSignal,
+		fmt.Sprintf("int32:%d", int(in/time.Second)),
+		"string:"+update.ArtifactName())
+}
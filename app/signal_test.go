@@ -0,0 +1,91 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// Records commands run, each failing with given return code.
+type signalTestCommander struct {
+	ret   int
+	calls [][]string
+}
+
+func (c *signalTestCommander) Command(name string, args ...string) *exec.Cmd {
+	c.calls = append(c.calls, append([]string{name}, args...))
+	cmd := exec.Command(os.Args[0], "-test.run=TestHelperProcessSuccess", "--",
+		strconv.Itoa(c.ret), "")
+	cmd.Env = []string{"NEED_MENDER_TEST_HELPER_PROCESS=1"}
+	return cmd
+}
+
+// Controller notifying applications through the real client.
+type notifyTestController struct {
+	*stateTestController
+	mender *mender
+}
+
+func (c *notifyTestController) NotifyReboot(update client.UpdateResponse, in time.Duration) {
+	c.stateTestController.NotifyReboot(update, in)
+	c.mender.NotifyReboot(update, in)
+}
+
+func TestRebootGracePeriod(t *testing.T) {
+	mender := newDefaultTestMender()
+	assert.Equal(t, time.Duration(0), mender.GetRebootGracePeriod())
+
+	mender = newTestMender(nil, MenderConfig{RebootGracePeriodSeconds: 30},
+		testMenderPieces{})
+	assert.Equal(t, 30*time.Second, mender.GetRebootGracePeriod())
+}
+
+func TestNotifyReboot(t *testing.T) {
+	update := client.UpdateResponse{}
+	update.Artifact.ArtifactName = "release-2"
+
+	mender := newDefaultTestMender()
+	cmdr := &signalTestCommander{}
+	mender.cmdr = cmdr
+	mender.NotifyReboot(update, 30*time.Second)
+	assert.Equal(t, [][]string{{"dbus-send", "--system", "--type=signal",
+		"/io/mender/Update", "io.mender.Update.RebootScheduled",
+		"int32:30", "string:release-2"}}, cmdr.calls)
+
+	// signals are best effort, neither failure nor missing commander
+	// stop the reboot
+	cmdr = &signalTestCommander{ret: 1}
+	mender.cmdr = cmdr
+	sc := &stateTestController{}
+	s, _ := NewRebootState(update).Handle(&StateContext{store: utils.NewMemStore()},
+		&notifyTestController{sc, mender})
+	assert.IsType(t, &FinalState{}, s)
+	assert.Len(t, cmdr.calls, 1)
+	assert.Equal(t, []string{"notify-reboot", "reboot"}, sc.calls)
+
+	mender.cmdr = nil
+	sc = &stateTestController{}
+	s, _ = NewRebootState(update).Handle(&StateContext{store: utils.NewMemStore()},
+		&notifyTestController{sc, mender})
+	assert.IsType(t, &FinalState{}, s)
+	assert.Equal(t, []string{"notify-reboot", "reboot"}, sc.calls)
+}
@@ -0,0 +1,108 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Deployments skipped on the device with -skip-deployment, eg. by field
+// engineers unblocking a device targeted by a known-bad deployment; they are
+// reported failed without being installed.
+const skippedDeploymentsName = "skipped-deployments"
+
+// deployments remembered; the oldest are forgotten first
+const maxSkippedDeployments = 32
+
+var ErrDeploymentSkipped = errors.New("deployment skipped on the device")
+
+type skippedDeployment struct {
+	ID    string    `json:"id"`
+	Since time.Time `json:"since"`
+}
+
+func loadSkippedDeployments(store Store) []skippedDeployment {
+	if store == nil {
+		return nil
+	}
+	data, err := store.ReadAll(skippedDeploymentsName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("failed to read skipped deployments: %v", err)
+		}
+		return nil
+	}
+	var skipped []skippedDeployment
+	if err := json.Unmarshal(data, &skipped); err != nil {
+		log.Warnf("discarding broken list of skipped deployments: %v", err)
+		return nil
+	}
+	return skipped
+}
+
+func deploymentSkipped(store Store, deploymentID string) bool {
+	for _, s := range loadSkippedDeployments(store) {
+		if s.ID == deploymentID {
+			return true
+		}
+	}
+	return false
+}
+
+func skipDeployment(store Store, deploymentID string, now time.Time) error {
+	if deploymentID == "" {
+		return errors.New("deployment ID must not be empty")
+	}
+	if deploymentSkipped(store, deploymentID) {
+		return nil
+	}
+	skipped := append(loadSkippedDeployments(store),
+		skippedDeployment{ID: deploymentID, Since: now})
+	if len(skipped) > maxSkippedDeployments {
+		skipped = skipped[len(skipped)-maxSkippedDeployments:]
+	}
+	data, _ := json.Marshal(skipped)
+	if err := store.WriteAll(skippedDeploymentsName, data); err != nil {
+		return errors.Wrapf(err, "failed to save skipped deployments")
+	}
+	return nil
+}
+
+// Skipped deployments are declined, and reported failed.
+func (m *mender) checkSkipped(update client.UpdateResponse) error {
+	if deploymentSkipped(m.store, update.ID) {
+		return errors.Wrapf(ErrDeploymentSkipped, "deployment %s", update.ID)
+	}
+	return nil
+}
+
+func doSkipDeployment(dataStore, deploymentID string) error {
+	dbstore := NewDBStore(dataStore)
+	if dbstore == nil {
+		return errors.New("failed to initialize DB store")
+	}
+	defer dbstore.Close()
+
+	if err := skipDeployment(dbstore, deploymentID, time.Now()); err != nil {
+		return err
+	}
+	log.Infof("deployment %s will be skipped", deploymentID)
+	return nil
+}
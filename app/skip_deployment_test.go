@@ -0,0 +1,84 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkipDeployment(t *testing.T) {
+	ms := utils.NewMemStore()
+	now := time.Now()
+
+	assert.False(t, deploymentSkipped(ms, "dep-1"))
+	assert.Error(t, skipDeployment(ms, "", now))
+	assert.NoError(t, skipDeployment(ms, "dep-1", now))
+	assert.NoError(t, skipDeployment(ms, "dep-1", now))
+	assert.True(t, deploymentSkipped(ms, "dep-1"))
+	assert.Len(t, loadSkippedDeployments(ms), 1)
+
+	// the oldest are forgotten
+	for i := 0; i < maxSkippedDeployments; i++ {
+		assert.NoError(t, skipDeployment(ms, fmt.Sprintf("dep-%d", i+2), now))
+	}
+	assert.Len(t, loadSkippedDeployments(ms), maxSkippedDeployments)
+	assert.False(t, deploymentSkipped(ms, "dep-1"))
+	assert.True(t, deploymentSkipped(ms, "dep-2"))
+
+	ms.WriteAll(skippedDeploymentsName, []byte("garbage"))
+	assert.False(t, deploymentSkipped(ms, "dep-2"))
+}
+
+func TestSkippedDeploymentDeclined(t *testing.T) {
+	mender := newTestMender(nil, MenderConfig{QuarantineAfterFailedDeployments: 1},
+		testMenderPieces{})
+	update := client.UpdateResponse{ID: "known-bad"}
+
+	assert.NoError(t, mender.FilterUpdate(update))
+	assert.NoError(t, skipDeployment(mender.store, update.ID, time.Now()))
+	err := mender.FilterUpdate(update)
+	assert.Equal(t, ErrDeploymentSkipped, errors.Cause(err))
+	assert.Equal(t, "deployment_skipped", errorCode(err))
+	assert.NoError(t, mender.FilterUpdate(client.UpdateResponse{ID: "other"}))
+
+	// failure reported for the skipped deployment does not quarantine
+	recordDeploymentResult(mender.store, 1, update.ID, client.StatusFailure, time.Now())
+	assert.NoError(t, mender.checkQuarantine())
+}
+
+func TestSkipDeploymentCommand(t *testing.T) {
+	td, err := ioutil.TempDir("", "skip-deployment")
+	assert.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	assert.NoError(t, doSkipDeployment(td, "known-bad"))
+	store := NewDBStore(td)
+	defer store.Close()
+	assert.True(t, deploymentSkipped(store, "known-bad"))
+
+	opts, err := argsParse([]string{"-no-syslog", "-skip-deployment", "known-bad"})
+	assert.NoError(t, err)
+	assert.Equal(t, "known-bad", *opts.skipDeploy)
+	_, err = argsParse([]string{"-no-syslog", "-skip-deployment", "known-bad", "-daemon"})
+	assert.Equal(t, errMsgAmbiguousArgumentsGiven, err)
+}
@@ -11,14 +11,17 @@
 //    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 //    See the License for the specific language governing permissions and
 //    limitations under the License.
-package main
+package app
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
 	"github.com/pkg/errors"
@@ -133,19 +136,79 @@ import (
 
 // state context carrying over data that may be used by all state handlers
 type StateContext struct {
+	// cancellation context of the state machine; canceled once the daemon is
+	// requested to stop
+	context context.Context
 	// data store access
 	store                Store
 	lastUpdateCheck      time.Time
 	lastInventoryUpdate  time.Time
 	fetchInstallAttempts int
+	// persistent retry counters and deadlines
+	retry retryBackoff
+	// daemon started with a deployment in progress which is yet to be
+	// finished; retries are not backed off until then
+	resuming bool
+	// time until which the pending update was deferred by local policy
+	deferredUntil time.Time
+	// last deferral reported to the server
+	lastDeferral string
+	// time applications started holding the commit of the update
+	commitHoldStart        time.Time
+	lastConfigurationCheck time.Time
+	// all waits of the state machine are shortened by this factor if set;
+	// by the test loop only
+	timerAcceleration time.Duration
+	// deployment logs of the agent running the state machine; none are kept
+	// if not set
+	logManager *DeploymentLogManager
+}
+
+// deploymentLogger returns the deployment log manager states write the logs
+// of the deployment in progress to.
+func (ctx *StateContext) deploymentLogger() *DeploymentLogManager {
+	if ctx == nil {
+		return nil
+	}
+	return ctx.logManager
+}
+
+// Context returns the context that all client calls, waits and device
+// operations of state handlers should be bound to.
+func (ctx *StateContext) Context() context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	c := ctx.context
+	if c == nil {
+		c = context.Background()
+	}
+	if ctx.timerAcceleration > 1 {
+		c = withTimerAcceleration(c, ctx.timerAcceleration)
+	}
+	return c
+}
+
+type timerAccelerationKey struct{}
+
+// withTimerAcceleration returns ctx with waits bound to it shortened by
+// `factor`.
+func withTimerAcceleration(ctx context.Context, factor time.Duration) context.Context {
+	return context.WithValue(ctx, timerAccelerationKey{}, factor)
+}
+
+// acceleratedWait returns how long to wait instead of `wait` under ctx.
+func acceleratedWait(ctx context.Context, wait time.Duration) time.Duration {
+	if factor, ok := ctx.Value(timerAccelerationKey{}).(time.Duration); ok && factor > 1 {
+		return wait / factor
+	}
+	return wait
 }
 
 type State interface {
 	// Perform state action, returns next state and boolean flag indicating if
 	// execution was cancelled or not
 	Handle(ctx *StateContext, c Controller) (State, bool)
-	// Cancel state action, returns true if action was cancelled
-	Cancel() bool
 	// Return numeric state ID
 	Id() MenderState
 }
@@ -167,8 +230,11 @@ type StateData struct {
 	Name MenderState
 	// update reponse data for the update that was in progress
 	UpdateInfo client.UpdateResponse
-	// update status
+	// update status; status which is still to be acknowledged by the server
 	UpdateStatus string
+	// boot during which the reboot into the new artifact was handed off; the
+	// device has not rebooted yet while it is the same
+	RebootBootID string `json:",omitempty"`
 }
 
 const (
@@ -203,8 +269,16 @@ var (
 		},
 	}
 
+	configurationUpdateState = &ConfigurationUpdateState{
+		BaseState{
+			id: MenderStateConfigurationUpdate,
+		},
+	}
+
 	checkWaitState = NewCheckWaitState()
 
+	stateLoopWaitState = NewStateLoopWaitState()
+
 	updateCheckState = &UpdateCheckState{
 		BaseState{
 			id: MenderStateUpdateCheck,
@@ -227,34 +301,29 @@ func (b *BaseState) Id() MenderState {
 	return b.id
 }
 
-func (b *BaseState) Cancel() bool {
-	return false
-}
-
+// States that wait are cancelled through the context of the state machine.
 type CancellableState interface {
 	Id() MenderState
-	Cancel() bool
-	StateAfterWait(next, same State, wait time.Duration) (State, bool)
-	Wait(wait time.Duration) bool
-	Stop()
+	StateAfterWait(ctx context.Context, next, same State, wait time.Duration) (State, bool)
+	Wait(ctx context.Context, wait time.Duration) bool
+	WaitOrWake(ctx context.Context, wait time.Duration, wake <-chan struct{}) bool
 }
 
 type cancellableState struct {
 	BaseState
-	cancel chan bool
 }
 
 func NewCancellableState(base BaseState) CancellableState {
 	return &cancellableState{
 		base,
-		make(chan bool),
 	}
 }
 
 // Perform wait for time `wait` and return state (`next`, false) after the wait
 // has completed. If wait was interrupted returns (`same`, true)
-func (cs *cancellableState) StateAfterWait(next, same State, wait time.Duration) (State, bool) {
-	if cs.Wait(wait) {
+func (cs *cancellableState) StateAfterWait(ctx context.Context, next, same State,
+	wait time.Duration) (State, bool) {
+	if cs.Wait(ctx, wait) {
 		// wait complete
 		return next, false
 	}
@@ -262,30 +331,31 @@ func (cs *cancellableState) StateAfterWait(next, same State, wait time.Duration)
 }
 
 // wait and return true if wait was completed (false if canceled)
-func (cs *cancellableState) Wait(wait time.Duration) bool {
-	ticker := time.NewTicker(wait)
+func (cs *cancellableState) Wait(ctx context.Context, wait time.Duration) bool {
+	return cs.WaitOrWake(ctx, wait, nil)
+}
 
-	defer ticker.Stop()
+// wait, unless woken up earlier through `wake`; returns true if wait was
+// completed or woken up (false if canceled)
+func (cs *cancellableState) WaitOrWake(ctx context.Context, wait time.Duration,
+	wake <-chan struct{}) bool {
+	timer := time.NewTimer(acceleratedWait(ctx, wait))
+
+	defer timer.Stop()
 	select {
-	case <-ticker.C:
+	case <-timer.C:
 		log.Debugf("wait complete")
 		return true
-	case <-cs.cancel:
+	case <-wake:
+		log.Debugf("wait woken up")
+		return true
+	case <-ctx.Done():
 		log.Infof("wait canceled")
 	}
 
 	return false
 }
 
-func (cs *cancellableState) Cancel() bool {
-	cs.cancel <- true
-	return true
-}
-
-func (cs *cancellableState) Stop() {
-	close(cs.cancel)
-}
-
 type InitState struct {
 	BaseState
 }
@@ -293,7 +363,7 @@ type InitState struct {
 func (i *InitState) Handle(ctx *StateContext, c Controller) (State, bool) {
 
 	// make sure that deployment logging is disabled
-	DeploymentLogger.Disable()
+	ctx.deploymentLogger().Disable()
 
 	// restart counter so that we are able to retry next time
 	if ctx != nil {
@@ -314,13 +384,26 @@ type BootstrappedState struct {
 
 func (b *BootstrappedState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	log.Debugf("handle bootstrapped state")
-	if err := c.Authorize(); err != nil {
+	if !ctx.isResuming() && ctx.authRetryPending(time.Now()) {
+		// backing off since before restart
+		return authorizeWaitState, false
+	}
+	if err := c.Authorize(ctx.Context()); err != nil {
 		log.Errorf("authorize failed: %v", err)
+		switch errors.Cause(err) {
+		case client.AuthErrorRejected:
+			return NewRejectedState(), false
+		case client.AuthErrorUnauthorized:
+			if ctx.unauthorized(c.GetRejectedUnauthorizedAttempts()) {
+				return NewRejectedState(), false
+			}
+		}
 		if !err.IsFatal() {
 			return authorizeWaitState, false
 		}
 		return NewErrorState(err), false
 	}
+	ctx.authSucceeded()
 	return authorizedState, false
 }
 
@@ -341,7 +424,7 @@ func NewUpdateVerifyState(update client.UpdateResponse) State {
 func (uv *UpdateVerifyState) Handle(ctx *StateContext, c Controller) (State, bool) {
 
 	// start deployment logging
-	if err := DeploymentLogger.Enable(uv.update.ID); err != nil {
+	if err := ctx.deploymentLogger().Enable(uv.update.ID); err != nil {
 		// just log error
 		log.Errorf("failed to enable deployment logger: %s", err)
 	}
@@ -359,6 +442,7 @@ func (uv *UpdateVerifyState) Handle(ctx *StateContext, c Controller) (State, boo
 	if has {
 		if uv.update.ArtifactName() == c.GetCurrentArtifactName() {
 			log.Infof("successfully running with new image %v", c.GetCurrentArtifactName())
+			c.SetUpdateMarker(uv.update, updateMarkerUncommitted)
 			// update info and has upgrade flag are there, we're running the new
 			// update, everything looks good, proceed with committing
 			return NewUpdateCommitState(uv.update), false
@@ -378,6 +462,9 @@ func (uv *UpdateVerifyState) Handle(ctx *StateContext, c Controller) (State, boo
 	log.Errorf("update info for deployment %v present, but update flag is not set;"+
 		" running rollback image (previous active partition)",
 		uv.update.ID)
+	c.LogPreviousBoot()
+	c.RestoreDataSnapshot(uv.update)
+	c.SetUpdateMarker(uv.update, updateMarkerRolledBack)
 	return NewUpdateStatusReportState(uv.update, client.StatusFailure), false
 }
 
@@ -398,7 +485,7 @@ func NewUpdateCommitState(update client.UpdateResponse) State {
 func (uc *UpdateCommitState) Handle(ctx *StateContext, c Controller) (State, bool) {
 
 	// start deployment logging
-	if err := DeploymentLogger.Enable(uc.update.ID); err != nil {
+	if err := ctx.deploymentLogger().Enable(uc.update.ID); err != nil {
 		log.Errorf("Can not enable deployment logger: %s", err)
 	}
 
@@ -408,9 +495,34 @@ func (uc *UpdateCommitState) Handle(ctx *StateContext, c Controller) (State, boo
 	var zeroTime time.Time
 	ctx.lastInventoryUpdate = zeroTime
 
+	// let applications finish their own migrations before committing
+	var subState string
+	if holders := c.CommitHolds(); len(holders) > 0 {
+		timeout, action := c.GetCommitHoldPolicy()
+		if time.Since(ctx.startCommitHold(time.Now())) < timeout {
+			log.Infof("update commit held by %s", strings.Join(holders, ", "))
+			return NewUpdateCommitHoldState(uc.update), false
+		}
+
+		ctx.endCommitHold()
+		subState = commitHoldSubState(holders, timeout, action)
+		logWithFields(logrus.Fields{
+			LogFieldState:    uc.Id().String(),
+			LogFieldSubState: subState,
+		}).Errorf("%s", subState)
+		if action == commitHoldRollback {
+			return NewRollbackState(uc.update), false
+		}
+	} else if ctx.endCommitHold() {
+		subState = "commit released by applications"
+	}
+
 	err := c.CommitUpdate()
 	if err != nil {
-		log.Errorf("update commit failed: %s", err)
+		logStateError(uc, err, "update commit failed: %s", err)
+		if !c.RebootRequired() {
+			return NewRollbackState(uc.update), false
+		}
 		// we need to perform roll-back here; one scenario is when u-boot fw utils
 		// won't work after update; at this point without rolling-back it won't be
 		// possible to perform new update
@@ -419,7 +531,42 @@ func (uc *UpdateCommitState) Handle(ctx *StateContext, c Controller) (State, boo
 	}
 
 	// update is commited now; report status
-	return NewUpdateStatusReportState(uc.update, client.StatusSuccess), false
+	c.SetUpdateMarker(uc.update, updateMarkerCommitted)
+	c.DropDataSnapshot()
+	c.CleanupCommitted(uc.update)
+	return NewUpdateStatusReportSubState(uc.update, client.StatusSuccess, subState), false
+}
+
+// Wait for applications to release the commit of the update.
+type UpdateCommitHoldState struct {
+	CancellableState
+	update client.UpdateResponse
+}
+
+func NewUpdateCommitHoldState(update client.UpdateResponse) State {
+	return &UpdateCommitHoldState{
+		CancellableState: NewCancellableState(BaseState{
+			id: MenderStateUpdateCommitHold,
+		}),
+		update: update,
+	}
+}
+
+func (uh *UpdateCommitHoldState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	log.Debugf("handle update commit hold state")
+	// sleep until the hold expires, unless it is released before; holds
+	// placed through files are checked every now and then
+	timeout, _ := c.GetCommitHoldPolicy()
+	wait := timeout - time.Since(ctx.startCommitHold(time.Now()))
+	if wait > commitHoldPollInterval {
+		wait = commitHoldPollInterval
+	}
+	if wait > 0 {
+		if !uh.WaitOrWake(ctx.Context(), wait, c.CommitHoldReleased()) {
+			return uh, true
+		}
+	}
+	return NewUpdateCommitState(uh.update), false
 }
 
 type UpdateCheckState struct {
@@ -429,8 +576,9 @@ type UpdateCheckState struct {
 func (u *UpdateCheckState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	log.Debugf("handle update check state")
 	ctx.lastUpdateCheck = time.Now()
+	ctx.deferredUntil = time.Time{}
 
-	update, err := c.CheckUpdate()
+	update, err := c.CheckUpdate(ctx.Context())
 
 	if err != nil {
 		if err.Cause() == os.ErrExist {
@@ -440,13 +588,147 @@ func (u *UpdateCheckState) Handle(ctx *StateContext, c Controller) (State, bool)
 		}
 
 		log.Errorf("update check failed: %s", err)
+		if isEndpointOutage(err.Cause()) {
+			// only the deployments API is failing; authorizing again
+			// would not help, and inventory must keep being reported
+			return checkWaitState, false
+		}
+		if err.Cause() == client.ErrNotAuthorized &&
+			ctx.unauthorized(c.GetRejectedUnauthorizedAttempts()) {
+			return NewRejectedState(), false
+		}
 		// maybe transient error?
 		return NewErrorState(err), false
 	}
 
 	if update != nil {
+		if err := c.FilterUpdate(*update); err != nil {
+			// make sure the reason ends up in the uploaded deployment log
+			ctx.deploymentLogger().Enable(update.ID)
+			logStateError(u, err, "deployment %s rejected: %s", update.ID, err)
+			return NewUpdateErrorState(NewFatalError(err), *update), false
+		}
+		if until, reason := c.DeferUpdate(*update); !until.IsZero() {
+			return NewUpdateDeferredState(*update, until, reason), false
+		}
+		ctx.lastDeferral = ""
+		if ctx.fetchRetryPending(update.ID, time.Now()) {
+			return NewFetchInstallRetryState(u, *update, nil), false
+		}
 		return NewUpdateFetchState(*update), false
 	}
+	ctx.lastDeferral = ""
+
+	if cmd := c.PendingCommand(); cmd != nil {
+		return NewDeviceCommandState(*cmd), false
+	}
+	return checkWaitState, false
+}
+
+type DeviceCommandState struct {
+	BaseState
+	command DeviceCommand
+}
+
+func NewDeviceCommandState(command DeviceCommand) State {
+	return &DeviceCommandState{
+		BaseState{
+			id: MenderStateDeviceCommand,
+		},
+		command,
+	}
+}
+
+func (d *DeviceCommandState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	log.Infof("executing device command %s (%s)", d.command.Name, d.command.ID)
+
+	switch d.command.Name {
+	case CommandCheckUpdate:
+		return updateCheckState, false
+
+	case CommandCollectLogs:
+		logs, err := ctx.deploymentLogger().GetLogs(d.command.DeploymentID)
+		if err != nil {
+			log.Errorf("failed to collect logs of deployment %s: %v",
+				d.command.DeploymentID, err)
+			break
+		}
+		if merr := c.UploadLog(ctx.Context(), client.UpdateResponse{
+			ID: d.command.DeploymentID,
+		}, logs); merr != nil {
+			log.Errorf("failed to upload logs: %v", merr)
+		}
+
+	case CommandReboot:
+		log.Info("rebooting device")
+		if err := c.Reboot(); err != nil {
+			log.Errorf("error rebooting device: %v", err)
+			break
+		}
+		return doneState, false
+
+	case CommandDecommission:
+		if merr := c.Decommission(); merr != nil {
+			return NewErrorState(merr), false
+		}
+		// start over with new identity
+		return initState, false
+
+	case CommandClearQuarantine:
+		if merr := c.ClearQuarantine(); merr != nil {
+			log.Errorf("failed to clear deployment quarantine: %v", merr)
+		}
+
+	case CommandDebugLogging:
+		if err := c.EnableDebugLogging(d.command); err != nil {
+			log.Errorf("failed to enable debug logging: %v", err)
+		}
+
+	default:
+		log.Errorf("unknown device command %s", d.command.Name)
+	}
+	return checkWaitState, false
+}
+
+type UpdateDeferredState struct {
+	BaseState
+	update client.UpdateResponse
+	until  time.Time
+	reason string
+}
+
+func NewUpdateDeferredState(update client.UpdateResponse, until time.Time,
+	reason string) State {
+	return &UpdateDeferredState{
+		BaseState{
+			id: MenderStateUpdateDeferred,
+		},
+		update,
+		until,
+		reason,
+	}
+}
+
+func (u *UpdateDeferredState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	log.Infof("update %s deferred until %v: %s", u.update.ArtifactName(),
+		u.until, u.reason)
+
+	// check for the update again once the deferral expires
+	ctx.deferredUntil = u.until
+
+	// let the server know, but only once for every deferral
+	deferral := u.update.ID + " " + deferredSubState(u.until, u.reason)
+	if ctx.lastDeferral == deferral {
+		return checkWaitState, false
+	}
+
+	if err := c.ReportUpdateDeferred(ctx.Context(), u.update, u.until,
+		u.reason); err != nil {
+		// try again with the next update check
+		log.Warnf("failed to report deferred update: %v", err)
+		return checkWaitState, false
+	}
+	ctx.lastDeferral = deferral
 	return checkWaitState, false
 }
 
@@ -466,7 +748,7 @@ func NewUpdateFetchState(update client.UpdateResponse) State {
 
 func (u *UpdateFetchState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	// start deployment logging
-	if err := DeploymentLogger.Enable(u.update.ID); err != nil {
+	if err := ctx.deploymentLogger().Enable(u.update.ID); err != nil {
 		return NewUpdateErrorState(NewTransientError(err), u.update), false
 	}
 
@@ -480,20 +762,120 @@ func (u *UpdateFetchState) Handle(ctx *StateContext, c Controller) (State, bool)
 		return NewUpdateErrorState(NewTransientError(err), u.update), false
 	}
 
-	merr := c.ReportUpdateStatus(u.update, client.StatusDownloading)
-	if merr != nil && merr.IsFatal() {
+	// deployment may have been aborted since it was found
+	if merr := c.RevalidateUpdate(ctx.Context(), u.update, ctx.lastUpdateCheck); merr != nil {
+		logStateError(u, merr, "%s", merr)
+		if merr.IsFatal() {
+			ctx.resetFetchInstallAttempts()
+			return NewUpdateErrorState(merr, u.update), false
+		}
+		return NewFetchInstallRetryState(u, u.update, merr), false
+	}
+
+	// artifact gone is not worth retrying; expired artifact URL is
+	// refreshed
+	update, merr := c.CheckArtifactAvailable(ctx.Context(), u.update)
+	if merr != nil {
+		logStateError(u, merr, "%s", merr)
+		if merr.IsFatal() {
+			ctx.resetFetchInstallAttempts()
+			return NewUpdateErrorState(merr, u.update), false
+		}
+		return NewFetchInstallRetryState(u, u.update, merr), false
+	}
+	if update.URI() != u.update.URI() {
+		u.update = update
+		if err := StoreStateData(ctx.store, StateData{
+			Name:       u.Id(),
+			UpdateInfo: u.update,
+		}); err != nil {
+			log.Errorf("failed to store state data in fetch state: %v", err)
+		}
+	}
+	recordInstallStatus(ctx.store, u.update, client.StatusDownloading)
+
+	// progress is reported in the background, and while the artifact is
+	// downloaded and installed; should the deployment be aborted
+	// meanwhile, the install fails
+	if merr := c.ReportUpdateStatusAsync(ctx.Context(), u.update,
+		client.StatusDownloading); merr != nil {
 		return NewUpdateErrorState(NewTransientError(merr.Cause()), u.update), false
 	}
 
-	in, size, err := c.FetchUpdate(u.update.URI())
+	// reject incompatible artifact after fetching just a few kilobytes
+	if merr := c.VerifyUpdateHeader(ctx.Context(), u.update); merr != nil {
+		if merr.Cause() == os.ErrExist {
+			// same artifact is running already
+			return NewUpdateStatusReportState(u.update, client.StatusAlreadyInstalled), false
+		}
+		logStateError(u, merr, "update header verification failed: %s", merr)
+		if merr.IsFatal() {
+			return NewUpdateErrorState(merr, u.update), false
+		}
+		return NewFetchInstallRetryState(u, u.update, merr), false
+	}
+
+	in, size, err := c.FetchUpdate(ctx.Context(), u.update)
 	if err != nil {
-		log.Errorf("update fetch failed: %s", err)
+		logStateError(u, err, "update fetch failed: %s", err)
+		logFetchDiagnostics(err)
 		return NewFetchInstallRetryState(u, u.update, err), false
 	}
 
 	return NewUpdateInstallState(in, size, u.update), false
 }
 
+// Log failure of state s; the deployment log gets the state and error code of
+// err along with the message.
+func logStateError(s State, err error, format string, args ...interface{}) {
+	logWithFields(logrus.Fields{
+		LogFieldState:     s.Id().String(),
+		LogFieldErrorCode: errorCode(err),
+	}).Errorf(format, args...)
+}
+
+// Write diagnostics of the update download to the deployment log, so that they
+// are uploaded to the server if the update fails.
+func logFetchDiagnostics(v interface{}) {
+	if msg := fetchDiagnosticsMessage(v); msg != "" {
+		log.Error(msg)
+	}
+}
+
+func fetchDiagnosticsMessage(v interface{}) string {
+	dr, ok := v.(client.FetchDiagnosticsReporter)
+	if !ok {
+		return ""
+	}
+	data, err := json.Marshal(dr.FetchDiagnostics())
+	if err != nil {
+		return ""
+	}
+	return "update download diagnostics: " + string(data)
+}
+
+// Wrapper for image data stream which stops returning data once the context is
+// cancelled, so that an ongoing install is interrupted right away.
+type contextReader struct {
+	ctx context.Context
+	r   io.ReadCloser
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+func (cr *contextReader) Close() error {
+	return cr.r.Close()
+}
+
+func (cr *contextReader) imageStream() io.Reader {
+	return cr.r
+}
+
 type UpdateInstallState struct {
 	BaseState
 	// reader for obtaining image data
@@ -520,7 +902,7 @@ func (u *UpdateInstallState) Handle(ctx *StateContext, c Controller) (State, boo
 	defer u.imagein.Close()
 
 	// start deployment logging
-	if err := DeploymentLogger.Enable(u.update.ID); err != nil {
+	if err := ctx.deploymentLogger().Enable(u.update.ID); err != nil {
 		return NewUpdateErrorState(NewTransientError(err), u.update), false
 	}
 
@@ -534,30 +916,63 @@ func (u *UpdateInstallState) Handle(ctx *StateContext, c Controller) (State, boo
 		return NewUpdateErrorState(NewTransientError(err), u.update), false
 	}
 
-	merr := c.ReportUpdateStatus(u.update, client.StatusInstalling)
-	if merr != nil && merr.IsFatal() {
-		return NewUpdateErrorState(NewTransientError(merr.Cause()), u.update), false
+	if merr := c.ReportUpdateStatusAsync(ctx.Context(), u.update,
+		client.StatusInstalling); merr != nil {
+		return NewUpdateCleanupState(u.update,
+			NewTransientError(merr.Cause())), false
 	}
 
-	if err := c.InstallUpdate(u.imagein, u.size); err != nil {
-		log.Errorf("update install failed: %s", err)
+	c.SnapshotData(u.update)
+	in := &contextReader{ctx: ctx.Context(), r: &abortCheckReader{
+		r: u.imagein,
+		check: func() menderError {
+			return c.ReportUpdateStatusAsync(ctx.Context(), u.update,
+				client.StatusInstalling)
+		},
+		// reported just now
+		next: time.Now().Add(abortCheckInterval),
+	}}
+	if err := c.InstallArtifact(u.update, in, u.size); err != nil {
+		logStateError(u, err, "update install failed: %s", err)
+		logFetchDiagnostics(u.imagein)
 		return NewFetchInstallRetryState(u, u.update, err), false
 	}
 
-	// restart counter so that we are able to retry next time
-	ctx.fetchInstallAttempts = 0
+	// payload is written, but must not be enabled unless scanner accepts it
+	if err := c.PayloadVerdict(u.update); err != nil {
+		logStateError(u, err, "update payload not accepted: %s", err)
+		ctx.resetFetchInstallAttempts()
+		return NewUpdateCleanupState(u.update, NewFatalError(err)), false
+	}
+
+	ctx.resetFetchInstallAttempts()
 
 	// check if update is not aborted
 	// this step is needed as installing might take a while and we might end up with
 	// proceeding with already cancelled update
-	merr = c.ReportUpdateStatus(u.update, client.StatusInstalling)
+	merr := c.ReportUpdateStatus(ctx.Context(), u.update, client.StatusInstalling)
 	if merr != nil && merr.IsFatal() {
-		return NewUpdateErrorState(NewTransientError(merr.Cause()), u.update), false
+		return NewUpdateCleanupState(u.update,
+			NewTransientError(merr.Cause())), false
 	}
 
 	// if install was successful mark inactive partition as active one
 	if err := c.EnableUpdatedPartition(); err != nil {
-		return NewUpdateErrorState(NewTransientError(err), u.update), false
+		return NewUpdateCleanupState(u.update, NewTransientError(err)), false
+	}
+
+	if !c.RebootRequired() {
+		// application-only update is running already; applications
+		// can hold the commit until they are sure it works
+		if err := StoreStateData(ctx.store, StateData{
+			Name:       MenderStateUpdateCommit,
+			UpdateInfo: u.update,
+		}); err != nil {
+			log.Errorf("failed to store state data in install state: %v", err)
+			return NewRollbackState(u.update), false
+		}
+		c.SetUpdateMarker(u.update, updateMarkerUncommitted)
+		return NewUpdateCommitState(u.update), false
 	}
 
 	return NewRebootState(u.update), false
@@ -613,21 +1028,96 @@ func getFetchInstallRetry(tried int, regularInterval time.Duration) (time.Durati
 	return interval, nil
 }
 
+// Number of attempts made when TLS handshake fails; retrying helps only if the
+// device clock or certificates get fixed in the meantime.
+const maxTLSRetries = 3
+
+// Number of attempts made, a minute apart, when the server name can not be
+// resolved; the network is likely still coming up, and the usual ladder would
+// keep waiting long after it is.
+const maxDNSRetries = 15
+
+// Choose retry interval depending on the kind of failure. Returns error if the
+// attempt should not be retried.
+func getFetchInstallRetryForError(fetchErr error, tried int,
+	regularInterval time.Duration) (time.Duration, error) {
+
+	switch client.ClassifyError(fetchErr) {
+	case client.ErrorClassTerminal:
+		return 0, errors.New("Request rejected by server")
+
+	case client.ErrorClassTLS:
+		if tried >= maxTLSRetries {
+			return 0, errors.New("Tried maximum amount of times")
+		}
+		if regularInterval < 1*time.Minute {
+			return 1 * time.Minute, nil
+		}
+		return regularInterval, nil
+
+	case client.ErrorClassDNS:
+		if tried >= maxDNSRetries {
+			return 0, errors.New("Tried maximum amount of times")
+		}
+		return 1 * time.Minute, nil
+
+	case client.ErrorClassThrottled:
+		intvl, err := getFetchInstallRetry(tried, regularInterval)
+		if err != nil {
+			return 0, err
+		}
+		// respect delay requested by the server
+		if herr, ok := errors.Cause(fetchErr).(*client.HTTPError); ok &&
+			herr.RetryAfter > intvl {
+			return herr.RetryAfter, nil
+		}
+		return intvl, nil
+	}
+
+	return getFetchInstallRetry(tried, regularInterval)
+}
+
 func (fir *FetchInstallRetryState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	log.Debugf("handle fetch install retry state")
 
-	intvl, err := getFetchInstallRetry(ctx.fetchInstallAttempts, c.GetUpdatePollInterval())
+	if fir.err != nil && client.ClassifyError(fir.err) == client.ErrorClassTerminal {
+		log.Errorf("update fetch rejected by server, not retrying: %v", fir.err)
+		ctx.resetFetchInstallAttempts()
+		if fir.from.Id() == MenderStateUpdateInstall {
+			return NewUpdateCleanupState(fir.update, NewFatalError(fir.err)), false
+		}
+		return NewUpdateErrorState(NewFatalError(fir.err), fir.update), false
+	}
+
+	now := time.Now()
+	if fir.err == nil && ctx.fetchRetryPending(fir.update.ID, now) {
+		// fetch attempt failed before restart
+		wait := ctx.retry.FetchNotBefore.Sub(now)
+		log.Infof("resuming wait of %v before next fetch/install attempt", wait)
+		return fir.StateAfterWait(ctx.Context(), NewUpdateFetchState(fir.update), fir, wait)
+	}
+	ctx.restoreFetchInstallAttempts(fir.update.ID)
+
+	intvl, err := getFetchInstallRetryForError(fir.err, ctx.fetchInstallAttempts,
+		c.GetUpdatePollInterval())
 	if err != nil {
+		if fir.from.Id() == MenderStateUpdateInstall {
+			// partition was written already
+			ctx.resetFetchInstallAttempts()
+			return NewUpdateCleanupState(fir.update,
+				NewTransientError(errors.Wrap(fir.err, err.Error()))), false
+		}
+		ctx.resetFetchInstallAttempts()
 		if fir.err != nil {
 			return NewErrorState(NewTransientError(errors.Wrap(fir.err, err.Error()))), false
 		}
 		return NewErrorState(NewTransientError(err)), false
 	}
 
-	ctx.fetchInstallAttempts++
+	ctx.fetchInstallRetried(fir.update.ID, now.Add(intvl))
 
 	log.Debugf("wait %v before next fetch/install attempt", intvl)
-	return fir.StateAfterWait(NewUpdateFetchState(fir.update), fir, intvl)
+	return fir.StateAfterWait(ctx.Context(), NewUpdateFetchState(fir.update), fir, intvl)
 }
 
 type CheckWaitState struct {
@@ -666,16 +1156,54 @@ func (cw *CheckWaitState) Handle(ctx *StateContext, c Controller) (State, bool)
 		next.when = inventory
 		next.state = inventoryUpdateState
 	}
+	periodic := []time.Time{update, inventory}
+
+	// device configuration is deployed independently of updates
+	configIntvl := c.GetConfigurationPollInterval()
+	if configIntvl > 0 {
+		configuration := ctx.lastConfigurationCheck.Add(configIntvl)
+		if configuration.Before(next.when) {
+			next.when = configuration
+			next.state = configurationUpdateState
+		}
+		periodic = append(periodic, configuration)
+	}
+	// periodic checks are delayed to share the wakeup, but not past the
+	// deadlines below
+	wake := coalesceWakeup(next.when, periodic,
+		wakeupCoalesceWindow(c.GetUpdatePollInterval(),
+			c.GetInventoryPollInterval(), configIntvl))
+
+	// deferred update may be installed now
+	if !ctx.deferredUntil.IsZero() && ctx.deferredUntil.Before(wake) {
+		wake = ctx.deferredUntil
+		if ctx.deferredUntil.Before(next.when) {
+			next.when = ctx.deferredUntil
+			next.state = updateCheckState
+		}
+	}
+
+	// refresh authorization token before it expires, rather than finding out
+	// about that by failed request in the middle of an update
+	if refresh := c.GetAuthTokenRefreshTime(); !refresh.IsZero() &&
+		refresh.Before(wake) {
+		wake = refresh
+		if refresh.Before(next.when) {
+			log.Debugf("authorization token needs refreshing at %v", refresh)
+			next.when = refresh
+			next.state = bootstrappedState
+		}
+	}
 
 	now := time.Now()
 	log.Debugf("next check: %v:%v, (%v)", next.when, next.state, now)
 
-	if next.when.After(time.Now()) {
-		wait := next.when.Sub(now)
+	if wake.After(now) {
+		wait := wake.Sub(now)
 
 		log.Debugf("waiting %s for the next state", wait)
 
-		completed := cw.Wait(wait)
+		completed := cw.Wait(ctx.Context(), wait)
 		if !completed {
 			log.Info("waiting cancelled")
 			return cw, true
@@ -700,10 +1228,62 @@ func NewAuthorizeWaitState() State {
 
 func (a *AuthorizeWaitState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	log.Debugf("handle authorize wait state")
-	intvl := c.GetRetryPollInterval()
+	var intvl time.Duration
+	if ctx.isResuming() {
+		// network is likely just coming up after reboot
+		intvl = resumeAuthRetryInterval
+		if retry := c.GetRetryPollInterval(); retry < intvl {
+			intvl = retry
+		}
+	} else {
+		intvl = ctx.authRetryWait(time.Now(), c.GetRetryPollInterval(),
+			c.GetUpdatePollInterval())
+	}
 
 	log.Debugf("wait %v before next authorization attempt", intvl)
-	return a.StateAfterWait(bootstrappedState, a, intvl)
+	return a.StateAfterWait(ctx.Context(), bootstrappedState, a, intvl)
+}
+
+// Device was rejected or decommissioned by the server; instead of retrying
+// authorization with the dead identity at the usual pace, authorization
+// data are removed and bootstrap starts over after a long wait.
+type RejectedState struct {
+	CancellableState
+}
+
+func NewRejectedState() State {
+	return &RejectedState{
+		NewCancellableState(BaseState{
+			id: MenderStateRejected,
+		}),
+	}
+}
+
+func (r *RejectedState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	if merr := c.HandleRejection(); merr != nil {
+		return NewErrorState(merr), false
+	}
+	intvl := ctx.rejectedRetryWait(time.Now(), c.GetRejectedRetryInterval())
+	log.Warnf("device rejected by the server, trying again in %v", intvl)
+	return r.StateAfterWait(ctx.Context(), initState, r, intvl)
+}
+
+type StateLoopWaitState struct {
+	CancellableState
+}
+
+func NewStateLoopWaitState() State {
+	return &StateLoopWaitState{
+		NewCancellableState(BaseState{
+			id: MenderStateLoopWait,
+		}),
+	}
+}
+
+func (s *StateLoopWaitState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	log.Warnf("state machine is looping, waiting %v before starting over",
+		stateLoopBackoff)
+	return s.StateAfterWait(ctx.Context(), initState, s, stateLoopBackoff)
 }
 
 type AuthorizedState struct {
@@ -740,35 +1320,8 @@ func (a *AuthorizedState) Handle(ctx *StateContext, c Controller) (State, bool)
 
 	log.Infof("handling loaded state: %s", sd.Name)
 
-	// chack last known status
-	switch sd.Name {
-	// update process was finished; check what is the status of update
-	case MenderStateReboot:
-		return NewUpdateVerifyState(sd.UpdateInfo), false
-
-		// update prosess was initialized but stopped in the middle
-	case MenderStateUpdateFetch, MenderStateUpdateInstall:
-		// TODO: for now we just continue sending error report to the server
-		// in future we might want to have some recovery option here
-		me := NewFatalError(errors.New("update process was interrupted"))
-		return NewUpdateErrorState(me, sd.UpdateInfo), false
-
-		// there was some error while reporting update status
-	case MenderStateUpdateStatusReport:
-		log.Infof("restoring update status report state")
-		if sd.UpdateStatus != client.StatusFailure &&
-			sd.UpdateStatus != client.StatusSuccess {
-			return NewUpdateStatusReportState(sd.UpdateInfo, client.StatusFailure), false
-		}
-		// check what is exact state of update before reporting anything
-		return NewUpdateVerifyState(sd.UpdateInfo), false
-
-		// this should not happen
-	default:
-		log.Errorf("got invalid update state: %v", sd.Name)
-		me := NewFatalError(errors.New("got invalid update state"))
-		return NewUpdateErrorState(me, sd.UpdateInfo), false
-	}
+	// resume as declared by the state which stored the data
+	return resumeState(sd, c), false
 }
 
 type InventoryUpdateState struct {
@@ -779,7 +1332,7 @@ func (iu *InventoryUpdateState) Handle(ctx *StateContext, c Controller) (State,
 
 	ctx.lastInventoryUpdate = time.Now()
 
-	err := c.InventoryRefresh()
+	err := c.InventoryRefresh(ctx.Context())
 	if err != nil {
 		log.Warnf("failed to refresh inventory: %v", err)
 	} else {
@@ -788,6 +1341,20 @@ func (iu *InventoryUpdateState) Handle(ctx *StateContext, c Controller) (State,
 	return checkWaitState, false
 }
 
+type ConfigurationUpdateState struct {
+	BaseState
+}
+
+func (cu *ConfigurationUpdateState) Handle(ctx *StateContext, c Controller) (State, bool) {
+
+	ctx.lastConfigurationCheck = time.Now()
+
+	if err := c.UpdateConfiguration(ctx.Context()); err != nil {
+		log.Errorf("device configuration update failed: %v", err)
+	}
+	return checkWaitState, false
+}
+
 type ErrorState struct {
 	BaseState
 	cause menderError
@@ -819,6 +1386,57 @@ func (e *ErrorState) IsFatal() bool {
 	return e.cause.IsFatal()
 }
 
+// Cleans up after failed or aborted install, e.g. partially written
+// partition, before reporting the failure.
+type UpdateCleanupState struct {
+	CancellableState
+	update client.UpdateResponse
+	cause  menderError
+	tries  int
+}
+
+const (
+	maxCleanupTries      = 3
+	cleanupRetryInterval = 1 * time.Minute
+)
+
+func NewUpdateCleanupState(update client.UpdateResponse, cause menderError) State {
+	return &UpdateCleanupState{
+		CancellableState: NewCancellableState(BaseState{
+			id: MenderStateUpdateCleanup,
+		}),
+		update: update,
+		cause:  cause,
+	}
+}
+
+func (uc *UpdateCleanupState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	ctx.deploymentLogger().Enable(uc.update.ID)
+	if uc.cause != nil {
+		log.Errorf("cleaning up after failed update: %v", uc.cause.Cause())
+	}
+
+	// resume cleanup should the device lose power meanwhile
+	if err := StoreStateData(ctx.store, StateData{
+		Name:       uc.Id(),
+		UpdateInfo: uc.update,
+	}); err != nil {
+		log.Errorf("failed to store state data in update cleanup state: %v", err)
+	}
+
+	if err := c.CleanupUpdate(); err != nil {
+		uc.tries++
+		if uc.tries < maxCleanupTries {
+			log.Errorf("cleanup after failed update failed, retrying in %v: %v",
+				cleanupRetryInterval, err)
+			return uc.StateAfterWait(ctx.Context(), uc, uc, cleanupRetryInterval)
+		}
+		log.Errorf("cleanup after failed update failed, giving up: %v", err)
+	}
+
+	return NewUpdateStatusReportState(uc.update, client.StatusFailure), false
+}
+
 type UpdateErrorState struct {
 	ErrorState
 	update client.UpdateResponse
@@ -847,23 +1465,41 @@ type UpdateStatusReportState struct {
 	CancellableState
 	update             client.UpdateResponse
 	status             string
+	subState           string
 	triesSendingReport int
 }
 
 func NewUpdateStatusReportState(update client.UpdateResponse, status string) State {
+	return NewUpdateStatusReportSubState(update, status, "")
+}
+
+func NewUpdateStatusReportSubState(update client.UpdateResponse, status,
+	subState string) State {
 	return &UpdateStatusReportState{
 		CancellableState: NewCancellableState(BaseState{
 			id: MenderStateUpdateStatusReport,
 		}),
-		update: update,
-		status: status,
+		update:   update,
+		status:   status,
+		subState: subState,
 	}
 }
 
-type SendData func(updResp client.UpdateResponse, status string, c Controller) menderError
+type SendData func(ctx context.Context, updResp client.UpdateResponse, status string,
+	c Controller) menderError
 
-func sendDeploymentLogs(update client.UpdateResponse, status string, c Controller) menderError {
-	logs, err := DeploymentLogger.GetLogs(update.ID)
+// deploymentLogSender returns SendData uploading the logs of the deployment
+// from logManager.
+func deploymentLogSender(logManager *DeploymentLogManager) SendData {
+	return func(ctx context.Context, update client.UpdateResponse, status string,
+		c Controller) menderError {
+		return sendDeploymentLogs(ctx, logManager, update, c)
+	}
+}
+
+func sendDeploymentLogs(ctx context.Context, logManager *DeploymentLogManager,
+	update client.UpdateResponse, c Controller) menderError {
+	logs, err := logManager.GetLogs(update.ID)
 	if err != nil {
 		log.Errorf("Failed to get deployment logs for deployment [%v]: %v",
 			update.ID, err)
@@ -871,7 +1507,7 @@ func sendDeploymentLogs(update client.UpdateResponse, status string, c Controlle
 		return NewFatalError(errors.New("can not get deployment logs from file"))
 	}
 
-	if err = c.UploadLog(update, logs); err != nil {
+	if err = c.UploadLog(ctx, update, logs); err != nil {
 		// we got error while sending deployment logs to server;
 		log.Errorf("failed to report deployment logs: %v", err)
 		return NewFatalError(errors.Wrapf(err, "failed to send deployment logs"))
@@ -880,8 +1516,9 @@ func sendDeploymentLogs(update client.UpdateResponse, status string, c Controlle
 }
 
 // wrapper for report sending
-func sendStatus(update client.UpdateResponse, status string, c Controller) menderError {
-	return c.ReportUpdateStatus(update, status)
+func sendStatus(ctx context.Context, update client.UpdateResponse, status string,
+	c Controller) menderError {
+	return c.ReportUpdateStatus(ctx, update, status)
 }
 
 // retry at least that many times
@@ -900,7 +1537,8 @@ func maxSendingAttempts(upi, rpi time.Duration) int {
 	return int(max) * 2
 }
 
-func (usr *UpdateStatusReportState) trySend(send SendData, c Controller) (error, bool) {
+func (usr *UpdateStatusReportState) trySend(ctx context.Context, send SendData,
+	c Controller) (error, bool) {
 
 	maxTrySending :=
 		maxSendingAttempts(c.GetUpdatePollInterval(), c.GetRetryPollInterval())
@@ -909,7 +1547,7 @@ func (usr *UpdateStatusReportState) trySend(send SendData, c Controller) (error,
 		log.Infof("attempting to report data of deployment [%v] to the backend;"+
 			" deployment status [%v], try %d",
 			usr.update.ID, usr.status, usr.triesSendingReport)
-		if err := send(usr.update, usr.status, c); err != nil {
+		if err := send(ctx, usr.update, usr.status, c); err != nil {
 			log.Errorf("failed to report data %v: %v", usr.status, err.Cause())
 			// fatal error means that the cause is not likely to go
 			// away with subsequent retries, just stop at once
@@ -919,7 +1557,7 @@ func (usr *UpdateStatusReportState) trySend(send SendData, c Controller) (error,
 
 			// error reporting status or sending logs;
 			// wait for some time before trying again
-			if wc := usr.Wait(c.GetRetryPollInterval()); wc == false {
+			if wc := usr.Wait(ctx, c.GetRetryPollInterval()); wc == false {
 				// if the waiting was interrupted don't increase triesSendingReport
 				return nil, true
 			}
@@ -937,7 +1575,7 @@ func (usr *UpdateStatusReportState) Handle(ctx *StateContext, c Controller) (Sta
 
 	// start deployment logging; no error checking
 	// we can do nothing here; either we will have the logs or not...
-	DeploymentLogger.Enable(usr.update.ID)
+	ctx.deploymentLogger().Enable(usr.update.ID)
 
 	log.Debug("handle update status report state")
 
@@ -950,11 +1588,32 @@ func (usr *UpdateStatusReportState) Handle(ctx *StateContext, c Controller) (Sta
 			err)
 		return NewReportErrorState(usr.update, usr.status), false
 	}
+	switch usr.status {
+	case client.StatusSuccess, client.StatusFailure, client.StatusAlreadyInstalled:
+		recordInstallStatus(ctx.store, usr.update, usr.status)
+	}
 
-	err, wasInterupted := usr.trySend(sendStatus, c)
+	send := sendStatus
+	if usr.subState != "" {
+		send = func(ctx context.Context, update client.UpdateResponse, status string,
+			c Controller) menderError {
+			return c.ReportUpdateSubState(ctx, update, status, usr.subState)
+		}
+	}
+	err, wasInterupted := usr.trySend(ctx.Context(), send, c)
 	if wasInterupted {
-		return usr, false
+		return usr, true
 	}
+
+	if usr.status == client.StatusRebooting {
+		// rebooting status left unacknowledged before the reboot; the
+		// update is not complete yet, carry on with verifying it
+		if err != nil {
+			log.Errorf("failed to re-send rebooting status: %v", err)
+		}
+		return NewUpdateVerifyState(usr.update), false
+	}
+
 	if err != nil {
 		log.Errorf("failed to send status to server: %v", err)
 		return NewReportErrorState(usr.update, usr.status), false
@@ -962,9 +1621,10 @@ func (usr *UpdateStatusReportState) Handle(ctx *StateContext, c Controller) (Sta
 
 	if usr.status == client.StatusFailure {
 		log.Debugf("attempting to upload deployment logs for failed update")
-		err, wasInterupted = usr.trySend(sendDeploymentLogs, c)
+		err, wasInterupted = usr.trySend(ctx.Context(),
+			deploymentLogSender(ctx.deploymentLogger()), c)
 		if wasInterupted {
-			return usr, false
+			return usr, true
 		}
 		if err != nil {
 			log.Errorf("failed to send deployment logs to server: %v", err)
@@ -974,7 +1634,7 @@ func (usr *UpdateStatusReportState) Handle(ctx *StateContext, c Controller) (Sta
 
 	log.Debug("reporting complete")
 	// stop deployment logging as the update is completed at this point
-	DeploymentLogger.Disable()
+	ctx.deploymentLogger().Disable()
 	// status reported, logs uploaded if needed, remove state data
 	RemoveStateData(ctx.store)
 
@@ -1022,32 +1682,37 @@ func (res *ReportErrorState) Handle(ctx *StateContext, c Controller) (State, boo
 }
 
 type RebootState struct {
-	BaseState
+	CancellableState
 	update client.UpdateResponse
 }
 
 func NewRebootState(update client.UpdateResponse) State {
 	return &RebootState{
-		BaseState{
+		CancellableState: NewCancellableState(BaseState{
 			id: MenderStateReboot,
-		},
-		update,
+		}),
+		update: update,
 	}
 }
 
 func (e *RebootState) Handle(ctx *StateContext, c Controller) (State, bool) {
 
 	// start deployment logging
-	if err := DeploymentLogger.Enable(e.update.ID); err != nil {
+	if err := ctx.deploymentLogger().Enable(e.update.ID); err != nil {
 		// just log error; we need to reboot anyway
 		log.Errorf("failed to enable deployment logger: %s", err)
 	}
 
 	log.Debug("handling reboot state")
 
+	// rebooting status is pending until the server acknowledges it; if the
+	// device reboots before that, it is sent again after the reboot
+	bootID := currentBootID()
 	if err := StoreStateData(ctx.store, StateData{
-		Name:       e.Id(),
-		UpdateInfo: e.update,
+		Name:         e.Id(),
+		UpdateInfo:   e.update,
+		UpdateStatus: client.StatusRebooting,
+		RebootBootID: bootID,
 	}); err != nil {
 		// too late to do anything now, update is installed and enabled, let's play
 		// along and reboot
@@ -1055,55 +1720,72 @@ func (e *RebootState) Handle(ctx *StateContext, c Controller) (State, bool) {
 			"continuing with reboot", err)
 	}
 
-	merr := c.ReportUpdateStatus(e.update, client.StatusRebooting)
+	merr := c.ReportUpdateStatus(ctx.Context(), e.update, client.StatusRebooting)
 	if merr != nil && merr.IsFatal() {
 		return NewUpdateErrorState(NewTransientError(merr.Cause()), e.update), false
 	}
+	if merr != nil {
+		log.Warnf("rebooting status not acknowledged, will be sent again "+
+			"after reboot: %v", merr.Cause())
+	} else if err := StoreStateData(ctx.store, StateData{
+		Name:         e.Id(),
+		UpdateInfo:   e.update,
+		RebootBootID: bootID,
+	}); err != nil {
+		log.Errorf("failed to store state data in reboot state: %v", err)
+	}
 
-	log.Info("rebooting device")
+	// backup jobs, user sessions and the like may hold the reboot off
+	if !waitForRebootInhibitors(ctx, c, e, e.update) {
+		return e, true
+	}
 
-	if err := c.Reboot(); err != nil {
-		log.Errorf("error rebooting device: %v", err)
-		return NewErrorState(NewFatalError(err)), false
+	// give applications a chance to flush their data
+	grace := c.GetRebootGracePeriod()
+	c.NotifyReboot(e.update, grace)
+	if grace > 0 {
+		log.Infof("rebooting device in %v", grace)
+		if !e.Wait(ctx.Context(), grace) {
+			return e, true
+		}
 	}
 
-	// we can not reach this point
-	return doneState, false
+	return rebootDevice(ctx, c, e)
 }
 
 type RollbackState struct {
-	BaseState
+	CancellableState
 	update client.UpdateResponse
 }
 
 func NewRollbackState(update client.UpdateResponse) State {
 	return &RollbackState{
-		BaseState{
+		CancellableState: NewCancellableState(BaseState{
 			id: MenderStateRollback,
-		},
-		update,
+		}),
+		update: update,
 	}
 }
 
 func (rs *RollbackState) Handle(ctx *StateContext, c Controller) (State, bool) {
-	DeploymentLogger.Enable(rs.update.ID)
+	ctx.deploymentLogger().Enable(rs.update.ID)
 	log.Info("performing rollback")
+	reboot := c.RebootRequired()
 	// swap active and inactive partitions
 	if err := c.Rollback(); err != nil {
-		log.Errorf("rollback failed: %s", err)
+		logStateError(rs, err, "rollback failed: %s", err)
 		// TODO: what can we do here
 		return NewErrorState(NewFatalError(err)), false
 	}
+	c.SetUpdateMarker(rs.update, updateMarkerRolledBack)
 
-	log.Info("rebooting device")
-
-	if err := c.Reboot(); err != nil {
-		log.Errorf("error rebooting device: %v", err)
-		return NewErrorState(NewFatalError(err)), false
+	if !reboot {
+		// applications are back in the previous slot already
+		c.RestoreDataSnapshot(rs.update)
+		return NewUpdateStatusReportState(rs.update, client.StatusFailure), false
 	}
 
-	// we can not reach this point
-	return doneState, false
+	return rebootDevice(ctx, c, rs)
 }
 
 type FinalState struct {
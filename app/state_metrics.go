@@ -0,0 +1,176 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+)
+
+const stateTimesName = "state-times"
+
+// StateMetrics tells how long the client spent in each state, keyed by state
+// name (e.g. update-fetch, update-install, fetch-install-retry-wait).
+type StateMetrics struct {
+	// since the client was started
+	Total map[string]time.Duration
+	// during the most recent, possibly ongoing, deployment; time the
+	// device spent rebooting is not included
+	LastDeploymentID string
+	LastDeployment   map[string]time.Duration
+}
+
+// Time spent in states of a deployment; persistent, so that the time spent
+// before rebooting into the new artifact is not lost.
+type deploymentTimes struct {
+	ID string
+	// false once the deployment is over
+	Active    bool
+	Durations map[string]time.Duration
+}
+
+// Accounts time spent in states of the state machine.
+type stateTimes struct {
+	lock       sync.Mutex
+	store      Store
+	state      MenderState
+	since      time.Time
+	total      map[string]time.Duration
+	deployment deploymentTimes
+}
+
+// states the client gets to once a deployment is over
+var deploymentEndStates = map[MenderState]bool{
+	MenderStateCheckWait:       true,
+	MenderStateInventoryUpdate: true,
+	MenderStateUpdateCheck:     true,
+}
+
+func newStateTimes(store Store, state MenderState, now time.Time) *stateTimes {
+	t := &stateTimes{
+		store: store,
+		state: state,
+		since: now,
+		total: make(map[string]time.Duration),
+	}
+	if store == nil {
+		return t
+	}
+	if data, err := store.ReadAll(stateTimesName); err == nil {
+		if err := json.Unmarshal(data, &t.deployment); err != nil {
+			log.Warnf("discarding broken state times: %v", err)
+			t.deployment = deploymentTimes{}
+		}
+	}
+	return t
+}
+
+// Account time spent in the current state and switch to `state`;
+// `deploymentID` is not empty if `state` starts fetching an update.
+func (t *stateTimes) enter(state MenderState, deploymentID string, now time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	spent := now.Sub(t.since)
+	if spent < 0 {
+		// clock was set back
+		spent = 0
+	}
+	name := t.state.String()
+	t.total[name] += spent
+
+	changed := false
+	if t.deployment.Active {
+		t.deployment.Durations[name] += spent
+		changed = true
+	}
+	// fetch is retried within the same deployment
+	if deploymentID != "" &&
+		(deploymentID != t.deployment.ID || !t.deployment.Active) {
+		t.deployment = deploymentTimes{
+			ID:        deploymentID,
+			Active:    true,
+			Durations: make(map[string]time.Duration),
+		}
+		changed = true
+	} else if t.deployment.Active && deploymentEndStates[state] {
+		t.deployment.Active = false
+		changed = true
+	}
+
+	t.state = state
+	t.since = now
+
+	if changed {
+		t.save()
+	}
+}
+
+func (t *stateTimes) save() {
+	if t.store == nil {
+		return
+	}
+	data, err := json.Marshal(t.deployment)
+	if err == nil {
+		err = t.store.WriteAll(stateTimesName, data)
+	}
+	if err != nil {
+		log.Debugf("failed to save state times: %v", err)
+	}
+}
+
+func (t *stateTimes) metrics(now time.Time) StateMetrics {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	m := StateMetrics{
+		Total:            make(map[string]time.Duration, len(t.total)+1),
+		LastDeploymentID: t.deployment.ID,
+		LastDeployment: make(map[string]time.Duration,
+			len(t.deployment.Durations)+1),
+	}
+	for k, v := range t.total {
+		m.Total[k] = v
+	}
+	for k, v := range t.deployment.Durations {
+		m.LastDeployment[k] = v
+	}
+
+	// time spent in the current state so far
+	if spent := now.Sub(t.since); spent > 0 {
+		m.Total[t.state.String()] += spent
+		if t.deployment.Active {
+			m.LastDeployment[t.state.String()] += spent
+		}
+	}
+	return m
+}
+
+// Seconds spent in each state of the given deployment so far, for the final
+// status report; nil if the deployment is not the one being tracked.
+func (t *stateTimes) deploymentSeconds(deploymentID string, now time.Time) map[string]float64 {
+	m := t.metrics(now)
+	if deploymentID == "" || m.LastDeploymentID != deploymentID ||
+		len(m.LastDeployment) == 0 {
+		return nil
+	}
+	secs := make(map[string]float64, len(m.LastDeployment))
+	for k, v := range m.LastDeployment {
+		secs[k] = v.Seconds()
+	}
+	return secs
+}
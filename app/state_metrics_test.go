@@ -0,0 +1,107 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateTimes(t *testing.T) {
+	ms := utils.NewMemStore()
+	now := time.Unix(1000, 0)
+	st := newStateTimes(ms, MenderStateInit, now)
+
+	st.enter(MenderStateCheckWait, "", now.Add(time.Second))
+	st.enter(MenderStateUpdateCheck, "", now.Add(61*time.Second))
+	// deployment starts with fetching the update
+	st.enter(MenderStateUpdateFetch, "foo", now.Add(62*time.Second))
+	st.enter(MenderStateFetchInstallRetryWait, "", now.Add(72*time.Second))
+	// retry does not start a new deployment
+	st.enter(MenderStateUpdateFetch, "foo", now.Add(102*time.Second))
+	st.enter(MenderStateUpdateInstall, "", now.Add(112*time.Second))
+
+	m := st.metrics(now.Add(142 * time.Second))
+	assert.Equal(t, "foo", m.LastDeploymentID)
+	assert.Equal(t, map[string]time.Duration{
+		"update-fetch":             20 * time.Second,
+		"fetch-install-retry-wait": 30 * time.Second,
+		// ongoing
+		"update-install": 30 * time.Second,
+	}, m.LastDeployment)
+	assert.Equal(t, 60*time.Second, m.Total["check-wait"])
+	assert.Equal(t, time.Second, m.Total["init"])
+	assert.Equal(t, 20*time.Second, m.Total["update-fetch"])
+
+	st.enter(MenderStateReboot, "", now.Add(172*time.Second))
+	st.enter(MenderStateDone, "", now.Add(173*time.Second))
+
+	// time spent before rebooting is not lost
+	now = now.Add(time.Hour)
+	st = newStateTimes(ms, MenderStateInit, now)
+	m = st.metrics(now)
+	assert.Equal(t, "foo", m.LastDeploymentID)
+	assert.Equal(t, time.Second, m.LastDeployment["reboot"])
+	assert.Empty(t, m.Total)
+
+	st.enter(MenderStateUpdateVerify, "", now.Add(5*time.Second))
+	st.enter(MenderStateUpdateStatusReport, "", now.Add(6*time.Second))
+	secs := st.deploymentSeconds("foo", now.Add(8*time.Second))
+	assert.Equal(t, map[string]float64{
+		"update-fetch":             20,
+		"fetch-install-retry-wait": 30,
+		"update-install":           60,
+		"reboot":                   1,
+		"init":                     5,
+		"update-verify":            1,
+		"update-status-report":     2,
+	}, secs)
+	assert.Nil(t, st.deploymentSeconds("bar", now.Add(8*time.Second)))
+
+	// deployment is over; waiting for the next one is not accounted
+	st.enter(MenderStateCheckWait, "", now.Add(10*time.Second))
+	m = st.metrics(now.Add(time.Hour))
+	assert.Equal(t, 4*time.Second, m.LastDeployment["update-status-report"])
+	assert.NotContains(t, m.LastDeployment, "check-wait")
+
+	// new deployment replaces the last one
+	st.enter(MenderStateUpdateFetch, "bar", now.Add(2*time.Hour))
+	m = st.metrics(now.Add(2*time.Hour + time.Second))
+	assert.Equal(t, "bar", m.LastDeploymentID)
+	assert.Equal(t, map[string]time.Duration{"update-fetch": time.Second},
+		m.LastDeployment)
+
+	// broken data is discarded
+	ms.WriteAll(stateTimesName, []byte("garbage"))
+	st = newStateTimes(ms, MenderStateInit, now)
+	assert.Empty(t, st.metrics(now).LastDeploymentID)
+}
+
+func TestMenderStateTimes(t *testing.T) {
+	mender := newTestMender(nil, MenderConfig{}, testMenderPieces{})
+	update := client.UpdateResponse{ID: "foo"}
+
+	mender.SetState(NewUpdateFetchState(update))
+	mender.SetState(NewUpdateInstallState(nil, 0, update))
+
+	m := mender.stateTimes.metrics(time.Now())
+	assert.Equal(t, "foo", m.LastDeploymentID)
+	assert.Contains(t, m.LastDeployment, "update-fetch")
+	assert.Contains(t, m.LastDeployment, "update-install")
+	assert.Contains(t, m.Total, "init")
+}
@@ -0,0 +1,139 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Function picking the state to resume with after restart, from state data
+// stored by the state the daemon was in.
+type stateResumeFunc func(sd StateData, c Controller) State
+
+// How the daemon resumes after being restarted (power loss, crash, reboot
+// into the new artifact) in each state. Only states storing state data
+// have a resume function; the daemon restarted in any other state finds the
+// state data stored by an earlier state of the deployment, if any, and
+// resumes as that state declares, or starts over if there is none.
+//
+// Every state must be listed; the table is checked by tests restarting the
+// daemon in each of them.
+var stateResumeTable = map[MenderState]stateResumeFunc{
+	// not in deployment: start over
+	MenderStateInit:                nil,
+	MenderStateBootstrapped:        nil,
+	MenderStateAuthorized:          nil,
+	MenderStateAuthorizeWait:       nil,
+	MenderStateInventoryUpdate:     nil,
+	MenderStateCheckWait:           nil,
+	MenderStateUpdateCheck:         nil,
+	MenderStateLoopWait:            nil,
+	MenderStateUpdateDeferred:      nil,
+	MenderStateDeviceCommand:       nil,
+	MenderStateRejected:            nil,
+	MenderStateConfigurationUpdate: nil,
+	MenderStateError:               nil,
+	MenderStateDone:                nil,
+
+	// interrupted download is not resumed, the deployment fails
+	MenderStateUpdateFetch: resumeFailInterrupted,
+	// resumes as the fetch state, which stored state data before
+	MenderStateFetchInstallRetryWait: nil,
+	// partition may be partially written: cleaned up, deployment fails
+	MenderStateUpdateInstall: resumeCleanup,
+	// cleanup is done again, deployment fails
+	MenderStateUpdateCleanup: resumeCleanup,
+	// application-only update waiting for commit: commit, if it is still
+	// pending
+	MenderStateUpdateCommit: resumeCommit,
+	// rebooted into the new artifact: verify it, sending rebooting status
+	// first if the server did not acknowledge it
+	MenderStateReboot: resumeAfterReboot,
+	// resume as the reboot, install or commit state which stored state
+	// data before
+	MenderStateUpdateVerify:      nil,
+	MenderStateUpdateCommitHold:  nil,
+	MenderStateRollback:          nil,
+	MenderStateUpdateError:       nil,
+	MenderStateReportStatusError: nil,
+	// status of finished deployment is reported again, once the update
+	// is verified to be in the state reported
+	MenderStateUpdateStatusReport: resumeStatusReport,
+}
+
+func resumeFailInterrupted(sd StateData, c Controller) State {
+	// TODO: for now we just continue sending error report to the server
+	// in future we might want to have some recovery option here
+	me := NewFatalError(errors.New("update process was interrupted"))
+	return NewUpdateErrorState(me, sd.UpdateInfo)
+}
+
+func resumeCleanup(sd StateData, c Controller) State {
+	me := NewFatalError(errors.New("update process was interrupted"))
+	return NewUpdateCleanupState(sd.UpdateInfo, me)
+}
+
+func resumeCommit(sd StateData, c Controller) State {
+	has, herr := c.HasUpgrade()
+	if herr != nil || !has {
+		log.Errorf("no pending update to commit")
+		return NewUpdateStatusReportState(sd.UpdateInfo, client.StatusFailure)
+	}
+	return NewUpdateCommitState(sd.UpdateInfo)
+}
+
+func resumeAfterReboot(sd StateData, c Controller) State {
+	if sd.RebootBootID != "" && sd.RebootBootID == currentBootID() {
+		// restarted without reboot, eg. by the supervisor in exit reboot
+		// mode; the new artifact is not running, nothing to verify yet
+		log.Warnf("device not rebooted into the new artifact yet, " +
+			"handing the reboot off again")
+		return NewRebootState(sd.UpdateInfo)
+	}
+	if sd.UpdateStatus == client.StatusRebooting {
+		// device rebooted before the server acknowledged
+		// rebooting status
+		log.Infof("re-sending rebooting status")
+		return NewUpdateStatusReportState(sd.UpdateInfo, client.StatusRebooting)
+	}
+	return NewUpdateVerifyState(sd.UpdateInfo)
+}
+
+func resumeStatusReport(sd StateData, c Controller) State {
+	log.Infof("restoring update status report state")
+	if sd.UpdateStatus == client.StatusRebooting {
+		return NewUpdateStatusReportState(sd.UpdateInfo, client.StatusRebooting)
+	}
+	if sd.UpdateStatus != client.StatusFailure &&
+		sd.UpdateStatus != client.StatusSuccess {
+		return NewUpdateStatusReportState(sd.UpdateInfo, client.StatusFailure)
+	}
+	// check what is exact state of update before reporting anything
+	return NewUpdateVerifyState(sd.UpdateInfo)
+}
+
+// State to resume with after restart, given state data loaded from the
+// store.
+func resumeState(sd StateData, c Controller) State {
+	resume := stateResumeTable[sd.Name]
+	if resume == nil {
+		// this should not happen
+		log.Errorf("got invalid update state: %v", sd.Name)
+		me := NewFatalError(errors.New("got invalid update state"))
+		return NewUpdateErrorState(me, sd.UpdateInfo)
+	}
+	return resume(sd, c)
+}
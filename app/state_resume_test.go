@@ -0,0 +1,107 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateResumeTableComplete(t *testing.T) {
+	for state, name := range stateNames {
+		_, ok := stateResumeTable[state]
+		assert.True(t, ok, "no resume path declared for state %s", name)
+	}
+	for state := range stateResumeTable {
+		_, ok := stateNames[state]
+		assert.True(t, ok, "resume path declared for unknown state %v", state)
+	}
+}
+
+// Restart the daemon with state data stored in each of the states.
+func TestStateResume(t *testing.T) {
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+
+	type resumeCase struct {
+		status     string
+		hasUpgrade bool
+		next       State
+		nextStatus string
+	}
+	cases := map[MenderState][]resumeCase{
+		MenderStateUpdateFetch: {
+			{next: &UpdateErrorState{}},
+		},
+		MenderStateUpdateInstall: {
+			{next: &UpdateCleanupState{}},
+		},
+		MenderStateUpdateCleanup: {
+			{next: &UpdateCleanupState{}},
+		},
+		MenderStateUpdateCommit: {
+			{hasUpgrade: true, next: &UpdateCommitState{}},
+			{hasUpgrade: false, next: &UpdateStatusReportState{},
+				nextStatus: client.StatusFailure},
+		},
+		MenderStateReboot: {
+			{next: &UpdateVerifyState{}},
+			{status: client.StatusRebooting, next: &UpdateStatusReportState{},
+				nextStatus: client.StatusRebooting},
+		},
+		MenderStateUpdateStatusReport: {
+			{status: client.StatusSuccess, next: &UpdateVerifyState{}},
+			{status: client.StatusFailure, next: &UpdateVerifyState{}},
+			{status: client.StatusRebooting, next: &UpdateStatusReportState{},
+				nextStatus: client.StatusRebooting},
+			{status: client.StatusInstalling, next: &UpdateStatusReportState{},
+				nextStatus: client.StatusFailure},
+		},
+	}
+
+	for state, name := range stateNames {
+		resumes, ok := cases[state]
+		if stateResumeTable[state] == nil {
+			assert.False(t, ok, "state %s declares no resume path", name)
+			resumes = []resumeCase{{next: &UpdateErrorState{}}}
+		} else {
+			assert.True(t, ok, "resume path of state %s is not tested", name)
+		}
+
+		for _, rc := range resumes {
+			ms := utils.NewMemStore()
+			ctx := StateContext{store: ms}
+			assert.NoError(t, StoreStateData(ms, StateData{
+				Name:         state,
+				UpdateInfo:   update,
+				UpdateStatus: rc.status,
+			}))
+
+			s, c := (&AuthorizedState{}).Handle(&ctx, &stateTestController{
+				hasUpgrade: rc.hasUpgrade,
+			})
+			assert.False(t, c)
+			assert.IsType(t, rc.next, s, "resuming in state %s, status %q",
+				name, rc.status)
+			if usr, ok := s.(*UpdateStatusReportState); ok {
+				assert.Equal(t, rc.nextStatus, usr.status)
+				assert.Equal(t, update, usr.update)
+			}
+		}
+	}
+}
@@ -0,0 +1,2500 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/app/testutils"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+type stateTestController struct {
+	testutils.FakeDevice
+	updater         testutils.FakeUpdater
+	bootstrapErr    menderError
+	artifactName    string
+	pollIntvl       time.Duration
+	retryIntvl      time.Duration
+	authRefresh     time.Time
+	hasUpgrade      bool
+	hasUpgradeErr   menderError
+	state           State
+	updateResp      *client.UpdateResponse
+	updateRespErr   menderError
+	authorize       menderError
+	reportError     menderError
+	logSendingError menderError
+	reportStatus    string
+	reportUpdate    client.UpdateResponse
+	logUpdate       client.UpdateResponse
+	logs            []byte
+	inventoryErr    error
+	deferUntil      time.Time
+	deferReason     string
+	deferredReports int
+	command         *DeviceCommand
+	decommissioned  bool
+	decommissionErr menderError
+	unquarantined   bool
+	rejected        bool
+	rejectionErr    menderError
+	rejectedIntvl   time.Duration
+	unauthorizedMax int
+	verifyHeaderErr menderError
+	revalidateErr   menderError
+	updateMarkers   []string
+	commitHolds     []string
+	commitHoldTime  time.Duration
+	commitHoldAct   string
+	holdReleased    chan struct{}
+	stateTimeouts   map[MenderState]time.Duration
+	configIntvl     time.Duration
+	configErr       menderError
+	reportSubState  string
+	asyncReports    []string
+	// deployment found aborted by background report
+	asyncReportErr  menderError
+	rebootGrace     time.Duration
+	refreshedUpdate *client.UpdateResponse
+	artifactErr     menderError
+	inhibitors      []string
+	maxInhibit      time.Duration
+	rebootMode      string
+	appUpdate       bool
+	cleanupErr      error
+	filterErr       error
+	payloadErr      error
+	previousBootLog bool
+	// data snapshot operations
+	dataSnapshot []string
+	cleanedUp    bool
+	debugLogging *DeviceCommand
+	// device operations and notifications in the order they were made
+	calls []string
+}
+
+func (s *stateTestController) Bootstrap() menderError {
+	return s.bootstrapErr
+}
+
+func (s *stateTestController) GetCurrentArtifactName() string {
+	return s.artifactName
+}
+
+func (s *stateTestController) GetUpdatePollInterval() time.Duration {
+	return s.pollIntvl
+}
+
+func (s *stateTestController) GetInventoryPollInterval() time.Duration {
+	return s.pollIntvl
+}
+
+func (s *stateTestController) GetRetryPollInterval() time.Duration {
+	return s.retryIntvl
+}
+
+func (s *stateTestController) GetAuthTokenRefreshTime() time.Time {
+	return s.authRefresh
+}
+
+func (s *stateTestController) HasUpgrade() (bool, menderError) {
+	return s.hasUpgrade, s.hasUpgradeErr
+}
+
+func (s *stateTestController) CheckUpdate(ctx context.Context) (*client.UpdateResponse, menderError) {
+	return s.updateResp, s.updateRespErr
+}
+
+func (s *stateTestController) FetchUpdate(ctx context.Context,
+	update client.UpdateResponse) (io.ReadCloser, int64, error) {
+	return s.updater.FetchUpdate(ctx, nil, update.URI())
+}
+
+func (s *stateTestController) RevalidateUpdate(ctx context.Context,
+	update client.UpdateResponse, checked time.Time) menderError {
+	return s.revalidateErr
+}
+
+func (s *stateTestController) VerifyUpdateHeader(ctx context.Context,
+	update client.UpdateResponse) menderError {
+	return s.verifyHeaderErr
+}
+
+func (s *stateTestController) CheckArtifactAvailable(ctx context.Context,
+	update client.UpdateResponse) (client.UpdateResponse, menderError) {
+	if s.refreshedUpdate != nil {
+		return *s.refreshedUpdate, s.artifactErr
+	}
+	return update, s.artifactErr
+}
+
+func (s *stateTestController) GetState() State {
+	return s.state
+}
+
+func (s *stateTestController) SetState(state State) {
+	s.state = state
+}
+
+func (s *stateTestController) RunState(ctx *StateContext) (State, bool) {
+	return s.state.Handle(ctx, s)
+}
+
+func (s *stateTestController) Authorize(ctx context.Context) menderError {
+	return s.authorize
+}
+
+func (s *stateTestController) ReportUpdateStatus(ctx context.Context, update client.UpdateResponse,
+	status string) menderError {
+	s.reportUpdate = update
+	s.reportStatus = status
+	return s.reportError
+}
+
+func (s *stateTestController) ReportUpdateStatusAsync(ctx context.Context,
+	update client.UpdateResponse, status string) menderError {
+	s.reportUpdate = update
+	s.reportStatus = status
+	s.asyncReports = append(s.asyncReports, status)
+	return s.asyncReportErr
+}
+
+func (s *stateTestController) ReportUpdateDeferred(ctx context.Context,
+	update client.UpdateResponse, until time.Time, reason string) menderError {
+	s.reportUpdate = update
+	s.reportStatus = client.StatusDeferred
+	s.deferredReports++
+	return s.reportError
+}
+
+func (s *stateTestController) DeferUpdate(update client.UpdateResponse) (time.Time, string) {
+	return s.deferUntil, s.deferReason
+}
+
+func (s *stateTestController) FilterUpdate(update client.UpdateResponse) error {
+	return s.filterErr
+}
+
+func (s *stateTestController) InstallArtifact(update client.UpdateResponse,
+	from io.ReadCloser, size int64) error {
+	return s.InstallUpdate(from, size)
+}
+
+func (s *stateTestController) PayloadVerdict(update client.UpdateResponse) error {
+	return s.payloadErr
+}
+
+func (s *stateTestController) LogPreviousBoot() {
+	s.previousBootLog = true
+}
+
+func (s *stateTestController) SnapshotData(update client.UpdateResponse) {
+	s.dataSnapshot = append(s.dataSnapshot, "snapshot")
+}
+
+func (s *stateTestController) RestoreDataSnapshot(update client.UpdateResponse) {
+	s.dataSnapshot = append(s.dataSnapshot, "restore")
+}
+
+func (s *stateTestController) DropDataSnapshot() {
+	s.dataSnapshot = append(s.dataSnapshot, "drop")
+}
+
+func (s *stateTestController) CleanupCommitted(update client.UpdateResponse) {
+	s.cleanedUp = true
+}
+
+func (s *stateTestController) PendingCommand() *DeviceCommand {
+	cmd := s.command
+	s.command = nil
+	return cmd
+}
+
+func (s *stateTestController) Decommission() menderError {
+	s.decommissioned = true
+	return s.decommissionErr
+}
+
+func (s *stateTestController) ClearQuarantine() menderError {
+	s.unquarantined = true
+	return nil
+}
+
+func (s *stateTestController) EnableDebugLogging(command DeviceCommand) error {
+	s.debugLogging = &command
+	return nil
+}
+
+func (s *stateTestController) HandleRejection() menderError {
+	s.rejected = true
+	return s.rejectionErr
+}
+
+func (s *stateTestController) GetRejectedRetryInterval() time.Duration {
+	return s.rejectedIntvl
+}
+
+func (s *stateTestController) GetRejectedUnauthorizedAttempts() int {
+	if s.unauthorizedMax > 0 {
+		return s.unauthorizedMax
+	}
+	return defaultRejectedUnauthorizedAttempts
+}
+
+func (s *stateTestController) SetUpdateMarker(update client.UpdateResponse, state string) {
+	s.updateMarkers = append(s.updateMarkers, state)
+}
+
+func (s *stateTestController) CommitHolds() []string {
+	return s.commitHolds
+}
+
+func (s *stateTestController) CommitHoldReleased() <-chan struct{} {
+	return s.holdReleased
+}
+
+func (s *stateTestController) GetStateTimeout(state MenderState) time.Duration {
+	return s.stateTimeouts[state]
+}
+
+func (s *stateTestController) GetCommitHoldPolicy() (time.Duration, string) {
+	return s.commitHoldTime, s.commitHoldAct
+}
+
+func (s *stateTestController) ReportUpdateSubState(ctx context.Context,
+	update client.UpdateResponse, status, subState string) menderError {
+	s.reportSubState = subState
+	return s.ReportUpdateStatus(ctx, update, status)
+}
+
+func (s *stateTestController) GetRebootGracePeriod() time.Duration {
+	return s.rebootGrace
+}
+
+func (s *stateTestController) UpdateInhibitors() []string {
+	return s.inhibitors
+}
+
+func (s *stateTestController) GetMaxInhibit() time.Duration {
+	return s.maxInhibit
+}
+
+func (s *stateTestController) NotifyReboot(update client.UpdateResponse, in time.Duration) {
+	s.calls = append(s.calls, "notify-reboot")
+}
+
+func (s *stateTestController) RebootRequired() bool {
+	return !s.appUpdate
+}
+
+func (s *stateTestController) GetRebootMode() string {
+	if s.rebootMode == "" {
+		return rebootModeSelf
+	}
+	return s.rebootMode
+}
+
+func (s *stateTestController) RequestReboot() {
+	s.calls = append(s.calls, "request-reboot")
+}
+
+func (s *stateTestController) CleanupUpdate() error {
+	s.calls = append(s.calls, "cleanup")
+	return s.cleanupErr
+}
+
+func (s *stateTestController) EnableUpdatedPartition() error {
+	s.calls = append(s.calls, "enable-partition")
+	return s.FakeDevice.EnableUpdatedPartition()
+}
+
+func (s *stateTestController) Reboot() error {
+	s.calls = append(s.calls, "reboot")
+	return s.FakeDevice.Reboot()
+}
+
+func (s *stateTestController) UploadLog(ctx context.Context, update client.UpdateResponse,
+	logs []byte) menderError {
+	s.logUpdate = update
+	s.logs = logs
+	return s.logSendingError
+}
+
+func (s *stateTestController) InventoryRefresh(ctx context.Context) error {
+	return s.inventoryErr
+}
+
+func (s *stateTestController) InventorySnapshot() inventorySnapshot {
+	return inventorySnapshot{
+		interval: s.pollIntvl,
+		submit:   s.InventoryRefresh,
+	}
+}
+
+func (s *stateTestController) GetConfigurationPollInterval() time.Duration {
+	return s.configIntvl
+}
+
+func (s *stateTestController) UpdateConfiguration(ctx context.Context) menderError {
+	return s.configErr
+}
+
+type cancellableStateTest struct {
+	BaseState
+}
+
+func (c *cancellableStateTest) StateAfterWait(ctx context.Context, next, same State,
+	wait time.Duration) (State, bool) {
+	log.Debugf("Fake waiting for %f seconds, going from state %s to state %s",
+		wait.Seconds(), same.Id(), next.Id())
+	return next, false
+}
+
+func (c *cancellableStateTest) Wait(ctx context.Context, wait time.Duration) bool {
+	// Time machine into the future!
+	return true
+}
+
+func (c *cancellableStateTest) WaitOrWake(ctx context.Context, wait time.Duration,
+	wake <-chan struct{}) bool {
+	return true
+}
+
+func TestStateBase(t *testing.T) {
+	bs := BaseState{
+		MenderStateInit,
+	}
+
+	assert.Equal(t, MenderStateInit, bs.Id())
+}
+
+func TestStateContext(t *testing.T) {
+	var sc *StateContext
+	assert.NotNil(t, sc.Context())
+	assert.NoError(t, sc.Context().Err())
+
+	sc = &StateContext{}
+	assert.NoError(t, sc.Context().Err())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sc = &StateContext{context: ctx}
+	cancel()
+	assert.Equal(t, context.Canceled, sc.Context().Err())
+}
+
+func TestStateCancellable(t *testing.T) {
+	cs := NewCancellableState(BaseState{
+		id: MenderStateAuthorizeWait,
+	})
+
+	assert.Equal(t, MenderStateAuthorizeWait, cs.Id())
+
+	var s State
+	var c bool
+
+	// no update
+	var tstart, tend time.Time
+
+	tstart = time.Now()
+	s, c = cs.StateAfterWait(context.Background(), bootstrappedState, initState,
+		100*time.Millisecond)
+	tend = time.Now()
+	// not cancelled should return the 'next' state
+	assert.Equal(t, bootstrappedState, s)
+	assert.False(t, c)
+	assert.WithinDuration(t, tend, tstart, 105*time.Millisecond)
+
+	// asynchronously cancel state operation
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		cancel()
+	}()
+	// should finish right away
+	tstart = time.Now()
+	s, c = cs.StateAfterWait(ctx, bootstrappedState, initState,
+		100*time.Millisecond)
+	tend = time.Now()
+	// canceled should return the other state
+	assert.Equal(t, initState, s)
+	assert.True(t, c)
+	assert.WithinDuration(t, tend, tstart, 5*time.Millisecond)
+
+	// same thing again, but calling Wait() now
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		cancel()
+	}()
+	// should finish right away
+	tstart = time.Now()
+	wc := cs.Wait(ctx, 100*time.Millisecond)
+	tend = time.Now()
+	assert.False(t, wc)
+	assert.WithinDuration(t, tend, tstart, 5*time.Millisecond)
+
+	// let wait finish
+	tstart = time.Now()
+	wc = cs.Wait(context.Background(), 100*time.Millisecond)
+	tend = time.Now()
+	assert.True(t, wc)
+	assert.WithinDuration(t, tend, tstart, 105*time.Millisecond)
+}
+
+func TestStateError(t *testing.T) {
+
+	fooerr := NewTransientError(errors.New("foo"))
+
+	es := NewErrorState(fooerr)
+	assert.Equal(t, MenderStateError, es.Id())
+	assert.IsType(t, &ErrorState{}, es)
+	errstate, _ := es.(*ErrorState)
+	assert.NotNil(t, errstate)
+	assert.Equal(t, fooerr, errstate.cause)
+	s, c := es.Handle(nil, &stateTestController{})
+	assert.IsType(t, &InitState{}, s)
+	assert.False(t, c)
+
+	es = NewErrorState(nil)
+	errstate, _ = es.(*ErrorState)
+	assert.NotNil(t, errstate)
+	assert.Contains(t, errstate.cause.Error(), "general error")
+	s, c = es.Handle(nil, &stateTestController{})
+	assert.IsType(t, &FinalState{}, s)
+	assert.False(t, c)
+}
+
+func TestStateUpdateError(t *testing.T) {
+
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	fooerr := NewTransientError(errors.New("foo"))
+
+	es := NewUpdateErrorState(fooerr, update)
+	assert.Equal(t, MenderStateUpdateError, es.Id())
+	assert.IsType(t, &UpdateErrorState{}, es)
+	errstate, _ := es.(*UpdateErrorState)
+	assert.NotNil(t, errstate)
+	assert.Equal(t, fooerr, errstate.cause)
+
+	ms := utils.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+	sc := &stateTestController{}
+	es = NewUpdateErrorState(fooerr, update)
+	s, _ := es.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	// verify that update status report state data is correct
+	usr, _ := s.(*UpdateStatusReportState)
+	assert.Equal(t, client.StatusFailure, usr.status)
+	assert.Equal(t, update, usr.update)
+}
+
+func TestStateUpdateReportStatus(t *testing.T) {
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+
+	ms := utils.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+	sc := &stateTestController{}
+
+	// create directory for storing deployments logs
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+
+	openLogFileWithContent(path.Join(tempDir, "deployments.0001.foobar.log"),
+		`{ "time": "12:12:12", "level": "error", "msg": "log foo" }`)
+	ctx.logManager = NewDeploymentLogManager(tempDir)
+
+	usr := NewUpdateStatusReportState(update, client.StatusFailure)
+	usr.Handle(&ctx, sc)
+	assert.Equal(t, client.StatusFailure, sc.reportStatus)
+	assert.Equal(t, update, sc.reportUpdate)
+
+	assert.NotEmpty(t, sc.logs)
+	assert.JSONEq(t, `{
+	  "messages": [
+	      {
+	          "time": "12:12:12",
+	          "level": "error",
+	          "msg": "log foo"
+	      }
+	   ]}`, string(sc.logs))
+
+	// once error has been reported, state data should be wiped out
+	_, err := ms.ReadAll(stateDataKey)
+	assert.True(t, os.IsNotExist(err))
+
+	sc = &stateTestController{}
+	usr = NewUpdateStatusReportState(update, client.StatusSuccess)
+	usr.Handle(&ctx, sc)
+	assert.Equal(t, client.StatusSuccess, sc.reportStatus)
+	assert.Equal(t, update, sc.reportUpdate)
+	history, err := loadInstallHistory(ms)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, "foobar", history[0].DeploymentID)
+	assert.Equal(t, client.StatusSuccess, history[0].Result)
+	// once error has been reported, state data should be wiped
+	_, err = ms.ReadAll(stateDataKey)
+	assert.True(t, os.IsNotExist(err))
+
+	// cancelled state should not wipe state data, for this pretend the reporting
+	// fails and cancel
+	sc = &stateTestController{
+		pollIntvl:   5 * time.Second,
+		retryIntvl:  1 * time.Second,
+		reportError: NewTransientError(errors.New("report failed")),
+	}
+	usr = NewUpdateStatusReportState(update, client.StatusSuccess)
+	cctx, cancel := context.WithCancel(context.Background())
+	ctx.context = cctx
+	go func() {
+		cancel()
+	}()
+	s, c := usr.Handle(&ctx, sc)
+	// the state was canceled
+	assert.IsType(t, s, &UpdateStatusReportState{})
+	assert.True(t, c)
+	// once error has been reported, state data should be wiped
+	sd, err := LoadStateData(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, update, sd.UpdateInfo)
+	assert.Equal(t, client.StatusSuccess, sd.UpdateStatus)
+	ctx.context = nil
+
+	poll := 5 * time.Millisecond
+	retry := 1 * time.Millisecond
+	now1 := time.Now()
+	// error sending status
+	sc = &stateTestController{
+		pollIntvl:   poll,
+		retryIntvl:  retry,
+		reportError: NewTransientError(errors.New("test error sending status")),
+	}
+	s, c = usr.Handle(&ctx, sc)
+	assert.IsType(t, s, &ReportErrorState{})
+	assert.False(t, c)
+	assert.WithinDuration(t, time.Now(), now1, poll*3)
+	assert.Equal(t, maxSendingAttempts(poll, retry),
+		usr.(*UpdateStatusReportState).triesSendingReport)
+
+	// error sending logs
+	now2 := time.Now()
+	usr = NewUpdateStatusReportState(update, client.StatusFailure)
+	sc = &stateTestController{
+		pollIntvl:       poll,
+		logSendingError: NewTransientError(errors.New("test error sending logs")),
+	}
+	s, c = usr.Handle(&ctx, sc)
+	assert.IsType(t, s, &ReportErrorState{})
+	assert.False(t, c)
+	assert.WithinDuration(t, now2, time.Now(), 3*time.Second)
+
+	// pretend update was aborted at the backend, but was applied
+	// successfully on the device
+	usr = NewUpdateStatusReportState(update, client.StatusSuccess)
+	sc = &stateTestController{
+		reportError: NewFatalError(client.ErrDeploymentAborted),
+	}
+	s, c = usr.Handle(&ctx, sc)
+	assert.IsType(t, s, &ReportErrorState{})
+	assert.Equal(t, client.StatusSuccess, s.(*ReportErrorState).updateStatus)
+
+	// pretend update was aborted at the backend, along with local failure
+	usr = NewUpdateStatusReportState(update, client.StatusFailure)
+	sc = &stateTestController{
+		reportError: NewFatalError(client.ErrDeploymentAborted),
+	}
+	s, c = usr.Handle(&ctx, sc)
+	assert.IsType(t, s, &ReportErrorState{})
+	assert.Equal(t, client.StatusFailure, s.(*ReportErrorState).updateStatus)
+}
+
+func TestStateInit(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	ctx := &StateContext{logManager: NewDeploymentLogManager(tempDir)}
+
+	i := InitState{}
+
+	s, c := i.Handle(ctx, &stateTestController{
+		bootstrapErr: NewFatalError(errors.New("fake err")),
+	})
+	assert.IsType(t, &ErrorState{}, s)
+	assert.False(t, c)
+
+	s, c = i.Handle(ctx, &stateTestController{})
+	assert.IsType(t, &BootstrappedState{}, s)
+	assert.False(t, c)
+}
+
+func TestStateBootstrapped(t *testing.T) {
+	b := BootstrappedState{}
+
+	var s State
+	var c bool
+
+	s, c = b.Handle(nil, &stateTestController{})
+	assert.IsType(t, &AuthorizedState{}, s)
+	assert.False(t, c)
+
+	s, c = b.Handle(nil, &stateTestController{
+		authorize: NewTransientError(errors.New("auth fail temp")),
+	})
+	assert.IsType(t, &AuthorizeWaitState{}, s)
+	assert.False(t, c)
+
+	s, c = b.Handle(nil, &stateTestController{
+		authorize: NewFatalError(errors.New("upgrade err")),
+	})
+	assert.IsType(t, &ErrorState{}, s)
+	assert.False(t, c)
+}
+
+func TestStateAuthorized(t *testing.T) {
+	// create directory for storing deployments logs
+
+	b := AuthorizedState{}
+
+	var s State
+	var c bool
+
+	ms := utils.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+	s, c = b.Handle(&ctx, &stateTestController{
+		hasUpgrade: false,
+	})
+	assert.IsType(t, &InventoryUpdateState{}, s)
+	assert.False(t, c)
+
+	// pretend we have state data
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	update.Artifact.ArtifactName = "fakeid"
+
+	StoreStateData(ms, StateData{
+		Name:       MenderStateReboot,
+		UpdateInfo: update,
+	})
+	// have state data and have correct artifact name
+	s, c = b.Handle(&ctx, &stateTestController{
+		artifactName: "fakeid",
+	})
+	assert.IsType(t, &UpdateVerifyState{}, s)
+	uvs := s.(*UpdateVerifyState)
+	assert.Equal(t, update, uvs.update)
+	assert.False(t, c)
+
+	// error restoring state data
+	ms.Disable(true)
+	s, c = b.Handle(&ctx, &stateTestController{})
+	assert.IsType(t, &UpdateErrorState{}, s)
+	assert.False(t, c)
+	ms.Disable(false)
+
+	// pretend we were trying to report status the last time, first check that
+	// status is failure if UpdateStatus was not set when saving
+	StoreStateData(ms, StateData{
+		Name:       MenderStateUpdateStatusReport,
+		UpdateInfo: update,
+	})
+	s, c = b.Handle(&ctx, &stateTestController{})
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	usr := s.(*UpdateStatusReportState)
+	assert.Equal(t, client.StatusFailure, usr.status)
+	assert.Equal(t, update, usr.update)
+
+	// now pretend we were trying to report success
+	StoreStateData(ms, StateData{
+		Name:         MenderStateUpdateStatusReport,
+		UpdateInfo:   update,
+		UpdateStatus: client.StatusSuccess,
+	})
+	s, c = b.Handle(&ctx, &stateTestController{})
+	assert.IsType(t, &UpdateVerifyState{}, s)
+	ver, _ := s.(*UpdateVerifyState)
+	assert.Equal(t, update, ver.update)
+
+	// pretend last update was interrupted
+	StoreStateData(ms, StateData{
+		Name:       MenderStateUpdateFetch,
+		UpdateInfo: update,
+	})
+	s, c = b.Handle(&ctx, &stateTestController{})
+	assert.IsType(t, &UpdateErrorState{}, s)
+	use, _ := s.(*UpdateErrorState)
+	assert.Equal(t, update, use.update)
+
+	// pretend reading invalid state
+	StoreStateData(ms, StateData{
+		UpdateInfo: update,
+	})
+	s, c = b.Handle(&ctx, &stateTestController{})
+	assert.IsType(t, &UpdateErrorState{}, s)
+	use, _ = s.(*UpdateErrorState)
+	assert.Equal(t, update, use.update)
+}
+
+func TestStateInvetoryUpdate(t *testing.T) {
+	ius := inventoryUpdateState
+	ctx := new(StateContext)
+
+	s, _ := ius.Handle(ctx, &stateTestController{
+		inventoryErr: errors.New("some err"),
+	})
+	assert.IsType(t, &CheckWaitState{}, s)
+
+	s, _ = ius.Handle(ctx, &stateTestController{})
+	assert.IsType(t, &CheckWaitState{}, s)
+}
+
+func TestStateAuthorizeWait(t *testing.T) {
+	cws := NewAuthorizeWaitState()
+
+	var s State
+	var c bool
+	ctx := new(StateContext)
+
+	// no update
+	var tstart, tend time.Time
+
+	tstart = time.Now()
+	s, c = cws.Handle(ctx, &stateTestController{
+		retryIntvl: 100 * time.Millisecond,
+	})
+	tend = time.Now()
+	assert.IsType(t, &BootstrappedState{}, s)
+	assert.False(t, c)
+	assert.WithinDuration(t, tend, tstart, 105*time.Millisecond)
+
+	// asynchronously cancel state operation
+	cctx, cancel := context.WithCancel(context.Background())
+	ctx.context = cctx
+	go func() {
+		cancel()
+	}()
+	// should finish right away
+	tstart = time.Now()
+	s, c = cws.Handle(ctx, &stateTestController{
+		retryIntvl: 100 * time.Millisecond,
+	})
+	tend = time.Now()
+	// canceled state should return itself
+	assert.IsType(t, &AuthorizeWaitState{}, s)
+	assert.True(t, c)
+	assert.WithinDuration(t, tend, tstart, 5*time.Millisecond)
+}
+
+func TestStateRejected(t *testing.T) {
+	store := utils.NewMemStore()
+	ctx := &StateContext{store: store}
+
+	s, c := bootstrappedState.Handle(ctx, &stateTestController{
+		authorize: NewTransientError(client.AuthErrorRejected),
+	})
+	assert.IsType(t, &RejectedState{}, s)
+	assert.False(t, c)
+
+	sc := &stateTestController{rejectedIntvl: 10 * time.Millisecond}
+	tstart := time.Now()
+	s, c = s.Handle(ctx, sc)
+	assert.Equal(t, initState, s)
+	assert.False(t, c)
+	assert.True(t, sc.rejected)
+	assert.True(t, time.Since(tstart) >= 10*time.Millisecond)
+	// wait holds across restarts
+	assert.True(t, loadRetryBackoff(store).AuthNotBefore.After(tstart))
+
+	s, _ = NewRejectedState().Handle(ctx, &stateTestController{
+		rejectionErr: NewFatalError(errors.New("failed")),
+	})
+	assert.IsType(t, &ErrorState{}, s)
+}
+
+func TestStateRejectedUnauthorized(t *testing.T) {
+	store := utils.NewMemStore()
+	ctx := &StateContext{store: store}
+
+	// pending and rejected devices both get 401; taken as rejected only
+	// after enough of them, counting refused API requests too
+	sc := &stateTestController{
+		authorize:       NewTransientError(client.AuthErrorUnauthorized),
+		unauthorizedMax: 3,
+	}
+	s, _ := bootstrappedState.Handle(ctx, sc)
+	assert.Equal(t, authorizeWaitState, s)
+	s, _ = updateCheckState.Handle(ctx, &stateTestController{
+		updateRespErr:   NewTransientError(client.ErrNotAuthorized),
+		unauthorizedMax: 3,
+	})
+	assert.IsType(t, &ErrorState{}, s)
+	assert.Equal(t, 2, loadRetryBackoff(store).Unauthorized)
+	s, _ = bootstrappedState.Handle(ctx, sc)
+	assert.IsType(t, &RejectedState{}, s)
+
+	// count starts over after the long wait
+	s, _ = s.Handle(ctx, &stateTestController{rejectedIntvl: time.Millisecond})
+	assert.Equal(t, initState, s)
+	assert.Equal(t, 0, loadRetryBackoff(store).Unauthorized)
+
+	// and once authorized
+	ctx.retry = retryBackoff{}
+	bootstrappedState.Handle(ctx, sc)
+	assert.Equal(t, 1, ctx.retry.Unauthorized)
+	s, _ = bootstrappedState.Handle(ctx, &stateTestController{})
+	assert.Equal(t, authorizedState, s)
+	assert.Equal(t, retryBackoff{}, loadRetryBackoff(store))
+}
+
+func TestUpdateVerifyState(t *testing.T) {
+	// create directory for storing deployments logs
+
+	// pretend we have state data
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	update.Artifact.ArtifactName = "fakeid"
+
+	uvs := UpdateVerifyState{
+		update: update,
+	}
+
+	// HasUpgrade() failed
+	s, c := uvs.Handle(nil, &stateTestController{
+		hasUpgradeErr: NewFatalError(errors.New("upgrade err")),
+	})
+	assert.IsType(t, &UpdateErrorState{}, s)
+	ues := s.(*UpdateErrorState)
+	assert.Equal(t, update, ues.update)
+	assert.False(t, c)
+
+	// pretend artifact name is different from expected; rollback happened
+	s, c = uvs.Handle(nil, &stateTestController{
+		hasUpgrade:   true,
+		artifactName: "not-fakeid",
+	})
+	assert.IsType(t, &RebootState{}, s)
+	assert.False(t, c)
+
+	// artifact name is as expected; update was successful
+	s, c = uvs.Handle(nil, &stateTestController{
+		hasUpgrade:   true,
+		artifactName: "fakeid",
+	})
+	assert.IsType(t, &UpdateCommitState{}, s)
+	assert.False(t, c)
+
+	// we should continue reporting have upgrade flag is not set
+	s, _ = uvs.Handle(nil, &stateTestController{
+		hasUpgrade:   false,
+		artifactName: "fakeid",
+	})
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+}
+
+func TestStateUpdateCommit(t *testing.T) {
+	// create directory for storing deployments logs
+
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	cs := NewUpdateCommitState(update)
+
+	var s State
+	var c bool
+
+	ms := utils.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+	StoreStateData(ms, StateData{
+		UpdateInfo: update,
+	})
+	// commit without errors
+	sc := &stateTestController{}
+	s, c = cs.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.False(t, c)
+	usr, _ := s.(*UpdateStatusReportState)
+	assert.Equal(t, update, usr.update)
+	assert.Equal(t, client.StatusSuccess, usr.status)
+	assert.Equal(t, []string{updateMarkerCommitted}, sc.updateMarkers)
+	assert.True(t, sc.cleanedUp)
+
+	sc = &stateTestController{
+		FakeDevice: testutils.FakeDevice{
+			RetCommit: NewFatalError(errors.New("commit fail")),
+		},
+	}
+	s, c = cs.Handle(&ctx, sc)
+	assert.IsType(t, s, &RebootState{})
+	assert.False(t, c)
+	assert.False(t, sc.cleanedUp)
+	rs, _ := s.(*RebootState)
+	assert.Equal(t, update, rs.update)
+	assert.Empty(t, sc.updateMarkers)
+}
+
+func TestStateUpdateCommitHold(t *testing.T) {
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	cs := NewUpdateCommitState(update)
+	ctx := StateContext{
+		store: utils.NewMemStore(),
+	}
+
+	// application still migrating
+	sc := &stateTestController{
+		commitHolds:    []string{"db (migrating)"},
+		commitHoldTime: time.Minute,
+		commitHoldAct:  commitHoldRollback,
+	}
+	s, c := cs.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateCommitHoldState{}, s)
+	assert.False(t, c)
+	assert.False(t, ctx.commitHoldStart.IsZero())
+
+	s.(*UpdateCommitHoldState).CancellableState = &cancellableStateTest{BaseState{
+		id: MenderStateUpdateCommitHold,
+	}}
+	s, c = s.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateCommitState{}, s)
+	assert.False(t, c)
+
+	// hold released, commit and tell the server applications decided
+	sc.commitHolds = nil
+	s, c = s.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Equal(t, "commit released by applications", s.(*UpdateStatusReportState).subState)
+	assert.True(t, ctx.commitHoldStart.IsZero())
+
+	s, c = s.Handle(&ctx, sc)
+	assert.Equal(t, client.StatusSuccess, sc.reportStatus)
+	assert.Equal(t, "commit released by applications", sc.reportSubState)
+
+	// hold expired, client rolls back
+	ctx.commitHoldStart = time.Now().Add(-2 * time.Minute)
+	sc.commitHolds = []string{"db (migrating)"}
+	s, c = cs.Handle(&ctx, sc)
+	assert.IsType(t, &RollbackState{}, s)
+	assert.True(t, ctx.commitHoldStart.IsZero())
+
+	// hold expired, client commits
+	ctx.commitHoldStart = time.Now().Add(-2 * time.Minute)
+	sc.commitHoldAct = commitHoldCommit
+	s, c = cs.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Contains(t, s.(*UpdateStatusReportState).subState, "commit decided by client")
+	assert.Equal(t, []string{updateMarkerCommitted, updateMarkerCommitted}, sc.updateMarkers)
+}
+
+func TestStateUpdateCommitHoldWait(t *testing.T) {
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	hs := NewUpdateCommitHoldState(update)
+	ctx := StateContext{
+		commitHoldStart: time.Now(),
+	}
+	sc := &stateTestController{
+		commitHoldTime: time.Hour,
+		holdReleased:   make(chan struct{}, 1),
+	}
+
+	// woken up once the hold is released, not polling for it
+	sc.holdReleased <- struct{}{}
+	tstart := time.Now()
+	s, c := hs.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateCommitState{}, s)
+	assert.False(t, c)
+	assert.WithinDuration(t, tstart, time.Now(), 50*time.Millisecond)
+
+	// hold expired already
+	ctx.commitHoldStart = time.Now().Add(-2 * time.Hour)
+	s, c = hs.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateCommitState{}, s)
+	assert.False(t, c)
+
+	// wakes up once the hold expires
+	ctx.commitHoldStart = time.Now().Add(-time.Hour + 20*time.Millisecond)
+	s, c = hs.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateCommitState{}, s)
+	assert.False(t, c)
+
+	// cancelled
+	cctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ctx.context = cctx
+	ctx.commitHoldStart = time.Now()
+	s, c = hs.Handle(&ctx, sc)
+	assert.Equal(t, hs, s)
+	assert.True(t, c)
+
+	// holds placed through files are checked every now and then
+	oldPoll := commitHoldPollInterval
+	defer func() { commitHoldPollInterval = oldPoll }()
+	commitHoldPollInterval = 10 * time.Millisecond
+	ctx.context = nil
+	tstart = time.Now()
+	s, c = hs.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateCommitState{}, s)
+	assert.False(t, c)
+	assert.WithinDuration(t, tstart, time.Now(), time.Second)
+}
+
+func TestStateUpdateCommitHoldRestart(t *testing.T) {
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	store := utils.NewMemStore()
+	sc := &stateTestController{
+		commitHolds:    []string{"db"},
+		commitHoldTime: time.Minute,
+		commitHoldAct:  commitHoldRollback,
+	}
+	ctx := &StateContext{store: store}
+	s, _ := NewUpdateCommitState(update).Handle(ctx, sc)
+	assert.IsType(t, &UpdateCommitHoldState{}, s)
+	start := ctx.commitHoldStart
+
+	// hold does not start over after restart
+	ctx = &StateContext{store: store}
+	assert.Equal(t, start.UnixNano(), ctx.startCommitHold(time.Now().Add(time.Hour)).UnixNano())
+
+	// nor is release missed
+	ctx = &StateContext{store: store}
+	sc.commitHolds = nil
+	s, _ = NewUpdateCommitState(update).Handle(ctx, sc)
+	assert.Equal(t, "commit released by applications", s.(*UpdateStatusReportState).subState)
+	_, err := store.ReadAll(commitHoldStartName)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStateUpdateVerify(t *testing.T) {
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	update.Artifact.ArtifactName = "fooid"
+	vs := NewUpdateVerifyState(update)
+	ctx := StateContext{
+		store: utils.NewMemStore(),
+	}
+
+	// booted into the new artifact
+	sc := &stateTestController{
+		hasUpgrade:   true,
+		artifactName: "fooid",
+	}
+	s, c := vs.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateCommitState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, []string{updateMarkerUncommitted}, sc.updateMarkers)
+
+	// running the old artifact
+	sc = &stateTestController{
+		hasUpgrade:   true,
+		artifactName: "barid",
+	}
+	s, c = vs.Handle(&ctx, sc)
+	assert.IsType(t, &RebootState{}, s)
+	assert.Empty(t, sc.updateMarkers)
+	assert.False(t, sc.previousBootLog)
+
+	// rolled back
+	sc = &stateTestController{}
+	s, c = vs.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Equal(t, []string{updateMarkerRolledBack}, sc.updateMarkers)
+	assert.True(t, sc.previousBootLog)
+}
+
+func TestStateUpdateCheckWait(t *testing.T) {
+	cws := NewCheckWaitState()
+	ctx := new(StateContext)
+
+	// no update
+	var tstart, tend time.Time
+
+	tstart = time.Now()
+	s, c := cws.Handle(ctx, &stateTestController{
+		pollIntvl: 100 * time.Millisecond,
+	})
+	tend = time.Now()
+	ctx.lastInventoryUpdate = tend
+	ctx.lastUpdateCheck = tend
+	assert.IsType(t, &UpdateCheckState{}, s)
+	assert.False(t, c)
+	assert.WithinDuration(t, tend, tstart, 105*time.Millisecond)
+
+	// asynchronously cancel state operation
+	cctx, cancel := context.WithCancel(context.Background())
+	ctx.context = cctx
+	go func() {
+		cancel()
+	}()
+	// should finish right away
+	tstart = time.Now()
+	s, c = cws.Handle(ctx, &stateTestController{
+		pollIntvl: 100 * time.Millisecond,
+	})
+	tend = time.Now()
+	// canceled state should return itself
+	assert.IsType(t, &CheckWaitState{}, s)
+	assert.True(t, c)
+	assert.WithinDuration(t, tend, tstart, 5*time.Millisecond)
+}
+
+func TestStateCheckWaitCoalesce(t *testing.T) {
+	cws := NewCheckWaitState()
+	now := time.Now()
+	ctx := &StateContext{
+		lastUpdateCheck:     now,
+		lastInventoryUpdate: now.Add(-10 * time.Millisecond),
+	}
+
+	// inventory is due first, but waits for the update check due right
+	// after it, both run on a single wakeup
+	tc := &stateTestController{
+		pollIntvl: time.Second,
+	}
+	s, _ := cws.Handle(ctx, tc)
+	assert.IsType(t, &InventoryUpdateState{}, s)
+	assert.False(t, time.Now().Before(now.Add(time.Second)))
+	ctx.lastInventoryUpdate = time.Now()
+
+	tstart := time.Now()
+	s, _ = cws.Handle(ctx, tc)
+	assert.IsType(t, &UpdateCheckState{}, s)
+	assert.WithinDuration(t, tstart, time.Now(), 5*time.Millisecond)
+
+	// token refresh is not delayed
+	ctx.lastUpdateCheck = time.Now()
+	ctx.lastInventoryUpdate = time.Now().Add(-50 * time.Millisecond)
+	tc.authRefresh = time.Now().Add(time.Second - 40*time.Millisecond)
+	tstart = time.Now()
+	s, _ = cws.Handle(ctx, tc)
+	assert.IsType(t, &InventoryUpdateState{}, s)
+	assert.True(t, time.Now().Before(tstart.Add(time.Second-30*time.Millisecond)))
+}
+
+func TestStateUpdateCheck(t *testing.T) {
+	cs := UpdateCheckState{}
+	ctx := new(StateContext)
+
+	var s State
+	var c bool
+
+	// no update
+	s, c = cs.Handle(ctx, &stateTestController{})
+	assert.IsType(t, &CheckWaitState{}, s)
+	assert.False(t, c)
+
+	// pretend update check failed
+	s, c = cs.Handle(ctx, &stateTestController{
+		updateRespErr: NewTransientError(errors.New("check failed")),
+	})
+	assert.IsType(t, &ErrorState{}, s)
+	assert.False(t, c)
+
+	// deployments API failing on the server side does not restart the
+	// client, inventory keeps being reported
+	s, c = cs.Handle(ctx, &stateTestController{
+		updateRespErr: NewTransientError(
+			&client.HTTPError{StatusCode: http.StatusInternalServerError}),
+	})
+	assert.IsType(t, &CheckWaitState{}, s)
+	assert.False(t, c)
+
+	// pretend we have an update
+	update := &client.UpdateResponse{}
+
+	s, c = cs.Handle(ctx, &stateTestController{
+		updateResp: update,
+	})
+	assert.IsType(t, &UpdateFetchState{}, s)
+	assert.False(t, c)
+	ufs, _ := s.(*UpdateFetchState)
+	assert.Equal(t, *update, ufs.update)
+}
+
+func TestStateUpdateCheckFiltered(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	ctx := &StateContext{logManager: NewDeploymentLogManager(tempDir)}
+	defer ctx.logManager.Disable()
+
+	cs := UpdateCheckState{}
+	update := &client.UpdateResponse{ID: "foo"}
+
+	// update rejected by artifact filter is reported as failed right away,
+	// without being fetched or deferred
+	s, c := cs.Handle(ctx, &stateTestController{
+		updateResp: update,
+		deferUntil: time.Now().Add(time.Hour),
+		filterErr:  ErrArtifactRejected,
+	})
+	assert.IsType(t, &UpdateErrorState{}, s)
+	assert.False(t, c)
+	ues, _ := s.(*UpdateErrorState)
+	assert.Equal(t, *update, ues.update)
+	assert.True(t, ues.cause.IsFatal())
+
+	// rejection reason goes to the deployment log
+	assert.True(t, ctx.logManager.loggingEnabled)
+	assert.Equal(t, "foo", ctx.logManager.deploymentID)
+}
+
+func TestStateUpdateDeferred(t *testing.T) {
+	ctx := new(StateContext)
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	until := time.Now().Add(time.Hour)
+	sc := &stateTestController{
+		updateResp:  &update,
+		deferUntil:  until,
+		deferReason: "battery low",
+	}
+
+	// policy defers the update
+	s, c := updateCheckState.Handle(ctx, sc)
+	assert.IsType(t, &UpdateDeferredState{}, s)
+	assert.False(t, c)
+	uds, _ := s.(*UpdateDeferredState)
+	assert.Equal(t, update, uds.update)
+	assert.Equal(t, until, uds.until)
+	assert.Equal(t, "battery low", uds.reason)
+
+	// deferral is reported and remembered
+	s, c = uds.Handle(ctx, sc)
+	assert.Equal(t, checkWaitState, s)
+	assert.False(t, c)
+	assert.Equal(t, until, ctx.deferredUntil)
+	assert.Equal(t, client.StatusDeferred, sc.reportStatus)
+	assert.Equal(t, 1, sc.deferredReports)
+
+	// same deferral is not reported again
+	s, _ = updateCheckState.Handle(ctx, sc)
+	s, _ = s.Handle(ctx, sc)
+	assert.Equal(t, checkWaitState, s)
+	assert.Equal(t, 1, sc.deferredReports)
+
+	// failed report is retried
+	sc.deferUntil = until.Add(time.Hour)
+	sc.reportError = NewTransientError(errors.New("report failed"))
+	s, _ = updateCheckState.Handle(ctx, sc)
+	s, _ = s.Handle(ctx, sc)
+	assert.Equal(t, checkWaitState, s)
+	assert.Equal(t, 2, sc.deferredReports)
+	sc.reportError = nil
+	s, _ = updateCheckState.Handle(ctx, sc)
+	s, _ = s.Handle(ctx, sc)
+	assert.Equal(t, 3, sc.deferredReports)
+
+	// update check happens right when deferral expires, even if regular
+	// check is not due yet
+	sc.pollIntvl = 24 * time.Hour
+	ctx.lastUpdateCheck = time.Now()
+	ctx.lastInventoryUpdate = time.Now()
+	ctx.deferredUntil = time.Now().Add(-time.Second)
+	s, c = checkWaitState.Handle(ctx, sc)
+	assert.Equal(t, updateCheckState, s)
+	assert.False(t, c)
+
+	// policy lets the update through
+	sc.deferUntil = time.Time{}
+	s, _ = updateCheckState.Handle(ctx, sc)
+	assert.IsType(t, &UpdateFetchState{}, s)
+	assert.True(t, ctx.deferredUntil.IsZero())
+	assert.Equal(t, "", ctx.lastDeferral)
+}
+
+func TestStateDeviceCommand(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	ctx := &StateContext{logManager: NewDeploymentLogManager(tempDir)}
+
+	// command received with update check
+	sc := &stateTestController{
+		command: &DeviceCommand{
+			ID:   "cmd-1",
+			Name: CommandCheckUpdate,
+		},
+	}
+	s, c := updateCheckState.Handle(ctx, sc)
+	assert.IsType(t, &DeviceCommandState{}, s)
+	assert.False(t, c)
+
+	// check update right away
+	s, c = s.Handle(ctx, sc)
+	assert.Equal(t, updateCheckState, s)
+	assert.False(t, c)
+
+	// reboot
+	s, _ = NewDeviceCommandState(DeviceCommand{Name: CommandReboot}).Handle(ctx, sc)
+	assert.Equal(t, doneState, s)
+	sc.RetReboot = errors.New("reboot failed")
+	s, _ = NewDeviceCommandState(DeviceCommand{Name: CommandReboot}).Handle(ctx, sc)
+	assert.Equal(t, checkWaitState, s)
+
+	// decommission
+	s, _ = NewDeviceCommandState(DeviceCommand{Name: CommandDecommission}).Handle(ctx, sc)
+	assert.Equal(t, initState, s)
+	assert.True(t, sc.decommissioned)
+	sc.decommissionErr = NewFatalError(errors.New("failed"))
+	s, _ = NewDeviceCommandState(DeviceCommand{Name: CommandDecommission}).Handle(ctx, sc)
+	assert.IsType(t, &ErrorState{}, s)
+
+	// collect logs
+	ctx.logManager.Enable("deployment-1")
+	ctx.logManager.WriteLog([]byte(`{"msg":"foo"}`))
+	ctx.logManager.Disable()
+	s, _ = NewDeviceCommandState(DeviceCommand{
+		Name:         CommandCollectLogs,
+		DeploymentID: "deployment-1",
+	}).Handle(ctx, sc)
+	assert.Equal(t, checkWaitState, s)
+	assert.Equal(t, "deployment-1", sc.logUpdate.ID)
+	assert.NotEmpty(t, sc.logs)
+
+	// debug logging
+	s, _ = NewDeviceCommandState(DeviceCommand{
+		Name:     CommandDebugLogging,
+		APITrace: true,
+	}).Handle(ctx, sc)
+	assert.Equal(t, checkWaitState, s)
+	if assert.NotNil(t, sc.debugLogging) {
+		assert.True(t, sc.debugLogging.APITrace)
+	}
+}
+
+func TestUpdateCheckSameImage(t *testing.T) {
+	cs := UpdateCheckState{}
+	ctx := new(StateContext)
+
+	var s State
+	var c bool
+
+	// pretend we have an update
+	update := &client.UpdateResponse{
+		ID: "my-id",
+	}
+
+	s, c = cs.Handle(ctx, &stateTestController{
+		updateResp:    update,
+		updateRespErr: NewTransientError(os.ErrExist),
+	})
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.False(t, c)
+	urs, _ := s.(*UpdateStatusReportState)
+	assert.Equal(t, *update, urs.update)
+	assert.Equal(t, client.StatusAlreadyInstalled, urs.status)
+}
+
+func TestStateUpdateFetch(t *testing.T) {
+	// create directory for storing deployments logs
+
+	// pretend we have an update
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	cs := NewUpdateFetchState(update)
+
+	ms := utils.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+
+	// can not store state data
+	ms.ReadOnly(true)
+	s, c := cs.Handle(&ctx, &stateTestController{})
+	assert.IsType(t, &UpdateErrorState{}, s)
+	assert.False(t, c)
+	ms.ReadOnly(false)
+
+	data := "test"
+	stream := ioutil.NopCloser(bytes.NewBufferString(data))
+
+	sc := &stateTestController{
+		updater: testutils.FakeUpdater{
+			FetchUpdateReturnReadCloser: stream,
+			FetchUpdateReturnSize:       int64(len(data)),
+		},
+	}
+	s, c = cs.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateInstallState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, client.StatusDownloading, sc.reportStatus)
+	assert.Equal(t, update, sc.reportUpdate)
+	// progress is reported in the background
+	assert.Equal(t, []string{client.StatusDownloading}, sc.asyncReports)
+
+	ud, err := LoadStateData(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, StateData{
+		Version:    stateDataVersion,
+		UpdateInfo: update,
+		Name:       MenderStateUpdateFetch,
+	}, ud)
+
+	history, err := loadInstallHistory(ms)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, client.StatusDownloading, history[0].Result)
+
+	uis, _ := s.(*UpdateInstallState)
+	assert.Equal(t, stream, uis.imagein)
+	assert.Equal(t, int64(len(data)), uis.size)
+
+	ms.ReadOnly(true)
+	// pretend writing update state data fails
+	sc = &stateTestController{}
+	s, c = uis.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateErrorState{}, s)
+	ms.ReadOnly(false)
+
+	// pretend update was aborted
+	sc = &stateTestController{
+		reportError: NewFatalError(client.ErrDeploymentAborted),
+	}
+	s, c = uis.Handle(&ctx, sc)
+	// partially written partition is cleaned up first
+	assert.IsType(t, &UpdateCleanupState{}, s)
+	ucs := s.(*UpdateCleanupState)
+	assert.False(t, ucs.cause.IsFatal())
+}
+
+func TestStateUpdateCleanup(t *testing.T) {
+	ms := utils.NewMemStore()
+	ctx := StateContext{store: ms}
+	update := client.UpdateResponse{ID: "foo"}
+	cause := NewTransientError(errors.New("install failed"))
+
+	sc := &stateTestController{}
+	s, c := NewUpdateCleanupState(update, cause).Handle(&ctx, sc)
+	assert.False(t, c)
+	assert.Equal(t, []string{"cleanup"}, sc.calls)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Equal(t, client.StatusFailure, s.(*UpdateStatusReportState).status)
+
+	// resumed after restart
+	sd, err := LoadStateData(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, MenderStateUpdateCleanup, sd.Name)
+	s, _ = authorizedState.Handle(&ctx, &stateTestController{})
+	assert.IsType(t, &UpdateCleanupState{}, s)
+
+	// so is install interrupted by power loss
+	StoreStateData(ms, StateData{Name: MenderStateUpdateInstall,
+		UpdateInfo: update})
+	s, _ = authorizedState.Handle(&ctx, &stateTestController{})
+	assert.IsType(t, &UpdateCleanupState{}, s)
+	assert.Equal(t, update, s.(*UpdateCleanupState).update)
+
+	// failed cleanup is retried after a while, then given up
+	sc = &stateTestController{cleanupErr: errors.New("I/O error")}
+	cs := NewUpdateCleanupState(update, cause).(*UpdateCleanupState)
+	ctx.timerAcceleration = cleanupRetryInterval / time.Millisecond
+	for i := 1; i < maxCleanupTries; i++ {
+		s, c = cs.Handle(&ctx, sc)
+		assert.Equal(t, cs, s)
+		assert.False(t, c)
+	}
+	s, _ = cs.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Len(t, sc.calls, maxCleanupTries)
+
+	// install which failed for good is cleaned up; failed fetch is not
+	gone := client.NewHTTPError(&http.Response{StatusCode: http.StatusNotFound},
+		"fetch")
+	fir := NewFetchInstallRetryState(NewUpdateInstallState(nil, 0, update),
+		update, gone)
+	s, _ = fir.Handle(&ctx, &stateTestController{})
+	assert.IsType(t, &UpdateCleanupState{}, s)
+	fir = NewFetchInstallRetryState(NewUpdateFetchState(update),
+		update, gone)
+	s, _ = fir.Handle(&ctx, &stateTestController{})
+	assert.IsType(t, &UpdateErrorState{}, s)
+}
+
+func TestRetryIntervalCalculation(t *testing.T) {
+	// Test with one minute maximum interval.
+	intvl, err := getFetchInstallRetry(0, 1*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, intvl, 1*time.Minute)
+
+	intvl, err = getFetchInstallRetry(1, 1*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, intvl, 1*time.Minute)
+
+	intvl, err = getFetchInstallRetry(2, 1*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, intvl, 1*time.Minute)
+
+	intvl, err = getFetchInstallRetry(3, 1*time.Minute)
+	assert.Error(t, err)
+
+	intvl, err = getFetchInstallRetry(7, 1*time.Minute)
+	assert.Error(t, err)
+
+	// Test with two minute maximum interval.
+	intvl, err = getFetchInstallRetry(5, 2*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, intvl, 2*time.Minute)
+
+	intvl, err = getFetchInstallRetry(6, 2*time.Minute)
+	assert.Error(t, err)
+
+	// Test with 10 minute maximum interval.
+	intvl, err = getFetchInstallRetry(11, 10*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, intvl, 8*time.Minute)
+
+	intvl, err = getFetchInstallRetry(12, 10*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, intvl, 10*time.Minute)
+
+	intvl, err = getFetchInstallRetry(14, 10*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, intvl, 10*time.Minute)
+
+	intvl, err = getFetchInstallRetry(15, 10*time.Minute)
+	assert.Error(t, err)
+
+	// Test with one second maximum interval.
+	intvl, err = getFetchInstallRetry(0, 1*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, intvl, 1*time.Minute)
+
+	intvl, err = getFetchInstallRetry(1, 1*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, intvl, 1*time.Minute)
+
+	intvl, err = getFetchInstallRetry(2, 1*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, intvl, 1*time.Minute)
+
+	intvl, err = getFetchInstallRetry(3, 1*time.Second)
+	assert.Error(t, err)
+}
+
+func TestRetryIntervalForError(t *testing.T) {
+	httpErr := func(code int, retryAfter string) error {
+		rsp := &http.Response{StatusCode: code, Header: http.Header{}}
+		rsp.Header.Set("Retry-After", retryAfter)
+		return client.NewHTTPError(rsp, "fetch failed")
+	}
+
+	// regular transient errors follow the usual ladder
+	intvl, err := getFetchInstallRetryForError(errors.New("connection reset"),
+		11, 10*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 8*time.Minute, intvl)
+
+	// artifact is gone
+	_, err = getFetchInstallRetryForError(httpErr(http.StatusNotFound, ""),
+		0, 10*time.Minute)
+	assert.Error(t, err)
+
+	// server asks to wait longer than the ladder would
+	intvl, err = getFetchInstallRetryForError(
+		NewTransientError(httpErr(http.StatusServiceUnavailable, "600")),
+		0, 10*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, intvl)
+
+	intvl, err = getFetchInstallRetryForError(
+		httpErr(http.StatusTooManyRequests, "10"), 0, 10*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 1*time.Minute, intvl)
+
+	_, err = getFetchInstallRetryForError(
+		httpErr(http.StatusTooManyRequests, "600"), 15, 10*time.Minute)
+	assert.Error(t, err)
+
+	// TLS errors are retried at regular interval, just a few times
+	tlsErr := x509.UnknownAuthorityError{}
+	intvl, err = getFetchInstallRetryForError(tlsErr, 0, 10*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, intvl)
+
+	intvl, err = getFetchInstallRetryForError(tlsErr, 2, 1*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, 1*time.Minute, intvl)
+
+	_, err = getFetchInstallRetryForError(tlsErr, 3, 10*time.Minute)
+	assert.Error(t, err)
+
+	// name resolution failures are retried every minute, for a while
+	dnsErr := NewTransientError(&url.Error{Op: "Get", URL: "https://mender.io",
+		Err: &net.OpError{Op: "dial",
+			Err: &net.DNSError{Err: "no such host", Name: "mender.io"}}})
+	intvl, err = getFetchInstallRetryForError(dnsErr, 0, 30*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 1*time.Minute, intvl)
+
+	intvl, err = getFetchInstallRetryForError(dnsErr, maxDNSRetries-1, 30*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 1*time.Minute, intvl)
+
+	_, err = getFetchInstallRetryForError(dnsErr, maxDNSRetries, 30*time.Minute)
+	assert.Error(t, err)
+}
+
+func TestStateUpdateFetchRejected(t *testing.T) {
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	cs := NewUpdateFetchState(update)
+	ctx := StateContext{
+		store: utils.NewMemStore(),
+	}
+	stc := stateTestController{
+		updater: testutils.FakeUpdater{
+			FetchUpdateReturnError: client.NewHTTPError(
+				&http.Response{StatusCode: http.StatusNotFound}, "fetch failed"),
+		},
+		pollIntvl: 5 * time.Minute,
+	}
+
+	s, c := cs.Handle(&ctx, &stc)
+	assert.IsType(t, &FetchInstallRetryState{}, s)
+	assert.False(t, c)
+
+	// no waiting, the update fails right away
+	s, c = s.Handle(&ctx, &stc)
+	assert.IsType(t, &UpdateErrorState{}, s)
+	assert.False(t, c)
+	assert.True(t, s.(*UpdateErrorState).cause.IsFatal())
+}
+
+func TestStateUpdateFetchVerifyHeader(t *testing.T) {
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	cs := NewUpdateFetchState(update)
+	ctx := StateContext{
+		store: utils.NewMemStore(),
+	}
+
+	// incompatible artifact, no point in retrying
+	sc := &stateTestController{
+		verifyHeaderErr: NewFatalError(errors.New("wrong device type")),
+	}
+	s, c := cs.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateErrorState{}, s)
+	assert.False(t, c)
+
+	// header could not be fetched
+	sc = &stateTestController{
+		verifyHeaderErr: NewTransientError(errors.New("connection reset")),
+	}
+	s, c = cs.Handle(&ctx, sc)
+	assert.IsType(t, &FetchInstallRetryState{}, s)
+	assert.False(t, c)
+}
+
+func TestStateUpdateFetchRevalidate(t *testing.T) {
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	cs := NewUpdateFetchState(update)
+	ctx := StateContext{
+		store: utils.NewMemStore(),
+	}
+
+	// deployment aborted meanwhile, nothing is downloaded
+	sc := &stateTestController{
+		revalidateErr: NewFatalError(ErrDeploymentRevoked),
+	}
+	s, c := cs.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateErrorState{}, s)
+	assert.False(t, c)
+	assert.Empty(t, sc.asyncReports)
+
+	// server could not be asked
+	sc = &stateTestController{
+		revalidateErr: NewTransientError(errors.New("connection reset")),
+	}
+	s, c = cs.Handle(&ctx, sc)
+	assert.IsType(t, &FetchInstallRetryState{}, s)
+	assert.False(t, c)
+}
+
+func TestStateUpdateFetchArtifactCheck(t *testing.T) {
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	update.Artifact.Source.URI = "https://artifacts/foobar?sig=1"
+	ms := utils.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+
+	// artifact gone, nothing is downloaded
+	sc := &stateTestController{
+		artifactErr: NewFatalError(client.ErrArtifactGone),
+	}
+	s, c := NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateErrorState{}, s)
+	assert.False(t, c)
+	assert.Empty(t, sc.asyncReports)
+
+	// availability could not be checked
+	sc = &stateTestController{
+		artifactErr: NewTransientError(errors.New("connection reset")),
+	}
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &FetchInstallRetryState{}, s)
+
+	// expired URL refreshed, and kept for resuming after restart
+	refreshed := update
+	refreshed.Artifact.Source.URI = "https://artifacts/foobar?sig=2"
+	sc = &stateTestController{
+		refreshedUpdate: &refreshed,
+	}
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateInstallState{}, s)
+	assert.Equal(t, refreshed, s.(*UpdateInstallState).update)
+	sd, err := LoadStateData(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, refreshed.URI(), sd.UpdateInfo.URI())
+}
+
+func TestStateUpdateFetchRetry(t *testing.T) {
+	// pretend we have an update
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+	cs := NewUpdateFetchState(update)
+	ms := utils.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+	stc := stateTestController{
+		updater: testutils.FakeUpdater{
+			FetchUpdateReturnError: NewTransientError(errors.New("fetch failed")),
+		},
+		pollIntvl: 5 * time.Minute,
+	}
+
+	// pretend update check failed
+	s, c := cs.Handle(&ctx, &stc)
+	assert.IsType(t, &FetchInstallRetryState{}, s)
+	assert.False(t, c)
+
+	// Test for the twelve expected attempts:
+	// (1m*3) + (2m*3) + (4m*3) + (5m*3)
+	for i := 0; i < 12; i++ {
+		s.(*FetchInstallRetryState).CancellableState = &cancellableStateTest{BaseState{
+			id: MenderStateCheckWait,
+		}}
+
+		s, c = s.Handle(&ctx, &stc)
+		assert.IsType(t, &UpdateFetchState{}, s)
+		assert.False(t, c)
+
+		s, c = s.Handle(&ctx, &stc)
+		assert.IsType(t, &FetchInstallRetryState{}, s)
+		assert.False(t, c)
+	}
+
+	// Final attempt should fail completely.
+	s.(*FetchInstallRetryState).CancellableState = &cancellableStateTest{BaseState{
+		id: MenderStateCheckWait,
+	}}
+
+	s, c = s.Handle(&ctx, &stc)
+	assert.IsType(t, &ErrorState{}, s)
+	assert.False(t, c)
+
+	s, c = s.Handle(&ctx, &stc)
+	assert.IsType(t, &InitState{}, s)
+	assert.False(t, c)
+}
+
+func TestStateUpdateInstall(t *testing.T) {
+	// create directory for storing deployments logs
+
+	data := "test"
+	stream := ioutil.NopCloser(bytes.NewBufferString(data))
+
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	uis := NewUpdateInstallState(stream, int64(len(data)), update)
+
+	ms := utils.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+
+	ms.ReadOnly(true)
+	// pretend writing update state data fails
+	sc := &stateTestController{}
+	s, c := uis.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateErrorState{}, s)
+	ms.ReadOnly(false)
+
+	sc = &stateTestController{}
+	s, c = uis.Handle(&ctx, sc)
+	assert.IsType(t, &RebootState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, client.StatusInstalling, sc.reportStatus)
+	// installing reported in the background before install, and once done
+	assert.Equal(t, []string{client.StatusInstalling}, sc.asyncReports)
+
+	ud, err := LoadStateData(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, StateData{
+		Version:    stateDataVersion,
+		UpdateInfo: update,
+		Name:       MenderStateUpdateInstall,
+	}, ud)
+
+	// pretend update was aborted
+	sc = &stateTestController{
+		reportError: NewFatalError(client.ErrDeploymentAborted),
+	}
+	s, c = uis.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateCleanupState{}, s)
+	ucs := s.(*UpdateCleanupState)
+	assert.False(t, ucs.cause.IsFatal())
+
+	// aborted while downloading, found out by background report
+	sc = &stateTestController{
+		asyncReportErr: NewFatalError(client.ErrDeploymentAborted),
+	}
+	s, _ = uis.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateCleanupState{}, s)
+	assert.Equal(t, client.ErrDeploymentAborted, s.(*UpdateCleanupState).cause.Cause())
+	assert.Empty(t, sc.calls)
+
+	// payload rejected by scanner; never enabled, nor retried
+	ctx.fetchInstallAttempts = 2
+	sc = &stateTestController{
+		payloadErr: ErrPayloadRejected,
+	}
+	s, c = uis.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateCleanupState{}, s)
+	ucs = s.(*UpdateCleanupState)
+	assert.True(t, ucs.cause.IsFatal())
+	assert.Equal(t, ErrPayloadRejected, ucs.cause.Cause())
+	assert.Empty(t, sc.calls)
+	assert.Equal(t, 0, ctx.fetchInstallAttempts)
+}
+
+func TestStateAppSlotUpdate(t *testing.T) {
+	data := "app"
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	ms := utils.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+
+	// application-only update needs no reboot, goes straight to commit
+	uis := NewUpdateInstallState(ioutil.NopCloser(bytes.NewBufferString(data)),
+		int64(len(data)), update)
+	sc := &stateTestController{appUpdate: true}
+	s, c := uis.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateCommitState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, []string{updateMarkerUncommitted}, sc.updateMarkers)
+
+	ud, err := LoadStateData(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, MenderStateUpdateCommit, ud.Name)
+
+	// client restarted while waiting for commit
+	s, _ = (&AuthorizedState{}).Handle(&ctx, &stateTestController{
+		appUpdate:  true,
+		hasUpgrade: true,
+	})
+	assert.IsType(t, &UpdateCommitState{}, s)
+	s, _ = (&AuthorizedState{}).Handle(&ctx, &stateTestController{})
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Equal(t, client.StatusFailure, s.(*UpdateStatusReportState).status)
+
+	// failed commit rolls back
+	s, _ = NewUpdateCommitState(update).Handle(&ctx, &stateTestController{
+		appUpdate: true,
+		FakeDevice: testutils.FakeDevice{
+			RetCommit: errors.New("commit failed"),
+		},
+	})
+	assert.IsType(t, &RollbackState{}, s)
+
+	// rollback without reboot
+	s, _ = NewRollbackState(update).Handle(&ctx, &stateTestController{appUpdate: true})
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Equal(t, client.StatusFailure, s.(*UpdateStatusReportState).status)
+}
+
+func TestStateUpdateInstallRetry(t *testing.T) {
+	// create directory for storing deployments logs
+
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	data := "test"
+	stream := ioutil.NopCloser(bytes.NewBufferString(data))
+	uis := NewUpdateInstallState(stream, int64(len(data)), update)
+	ms := utils.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+	stc := stateTestController{
+		FakeDevice: testutils.FakeDevice{
+			RetInstallUpdate: NewFatalError(errors.New("install failed")),
+		},
+		pollIntvl: 5 * time.Minute,
+	}
+
+	// pretend update check failed
+	s, c := uis.Handle(&ctx, &stc)
+	assert.IsType(t, &FetchInstallRetryState{}, s)
+	assert.False(t, c)
+
+	// Test for the twelve expected attempts:
+	// (1m*3) + (2m*3) + (4m*3) + (5m*3)
+	for i := 0; i < 12; i++ {
+		s.(*FetchInstallRetryState).CancellableState = &cancellableStateTest{BaseState{
+			id: MenderStateCheckWait,
+		}}
+
+		s, c = s.Handle(&ctx, &stc)
+		assert.IsType(t, &UpdateFetchState{}, s)
+		assert.False(t, c)
+
+		s, c = s.Handle(&ctx, &stc)
+		assert.IsType(t, &UpdateInstallState{}, s)
+		assert.False(t, c)
+
+		// Reset data stream to something that can be closed.
+		stream = ioutil.NopCloser(bytes.NewBufferString(data))
+		s.(*UpdateInstallState).imagein = stream
+
+		s, c = s.Handle(&ctx, &stc)
+		assert.IsType(t, &FetchInstallRetryState{}, s)
+		assert.False(t, c)
+	}
+
+	// Final attempt should fail completely.
+	s.(*FetchInstallRetryState).CancellableState = &cancellableStateTest{BaseState{
+		id: MenderStateCheckWait,
+	}}
+
+	// partially written partition is cleaned up and the failure reported
+	s, c = s.Handle(&ctx, &stc)
+	assert.IsType(t, &UpdateCleanupState{}, s)
+	assert.False(t, c)
+
+	s, c = s.Handle(&ctx, &stc)
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Equal(t, client.StatusFailure, s.(*UpdateStatusReportState).status)
+	assert.False(t, c)
+}
+
+func TestStateReboot(t *testing.T) {
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	rs := NewRebootState(update)
+
+	// create directory for storing deployments logs
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+
+	oldBootIDFile := bootIDFile
+	bootIDFile = path.Join(tempDir, "boot_id")
+	defer func() { bootIDFile = oldBootIDFile }()
+	ioutil.WriteFile(bootIDFile, []byte("boot-1\n"), 0644)
+
+	ms := utils.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+	s, c := rs.Handle(&ctx, &stateTestController{
+		FakeDevice: testutils.FakeDevice{
+			RetReboot: NewFatalError(errors.New("reboot failed")),
+		}})
+	assert.IsType(t, &ErrorState{}, s)
+	assert.False(t, c)
+
+	sc := &stateTestController{}
+	s, c = rs.Handle(&ctx, sc)
+	assert.IsType(t, &FinalState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, client.StatusRebooting, sc.reportStatus)
+	ud, err := LoadStateData(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, StateData{
+		Version:      stateDataVersion,
+		UpdateInfo:   update,
+		Name:         MenderStateReboot,
+		RebootBootID: "boot-1",
+	}, ud)
+
+	ms.ReadOnly(true)
+	// reboot will be performed regardless of failures to write update state data
+	s, c = rs.Handle(&ctx, sc)
+	assert.IsType(t, &FinalState{}, s)
+	assert.False(t, c)
+
+	// pretend update was aborted
+	sc = &stateTestController{
+		reportError: NewFatalError(client.ErrDeploymentAborted),
+	}
+	s, c = rs.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateErrorState{}, s)
+	ues := s.(*UpdateErrorState)
+	assert.False(t, ues.IsFatal())
+}
+
+func TestStateRebootStatusPending(t *testing.T) {
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+
+	oldBootIDFile := bootIDFile
+	bootIDFile = path.Join(tempDir, "boot_id")
+	defer func() { bootIDFile = oldBootIDFile }()
+	ioutil.WriteFile(bootIDFile, []byte("boot-1\n"), 0644)
+
+	ms := utils.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+
+	// rebooting status is not acknowledged, device reboots anyway
+	sc := &stateTestController{
+		reportError: NewTransientError(errors.New("connection reset")),
+	}
+	s, _ := NewRebootState(update).Handle(&ctx, sc)
+	assert.IsType(t, &FinalState{}, s)
+	ud, err := LoadStateData(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, StateData{
+		Version:      stateDataVersion,
+		UpdateInfo:   update,
+		Name:         MenderStateReboot,
+		UpdateStatus: client.StatusRebooting,
+		RebootBootID: "boot-1",
+	}, ud)
+
+	// after the reboot the status is sent again before verifying update
+	ioutil.WriteFile(bootIDFile, []byte("boot-2\n"), 0644)
+	s, _ = (&AuthorizedState{}).Handle(&ctx, &stateTestController{})
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	usr := s.(*UpdateStatusReportState)
+	assert.Equal(t, client.StatusRebooting, usr.status)
+	assert.Equal(t, update, usr.update)
+
+	sc = &stateTestController{}
+	s, _ = usr.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateVerifyState{}, s)
+	assert.Equal(t, client.StatusRebooting, sc.reportStatus)
+
+	// interrupted while re-sending
+	s, _ = (&AuthorizedState{}).Handle(&ctx, &stateTestController{})
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.Equal(t, client.StatusRebooting, s.(*UpdateStatusReportState).status)
+
+	// failing to re-send does not stop the update
+	sc = &stateTestController{
+		reportError: NewFatalError(errors.New("rejected")),
+	}
+	s, _ = NewUpdateStatusReportState(update, client.StatusRebooting).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateVerifyState{}, s)
+
+	// acknowledged before reboot
+	s, _ = NewRebootState(update).Handle(&ctx, &stateTestController{})
+	assert.IsType(t, &FinalState{}, s)
+	ioutil.WriteFile(bootIDFile, []byte("boot-3\n"), 0644)
+	s, _ = (&AuthorizedState{}).Handle(&ctx, &stateTestController{})
+	assert.IsType(t, &UpdateVerifyState{}, s)
+}
+
+func TestStateRebootGracePeriod(t *testing.T) {
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	ctx := StateContext{
+		store: utils.NewMemStore(),
+	}
+	sc := &stateTestController{
+		FakeDevice: testutils.FakeDevice{
+			ConsumeUpdate: true,
+		},
+		rebootGrace: time.Hour,
+	}
+
+	// applications are notified only once the update is enabled
+	data := "test"
+	is := NewUpdateInstallState(ioutil.NopCloser(bytes.NewBufferString(data)),
+		int64(len(data)), update)
+	s, c := is.Handle(&ctx, sc)
+	assert.IsType(t, &RebootState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, []string{"enable-partition"}, sc.calls)
+
+	// wait for grace period
+	s.(*RebootState).CancellableState = &cancellableStateTest{BaseState{
+		id: MenderStateReboot,
+	}}
+	s, c = s.Handle(&ctx, sc)
+	assert.IsType(t, &FinalState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, []string{"enable-partition", "notify-reboot", "reboot"}, sc.calls)
+
+	// grace period interrupted
+	sc.calls = nil
+	rs := NewRebootState(update)
+	cctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ctx.context = cctx
+	s, c = rs.Handle(&ctx, sc)
+	assert.Equal(t, rs, s)
+	assert.True(t, c)
+	assert.Equal(t, []string{"notify-reboot"}, sc.calls)
+}
+
+func TestStateRebootHandoff(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+
+	oldBootIDFile := bootIDFile
+	bootIDFile = path.Join(tempDir, "boot_id")
+	defer func() { bootIDFile = oldBootIDFile }()
+	ioutil.WriteFile(bootIDFile, []byte("boot-1\n"), 0644)
+
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	ms := utils.NewMemStore()
+	ctx := StateContext{
+		store: ms,
+	}
+
+	// supervisor reboots once the client exits
+	sc := &stateTestController{
+		rebootMode: rebootModeExit,
+	}
+	s, c := NewRebootState(update).Handle(&ctx, sc)
+	assert.IsType(t, &ErrorState{}, s)
+	assert.False(t, c)
+	es := s.(*ErrorState)
+	assert.True(t, es.IsFatal())
+	assert.Equal(t, ErrRebootRequired, es.cause.Cause())
+	assert.Equal(t, []string{"notify-reboot"}, sc.calls)
+
+	// supervisor restarted the client without reboot; the new artifact is
+	// not running, reboot is handed off again instead of verifying it
+	sd, err := LoadStateData(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, MenderStateReboot, sd.Name)
+	s, _ = authorizedState.Handle(&ctx, sc)
+	assert.IsType(t, &RebootState{}, s)
+	s, _ = s.Handle(&ctx, sc)
+	assert.Equal(t, ErrRebootRequired, s.(*ErrorState).cause.Cause())
+
+	// state machine resumes with verifying the update after reboot
+	ioutil.WriteFile(bootIDFile, []byte("boot-2\n"), 0644)
+	s, _ = authorizedState.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateVerifyState{}, s)
+
+	// external reboot manager is asked to reboot, client waits
+	cctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ctx.context = cctx
+	sc = &stateTestController{
+		rebootMode: rebootModeSignal,
+	}
+	rs := NewRebootState(update)
+	s, c = rs.Handle(&ctx, sc)
+	assert.Equal(t, rs, s)
+	assert.True(t, c)
+	assert.Equal(t, []string{"notify-reboot", "request-reboot"}, sc.calls)
+
+	// rollback is handed off as well
+	sc = &stateTestController{
+		rebootMode: rebootModeExit,
+	}
+	s, _ = NewRollbackState(update).Handle(&ctx, sc)
+	assert.IsType(t, &ErrorState{}, s)
+	assert.Empty(t, sc.calls)
+}
+
+func TestStateRollback(t *testing.T) {
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	rs := NewRollbackState(update)
+
+	// create directory for storing deployments logs
+
+	sc := &stateTestController{
+		FakeDevice: testutils.FakeDevice{
+			RetRollback: NewFatalError(errors.New("rollback failed")),
+		}}
+	s, c := rs.Handle(nil, sc)
+	assert.IsType(t, &ErrorState{}, s)
+	assert.False(t, c)
+	assert.Empty(t, sc.updateMarkers)
+
+	sc = &stateTestController{}
+	s, c = rs.Handle(nil, sc)
+	assert.IsType(t, &FinalState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, []string{updateMarkerRolledBack}, sc.updateMarkers)
+}
+
+func TestStateFinal(t *testing.T) {
+	rs := FinalState{}
+
+	assert.Panics(t, func() {
+		rs.Handle(nil, &stateTestController{})
+	}, "final state Handle() should panic")
+}
+
+func TestStateData(t *testing.T) {
+	ms := utils.NewMemStore()
+	sd := StateData{
+		Version: stateDataVersion,
+		Name:    MenderStateInit,
+		UpdateInfo: client.UpdateResponse{
+			ID: "foobar",
+		},
+	}
+	err := StoreStateData(ms, sd)
+	assert.NoError(t, err)
+	rsd, err := LoadStateData(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, sd, rsd)
+
+	// test if data marshalling works fine
+	data, err := ms.ReadAll(stateDataKey)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"Name":"init"`)
+
+	sd.Version = 999
+	err = StoreStateData(ms, sd)
+	assert.NoError(t, err)
+	rsd, err = LoadStateData(ms)
+	assert.Error(t, err)
+	assert.Equal(t, StateData{}, rsd)
+	assert.Equal(t, sd.Version, 999)
+
+	ms.Remove(stateDataKey)
+	_, err = LoadStateData(ms)
+	assert.Error(t, err)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStateReportError(t *testing.T) {
+	update := client.UpdateResponse{
+		ID: "foobar",
+	}
+
+	ms := utils.NewMemStore()
+	ctx := &StateContext{
+		store: ms,
+	}
+	sc := &stateTestController{}
+
+	// update succeeded, but we failed to report the status to the server,
+	// rollback happens next
+	res := NewReportErrorState(update, client.StatusSuccess)
+	s, c := res.Handle(ctx, sc)
+	assert.IsType(t, &RollbackState{}, s)
+	assert.False(t, c)
+
+	// store some state data, failing to report status with a failed update
+	// will just clean that up and
+	StoreStateData(ms, StateData{
+		Name:       MenderStateReportStatusError,
+		UpdateInfo: update,
+	})
+	// update failed and we failed to report that status to the server,
+	// state data should be removed and we should go back to init
+	res = NewReportErrorState(update, client.StatusFailure)
+	s, c = res.Handle(ctx, sc)
+	assert.IsType(t, &InitState{}, s)
+	assert.False(t, c)
+
+	_, err := LoadStateData(ms)
+	assert.Equal(t, err, os.ErrNotExist)
+
+	// store some state data, failing to report status with an update that
+	// is already installed will also clean it up
+	StoreStateData(ms, StateData{
+		Name:       MenderStateReportStatusError,
+		UpdateInfo: update,
+	})
+	// update is already installed and we failed to report that status to
+	// the server, state data should be removed and we should go back to
+	// init
+	res = NewReportErrorState(update, client.StatusAlreadyInstalled)
+	s, c = res.Handle(ctx, sc)
+	assert.IsType(t, &InitState{}, s)
+	assert.False(t, c)
+
+	_, err = LoadStateData(ms)
+	assert.Equal(t, err, os.ErrNotExist)
+}
+
+func TestMaxSendingAttempts(t *testing.T) {
+	assert.Equal(t, minReportSendRetries, maxSendingAttempts(time.Second, 0*time.Second))
+	assert.Equal(t, minReportSendRetries, maxSendingAttempts(time.Second, time.Minute))
+	assert.Equal(t, 10, maxSendingAttempts(5*time.Second, time.Second))
+	assert.Equal(t, minReportSendRetries, maxSendingAttempts(time.Second, time.Second))
+}
+
+func TestContextReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cr := &contextReader{
+		ctx: ctx,
+		r:   ioutil.NopCloser(bytes.NewBufferString("foobar")),
+	}
+
+	buf := make([]byte, 3)
+	n, err := cr.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	// no more data once cancelled
+	cancel()
+	n, err = cr.Read(buf)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, n)
+	assert.NoError(t, cr.Close())
+}
+
+func TestStateCheckWaitAuthRefresh(t *testing.T) {
+	cws := NewCheckWaitState()
+	ctx := &StateContext{
+		lastUpdateCheck:     time.Now(),
+		lastInventoryUpdate: time.Now(),
+	}
+
+	// token needs refreshing before next update check or inventory update
+	s, c := cws.Handle(ctx, &stateTestController{
+		pollIntvl:   time.Hour,
+		authRefresh: time.Now().Add(10 * time.Millisecond),
+	})
+	assert.IsType(t, &BootstrappedState{}, s)
+	assert.False(t, c)
+
+	// token is past its refresh time already
+	s, c = cws.Handle(ctx, &stateTestController{
+		pollIntvl:   time.Hour,
+		authRefresh: time.Now().Add(-time.Minute),
+	})
+	assert.IsType(t, &BootstrappedState{}, s)
+	assert.False(t, c)
+
+	// update check comes first
+	ctx.lastUpdateCheck = time.Time{}
+	s, c = cws.Handle(ctx, &stateTestController{
+		pollIntvl:   time.Hour,
+		authRefresh: time.Now().Add(time.Minute),
+	})
+	assert.IsType(t, &UpdateCheckState{}, s)
+	assert.False(t, c)
+}
+
+func TestStateConfigurationUpdate(t *testing.T) {
+	cws := NewCheckWaitState()
+	ctx := &StateContext{
+		lastUpdateCheck:     time.Now(),
+		lastInventoryUpdate: time.Now(),
+	}
+
+	// device configuration is not enabled
+	tc := &stateTestController{
+		pollIntvl: 10 * time.Millisecond,
+	}
+	s, _ := cws.Handle(ctx, tc)
+	assert.IsType(t, &UpdateCheckState{}, s)
+
+	// configuration is due before the update check
+	tc.configIntvl = time.Millisecond
+	s, c := cws.Handle(ctx, tc)
+	assert.IsType(t, &ConfigurationUpdateState{}, s)
+	assert.False(t, c)
+
+	// failures do not affect updates
+	tc.configErr = NewFatalError(ErrConfigurationApply)
+	s, c = s.Handle(ctx, tc)
+	assert.IsType(t, &CheckWaitState{}, s)
+	assert.False(t, c)
+	assert.False(t, ctx.lastConfigurationCheck.IsZero())
+
+	tc.configIntvl = time.Hour
+	s, _ = cws.Handle(ctx, tc)
+	assert.IsType(t, &UpdateCheckState{}, s)
+}
+
+type fetchDiagnosticsError struct{}
+
+func (fetchDiagnosticsError) Error() string {
+	return "connection reset"
+}
+
+func (fetchDiagnosticsError) FetchDiagnostics() client.FetchDiagnostics {
+	return client.FetchDiagnostics{
+		Host:          "cdn.mender.io",
+		BytesReceived: 1024,
+	}
+}
+
+func TestFetchDiagnosticsMessage(t *testing.T) {
+	assert.Equal(t, "", fetchDiagnosticsMessage(errors.New("fetch failed")))
+	assert.Equal(t, "", fetchDiagnosticsMessage(nil))
+
+	msg := fetchDiagnosticsMessage(fetchDiagnosticsError{})
+	assert.Contains(t, msg, "update download diagnostics")
+	assert.Contains(t, msg, `"host":"cdn.mender.io"`)
+	assert.Contains(t, msg, `"bytes_received":1024`)
+}
@@ -0,0 +1,124 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// Time limits of states, so that a hanging download or install can not keep
+// the device in the middle of a deployment forever. Installing includes
+// streaming the artifact from the server. StateTimeoutsSeconds overrides
+// these per state; 0 disables the limit. Waiting for applications holding
+// the commit is limited by CommitHoldTimeoutSeconds.
+var defaultStateTimeouts = map[MenderState]time.Duration{
+	MenderStateUpdateFetch:   30 * time.Minute,
+	MenderStateUpdateInstall: 60 * time.Minute,
+	MenderStateUpdateCommit:  10 * time.Minute,
+}
+
+var ErrStateTimeout = errors.New("state timed out")
+
+// State which can be given time limit; TimedOut returns the state to continue
+// with once the limit is exceeded.
+type timeLimitedState interface {
+	TimedOut(c Controller, err menderError) State
+}
+
+// Fetch which did not finish in time fails the deployment; nothing is written
+// to the device yet.
+func (u *UpdateFetchState) TimedOut(c Controller, err menderError) State {
+	return NewUpdateErrorState(err, u.update)
+}
+
+// Partially written update must be cleaned up before the failure is reported.
+func (u *UpdateInstallState) TimedOut(c Controller, err menderError) State {
+	return NewUpdateCleanupState(u.update, err)
+}
+
+// Update that could not be committed is rolled back, the same way as when
+// committing fails.
+func (uc *UpdateCommitState) TimedOut(c Controller, err menderError) State {
+	if !c.RebootRequired() {
+		return NewRollbackState(uc.update)
+	}
+	return NewRebootState(uc.update)
+}
+
+// Check per-state timeouts from configuration: only states having a timeout
+// policy may be given one.
+func validateStateTimeouts(timeouts map[string]int) error {
+	for name, secs := range timeouts {
+		var state MenderState
+		if err := state.UnmarshalJSON([]byte(fmt.Sprintf("%q", name))); err != nil {
+			return errors.Errorf("invalid state %q in state timeouts", name)
+		}
+		if _, ok := defaultStateTimeouts[state]; !ok {
+			return errors.Errorf("state %q can not be given a timeout", name)
+		}
+		if secs < 0 {
+			return errors.Errorf("invalid timeout %d of state %q", secs, name)
+		}
+	}
+	return nil
+}
+
+// GetStateTimeout returns how long the state may take; 0 if it is not
+// limited.
+func (m *mender) GetStateTimeout(state MenderState) time.Duration {
+	if secs, ok := m.config.StateTimeoutsSeconds[state.String()]; ok {
+		return time.Duration(secs) * time.Second
+	}
+	return defaultStateTimeouts[state]
+}
+
+// Runs the state within its time limit, if any. The context of the state is
+// only canceled once the limit is exceeded, or after the next state, as the
+// artifact stream opened while fetching is read while installing.
+func (d *menderDaemon) runState() (State, bool) {
+	current := d.mender.GetState()
+	parent := d.sctx.context
+	var cancel context.CancelFunc
+	var timer *time.Timer
+	timeout := d.mender.GetStateTimeout(current.Id())
+	if _, ok := current.(timeLimitedState); ok && timeout > 0 && parent != nil {
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(parent)
+		timer = time.AfterFunc(timeout, cancel)
+		d.sctx.context = ctx
+	}
+
+	state, cancelled := d.mender.RunState(&d.sctx)
+
+	d.sctx.context = parent
+	if d.stateCancel != nil {
+		d.stateCancel()
+	}
+	d.stateCancel = cancel
+	if timer != nil && !timer.Stop() && parent.Err() == nil {
+		err := NewFatalError(errors.Wrapf(ErrStateTimeout,
+			"%s took longer than %v", current.Id(), timeout))
+		logWithFields(logrus.Fields{
+			LogFieldState:     current.Id().String(),
+			LogFieldErrorCode: errorCode(err),
+		}).Errorf("%v", err.Cause())
+		return current.(timeLimitedState).TimedOut(d.mender, err), false
+	}
+	return state, cancelled
+}
@@ -0,0 +1,121 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// Install which never finishes on its own.
+type hangingInstallState struct {
+	UpdateInstallState
+	ctx context.Context
+}
+
+func (h *hangingInstallState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	h.ctx = ctx.Context()
+	<-ctx.Context().Done()
+	return h, true
+}
+
+func TestStateTimeoutsConfig(t *testing.T) {
+	assert.NoError(t, validateStateTimeouts(nil))
+	assert.NoError(t, validateStateTimeouts(map[string]int{
+		"update-fetch":   60,
+		"update-install": 0,
+		"update-commit":  10,
+	}))
+	assert.Error(t, validateStateTimeouts(map[string]int{"no-such-state": 1}))
+	assert.Error(t, validateStateTimeouts(map[string]int{"check-wait": 1}))
+	assert.Error(t, validateStateTimeouts(map[string]int{"update-fetch": -1}))
+
+	_, err := NewMender(MenderConfig{StateTimeoutsSeconds: map[string]int{"reboot": 1}},
+		MenderPieces{store: utils.NewMemStore()})
+	assert.Error(t, err)
+
+	mender := newTestMender(nil, MenderConfig{
+		StateTimeoutsSeconds: map[string]int{
+			"update-install": 0,
+			"update-commit":  5,
+		},
+	}, testMenderPieces{})
+	assert.Equal(t, 30*time.Minute, mender.GetStateTimeout(MenderStateUpdateFetch))
+	assert.Equal(t, time.Duration(0), mender.GetStateTimeout(MenderStateUpdateInstall))
+	assert.Equal(t, 5*time.Second, mender.GetStateTimeout(MenderStateUpdateCommit))
+	assert.Equal(t, time.Duration(0), mender.GetStateTimeout(MenderStateCheckWait))
+}
+
+func TestStateTimedOut(t *testing.T) {
+	update := client.UpdateResponse{ID: "foo"}
+	err := NewFatalError(ErrStateTimeout)
+	c := &stateTestController{appUpdate: true}
+
+	s := NewUpdateFetchState(update).(timeLimitedState).TimedOut(c, err)
+	assert.IsType(t, &UpdateErrorState{}, s)
+
+	s = NewUpdateInstallState(nil, 0, update).(timeLimitedState).TimedOut(c, err)
+	assert.IsType(t, &UpdateCleanupState{}, s)
+	assert.Equal(t, err, s.(*UpdateCleanupState).cause)
+
+	s = NewUpdateCommitState(update).(timeLimitedState).TimedOut(c, err)
+	assert.IsType(t, &RollbackState{}, s)
+	c.appUpdate = false
+	s = NewUpdateCommitState(update).(timeLimitedState).TimedOut(c, err)
+	assert.IsType(t, &RebootState{}, s)
+
+	assert.Equal(t, "state_timeout", errorCode(err))
+}
+
+func TestDaemonStateTimeout(t *testing.T) {
+	update := client.UpdateResponse{ID: "foo"}
+	install := &hangingInstallState{
+		UpdateInstallState: *NewUpdateInstallState(nil, 0, update).(*UpdateInstallState),
+	}
+	c := &stateTestController{
+		state: install,
+		stateTimeouts: map[MenderState]time.Duration{
+			MenderStateUpdateInstall: 10 * time.Millisecond,
+		},
+	}
+	daemon := NewDaemon(c, utils.NewMemStore())
+
+	s, cancelled := daemon.runState()
+	assert.False(t, cancelled)
+	assert.IsType(t, &UpdateCleanupState{}, s)
+	assert.Equal(t, ErrStateTimeout, errors.Cause(s.(*UpdateCleanupState).cause.Cause()))
+	assert.NoError(t, daemon.sctx.Context().Err())
+
+	// state context is released after the next state
+	c.state = updateCheckState
+	daemon.runState()
+	assert.Error(t, install.ctx.Err())
+
+	// no limit
+	c.stateTimeouts = nil
+	c.state = install
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		daemon.StopDaemon()
+	}()
+	s, cancelled = daemon.runState()
+	assert.True(t, cancelled)
+	assert.Equal(t, install, s)
+}
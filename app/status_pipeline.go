@@ -0,0 +1,160 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+)
+
+// Sends report prepared on the state machine goroutine; nothing of the
+// controller is touched by the pipeline goroutine.
+type statusSender func(ctx context.Context) menderError
+
+type queuedStatus struct {
+	ctx          context.Context
+	deploymentID string
+	status       string
+	send         statusSender
+}
+
+// Pipeline for progress reports (downloading, installing) which are sent in
+// the background, so that the update is not held up waiting for the server
+// on high latency links. At most one report is in flight; reports queued
+// meanwhile replace each other, as the server only needs to know the latest
+// status. Statuses that must be delivered (rebooting, success, failure, ...)
+// are sent synchronously after the pipeline is flushed, which keeps reports
+// in order. Deployment found aborted by a background report is remembered,
+// so that the download can be stopped.
+type statusPipeline struct {
+	lock sync.Mutex
+	// closed once the pipeline is idle; nil if not running
+	done    chan struct{}
+	pending *queuedStatus
+	// deployment the server reported aborted
+	aborted string
+}
+
+func newStatusPipeline() *statusPipeline {
+	return &statusPipeline{}
+}
+
+func (p *statusPipeline) Enqueue(ctx context.Context, deploymentID, status string,
+	send statusSender) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	q := &queuedStatus{ctx, deploymentID, status, send}
+	if p.done != nil {
+		if p.pending != nil {
+			log.Debugf("status report %q superseded by %q",
+				p.pending.status, status)
+		}
+		p.pending = q
+		return
+	}
+
+	p.done = make(chan struct{})
+	go p.run(q)
+}
+
+func (p *statusPipeline) run(q *queuedStatus) {
+	for q != nil {
+		err := q.send(q.ctx)
+		if err != nil {
+			// the following synchronous report will run into the same
+			// problem and handle it
+			log.Warnf("failed to report status %q in background: %v",
+				q.status, err.Cause())
+		}
+
+		p.lock.Lock()
+		if err != nil && err.Cause() == client.ErrDeploymentAborted {
+			p.aborted = q.deploymentID
+		}
+		q = p.pending
+		p.pending = nil
+		if q == nil {
+			close(p.done)
+			p.done = nil
+		}
+		p.lock.Unlock()
+	}
+}
+
+// Whether a background report found the deployment aborted.
+func (p *statusPipeline) Aborted(deploymentID string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return deploymentID != "" && p.aborted == deploymentID
+}
+
+// Drops queued reports, which are superseded by status about to be reported,
+// and waits for the report in flight, if any. Returns false if ctx was
+// cancelled while waiting.
+func (p *statusPipeline) Flush(ctx context.Context) bool {
+	p.lock.Lock()
+	if p.pending != nil {
+		log.Debugf("status report %q superseded", p.pending.status)
+		p.pending = nil
+	}
+	done := p.done
+	p.lock.Unlock()
+
+	if done == nil {
+		return true
+	}
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// How often progress is reported while the artifact is downloaded and
+// installed; finds out if the deployment was aborted meanwhile.
+const abortCheckInterval = time.Minute
+
+// Reader of the artifact which reports progress every now and then, and fails
+// once the deployment is found aborted.
+type abortCheckReader struct {
+	r io.ReadCloser
+	// reports progress; fails if the deployment was aborted
+	check func() menderError
+	next  time.Time
+}
+
+func (a *abortCheckReader) Read(p []byte) (int, error) {
+	if now := time.Now(); now.After(a.next) {
+		a.next = now.Add(abortCheckInterval)
+		if err := a.check(); err != nil {
+			return 0, err
+		}
+	}
+	return a.r.Read(p)
+}
+
+func (a *abortCheckReader) Close() error {
+	return a.r.Close()
+}
+
+func (a *abortCheckReader) imageStream() io.Reader {
+	return a.r
+}
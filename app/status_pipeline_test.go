@@ -0,0 +1,158 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusPipeline(t *testing.T) {
+	var lock sync.Mutex
+	var sent []string
+	release := make(chan struct{})
+
+	p := newStatusPipeline()
+	enqueue := func(status string) {
+		p.Enqueue(context.Background(), "foo", status,
+			func(ctx context.Context) menderError {
+				<-release
+				lock.Lock()
+				sent = append(sent, status)
+				lock.Unlock()
+				if status == client.StatusDownloading {
+					return NewFatalError(errors.New("failed"))
+				}
+				return nil
+			})
+	}
+
+	// nothing to wait for
+	assert.True(t, p.Flush(context.Background()))
+
+	// downloading is in flight while the rest queue up and replace each
+	// other
+	enqueue(client.StatusDownloading)
+	enqueue(client.StatusInstalling)
+	enqueue("in-progress")
+	release <- struct{}{}
+	release <- struct{}{}
+	assert.True(t, p.Flush(context.Background()))
+
+	lock.Lock()
+	assert.Equal(t, []string{client.StatusDownloading, "in-progress"}, sent)
+	sent = nil
+	lock.Unlock()
+
+	// queued reports are dropped by flush, report in flight is waited for
+	enqueue(client.StatusDownloading)
+	enqueue(client.StatusInstalling)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release <- struct{}{}
+	}()
+	assert.True(t, p.Flush(context.Background()))
+	lock.Lock()
+	assert.Equal(t, []string{client.StatusDownloading}, sent)
+	lock.Unlock()
+
+	// waiting can be cancelled
+	enqueue(client.StatusInstalling)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.False(t, p.Flush(ctx))
+	release <- struct{}{}
+	assert.True(t, p.Flush(context.Background()))
+
+	// failures other than abort are left to the following reports
+	assert.False(t, p.Aborted("foo"))
+	p.Enqueue(context.Background(), "foo", client.StatusInstalling,
+		func(ctx context.Context) menderError {
+			return NewFatalError(client.ErrDeploymentAborted)
+		})
+	assert.True(t, p.Flush(context.Background()))
+	assert.True(t, p.Aborted("foo"))
+	assert.False(t, p.Aborted("bar"))
+}
+
+func TestReportUpdateStatusAsync(t *testing.T) {
+	var lock sync.Mutex
+	var auth []string
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		auth = append(auth, r.Header.Get("Authorization"))
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	mender := newTestMender(nil, MenderConfig{ServerURL: srv.URL}, testMenderPieces{})
+	mender.authToken = client.AuthToken("token-1")
+	update := client.UpdateResponse{ID: "dep-1"}
+	ctx := context.Background()
+
+	// token of the time of the report is sent, even if it changes meanwhile
+	assert.Nil(t, mender.ReportUpdateStatusAsync(ctx, update, client.StatusDownloading))
+	mender.authToken = client.AuthToken("token-2")
+	assert.True(t, mender.statusReports.Flush(ctx))
+	lock.Lock()
+	assert.Equal(t, []string{"Bearer token-1"}, auth)
+	status = http.StatusConflict
+	lock.Unlock()
+
+	// aborted deployment is found out by the following report
+	assert.Nil(t, mender.ReportUpdateStatusAsync(ctx, update, client.StatusInstalling))
+	assert.True(t, mender.statusReports.Flush(ctx))
+	merr := mender.ReportUpdateStatusAsync(ctx, update, client.StatusInstalling)
+	if assert.NotNil(t, merr) {
+		assert.Equal(t, client.ErrDeploymentAborted, merr.Cause())
+	}
+}
+
+func TestAbortCheckReader(t *testing.T) {
+	var checks int
+	var abort menderError
+	r := &abortCheckReader{
+		r: ioutil.NopCloser(strings.NewReader("0123456789")),
+		check: func() menderError {
+			checks++
+			return abort
+		},
+	}
+	buf := make([]byte, 2)
+	n, err := r.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	// not checked again until the interval passes
+	_, err = r.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, checks)
+
+	abort = NewFatalError(client.ErrDeploymentAborted)
+	r.next = time.Now()
+	_, err = r.Read(buf)
+	assert.Equal(t, abort, err)
+	assert.Equal(t, 2, checks)
+}
@@ -0,0 +1,192 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+)
+
+// Encryption of sensitive store entries at rest, so that a copy of the data
+// partition does not directly reveal credentials and identifiers. Entries
+// are sealed with AES-GCM, with the key derived from the configured key file;
+// the entry name is authenticated too, so sealed values can not be swapped
+// between entries. Entries written before encryption was enabled are read as
+// they are until sealed by sealPlaintextEntries.
+var encryptedStoreEntries = map[string]bool{
+	authTokenName:            true,
+	migrationAuthTokenName:   true,
+	defaultTenantTokenFile:   true,
+	migrationTenantTokenFile: true,
+	deviceEventsName:         true,
+}
+
+// Entries the device can do without, eg. once the key was replaced: auth
+// tokens are obtained again from the server, and queued events are lost.
+// Those which can not be decrypted are removed and read as missing.
+var droppableStoreEntries = map[string]bool{
+	authTokenName:          true,
+	migrationAuthTokenName: true,
+	deviceEventsName:       true,
+}
+
+// prefix of sealed entries, followed by nonce and ciphertext
+var sealedEntryMagic = []byte("mender-sealed-1:")
+
+type encryptingStore struct {
+	Store
+	aead cipher.AEAD
+}
+
+// Wraps the store so that sensitive entries are encrypted with the key from
+// given key file. Returns the store as is if no key file is configured.
+func newEncryptingStore(store Store, keyFile string) (Store, error) {
+	if keyFile == "" {
+		return store, nil
+	}
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read store encryption key")
+	}
+	if len(bytes.TrimSpace(key)) == 0 {
+		return nil, errors.Errorf("store encryption key file %s is empty", keyFile)
+	}
+	digest := sha256.Sum256(key)
+	block, err := aes.NewCipher(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingStore{Store: store, aead: aead}, nil
+}
+
+func (s *encryptingStore) seal(name string, data []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrapf(err, "failed to generate nonce")
+	}
+	sealed := append([]byte{}, sealedEntryMagic...)
+	sealed = append(sealed, nonce...)
+	return s.aead.Seal(sealed, nonce, data, []byte(name)), nil
+}
+
+func (s *encryptingStore) open(name string, sealed []byte) ([]byte, error) {
+	sealed = sealed[len(sealedEntryMagic):]
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, errors.Errorf("store entry %s truncated", name)
+	}
+	nonce := sealed[:s.aead.NonceSize()]
+	data, err := s.aead.Open(nil, nonce, sealed[len(nonce):], []byte(name))
+	if err != nil {
+		return nil, errors.Errorf("failed to decrypt store entry %s, "+
+			"wrong key or corrupted data", name)
+	}
+	return data, nil
+}
+
+func (s *encryptingStore) ReadAll(name string) ([]byte, error) {
+	data, err := s.Store.ReadAll(name)
+	if err != nil || !encryptedStoreEntries[name] {
+		return data, err
+	}
+	if !bytes.HasPrefix(data, sealedEntryMagic) {
+		// written before encryption was enabled
+		return data, nil
+	}
+	data, err = s.open(name, data)
+	if err != nil && droppableStoreEntries[name] {
+		log.Warnf("%v; removing it", err)
+		if err := s.Store.Remove(name); err != nil && !os.IsNotExist(err) {
+			log.Errorf("failed to remove store entry %s: %v", name, err)
+		}
+		return nil, os.ErrNotExist
+	}
+	return data, err
+}
+
+// sealPlaintextEntries encrypts the sensitive entries written before
+// encryption was enabled; nothing to do unless store is encrypting.
+func sealPlaintextEntries(store Store) {
+	s, ok := store.(*encryptingStore)
+	if !ok {
+		return
+	}
+	for name := range encryptedStoreEntries {
+		data, err := s.Store.ReadAll(name)
+		if err != nil || bytes.HasPrefix(data, sealedEntryMagic) {
+			continue
+		}
+		log.Infof("encrypting store entry %s", name)
+		if err := s.WriteAll(name, data); err != nil {
+			log.Warnf("failed to encrypt store entry %s: %v", name, err)
+		}
+	}
+}
+
+func (s *encryptingStore) WriteAll(name string, data []byte) error {
+	if !encryptedStoreEntries[name] {
+		return s.Store.WriteAll(name, data)
+	}
+	sealed, err := s.seal(name, data)
+	if err != nil {
+		return err
+	}
+	return s.Store.WriteAll(name, sealed)
+}
+
+func (s *encryptingStore) OpenRead(name string) (io.ReadCloser, error) {
+	if !encryptedStoreEntries[name] {
+		return s.Store.OpenRead(name)
+	}
+	data, err := s.ReadAll(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *encryptingStore) OpenWrite(name string) (utils.WriteCloserCommitter, error) {
+	if !encryptedStoreEntries[name] {
+		return s.Store.OpenWrite(name)
+	}
+	return &sealingWriter{store: s, name: name}, nil
+}
+
+// Collects data of an encrypted entry, which is sealed and written on commit.
+type sealingWriter struct {
+	bytes.Buffer
+	store *encryptingStore
+	name  string
+}
+
+func (w *sealingWriter) Commit() error {
+	return w.store.WriteAll(w.name, w.Bytes())
+}
+
+func (w *sealingWriter) Close() error {
+	return nil
+}
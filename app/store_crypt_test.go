@@ -0,0 +1,154 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeStoreKey(t *testing.T, dir, name, key string) string {
+	keyFile := path.Join(dir, name)
+	assert.NoError(t, ioutil.WriteFile(keyFile, []byte(key), 0600))
+	return keyFile
+}
+
+func TestEncryptingStore(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "storecrypt")
+	defer os.RemoveAll(tdir)
+
+	ms := utils.NewMemStore()
+
+	// no key configured, store is used as is
+	store, err := newEncryptingStore(ms, "")
+	assert.NoError(t, err)
+	assert.Equal(t, ms, store)
+
+	_, err = newEncryptingStore(ms, path.Join(tdir, "missing"))
+	assert.Error(t, err)
+	_, err = newEncryptingStore(ms, writeStoreKey(t, tdir, "empty", "\n"))
+	assert.Error(t, err)
+
+	keyFile := writeStoreKey(t, tdir, "key", "secret key")
+	store, err = newEncryptingStore(ms, keyFile)
+	assert.NoError(t, err)
+
+	// sensitive entries are encrypted at rest
+	assert.NoError(t, store.WriteAll(authTokenName, []byte("token")))
+	raw, _ := ms.ReadAll(authTokenName)
+	assert.NotContains(t, string(raw), "token")
+	data, err := store.ReadAll(authTokenName)
+	assert.NoError(t, err)
+	assert.Equal(t, "token", string(data))
+
+	// other entries are not
+	assert.NoError(t, store.WriteAll(installHistoryName, []byte("history")))
+	raw, _ = ms.ReadAll(installHistoryName)
+	assert.Equal(t, "history", string(raw))
+
+	// missing entries are reported as such
+	_, err = store.ReadAll(migrationAuthTokenName)
+	assert.True(t, os.IsNotExist(err))
+
+	// entry written before encryption was enabled is read as it is, and
+	// sealed only when asked to
+	assert.NoError(t, ms.WriteAll(defaultTenantTokenFile, []byte("tenant")))
+	data, err = store.ReadAll(defaultTenantTokenFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant", string(data))
+	raw, _ = ms.ReadAll(defaultTenantTokenFile)
+	assert.Equal(t, "tenant", string(raw))
+	sealPlaintextEntries(store)
+	raw, _ = ms.ReadAll(defaultTenantTokenFile)
+	assert.True(t, bytes.HasPrefix(raw, sealedEntryMagic))
+	data, err = store.ReadAll(defaultTenantTokenFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant", string(data))
+	// no-op without encryption
+	sealPlaintextEntries(ms)
+
+	// sealed value is bound to its entry
+	raw, _ = ms.ReadAll(authTokenName)
+	assert.NoError(t, ms.WriteAll(migrationTenantTokenFile, raw))
+	_, err = store.ReadAll(migrationTenantTokenFile)
+	assert.Error(t, err)
+
+	// truncated entry
+	assert.NoError(t, ms.WriteAll(migrationTenantTokenFile, sealedEntryMagic))
+	_, err = store.ReadAll(migrationTenantTokenFile)
+	assert.Error(t, err)
+
+	// different key can not decrypt tenant token, which can not be done
+	// without
+	other, err := newEncryptingStore(ms, writeStoreKey(t, tdir, "other", "other key"))
+	assert.NoError(t, err)
+	_, err = other.ReadAll(defaultTenantTokenFile)
+	assert.Error(t, err)
+	assert.False(t, os.IsNotExist(err))
+
+	// while auth token is dropped, to be obtained again
+	_, err = other.ReadAll(authTokenName)
+	assert.True(t, os.IsNotExist(err))
+	_, err = ms.ReadAll(authTokenName)
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, store.WriteAll(authTokenName, []byte("token")))
+
+	// streaming access
+	w, err := store.OpenWrite(deviceEventsName)
+	assert.NoError(t, err)
+	w.Write([]byte("events"))
+	assert.NoError(t, w.Commit())
+	assert.NoError(t, w.Close())
+	raw, _ = ms.ReadAll(deviceEventsName)
+	assert.NotContains(t, string(raw), "events")
+	r, err := store.OpenRead(deviceEventsName)
+	assert.NoError(t, err)
+	data, _ = ioutil.ReadAll(r)
+	assert.Equal(t, "events", string(data))
+}
+
+func TestLoadTenantTokenEncrypted(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "storecrypt")
+	defer os.RemoveAll(tdir)
+	keyFile := writeStoreKey(t, tdir, "key", "secret key")
+
+	tokenFile := path.Join(tdir, defaultTenantTokenFile)
+	assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("tenant"), 0600))
+
+	tok, err := loadTenantToken(tdir, defaultTenantTokenFile, keyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant", string(tok))
+	// reading leaves provisioned token as it is
+	raw, _ := ioutil.ReadFile(tokenFile)
+	assert.Equal(t, "tenant", string(raw))
+
+	assert.NoError(t, sealTenantTokens(tdir, keyFile))
+	raw, _ = ioutil.ReadFile(tokenFile)
+	assert.NotContains(t, string(raw), "tenant")
+	assert.Error(t, sealTenantTokens(tdir, path.Join(tdir, "missing")))
+
+	tok, err = loadTenantToken(tdir, defaultTenantTokenFile, keyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant", string(tok))
+
+	tok, err = loadTenantToken(tdir, migrationTenantTokenFile, keyFile)
+	assert.NoError(t, err)
+	assert.Nil(t, tok)
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+var ErrNoRootfsImage = errors.New("no root filesystem found")
+
+// Recognized root filesystem signatures: squashfs at the very beginning, ext2/3/4
+// magic in the superblock starting at 1024 bytes.
+const (
+	squashfsMagic     = "hsqs"
+	extMagicOffset    = 1024 + 56
+	extMagic          = 0xEF53
+	fsSignatureLength = extMagicOffset + 2
+)
+
+// Check that the image at `path` looks like a root filesystem one can boot
+// into, not an empty or half-written partition.
+func checkRootfsImage(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	head := make([]byte, fsSignatureLength)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return errors.Wrapf(ErrNoRootfsImage, "%s: %v", path, err)
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte(squashfsMagic)):
+		return nil
+	case binary.LittleEndian.Uint16(head[extMagicOffset:]) == extMagic:
+		return nil
+	}
+	return errors.Wrapf(ErrNoRootfsImage, "%s: unknown filesystem", path)
+}
+
+// SwitchPartition makes the device boot from the other root filesystem
+// partition permanently, regardless of the update state; meant for recovering
+// devices stuck with broken, but committed update. The other partition is
+// checked first to contain something bootable.
+func (d *device) SwitchPartition() error {
+	if has, err := d.HasUpdate(); err != nil {
+		return err
+	} else if has {
+		return errors.New("update in progress; it is rolled back " +
+			"automatically unless committed")
+	}
+
+	if d.rootfsFiles != nil {
+		return d.switchRootfsFile()
+	}
+
+	inactive, err := d.getInactivePartition()
+	if err != nil {
+		return err
+	}
+
+	stat, err := d.Stat(d.inactive)
+	if err != nil {
+		return errors.Wrapf(err, "can not switch partition")
+	}
+	if stat.Mode()&os.ModeDevice == 0 {
+		return errors.Errorf("can not switch partition: %s is not a device", d.inactive)
+	}
+
+	if d.luks != nil {
+		if err := d.luks.Verify(d.inactive); err != nil {
+			return errors.Wrapf(err, "can not switch partition")
+		}
+	} else if err := checkRootfsImage(d.inactive); err != nil {
+		return errors.Wrapf(err, "can not switch partition")
+	}
+
+	log.Infof("switching boot partition to %s", d.inactive)
+	return writeEnvBarrier(d, BootVars{
+		"mender_boot_part":  inactive,
+		"upgrade_available": "0",
+		"bootcount":         "0",
+	})
+}
@@ -0,0 +1,116 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFsImage(t *testing.T, file string, fs string) {
+	img := make([]byte, 4096)
+	switch fs {
+	case "ext4":
+		binary.LittleEndian.PutUint16(img[extMagicOffset:], extMagic)
+	case "squashfs":
+		copy(img, squashfsMagic)
+	}
+	assert.NoError(t, ioutil.WriteFile(file, img, 0644))
+}
+
+func TestCheckRootfsImage(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "rootfs")
+	defer os.RemoveAll(tdir)
+	img := path.Join(tdir, "img")
+
+	for _, fs := range []string{"ext4", "squashfs"} {
+		writeFsImage(t, img, fs)
+		assert.NoError(t, checkRootfsImage(img), fs)
+	}
+
+	writeFsImage(t, img, "")
+	assert.Equal(t, ErrNoRootfsImage, errors.Cause(checkRootfsImage(img)))
+
+	assert.NoError(t, ioutil.WriteFile(img, []byte("short"), 0644))
+	assert.Equal(t, ErrNoRootfsImage, errors.Cause(checkRootfsImage(img)))
+
+	assert.Error(t, checkRootfsImage(path.Join(tdir, "missing")))
+}
+
+func TestSwitchPartition(t *testing.T) {
+	oldSync := syncFilesystems
+	defer func() { syncFilesystems = oldSync }()
+
+	tdir, _ := ioutil.TempDir("", "rootfs")
+	defer os.RemoveAll(tdir)
+	part := path.Join(tdir, "part2")
+	writeFsImage(t, part, "ext4")
+
+	devInfo, err := os.Stat("/dev/null")
+	assert.NoError(t, err)
+	fileInfo, err := os.Stat(part)
+	assert.NoError(t, err)
+
+	newDev := func(env *crashingBootEnv, file os.FileInfo) *device {
+		syncFilesystems = env.sync
+		return &device{
+			BootEnvReadWriter: env,
+			partitions: &partitions{
+				StatCommander: fakeStatCommander{file: file},
+				inactive:      part,
+			},
+		}
+	}
+	bootVars := func() BootVars {
+		return BootVars{
+			"mender_boot_part":  "1",
+			"upgrade_available": "0",
+			"bootcount":         "0",
+		}
+	}
+
+	env := newCrashingBootEnv(bootVars(), -1)
+	assert.NoError(t, newDev(env, devInfo).SwitchPartition())
+	assert.Equal(t, BootVars{
+		"mender_boot_part":  "2",
+		"upgrade_available": "0",
+		"bootcount":         "0",
+	}, env.persisted)
+
+	// not a device
+	env = newCrashingBootEnv(bootVars(), -1)
+	assert.Error(t, newDev(env, fileInfo).SwitchPartition())
+	assert.Equal(t, bootVars(), env.persisted)
+
+	// nothing to boot on the other partition
+	writeFsImage(t, part, "")
+	env = newCrashingBootEnv(bootVars(), -1)
+	err = newDev(env, devInfo).SwitchPartition()
+	assert.Equal(t, ErrNoRootfsImage, errors.Cause(err))
+	assert.Equal(t, bootVars(), env.persisted)
+
+	// update in progress is rolled back by the bootloader instead
+	writeFsImage(t, part, "ext4")
+	vars := bootVars()
+	vars["upgrade_available"] = "1"
+	env = newCrashingBootEnv(vars, -1)
+	assert.Error(t, newDev(env, devInfo).SwitchPartition())
+	assert.Equal(t, "1", env.persisted["mender_boot_part"])
+}
@@ -0,0 +1,50 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// printSystemdUnit prints systemd unit running the daemon with given binary,
+// configuration file and data store. The unit is started once the network is
+// configured and the clock synchronized, as far as systemd can tell; the
+// daemon's own readiness waits (see readinessGate) cover devices where
+// network-online.target is reached before the server is reachable.
+func printSystemdUnit(out io.Writer, binary, configFile, dataStore string) {
+	start := []string{binary, "-daemon"}
+	if configFile != defaultConfFile {
+		start = append(start, "-config", configFile)
+	}
+	if dataStore != defaultDataStore {
+		start = append(start, "-data", dataStore)
+	}
+
+	fmt.Fprintf(out, `# generated by mender -systemd-unit
+[Unit]
+Description=Mender OTA update service
+Wants=network-online.target
+After=systemd-resolved.service network-online.target time-sync.target
+
+[Service]
+Type=simple
+ExecStart=%s
+Restart=on-abort
+
+[Install]
+WantedBy=multi-user.target
+`, strings.Join(start, " "))
+}
@@ -0,0 +1,35 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintSystemdUnit(t *testing.T) {
+	out := &bytes.Buffer{}
+	printSystemdUnit(out, "/usr/bin/mender", defaultConfFile, defaultDataStore)
+	assert.Contains(t, out.String(), "\nExecStart=/usr/bin/mender -daemon\n")
+	assert.Contains(t, out.String(), "\nWants=network-online.target\n")
+	assert.Contains(t, out.String(),
+		"\nAfter=systemd-resolved.service network-online.target time-sync.target\n")
+
+	out.Reset()
+	printSystemdUnit(out, "/usr/bin/mender", "/etc/mender/mender.conf", "/data/mender")
+	assert.Contains(t, out.String(), "\nExecStart=/usr/bin/mender -daemon "+
+		"-config /etc/mender/mender.conf -data /data/mender\n")
+}
@@ -0,0 +1,248 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+)
+
+// Timers in test loop run that many times faster; intervals configured in
+// seconds become milliseconds.
+const testLoopAcceleration = 1000
+
+// Key of the device in test loop; the key is generated and kept in memory,
+// never stored along with the real one.
+const testLoopKeyName = "mender-test-loop.pem"
+
+// Identity of the device in test loop, so that the server never takes it
+// for the real device.
+type testLoopIdentity struct{}
+
+func (testLoopIdentity) Get() (string, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return "mender_test_loop=" + host, nil
+}
+
+// In-memory device used by the test loop. Images are read and discarded;
+// rebooting boots into the artifact that was installed (or back into the
+// previous one after rollback) by updating the artifact info file, and
+// the daemon starts over, as it would after real reboot.
+type memDevice struct {
+	store            Store
+	artifactInfoFile string
+
+	artifact string
+	previous string
+	// boot flags
+	upgradeAvailable bool
+	bootNew          bool
+	bootPrevious     bool
+}
+
+func newMemDevice(store Store, artifactInfoFile, artifact string) (*memDevice, error) {
+	d := &memDevice{
+		store:            store,
+		artifactInfoFile: artifactInfoFile,
+	}
+	return d, d.boot(artifact)
+}
+
+func (d *memDevice) boot(artifact string) error {
+	d.previous, d.artifact = d.artifact, artifact
+	return ioutil.WriteFile(d.artifactInfoFile,
+		[]byte(fmt.Sprintf("artifact_name=%s\n", artifact)), 0644)
+}
+
+func (d *memDevice) InstallUpdate(image io.ReadCloser, size int64) error {
+	n, err := io.Copy(ioutil.Discard, image)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return errors.Errorf("image size mismatch: read %d, expected %d", n, size)
+	}
+	return nil
+}
+
+func (d *memDevice) EnableUpdatedPartition() error {
+	d.upgradeAvailable = true
+	d.bootNew = true
+	return nil
+}
+
+func (d *memDevice) CommitUpdate() error {
+	d.upgradeAvailable = false
+	return nil
+}
+
+func (d *memDevice) Rollback() error {
+	d.upgradeAvailable = false
+	d.bootNew = false
+	d.bootPrevious = true
+	return nil
+}
+
+func (d *memDevice) HasUpdate() (bool, error) {
+	return d.upgradeAvailable, nil
+}
+
+func (d *memDevice) Reboot() error {
+	switch {
+	case d.bootNew:
+		// the new artifact carries its own artifact info
+		sd, err := LoadStateData(d.store)
+		if err != nil {
+			return errors.Wrapf(err, "no update to boot into")
+		}
+		if err := d.boot(sd.UpdateInfo.ArtifactName()); err != nil {
+			return err
+		}
+	case d.bootPrevious:
+		if err := d.boot(d.previous); err != nil {
+			return err
+		}
+	}
+	d.bootNew = false
+	d.bootPrevious = false
+	return nil
+}
+
+type testLoop struct {
+	daemon       *menderDaemon
+	mender       *mender
+	device       *memDevice
+	artifactInfo string
+}
+
+// Sets up the daemon running against in-memory device and data store, with
+// accelerated timers and strict resource auditing, for soak testing the
+// state machine with thousands of update cycles.
+func newTestLoop(config MenderConfig, dataStore string) (*testLoop, error) {
+	// rebooting is simulated by the device
+	config.RebootMode = rebootModeSelf
+	// the device must not be moved to a real server either
+	config.MigrationServerURL = ""
+
+	store := utils.NewMemStore()
+	authmgr := NewAuthManager(AuthManagerConfig{
+		AuthDataStore:  store,
+		KeyStore:       NewKeystore(store, testLoopKeyName),
+		IdentitySource: testLoopIdentity{},
+	})
+	if authmgr == nil {
+		return nil, errors.New("error initializing authentication manager")
+	}
+
+	scratch := newScratchDir(&config, dataStore)
+	if err := scratch.prepare(); err != nil {
+		return nil, err
+	}
+	info, err := scratch.TempFile("mender-test-loop", 0)
+	if err != nil {
+		return nil, err
+	}
+	info.Close()
+
+	dev, err := newMemDevice(store, info.Name(),
+		GetCurrentArtifactName(defaultArtifactInfoFile))
+	if err != nil {
+		os.Remove(info.Name())
+		return nil, err
+	}
+
+	m, err := NewMender(config, MenderPieces{
+		device:  dev,
+		store:   store,
+		authMgr: authmgr,
+		scratch: scratch,
+	})
+	if m == nil {
+		os.Remove(info.Name())
+		return nil, errors.Wrap(err, "error initializing mender controller")
+	}
+	m.artifactInfoFile = info.Name()
+	// leave the real update marker and applications alone
+	m.updateMarkerFile = ""
+	m.commitHolds.dir = ""
+	m.cmdr = nil
+
+	m.logManager = NewDeploymentLogManager(dataStore)
+
+	d := NewDaemon(m, store)
+	d.sctx.logManager = m.logManager
+	d.events = m.events
+	d.audit = newResourceAudit(true)
+	d.guard.disabled = true
+
+	return &testLoop{
+		daemon:       d,
+		mender:       m,
+		device:       dev,
+		artifactInfo: info.Name(),
+	}, nil
+}
+
+// Runs the daemon through `boots` simulated boots, or until it fails if
+// `boots` is 0.
+func (l *testLoop) Run(boots int) error {
+	l.daemon.sctx.timerAcceleration = testLoopAcceleration
+
+	for boot := 1; boots == 0 || boot <= boots; boot++ {
+		if err := l.daemon.Run(); err != nil {
+			return err
+		}
+		if l.daemon.shouldStop() {
+			return nil
+		}
+		log.Infof("test loop: boot %d, running %s", boot, l.device.artifact)
+		l.mender.SetState(initState)
+	}
+	return nil
+}
+
+func (l *testLoop) Close() {
+	l.daemon.Cleanup()
+	os.Remove(l.artifactInfo)
+}
+
+// Runs the test loop against `server`, which must not be the server the
+// device is configured with.
+func runTestLoop(config *MenderConfig, dataStore, server string) error {
+	if strings.TrimRight(server, "/") == strings.TrimRight(config.ServerURL, "/") {
+		return errors.Errorf("refusing to run test loop against the configured "+
+			"server %s", config.ServerURL)
+	}
+	log.Warnf("running test loop against %s: in-memory device, timers "+
+		"accelerated %d times", server, testLoopAcceleration)
+
+	testConfig := *config
+	testConfig.ServerURL = server
+	l, err := newTestLoop(testConfig, dataStore)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return l.Run(0)
+}
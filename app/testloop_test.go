@@ -0,0 +1,242 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender-artifact/parser"
+	"github.com/mendersoftware/mender-artifact/test_utils"
+	"github.com/mendersoftware/mender-artifact/writer"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemDevice(t *testing.T) {
+	info, err := ioutil.TempFile("", "artifact_info")
+	assert.NoError(t, err)
+	info.Close()
+	defer os.Remove(info.Name())
+
+	store := utils.NewMemStore()
+	d, err := newMemDevice(store, info.Name(), "release-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "release-1", GetCurrentArtifactName(info.Name()))
+
+	image := ioutil.NopCloser(bytes.NewBufferString("image"))
+	assert.NoError(t, d.InstallUpdate(image, 5))
+	image = ioutil.NopCloser(bytes.NewBufferString("image"))
+	assert.Error(t, d.InstallUpdate(image, 6))
+
+	// boot into new artifact
+	update := client.UpdateResponse{ID: "foo"}
+	update.Artifact.ArtifactName = "release-2"
+	assert.NoError(t, StoreStateData(store, StateData{
+		Name:       MenderStateReboot,
+		UpdateInfo: update,
+	}))
+	assert.NoError(t, d.EnableUpdatedPartition())
+	assert.NoError(t, d.Reboot())
+	has, _ := d.HasUpdate()
+	assert.True(t, has)
+	assert.Equal(t, "release-2", GetCurrentArtifactName(info.Name()))
+
+	// roll back
+	assert.NoError(t, d.Rollback())
+	has, _ = d.HasUpdate()
+	assert.False(t, has)
+	assert.NoError(t, d.Reboot())
+	assert.Equal(t, "release-1", GetCurrentArtifactName(info.Name()))
+
+	// plain reboot keeps the artifact
+	assert.NoError(t, d.Reboot())
+	assert.Equal(t, "release-1", GetCurrentArtifactName(info.Name()))
+}
+
+func TestTimerAcceleration(t *testing.T) {
+	sctx := &StateContext{
+		context:           context.Background(),
+		timerAcceleration: testLoopAcceleration,
+	}
+	cs := NewCancellableState(BaseState{})
+	start := time.Now()
+	assert.True(t, cs.Wait(sctx.Context(), 10*time.Second))
+	assert.True(t, time.Since(start) < time.Second)
+
+	// not accelerated otherwise
+	assert.Equal(t, 10*time.Second, acceleratedWait(context.Background(), 10*time.Second))
+	sctx.timerAcceleration = 0
+	assert.Equal(t, 10*time.Second, acceleratedWait(sctx.Context(), 10*time.Second))
+}
+
+func TestTestLoopArgs(t *testing.T) {
+	_, err := argsParse([]string{"-test-loop"})
+	assert.Error(t, err)
+
+	// test server must be given
+	_, err = argsParse([]string{"-daemon", "-test-loop"})
+	assert.Error(t, err)
+
+	opts, err := argsParse([]string{"-daemon", "-test-loop",
+		"-test-loop-server", "https://test.mender.io"})
+	assert.NoError(t, err)
+	assert.True(t, *opts.testLoop)
+	assert.Equal(t, "https://test.mender.io", *opts.testLoopServer)
+}
+
+func TestTestLoopServer(t *testing.T) {
+	config := &MenderConfig{ServerURL: "https://hosted.mender.io"}
+	err := runTestLoop(config, "/nonexistent", "https://hosted.mender.io/")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "refusing")
+
+	identity, err := testLoopIdentity{}.Get()
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(identity, "mender_test_loop="))
+}
+
+func writeTestArtifact(t *testing.T, dir, name string) string {
+	updateDir := path.Join(dir, name)
+	assert.NoError(t, tutils.MakeFakeUpdateDir(updateDir, tutils.RootfsImageStructOK))
+
+	aw := awriter.NewWriter("mender", 1, []string{"vexpress-qemu"}, name)
+	aw.Register(&parser.RootfsParser{})
+	artifact := path.Join(dir, name+".mender")
+	assert.NoError(t, aw.Write(updateDir, artifact))
+	return artifact
+}
+
+// Fake server deploying two artifacts in turn, until `deployments`
+// deployments succeed.
+type soakServer struct {
+	lock        sync.Mutex
+	artifacts   map[string]string
+	deployments int
+	started     int
+	succeeded   int
+	failed      int
+	done        func()
+}
+
+func (s *soakServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	p := strings.TrimPrefix(r.URL.Path, "/api/devices/v1")
+	switch {
+	case p == "/authentication/auth_requests":
+		w.Write([]byte("token"))
+
+	case p == "/inventory/device/attributes":
+
+	case p == "/deployments/device/deployments/next":
+		if s.succeeded >= s.deployments {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		name := "release-1"
+		if r.URL.Query().Get("artifact_name") == name {
+			name = "release-2"
+		}
+		s.started++
+		var update client.UpdateResponse
+		update.ID = fmt.Sprintf("deployment-%d", s.started)
+		update.Artifact.ArtifactName = name
+		update.Artifact.CompatibleDevices = []string{"vexpress-qemu"}
+		update.Artifact.Source.URI = "http://" + r.Host + "/artifacts/" + name
+		data, _ := json.Marshal(update)
+		w.Write(data)
+
+	case strings.HasSuffix(p, "/status"):
+		var report client.StatusReport
+		json.NewDecoder(r.Body).Decode(&report)
+		switch report.Status {
+		case client.StatusSuccess:
+			s.succeeded++
+			if s.succeeded == s.deployments {
+				s.done()
+			}
+		case client.StatusFailure:
+			s.failed++
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case strings.HasSuffix(p, "/log"):
+		w.WriteHeader(http.StatusNoContent)
+
+	case strings.HasPrefix(p, "/artifacts/"):
+		http.ServeFile(w, r, s.artifacts[path.Base(p)])
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// Long-haul run of the test loop through 1000 consecutive deployments,
+// checking that resource usage does not keep growing.
+func TestTestLoopSoak(t *testing.T) {
+	if testing.Short() || os.Getenv("MENDER_SOAK_TEST") != "1" {
+		t.Skip("soak test runs with MENDER_SOAK_TEST=1 only (make soaktest)")
+	}
+
+	tdir, err := ioutil.TempDir("", "soak")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	srv := &soakServer{
+		artifacts: map[string]string{
+			"release-1": writeTestArtifact(t, tdir, "release-1"),
+			"release-2": writeTestArtifact(t, tdir, "release-2"),
+		},
+		deployments: 1000,
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	l, err := newTestLoop(MenderConfig{
+		ServerURL:                    ts.URL,
+		UpdatePollIntervalSeconds:    1,
+		InventoryPollIntervalSeconds: 1,
+		RetryPollIntervalSeconds:     1,
+	}, tdir)
+	assert.NoError(t, err)
+	defer l.Close()
+	srv.done = l.daemon.StopDaemon
+
+	deviceType := path.Join(tdir, "device_type")
+	assert.NoError(t, ioutil.WriteFile(deviceType,
+		[]byte("device_type=vexpress-qemu\n"), 0644))
+	l.mender.deviceTypeFile = deviceType
+
+	assert.NoError(t, l.Run(0))
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	assert.Equal(t, srv.deployments, srv.succeeded)
+	assert.Equal(t, 0, srv.failed)
+	assert.True(t, l.daemon.audit.cycles >= srv.deployments)
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package testutils provides fakes of the device and update client the mender
+// agent is built on, for unit testing code embedding the agent or
+// implementing update modules against the same contracts the core uses.
+//
+// There is no fake of the state machine controller (app.Controller): its
+// methods use types internal to the app package, so it can only be faked
+// within that package, and the tests of the app package import this one.
+package testutils
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/mendersoftware/mender/installer"
+)
+
+// FakeDevice stands for the device the update is installed on; methods return
+// the values set in the corresponding fields.
+type FakeDevice struct {
+	RetReboot         error
+	RetInstallUpdate  error
+	RetEnablePart     error
+	RetCommit         error
+	RetRollback       error
+	RetHasUpdate      bool
+	RetHasUpdateError error
+	// read whole image when installing update, instead of returning
+	// RetInstallUpdate
+	ConsumeUpdate bool
+}
+
+var _ installer.UInstaller = FakeDevice{}
+
+func (f FakeDevice) Reboot() error {
+	return f.RetReboot
+}
+
+func (f FakeDevice) Rollback() error {
+	return f.RetRollback
+}
+
+func (f FakeDevice) InstallUpdate(from io.ReadCloser, sz int64) error {
+	if f.ConsumeUpdate {
+		_, err := io.Copy(ioutil.Discard, from)
+		return err
+	}
+	return f.RetInstallUpdate
+}
+
+func (f FakeDevice) EnableUpdatedPartition() error {
+	return f.RetEnablePart
+}
+
+func (f FakeDevice) CommitUpdate() error {
+	return f.RetCommit
+}
+
+func (f FakeDevice) HasUpdate() (bool, error) {
+	return f.RetHasUpdate, f.RetHasUpdateError
+}
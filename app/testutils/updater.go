@@ -0,0 +1,63 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package testutils
+
+import (
+	"context"
+	"io"
+
+	"github.com/mendersoftware/mender/client"
+)
+
+// FakeUpdater replaces the deployments client; methods return the values set
+// in the corresponding fields without talking to the server.
+type FakeUpdater struct {
+	GetScheduledUpdateReturnIface     interface{}
+	GetScheduledUpdateReturnError     error
+	FetchUpdateReturnReadCloser       io.ReadCloser
+	FetchUpdateReturnSize             int64
+	FetchUpdateReturnError            error
+	FetchUpdateHeaderReturnReadCloser io.ReadCloser
+	FetchUpdateHeaderReturnError      error
+	CheckArtifactReturnError          error
+	FetchUpdateFromReturnReadCloser   io.ReadCloser
+	FetchUpdateFromReturnError        error
+}
+
+var _ client.Updater = FakeUpdater{}
+
+func (f FakeUpdater) GetScheduledUpdate(ctx context.Context, api client.ApiRequester,
+	url string, current client.CurrentUpdate) (interface{}, error) {
+	return f.GetScheduledUpdateReturnIface, f.GetScheduledUpdateReturnError
+}
+
+func (f FakeUpdater) FetchUpdate(ctx context.Context, api client.ApiRequester,
+	url string) (io.ReadCloser, int64, error) {
+	return f.FetchUpdateReturnReadCloser, f.FetchUpdateReturnSize, f.FetchUpdateReturnError
+}
+
+func (f FakeUpdater) FetchUpdateHeader(ctx context.Context, api client.ApiRequester,
+	url string, size int64) (io.ReadCloser, error) {
+	return f.FetchUpdateHeaderReturnReadCloser, f.FetchUpdateHeaderReturnError
+}
+
+func (f FakeUpdater) CheckArtifact(ctx context.Context, api client.ApiRequester,
+	url string) error {
+	return f.CheckArtifactReturnError
+}
+
+func (f FakeUpdater) FetchUpdateFrom(ctx context.Context, api client.ApiRequester,
+	url string, offset int64) (io.ReadCloser, error) {
+	return f.FetchUpdateFromReturnReadCloser, f.FetchUpdateFromReturnError
+}
@@ -0,0 +1,208 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// Measured boot support: SHA-256 digest of the artifact is extended into
+// a TPM PCR when the artifact is installed and again when it is committed,
+// and a quote of the PCR signed with the attestation key is reported in
+// inventory, so that the server can verify which artifact the device is
+// running. The TPM is accessed with tpm2-tools.
+const (
+	tpmExtendTool = "tpm2_pcrextend"
+	tpmQuoteTool  = "tpm2_quote"
+
+	// digest of the installed, not yet committed artifact
+	tpmPendingDigestName = "tpm-pending-digest"
+	// digest of the committed artifact
+	tpmMeasuredDigestName = "tpm-measured-digest"
+
+	// PCRs available for measurements; PCR 0 belongs to firmware
+	tpmMinPCR = 1
+	tpmMaxPCR = 23
+)
+
+type tpmMeasurement struct {
+	pcr       int
+	akContext string
+	// directory for quote output files; system default if empty
+	dir   string
+	cmdr  Commander
+	store Store
+}
+
+// Returns nil measurement if no PCR is configured.
+func newTPMMeasurement(config MenderConfig, store Store,
+	scratch *scratchDir) (*tpmMeasurement, error) {
+	if config.TPMMeasurementPCR == 0 {
+		return nil, nil
+	}
+	if config.TPMMeasurementPCR < tpmMinPCR || config.TPMMeasurementPCR > tpmMaxPCR {
+		return nil, errors.Errorf("invalid TPM measurement PCR %d, expected %d-%d",
+			config.TPMMeasurementPCR, tpmMinPCR, tpmMaxPCR)
+	}
+	t := &tpmMeasurement{
+		pcr:       config.TPMMeasurementPCR,
+		akContext: config.TPMAttestationKey,
+		cmdr:      &osCalls{},
+		store:     store,
+	}
+	if scratch != nil {
+		t.dir = scratch.path
+	}
+	return t, nil
+}
+
+func (t *tpmMeasurement) extend(digest string) error {
+	out, err := t.cmdr.Command(tpmExtendTool,
+		fmt.Sprintf("%d:sha256=%s", t.pcr, digest)).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "failed to extend PCR %d: %s",
+			t.pcr, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Artifact being installed is hashed on the fly.
+func (t *tpmMeasurement) hashArtifact(from io.ReadCloser) (io.ReadCloser, hash.Hash) {
+	h := sha256.New()
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(from, h), from}, h
+}
+
+// installed measures the artifact just written to the device and keeps its
+// digest until the update is committed.
+func (t *tpmMeasurement) installed(h hash.Hash) {
+	digest := hex.EncodeToString(h.Sum(nil))
+	log.Infof("measuring installed artifact %s into PCR %d", digest, t.pcr)
+	if err := t.extend(digest); err != nil {
+		log.Errorf("%v", err)
+	}
+	if err := t.store.WriteAll(tpmPendingDigestName, []byte(digest)); err != nil {
+		log.Errorf("failed to store digest of installed artifact: %v", err)
+	}
+}
+
+// committed measures the committed artifact again; the PCR was reset by
+// the reboot into it.
+func (t *tpmMeasurement) committed() {
+	digest, err := t.store.ReadAll(tpmPendingDigestName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("failed to read digest of installed artifact: %v", err)
+		}
+		return
+	}
+	log.Infof("measuring committed artifact %s into PCR %d", digest, t.pcr)
+	if err := t.extend(string(digest)); err != nil {
+		log.Errorf("%v", err)
+	}
+	if err := t.store.WriteAll(tpmMeasuredDigestName, digest); err != nil {
+		log.Errorf("failed to store digest of committed artifact: %v", err)
+		return
+	}
+	t.store.Remove(tpmPendingDigestName)
+}
+
+type tpmQuote struct {
+	Message   []byte `json:"message"`
+	Signature []byte `json:"signature"`
+}
+
+// quote returns quote of the measurement PCR with nonce as qualifying data.
+func (t *tpmMeasurement) quote(nonce string) (*tpmQuote, error) {
+	msg, err := ioutil.TempFile(t.dir, "tpm-quote")
+	if err != nil {
+		return nil, err
+	}
+	msg.Close()
+	defer os.Remove(msg.Name())
+	sig, err := ioutil.TempFile(t.dir, "tpm-quote-sig")
+	if err != nil {
+		return nil, err
+	}
+	sig.Close()
+	defer os.Remove(sig.Name())
+
+	out, err := t.cmdr.Command(tpmQuoteTool,
+		"-c", t.akContext,
+		"-l", fmt.Sprintf("sha256:%d", t.pcr),
+		"-q", nonce,
+		"-m", msg.Name(),
+		"-s", sig.Name()).CombinedOutput()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to quote PCR %d: %s",
+			t.pcr, strings.TrimSpace(string(out)))
+	}
+
+	var q tpmQuote
+	if q.Message, err = ioutil.ReadFile(msg.Name()); err != nil {
+		return nil, err
+	}
+	if q.Signature, err = ioutil.ReadFile(sig.Name()); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// inventoryAttributes returns digest of the committed artifact, and if the
+// attestation key is configured, quote over it.
+func (t *tpmMeasurement) inventoryAttributes() []client.InventoryAttribute {
+	digest, err := t.store.ReadAll(tpmMeasuredDigestName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("failed to read digest of committed artifact: %v", err)
+		}
+		return nil
+	}
+	attrs := []client.InventoryAttribute{
+		{Name: "mender_tpm_pcr", Value: fmt.Sprintf("%d", t.pcr)},
+		{Name: "mender_tpm_artifact_digest", Value: string(digest)},
+	}
+	if t.akContext == "" {
+		return attrs
+	}
+
+	q, err := t.quote(string(digest))
+	if err != nil {
+		log.Errorf("%v", err)
+		return attrs
+	}
+	data, err := json.Marshal(q)
+	if err != nil {
+		return attrs
+	}
+	attrs = append(attrs, client.InventoryAttribute{
+		Name:  "mender_tpm_quote",
+		Value: string(data),
+	})
+	return attrs
+}
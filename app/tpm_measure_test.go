@@ -0,0 +1,179 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/mendersoftware/mender/app/testutils"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// Fake tpm2-tools recording command lines; quote writes fixed message and
+// signature to the output files.
+type fakeTPMTools struct {
+	calls []string
+	fail  bool
+}
+
+func (f *fakeTPMTools) Command(name string, arg ...string) *exec.Cmd {
+	f.calls = append(f.calls, strings.Join(append([]string{name}, arg...), " "))
+	if f.fail {
+		return exec.Command("/bin/sh", "-c", "echo no TPM; exit 1")
+	}
+	script := "true"
+	if name == tpmQuoteTool {
+		var msg, sig string
+		for i := 0; i+1 < len(arg); i++ {
+			switch arg[i] {
+			case "-m":
+				msg = arg[i+1]
+			case "-s":
+				sig = arg[i+1]
+			}
+		}
+		script = "echo -n quoted > " + msg + "; echo -n signed > " + sig
+	}
+	return exec.Command("/bin/sh", "-c", script)
+}
+
+func TestTPMMeasurementConfig(t *testing.T) {
+	tm, err := newTPMMeasurement(MenderConfig{}, utils.NewMemStore(), nil)
+	assert.NoError(t, err)
+	assert.Nil(t, tm)
+
+	for _, pcr := range []int{-1, 24} {
+		_, err = newTPMMeasurement(MenderConfig{TPMMeasurementPCR: pcr},
+			utils.NewMemStore(), nil)
+		assert.Error(t, err)
+	}
+
+	scratch := &scratchDir{path: "/data/mender/scratch"}
+	tm, err = newTPMMeasurement(MenderConfig{TPMMeasurementPCR: 9},
+		utils.NewMemStore(), scratch)
+	assert.NoError(t, err)
+	assert.Equal(t, 9, tm.pcr)
+	assert.Equal(t, scratch.path, tm.dir)
+}
+
+func TestTPMMeasurement(t *testing.T) {
+	store := utils.NewMemStore()
+	tools := &fakeTPMTools{}
+	tm, _ := newTPMMeasurement(MenderConfig{
+		TPMMeasurementPCR: 9,
+		TPMAttestationKey: "/data/mender/ak.ctx",
+	}, store, nil)
+	tm.cmdr = tools
+
+	// nothing measured yet
+	assert.Empty(t, tm.inventoryAttributes())
+	tm.committed()
+	assert.Empty(t, tools.calls)
+
+	artifact := []byte("artifact data")
+	sum := sha256.Sum256(artifact)
+	digest := hex.EncodeToString(sum[:])
+
+	r, h := tm.hashArtifact(ioutil.NopCloser(bytes.NewReader(artifact)))
+	ioutil.ReadAll(r)
+	tm.installed(h)
+	assert.Equal(t, []string{"tpm2_pcrextend 9:sha256=" + digest}, tools.calls)
+	// not committed yet
+	assert.Empty(t, tm.inventoryAttributes())
+
+	tm.committed()
+	assert.Len(t, tools.calls, 2)
+	assert.Equal(t, tools.calls[0], tools.calls[1])
+
+	attrs := tm.inventoryAttributes()
+	assert.Len(t, attrs, 3)
+	assert.Equal(t, client.InventoryAttribute{Name: "mender_tpm_pcr", Value: "9"}, attrs[0])
+	assert.Equal(t, client.InventoryAttribute{
+		Name: "mender_tpm_artifact_digest", Value: digest}, attrs[1])
+	assert.Equal(t, "mender_tpm_quote", attrs[2].Name)
+	var q tpmQuote
+	assert.NoError(t, json.Unmarshal([]byte(attrs[2].Value.(string)), &q))
+	assert.Equal(t, tpmQuote{Message: []byte("quoted"), Signature: []byte("signed")}, q)
+	assert.Contains(t, tools.calls[2], "tpm2_quote -c /data/mender/ak.ctx -l sha256:9 -q "+digest)
+
+	// commit without install does not measure again
+	tm.committed()
+	assert.Len(t, tools.calls, 3)
+
+	// TPM failures do not fail the update, quote is left out
+	tools.fail = true
+	r, h = tm.hashArtifact(ioutil.NopCloser(bytes.NewReader(artifact)))
+	ioutil.ReadAll(r)
+	tm.installed(h)
+	tm.committed()
+	attrs = tm.inventoryAttributes()
+	assert.Len(t, attrs, 2)
+}
+
+func TestMenderTPMMeasurement(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	name := writeTestArtifact(t, tdir, "release-1")
+	artifact, err := ioutil.ReadFile(name)
+	assert.NoError(t, err)
+	sum := sha256.Sum256(artifact)
+
+	store := utils.NewMemStore()
+	m := newTestMender(nil, MenderConfig{TPMMeasurementPCR: 9}, testMenderPieces{
+		MenderPieces: MenderPieces{
+			device: &testutils.FakeDevice{ConsumeUpdate: true},
+			store:  store,
+		},
+	})
+	assert.NotNil(t, m)
+	tools := &fakeTPMTools{}
+	m.tpm.cmdr = tools
+	m.deviceTypeFile = path.Join(tdir, "device_type")
+	assert.NoError(t, ioutil.WriteFile(m.deviceTypeFile,
+		[]byte("device_type=vexpress-qemu\n"), 0644))
+
+	assert.NoError(t, m.InstallArtifact(client.UpdateResponse{},
+		ioutil.NopCloser(bytes.NewReader(artifact)), 0))
+	assert.NoError(t, m.CommitUpdate())
+
+	// digest of the artifact as stored on the server
+	measured, err := store.ReadAll(tpmMeasuredDigestName)
+	assert.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(sum[:]), string(measured))
+	assert.Len(t, tools.calls, 2)
+
+	// failed commit is not measured
+	errCommit := errors.New("commit failed")
+	m.UInstallCommitRebooter = &testutils.FakeDevice{
+		ConsumeUpdate: true,
+		RetCommit:     errCommit,
+	}
+	assert.NoError(t, m.InstallArtifact(client.UpdateResponse{},
+		ioutil.NopCloser(bytes.NewReader(artifact)), 0))
+	assert.Equal(t, errCommit, m.CommitUpdate())
+	assert.Len(t, tools.calls, 3)
+}
@@ -0,0 +1,108 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/pkg/errors"
+)
+
+// States of the update marker.
+const (
+	// device booted into the new artifact, but the update is not committed
+	// yet; it will be rolled back if anything goes wrong
+	updateMarkerUncommitted = "uncommitted"
+	// the update is committed, device stays with the new artifact
+	updateMarkerCommitted = "committed"
+	// the update failed and the device is back with the previous artifact;
+	// whatever was done for the new one must be undone
+	updateMarkerRolledBack = "rolled-back"
+)
+
+// D-Bus signal emitted whenever the marker changes
+const updateMarkerSignal = "MarkerChanged"
+
+var defaultUpdateMarkerFile = path.Join(getStateDirPath(), "update_marker")
+
+// Update marker lets applications running on the device know that they are
+// running a freshly installed artifact, so that they can run their own
+// migrations and self-checks before or after the update is committed.
+type updateMarker struct {
+	State        string `json:"state"`
+	ArtifactName string `json:"artifact_name"`
+	DeploymentID string `json:"deployment_id"`
+	// time of booting into the new artifact or of committing the update
+	Time time.Time `json:"time"`
+}
+
+func writeUpdateMarker(file string, marker updateMarker) error {
+	data, err := json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+
+	// applications may read the marker any time; never leave it half written
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func readUpdateMarker(file string) (*updateMarker, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var marker updateMarker
+	if err := json.Unmarshal(data, &marker); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse update marker")
+	}
+	return &marker, nil
+}
+
+// Update the marker file and notify applications listening on the system bus.
+// Failures are only logged, as the marker is informational and must not
+// affect the update itself.
+func (m *mender) SetUpdateMarker(update client.UpdateResponse, state string) {
+	if m.updateMarkerFile == "" {
+		return
+	}
+
+	marker := updateMarker{
+		State:        state,
+		ArtifactName: update.ArtifactName(),
+		DeploymentID: update.ID,
+		Time:         time.Now().UTC(),
+	}
+	if err := writeUpdateMarker(m.updateMarkerFile, marker); err != nil {
+		log.Errorf("failed to write update marker %s: %v", m.updateMarkerFile, err)
+		return
+	}
+
+	m.emitSignal(updateMarkerSignal, "string:"+marker.State,
+		"string:"+marker.ArtifactName, "string:"+marker.Time.Format(time.RFC3339))
+}
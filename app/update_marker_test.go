@@ -0,0 +1,70 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetUpdateMarker(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	update := client.UpdateResponse{
+		ID: "foo",
+	}
+	update.Artifact.ArtifactName = "release-2"
+
+	mender := newDefaultTestMender()
+	cmdr := newTestOSCalls("", 0)
+	mender.cmdr = &cmdr
+
+	// disabled
+	mender.SetUpdateMarker(update, updateMarkerUncommitted)
+
+	mender.updateMarkerFile = path.Join(tdir, "update_marker")
+	mender.SetUpdateMarker(update, updateMarkerUncommitted)
+
+	marker, err := readUpdateMarker(mender.updateMarkerFile)
+	assert.NoError(t, err)
+	assert.Equal(t, updateMarkerUncommitted, marker.State)
+	assert.Equal(t, "release-2", marker.ArtifactName)
+	assert.Equal(t, "foo", marker.DeploymentID)
+	assert.WithinDuration(t, time.Now(), marker.Time, time.Minute)
+
+	// failing to emit the signal does not affect the marker
+	cmdr = newTestOSCalls("", 1)
+	mender.SetUpdateMarker(update, updateMarkerCommitted)
+
+	marker, err = readUpdateMarker(mender.updateMarkerFile)
+	assert.NoError(t, err)
+	assert.Equal(t, updateMarkerCommitted, marker.State)
+
+	_, err = os.Stat(mender.updateMarkerFile + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+
+	// directory does not exist
+	mender.updateMarkerFile = path.Join(tdir, "nonexistent", "update_marker")
+	mender.SetUpdateMarker(update, updateMarkerCommitted)
+	_, err = readUpdateMarker(mender.updateMarkerFile)
+	assert.Error(t, err)
+}
@@ -0,0 +1,47 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"time"
+)
+
+// Periodic checks (update, inventory, configuration) falling due shortly
+// after each other are run on a single wakeup of the device, instead of
+// each waking it up on its own; battery powered devices spend most of the
+// time waiting between them. The earliest check is delayed by at most the
+// window, which is a tenth of the shortest check interval, up to a minute.
+const maxWakeupCoalesceWindow = time.Minute
+
+func wakeupCoalesceWindow(intervals ...time.Duration) time.Duration {
+	window := maxWakeupCoalesceWindow
+	for _, intvl := range intervals {
+		if intvl > 0 && intvl/10 < window {
+			window = intvl / 10
+		}
+	}
+	return window
+}
+
+// coalesceWakeup returns time to wake up at to run the check due at `when`
+// together with the ones due within the window after it.
+func coalesceWakeup(when time.Time, due []time.Time, window time.Duration) time.Time {
+	wake := when
+	for _, d := range due {
+		if d.After(wake) && d.Sub(when) <= window {
+			wake = d
+		}
+	}
+	return wake
+}
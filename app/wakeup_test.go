@@ -0,0 +1,42 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWakeupCoalesceWindow(t *testing.T) {
+	assert.Equal(t, maxWakeupCoalesceWindow, wakeupCoalesceWindow())
+	assert.Equal(t, maxWakeupCoalesceWindow,
+		wakeupCoalesceWindow(30*time.Minute, 24*time.Hour))
+	assert.Equal(t, 30*time.Second,
+		wakeupCoalesceWindow(30*time.Minute, 5*time.Minute, 0))
+}
+
+func TestCoalesceWakeup(t *testing.T) {
+	now := time.Now()
+	due := []time.Time{
+		now,
+		now.Add(20 * time.Second),
+		now.Add(50 * time.Second),
+		now.Add(2 * time.Minute),
+	}
+	assert.Equal(t, now.Add(50*time.Second), coalesceWakeup(now, due, time.Minute))
+	assert.Equal(t, now, coalesceWakeup(now, due, 10*time.Second))
+	assert.Equal(t, now, coalesceWakeup(now, nil, time.Minute))
+}
@@ -0,0 +1,53 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendersoftware/log"
+)
+
+// SetTraceUntil makes the client log every request it makes, with response
+// status and time taken, until the given time; zero time stops tracing.
+// Query strings (credentials of pre-signed URLs) and headers are left out.
+func (a *ApiClient) SetTraceUntil(until time.Time) {
+	var ns int64
+	if !until.IsZero() {
+		ns = until.UnixNano()
+	}
+	atomic.StoreInt64(&a.traceUntil, ns)
+}
+
+func (a *ApiClient) tracing(now time.Time) bool {
+	until := atomic.LoadInt64(&a.traceUntil)
+	return until != 0 && now.UnixNano() < until
+}
+
+// Log the request made at start.
+func traceRequest(req *http.Request, rsp *http.Response, err error, start time.Time) {
+	u := *req.URL
+	u.RawQuery = ""
+	u.User = nil
+	took := time.Since(start)
+	if err != nil {
+		log.Infof("api trace: %s %s failed after %v: %v", req.Method, u.String(),
+			took, err)
+		return
+	}
+	log.Infof("api trace: %s %s: %s in %v, %d bytes", req.Method, u.String(),
+		rsp.Status, took, rsp.ContentLength)
+}
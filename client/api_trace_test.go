@@ -0,0 +1,61 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApiTrace(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	oldOutput := log.Log.Out
+	log.SetOutput(&buf)
+	defer log.SetOutput(oldOutput)
+
+	ac, err := New(Config{})
+	assert.NoError(t, err)
+	get := func() {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/artifact?X-Amz-Signature=secret", nil)
+		rsp, err := ac.Request("token").Do(req)
+		if assert.NoError(t, err) {
+			rsp.Body.Close()
+		}
+	}
+
+	get()
+	assert.NotContains(t, buf.String(), "api trace")
+
+	ac.SetTraceUntil(time.Now().Add(time.Hour))
+	get()
+	assert.Contains(t, buf.String(), "api trace: GET "+ts.URL+"/artifact: 204 No Content")
+	assert.NotContains(t, buf.String(), "secret")
+	assert.NotContains(t, buf.String(), "token")
+
+	buf.Reset()
+	ac.SetTraceUntil(time.Time{})
+	get()
+	assert.NotContains(t, buf.String(), "api trace")
+}
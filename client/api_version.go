@@ -0,0 +1,156 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// ApiVersion is generation of the device API used for talking to the server.
+// Endpoints which changed between generations have request codec for each of
+// them; responses are compatible.
+type ApiVersion int
+
+const (
+	// newest version supported by the server, found by trying the newest
+	// one first and falling back to older ones
+	ApiVersionAuto ApiVersion = iota
+	ApiVersion1
+	ApiVersion2
+
+	newestApiVersion = ApiVersion2
+)
+
+// after falling back to older API version, newer one is tried again after
+// this long, in case the server was upgraded meanwhile
+const apiVersionProbeInterval = time.Hour
+
+// ParseApiVersion parses API version configuration: "auto", or version
+// number with optional "v" prefix; version 1 if empty.
+func ParseApiVersion(s string) (ApiVersion, error) {
+	switch s {
+	case "":
+		return ApiVersion1, nil
+	case "auto":
+		return ApiVersionAuto, nil
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(s, "v"))
+	if err != nil || n < int(ApiVersion1) || n > int(newestApiVersion) {
+		return ApiVersion1, errors.Errorf("unsupported API version %q", s)
+	}
+	return ApiVersion(n), nil
+}
+
+func (v ApiVersion) String() string {
+	if v == ApiVersionAuto {
+		return "auto"
+	}
+	return "v" + strconv.Itoa(int(v))
+}
+
+func buildVersionedApiURL(server string, version ApiVersion, url string) string {
+	return buildURL(server) + "/api/devices/" + version.String() + "/" +
+		strings.TrimPrefix(url, "/")
+}
+
+type updateCheckCodec func(server string, current CurrentUpdate) (*http.Request, error)
+
+var updateCheckCodecs = map[ApiVersion]updateCheckCodec{
+	ApiVersion1: makeUpdateCheckRequest,
+	ApiVersion2: makeUpdateCheckRequestV2,
+}
+
+// Version 2 update check posts what the device provides, instead of passing
+// it in the query.
+func makeUpdateCheckRequestV2(server string, current CurrentUpdate) (*http.Request, error) {
+	provides := map[string]string{}
+	if current.DeviceType != "" {
+		provides["device_type"] = current.DeviceType
+	}
+	if current.Artifact != "" {
+		provides["artifact_name"] = current.Artifact
+	}
+	if current.Channel != "" {
+		provides["update_channel"] = current.Channel
+	}
+	check := map[string]interface{}{"device_provides": provides}
+	if current.Capabilities != nil {
+		check["device_capabilities"] = current.Capabilities
+	}
+	body, err := json.Marshal(check)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost,
+		buildVersionedApiURL(server, ApiVersion2, "/deployments/device/deployments/next"),
+		bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// Set API version of update checks; ApiVersionAuto negotiates it with the
+// server.
+func (u *UpdateClient) SetApiVersion(version ApiVersion) {
+	u.apiVersion = version
+	u.fallback = 0
+}
+
+// updateCheckVersion returns API version to make update check with.
+func (u *UpdateClient) updateCheckVersion(now time.Time) ApiVersion {
+	if u.apiVersion != ApiVersionAuto {
+		return u.apiVersion
+	}
+	if u.fallback != 0 && now.Before(u.probeAfter) {
+		return u.fallback
+	}
+	return newestApiVersion
+}
+
+// fallBack tells if update check should be retried with older API version
+// after the server responded with `status` to `version` request.
+func (u *UpdateClient) fallBack(version ApiVersion, status int, now time.Time) bool {
+	if u.apiVersion != ApiVersionAuto || version <= ApiVersion1 ||
+		(status != http.StatusNotFound && status != http.StatusMethodNotAllowed) {
+		return false
+	}
+	log.Infof("server does not support device API %v, falling back to %v",
+		version, version-1)
+	u.fallback = version - 1
+	u.probeAfter = now.Add(apiVersionProbeInterval)
+	return true
+}
+
+// requestKey identifies request for caching its response.
+func requestKey(req *http.Request) string {
+	key := req.Method + " " + req.URL.String()
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			data, _ := ioutil.ReadAll(body)
+			key += " " + string(data)
+		}
+	}
+	return key
+}
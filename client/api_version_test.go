@@ -0,0 +1,136 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseApiVersion(t *testing.T) {
+	for s, expected := range map[string]ApiVersion{
+		"":     ApiVersion1,
+		"1":    ApiVersion1,
+		"v2":   ApiVersion2,
+		"auto": ApiVersionAuto,
+	} {
+		v, err := ParseApiVersion(s)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, v)
+	}
+	for _, s := range []string{"0", "3", "latest"} {
+		_, err := ParseApiVersion(s)
+		assert.Error(t, err, s)
+	}
+	assert.Equal(t, "v2", ApiVersion2.String())
+}
+
+func TestUpdateCheckApiVersion(t *testing.T) {
+	v2Supported := false
+	var requests []string
+	var body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case apiPrefix + "deployments/device/deployments/next":
+			assert.Equal(t, "foo", r.URL.Query().Get("artifact_name"))
+		case "/api/devices/v2/deployments/device/deployments/next":
+			if !v2Supported {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			data, _ := ioutil.ReadAll(r.Body)
+			body = string(data)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	current := CurrentUpdate{Artifact: "foo", DeviceType: "bar"}
+	check := func(u *UpdateClient) {
+		requests = nil
+		data, err := u.GetScheduledUpdate(context.Background(), http.DefaultClient,
+			ts.URL, current)
+		assert.NoError(t, err)
+		assert.Nil(t, data)
+	}
+
+	// version 1 by default
+	u := NewUpdate()
+	check(u)
+	assert.Equal(t, []string{"GET /api/devices/v1/deployments/device/deployments/next"},
+		requests)
+
+	// negotiated, falling back to version 1
+	u.SetApiVersion(ApiVersionAuto)
+	check(u)
+	assert.Equal(t, []string{
+		"POST /api/devices/v2/deployments/device/deployments/next",
+		"GET /api/devices/v1/deployments/device/deployments/next",
+	}, requests)
+	check(u)
+	assert.Equal(t, []string{"GET /api/devices/v1/deployments/device/deployments/next"},
+		requests)
+
+	// server upgraded meanwhile
+	v2Supported = true
+	u.probeAfter = time.Now().Add(-time.Second)
+	check(u)
+	assert.Equal(t, []string{"POST /api/devices/v2/deployments/device/deployments/next"},
+		requests)
+	assert.JSONEq(t, `{"device_provides": {"artifact_name": "foo", "device_type": "bar"}}`,
+		body)
+
+	// pinned version is not negotiated
+	v2Supported = false
+	u = NewUpdate()
+	u.SetApiVersion(ApiVersion2)
+	requests = nil
+	_, err := u.GetScheduledUpdate(context.Background(), http.DefaultClient, ts.URL, current)
+	assert.Error(t, err)
+	assert.Len(t, requests, 1)
+}
+
+func TestUpdateCheckV2Conditional(t *testing.T) {
+	var ifNoneMatch string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifNoneMatch = r.Header.Get("If-None-Match")
+		w.Header().Set("ETag", `"no-update"`)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	u := NewUpdate()
+	u.SetApiVersion(ApiVersion2)
+	current := CurrentUpdate{Artifact: "foo"}
+	_, err := u.GetScheduledUpdate(context.Background(), http.DefaultClient, ts.URL, current)
+	assert.NoError(t, err)
+	assert.Equal(t, "", ifNoneMatch)
+
+	_, err = u.GetScheduledUpdate(context.Background(), http.DefaultClient, ts.URL, current)
+	assert.NoError(t, err)
+	assert.Equal(t, `"no-update"`, ifNoneMatch)
+
+	// device provides something else now, same URL notwithstanding
+	current.Artifact = "bar"
+	_, err = u.GetScheduledUpdate(context.Background(), http.DefaultClient, ts.URL, current)
+	assert.NoError(t, err)
+	assert.Equal(t, "", ifNoneMatch)
+}
@@ -15,7 +15,10 @@ package client
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -26,6 +29,71 @@ const (
 
 type AuthToken string
 
+// Claims of the token the device cares about.
+type authTokenClaims struct {
+	Exp *int64 `json:"exp"`
+	Iat *int64 `json:"iat"`
+	Sub string `json:"sub"`
+}
+
+// The token is a JWT, but it is opaque to the device; the signature is not
+// verified here, only the server can do that.
+func (t AuthToken) claims() (*authTokenClaims, error) {
+	parts := strings.Split(strings.TrimSpace(string(t)), ".")
+	if len(parts) != 3 {
+		return nil, errors.New("auth token is not a JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode auth token claims")
+	}
+
+	var claims authTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse auth token claims")
+	}
+	return &claims, nil
+}
+
+// Expiry returns the expiration time found in the `exp` claim of the token.
+func (t AuthToken) Expiry() (time.Time, error) {
+	claims, err := t.claims()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if claims.Exp == nil {
+		return time.Time{}, errors.New("auth token has no expiration time")
+	}
+	return time.Unix(*claims.Exp, 0), nil
+}
+
+// IssuedAt returns the time the token was issued at, found in the `iat` claim
+// of the token.
+func (t AuthToken) IssuedAt() (time.Time, error) {
+	claims, err := t.claims()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if claims.Iat == nil {
+		return time.Time{}, errors.New("auth token has no issue time")
+	}
+	return time.Unix(*claims.Iat, 0), nil
+}
+
+// DeviceID returns the ID the server knows the device by, found in the `sub`
+// claim of the token.
+func (t AuthToken) DeviceID() (string, error) {
+	claims, err := t.claims()
+	if err != nil {
+		return "", err
+	}
+	if claims.Sub == "" {
+		return "", errors.New("auth token has no subject")
+	}
+	return claims.Sub, nil
+}
+
 // Structure representing authorization request data. The caller must fill each
 // field.
 type AuthReqData struct {
@@ -35,6 +103,11 @@ type AuthReqData struct {
 	TenantToken string `json:"tenant_token"`
 	// client's public key
 	Pubkey string `json:"pubkey"`
+	// optional details letting server operators tell pending devices
+	// apart, eg. to accept only known client versions
+	ClientVersion string `json:"client_version,omitempty"`
+	ArtifactName  string `json:"artifact_name,omitempty"`
+	DeviceType    string `json:"device_type,omitempty"`
 }
 
 // Produce a raw byte sequence with authorization data encoded in a format
@@ -0,0 +1,79 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeJWT(claims string) AuthToken {
+	enc := base64.RawURLEncoding
+	return AuthToken(enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) +
+		"." + enc.EncodeToString([]byte(claims)) +
+		"." + enc.EncodeToString([]byte("signature")))
+}
+
+func TestAuthTokenExpiry(t *testing.T) {
+	exp, err := makeJWT(`{"sub":"device","exp":1500000000}`).Expiry()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Unix(1500000000, 0), exp)
+
+	// trailing newline as read from the store
+	exp, err = (makeJWT(`{"exp":1500000000}`) + "\n").Expiry()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Unix(1500000000, 0), exp)
+
+	_, err = makeJWT(`{"sub":"device"}`).Expiry()
+	assert.Error(t, err)
+
+	_, err = makeJWT(`garbage`).Expiry()
+	assert.Error(t, err)
+
+	_, err = AuthToken("footoken").Expiry()
+	assert.Error(t, err)
+
+	_, err = AuthToken("a.!!!.b").Expiry()
+	assert.Error(t, err)
+
+	_, err = EmptyAuthToken.Expiry()
+	assert.Error(t, err)
+}
+
+func TestAuthTokenIssuedAt(t *testing.T) {
+	iat, err := makeJWT(`{"iat":1500000000,"exp":1500600000}`).IssuedAt()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Unix(1500000000, 0), iat)
+
+	_, err = makeJWT(`{"exp":1500600000}`).IssuedAt()
+	assert.Error(t, err)
+
+	_, err = AuthToken("footoken").IssuedAt()
+	assert.Error(t, err)
+}
+
+func TestAuthTokenDeviceID(t *testing.T) {
+	id, err := makeJWT(`{"sub":"5a3b8c1d","exp":1500600000}`).DeviceID()
+	assert.NoError(t, err)
+	assert.Equal(t, "5a3b8c1d", id)
+
+	_, err = makeJWT(`{"exp":1500600000}`).DeviceID()
+	assert.Error(t, err)
+
+	_, err = AuthToken("footoken").DeviceID()
+	assert.Error(t, err)
+}
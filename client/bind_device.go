@@ -0,0 +1,57 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Bind sockets of this client to network interface with given name, so that
+// traffic goes out through it regardless of the routing table, eg. over the
+// management network of a multi-homed gateway. Naming a VRF device binds the
+// sockets to the VRF. Empty name leaves sockets unbound.
+func (a *ApiClient) SetBindDevice(device string) error {
+	if device == "" {
+		a.dialer.Control = nil
+		return nil
+	}
+	if len(device) >= unix.IFNAMSIZ {
+		return errors.Errorf("invalid network interface name %q", device)
+	}
+	if _, err := net.InterfaceByName(device); err != nil {
+		// may be brought up later
+		log.Warnf("network interface %s not found: %v", device, err)
+	}
+	a.dialer.Control = bindToDevice(device)
+	return nil
+}
+
+func bindToDevice(device string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET,
+				unix.SO_BINDTODEVICE, device)
+		})
+		if err != nil {
+			return err
+		}
+		return errors.Wrapf(serr, "failed to bind socket to %s", device)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetBindDevice(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	api, err := New(Config{})
+	assert.NoError(t, err)
+	assert.Error(t, api.SetBindDevice("much-too-long-interface"))
+	assert.Nil(t, api.dialer.Control)
+
+	if os.Geteuid() != 0 {
+		t.Skip("binding sockets to device requires root")
+	}
+
+	assert.NoError(t, api.SetBindDevice("lo"))
+	rsp, err := api.Get(ts.URL)
+	assert.NoError(t, err)
+	if rsp != nil {
+		assert.Equal(t, http.StatusNoContent, rsp.StatusCode)
+		rsp.Body.Close()
+	}
+
+	// fresh client, not reusing the connection kept alive
+	api, _ = New(Config{})
+	assert.NoError(t, api.SetBindDevice("nosuchdev0"))
+	_, err = api.Get(ts.URL)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to bind socket to nosuchdev0")
+
+	assert.NoError(t, api.SetBindDevice(""))
+	rsp, err = api.Get(ts.URL)
+	assert.NoError(t, err)
+	if rsp != nil {
+		rsp.Body.Close()
+	}
+}
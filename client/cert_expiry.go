@@ -0,0 +1,91 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Certificate with its validity end, for checking certificates the device
+// depends on for approaching expiry.
+type CertExpiry struct {
+	// where the certificate comes from: server, or file it was loaded from
+	Source   string
+	Subject  string
+	NotAfter time.Time
+}
+
+func newCertExpiry(source string, cert *x509.Certificate) CertExpiry {
+	return CertExpiry{
+		Source:   source,
+		Subject:  cert.Subject.CommonName,
+		NotAfter: cert.NotAfter,
+	}
+}
+
+// LoadCertExpiry returns validity of all certificates found in PEM file.
+func LoadCertExpiry(file string) ([]CertExpiry, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []CertExpiry
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse certificate in %s", file)
+		}
+		certs = append(certs, newCertExpiry(file, cert))
+	}
+	return certs, nil
+}
+
+// Remember certificate chain presented by the server.
+func (a *ApiClient) recordServerCerts(rsp *http.Response) {
+	if rsp == nil || rsp.TLS == nil || len(rsp.TLS.PeerCertificates) == 0 {
+		return
+	}
+
+	certs := make([]CertExpiry, 0, len(rsp.TLS.PeerCertificates))
+	for _, cert := range rsp.TLS.PeerCertificates {
+		certs = append(certs, newCertExpiry("server", cert))
+	}
+
+	a.certsLock.Lock()
+	a.serverCerts = certs
+	a.certsLock.Unlock()
+}
+
+// ServerCertExpiry returns validity of certificate chain the server presented
+// in the most recent TLS connection; nil if no TLS connection was made yet.
+func (a *ApiClient) ServerCertExpiry() []CertExpiry {
+	a.certsLock.Lock()
+	defer a.certsLock.Unlock()
+	return a.serverCerts
+}
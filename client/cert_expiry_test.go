@@ -0,0 +1,70 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadCertExpiry(t *testing.T) {
+	certs, err := LoadCertExpiry("server.crt")
+	assert.NoError(t, err)
+	assert.Len(t, certs, 1)
+	assert.Equal(t, "server.crt", certs[0].Source)
+	assert.Equal(t, 2084, certs[0].NotAfter.Year())
+
+	// key is skipped, only certificates matter
+	certs, err = LoadCertExpiry("client.key")
+	assert.NoError(t, err)
+	assert.Empty(t, certs)
+
+	_, err = LoadCertExpiry("non-existing.crt")
+	assert.Error(t, err)
+
+	tdir, _ := ioutil.TempDir("", "certs")
+	defer os.RemoveAll(tdir)
+	broken := path.Join(tdir, "broken.crt")
+	ioutil.WriteFile(broken,
+		[]byte("-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n"), 0644)
+	_, err = LoadCertExpiry(broken)
+	assert.Error(t, err)
+}
+
+func TestServerCertExpiry(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	api, err := New(Config{IsHttps: true, NoVerify: true})
+	assert.NoError(t, err)
+	assert.Nil(t, api.ServerCertExpiry())
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	rsp, err := api.Do(req)
+	assert.NoError(t, err)
+	rsp.Body.Close()
+
+	certs := api.ServerCertExpiry()
+	assert.Len(t, certs, len(ts.TLS.Certificates[0].Certificate))
+	assert.Equal(t, "server", certs[0].Source)
+	assert.True(t, certs[0].NotAfter.After(time.Now()))
+}
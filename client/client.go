@@ -21,6 +21,7 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mendersoftware/log"
@@ -73,7 +74,67 @@ type RequestProcessingFunc func(response *http.Response) (interface{}, error)
 
 // wrapper for http.Client with additional methods
 type ApiClient struct {
+	// requests are logged until then (unix time, ns); see SetTraceUntil;
+	// first, to be aligned for atomic access on 32-bit platforms
+	traceUntil int64
 	http.Client
+	// headers added to every request
+	headers http.Header
+	// dialer of the transport
+	dialer *net.Dialer
+	// requests wait for their turn here unless nil
+	queue *RequestQueue
+	// certificate chain presented by the server last time
+	certsLock   sync.Mutex
+	serverCerts []CertExpiry
+}
+
+// Set headers (User-Agent, routing tags required by gateways, ...) to be
+// added to all requests made with this client. Headers already present in a
+// request are left untouched.
+func (a *ApiClient) SetHeaders(headers http.Header) {
+	a.headers = headers
+}
+
+// Resolve hostnames with DNS-over-HTTPS resolver at given URL when the system
+// resolver fails.
+func (a *ApiClient) SetDoHResolver(resolverURL string) error {
+	r, err := newDoHResolver(resolverURL)
+	if err != nil {
+		return err
+	}
+	// queries go out the same way as requests
+	r.client.Transport = &http.Transport{DialContext: a.dialer.DialContext}
+	transport := a.Client.Transport.(*http.Transport)
+	transport.DialContext = r.dialContext(transport.DialContext)
+	return nil
+}
+
+// Make requests wait for their turn in given queue, which may be shared with
+// other clients.
+func (a *ApiClient) SetRequestQueue(queue *RequestQueue) {
+	a.queue = queue
+}
+
+func (a *ApiClient) Do(req *http.Request) (*http.Response, error) {
+	for name, values := range a.headers {
+		if req.Header.Get(name) == "" {
+			req.Header[name] = values
+		}
+	}
+	var rsp *http.Response
+	var err error
+	start := time.Now()
+	if a.queue != nil {
+		rsp, err = a.queue.do(req, a.Client.Do)
+	} else {
+		rsp, err = a.Client.Do(req)
+	}
+	if a.tracing(start) {
+		traceRequest(req, rsp, err, start)
+	}
+	a.recordServerCerts(rsp)
+	return rsp, err
 }
 
 // Return a new ApiRequest sharing this ApiClient helper
@@ -123,18 +184,20 @@ func New(conf Config) (*ApiClient, error) {
 	}
 	// set connection timeout
 	client.Timeout = defaultClientReadingTimeout
+	client.CheckRedirect = checkRedirect
 
 	transport := client.Transport.(*http.Transport)
 	//set keepalive options
-	transport.DialContext = (&net.Dialer{
+	dialer := &net.Dialer{
 		KeepAlive: connectionKeepaliveTime,
-	}).DialContext
+	}
+	transport.DialContext = dialer.DialContext
 
 	if err := http2.ConfigureTransport(transport); err != nil {
 		log.Warnf("failed to enable HTTP/2 for client: %v", err)
 	}
 
-	return &ApiClient{*client}, nil
+	return &ApiClient{Client: *client, dialer: dialer}, nil
 }
 
 func newHttpClient() *http.Client {
@@ -15,6 +15,7 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
@@ -24,10 +25,16 @@ import (
 	"github.com/pkg/errors"
 )
 
-var AuthErrorUnauthorized = errors.New("authentication request rejected")
+var (
+	AuthErrorUnauthorized = errors.New("authentication request rejected")
+	// device was rejected or decommissioned; retrying with the same
+	// identity is pointless until the server side is sorted out
+	AuthErrorRejected = errors.New("device rejected by the server")
+)
 
 type AuthRequester interface {
-	Request(api ApiRequester, server string, dataSrc AuthDataMessenger) ([]byte, error)
+	Request(ctx context.Context, api ApiRequester, server string,
+		dataSrc AuthDataMessenger) ([]byte, error)
 }
 
 // Auth client wrapper. Instantiate by yourself or use `NewAuthClient()` helper
@@ -39,7 +46,8 @@ func NewAuth() *AuthClient {
 	return &ac
 }
 
-func (u *AuthClient) Request(api ApiRequester, server string, dataSrc AuthDataMessenger) ([]byte, error) {
+func (u *AuthClient) Request(ctx context.Context, api ApiRequester, server string,
+	dataSrc AuthDataMessenger) ([]byte, error) {
 
 	req, err := makeAuthRequest(server, dataSrc)
 	if err != nil {
@@ -47,7 +55,7 @@ func (u *AuthClient) Request(api ApiRequester, server string, dataSrc AuthDataMe
 	}
 
 	log.Debugf("making authorization request to server %s with req: %s", server, req)
-	rsp, err := api.Do(req)
+	rsp, err := api.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to execute authorization request")
 	}
@@ -58,6 +66,8 @@ func (u *AuthClient) Request(api ApiRequester, server string, dataSrc AuthDataMe
 	switch rsp.StatusCode {
 	case http.StatusUnauthorized:
 		return nil, AuthErrorUnauthorized
+	case http.StatusForbidden:
+		return nil, AuthErrorRejected
 	case http.StatusOK:
 		log.Debugf("receive response data")
 		data, err := ioutil.ReadAll(rsp.Body)
@@ -14,6 +14,7 @@
 package client
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -109,7 +110,7 @@ func TestClientAuth(t *testing.T) {
 	msger := &testAuthDataMessenger{
 		reqData: []byte("foobar"),
 	}
-	rsp, err := client.Request(ac, ts.URL, msger)
+	rsp, err := client.Request(context.Background(), ac, ts.URL, msger)
 	assert.NoError(t, err)
 	assert.NotNil(t, rsp)
 	assert.Equal(t, responder.data, string(rsp))
@@ -117,6 +118,22 @@ func TestClientAuth(t *testing.T) {
 	assert.Equal(t, "application/json", responder.headers.Get("Content-Type"))
 
 	responder.httpStatus = 401
-	_, err = client.Request(ac, ts.URL, msger)
+	_, err = client.Request(context.Background(), ac, ts.URL, msger)
 	assert.Error(t, err)
 }
+
+func TestClientAuthRejected(t *testing.T) {
+	status := http.StatusForbidden
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	msger := &testAuthDataMessenger{reqData: []byte("foobar")}
+	_, err := NewAuth().Request(context.Background(), http.DefaultClient, ts.URL, msger)
+	assert.Equal(t, AuthErrorRejected, err)
+
+	status = http.StatusUnauthorized
+	_, err = NewAuth().Request(context.Background(), http.DefaultClient, ts.URL, msger)
+	assert.Equal(t, AuthErrorUnauthorized, err)
+}
@@ -0,0 +1,82 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Device lifecycle event types.
+const (
+	EventBoot                 = "boot"
+	EventRollback             = "rollback"
+	EventUpdateDeferred       = "update_deferred"
+	EventConnectivityLost     = "connectivity_lost"
+	EventConnectivityRestored = "connectivity_restored"
+)
+
+// server does not accept device events
+var ErrEventsNotSupported = errors.New("server does not support device events")
+
+// DeviceEvent tells the server about something that happened on the device,
+// beyond status of the deployment in progress. Events are stamped the same
+// way status reports are.
+type DeviceEvent struct {
+	Type         string            `json:"type"`
+	Seq          uint64            `json:"seq,omitempty"`
+	Time         string            `json:"time,omitempty"`
+	Uptime       float64           `json:"uptime,omitempty"`
+	DeploymentID string            `json:"deployment_id,omitempty"`
+	Data         map[string]string `json:"data,omitempty"`
+}
+
+// SendEvents sends batch of device events to the server.
+func SendEvents(ctx context.Context, api ApiRequester, server string,
+	events []DeviceEvent) error {
+
+	body, err := json.Marshal(struct {
+		Events []DeviceEvent `json:"events"`
+	}{events})
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode device events")
+	}
+	req, err := http.NewRequest(http.MethodPost,
+		buildApiURL(server, "/devices/events"), bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "failed to create device events request")
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	r, err := api.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "sending device events failed")
+	}
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusNoContent, http.StatusAccepted, http.StatusOK:
+		return nil
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return ErrEventsNotSupported
+	case http.StatusUnauthorized:
+		return ErrNotAuthorized
+	default:
+		return NewHTTPError(r, "sending device events failed")
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendEvents(t *testing.T) {
+	var status int
+	var path string
+	var recdata []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		recdata, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	events := []DeviceEvent{
+		{Type: EventBoot, Seq: 1, Data: map[string]string{"artifact_name": "release-1"}},
+		{Type: EventUpdateDeferred, Seq: 2, DeploymentID: "deployment-1"},
+	}
+
+	status = http.StatusNoContent
+	err := SendEvents(context.Background(), http.DefaultClient, ts.URL, events)
+	assert.NoError(t, err)
+	assert.Equal(t, apiPrefix+"devices/events", path)
+	assert.JSONEq(t, `{"events": [
+		{"type": "boot", "seq": 1, "data": {"artifact_name": "release-1"}},
+		{"type": "update_deferred", "seq": 2, "deployment_id": "deployment-1"}
+	]}`, string(recdata))
+
+	for _, s := range []int{http.StatusNotFound, http.StatusMethodNotAllowed,
+		http.StatusNotImplemented} {
+		status = s
+		err = SendEvents(context.Background(), http.DefaultClient, ts.URL, events)
+		assert.Equal(t, ErrEventsNotSupported, err)
+	}
+
+	status = http.StatusUnauthorized
+	err = SendEvents(context.Background(), http.DefaultClient, ts.URL, events)
+	assert.Equal(t, ErrNotAuthorized, err)
+
+	status = http.StatusInternalServerError
+	err = SendEvents(context.Background(), http.DefaultClient, ts.URL, events)
+	assert.Error(t, err)
+	assert.Equal(t, ErrorClassTransient, ClassifyError(err))
+}
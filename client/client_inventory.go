@@ -15,6 +15,7 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 
@@ -23,7 +24,7 @@ import (
 )
 
 type InventorySubmitter interface {
-	Submit(api ApiRequester, server string, data interface{}) error
+	Submit(ctx context.Context, api ApiRequester, server string, data interface{}) error
 }
 
 type InventoryClient struct {
@@ -34,13 +35,14 @@ func NewInventory() InventorySubmitter {
 }
 
 // Report status information to the backend
-func (i *InventoryClient) Submit(api ApiRequester, url string, data interface{}) error {
+func (i *InventoryClient) Submit(ctx context.Context, api ApiRequester, url string,
+	data interface{}) error {
 	req, err := makeInventorySubmitRequest(url, data)
 	if err != nil {
 		return errors.Wrapf(err, "failed to prepare inventory submit request")
 	}
 
-	r, err := api.Do(req)
+	r, err := api.Do(req.WithContext(WithRequestPriority(ctx, PriorityInventory)))
 	if err != nil {
 		log.Error("failed to submit inventory data: ", err)
 		return errors.Wrapf(err, "inventory submit failed")
@@ -50,7 +52,7 @@ func (i *InventoryClient) Submit(api ApiRequester, url string, data interface{})
 
 	if r.StatusCode != http.StatusOK {
 		log.Errorf("got unexpected HTTP status when submitting to inventory: %v", r.StatusCode)
-		return errors.Errorf("inventory submit failed, bad status %v", r.StatusCode)
+		return NewHTTPError(r, "inventory submit failed")
 	}
 	log.Debugf("inventory update sent, response %v", r)
 
@@ -14,6 +14,7 @@
 package client
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -52,14 +53,14 @@ func TestInventoryClient(t *testing.T) {
 	client := NewInventory()
 	assert.NotNil(t, client)
 
-	err = client.Submit(NewMockApiClient(nil, errors.New("foo")),
+	err = client.Submit(context.Background(), NewMockApiClient(nil, errors.New("foo")),
 		ts.URL,
 		InventoryData{
 			{"foo", "bar"},
 		})
 	assert.Error(t, err)
 
-	err = client.Submit(ac, ts.URL, InventoryData{
+	err = client.Submit(context.Background(), ac, ts.URL, InventoryData{
 		{"foo", "bar"},
 		{"bar", []string{"baz", "zen"}},
 	})
@@ -71,6 +72,6 @@ func TestInventoryClient(t *testing.T) {
 	assert.Equal(t, apiPrefix+"inventory/device/attributes", responder.path)
 
 	responder.httpStatus = 401
-	err = client.Submit(ac, ts.URL, nil)
+	err = client.Submit(context.Background(), ac, ts.URL, nil)
 	assert.Error(t, err)
 }
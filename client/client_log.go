@@ -15,6 +15,7 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"net/http"
 
@@ -23,12 +24,15 @@ import (
 )
 
 type LogUploader interface {
-	Upload(api ApiRequester, server string, logs LogData) error
+	Upload(ctx context.Context, api ApiRequester, server string, logs LogData) error
 }
 
 type LogData struct {
 	DeploymentID string `json:"-"`
 	Messages     []byte `json:"messages"`
+	// additional fields added to the uploaded JSON object, see
+	// StatusReport.Extra
+	Extra map[string]string `json:"-"`
 }
 
 type LogUploadClient struct {
@@ -39,13 +43,14 @@ func NewLog() LogUploader {
 }
 
 // Report status information to the backend
-func (u *LogUploadClient) Upload(api ApiRequester, url string, logs LogData) error {
+func (u *LogUploadClient) Upload(ctx context.Context, api ApiRequester, url string,
+	logs LogData) error {
 	req, err := makeLogUploadRequest(url, &logs)
 	if err != nil {
 		return errors.Wrapf(err, "failed to prepare log upload request")
 	}
 
-	r, err := api.Do(req)
+	r, err := api.Do(req.WithContext(WithRequestPriority(ctx, PriorityLogUpload)))
 	if err != nil {
 		log.Error("failed to upload logs: ", err)
 		return errors.Wrapf(err, "uploading logs failed")
@@ -56,7 +61,7 @@ func (u *LogUploadClient) Upload(api ApiRequester, url string, logs LogData) err
 	// HTTP 204 No Content
 	if r.StatusCode != http.StatusNoContent {
 		log.Errorf("got unexpected HTTP status when uploading log: %v", r.StatusCode)
-		return errors.Errorf("uploading logs failed, bad status %v", r.StatusCode)
+		return NewHTTPError(r, "uploading logs failed")
 	}
 	log.Debugf("logs uploaded, response %v", r)
 
@@ -68,7 +73,12 @@ func makeLogUploadRequest(server string, logs *LogData) (*http.Request, error) {
 		logs.DeploymentID)
 	url := buildApiURL(server, path)
 
-	hreq, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(logs.Messages))
+	body, err := addExtraFields(logs.Messages, logs.Extra)
+	if err != nil {
+		return nil, err
+	}
+
+	hreq, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to create log sending HTTP request")
 	}
@@ -14,6 +14,7 @@
 package client
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -59,10 +60,10 @@ func TestLogUploadClient(t *testing.T) {
 { "time": "12:12:13", "level": "debug", "msg": "log bar" }]
 }`),
 	}
-	err = client.Upload(NewMockApiClient(nil, errors.New("foo")), ts.URL, ld)
+	err = client.Upload(context.Background(), NewMockApiClient(nil, errors.New("foo")), ts.URL, ld)
 	assert.Error(t, err)
 
-	err = client.Upload(ac, ts.URL, ld)
+	err = client.Upload(context.Background(), ac, ts.URL, ld)
 	assert.NoError(t, err)
 	assert.NotNil(t, responder.recdata)
 	assert.JSONEq(t, `{
@@ -81,10 +82,33 @@ func TestLogUploadClient(t *testing.T) {
 	assert.Equal(t, apiPrefix+"deployments/device/deployments/deployment1/log", responder.path)
 
 	responder.httpStatus = 401
-	err = client.Upload(ac, ts.URL, LogData{
+	err = client.Upload(context.Background(), ac, ts.URL, LogData{
 		DeploymentID: "deployment1",
 		Messages: []byte(`[{ "time": "12:12:12", "level": "error", "msg": "log foo" },
 { "time": "12:12:13", "level": "debug", "msg": "log bar" }]`),
 	})
 	assert.Error(t, err)
 }
+
+func TestMakeLogUploadRequest(t *testing.T) {
+	logs := LogData{
+		DeploymentID: "deployment1",
+		Messages:     []byte(`{"messages": [{"level": "error", "msg": "log foo"}]}`),
+	}
+	req, err := makeLogUploadRequest("http://foo.bar", &logs)
+	assert.NoError(t, err)
+	data, _ := ioutil.ReadAll(req.Body)
+	assert.Equal(t, logs.Messages, data)
+
+	logs.Extra = map[string]string{"site_id": "plant-7", "messages": "bogus"}
+	req, err = makeLogUploadRequest("http://foo.bar", &logs)
+	assert.NoError(t, err)
+	data, _ = ioutil.ReadAll(req.Body)
+	assert.JSONEq(t, `{"messages": [{"level": "error", "msg": "log foo"}],
+		"site_id": "plant-7"}`, string(data))
+
+	// logs not in the expected format
+	logs.Messages = []byte(`[]`)
+	_, err = makeLogUploadRequest("http://foo.bar", &logs)
+	assert.Error(t, err)
+}
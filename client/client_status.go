@@ -15,6 +15,7 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -30,6 +31,9 @@ const (
 	StatusSuccess          = "success"
 	StatusFailure          = "failure"
 	StatusAlreadyInstalled = "already-installed"
+	// installation postponed by local policy on the device, details are
+	// provided in substate
+	StatusDeferred = "deferred"
 )
 
 var (
@@ -37,12 +41,25 @@ var (
 )
 
 type StatusReporter interface {
-	Report(api ApiRequester, server string, report StatusReport) error
+	Report(ctx context.Context, api ApiRequester, server string, report StatusReport) error
 }
 
 type StatusReport struct {
 	DeploymentID string `json:"-"`
 	Status       string `json:"status"`
+	SubState     string `json:"substate,omitempty"`
+	// client-side sequence number and time of the report, wall clock
+	// (RFC3339) and seconds since boot, for ordering reports from
+	// devices with unreliable clocks
+	Seq    uint64  `json:"seq,omitempty"`
+	Time   string  `json:"time,omitempty"`
+	Uptime float64 `json:"uptime,omitempty"`
+	// seconds spent in each state of the deployment; sent with final
+	// statuses
+	StateDurations map[string]float64 `json:"state_durations,omitempty"`
+	// additional fields configured on the device (eg. site ID) added to
+	// the report; fields of the report itself take precedence
+	Extra map[string]string `json:"-"`
 }
 
 type StatusClient struct {
@@ -53,13 +70,19 @@ func NewStatus() StatusReporter {
 }
 
 // Report status information to the backend
-func (u *StatusClient) Report(api ApiRequester, url string, report StatusReport) error {
+func (u *StatusClient) Report(ctx context.Context, api ApiRequester, url string,
+	report StatusReport) error {
 	req, err := makeStatusReportRequest(url, report)
 	if err != nil {
 		return errors.Wrapf(err, "failed to prepare status report request")
 	}
 
-	r, err := api.Do(req)
+	prio := PriorityAbortPoll
+	switch report.Status {
+	case StatusSuccess, StatusFailure, StatusAlreadyInstalled:
+		prio = PriorityTerminalStatus
+	}
+	r, err := api.Do(req.WithContext(WithRequestPriority(ctx, prio)))
 	if err != nil {
 		log.Error("failed to report status: ", err)
 		return errors.Wrapf(err, "reporting status failed")
@@ -74,7 +97,7 @@ func (u *StatusClient) Report(api ApiRequester, url string, report StatusReport)
 		return ErrDeploymentAborted
 	case r.StatusCode != http.StatusNoContent:
 		log.Errorf("got unexpected HTTP status when reporting status: %v", r.StatusCode)
-		return errors.Errorf("reporting status failed, bad status %v", r.StatusCode)
+		return NewHTTPError(r, "reporting status failed")
 	}
 
 	log.Debugf("status reported, response %v", r)
@@ -82,16 +105,40 @@ func (u *StatusClient) Report(api ApiRequester, url string, report StatusReport)
 	return nil
 }
 
+// addExtraFields adds fields missing in JSON object body.
+func addExtraFields(body []byte, extra map[string]string) ([]byte, error) {
+	if len(extra) == 0 {
+		return body, nil
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return nil, errors.Wrapf(err, "failed to add extra fields")
+	}
+	for k, v := range extra {
+		if _, ok := obj[k]; ok {
+			log.Debugf("extra field %s conflicts with standard one, ignored", k)
+			continue
+		}
+		obj[k], _ = json.Marshal(v)
+	}
+	return json.Marshal(obj)
+}
+
 func makeStatusReportRequest(server string, report StatusReport) (*http.Request, error) {
 	path := fmt.Sprintf("/deployments/device/deployments/%s/status",
 		report.DeploymentID)
 	url := buildApiURL(server, path)
 
-	out := &bytes.Buffer{}
-	enc := json.NewEncoder(out)
-	enc.Encode(&report)
+	body, err := json.Marshal(&report)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode status report")
+	}
+	body, err = addExtraFields(body, report.Extra)
+	if err != nil {
+		return nil, err
+	}
 
-	hreq, err := http.NewRequest(http.MethodPut, url, out)
+	hreq, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to create status HTTP request")
 	}
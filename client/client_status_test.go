@@ -14,6 +14,7 @@
 package client
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -52,7 +53,7 @@ func TestStatusClient(t *testing.T) {
 	client := NewStatus()
 	assert.NotNil(t, client)
 
-	err = client.Report(NewMockApiClient(nil, errors.New("foo")),
+	err = client.Report(context.Background(), NewMockApiClient(nil, errors.New("foo")),
 		ts.URL,
 		StatusReport{
 			DeploymentID: "deployment1",
@@ -61,7 +62,7 @@ func TestStatusClient(t *testing.T) {
 	assert.Error(t, err)
 	assert.NotEqual(t, err, ErrDeploymentAborted)
 
-	err = client.Report(ac, ts.URL, StatusReport{
+	err = client.Report(context.Background(), ac, ts.URL, StatusReport{
 		DeploymentID: "deployment1",
 		Status:       StatusFailure,
 	})
@@ -71,7 +72,7 @@ func TestStatusClient(t *testing.T) {
 	assert.Equal(t, apiPrefix+"deployments/device/deployments/deployment1/status", responder.path)
 
 	responder.httpStatus = http.StatusUnauthorized
-	err = client.Report(ac, ts.URL, StatusReport{
+	err = client.Report(context.Background(), ac, ts.URL, StatusReport{
 		DeploymentID: "deployment1",
 		Status:       StatusSuccess,
 	})
@@ -79,9 +80,44 @@ func TestStatusClient(t *testing.T) {
 	assert.NotEqual(t, err, ErrDeploymentAborted)
 
 	responder.httpStatus = http.StatusConflict
-	err = client.Report(ac, ts.URL, StatusReport{
+	err = client.Report(context.Background(), ac, ts.URL, StatusReport{
 		DeploymentID: "deployment1",
 		Status:       StatusSuccess,
 	})
 	assert.Equal(t, err, ErrDeploymentAborted)
 }
+
+func TestMakeStatusReportRequest(t *testing.T) {
+	req, err := makeStatusReportRequest("http://foo.bar", StatusReport{
+		DeploymentID: "deployment1",
+		Status:       StatusSuccess,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "http://foo.bar/api/devices/v1/deployments/device/deployments/deployment1/status",
+		req.URL.String())
+	data, _ := ioutil.ReadAll(req.Body)
+	assert.JSONEq(t, `{"status": "success"}`, string(data))
+
+	req, err = makeStatusReportRequest("http://foo.bar", StatusReport{
+		DeploymentID: "deployment1",
+		Status:       StatusDeferred,
+		SubState:     "deferred until 2017-01-02T03:04:05Z: battery low",
+	})
+	assert.NoError(t, err)
+	data, _ = ioutil.ReadAll(req.Body)
+	assert.JSONEq(t, `{"status": "deferred",
+		"substate": "deferred until 2017-01-02T03:04:05Z: battery low"}`,
+		string(data))
+	// extra fields do not override the standard ones
+	req, err = makeStatusReportRequest("http://foo.bar", StatusReport{
+		DeploymentID: "deployment1",
+		Status:       StatusSuccess,
+		Extra: map[string]string{
+			"site_id": "plant-7",
+			"status":  "bogus",
+		},
+	})
+	assert.NoError(t, err)
+	data, _ = ioutil.ReadAll(req.Body)
+	assert.JSONEq(t, `{"status": "success", "site_id": "plant-7"}`, string(data))
+}
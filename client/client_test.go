@@ -164,3 +164,27 @@ func TestCaLoading(t *testing.T) {
 	assert.True(t, systemOK)
 	assert.True(t, oursOK)
 }
+
+func TestApiClientHeaders(t *testing.T) {
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	}))
+	defer ts.Close()
+
+	ac, err := New(Config{})
+	assert.NoError(t, err)
+	ac.SetHeaders(http.Header{
+		"User-Agent":         []string{"mender/1.2.3 (qemux86)"},
+		"X-Forwarded-Client": []string{"fleet-a"},
+		"Authorization":      []string{"Bearer nope"},
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	_, err = ac.Request("token").Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "mender/1.2.3 (qemux86)", header.Get("User-Agent"))
+	assert.Equal(t, "fleet-a", header.Get("X-Forwarded-Client"))
+	// headers set for the request win
+	assert.Equal(t, "Bearer token", header.Get("Authorization"))
+}
@@ -14,11 +14,18 @@
 package client
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/mendersoftware/log"
 	"github.com/pkg/errors"
@@ -26,24 +33,63 @@ import (
 
 const (
 	minimumImageSize int64 = 4096 //kB
+
+	// Header set by the server in update check responses to instruct the
+	// device to switch over to another server (given as header value).
+	MigrateToHeader = "X-MEN-Migrate-To"
+
+	// Headers carrying command for the device (base64 encoded JSON) and its
+	// RSA PKCS#1 v1.5 SHA256 signature (base64 encoded).
+	DeviceCommandHeader          = "X-MEN-Device-Command"
+	DeviceCommandSignatureHeader = "X-MEN-Device-Command-Signature"
+
+	// Header set by the server in update check and authorization responses
+	// to override update polling interval of the device (in seconds) for
+	// as long as the header is being sent.
+	PollIntervalHeader = "X-MEN-Poll-Interval"
 )
 
 type Updater interface {
-	GetScheduledUpdate(api ApiRequester, server string, current CurrentUpdate) (interface{}, error)
-	FetchUpdate(api ApiRequester, url string) (io.ReadCloser, int64, error)
+	GetScheduledUpdate(ctx context.Context, api ApiRequester, server string,
+		current CurrentUpdate) (interface{}, error)
+	FetchUpdate(ctx context.Context, api ApiRequester, url string) (io.ReadCloser, int64, error)
+	FetchUpdateHeader(ctx context.Context, api ApiRequester, url string, size int64) (io.ReadCloser, error)
+	CheckArtifact(ctx context.Context, api ApiRequester, url string) error
+	FetchUpdateFrom(ctx context.Context, api ApiRequester, url string,
+		offset int64) (io.ReadCloser, error)
 }
 
 var (
 	ErrNotAuthorized = errors.New("client not authorized")
+	// artifact is no longer at the URL (404, 410)
+	ErrArtifactGone = errors.New("artifact no longer available")
+	// pre-signed artifact URL is no longer valid (403); the server issues
+	// a new one
+	ErrArtifactURLExpired = errors.New("artifact URL expired")
 )
 
 type UpdateClient struct {
 	minImageSize int64
+	// validators of the last "no update" response, if the server provided
+	// any; used for making the next update check conditional
+	noUpdate *noUpdateCache
+	// configured API version of update checks, and older version used
+	// until probeAfter if the server did not support the newer one
+	apiVersion ApiVersion
+	fallback   ApiVersion
+	probeAfter time.Time
+}
+
+type noUpdateCache struct {
+	key          string
+	etag         string
+	lastModified string
 }
 
 func NewUpdate() *UpdateClient {
 	up := UpdateClient{
 		minImageSize: minimumImageSize,
+		apiVersion:   ApiVersion1,
 	}
 	return &up
 }
@@ -53,66 +99,281 @@ func NewUpdate() *UpdateClient {
 type CurrentUpdate struct {
 	Artifact   string
 	DeviceType string
+	Channel    string
+	// optional hints for the server choosing the artifact
+	Capabilities *DeviceCapabilities
 }
 
-func (u *UpdateClient) GetScheduledUpdate(api ApiRequester, server string,
-	current CurrentUpdate) (interface{}, error) {
+// DeviceCapabilities are sent along with update checks, so that the server
+// can pick the artifact best suited for the device, eg. full image instead of
+// delta one, or a smaller one for devices behind slow links.
+type DeviceCapabilities struct {
+	// space available for downloaded payloads, in MiB
+	FreeSpaceMB int64 `json:"free_space_mb,omitempty"`
+	// download speed measured during the last update, bytes per second
+	LinkSpeed int64 `json:"link_speed,omitempty"`
+	// rate the last artifact was downloaded and installed at, bytes per
+	// second; install time of an artifact is estimated from it
+	InstallRate int64 `json:"install_rate,omitempty"`
+	// update types the device can install
+	PayloadTypes  []string `json:"payload_types,omitempty"`
+	SupportsDelta bool     `json:"supports_delta"`
+	// latency and download speed (bytes per second) of the link to the
+	// artifact host, probed shortly before the update check
+	ProbeLatencyMs int64 `json:"probe_latency_ms,omitempty"`
+	ProbeSpeed     int64 `json:"probe_speed,omitempty"`
+}
 
-	return u.getUpdateInfo(api, processUpdateResponse, server, current)
+// Add capabilities to query of update check request.
+func (c *DeviceCapabilities) addQuery(vals url.Values) {
+	if c == nil {
+		return
+	}
+	if c.FreeSpaceMB > 0 {
+		vals.Add("free_space_mb", strconv.FormatInt(c.FreeSpaceMB, 10))
+	}
+	if c.LinkSpeed > 0 {
+		vals.Add("link_speed", strconv.FormatInt(c.LinkSpeed, 10))
+	}
+	if c.InstallRate > 0 {
+		vals.Add("install_rate", strconv.FormatInt(c.InstallRate, 10))
+	}
+	if len(c.PayloadTypes) > 0 {
+		vals.Add("payload_types", strings.Join(c.PayloadTypes, ","))
+	}
+	vals.Add("supports_delta", strconv.FormatBool(c.SupportsDelta))
+	if c.ProbeLatencyMs > 0 {
+		vals.Add("probe_latency_ms", strconv.FormatInt(c.ProbeLatencyMs, 10))
+	}
+	if c.ProbeSpeed > 0 {
+		vals.Add("probe_speed", strconv.FormatInt(c.ProbeSpeed, 10))
+	}
 }
 
-func (u *UpdateClient) getUpdateInfo(api ApiRequester, process RequestProcessingFunc,
+func (u *UpdateClient) GetScheduledUpdate(ctx context.Context, api ApiRequester,
 	server string, current CurrentUpdate) (interface{}, error) {
-	req, err := makeUpdateCheckRequest(server, current)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to create update check request")
-	}
 
-	r, err := api.Do(req)
+	return u.getUpdateInfo(ctx, api, processUpdateResponse, server, current)
+}
 
-	if err != nil {
-		log.Debug("Sending request error: ", err)
-		return nil, errors.Wrapf(err, "update check request failed")
+func (u *UpdateClient) getUpdateInfo(ctx context.Context, api ApiRequester,
+	process RequestProcessingFunc, server string, current CurrentUpdate) (interface{}, error) {
+	var req *http.Request
+	var r *http.Response
+	var key string
+	var conditional bool
+	for {
+		version := u.updateCheckVersion(time.Now())
+		var err error
+		req, err = updateCheckCodecs[version](server, current)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create update check request")
+		}
+
+		// nothing changed since the last check that found no update,
+		// server only needs to confirm that
+		key = requestKey(req)
+		cache := u.noUpdate
+		conditional = cache != nil && cache.key == key
+		if conditional {
+			if cache.etag != "" {
+				req.Header.Set("If-None-Match", cache.etag)
+			}
+			if cache.lastModified != "" {
+				req.Header.Set("If-Modified-Since", cache.lastModified)
+			}
+		}
+
+		r, err = api.Do(req.WithContext(ctx))
+		if err != nil {
+			log.Debug("Sending request error: ", err)
+			return nil, errors.Wrapf(err, "update check request failed")
+		}
+		if !u.fallBack(version, r.StatusCode, time.Now()) {
+			break
+		}
+		r.Body.Close()
 	}
 
 	defer r.Body.Close()
 
+	if r.StatusCode == http.StatusNotModified && conditional {
+		log.Debug("No update available (not modified)")
+		return nil, nil
+	}
+
 	data, err := process(r)
-	return data, err
+	if err != nil {
+		return data, err
+	}
+
+	// Only "no update" responses are remembered; update responses carry
+	// download links which expire, so they are always requested anew.
+	// Servers not supporting conditional requests send no validators, and
+	// all checks are then plain requests.
+	u.noUpdate = nil
+	if data == nil {
+		etag, lastModified := r.Header.Get("ETag"), r.Header.Get("Last-Modified")
+		if etag != "" || lastModified != "" {
+			u.noUpdate = &noUpdateCache{key, etag, lastModified}
+		}
+	}
+	return data, nil
 }
 
 // FetchUpdate returns a byte stream which is a download of the given link.
-func (u *UpdateClient) FetchUpdate(api ApiRequester, url string) (io.ReadCloser, int64, error) {
+func (u *UpdateClient) FetchUpdate(ctx context.Context, api ApiRequester,
+	url string) (io.ReadCloser, int64, error) {
 
 	req, err := makeUpdateFetchRequest(url)
 	if err != nil {
 		return nil, -1, errors.Wrapf(err, "failed to create update fetch request")
 	}
 
-	r, err := api.Do(req)
+	trace := newFetchTrace(req.URL.Host)
+	ctx = httptrace.WithClientTrace(ctx, trace.clientTrace())
+
+	r, err := api.Do(req.WithContext(ctx))
 	if err != nil {
 		log.Error("Can not fetch update image: ", err)
-		return nil, -1, errors.Wrapf(err, "update fetch request failed")
+		return nil, -1, newFetchError(errors.Wrapf(err, "update fetch request failed"), trace)
 	}
 
 	log.Debugf("Received fetch update response %v+", r)
+	trace.response(r.StatusCode)
 
 	if r.StatusCode != http.StatusOK {
 		r.Body.Close()
 		log.Errorf("Error fetching shcheduled update info: code (%d)", r.StatusCode)
-		return nil, -1, errors.New("Error receiving scheduled update information.")
+		return nil, -1, newFetchError(NewHTTPError(r, "error fetching update image"), trace)
 	}
 
 	if r.ContentLength < 0 {
 		r.Body.Close()
-		return nil, -1, errors.New("Will not continue with unknown image size.")
+		return nil, -1, newFetchError(errors.New("Will not continue with unknown image size."), trace)
 	} else if r.ContentLength < u.minImageSize {
 		r.Body.Close()
 		log.Errorf("Image smaller than expected. Expected: %d, received: %d", u.minImageSize, r.ContentLength)
-		return nil, -1, errors.New("Image size is smaller than expected. Aborting.")
+		return nil, -1, newFetchError(errors.New("Image size is smaller than expected. Aborting."), trace)
+	}
+
+	return &fetchReader{r.Body, trace}, r.ContentLength, nil
+}
+
+// FetchUpdateFrom returns download of the given link starting at offset, for
+// resuming interrupted download. Range request is used; of servers not
+// supporting it, the leading part is downloaded and skipped. Returns
+// ErrArtifactURLExpired or ErrArtifactGone if the artifact is no longer
+// available at the URL.
+func (u *UpdateClient) FetchUpdateFrom(ctx context.Context, api ApiRequester,
+	url string, offset int64) (io.ReadCloser, error) {
+
+	req, err := makeUpdateFetchRequest(url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create update fetch request")
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	trace := newFetchTrace(req.URL.Host)
+	ctx = httptrace.WithClientTrace(ctx, trace.clientTrace())
+
+	r, err := api.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, newFetchError(errors.Wrapf(err, "update fetch request failed"), trace)
+	}
+	trace.response(r.StatusCode)
+
+	switch r.StatusCode {
+	case http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-", &start); err == nil &&
+			start != offset {
+			r.Body.Close()
+			return nil, newFetchError(errors.Errorf("server sent range starting at %d, "+
+				"requested %d", start, offset), trace)
+		}
+	case http.StatusOK:
+		log.Debugf("artifact server does not support range requests, skipping %d bytes",
+			offset)
+		if _, err := io.CopyN(ioutil.Discard, r.Body, offset); err != nil {
+			r.Body.Close()
+			return nil, newFetchError(errors.Wrapf(err, "failed to skip downloaded part"),
+				trace)
+		}
+	case http.StatusForbidden:
+		r.Body.Close()
+		return nil, newFetchError(errors.Wrapf(ErrArtifactURLExpired, "HTTP status %d",
+			r.StatusCode), trace)
+	case http.StatusNotFound, http.StatusGone:
+		r.Body.Close()
+		return nil, newFetchError(errors.Wrapf(ErrArtifactGone, "HTTP status %d",
+			r.StatusCode), trace)
+	default:
+		r.Body.Close()
+		return nil, newFetchError(NewHTTPError(r, "error fetching update image"), trace)
+	}
+	return &fetchReader{r.Body, trace}, nil
+}
+
+// FetchUpdateHeader returns at most `size` leading bytes of the update, which
+// is enough for inspecting the artifact header without downloading the whole
+// image. Range request is used, servers not supporting it will start sending
+// the whole image, but only the requested part is read.
+func (u *UpdateClient) FetchUpdateHeader(ctx context.Context, api ApiRequester,
+	url string, size int64) (io.ReadCloser, error) {
+
+	req, err := makeUpdateFetchRequest(url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create update fetch request")
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", size-1))
+
+	r, err := api.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "update header fetch request failed")
+	}
+
+	if r.StatusCode != http.StatusPartialContent && r.StatusCode != http.StatusOK {
+		r.Body.Close()
+		return nil, NewHTTPError(r, "error fetching update header")
 	}
 
-	return r.Body, r.ContentLength, nil
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(r.Body, size), r.Body}, nil
+}
+
+// CheckArtifact tells if the artifact can be downloaded from the URL, with
+// HEAD request; returns ErrArtifactGone or ErrArtifactURLExpired if it can
+// not, other errors if that could not be found out. Servers not supporting
+// HEAD are assumed to have the artifact.
+func (u *UpdateClient) CheckArtifact(ctx context.Context, api ApiRequester,
+	url string) error {
+
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create artifact check request")
+	}
+	r, err := api.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "artifact check request failed")
+	}
+	r.Body.Close()
+
+	switch {
+	case r.StatusCode >= 200 && r.StatusCode < 300:
+		return nil
+	case r.StatusCode == http.StatusMethodNotAllowed ||
+		r.StatusCode == http.StatusNotImplemented:
+		log.Debugf("artifact server does not support HEAD requests (%d)", r.StatusCode)
+		return nil
+	case r.StatusCode == http.StatusNotFound || r.StatusCode == http.StatusGone:
+		return errors.Wrapf(ErrArtifactGone, "HTTP status %d", r.StatusCode)
+	case r.StatusCode == http.StatusForbidden:
+		return errors.Wrapf(ErrArtifactURLExpired, "HTTP status %d", r.StatusCode)
+	}
+	return NewHTTPError(r, "error checking artifact")
 }
 
 // have update for the client
@@ -124,8 +385,80 @@ type UpdateResponse struct {
 		}
 		CompatibleDevices []string `json:"device_types_compatible"`
 		ArtifactName      string   `json:"artifact_name"`
+		// Artifact metadata provided by the server (optional).
+		Metadata map[string]interface{} `json:"metadata,omitempty"`
 	}
 	ID string
+	// Deployment metadata: fields of the response the client does not know,
+	// preserved as they were received (numbers as json.Number) so that they
+	// can be passed on to policies, notification commands and the audit.
+	DeploymentMetadata map[string]interface{} `json:"-"`
+}
+
+// updateResponseFields are the response fields known to the client; JSON
+// field names are matched case insensitively.
+var updateResponseFields = []string{"artifact", "id"}
+
+func isUpdateResponseField(name string) bool {
+	for _, f := range updateResponseFields {
+		if strings.EqualFold(name, f) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ur *UpdateResponse) UnmarshalJSON(data []byte) error {
+	type known UpdateResponse
+	var k known
+	if err := json.Unmarshal(data, &k); err != nil {
+		return err
+	}
+
+	var fields map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil {
+		return err
+	}
+	k.DeploymentMetadata = nil
+	for name, v := range fields {
+		if isUpdateResponseField(name) {
+			continue
+		}
+		if k.DeploymentMetadata == nil {
+			k.DeploymentMetadata = make(map[string]interface{})
+		}
+		k.DeploymentMetadata[name] = v
+	}
+	*ur = UpdateResponse(k)
+	return nil
+}
+
+// MarshalJSON puts deployment metadata back next to the known fields, so
+// that the response survives being stored and loaded again.
+func (ur UpdateResponse) MarshalJSON() ([]byte, error) {
+	type known UpdateResponse
+	data, err := json.Marshal(known(ur))
+	if err != nil || len(ur.DeploymentMetadata) == 0 {
+		return data, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for name, v := range ur.DeploymentMetadata {
+		if isUpdateResponseField(name) {
+			continue
+		}
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to encode deployment metadata %q", name)
+		}
+		fields[name] = raw
+	}
+	return json.Marshal(fields)
 }
 
 func (ur UpdateResponse) CompatibleDevices() []string {
@@ -140,6 +473,39 @@ func (ur UpdateResponse) URI() string {
 	return ur.Artifact.Source.URI
 }
 
+// Layouts of artifact URL expiry time; the server omits the colon of the
+// zone offset.
+var uriExpireLayouts = []string{
+	"2006-01-02T15:04:05.999999999Z0700",
+	time.RFC3339Nano,
+}
+
+// URIExpired tells if the artifact URL expired by now, going by the expiry
+// time given by the server; false if none was given.
+func (ur UpdateResponse) URIExpired(now time.Time) bool {
+	for _, layout := range uriExpireLayouts {
+		if expire, err := time.Parse(layout, ur.Artifact.Source.Expire); err == nil {
+			return !now.Before(expire)
+		}
+	}
+	return false
+}
+
+// PollIntervalHint returns polling interval requested by the server in the
+// response headers; false if none or invalid.
+func PollIntervalHint(h http.Header) (time.Duration, bool) {
+	v := h.Get(PollIntervalHeader)
+	if v == "" {
+		return 0, false
+	}
+	secs, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || secs <= 0 {
+		log.Warnf("ignoring invalid polling interval hint %q", v)
+		return 0, false
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
 func validateGetUpdate(update UpdateResponse) error {
 	// check if we have JSON data correctly decoded
 	if update.ID == "" ||
@@ -187,7 +553,7 @@ func processUpdateResponse(response *http.Response) (interface{}, error) {
 
 	default:
 		log.Warn("Client recieved invalid response status code: ", response.StatusCode)
-		return nil, errors.New("Invalid response received from server")
+		return nil, NewHTTPError(response, "invalid response received from server")
 	}
 }
 
@@ -199,6 +565,10 @@ func makeUpdateCheckRequest(server string, current CurrentUpdate) (*http.Request
 	if current.Artifact != "" {
 		vals.Add("artifact_name", current.Artifact)
 	}
+	if current.Channel != "" {
+		vals.Add("update_channel", current.Channel)
+	}
+	current.Capabilities.addQuery(vals)
 
 	ep := "/deployments/device/deployments/next"
 	if len(vals) != 0 {
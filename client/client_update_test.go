@@ -14,14 +14,19 @@
 package client
 
 import (
-	"errors"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -163,6 +168,53 @@ func TestParseUpdateResponse(t *testing.T) {
 	}
 }
 
+func TestUpdateResponseDeploymentMetadata(t *testing.T) {
+	data := `{
+		"id": "deployment-123",
+		"artifact": {
+			"source": {"uri": "https://menderupdate.com"},
+			"device_types_compatible": ["BBB"],
+			"artifact_name": "release-1"
+		},
+		"campaign": "spring",
+		"window": {"start": "02:00", "end": "04:00"},
+		"rollout_id": 12345678901234567890
+	}`
+
+	var update UpdateResponse
+	assert.NoError(t, json.Unmarshal([]byte(data), &update))
+	assert.Equal(t, "deployment-123", update.ID)
+	assert.Equal(t, "release-1", update.ArtifactName())
+	assert.Equal(t, map[string]interface{}{
+		"campaign":   "spring",
+		"window":     map[string]interface{}{"start": "02:00", "end": "04:00"},
+		"rollout_id": json.Number("12345678901234567890"),
+	}, update.DeploymentMetadata)
+
+	// metadata survives being stored
+	stored, err := json.Marshal(update)
+	assert.NoError(t, err)
+	var loaded UpdateResponse
+	assert.NoError(t, json.Unmarshal(stored, &loaded))
+	assert.Equal(t, update, loaded)
+	assert.Contains(t, string(stored), "12345678901234567890")
+
+	// metadata does not override known fields
+	loaded.DeploymentMetadata["ID"] = "other"
+	stored, err = json.Marshal(loaded)
+	assert.NoError(t, err)
+	loaded = UpdateResponse{}
+	assert.NoError(t, json.Unmarshal(stored, &loaded))
+	assert.Equal(t, "deployment-123", loaded.ID)
+
+	// response without extra fields
+	loaded = UpdateResponse{}
+	assert.NoError(t, json.Unmarshal([]byte(correctUpdateResponse), &loaded))
+	assert.Nil(t, loaded.DeploymentMetadata)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"id": 1}`), &loaded))
+}
+
 func Test_GetScheduledUpdate_errorParsingResponse_UpdateFailing(t *testing.T) {
 	// Test server that always responds with 200 code, and specific payload
 	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -184,7 +236,7 @@ func Test_GetScheduledUpdate_errorParsingResponse_UpdateFailing(t *testing.T) {
 
 	fakeProcessUpdate := func(response *http.Response) (interface{}, error) { return nil, errors.New("") }
 
-	_, err = client.getUpdateInfo(ac, fakeProcessUpdate, ts.URL, CurrentUpdate{})
+	_, err = client.getUpdateInfo(context.Background(), ac, fakeProcessUpdate, ts.URL, CurrentUpdate{})
 	assert.Error(t, err)
 }
 
@@ -208,7 +260,7 @@ func Test_GetScheduledUpdate_responseMissingParameters_UpdateFailing(t *testing.
 	assert.NotNil(t, client)
 	fakeProcessUpdate := func(response *http.Response) (interface{}, error) { return nil, nil }
 
-	_, err = client.getUpdateInfo(ac, fakeProcessUpdate, ts.URL, CurrentUpdate{})
+	_, err = client.getUpdateInfo(context.Background(), ac, fakeProcessUpdate, ts.URL, CurrentUpdate{})
 	assert.NoError(t, err)
 }
 
@@ -231,7 +283,7 @@ func Test_GetScheduledUpdate_ParsingResponseOK_updateSuccess(t *testing.T) {
 	client := NewUpdate()
 	assert.NotNil(t, client)
 
-	data, err := client.GetScheduledUpdate(ac, ts.URL, CurrentUpdate{})
+	data, err := client.GetScheduledUpdate(context.Background(), ac, ts.URL, CurrentUpdate{})
 	assert.NoError(t, err)
 	update, ok := data.(UpdateResponse)
 	assert.True(t, ok)
@@ -257,7 +309,7 @@ func Test_FetchUpdate_noContent_UpdateFailing(t *testing.T) {
 	client := NewUpdate()
 	assert.NotNil(t, client)
 
-	_, _, err = client.FetchUpdate(ac, ts.URL)
+	_, _, err = client.FetchUpdate(context.Background(), ac, ts.URL)
 	assert.Error(t, err)
 }
 
@@ -280,7 +332,7 @@ func Test_FetchUpdate_invalidRequest_UpdateFailing(t *testing.T) {
 	client := NewUpdate()
 	assert.NotNil(t, client)
 
-	_, _, err = client.FetchUpdate(ac, "broken-request")
+	_, _, err = client.FetchUpdate(context.Background(), ac, "broken-request")
 	assert.Error(t, err)
 }
 
@@ -304,18 +356,18 @@ func Test_FetchUpdate_correctContent_UpdateFetched(t *testing.T) {
 	assert.NotNil(t, client)
 	client.minImageSize = 1
 
-	_, _, err = client.FetchUpdate(ac, ts.URL)
+	_, _, err = client.FetchUpdate(context.Background(), ac, ts.URL)
 	assert.NoError(t, err)
 }
 
 func Test_UpdateApiClientError(t *testing.T) {
 	client := NewUpdate()
 
-	_, err := client.GetScheduledUpdate(NewMockApiClient(nil, errors.New("foo")),
+	_, err := client.GetScheduledUpdate(context.Background(), NewMockApiClient(nil, errors.New("foo")),
 		"http://foo.bar", CurrentUpdate{})
 	assert.Error(t, err)
 
-	_, _, err = client.FetchUpdate(NewMockApiClient(nil, errors.New("foo")),
+	_, _, err = client.FetchUpdate(context.Background(), NewMockApiClient(nil, errors.New("foo")),
 		"http://foo.bar")
 	assert.Error(t, err)
 }
@@ -349,4 +401,369 @@ func TestMakeUpdateCheckRequest(t *testing.T) {
 	assert.Equal(t, "http://foo.bar/api/devices/v1/deployments/device/deployments/next?artifact_name=foo&device_type=hammer",
 		req.URL.String())
 	t.Logf("%s\n", req.URL.String())
+
+	req, err = makeUpdateCheckRequest("http://foo.bar", CurrentUpdate{
+		Artifact:   "foo",
+		DeviceType: "hammer",
+		Channel:    "beta",
+	})
+	assert.NotNil(t, req)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "http://foo.bar/api/devices/v1/deployments/device/deployments/next?artifact_name=foo&device_type=hammer&update_channel=beta",
+		req.URL.String())
+}
+
+func TestUpdateCheckCapabilities(t *testing.T) {
+	current := CurrentUpdate{
+		Artifact: "foo",
+		Capabilities: &DeviceCapabilities{
+			FreeSpaceMB:  512,
+			LinkSpeed:    125000,
+			PayloadTypes: []string{"rootfs-image", "app-slot"},
+		},
+	}
+
+	req, err := makeUpdateCheckRequest("http://foo.bar", current)
+	assert.NoError(t, err)
+	q := req.URL.Query()
+	assert.Equal(t, "foo", q.Get("artifact_name"))
+	assert.Equal(t, "512", q.Get("free_space_mb"))
+	assert.Equal(t, "125000", q.Get("link_speed"))
+	assert.Equal(t, "rootfs-image,app-slot", q.Get("payload_types"))
+	assert.Equal(t, "false", q.Get("supports_delta"))
+	// not measured yet
+	_, ok := q["install_rate"]
+	assert.False(t, ok)
+	_, ok = q["probe_speed"]
+	assert.False(t, ok)
+
+	req, err = makeUpdateCheckRequestV2("http://foo.bar", current)
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(req.Body)
+	assert.JSONEq(t, `{
+		"device_provides": {"artifact_name": "foo"},
+		"device_capabilities": {
+			"free_space_mb": 512,
+			"link_speed": 125000,
+			"payload_types": ["rootfs-image", "app-slot"],
+			"supports_delta": false
+		}
+	}`, string(body))
+}
+
+func TestFetchUpdateLargeImage(t *testing.T) {
+	// size which does not fit in 32 bits
+	const size = int64(5 * 1024 * 1024 * 1024)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		// connection is dropped after the first bytes
+		io.WriteString(w, "0123456789")
+	}))
+	defer ts.Close()
+
+	client := NewUpdate()
+	api := &ApiClient{}
+
+	img, sz, err := client.FetchUpdate(context.Background(), api, ts.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, size, sz)
+
+	// image is streamed, never read in whole
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(img, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", string(buf))
+	_, err = io.Copy(ioutil.Discard, img)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	img.Close()
+}
+
+// zeroReader yields `left` zero bytes.
+type zeroReader struct {
+	left int64
+}
+
+func (r *zeroReader) Read(p []byte) (int, error) {
+	if r.left == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	r.left -= int64(len(p))
+	return len(p), nil
+}
+
+func TestFetchUpdateLargeImageStreamed(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams more than 4 GiB")
+	}
+
+	const size = int64(4*1024*1024*1024 + 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		io.Copy(w, &zeroReader{left: size})
+	}))
+	defer ts.Close()
+
+	client := NewUpdate()
+	img, sz, err := client.FetchUpdate(context.Background(), &ApiClient{}, ts.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, size, sz)
+	defer img.Close()
+
+	n, err := io.Copy(ioutil.Discard, img)
+	assert.NoError(t, err)
+	assert.Equal(t, size, n)
+	diag := img.(FetchDiagnosticsReporter).FetchDiagnostics()
+	assert.Equal(t, size, diag.BytesReceived)
+}
+
+func TestFetchUpdateHeader(t *testing.T) {
+	image := strings.Repeat("0123456789", 1000)
+	supportRange := true
+	status := http.StatusOK
+	var rangeHdr string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangeHdr = r.Header.Get("Range")
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		if supportRange {
+			http.ServeContent(w, r, "image", time.Time{}, strings.NewReader(image))
+			return
+		}
+		io.WriteString(w, image)
+	}))
+	defer ts.Close()
+
+	client := NewUpdate()
+	api := &ApiClient{}
+
+	hdr, err := client.FetchUpdateHeader(context.Background(), api, ts.URL, 100)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(hdr)
+	hdr.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, image[:100], string(data))
+	assert.Equal(t, "bytes=0-99", rangeHdr)
+
+	// server sends whole image, only the leading part is read
+	supportRange = false
+	hdr, err = client.FetchUpdateHeader(context.Background(), api, ts.URL, 100)
+	assert.NoError(t, err)
+	data, err = ioutil.ReadAll(hdr)
+	hdr.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, image[:100], string(data))
+
+	status = http.StatusNotFound
+	_, err = client.FetchUpdateHeader(context.Background(), api, ts.URL, 100)
+	assert.Error(t, err)
+
+	_, err = client.FetchUpdateHeader(context.Background(),
+		NewMockApiClient(nil, errors.New("foo")), ts.URL, 100)
+	assert.Error(t, err)
+}
+
+func TestGetScheduledUpdateConditional(t *testing.T) {
+	etag := `"no-deployment-1"`
+	haveUpdate := false
+	var reqHeader http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqHeader = r.Header
+		switch {
+		case haveUpdate:
+			w.Header().Set("ETag", `"deployment-2"`)
+			w.Write([]byte(correctUpdateResponse))
+		case etag != "" && r.Header.Get("If-None-Match") == etag:
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			if etag != "" {
+				w.Header().Set("ETag", etag)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer ts.Close()
+
+	ac, err := New(Config{})
+	assert.NoError(t, err)
+	client := NewUpdate()
+	current := CurrentUpdate{Artifact: "release-1", DeviceType: "BBB"}
+
+	// first check is a plain request
+	data, err := client.GetScheduledUpdate(context.Background(), ac, ts.URL, current)
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+	assert.Empty(t, reqHeader.Get("If-None-Match"))
+
+	// server confirms nothing changed
+	data, err = client.GetScheduledUpdate(context.Background(), ac, ts.URL, current)
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+	assert.Equal(t, etag, reqHeader.Get("If-None-Match"))
+
+	// different query is not conditional
+	data, err = client.GetScheduledUpdate(context.Background(), ac, ts.URL,
+		CurrentUpdate{Artifact: "release-0", DeviceType: "BBB"})
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+	assert.Empty(t, reqHeader.Get("If-None-Match"))
+
+	// update responses are not remembered
+	haveUpdate = true
+	data, err = client.GetScheduledUpdate(context.Background(), ac, ts.URL, current)
+	assert.NoError(t, err)
+	assert.IsType(t, UpdateResponse{}, data)
+	data, err = client.GetScheduledUpdate(context.Background(), ac, ts.URL, current)
+	assert.NoError(t, err)
+	assert.IsType(t, UpdateResponse{}, data)
+	assert.Empty(t, reqHeader.Get("If-None-Match"))
+
+	// server not supporting conditional requests
+	haveUpdate = false
+	etag = ""
+	for i := 0; i < 2; i++ {
+		data, err = client.GetScheduledUpdate(context.Background(), ac, ts.URL, current)
+		assert.NoError(t, err)
+		assert.Nil(t, data)
+		assert.Empty(t, reqHeader.Get("If-None-Match"))
+		assert.Empty(t, reqHeader.Get("If-Modified-Since"))
+	}
+}
+
+func TestPollIntervalHint(t *testing.T) {
+	header := http.Header{}
+	_, ok := PollIntervalHint(header)
+	assert.False(t, ok)
+
+	header.Set(PollIntervalHeader, " 90 ")
+	interval, ok := PollIntervalHint(header)
+	assert.True(t, ok)
+	assert.Equal(t, 90*time.Second, interval)
+
+	for _, v := range []string{"0", "-5", "1m", "fast"} {
+		header.Set(PollIntervalHeader, v)
+		_, ok = PollIntervalHint(header)
+		assert.False(t, ok, v)
+	}
+}
+
+func TestCheckArtifact(t *testing.T) {
+	status := http.StatusOK
+	var method string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	client := NewUpdate()
+	api := &ApiClient{}
+
+	assert.NoError(t, client.CheckArtifact(context.Background(), api, ts.URL))
+	assert.Equal(t, http.MethodHead, method)
+
+	// HEAD not supported
+	status = http.StatusMethodNotAllowed
+	assert.NoError(t, client.CheckArtifact(context.Background(), api, ts.URL))
+
+	for code, cause := range map[int]error{
+		http.StatusNotFound:  ErrArtifactGone,
+		http.StatusGone:      ErrArtifactGone,
+		http.StatusForbidden: ErrArtifactURLExpired,
+	} {
+		status = code
+		err := client.CheckArtifact(context.Background(), api, ts.URL)
+		assert.Equal(t, cause, errors.Cause(err), "status %d", code)
+	}
+
+	status = http.StatusInternalServerError
+	err := client.CheckArtifact(context.Background(), api, ts.URL)
+	assert.IsType(t, &HTTPError{}, errors.Cause(err))
+	assert.Equal(t, ErrorClassTransient, ClassifyError(err))
+
+	err = client.CheckArtifact(context.Background(),
+		NewMockApiClient(nil, errors.New("foo")), ts.URL)
+	assert.Error(t, err)
+}
+
+func TestUpdateResponseURIExpired(t *testing.T) {
+	now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	var update UpdateResponse
+	assert.False(t, update.URIExpired(now))
+
+	update.Artifact.Source.Expire = "2017-03-01T13:00:00Z"
+	assert.False(t, update.URIExpired(now))
+	update.Artifact.Source.Expire = "2017-03-01T11:00:00Z"
+	assert.True(t, update.URIExpired(now))
+
+	// as sent by the server
+	update.Artifact.Source.Expire = "2017-03-01T11:00:00.063+0000"
+	assert.True(t, update.URIExpired(now))
+
+	update.Artifact.Source.Expire = "garbage"
+	assert.False(t, update.URIExpired(now))
+}
+
+func TestFetchUpdateFrom(t *testing.T) {
+	image := strings.Repeat("0123456789", 1000)
+	supportRange := true
+	status := http.StatusOK
+	var rangeHdr string
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangeHdr = r.Header.Get("Range")
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		if supportRange {
+			http.ServeContent(w, r, "image", time.Time{}, strings.NewReader(image))
+			return
+		}
+		io.WriteString(w, image)
+	}))
+	defer ts.Close()
+
+	client := NewUpdate()
+	api := &ApiClient{}
+
+	img, err := client.FetchUpdateFrom(context.Background(), api, ts.URL, 1234)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(img)
+	img.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, image[1234:], string(data))
+	assert.Equal(t, "bytes=1234-", rangeHdr)
+
+	// leading part is skipped if the server sends whole image
+	supportRange = false
+	img, err = client.FetchUpdateFrom(context.Background(), api, ts.URL, 1234)
+	assert.NoError(t, err)
+	data, err = ioutil.ReadAll(img)
+	img.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, image[1234:], string(data))
+
+	for code, cause := range map[int]error{
+		http.StatusNotFound:  ErrArtifactGone,
+		http.StatusForbidden: ErrArtifactURLExpired,
+	} {
+		status = code
+		_, err = client.FetchUpdateFrom(context.Background(), api, ts.URL, 1234)
+		assert.Equal(t, cause, errors.Cause(err), "status %d", code)
+	}
+
+	status = http.StatusInternalServerError
+	_, err = client.FetchUpdateFrom(context.Background(), api, ts.URL, 1234)
+	assert.IsType(t, &HTTPError{}, errors.Cause(err))
 }
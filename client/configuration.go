@@ -0,0 +1,107 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// server does not support device configuration
+var ErrConfigurationNotSupported = errors.New("server does not support device configuration")
+
+// DeviceConfiguration is a configuration document the server deploys to the
+// device, in parallel to update deployments. The document is passed to the
+// device as is.
+type DeviceConfiguration struct {
+	ID            string          `json:"id"`
+	Configuration json.RawMessage `json:"configuration"`
+}
+
+// GetConfiguration returns configuration pending for the device, nil if
+// there is none.
+func GetConfiguration(ctx context.Context, api ApiRequester,
+	server string) (*DeviceConfiguration, error) {
+
+	req, err := http.NewRequest(http.MethodGet,
+		buildApiURL(server, "/deviceconfig/configuration"), nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create configuration request")
+	}
+
+	r, err := api.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "configuration request failed")
+	}
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return nil, ErrConfigurationNotSupported
+	case http.StatusUnauthorized:
+		return nil, ErrNotAuthorized
+	default:
+		return nil, NewHTTPError(r, "configuration request failed")
+	}
+
+	var config DeviceConfiguration
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse configuration")
+	}
+	if config.ID == "" || len(config.Configuration) == 0 {
+		return nil, errors.New("configuration without ID or document")
+	}
+	return &config, nil
+}
+
+// ReportConfiguration tells the server which configuration is applied on the
+// device.
+func ReportConfiguration(ctx context.Context, api ApiRequester, server string,
+	config DeviceConfiguration) error {
+
+	body, err := json.Marshal(config)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode configuration")
+	}
+	req, err := http.NewRequest(http.MethodPut,
+		buildApiURL(server, "/deviceconfig/configuration"), bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "failed to create configuration report request")
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	r, err := api.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "reporting configuration failed")
+	}
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusNoContent, http.StatusOK:
+		return nil
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return ErrConfigurationNotSupported
+	case http.StatusUnauthorized:
+		return ErrNotAuthorized
+	default:
+		return NewHTTPError(r, "reporting configuration failed")
+	}
+}
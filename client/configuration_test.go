@@ -0,0 +1,92 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetConfiguration(t *testing.T) {
+	var status int
+	var path, body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	status = http.StatusOK
+	body = `{"id": "config-1", "configuration": {"timezone": "Europe/Oslo"}}`
+	config, err := GetConfiguration(context.Background(), http.DefaultClient, ts.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, apiPrefix+"deviceconfig/configuration", path)
+	assert.Equal(t, "config-1", config.ID)
+	assert.JSONEq(t, `{"timezone": "Europe/Oslo"}`, string(config.Configuration))
+
+	// nothing pending
+	status = http.StatusNoContent
+	body = ""
+	config, err = GetConfiguration(context.Background(), http.DefaultClient, ts.URL)
+	assert.NoError(t, err)
+	assert.Nil(t, config)
+
+	status = http.StatusOK
+	body = `{"configuration": {}}`
+	_, err = GetConfiguration(context.Background(), http.DefaultClient, ts.URL)
+	assert.Error(t, err)
+
+	status = http.StatusNotFound
+	_, err = GetConfiguration(context.Background(), http.DefaultClient, ts.URL)
+	assert.Equal(t, ErrConfigurationNotSupported, err)
+
+	status = http.StatusUnauthorized
+	_, err = GetConfiguration(context.Background(), http.DefaultClient, ts.URL)
+	assert.Equal(t, ErrNotAuthorized, err)
+}
+
+func TestReportConfiguration(t *testing.T) {
+	var status int
+	var method string
+	var recdata []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		recdata, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	config := DeviceConfiguration{
+		ID:            "config-1",
+		Configuration: []byte(`{"timezone": "Europe/Oslo"}`),
+	}
+
+	status = http.StatusNoContent
+	err := ReportConfiguration(context.Background(), http.DefaultClient, ts.URL, config)
+	assert.NoError(t, err)
+	assert.Equal(t, http.MethodPut, method)
+	assert.JSONEq(t, `{"id": "config-1", "configuration": {"timezone": "Europe/Oslo"}}`,
+		string(recdata))
+
+	status = http.StatusInternalServerError
+	err = ReportConfiguration(context.Background(), http.DefaultClient, ts.URL, config)
+	assert.Error(t, err)
+	assert.Equal(t, ErrorClassTransient, ClassifyError(err))
+}
@@ -0,0 +1,237 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Steps of connection check, in order.
+const (
+	CheckStepDNS         = "dns"
+	CheckStepTCP         = "tcp"
+	CheckStepTLS         = "tls"
+	CheckStepAuth        = "auth"
+	CheckStepDeployments = "deployments"
+)
+
+// Result of connection check step.
+const (
+	CheckOK      = "ok"
+	CheckFailed  = "failed"
+	CheckSkipped = "skipped"
+)
+
+const connectionCheckDialTimeout = 10 * time.Second
+
+type ConnectionCheckStep struct {
+	Name    string
+	Result  string
+	Detail  string
+	Latency time.Duration
+}
+
+type connectionCheck struct {
+	steps []ConnectionCheckStep
+
+	ctx    context.Context
+	api    *ApiClient
+	server string
+	auth   AuthDataMessenger
+	// server address, and what earlier steps obtained for the later ones
+	url        *url.URL
+	host, port string
+	conn       net.Conn
+	token      AuthToken
+}
+
+// run executes the step unless an earlier step failed; the step returns
+// detail of the result.
+func (cc *connectionCheck) run(name string, step func() (string, error)) {
+	for _, s := range cc.steps {
+		if s.Result != CheckOK {
+			cc.steps = append(cc.steps, ConnectionCheckStep{
+				Name:   name,
+				Result: CheckSkipped,
+			})
+			return
+		}
+	}
+
+	start := time.Now()
+	detail, err := step()
+	s := ConnectionCheckStep{
+		Name:    name,
+		Result:  CheckOK,
+		Detail:  detail,
+		Latency: time.Since(start),
+	}
+	if err != nil {
+		s.Result = CheckFailed
+		s.Detail = err.Error()
+	}
+	cc.steps = append(cc.steps, s)
+}
+
+// CheckConnection diagnoses connectivity with the server step by step: DNS
+// resolution, TCP connection, TLS handshake, authorization request and
+// request to the deployments endpoint; once a step fails, the following
+// ones are skipped. The authorization token obtained is not stored
+// anywhere; auth may be nil if the device has no key yet.
+func CheckConnection(ctx context.Context, api *ApiClient, server string,
+	auth AuthDataMessenger) []ConnectionCheckStep {
+	cc := &connectionCheck{
+		ctx:    ctx,
+		api:    api,
+		server: server,
+		auth:   auth,
+		token:  EmptyAuthToken,
+	}
+
+	u, err := url.Parse(buildURL(server))
+	if err != nil {
+		cc.steps = append(cc.steps, ConnectionCheckStep{
+			Name:   CheckStepDNS,
+			Result: CheckFailed,
+			Detail: errors.Wrapf(err, "invalid server URL %s", server).Error(),
+		})
+	} else {
+		cc.url = u
+		cc.host, cc.port = serverHostPort(u)
+	}
+
+	cc.run(CheckStepDNS, cc.checkDNS)
+	cc.run(CheckStepTCP, cc.checkTCP)
+	if cc.conn != nil {
+		defer cc.conn.Close()
+	}
+	cc.run(CheckStepTLS, cc.checkTLS)
+	cc.run(CheckStepAuth, cc.checkAuth)
+	cc.run(CheckStepDeployments, cc.checkDeployments)
+
+	return cc.steps
+}
+
+// Host and port to connect to, with the default port of the scheme if not
+// given.
+func serverHostPort(u *url.URL) (string, string) {
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = strings.Trim(u.Host, "[]")
+	}
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return host, port
+}
+
+func (cc *connectionCheck) checkDNS() (string, error) {
+	addrs, err := net.LookupHost(cc.host)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s resolved to %v", cc.host, addrs), nil
+}
+
+func (cc *connectionCheck) checkTCP() (string, error) {
+	d := net.Dialer{
+		Timeout: connectionCheckDialTimeout,
+		Control: cc.api.dialer.Control,
+	}
+	c, err := d.DialContext(cc.ctx, "tcp", net.JoinHostPort(cc.host, cc.port))
+	if err != nil {
+		return "", err
+	}
+	cc.conn = c
+	return fmt.Sprintf("connected to %s", c.RemoteAddr()), nil
+}
+
+func (cc *connectionCheck) checkTLS() (string, error) {
+	if cc.url.Scheme == "http" {
+		return "not used", nil
+	}
+	tc := tls.Client(cc.conn, cc.api.checkTLSConfig(cc.host))
+	cc.conn.SetDeadline(time.Now().Add(connectionCheckDialTimeout))
+	if err := tc.Handshake(); err != nil {
+		return "", err
+	}
+	state := tc.ConnectionState()
+	detail := fmt.Sprintf("TLS version %#x", state.Version)
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		detail += fmt.Sprintf(", server certificate %s expires %s",
+			cert.Subject.CommonName, cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+	return detail, nil
+}
+
+func (cc *connectionCheck) checkAuth() (string, error) {
+	if cc.auth == nil {
+		return "", errors.New("device key not available; bootstrap first")
+	}
+	data, err := NewAuth().Request(cc.ctx, cc.api, cc.server, cc.auth)
+	switch {
+	case err == AuthErrorUnauthorized:
+		// server reached, the device just is not accepted (yet)
+		return "device not authorized by server", nil
+	case err != nil:
+		return "", err
+	}
+	cc.token = AuthToken(data)
+	return "device authorized", nil
+}
+
+func (cc *connectionCheck) checkDeployments() (string, error) {
+	req, err := http.NewRequest(http.MethodHead,
+		buildApiURL(cc.server, "/deployments/device/deployments/next"), nil)
+	if err != nil {
+		return "", err
+	}
+	var requester ApiRequester = cc.api
+	if cc.token != EmptyAuthToken {
+		requester = cc.api.Request(cc.token)
+	}
+	rsp, err := requester.Do(req.WithContext(cc.ctx))
+	if err != nil {
+		return "", err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode >= 500 {
+		return "", NewHTTPError(rsp, "deployments endpoint failed")
+	}
+	return fmt.Sprintf("server responded with %s", rsp.Status), nil
+}
+
+// TLS configuration of the client for connecting to host.
+func (a *ApiClient) checkTLSConfig(host string) *tls.Config {
+	conf := &tls.Config{ServerName: host}
+	if t, ok := a.Client.Transport.(*http.Transport); ok && t.TLSClientConfig != nil {
+		conf.RootCAs = t.TLSClientConfig.RootCAs
+		conf.Certificates = t.TLSClientConfig.Certificates
+		conf.InsecureSkipVerify = t.TLSClientConfig.InsecureSkipVerify
+	}
+	return conf
+}
@@ -0,0 +1,140 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func checkResults(steps []ConnectionCheckStep) map[string]string {
+	res := map[string]string{}
+	for _, s := range steps {
+		res[s.Name] = s.Result
+	}
+	return res
+}
+
+func TestCheckConnection(t *testing.T) {
+	var authStatus, deploymentsStatus int
+	var deploymentsAuth, deploymentsMethod string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case apiPrefix + "authentication/auth_requests":
+			w.WriteHeader(authStatus)
+			w.Write([]byte("device-token"))
+		case apiPrefix + "deployments/device/deployments/next":
+			deploymentsAuth = r.Header.Get("Authorization")
+			deploymentsMethod = r.Method
+			w.WriteHeader(deploymentsStatus)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	// trust the certificate of the test server
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	serverCert := path.Join(tdir, "server.crt")
+	assert.NoError(t, ioutil.WriteFile(serverCert, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: ts.TLS.Certificates[0].Certificate[0],
+	}), 0644))
+
+	ac, err := NewApiClient(Config{ServerCert: serverCert, IsHttps: true})
+	assert.NoError(t, err)
+
+	msger := &testAuthDataMessenger{reqData: []byte("foobar")}
+	order := []string{CheckStepDNS, CheckStepTCP, CheckStepTLS, CheckStepAuth,
+		CheckStepDeployments}
+
+	authStatus, deploymentsStatus = http.StatusOK, http.StatusNoContent
+	steps := CheckConnection(context.Background(), ac, ts.URL, msger)
+	assert.Len(t, steps, len(order))
+	for i, s := range steps {
+		assert.Equal(t, order[i], s.Name)
+		assert.Equal(t, CheckOK, s.Result, "%s: %s", s.Name, s.Detail)
+	}
+	assert.Equal(t, http.MethodHead, deploymentsMethod)
+	// token from the dry-run authorization is used
+	assert.Equal(t, "Bearer device-token", deploymentsAuth)
+	assert.Contains(t, steps[2].Detail, "server certificate")
+
+	// device not accepted yet; server is reachable nevertheless
+	authStatus, deploymentsStatus = http.StatusUnauthorized, http.StatusUnauthorized
+	steps = CheckConnection(context.Background(), ac, ts.URL, msger)
+	for _, s := range steps {
+		assert.Equal(t, CheckOK, s.Result, "%s: %s", s.Name, s.Detail)
+	}
+	assert.Equal(t, "", deploymentsAuth)
+
+	// no device key
+	steps = CheckConnection(context.Background(), ac, ts.URL, nil)
+	assert.Equal(t, map[string]string{
+		CheckStepDNS:         CheckOK,
+		CheckStepTCP:         CheckOK,
+		CheckStepTLS:         CheckOK,
+		CheckStepAuth:        CheckFailed,
+		CheckStepDeployments: CheckSkipped,
+	}, checkResults(steps))
+
+	// server error
+	authStatus, deploymentsStatus = http.StatusOK, http.StatusInternalServerError
+	steps = CheckConnection(context.Background(), ac, ts.URL, msger)
+	assert.Equal(t, CheckFailed, checkResults(steps)[CheckStepDeployments])
+
+	// server certificate not trusted
+	untrusted, err := NewApiClient(Config{ServerCert: "client.crt", IsHttps: true})
+	assert.NoError(t, err)
+	steps = CheckConnection(context.Background(), untrusted, ts.URL, msger)
+	assert.Equal(t, map[string]string{
+		CheckStepDNS:         CheckOK,
+		CheckStepTCP:         CheckOK,
+		CheckStepTLS:         CheckFailed,
+		CheckStepAuth:        CheckSkipped,
+		CheckStepDeployments: CheckSkipped,
+	}, checkResults(steps))
+}
+
+func TestCheckConnectionUnreachable(t *testing.T) {
+	ac, err := NewApiClient(Config{})
+	assert.NoError(t, err)
+
+	// nothing listens there once the server is closed
+	ts := httptest.NewServer(http.NotFoundHandler())
+	url := ts.URL
+	ts.Close()
+
+	steps := CheckConnection(context.Background(), ac, url, nil)
+	assert.Equal(t, map[string]string{
+		CheckStepDNS:         CheckOK,
+		CheckStepTCP:         CheckFailed,
+		CheckStepTLS:         CheckSkipped,
+		CheckStepAuth:        CheckSkipped,
+		CheckStepDeployments: CheckSkipped,
+	}, checkResults(steps))
+
+	steps = CheckConnection(context.Background(), ac, "https://no-such-host.invalid", nil)
+	assert.Equal(t, CheckFailed, checkResults(steps)[CheckStepDNS])
+	assert.Equal(t, CheckSkipped, checkResults(steps)[CheckStepTCP])
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+var (
+	// server does not let devices request deployments
+	ErrDeploymentRequestNotSupported = errors.New("server does not support deployment requests")
+	// artifact is not known to the server or not compatible with the device
+	ErrArtifactNotFound = errors.New("artifact not found")
+)
+
+// DeploymentRequest asks the server to deploy the named artifact to the
+// device, eg. when a technician reinstalls the device on site.
+type DeploymentRequest struct {
+	ArtifactName string `json:"artifact_name"`
+}
+
+// RequestDeployment sends deployment request to the server and returns ID of
+// the deployment created, if the server tells it.
+func RequestDeployment(ctx context.Context, api ApiRequester, server string,
+	request DeploymentRequest) (string, error) {
+
+	body, _ := json.Marshal(&request)
+	req, err := http.NewRequest(http.MethodPost,
+		buildApiURL(server, "/deployments/device/deployments/requests"),
+		bytes.NewReader(body))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create deployment request")
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	r, err := api.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.Wrapf(err, "deployment request failed")
+	}
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusCreated, http.StatusAccepted, http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return "", ErrDeploymentRequestNotSupported
+	case http.StatusUnprocessableEntity:
+		return "", errors.Wrapf(ErrArtifactNotFound, "artifact %s", request.ArtifactName)
+	case http.StatusUnauthorized:
+		return "", ErrNotAuthorized
+	default:
+		return "", NewHTTPError(r, "deployment request failed")
+	}
+
+	var rsp struct {
+		ID string `json:"id"`
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err == nil && len(data) != 0 {
+		if err := json.Unmarshal(data, &rsp); err != nil {
+			log.Warnf("failed to parse deployment request response: %v", err)
+		}
+	}
+	if loc := r.Header.Get("Location"); rsp.ID == "" && loc != "" {
+		rsp.ID = path.Base(loc)
+	}
+	return rsp.ID, nil
+}
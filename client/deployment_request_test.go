@@ -0,0 +1,86 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestDeployment(t *testing.T) {
+	var status int
+	var body, location, path string
+	var recdata []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		recdata, _ = ioutil.ReadAll(r.Body)
+		if location != "" {
+			w.Header().Set("Location", location)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	request := DeploymentRequest{ArtifactName: "release-2"}
+
+	status, body = http.StatusCreated, `{"id": "deployment-1"}`
+	id, err := RequestDeployment(context.Background(), http.DefaultClient, ts.URL, request)
+	assert.NoError(t, err)
+	assert.Equal(t, "deployment-1", id)
+	assert.Equal(t, apiPrefix+"deployments/device/deployments/requests", path)
+	assert.JSONEq(t, `{"artifact_name": "release-2"}`, string(recdata))
+
+	// deployment ID in location only
+	status, body = http.StatusAccepted, ""
+	location = ts.URL + "/deployments/deployment-2"
+	id, err = RequestDeployment(context.Background(), http.DefaultClient, ts.URL, request)
+	assert.NoError(t, err)
+	assert.Equal(t, "deployment-2", id)
+
+	// nothing told
+	location = ""
+	id, err = RequestDeployment(context.Background(), http.DefaultClient, ts.URL, request)
+	assert.NoError(t, err)
+	assert.Equal(t, "", id)
+
+	for _, s := range []int{http.StatusNotFound, http.StatusMethodNotAllowed,
+		http.StatusNotImplemented} {
+		status = s
+		_, err = RequestDeployment(context.Background(), http.DefaultClient, ts.URL, request)
+		assert.Equal(t, ErrDeploymentRequestNotSupported, err)
+	}
+
+	status = http.StatusUnprocessableEntity
+	_, err = RequestDeployment(context.Background(), http.DefaultClient, ts.URL, request)
+	assert.Equal(t, ErrArtifactNotFound, errors.Cause(err))
+
+	status = http.StatusUnauthorized
+	_, err = RequestDeployment(context.Background(), http.DefaultClient, ts.URL, request)
+	assert.Equal(t, ErrNotAuthorized, err)
+
+	status = http.StatusInternalServerError
+	_, err = RequestDeployment(context.Background(), http.DefaultClient, ts.URL, request)
+	assert.IsType(t, &HTTPError{}, err)
+
+	_, err = RequestDeployment(context.Background(),
+		NewMockApiClient(nil, errors.New("foo")), ts.URL, request)
+	assert.Error(t, err)
+}
@@ -0,0 +1,71 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// server does not let devices set their own group or tags
+var ErrDeviceTaggingNotSupported = errors.New("server does not support device-initiated tagging")
+
+// SetDeviceGroup assigns the device to the group on the server, eg. when
+// provisioning scripts place the device in a group deployments are targeted
+// at.
+func SetDeviceGroup(ctx context.Context, api ApiRequester, server string,
+	group string) error {
+	return putDeviceTags(ctx, api, buildApiURL(server, "/inventory/device/group"),
+		struct {
+			Group string `json:"group"`
+		}{group}, "device group")
+}
+
+// SetDeviceTags sets tags of the device on the server; tags not given are
+// left as they are.
+func SetDeviceTags(ctx context.Context, api ApiRequester, server string,
+	tags []InventoryAttribute) error {
+	return putDeviceTags(ctx, api, buildApiURL(server, "/inventory/device/tags"),
+		tags, "device tags")
+}
+
+func putDeviceTags(ctx context.Context, api ApiRequester, url string,
+	data interface{}, what string) error {
+	body, _ := json.Marshal(data)
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s request", what)
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	r, err := api.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "failed to set %s", what)
+	}
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusCreated:
+		return nil
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return ErrDeviceTaggingNotSupported
+	case http.StatusUnauthorized:
+		return ErrNotAuthorized
+	}
+	return NewHTTPError(r, "failed to set "+what)
+}
@@ -0,0 +1,70 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetDeviceTags(t *testing.T) {
+	var status int
+	var method, path string
+	var recdata []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		recdata, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	status = http.StatusNoContent
+	err := SetDeviceGroup(context.Background(), http.DefaultClient, ts.URL, "factory-line-3")
+	assert.NoError(t, err)
+	assert.Equal(t, http.MethodPut, method)
+	assert.Equal(t, apiPrefix+"inventory/device/group", path)
+	assert.JSONEq(t, `{"group": "factory-line-3"}`, string(recdata))
+
+	status = http.StatusOK
+	err = SetDeviceTags(context.Background(), http.DefaultClient, ts.URL,
+		[]InventoryAttribute{{Name: "site", Value: "oslo"}})
+	assert.NoError(t, err)
+	assert.Equal(t, apiPrefix+"inventory/device/tags", path)
+	assert.JSONEq(t, `[{"name": "site", "value": "oslo"}]`, string(recdata))
+
+	for _, s := range []int{http.StatusNotFound, http.StatusMethodNotAllowed,
+		http.StatusNotImplemented} {
+		status = s
+		err = SetDeviceGroup(context.Background(), http.DefaultClient, ts.URL, "g")
+		assert.Equal(t, ErrDeviceTaggingNotSupported, err)
+	}
+
+	status = http.StatusUnauthorized
+	err = SetDeviceTags(context.Background(), http.DefaultClient, ts.URL, nil)
+	assert.Equal(t, ErrNotAuthorized, err)
+
+	status = http.StatusBadRequest
+	err = SetDeviceGroup(context.Background(), http.DefaultClient, ts.URL, "g")
+	assert.IsType(t, &HTTPError{}, err)
+
+	err = SetDeviceGroup(context.Background(),
+		NewMockApiClient(nil, errors.New("foo")), ts.URL, "g")
+	assert.Error(t, err)
+}
@@ -0,0 +1,203 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// Freshly flashed devices often come up with broken /etc/resolv.conf, leaving
+// them unable to ever reach the server to get fixed. If configured, the
+// server hostname is resolved with DNS-over-HTTPS (JSON API, as served by
+// e.g. https://1.1.1.1/dns-query) when, and only when, the system resolver
+// fails. The resolver URL should use an IP address, as resolving its own
+// hostname requires the system resolver.
+const (
+	dohRequestTimeout = 10 * time.Second
+	// lower bound of time answers are cached for
+	dohMinCacheTime = time.Minute
+
+	dohTypeA    = 1
+	dohTypeAAAA = 28
+)
+
+type dohAnswer struct {
+	Type int    `json:"type"`
+	TTL  int    `json:"TTL"`
+	Data string `json:"data"`
+}
+
+type dohResponse struct {
+	Status int         `json:"Status"`
+	Answer []dohAnswer `json:"Answer"`
+}
+
+type dohCacheEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+type dohResolver struct {
+	url    string
+	client *http.Client
+
+	lock  sync.Mutex
+	cache map[string]dohCacheEntry
+}
+
+func newDoHResolver(resolverURL string) (*dohResolver, error) {
+	u, err := url.Parse(resolverURL)
+	if err != nil || u.Host == "" {
+		return nil, errors.Errorf("invalid DNS-over-HTTPS resolver URL %q",
+			resolverURL)
+	}
+	return &dohResolver{
+		url:    resolverURL,
+		client: &http.Client{Timeout: dohRequestTimeout},
+		cache:  make(map[string]dohCacheEntry),
+	}, nil
+}
+
+func (r *dohResolver) query(ctx context.Context, host string,
+	qtype int) ([]string, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	q := url.Values{}
+	q.Set("name", host)
+	q.Set("type", map[int]string{dohTypeA: "A", dohTypeAAAA: "AAAA"}[qtype])
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Accept", "application/dns-json")
+
+	rsp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, 0, NewHTTPError(rsp, "DNS-over-HTTPS query failed")
+	}
+	var answer dohResponse
+	if err := json.NewDecoder(rsp.Body).Decode(&answer); err != nil {
+		return nil, 0, errors.Wrap(err, "failed to parse DNS-over-HTTPS response")
+	}
+	if answer.Status != 0 {
+		return nil, 0, errors.Errorf("DNS-over-HTTPS query failed with rcode %d",
+			answer.Status)
+	}
+	var addrs []string
+	ttl := dohMinCacheTime
+	for _, a := range answer.Answer {
+		// CNAME records are resolved by the server
+		if a.Type != qtype || net.ParseIP(a.Data) == nil {
+			continue
+		}
+		addrs = append(addrs, a.Data)
+		if t := time.Duration(a.TTL) * time.Second; t > ttl {
+			ttl = t
+		}
+	}
+	return addrs, ttl, nil
+}
+
+// lookup resolves host to IP addresses. Answers are cached for their TTL;
+// an expired answer is still used if the resolver can not be reached.
+func (r *dohResolver) lookup(ctx context.Context, host string) ([]string, error) {
+	r.lock.Lock()
+	cached, ok := r.cache[host]
+	r.lock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.addrs, nil
+	}
+
+	var addrs []string
+	var ttl time.Duration
+	var err error
+	for _, qtype := range []int{dohTypeA, dohTypeAAAA} {
+		a, t, qerr := r.query(ctx, host, qtype)
+		if qerr != nil {
+			err = qerr
+			continue
+		}
+		addrs = append(addrs, a...)
+		if ttl == 0 || t < ttl {
+			ttl = t
+		}
+	}
+	if len(addrs) == 0 {
+		if ok {
+			log.Warnf("DNS-over-HTTPS lookup of %s failed, using expired answer: %v",
+				host, err)
+			return cached.addrs, nil
+		}
+		if err == nil {
+			err = errors.Errorf("no addresses found for %s", host)
+		}
+		return nil, errors.Wrapf(err, "DNS-over-HTTPS lookup of %s failed", host)
+	}
+
+	r.lock.Lock()
+	r.cache[host] = dohCacheEntry{addrs: addrs, expires: time.Now().Add(ttl)}
+	r.lock.Unlock()
+	return addrs, nil
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func isDNSError(err error) bool {
+	if op, ok := err.(*net.OpError); ok {
+		err = op.Err
+	}
+	_, ok := err.(*net.DNSError)
+	return ok
+}
+
+// dialContext wraps dial, resolving the host with DNS-over-HTTPS if the
+// system resolver fails.
+func (r *dohResolver) dialContext(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err == nil || !isDNSError(err) {
+			return conn, err
+		}
+		host, port, serr := net.SplitHostPort(addr)
+		if serr != nil {
+			return nil, err
+		}
+		log.Infof("system resolver failed to resolve %s, trying DNS-over-HTTPS: %v",
+			host, err)
+		addrs, lerr := r.lookup(ctx, host)
+		if lerr != nil {
+			log.Error(lerr)
+			return nil, err
+		}
+		for _, ip := range addrs {
+			conn, err = dial(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoHResolver(t *testing.T) {
+	queries := 0
+	available := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		if !available {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, "application/dns-json", r.Header.Get("Accept"))
+		assert.Equal(t, "server.example", r.URL.Query().Get("name"))
+		switch r.URL.Query().Get("type") {
+		case "A":
+			fmt.Fprint(w, `{"Status":0,"Answer":[
+				{"name":"server.example","type":5,"TTL":300,"data":"cdn.example."},
+				{"name":"cdn.example","type":1,"TTL":0,"data":"127.0.0.1"}]}`)
+		case "AAAA":
+			fmt.Fprint(w, `{"Status":0}`)
+		}
+	}))
+	defer ts.Close()
+
+	_, err := newDoHResolver("not a url")
+	assert.Error(t, err)
+
+	r, err := newDoHResolver(ts.URL)
+	assert.NoError(t, err)
+
+	addrs, err := r.lookup(context.Background(), "server.example")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1"}, addrs)
+	assert.Equal(t, 2, queries)
+
+	// answer is cached
+	addrs, err = r.lookup(context.Background(), "server.example")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1"}, addrs)
+	assert.Equal(t, 2, queries)
+
+	// expired answer is used if the resolver is unavailable
+	entry := r.cache["server.example"]
+	entry.expires = entry.expires.Add(-2 * dohMinCacheTime)
+	r.cache["server.example"] = entry
+	available = false
+	addrs, err = r.lookup(context.Background(), "server.example")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1"}, addrs)
+	assert.Equal(t, 4, queries)
+
+	delete(r.cache, "server.example")
+	_, err = r.lookup(context.Background(), "server.example")
+	assert.Error(t, err)
+}
+
+func TestDoHResolverDial(t *testing.T) {
+	resolver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("type") == "A" {
+			fmt.Fprint(w, `{"Status":0,"Answer":[{"type":1,"TTL":60,"data":"127.0.0.1"}]}`)
+		} else {
+			fmt.Fprint(w, `{"Status":3}`)
+		}
+	}))
+	defer resolver.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	var dialed []string
+	// system resolver knows nothing about the server
+	systemDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		host, _, _ := net.SplitHostPort(addr)
+		if net.ParseIP(host) == nil {
+			return nil, &net.OpError{Op: "dial", Net: network,
+				Err: &net.DNSError{Err: "no such host", Name: host}}
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+
+	r, err := newDoHResolver(resolver.URL)
+	assert.NoError(t, err)
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: r.dialContext(systemDial),
+	}}
+	rsp, err := client.Get("http://server.example:" + port + "/")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, rsp.StatusCode)
+	rsp.Body.Close()
+	assert.Equal(t, []string{"server.example:" + port, "127.0.0.1:" + port}, dialed)
+
+	// other errors are not retried
+	dialed = nil
+	_, err = client.Get("http://127.0.0.1:1/")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"127.0.0.1:1"}, dialed)
+}
+
+func TestSetDoHResolver(t *testing.T) {
+	api, err := New(Config{})
+	assert.NoError(t, err)
+	assert.Error(t, api.SetDoHResolver("/dns-query"))
+	assert.NoError(t, api.SetDoHResolver("https://1.1.1.1/dns-query"))
+}
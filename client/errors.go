@@ -0,0 +1,131 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorClass tells how likely a failed request is to succeed when retried.
+type ErrorClass int
+
+const (
+	// network glitch, server error; retry soon
+	ErrorClassTransient ErrorClass = iota
+	// server is overloaded or unavailable (429, 503); retry, but back off
+	ErrorClassThrottled
+	// name resolution failed; network is likely not configured yet
+	ErrorClassDNS
+	// TLS handshake or certificate verification failed; unlikely to go
+	// away soon (wrong certificates or clock)
+	ErrorClassTLS
+	// request was rejected (404 artifact gone, 400, ...); retrying does
+	// not help
+	ErrorClassTerminal
+)
+
+var errorClassNames = map[ErrorClass]string{
+	ErrorClassTransient: "transient",
+	ErrorClassThrottled: "throttled",
+	ErrorClassDNS:       "dns",
+	ErrorClassTLS:       "tls",
+	ErrorClassTerminal:  "terminal",
+}
+
+func (c ErrorClass) String() string {
+	return errorClassNames[c]
+}
+
+// HTTPError is returned when the server responds with unexpected HTTP status.
+type HTTPError struct {
+	StatusCode int
+	// delay requested by the server with Retry-After header, if any
+	RetryAfter time.Duration
+	msg        string
+}
+
+func NewHTTPError(rsp *http.Response, msg string) *HTTPError {
+	return &HTTPError{
+		StatusCode: rsp.StatusCode,
+		RetryAfter: parseRetryAfter(rsp.Header.Get("Retry-After")),
+		msg:        msg,
+	}
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s: unexpected HTTP status %d", e.msg, e.StatusCode)
+}
+
+// Retry-After is either number of seconds or HTTP date
+func parseRetryAfter(val string) time.Duration {
+	if val == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(val); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if when, err := http.ParseTime(val); err == nil {
+		if d := when.Sub(time.Now()); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// ClassifyError decides how the request that failed with `err` should be
+// retried.
+func ClassifyError(err error) ErrorClass {
+	err = errors.Cause(err)
+	if uerr, ok := err.(*url.Error); ok {
+		err = uerr.Err
+	}
+
+	switch e := err.(type) {
+	case *HTTPError:
+		switch {
+		case e.StatusCode == http.StatusTooManyRequests ||
+			e.StatusCode == http.StatusServiceUnavailable:
+			return ErrorClassThrottled
+		case e.StatusCode == http.StatusUnauthorized ||
+			e.StatusCode == http.StatusRequestTimeout:
+			// expired authorization is fixed by authorizing again
+			return ErrorClassTransient
+		case e.StatusCode >= 400 && e.StatusCode < 500:
+			return ErrorClassTerminal
+		}
+		return ErrorClassTransient
+
+	case *net.DNSError:
+		return ErrorClassDNS
+
+	case x509.UnknownAuthorityError, x509.CertificateInvalidError,
+		x509.HostnameError, tls.RecordHeaderError:
+		return ErrorClassTLS
+
+	case *net.OpError:
+		if _, ok := e.Err.(*net.DNSError); ok {
+			return ErrorClassDNS
+		}
+	}
+	return ErrorClassTransient
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func httpError(code int, retryAfter string) *HTTPError {
+	rsp := &http.Response{
+		StatusCode: code,
+		Header:     http.Header{},
+	}
+	if retryAfter != "" {
+		rsp.Header.Set("Retry-After", retryAfter)
+	}
+	return NewHTTPError(rsp, "test")
+}
+
+func TestClassifyError(t *testing.T) {
+	tc := []struct {
+		err   error
+		class ErrorClass
+	}{
+		{errors.New("connection reset"), ErrorClassTransient},
+		{context.DeadlineExceeded, ErrorClassTransient},
+		{httpError(http.StatusInternalServerError, ""), ErrorClassTransient},
+		{httpError(http.StatusBadGateway, ""), ErrorClassTransient},
+		{httpError(http.StatusUnauthorized, ""), ErrorClassTransient},
+		{httpError(http.StatusRequestTimeout, ""), ErrorClassTransient},
+		{httpError(http.StatusServiceUnavailable, ""), ErrorClassThrottled},
+		{httpError(http.StatusTooManyRequests, ""), ErrorClassThrottled},
+		{httpError(http.StatusNotFound, ""), ErrorClassTerminal},
+		{httpError(http.StatusBadRequest, ""), ErrorClassTerminal},
+		{errors.Wrap(httpError(http.StatusNotFound, ""), "wrapped"), ErrorClassTerminal},
+		{&net.DNSError{Err: "no such host", Name: "mender"}, ErrorClassDNS},
+		{&url.Error{Op: "Get", URL: "https://mender",
+			Err: &net.OpError{Op: "dial", Err: &net.DNSError{}}}, ErrorClassDNS},
+		{&url.Error{Op: "Get", URL: "https://mender",
+			Err: x509.UnknownAuthorityError{}}, ErrorClassTLS},
+		{x509.HostnameError{Host: "mender"}, ErrorClassTLS},
+	}
+
+	for i, c := range tc {
+		assert.Equal(t, c.class, ClassifyError(c.err), "case %d: %v", i, c.err)
+	}
+}
+
+func TestHTTPErrorRetryAfter(t *testing.T) {
+	assert.Equal(t, time.Duration(0), httpError(http.StatusServiceUnavailable, "").RetryAfter)
+	assert.Equal(t, 120*time.Second, httpError(http.StatusServiceUnavailable, "120").RetryAfter)
+	assert.Equal(t, time.Duration(0), httpError(http.StatusServiceUnavailable, "bogus").RetryAfter)
+
+	when := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	ra := httpError(http.StatusTooManyRequests, when).RetryAfter
+	assert.True(t, ra > 59*time.Minute && ra <= time.Hour)
+
+	// date in the past
+	when = time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	assert.Equal(t, time.Duration(0), httpError(http.StatusTooManyRequests, when).RetryAfter)
+
+	assert.Contains(t, httpError(http.StatusNotFound, "").Error(), "404")
+}
+
+func TestFetchUpdateHTTPError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	_, _, err := NewUpdate().FetchUpdate(context.Background(), &ApiClient{}, ts.URL)
+	assert.Error(t, err)
+	assert.Equal(t, ErrorClassThrottled, ClassifyError(err))
+	herr, ok := errors.Cause(err).(*HTTPError)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, herr.RetryAfter)
+}
@@ -0,0 +1,209 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"io"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// FetchDiagnostics describes how downloading the update went, so that network
+// issues on the server side (CDN) can be told apart from connectivity issues
+// of the device.
+type FetchDiagnostics struct {
+	Host string `json:"host"`
+	// addresses the host name resolved to
+	DNSAddrs  []string `json:"dns_addrs,omitempty"`
+	DNSError  string   `json:"dns_error,omitempty"`
+	DNSTimeMs int64    `json:"dns_time_ms"`
+	// TCP connection setup
+	ConnectAddr   string `json:"connect_addr,omitempty"`
+	ConnectError  string `json:"connect_error,omitempty"`
+	ConnectTimeMs int64  `json:"connect_time_ms"`
+	// time from establishing TCP connection until the connection was ready
+	// for sending the request (TLS handshake)
+	TLSTimeMs int64  `json:"tls_time_ms"`
+	TLSError  string `json:"tls_error,omitempty"`
+	// whether an idle connection was reused, in which case the above were
+	// not performed
+	ConnReused bool   `json:"conn_reused"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// image data received so far
+	BytesReceived int64 `json:"bytes_received"`
+	DurationMs    int64 `json:"duration_ms"`
+	// average download speed in bytes per second
+	Throughput int64 `json:"throughput"`
+}
+
+// FetchDiagnosticsReporter is implemented by both errors and image streams
+// returned by FetchUpdate.
+type FetchDiagnosticsReporter interface {
+	FetchDiagnostics() FetchDiagnostics
+}
+
+// Collects diagnostics through the request trace and while image data is
+// being read. Trace hooks are called from different goroutines.
+type fetchTrace struct {
+	lock sync.Mutex
+	diag FetchDiagnostics
+
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	// first byte of the response
+	firstByte time.Time
+}
+
+func newFetchTrace(host string) *fetchTrace {
+	return &fetchTrace{
+		diag:  FetchDiagnostics{Host: host},
+		start: time.Now(),
+	}
+}
+
+func msSince(t time.Time) int64 {
+	return int64(time.Since(t) / time.Millisecond)
+}
+
+func (t *fetchTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.lock.Lock()
+			defer t.lock.Unlock()
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			t.lock.Lock()
+			defer t.lock.Unlock()
+			t.diag.DNSTimeMs = msSince(t.dnsStart)
+			for _, a := range info.Addrs {
+				t.diag.DNSAddrs = append(t.diag.DNSAddrs, a.String())
+			}
+			if info.Err != nil {
+				t.diag.DNSError = info.Err.Error()
+			}
+		},
+		ConnectStart: func(network, addr string) {
+			t.lock.Lock()
+			defer t.lock.Unlock()
+			t.connectStart = time.Now()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.lock.Lock()
+			defer t.lock.Unlock()
+			t.connectDone = time.Now()
+			t.diag.ConnectAddr = addr
+			t.diag.ConnectTimeMs = msSince(t.connectStart)
+			if err != nil {
+				t.diag.ConnectError = err.Error()
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.lock.Lock()
+			defer t.lock.Unlock()
+			t.diag.ConnReused = info.Reused
+			if !t.connectDone.IsZero() {
+				t.diag.TLSTimeMs = msSince(t.connectDone)
+			}
+		},
+		GotFirstResponseByte: func() {
+			t.lock.Lock()
+			defer t.lock.Unlock()
+			t.firstByte = time.Now()
+		},
+	}
+}
+
+func (t *fetchTrace) response(code int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.diag.StatusCode = code
+}
+
+func (t *fetchTrace) failed(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.diag.Error = err.Error()
+	if ClassifyError(err) == ErrorClassTLS {
+		t.diag.TLSError = err.Error()
+	}
+}
+
+func (t *fetchTrace) received(n int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.diag.BytesReceived += int64(n)
+}
+
+func (t *fetchTrace) FetchDiagnostics() FetchDiagnostics {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	diag := t.diag
+	diag.DNSAddrs = append([]string(nil), t.diag.DNSAddrs...)
+	diag.DurationMs = msSince(t.start)
+	if !t.firstByte.IsZero() {
+		if secs := time.Since(t.firstByte).Seconds(); secs > 0 {
+			diag.Throughput = int64(float64(diag.BytesReceived) / secs)
+		}
+	}
+	return diag
+}
+
+// FetchError is returned when update fetch fails; it carries diagnostics of
+// the failed request.
+type FetchError struct {
+	err   error
+	trace *fetchTrace
+}
+
+func newFetchError(err error, trace *fetchTrace) *FetchError {
+	trace.failed(err)
+	return &FetchError{err, trace}
+}
+
+func (e *FetchError) Error() string {
+	return e.err.Error()
+}
+
+func (e *FetchError) Cause() error {
+	return e.err
+}
+
+func (e *FetchError) FetchDiagnostics() FetchDiagnostics {
+	return e.trace.FetchDiagnostics()
+}
+
+// Image data stream counting received bytes.
+type fetchReader struct {
+	io.ReadCloser
+	trace *fetchTrace
+}
+
+func (r *fetchReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.trace.received(n)
+	if err != nil && err != io.EOF {
+		r.trace.failed(err)
+	}
+	return n, err
+}
+
+func (r *fetchReader) FetchDiagnostics() FetchDiagnostics {
+	return r.trace.FetchDiagnostics()
+}
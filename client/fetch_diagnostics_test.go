@@ -0,0 +1,88 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchUpdateDiagnostics(t *testing.T) {
+	image := strings.Repeat("0123456789", 1000)
+	status := http.StatusOK
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(image)))
+		w.Write([]byte(image))
+	}))
+	defer ts.Close()
+	host := strings.TrimPrefix(ts.URL, "http://")
+
+	client := NewUpdate()
+	client.minImageSize = 1
+	api := &ApiClient{}
+
+	img, size, err := client.FetchUpdate(context.Background(), api, ts.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(image)), size)
+	data, err := ioutil.ReadAll(img)
+	assert.NoError(t, err)
+	img.Close()
+	assert.Equal(t, image, string(data))
+
+	dr, ok := img.(FetchDiagnosticsReporter)
+	assert.True(t, ok)
+	diag := dr.FetchDiagnostics()
+	assert.Equal(t, host, diag.Host)
+	assert.Equal(t, host, diag.ConnectAddr)
+	assert.Equal(t, http.StatusOK, diag.StatusCode)
+	assert.Equal(t, int64(len(image)), diag.BytesReceived)
+	assert.Empty(t, diag.Error)
+
+	// server error
+	status = http.StatusServiceUnavailable
+	_, _, err = client.FetchUpdate(context.Background(), api, ts.URL)
+	assert.Error(t, err)
+	dr, ok = err.(FetchDiagnosticsReporter)
+	assert.True(t, ok)
+	diag = dr.FetchDiagnostics()
+	assert.Equal(t, http.StatusServiceUnavailable, diag.StatusCode)
+	assert.Equal(t, int64(0), diag.BytesReceived)
+	assert.Contains(t, diag.Error, "503")
+	// classification looks through the diagnostics
+	assert.Equal(t, ErrorClassThrottled, ClassifyError(err))
+
+	// nobody listening
+	ts.Close()
+	_, _, err = client.FetchUpdate(context.Background(), api, ts.URL)
+	assert.Error(t, err)
+	diag = err.(FetchDiagnosticsReporter).FetchDiagnostics()
+	assert.NotEmpty(t, diag.ConnectError)
+	assert.Equal(t, 0, diag.StatusCode)
+	_, ok = errors.Cause(err).(*url.Error)
+	assert.True(t, ok)
+}
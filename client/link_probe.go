@@ -0,0 +1,92 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LinkProbe is the result of a quick download from the artifact host.
+type LinkProbe struct {
+	// time from sending the request until the first byte of the response
+	LatencyMs int64 `json:"latency_ms"`
+	// download speed, bytes per second; 0 if too little was received to
+	// tell
+	Speed int64 `json:"speed"`
+	// bytes downloaded
+	Bytes int64 `json:"bytes"`
+}
+
+// ProbeLink downloads at most size leading bytes of the file at url, to
+// measure latency and download speed of the link to the host serving it.
+func ProbeLink(ctx context.Context, api ApiRequester, url string,
+	size int64) (LinkProbe, error) {
+	var probe LinkProbe
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return probe, errors.Wrapf(err, "failed to create link probe request")
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", size-1))
+
+	var lock sync.Mutex
+	var sent, firstByte time.Time
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			lock.Lock()
+			defer lock.Unlock()
+			sent = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			lock.Lock()
+			defer lock.Unlock()
+			firstByte = time.Now()
+		},
+	})
+
+	r, err := api.Do(req.WithContext(ctx))
+	if err != nil {
+		return probe, errors.Wrapf(err, "link probe request failed")
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusPartialContent && r.StatusCode != http.StatusOK {
+		return probe, NewHTTPError(r, "link probe failed")
+	}
+	// servers not supporting ranges send the whole file
+	probe.Bytes, err = io.Copy(ioutil.Discard, io.LimitReader(r.Body, size))
+	if err != nil {
+		return probe, errors.Wrapf(err, "link probe download failed")
+	}
+	done := time.Now()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if !sent.IsZero() && !firstByte.IsZero() {
+		probe.LatencyMs = int64(firstByte.Sub(sent) / time.Millisecond)
+	}
+	if secs := done.Sub(firstByte).Seconds(); !firstByte.IsZero() && secs > 0 {
+		probe.Speed = int64(float64(probe.Bytes) / secs)
+	}
+	return probe, nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeLink(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 64*1024)
+	status := http.StatusOK
+	var rangeHdr string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangeHdr = r.Header.Get("Range")
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		http.ServeContent(w, r, "probe", time.Time{}, bytes.NewReader(data))
+	}))
+	defer ts.Close()
+
+	probe, err := ProbeLink(context.Background(), http.DefaultClient, ts.URL, 1024)
+	assert.NoError(t, err)
+	assert.Equal(t, "bytes=0-1023", rangeHdr)
+	assert.Equal(t, int64(1024), probe.Bytes)
+	assert.True(t, probe.Speed > 0)
+	assert.True(t, probe.LatencyMs >= 0)
+
+	// file shorter than the probe
+	probe, err = ProbeLink(context.Background(), http.DefaultClient, ts.URL, 1024*1024)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), probe.Bytes)
+
+	status = http.StatusForbidden
+	_, err = ProbeLink(context.Background(), http.DefaultClient, ts.URL, 1024)
+	assert.IsType(t, &HTTPError{}, err)
+}
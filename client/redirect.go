@@ -0,0 +1,76 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// redirects followed for a single request, eg. artifact storage redirecting
+// to CDN which redirects to the edge server
+const maxRedirects = 10
+
+var (
+	ErrTooManyRedirects  = errors.New("too many redirects")
+	ErrRedirectDowngrade = errors.New("redirect from https to http refused")
+)
+
+// headers carrying credentials of the original host, not to be sent to
+// other hosts
+var credentialHeaders = []string{"Authorization", "Cookie"}
+
+// Redirect policy of the client. Chain of redirects is followed up to
+// maxRedirects, but never from https to plain http. Credentials are sent only
+// to the host the request was made to, not to other hosts the chain leads
+// to, subdomains included.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.Wrapf(ErrTooManyRedirects, "stopped after %d redirects", len(via))
+	}
+	for _, prev := range via {
+		if prev.URL.Scheme == "https" && req.URL.Scheme != "https" {
+			return errors.Wrapf(ErrRedirectDowngrade, "redirect to %s", req.URL.Host)
+		}
+	}
+	if !sameHost(via[0].URL, req.URL) {
+		for _, h := range credentialHeaders {
+			req.Header.Del(h)
+		}
+	}
+	log.Debugf("following redirect to %s", req.URL.Host)
+	return nil
+}
+
+// Whether both URLs point at the same host and port.
+func sameHost(a, b *url.URL) bool {
+	return strings.EqualFold(a.Hostname(), b.Hostname()) && urlPort(a) == urlPort(b)
+}
+
+func urlPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	switch u.Scheme {
+	case "https":
+		return "443"
+	case "http":
+		return "80"
+	}
+	return ""
+}
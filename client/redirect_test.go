@@ -0,0 +1,112 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectChain(t *testing.T) {
+	artifact := strings.Repeat("a", 8192)
+	var cdnAuth string
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cdnAuth = r.Header.Get("Authorization")
+		w.Header().Set("Content-Length", strconv.Itoa(len(artifact)))
+		w.Write([]byte(artifact))
+	}))
+	defer cdn.Close()
+
+	var storageAuth []string
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		storageAuth = append(storageAuth, r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/artifact":
+			// same host first, then off to the CDN
+			http.Redirect(w, r, "/signed", http.StatusFound)
+		case "/signed":
+			http.Redirect(w, r, cdn.URL+"/artifact", http.StatusTemporaryRedirect)
+		default:
+			// redirects to itself forever
+			http.Redirect(w, r, r.URL.Path, http.StatusFound)
+		}
+	}))
+	defer storage.Close()
+
+	ac, err := New(Config{})
+	assert.NoError(t, err)
+	api := ac.Request("token")
+
+	image, size, err := NewUpdate().FetchUpdate(context.Background(), api,
+		storage.URL+"/artifact")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(len(artifact)), size)
+		data, _ := ioutil.ReadAll(image)
+		image.Close()
+		assert.Equal(t, artifact, string(data))
+	}
+
+	// token is sent to the host the request was made to, but not to the
+	// CDN on other port
+	assert.Equal(t, []string{"Bearer token", "Bearer token"}, storageAuth)
+	assert.Equal(t, "", cdnAuth)
+
+	_, _, err = NewUpdate().FetchUpdate(context.Background(), api,
+		storage.URL+"/loop")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), ErrTooManyRedirects.Error())
+}
+
+func TestCheckRedirect(t *testing.T) {
+	request := func(u string) *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, u, nil)
+		req.Header.Set("Authorization", "Bearer token")
+		return req
+	}
+	initial := request("https://hosted.mender.io/artifact")
+
+	req := request("https://hosted.mender.io:443/signed")
+	assert.NoError(t, checkRedirect(req, []*http.Request{initial}))
+	assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+
+	// subdomains are other hosts too
+	req = request("https://s3.hosted.mender.io/artifact")
+	assert.NoError(t, checkRedirect(req, []*http.Request{initial}))
+	assert.Equal(t, "", req.Header.Get("Authorization"))
+
+	req = request("http://hosted.mender.io/artifact")
+	err := checkRedirect(req, []*http.Request{initial})
+	assert.Equal(t, ErrRedirectDowngrade, errors.Cause(err))
+
+	// not even after the chain went through other https hosts
+	req = request("http://cdn.example.com/artifact")
+	err = checkRedirect(req, []*http.Request{initial,
+		request("https://s3.hosted.mender.io/artifact")})
+	assert.Equal(t, ErrRedirectDowngrade, errors.Cause(err))
+
+	via := []*http.Request{}
+	for i := 0; i < maxRedirects; i++ {
+		via = append(via, request("http://localhost/"+strings.Repeat("a", i)))
+	}
+	err = checkRedirect(request("http://localhost/"), via)
+	assert.Equal(t, ErrTooManyRedirects, errors.Cause(err))
+}
@@ -0,0 +1,206 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Priority of a request waiting for its turn in RequestQueue; higher runs
+// first.
+type RequestPriority int
+
+const (
+	PriorityLogUpload RequestPriority = iota
+	PriorityInventory
+	// requests not given any priority
+	PriorityDefault
+	// non-final status reports, which tell whether the deployment was
+	// aborted meanwhile
+	PriorityAbortPoll
+	PriorityTerminalStatus
+)
+
+type requestPriorityKey struct{}
+
+// Returns context under which requests get given priority in RequestQueue.
+func WithRequestPriority(ctx context.Context, prio RequestPriority) context.Context {
+	return context.WithValue(ctx, requestPriorityKey{}, prio)
+}
+
+func requestPriority(ctx context.Context) RequestPriority {
+	if prio, ok := ctx.Value(requestPriorityKey{}).(RequestPriority); ok {
+		return prio
+	}
+	return PriorityDefault
+}
+
+// Limits number of concurrent requests and rate at which they are started,
+// so that work piled up while offline does not open lots of connections at
+// once. Requests waiting for their turn are started by priority, in order of
+// arrival within the same priority. A request occupies its slot until the
+// response body is closed.
+type RequestQueue struct {
+	// 0 means no limit
+	maxActive int
+	interval  time.Duration
+
+	lock      sync.Mutex
+	active    int
+	lastStart time.Time
+	waiting   []*queuedRequest
+	// dispatch scheduled once interval since last start passes
+	timer *time.Timer
+
+	// overridden in tests
+	now       func() time.Time
+	afterFunc func(d time.Duration, f func()) *time.Timer
+}
+
+type queuedRequest struct {
+	prio  RequestPriority
+	ready chan struct{}
+}
+
+// Creates queue allowing given number of concurrent requests and starting at
+// most given number of requests per minute; 0 means no limit. Returns nil if
+// neither is limited.
+func NewRequestQueue(maxActive, perMinute int) *RequestQueue {
+	if maxActive <= 0 && perMinute <= 0 {
+		return nil
+	}
+	q := &RequestQueue{
+		maxActive: maxActive,
+		now:       time.Now,
+		afterFunc: time.AfterFunc,
+	}
+	if perMinute > 0 {
+		q.interval = time.Minute / time.Duration(perMinute)
+	}
+	return q
+}
+
+// Waits for a turn of the request with given priority. Returns function to
+// call once the request is finished.
+func (q *RequestQueue) acquire(ctx context.Context, prio RequestPriority) (func(), error) {
+	r := &queuedRequest{prio: prio, ready: make(chan struct{})}
+
+	q.lock.Lock()
+	// behind all waiting requests of the same or higher priority
+	i := len(q.waiting)
+	for i > 0 && q.waiting[i-1].prio < prio {
+		i--
+	}
+	q.waiting = append(q.waiting, nil)
+	copy(q.waiting[i+1:], q.waiting[i:])
+	q.waiting[i] = r
+	q.dispatch()
+	q.lock.Unlock()
+
+	select {
+	case <-r.ready:
+		return q.releaseFunc(), nil
+	case <-ctx.Done():
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i, w := range q.waiting {
+		if w == r {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return nil, ctx.Err()
+		}
+	}
+	// started meanwhile
+	q.release()
+	return nil, ctx.Err()
+}
+
+func (q *RequestQueue) releaseFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.lock.Lock()
+			defer q.lock.Unlock()
+			q.release()
+		})
+	}
+}
+
+// must be called with lock held
+func (q *RequestQueue) release() {
+	q.active--
+	q.dispatch()
+}
+
+// Starts waiting requests as limits allow; must be called with lock held.
+func (q *RequestQueue) dispatch() {
+	for len(q.waiting) > 0 {
+		if q.maxActive > 0 && q.active >= q.maxActive {
+			return
+		}
+		if q.interval > 0 && !q.lastStart.IsZero() {
+			wait := q.lastStart.Add(q.interval).Sub(q.now())
+			if wait > 0 {
+				if q.timer == nil {
+					q.timer = q.afterFunc(wait, func() {
+						q.lock.Lock()
+						defer q.lock.Unlock()
+						q.timer = nil
+						q.dispatch()
+					})
+				}
+				return
+			}
+		}
+		r := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.active++
+		q.lastStart = q.now()
+		close(r.ready)
+	}
+}
+
+// Performs the request once it gets its turn.
+func (q *RequestQueue) do(req *http.Request,
+	do func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+
+	release, err := q.acquire(req.Context(), requestPriority(req.Context()))
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := do(req)
+	if err != nil || rsp == nil || rsp.Body == nil {
+		release()
+		return rsp, err
+	}
+	rsp.Body = &releasingBody{ReadCloser: rsp.Body, release: release}
+	return rsp, nil
+}
+
+// Response body giving up slot of the request in the queue when closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,221 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func waitingRequests(q *RequestQueue) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.waiting)
+}
+
+func activeRequests(q *RequestQueue) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.active
+}
+
+// Queues request with given priority in the background, returning once it is
+// waiting.
+func queueRequest(t *testing.T, q *RequestQueue, prio RequestPriority,
+	started chan<- RequestPriority) {
+
+	waiting := waitingRequests(q)
+	go func() {
+		release, err := q.acquire(context.Background(), prio)
+		assert.NoError(t, err)
+		started <- prio
+		release()
+	}()
+	for waitingRequests(q) == waiting {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRequestQueuePriorities(t *testing.T) {
+	assert.Nil(t, NewRequestQueue(0, 0))
+
+	q := NewRequestQueue(1, 0)
+	release, err := q.acquire(context.Background(), PriorityDefault)
+	assert.NoError(t, err)
+
+	started := make(chan RequestPriority, 10)
+	for _, prio := range []RequestPriority{PriorityLogUpload, PriorityInventory,
+		PriorityTerminalStatus, PriorityAbortPoll, PriorityInventory} {
+		queueRequest(t, q, prio, started)
+	}
+
+	// waiting request given up
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		_, err := q.acquire(ctx, PriorityTerminalStatus)
+		errc <- err
+	}()
+	for waitingRequests(q) != 6 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-errc)
+	assert.Equal(t, 5, waitingRequests(q))
+
+	// releasing twice has no effect
+	release()
+	release()
+
+	var order []RequestPriority
+	for i := 0; i < 5; i++ {
+		order = append(order, <-started)
+	}
+	assert.Equal(t, []RequestPriority{PriorityTerminalStatus, PriorityAbortPoll,
+		PriorityInventory, PriorityInventory, PriorityLogUpload}, order)
+	for activeRequests(q) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRequestQueueRate(t *testing.T) {
+	q := NewRequestQueue(0, 60)
+	assert.Equal(t, time.Second, q.interval)
+
+	now := time.Now()
+	q.now = func() time.Time { return now }
+	var scheduled func()
+	var delay time.Duration
+	q.afterFunc = func(d time.Duration, f func()) *time.Timer {
+		delay = d
+		scheduled = f
+		return time.NewTimer(time.Hour)
+	}
+
+	// fake clock and timer are used with the lock held
+	scheduledDelay := func() time.Duration {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		return delay
+	}
+	advance := func(d time.Duration) {
+		q.lock.Lock()
+		now = now.Add(d)
+		f := scheduled
+		q.lock.Unlock()
+		f()
+	}
+
+	// first request starts right away
+	_, err := q.acquire(context.Background(), PriorityDefault)
+	assert.NoError(t, err)
+
+	started := make(chan RequestPriority, 10)
+	queueRequest(t, q, PriorityInventory, started)
+	queueRequest(t, q, PriorityTerminalStatus, started)
+	assert.Equal(t, time.Second, scheduledDelay())
+	assert.Len(t, started, 0)
+
+	// one request per interval
+	advance(time.Second)
+	assert.Equal(t, PriorityTerminalStatus, <-started)
+	assert.Equal(t, time.Second, scheduledDelay())
+
+	advance(time.Second)
+	assert.Equal(t, PriorityInventory, <-started)
+	assert.Equal(t, 0, waitingRequests(q))
+}
+
+func TestApiClientRequestQueue(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	ac, err := New(Config{})
+	assert.NoError(t, err)
+	ac.SetRequestQueue(NewRequestQueue(1, 0))
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	rsp, err := ac.Do(req)
+	assert.NoError(t, err)
+
+	// slot is held until response body is closed
+	var wg sync.WaitGroup
+	var second *http.Response
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		second, err = ac.Do(req)
+	}()
+	for waitingRequests(ac.queue) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	rsp.Body.Close()
+	wg.Wait()
+	assert.NoError(t, err)
+	second.Body.Close()
+	assert.Equal(t, 0, activeRequests(ac.queue))
+
+	// failed request gives up its slot as well
+	ts.Close()
+	req, _ = http.NewRequest(http.MethodGet, ts.URL, nil)
+	_, err = ac.Do(req)
+	assert.Error(t, err)
+	assert.Equal(t, 0, activeRequests(ac.queue))
+}
+
+// Records priority requests are made with.
+type priorityRecorder struct {
+	prio RequestPriority
+}
+
+func (p *priorityRecorder) Do(req *http.Request) (*http.Response, error) {
+	p.prio = requestPriority(req.Context())
+	return nil, errors.New("offline")
+}
+
+func TestRequestPriorities(t *testing.T) {
+	api := &priorityRecorder{}
+	ctx := context.Background()
+
+	for status, prio := range map[string]RequestPriority{
+		StatusSuccess:          PriorityTerminalStatus,
+		StatusFailure:          PriorityTerminalStatus,
+		StatusAlreadyInstalled: PriorityTerminalStatus,
+		StatusInstalling:       PriorityAbortPoll,
+		StatusDownloading:      PriorityAbortPoll,
+	} {
+		NewStatus().Report(ctx, api, "http://localhost",
+			StatusReport{DeploymentID: "deployment-1", Status: status})
+		assert.Equal(t, prio, api.prio, status)
+	}
+
+	NewInventory().Submit(ctx, api, "http://localhost", nil)
+	assert.Equal(t, PriorityInventory, api.prio)
+
+	NewLog().Upload(ctx, api, "http://localhost", LogData{DeploymentID: "deployment-1"})
+	assert.Equal(t, PriorityLogUpload, api.prio)
+
+	SendEvents(ctx, api, "http://localhost", nil)
+	assert.Equal(t, PriorityDefault, api.prio)
+}
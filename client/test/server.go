@@ -82,6 +82,7 @@ func NewClientTestServer() *ClientTestServer {
 	mux.HandleFunc("/api/devices/v1/authentication/auth_requests", cts.authReq)
 	mux.HandleFunc("/api/devices/v1/inventory/device/attributes", cts.inventoryReq)
 	mux.HandleFunc("/api/devices/v1/deployments/device/deployments/next", cts.updateReq)
+	mux.HandleFunc("/api/devices/v2/deployments/device/deployments/next", cts.updateReqV2)
 	// mux.HandleFunc("/api/devices/v1/deployments/device/deployments/%s/log", cts.logReq)
 	// mux.HandleFunc("/api/devices/v1/deployments/device/deployments/%s/status", cts.statusReq)
 	mux.HandleFunc("/api/devices/v1/deployments/device/deployments/", cts.deploymentsReq)
@@ -326,7 +327,38 @@ func (cts *ClientTestServer) updateReq(w http.ResponseWriter, r *http.Request) {
 
 	log.Infof("parsed URL query: %v", r.URL.Query())
 
-	if current := urlQueryToCurrentUpdate(r.URL.Query()); current != cts.Update.Current {
+	cts.respondUpdate(w, urlQueryToCurrentUpdate(r.URL.Query()))
+}
+
+func (cts *ClientTestServer) updateReqV2(w http.ResponseWriter, r *http.Request) {
+	log.Infof("got update request %v", r)
+	cts.Update.Called = true
+
+	if !isMethod(http.MethodPost, w, r) {
+		return
+	}
+
+	if !cts.verifyAuth(w, r) {
+		return
+	}
+
+	var body struct {
+		Provides map[string]string `json:"device_provides"`
+	}
+	if err := fromJSON(r.Body, &body); err != nil {
+		log.Errorf("failed to parse update request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	cts.respondUpdate(w, client.CurrentUpdate{
+		Artifact:   body.Provides["artifact_name"],
+		DeviceType: body.Provides["device_type"],
+	})
+}
+
+func (cts *ClientTestServer) respondUpdate(w http.ResponseWriter, current client.CurrentUpdate) {
+	if current != cts.Update.Current {
 		log.Errorf("incorrect current update info, got %+v, expected %+v",
 			current, cts.Update.Current)
 		w.WriteHeader(http.StatusBadRequest)
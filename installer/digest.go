@@ -0,0 +1,124 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Payload checksums in the artifact manifest are either plain hex encoded
+// digests, SHA-256 or, by their length, SHA-512, or are tagged with the
+// algorithm name, like "blake2b-256:<hex digest>". Tagged checksums let new
+// algorithms be introduced in artifacts without changing their format.
+const DefaultDigestAlgorithm = "sha256"
+
+var ErrUnsupportedDigest = errors.New("unsupported payload digest algorithm")
+
+var digestAlgorithms = struct {
+	sync.RWMutex
+	m map[string]func() hash.Hash
+}{
+	m: map[string]func() hash.Hash{
+		"sha256":      sha256.New,
+		"sha512":      sha512.New,
+		"blake2b-256": newBlake2b256,
+		"blake2b-512": newBlake2b512,
+	},
+}
+
+// Unkeyed BLAKE2b hashes; creating them fails only for keys too long.
+func newBlake2b256() hash.Hash {
+	h, _ := blake2b.New256(nil)
+	return h
+}
+
+func newBlake2b512() hash.Hash {
+	h, _ := blake2b.New512(nil)
+	return h
+}
+
+// RegisterDigestAlgorithm makes payloads with checksums tagged with name
+// verifiable with hashes returned by newHash, replacing any algorithm
+// registered under the same name.
+func RegisterDigestAlgorithm(name string, newHash func() hash.Hash) {
+	digestAlgorithms.Lock()
+	defer digestAlgorithms.Unlock()
+	digestAlgorithms.m[strings.ToLower(name)] = newHash
+}
+
+// DigestAlgorithms returns sorted names of supported payload digest
+// algorithms.
+func DigestAlgorithms() []string {
+	digestAlgorithms.RLock()
+	defer digestAlgorithms.RUnlock()
+	names := make([]string, 0, len(digestAlgorithms.m))
+	for name := range digestAlgorithms.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseChecksum splits checksum from the manifest into name of its digest
+// algorithm and hex encoded digest.
+func parseChecksum(checksum []byte) (string, []byte) {
+	checksum = bytes.TrimSpace(checksum)
+	if i := bytes.IndexByte(checksum, ':'); i >= 0 {
+		return strings.ToLower(string(checksum[:i])), checksum[i+1:]
+	}
+	if len(checksum) == 2*sha512.Size {
+		return "sha512", checksum
+	}
+	return DefaultDigestAlgorithm, checksum
+}
+
+// newPayloadHash returns hash computing the payload digest the way checksum
+// was made, and the hex encoded digest expected.
+func newPayloadHash(checksum []byte) (hash.Hash, []byte, error) {
+	name, digest := parseChecksum(checksum)
+	digestAlgorithms.RLock()
+	newHash, ok := digestAlgorithms.m[name]
+	digestAlgorithms.RUnlock()
+	if !ok {
+		return nil, nil, errors.Wrapf(ErrUnsupportedDigest, "%q", name)
+	}
+	return newHash(), digest, nil
+}
+
+// normalizeDigest returns SHA-256 digests as plain hex, and other digests
+// tagged with their algorithm, so that digests of the same payload compare
+// equal however the manifest spells them.
+func normalizeDigest(checksum []byte) string {
+	name, digest := parseChecksum(checksum)
+	if name == DefaultDigestAlgorithm {
+		return strings.ToLower(string(digest))
+	}
+	return name + ":" + strings.ToLower(string(digest))
+}
+
+// NewDigestHash returns hash computing digests with the algorithm checksum
+// was made with, and the hex encoded digest of the checksum. Checksums are
+// spelled like in the artifact manifest or as returned by ReadHeaderDigests.
+func NewDigestHash(checksum string) (hash.Hash, []byte, error) {
+	return newPayloadHash([]byte(checksum))
+}
@@ -0,0 +1,226 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package installer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha512"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mendersoftware/mender-artifact/parser"
+	perrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlake2bDigests(t *testing.T) {
+	// RFC 7693 appendix A and reference implementation test vectors
+	h := newBlake2b512()
+	h.Write([]byte("abc"))
+	assert.Equal(t, "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d1"+
+		"7d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923",
+		hex.EncodeToString(h.Sum(nil)))
+
+	h = newBlake2b256()
+	h.Write([]byte("abc"))
+	assert.Equal(t, "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319",
+		hex.EncodeToString(h.Sum(nil)))
+}
+
+func TestParseChecksum(t *testing.T) {
+	sha256sum := strings.Repeat("ab", 32)
+	sha512sum := strings.Repeat("cd", 64)
+
+	tc := []struct {
+		checksum string
+		name     string
+		digest   string
+	}{
+		{sha256sum, "sha256", sha256sum},
+		{sha256sum + "\n", "sha256", sha256sum},
+		{sha512sum, "sha512", sha512sum},
+		{"sha256:" + sha256sum, "sha256", sha256sum},
+		{"BLAKE2b-512:" + sha512sum, "blake2b-512", sha512sum},
+		{"", "sha256", ""},
+	}
+	for _, c := range tc {
+		name, digest := parseChecksum([]byte(c.checksum))
+		assert.Equal(t, c.name, name, c.checksum)
+		assert.Equal(t, c.digest, string(digest), c.checksum)
+	}
+
+	assert.Equal(t, sha256sum, normalizeDigest([]byte("SHA256:"+strings.ToUpper(sha256sum))))
+	assert.Equal(t, "sha512:"+sha512sum, normalizeDigest([]byte(sha512sum)))
+}
+
+func TestInstallDigestAlgorithms(t *testing.T) {
+	image := []byte("this is a rootfs image")
+
+	sha512sum := sha512.Sum512(image)
+	b2 := newBlake2b256()
+	b2.Write(image)
+
+	for _, sum := range []string{
+		string(checksum(image)),
+		"sha256:" + string(checksum(image)),
+		hex.EncodeToString(sha512sum[:]),
+		"sha512:" + strings.ToUpper(hex.EncodeToString(sha512sum[:])),
+		"blake2b-256:" + hex.EncodeToString(b2.Sum(nil)),
+	} {
+		dev := &fakeInstaller{}
+		err := InstallRootfs(dev)(bytes.NewReader(image), parser.UpdateFile{
+			Name:     "rootfs.ext4",
+			Size:     int64(len(image)),
+			Checksum: []byte(sum),
+		})
+		assert.NoError(t, err, sum)
+		assert.Equal(t, image, dev.data, sum)
+	}
+
+	// digest of the other algorithm of the same length does not pass
+	dev := &fakeInstaller{}
+	err := InstallRootfs(dev)(bytes.NewReader(image), parser.UpdateFile{
+		Name:     "rootfs.ext4",
+		Size:     int64(len(image)),
+		Checksum: []byte("blake2b-512:" + hex.EncodeToString(sha512sum[:])),
+	})
+	assert.Equal(t, ErrChecksumMismatch, perrors.Cause(err))
+
+	// unknown algorithm is rejected before anything is written
+	md5sum := md5.Sum(image)
+	dev = &fakeInstaller{}
+	err = InstallRootfs(dev)(bytes.NewReader(image), parser.UpdateFile{
+		Name:     "rootfs.ext4",
+		Size:     int64(len(image)),
+		Checksum: []byte("md5:" + hex.EncodeToString(md5sum[:])),
+	})
+	assert.Equal(t, ErrUnsupportedDigest, perrors.Cause(err))
+	assert.Nil(t, dev.data)
+
+	// until it is registered
+	RegisterDigestAlgorithm("MD5", md5.New)
+	defer func() {
+		digestAlgorithms.Lock()
+		delete(digestAlgorithms.m, "md5")
+		digestAlgorithms.Unlock()
+	}()
+	assert.Contains(t, DigestAlgorithms(), "md5")
+	err = InstallRootfs(dev)(bytes.NewReader(image), parser.UpdateFile{
+		Name:     "rootfs.ext4",
+		Size:     int64(len(image)),
+		Checksum: []byte("md5:" + hex.EncodeToString(md5sum[:])),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, image, dev.data)
+}
+
+// withPayloadChecksum returns the artifact with checksum of its payload in the
+// header replaced with sum, the way artifacts made with other digest
+// algorithms carry them.
+func withPayloadChecksum(t *testing.T, art []byte, sum string) []byte {
+	var out bytes.Buffer
+	tw := tar.NewWriter(&out)
+	tr := tar.NewReader(bytes.NewReader(art))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		data, err := ioutil.ReadAll(tr)
+		assert.NoError(t, err)
+		if hdr.Name == "header.tar.gz" {
+			data = withHeaderChecksum(t, data, sum)
+			hdr.Size = int64(len(data))
+		}
+		assert.NoError(t, tw.WriteHeader(hdr))
+		_, err = tw.Write(data)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	return out.Bytes()
+}
+
+func withHeaderChecksum(t *testing.T, header []byte, sum string) []byte {
+	gz, err := gzip.NewReader(bytes.NewReader(header))
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	gw := gzip.NewWriter(&out)
+	tw := tar.NewWriter(gw)
+	tr := tar.NewReader(gz)
+	replaced := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		data, err := ioutil.ReadAll(tr)
+		assert.NoError(t, err)
+		if strings.Contains(hdr.Name, "/checksums/") {
+			data = []byte(sum)
+			hdr.Size = int64(len(data))
+			replaced = true
+		}
+		assert.NoError(t, tw.WriteHeader(hdr))
+		_, err = tw.Write(data)
+		assert.NoError(t, err)
+	}
+	assert.True(t, replaced)
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, gw.Close())
+	return out.Bytes()
+}
+
+func TestInstallArtifactDigestAlgorithms(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	art := makeArtifact(t, tdir, []string{"vexpress-qemu"}, "release-1")
+	dev := &fakeInstaller{}
+	assert.NoError(t, Install(ioutil.NopCloser(bytes.NewReader(art)), "vexpress-qemu", dev))
+	image := dev.data
+	assert.NotEmpty(t, image)
+
+	sha512sum := sha512.Sum512(image)
+	b2 := newBlake2b256()
+	b2.Write(image)
+
+	for _, sum := range []string{
+		hex.EncodeToString(sha512sum[:]),
+		"sha512:" + hex.EncodeToString(sha512sum[:]),
+		"blake2b-256:" + hex.EncodeToString(b2.Sum(nil)),
+	} {
+		dev := &fakeInstaller{}
+		err := Install(ioutil.NopCloser(bytes.NewReader(withPayloadChecksum(t, art, sum))),
+			"vexpress-qemu", dev)
+		assert.NoError(t, err, sum)
+		assert.Equal(t, image, dev.data, sum)
+	}
+
+	// payload not matching the checksum fails the install
+	sha512sum[0]++
+	err := Install(ioutil.NopCloser(bytes.NewReader(withPayloadChecksum(t, art,
+		hex.EncodeToString(sha512sum[:])))), "vexpress-qemu", &fakeInstaller{})
+	assert.Equal(t, ErrChecksumMismatch, perrors.Cause(err))
+}
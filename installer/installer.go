@@ -15,10 +15,18 @@
 package installer
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
+	"path/filepath"
 
 	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender-artifact/metadata"
 	"github.com/mendersoftware/mender-artifact/parser"
 	"github.com/mendersoftware/mender-artifact/reader"
 	"github.com/pkg/errors"
@@ -29,32 +37,372 @@ type UInstaller interface {
 	EnableUpdatedPartition() error
 }
 
+// Device capable of installing application-only updates into A/B slots
+// independent of the root filesystem.
+type AppInstaller interface {
+	InstallApp(artifactName string, r io.Reader, size int64) error
+}
+
+// Type of updates carrying application directory tarball installed into the
+// inactive application slot.
+const AppSlotUpdateType = "app-slot"
+
+// Type of updates carrying root filesystem image.
+const RootfsUpdateType = "rootfs-image"
+
+// Device capable of installing update bundles of other update frameworks
+// with their own tools.
+type BundleInstaller interface {
+	InstallBundle(format string, r io.Reader, size int64) error
+}
+
+// Types of updates carrying a RAUC bundle (.raucb) or SWUpdate image (.swu)
+// as payload; the type is the format passed to BundleInstaller.
+const (
+	RAUCBundleUpdateType     = "rauc"
+	SWUpdateBundleUpdateType = "swupdate"
+)
+
+// PayloadObserver is given the name and size of every payload before it is
+// installed, and returns writer receiving a copy of the payload data as it is
+// being written to the device (eg. for integrity scanning or measurement), or
+// nil if the payload should not be observed.
+type PayloadObserver func(name string, size int64) io.Writer
+
+var (
+	ErrChecksumMismatch     = errors.New("update image checksum mismatch")
+	ErrIncompatibleArtifact = errors.New("artifact not compatible with device")
+	ErrAppSlotsUnsupported  = errors.New("device does not support application updates")
+	ErrBundlesUnsupported   = errors.New("device does not support update bundles")
+)
+
+// InstallRootfs returns a data handler streaming the image straight to the
+// device. The digest of the payload is computed on the fly, with the algorithm
+// the checksum from the artifact header was made with, and checked against it
+// once the image is written, so that the install never succeeds, and the
+// partition can not be enabled, with unverified image data. Images with
+// checksums of unsupported algorithms are not installed.
 func InstallRootfs(device UInstaller) parser.DataHandlerFunc {
+	return installRootfs(device, nil)
+}
+
+func installRootfs(device UInstaller, observe PayloadObserver) parser.DataHandlerFunc {
 	return func(r io.Reader, uf parser.UpdateFile) error {
 		log.Infof("installing update %v of size %v", uf.Name, uf.Size)
-		err := device.InstallUpdate(ioutil.NopCloser(r), uf.Size)
+		h, digest, err := newPayloadHash(uf.Checksum)
+		if err != nil {
+			log.Errorf("update image %v can not be verified: %v", uf.Name, err)
+			return err
+		}
+		err = device.InstallUpdate(ioutil.NopCloser(teePayload(r, uf, h, observe)), uf.Size)
 		if err != nil {
 			log.Errorf("update image installation failed: %v", err)
 			return err
 		}
+		if err := verifyChecksum(h, digest); err != nil {
+			log.Errorf("update image %v verification failed: %v", uf.Name, err)
+			return err
+		}
 		return nil
 	}
 }
 
-func Install(artifact io.ReadCloser, dt string, device UInstaller) error {
-	rp := parser.RootfsParser{
-		DataFunc: InstallRootfs(device),
+// InstallApp returns a data handler unpacking the application tarball into
+// the inactive application slot. Checksum is verified the same way as for
+// root filesystem images.
+func InstallApp(device AppInstaller, artifactName func() string) parser.DataHandlerFunc {
+	return installApp(device, artifactName, nil)
+}
+
+func installApp(device AppInstaller, artifactName func() string,
+	observe PayloadObserver) parser.DataHandlerFunc {
+	return func(r io.Reader, uf parser.UpdateFile) error {
+		log.Infof("installing application update %v of size %v", uf.Name, uf.Size)
+		h, digest, err := newPayloadHash(uf.Checksum)
+		if err != nil {
+			log.Errorf("application update %v can not be verified: %v", uf.Name, err)
+			return err
+		}
+		err = device.InstallApp(artifactName(), teePayload(r, uf, h, observe), uf.Size)
+		if err != nil {
+			log.Errorf("application installation failed: %v", err)
+			return err
+		}
+		if err := verifyChecksum(h, digest); err != nil {
+			log.Errorf("application update %v verification failed: %v", uf.Name, err)
+			return err
+		}
+		return nil
 	}
+}
+
+// installBundle returns a data handler passing the bundle to the device.
+func installBundle(device BundleInstaller, format string,
+	observe PayloadObserver) parser.DataHandlerFunc {
+	return func(r io.Reader, uf parser.UpdateFile) error {
+		log.Infof("installing %s bundle %v of size %v", format, uf.Name, uf.Size)
+		h, digest, err := newPayloadHash(uf.Checksum)
+		if err != nil {
+			log.Errorf("%s bundle %v can not be verified: %v", format, uf.Name, err)
+			return err
+		}
+		err = device.InstallBundle(format, teePayload(r, uf, h, observe), uf.Size)
+		if err != nil {
+			log.Errorf("%s bundle installation failed: %v", format, err)
+			return err
+		}
+		if err := verifyChecksum(h, digest); err != nil {
+			log.Errorf("%s bundle %v verification failed: %v", format, uf.Name, err)
+			return err
+		}
+		return nil
+	}
+}
+
+// Payload data is passed through the checksum and, if any, the observer while
+// it is read by the device.
+func teePayload(r io.Reader, uf parser.UpdateFile, h hash.Hash,
+	observe PayloadObserver) io.Reader {
+	if observe != nil {
+		if w := observe(uf.Name, uf.Size); w != nil {
+			return io.TeeReader(r, io.MultiWriter(h, w))
+		}
+	}
+	return io.TeeReader(r, h)
+}
+
+// Parser of root filesystem images. Like the other parsers of updates
+// installed here, it reads the payload itself: the vendored parser compares
+// SHA-256 of every payload with its checksum, which fails payloads with
+// checksums of other algorithms. Data handlers verify the payload with the
+// algorithm of its checksum instead.
+type rootfsParser struct {
+	parser.RootfsParser
+}
+
+func (rp *rootfsParser) Copy() parser.Parser {
+	return &rootfsParser{
+		parser.RootfsParser{DataFunc: rp.DataFunc},
+	}
+}
+
+func (rp *rootfsParser) ParseData(r io.Reader) error {
+	return parsePayloads(r, rp.GetUpdateFiles(), rp.DataFunc)
+}
+
+// parsePayloads unpacks payload files of the update data archive and hands
+// them to handle, which must verify them against their checksums.
+func parsePayloads(r io.Reader, files map[string]parser.UpdateFile,
+	handle parser.DataHandlerFunc) error {
+	if handle == nil {
+		return errors.New("parser: no data handler")
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return errors.Wrapf(err, "parser: can not read data archive")
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "parser: error reading archive")
+		}
+		uf, ok := files[filepath.Base(hdr.Name)]
+		if !ok {
+			return errors.Errorf("parser: can not find header info for data file %s",
+				hdr.Name)
+		}
+		uf.Date = hdr.ModTime
+		uf.Size = hdr.Size
+		if err := handle(tr, uf); err != nil {
+			return errors.Wrapf(err, "parser: data handler failed")
+		}
+	}
+}
+
+func noAppSlots(r io.Reader, uf parser.UpdateFile) error {
+	return ErrAppSlotsUnsupported
+}
+
+// Parser of application slot updates; payload layout is the same as of
+// root filesystem images, a single file.
+type appSlotParser struct {
+	parser.RootfsParser
+}
+
+func (ap *appSlotParser) GetUpdateType() *metadata.UpdateType {
+	return &metadata.UpdateType{Type: AppSlotUpdateType}
+}
+
+func (ap *appSlotParser) Copy() parser.Parser {
+	return &appSlotParser{
+		parser.RootfsParser{DataFunc: ap.DataFunc},
+	}
+}
+
+func (ap *appSlotParser) ParseData(r io.Reader) error {
+	return parsePayloads(r, ap.GetUpdateFiles(), ap.DataFunc)
+}
+
+func noBundles(r io.Reader, uf parser.UpdateFile) error {
+	return ErrBundlesUnsupported
+}
+
+// Parser of bundle updates; the bundle is the single payload file.
+type bundleParser struct {
+	parser.RootfsParser
+	updateType string
+}
+
+func (bp *bundleParser) GetUpdateType() *metadata.UpdateType {
+	return &metadata.UpdateType{Type: bp.updateType}
+}
+
+func (bp *bundleParser) Copy() parser.Parser {
+	return &bundleParser{
+		parser.RootfsParser{DataFunc: bp.DataFunc},
+		bp.updateType,
+	}
+}
+
+func (bp *bundleParser) ParseData(r io.Reader) error {
+	return parsePayloads(r, bp.GetUpdateFiles(), bp.DataFunc)
+}
+
+// compare digest of data that went through h with hex encoded checksum
+func verifyChecksum(h hash.Hash, checksum []byte) error {
+	sum := make([]byte, hex.EncodedLen(h.Size()))
+	hex.Encode(sum, h.Sum(nil))
+
+	if !bytes.EqualFold(sum, checksum) {
+		return errors.Wrapf(ErrChecksumMismatch, "expected %s, got %s",
+			checksum, sum)
+	}
+	return nil
+}
+
+// VerifyHeader checks artifact version, compatible devices and artifact name
+// found in the leading part of the artifact, so that incompatible deployments
+// can be rejected before the payload is downloaded. Returns error wrapping
+// ErrIncompatibleArtifact if artifact must not be installed; other errors
+// mean that artifact could not be checked.
+func VerifyHeader(artifact io.Reader, dt string, name string) error {
+	ar := areader.NewReader(artifact)
+	defer ar.Close()
+
+	_, err := verifyHeader(ar, dt, name)
+	return err
+}
+
+// ReadHeaderDigests verifies the artifact header like VerifyHeader and
+// returns checksums of the payloads listed in it, keyed by payload name.
+// SHA-256 checksums are plain hex encoded, others are prefixed with the name
+// of their algorithm and a colon. The whole header must be available,
+// payloads are not read.
+func ReadHeaderDigests(artifact io.Reader, dt string, name string) (map[string]string, error) {
+	ar := areader.NewReader(artifact)
+	defer ar.Close()
+
+	hinfo, err := verifyHeader(ar, dt, name)
+	if err != nil {
+		return nil, err
+	}
+	// only checksums are needed, generic parser does for any update type
+	for i, upd := range hinfo.Updates {
+		ar.PushWorker(ar.GetGeneric(upd.Type), fmt.Sprintf("%04d", i))
+	}
+	workers, err := ar.ReadHeader()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read artifact header")
+	}
+
+	digests := make(map[string]string)
+	for _, w := range workers {
+		for _, uf := range w.GetUpdateFiles() {
+			digests[uf.Name] = normalizeDigest(uf.Checksum)
+		}
+	}
+	return digests, nil
+}
+
+func verifyHeader(ar *areader.Reader, dt string, name string) (*metadata.HeaderInfo, error) {
+	info, err := ar.ReadInfo()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read artifact info")
+	}
+	if info.Format != "mender" || info.Version != 1 {
+		return nil, errors.Wrapf(ErrIncompatibleArtifact,
+			"unsupported artifact format %s version %d", info.Format, info.Version)
+	}
+
+	hinfo, err := ar.ReadHeaderInfo()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read artifact header")
+	}
+
+	// same as when installing, empty device type matches any
+	compatible := dt == ""
+	for _, dev := range hinfo.CompatibleDevices {
+		if dev == dt {
+			compatible = true
+			break
+		}
+	}
+	if !compatible {
+		return nil, errors.Wrapf(ErrIncompatibleArtifact,
+			"device type %s not in %v", dt, hinfo.CompatibleDevices)
+	}
+
+	if name != "" && hinfo.ArtifactName != name {
+		return nil, errors.Wrapf(ErrIncompatibleArtifact,
+			"artifact name %s does not match deployment artifact %s",
+			hinfo.ArtifactName, name)
+	}
+	return hinfo, nil
+}
+
+func Install(artifact io.ReadCloser, dt string, device UInstaller) error {
+	_, err := InstallObserved(artifact, dt, device, nil)
+	return err
+}
+
+// InstallObserved installs the artifact like Install, handing the payload
+// data to observe as well while it is written to the device. Returns the name
+// of the installed artifact.
+func InstallObserved(artifact io.ReadCloser, dt string, device UInstaller,
+	observe PayloadObserver) (string, error) {
+	rp := rootfsParser{parser.RootfsParser{
+		DataFunc: installRootfs(device, observe),
+	}}
 
 	ar := areader.NewReader(artifact)
 	defer ar.Close()
 
 	ar.Register(&rp)
+	// application updates must never end up being silently discarded by
+	// generic parser
+	ap := appSlotParser{parser.RootfsParser{DataFunc: noAppSlots}}
+	if apps, ok := device.(AppInstaller); ok {
+		ap.DataFunc = installApp(apps, ar.GetArtifactName, observe)
+	}
+	ar.Register(&ap)
+	// same for bundles
+	for _, format := range []string{RAUCBundleUpdateType, SWUpdateBundleUpdateType} {
+		bp := bundleParser{parser.RootfsParser{DataFunc: noBundles}, format}
+		if bundles, ok := device.(BundleInstaller); ok {
+			bp.DataFunc = installBundle(bundles, format, observe)
+		}
+		ar.Register(&bp)
+	}
 
 	_, err := ar.ReadCompatibleWithDevice(dt)
 	if err != nil {
-		return errors.Wrapf(err, "failed to read and install update")
+		return "", errors.Wrapf(err, "failed to read and install update")
 	}
 
-	return nil
+	return ar.GetArtifactName(), nil
 }
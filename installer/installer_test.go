@@ -0,0 +1,347 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package installer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender-artifact/parser"
+	atutils "github.com/mendersoftware/mender-artifact/test_utils"
+	"github.com/mendersoftware/mender-artifact/writer"
+	perrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeInstaller struct {
+	data       []byte
+	retInstall error
+}
+
+func (f *fakeInstaller) InstallUpdate(r io.ReadCloser, size int64) error {
+	if f.retInstall != nil {
+		return f.retInstall
+	}
+	data, err := ioutil.ReadAll(r)
+	f.data = data
+	return err
+}
+
+func (f *fakeInstaller) EnableUpdatedPartition() error {
+	return nil
+}
+
+func checksum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return []byte(hex.EncodeToString(sum[:]))
+}
+
+func TestInstallRootfs(t *testing.T) {
+	image := []byte("this is a rootfs image")
+
+	dev := &fakeInstaller{}
+	err := InstallRootfs(dev)(bytes.NewReader(image), parser.UpdateFile{
+		Name:     "rootfs.ext4",
+		Size:     int64(len(image)),
+		Checksum: checksum(image),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, image, dev.data)
+
+	// image written, but the digest does not match
+	dev = &fakeInstaller{}
+	err = InstallRootfs(dev)(bytes.NewReader(image), parser.UpdateFile{
+		Name:     "rootfs.ext4",
+		Size:     int64(len(image)),
+		Checksum: checksum([]byte("other image")),
+	})
+	assert.Error(t, err)
+	assert.Equal(t, ErrChecksumMismatch, perrors.Cause(err))
+
+	// no checksum in header
+	err = InstallRootfs(&fakeInstaller{})(bytes.NewReader(image), parser.UpdateFile{
+		Name: "rootfs.ext4",
+		Size: int64(len(image)),
+	})
+	assert.Equal(t, ErrChecksumMismatch, perrors.Cause(err))
+
+	// device error is passed on
+	dev = &fakeInstaller{retInstall: errors.New("write failed")}
+	err = InstallRootfs(dev)(bytes.NewReader(image), parser.UpdateFile{
+		Name:     "rootfs.ext4",
+		Size:     int64(len(image)),
+		Checksum: checksum(image),
+	})
+	assert.EqualError(t, err, "write failed")
+}
+
+func makeArtifact(t *testing.T, dir string, devices []string, name string) []byte {
+	root := path.Join(dir, "update-root")
+	err := atutils.MakeFakeUpdateDir(root, atutils.RootfsImageStructOK)
+	assert.NoError(t, err)
+
+	aw := awriter.NewWriter("mender", 1, devices, name)
+	aw.Register(&parser.RootfsParser{})
+
+	apath := path.Join(dir, "artifact.mender")
+	err = aw.Write(root, apath)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(apath)
+	assert.NoError(t, err)
+	return data
+}
+
+func TestVerifyHeader(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	art := makeArtifact(t, tdir, []string{"vexpress-qemu", "beaglebone"}, "release-1")
+
+	err := VerifyHeader(bytes.NewReader(art), "beaglebone", "release-1")
+	assert.NoError(t, err)
+	// any device type, any artifact name
+	err = VerifyHeader(bytes.NewReader(art), "", "")
+	assert.NoError(t, err)
+
+	// leading part of the artifact, without any payload, is enough
+	data := bytes.Index(art, []byte("data/0000"))
+	assert.True(t, data > 0)
+	err = VerifyHeader(bytes.NewReader(art[:data]), "beaglebone", "release-1")
+	assert.NoError(t, err)
+
+	err = VerifyHeader(bytes.NewReader(art), "raspberrypi", "release-1")
+	assert.Equal(t, ErrIncompatibleArtifact, perrors.Cause(err))
+
+	err = VerifyHeader(bytes.NewReader(art), "beaglebone", "release-2")
+	assert.Equal(t, ErrIncompatibleArtifact, perrors.Cause(err))
+
+	// not an artifact; not known to be incompatible, but can not be
+	// verified either
+	err = VerifyHeader(bytes.NewReader([]byte("garbage")), "beaglebone", "release-1")
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrIncompatibleArtifact, perrors.Cause(err))
+}
+
+func TestReadHeaderDigests(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	art := makeArtifact(t, tdir, []string{"vexpress-qemu"}, "release-1")
+
+	// digests in the header are those of the installed payload
+	var names []string
+	dev := &fakeInstaller{}
+	_, err := InstallObserved(ioutil.NopCloser(bytes.NewReader(art)), "vexpress-qemu", dev,
+		func(name string, size int64) io.Writer {
+			names = append(names, name)
+			return nil
+		})
+	assert.NoError(t, err)
+	assert.Len(t, names, 1)
+
+	data := bytes.Index(art, []byte("data/0000"))
+	digests, err := ReadHeaderDigests(bytes.NewReader(art[:data]), "vexpress-qemu", "release-1")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{names[0]: string(checksum(dev.data))}, digests)
+
+	_, err = ReadHeaderDigests(bytes.NewReader(art), "vexpress-qemu", "release-2")
+	assert.Equal(t, ErrIncompatibleArtifact, perrors.Cause(err))
+
+	// header cut short
+	_, err = ReadHeaderDigests(bytes.NewReader(art[:data/2]), "vexpress-qemu", "release-1")
+	assert.Error(t, err)
+}
+
+func TestInstallNoTempFiles(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	art := makeArtifact(t, tdir, []string{"vexpress-qemu"}, "release-1")
+
+	// payload must be streamed to the device, not spooled to disk
+	tmp := path.Join(tdir, "tmp")
+	assert.NoError(t, os.Mkdir(tmp, 0755))
+	oldTmp := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", tmp)
+	defer os.Setenv("TMPDIR", oldTmp)
+
+	dev := &fakeInstaller{}
+	err := Install(ioutil.NopCloser(bytes.NewReader(art)), "vexpress-qemu", dev)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, dev.data)
+
+	left, err := ioutil.ReadDir(tmp)
+	assert.NoError(t, err)
+	assert.Empty(t, left)
+}
+
+func TestInstallObserved(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	art := makeArtifact(t, tdir, []string{"vexpress-qemu"}, "release-1")
+
+	var observed bytes.Buffer
+	var names []string
+	dev := &fakeInstaller{}
+	name, err := InstallObserved(ioutil.NopCloser(bytes.NewReader(art)), "vexpress-qemu", dev,
+		func(name string, size int64) io.Writer {
+			names = append(names, name)
+			return &observed
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, "release-1", name)
+	assert.Len(t, names, 1)
+	assert.NotEmpty(t, dev.data)
+	assert.Equal(t, dev.data, observed.Bytes())
+
+	// observer may skip the payload
+	dev = &fakeInstaller{}
+	_, err = InstallObserved(ioutil.NopCloser(bytes.NewReader(art)), "vexpress-qemu", dev,
+		func(name string, size int64) io.Writer {
+			return nil
+		})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, dev.data)
+}
+
+type fakeAppInstaller struct {
+	fakeInstaller
+	artifactName string
+	app          []byte
+}
+
+func (f *fakeAppInstaller) InstallApp(name string, r io.Reader, size int64) error {
+	f.artifactName = name
+	data, err := ioutil.ReadAll(r)
+	f.app = data
+	return err
+}
+
+func makeAppArtifact(t *testing.T, dir string, name string, app []byte) []byte {
+	root := path.Join(dir, "app-root")
+	err := atutils.MakeFakeUpdateDir(root, []atutils.TestDirEntry{
+		{Path: "0000", IsDir: true},
+		{Path: "0000/data", IsDir: true},
+		{Path: "0000/data/app.tar", Content: app},
+		{Path: "0000/type-info", Content: []byte(`{"type": "app-slot"}`)},
+		{Path: "0000/meta-data"},
+	})
+	assert.NoError(t, err)
+
+	aw := awriter.NewWriter("mender", 1, []string{"vexpress-qemu"}, name)
+	aw.Register(&appSlotParser{})
+
+	apath := path.Join(dir, "app.mender")
+	assert.NoError(t, aw.Write(root, apath))
+
+	data, err := ioutil.ReadFile(apath)
+	assert.NoError(t, err)
+	return data
+}
+
+func TestInstallAppSlot(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	app := []byte("application tarball")
+	art := makeAppArtifact(t, tdir, "app-1", app)
+
+	dev := &fakeAppInstaller{}
+	err := Install(ioutil.NopCloser(bytes.NewReader(art)), "vexpress-qemu", dev)
+	assert.NoError(t, err)
+	assert.Equal(t, "app-1", dev.artifactName)
+	assert.Equal(t, app, dev.app)
+	// root filesystem untouched
+	assert.Nil(t, dev.data)
+
+	// never discarded silently by devices without application slots
+	rootfsOnly := &fakeInstaller{}
+	err = Install(ioutil.NopCloser(bytes.NewReader(art)), "vexpress-qemu", rootfsOnly)
+	assert.Equal(t, ErrAppSlotsUnsupported, perrors.Cause(err))
+
+	// regular rootfs artifacts still go to the root filesystem
+	dev = &fakeAppInstaller{}
+	art = makeArtifact(t, tdir, []string{"vexpress-qemu"}, "release-1")
+	err = Install(ioutil.NopCloser(bytes.NewReader(art)), "vexpress-qemu", dev)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("my first update"), dev.data)
+	assert.Nil(t, dev.app)
+}
+
+type fakeBundleInstaller struct {
+	fakeInstaller
+	format string
+	bundle []byte
+}
+
+func (f *fakeBundleInstaller) InstallBundle(format string, r io.Reader, size int64) error {
+	f.format = format
+	data, err := ioutil.ReadAll(r)
+	f.bundle = data
+	return err
+}
+
+func makeBundleArtifact(t *testing.T, dir string, format string, bundle []byte) []byte {
+	root := path.Join(dir, format+"-root")
+	err := atutils.MakeFakeUpdateDir(root, []atutils.TestDirEntry{
+		{Path: "0000", IsDir: true},
+		{Path: "0000/data", IsDir: true},
+		{Path: "0000/data/update.bundle", Content: bundle},
+		{Path: "0000/type-info", Content: []byte(`{"type": "` + format + `"}`)},
+		{Path: "0000/meta-data"},
+	})
+	assert.NoError(t, err)
+
+	aw := awriter.NewWriter("mender", 1, []string{"vexpress-qemu"}, "bundle-1")
+	aw.Register(&bundleParser{updateType: format})
+
+	apath := path.Join(dir, format+".mender")
+	assert.NoError(t, aw.Write(root, apath))
+
+	data, err := ioutil.ReadFile(apath)
+	assert.NoError(t, err)
+	return data
+}
+
+func TestInstallBundle(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	for _, format := range []string{RAUCBundleUpdateType, SWUpdateBundleUpdateType} {
+		bundle := []byte(format + " bundle")
+		art := makeBundleArtifact(t, tdir, format, bundle)
+
+		dev := &fakeBundleInstaller{}
+		err := Install(ioutil.NopCloser(bytes.NewReader(art)), "vexpress-qemu", dev)
+		assert.NoError(t, err)
+		assert.Equal(t, format, dev.format)
+		assert.Equal(t, bundle, dev.bundle)
+		assert.Nil(t, dev.data)
+
+		// never discarded silently by devices not installing bundles
+		rootfsOnly := &fakeInstaller{}
+		err = Install(ioutil.NopCloser(bytes.NewReader(art)), "vexpress-qemu", rootfsOnly)
+		assert.Equal(t, ErrBundlesUnsupported, perrors.Cause(err))
+	}
+}
@@ -79,3 +79,13 @@ func TestLimitedWriter(t *testing.T) {
 	// and we should get an error from the error writer
 	assert.EqualError(t, err, "fail")
 }
+
+func TestLimitedWriterLargeLimit(t *testing.T) {
+	// limits which do not fit in 32 bits
+	b := &bytes.Buffer{}
+	lw := LimitedWriter{b, 4 * 1024 * 1024 * 1024}
+	w, err := lw.Write([]byte("foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, w)
+	assert.Equal(t, uint64(4*1024*1024*1024-3), lw.N)
+}
@@ -73,9 +73,9 @@ func (p *ProgressWriter) reportGeneric(n int) {
 
 	// fill up with spaces and display 100%, but only if we know the size
 	if then == p.N {
-		// a line was completed, so 100% progress was already displayed
-		// at line end boundary
-		if thenDots != 0 && thenDots%dotsPerLine == 0 {
+		// a line was completed exactly at the end, so 100% progress was
+		// already displayed at line end boundary
+		if then != 0 && then%perLine == 0 {
 			return
 		}
 
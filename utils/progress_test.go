@@ -122,3 +122,27 @@ going over declared size, expected 100 N, now 101
 		b.String())
 
 }
+
+func TestProgressLargeSize(t *testing.T) {
+	const size = 5 * 1024 * 1024 * 1024
+	b := &bytes.Buffer{}
+	// pretend almost all of a 5 GiB image went through already
+	p := ProgressWriter{Out: b, N: size, c: size - 10}
+	n, err := p.Write(make([]byte, 10))
+	assert.NoError(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, " 100% 5242880 KiB\n", b.String()[b.Len()-18:])
+	assert.NotContains(t, b.String(), "going over")
+}
+
+func TestProgressLastDotAtLineEnd(t *testing.T) {
+	b := &bytes.Buffer{}
+	// last dot completes a line, but the size is a bit beyond it
+	p := &ProgressWriter{Out: b, N: 1024*1024 + 100}
+	writeZeros(p, 1024*1024+100)
+	assert.Equal(t,
+		`................................  99% 1024 KiB
+                                 100% 1024 KiB
+`,
+		b.String())
+}